@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// maxRecentSubdomains is how many subdomains the state file remembers for
+// completion.
+const maxRecentSubdomains = 10
+
+// addRecent puts name first in recent, dropping an older copy and anything
+// past maxRecentSubdomains.
+func addRecent(recent []string, name string) []string {
+	if name == "" {
+		return recent
+	}
+	recent = slices.DeleteFunc(slices.Clone(recent), func(s string) bool { return s == name })
+	recent = append([]string{name}, recent...)
+	if len(recent) > maxRecentSubdomains {
+		recent = recent[:maxRecentSubdomains]
+	}
+	return recent
+}
+
+// registerCompletions adds completions from on-disk state to the commands
+// under root: subdomains the tunnel recently registered, servers connected
+// to before, and the local service the last tunnel exposed.
+func registerCompletions(root *cobra.Command) {
+	for _, cmd := range root.Commands() {
+		if cmd.Flags().Lookup("subdomain") != nil {
+			cmd.RegisterFlagCompletionFunc("subdomain", completeSubdomains)
+		}
+		if cmd.Flags().Lookup("server") != nil {
+			cmd.RegisterFlagCompletionFunc("server", completeServers)
+		}
+		if cmd.Flags().Lookup("via") != nil {
+			cmd.RegisterFlagCompletionFunc("via", completeServers)
+		}
+		if cmd.Flags().Lookup("config") != nil {
+			cmd.MarkFlagFilename("config", "yaml", "yml")
+		}
+	}
+}
+
+// completeSubdomains completes the subdomains recently registered, most
+// recent first.
+func completeSubdomains(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	st := completionState()
+	recent := st.RecentSubdomains
+	if len(recent) == 0 && st.Subdomain != "" {
+		recent = []string{st.Subdomain} // recorded before the history was
+	}
+	return matching(recent, toComplete), cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveKeepOrder
+}
+
+// completeServers completes the server of the last tunnel and those in the
+// known hosts file.
+func completeServers(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var servers []string
+	if st := completionState(); st.Server != "" {
+		servers = append(servers, st.Server)
+	}
+	path := knownHostsPath
+	if home, err := os.UserHomeDir(); path == "" && err == nil {
+		path = filepath.Join(home, ".otun", "known_hosts")
+	}
+	if f, err := os.Open(path); path != "" && err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if addr, _, ok := strings.Cut(scanner.Text(), " "); ok && !slices.Contains(servers, addr) {
+				servers = append(servers, addr)
+			}
+		}
+	}
+	return matching(servers, toComplete), cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveKeepOrder
+}
+
+// completeLocalAddr completes the local service argument with the one the
+// last tunnel exposed.
+func completeLocalAddr(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var addrs []string
+	if st := completionState(); st.LocalAddr != "" {
+		addrs = append(addrs, st.LocalAddr)
+	}
+	return matching(addrs, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeForwardArgs completes otun forward's subdomain; its local port
+// is the user's to pick.
+func completeForwardArgs(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeSubdomains(cmd, args, toComplete)
+}
+
+// completeDir completes otun share's directory.
+func completeDir(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveFilterDirs
+}
+
+// completionState returns the state file's contents, or an empty state if
+// it can't be read: completion must never fail loudly.
+func completionState() State {
+	path, err := stateFile()
+	if err != nil {
+		return State{}
+	}
+	st, err := loadState(path)
+	if err != nil || st == nil {
+		return State{}
+	}
+	return *st
+}
+
+// matching returns the candidates starting with prefix.
+func matching(candidates []string, prefix string) []string {
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+)
+
+func TestAddRecent(t *testing.T) {
+	var full []string
+	for i := range maxRecentSubdomains {
+		full = append(full, fmt.Sprintf("app%d", i))
+	}
+
+	tests := []struct {
+		name   string
+		recent []string
+		add    string
+		want   []string
+	}{
+		{"first", nil, "myapp", []string{"myapp"}},
+		{"new goes first", []string{"blog"}, "myapp", []string{"myapp", "blog"}},
+		{"repeat moves first", []string{"blog", "myapp", "api"}, "myapp", []string{"myapp", "blog", "api"}},
+		{"empty ignored", []string{"blog"}, "", []string{"blog"}},
+		{"oldest dropped", full, "new", append([]string{"new"}, full[:maxRecentSubdomains-1]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addRecent(tt.recent, tt.add); !slices.Equal(got, tt.want) {
+				t.Errorf("addRecent(%q, %q) = %q, want %q", tt.recent, tt.add, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	knownHostsPath = ""
+
+	// Nothing recorded yet
+	if got, _ := completeSubdomains(nil, nil, ""); len(got) != 0 {
+		t.Errorf("subdomains without state = %q", got)
+	}
+
+	r := newStateRecorder("tunnel.example.com:4443", "localhost:3000")
+	for _, sub := range []string{"api", "blog", "myapp"} {
+		r.handle(client.Event{Type: client.EventRegistered, Subdomain: sub})
+	}
+	if err := os.WriteFile(filepath.Join(home, ".otun", "known_hosts"),
+		[]byte("tunnel.example.com:4443 SHA256:a\nother.example.com:4443 SHA256:b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := completeSubdomains(nil, nil, ""); !slices.Equal(got, []string{"myapp", "blog", "api"}) {
+		t.Errorf("subdomains = %q, most recent first", got)
+	}
+	if got, _ := completeSubdomains(nil, nil, "b"); !slices.Equal(got, []string{"blog"}) {
+		t.Errorf("subdomains starting with b = %q", got)
+	}
+	if got, _ := completeForwardArgs(nil, []string{"myapp"}, ""); len(got) != 0 {
+		t.Errorf("forward's port completed as %q", got)
+	}
+	if got, _ := completeServers(nil, nil, ""); !slices.Equal(got, []string{"tunnel.example.com:4443", "other.example.com:4443"}) {
+		t.Errorf("servers = %q", got)
+	}
+	if got, _ := completeLocalAddr(nil, nil, ""); !slices.Equal(got, []string{"localhost:3000"}) {
+		t.Errorf("local addresses = %q", got)
+	}
+}
@@ -3,7 +3,12 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
 )
 
 func TestLoadConfig_NoFile(t *testing.T) {
@@ -29,6 +34,18 @@ subdomain: myapp
 debug: true
 reconnect: false
 max_retries: 5
+local_dial_timeout: 2s
+local_dial_retries: 4
+control_tls: true
+via:
+  - us.example.com:4443
+  - eu.example.com:4443
+tunnels:
+  - local: 8080
+    subdomain: api
+  - local: 22
+    protocol: tcp
+    remote_port: 2222
 `
 	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
 		t.Fatalf("failed to write config: %v", err)
@@ -60,6 +77,53 @@ max_retries: 5
 	if cfg.MaxRetries == nil || *cfg.MaxRetries != 5 {
 		t.Errorf("expected max_retries 5, got %v", cfg.MaxRetries)
 	}
+	if cfg.LocalDialTimeout == nil || *cfg.LocalDialTimeout != 2*time.Second {
+		t.Errorf("expected local_dial_timeout 2s, got %v", cfg.LocalDialTimeout)
+	}
+	if cfg.LocalDialRetries == nil || *cfg.LocalDialRetries != 4 {
+		t.Errorf("expected local_dial_retries 4, got %v", cfg.LocalDialRetries)
+	}
+	if !slices.Equal(cfg.Via, []string{"us.example.com:4443", "eu.example.com:4443"}) {
+		t.Errorf("expected via [us.example.com:4443 eu.example.com:4443], got %v", cfg.Via)
+	}
+	if cfg.ControlTLS == nil || !*cfg.ControlTLS || cfg.Insecure != nil {
+		t.Errorf("expected control_tls true and insecure unset, got %v, %v", cfg.ControlTLS, cfg.Insecure)
+	}
+	wantTunnels := []TunnelConfig{{Local: "8080", Subdomain: "api"}, {Local: "22", Protocol: "tcp", RemotePort: 2222}}
+	if !slices.Equal(cfg.Tunnels, wantTunnels) {
+		t.Errorf("expected tunnels %+v, got %+v", wantTunnels, cfg.Tunnels)
+	}
+}
+
+func TestConfiguredTunnels(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfgs    []TunnelConfig
+		wantErr string
+	}{
+		{"none", nil, ""},
+		{"http and tcp", []TunnelConfig{{Local: "8080", Subdomain: "api"}, {Local: "22", Protocol: "tcp", RemotePort: 2222}}, ""},
+		{"tls", []TunnelConfig{{Local: "8443", Protocol: "tls", Subdomain: "secure"}}, ""},
+		{"no local", []TunnelConfig{{Subdomain: "api"}}, "tunnels[0]: local is required"},
+		{"tls without subdomain", []TunnelConfig{{Local: "8443", Protocol: "tls"}}, "tunnels[0]: tls tunnels need a subdomain"},
+		{"unknown protocol", []TunnelConfig{{Local: "8080"}, {Local: "53", Protocol: "udp"}}, `tunnels[1]: unknown protocol "udp"`},
+		{"remote port on http", []TunnelConfig{{Local: "8080", RemotePort: 80}}, "tunnels[0]: remote_port is for tcp tunnels"},
+		{"too many", make([]TunnelConfig, protocol.MaxTunnelsPerSession), "at most"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnels, err := configuredTunnels(tt.cfgs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("configuredTunnels() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(tunnels) != len(tt.cfgs) {
+				t.Fatalf("configuredTunnels() = %d tunnels, %v; want %d", len(tunnels), err, len(tt.cfgs))
+			}
+		})
+	}
 }
 
 func TestLoadConfig_PartialFile(t *testing.T) {
@@ -193,3 +257,39 @@ subdomain: test
 		t.Errorf("expected subdomain 'test', got '%s'", cfg.Subdomain)
 	}
 }
+
+func TestLoadConfig_SecretReferences(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	tokenPath := filepath.Join(tmpDir, "token")
+	t.Setenv("OTUN_TEST_SERVER", "secret.example.com:4443")
+
+	if err := os.WriteFile(tokenPath, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+	content := "server: ${env:OTUN_TEST_SERVER}\ntoken: ${file:" + tokenPath + "}\nsubdomain: $${literal}\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server != "secret.example.com:4443" {
+		t.Errorf("expected server from the environment, got '%s'", cfg.Server)
+	}
+	if cfg.Token != "file-token" {
+		t.Errorf("expected token from the file, got '%s'", cfg.Token)
+	}
+	if cfg.Subdomain != "${literal}" {
+		t.Errorf("expected escaped subdomain '${literal}', got '%s'", cfg.Subdomain)
+	}
+
+	if err := os.WriteFile(configPath, []byte("token: ${env:OTUN_TEST_UNSET}\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	if _, err := loadConfig(configPath); err == nil {
+		t.Error("expected error for an unset variable, got nil")
+	}
+}
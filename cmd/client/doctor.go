@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/spf13/cobra"
+)
+
+// doctorTimeout bounds each diagnostic check.
+var doctorTimeout time.Duration
+
+// certExpiryWarning is how close to expiry the server's certificate is
+// reported as a problem.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// errSkipped marks a check that doesn't apply, e.g. TLS for a server
+// addressed by IP.
+var errSkipped = errors.New("skipped")
+
+// check is one otun doctor diagnostic. run returns what it found; hint
+// suggests a fix when it fails. Checks after a failed fatal check are
+// skipped, since they can't succeed either.
+type check struct {
+	name  string
+	fatal bool
+	run   func(ctx context.Context) (string, error)
+	hint  string
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	var localAddr string
+	if len(args) > 0 {
+		localAddr = parseLocalAddr(args[0])
+	}
+
+	if path, err := stateFile(); err == nil {
+		st, err := loadState(path)
+		if err != nil {
+			fmt.Printf("! State     %v\n", err)
+		}
+		printState(os.Stdout, st)
+		if localAddr == "" && st != nil && st.Server == serverAddr {
+			localAddr = st.LocalAddr
+		}
+	}
+
+	if !runChecks(cmd.Context(), os.Stdout, doctorChecks(serverAddr, token, localAddr), doctorTimeout) {
+		os.Exit(1)
+	}
+}
+
+// printState summarizes what the last tunnel run recorded.
+func printState(w io.Writer, st *State) {
+	if st == nil {
+		fmt.Fprintln(w, "No tunnel has run yet")
+		fmt.Fprintln(w)
+		return
+	}
+	fmt.Fprintf(w, "Last tunnel: %s -> %s (server %s)\n", orNone(st.URL), st.LocalAddr, st.Server)
+	if st.LastConnected != nil {
+		fmt.Fprintf(w, "  connected   %s (%s ago)\n", st.LastConnected.Local().Format(time.RFC1123), since(*st.LastConnected))
+	} else {
+		fmt.Fprintln(w, "  connected   never")
+	}
+	if st.LastError != "" && st.LastErrorAt != nil {
+		fmt.Fprintf(w, "  last error  %s (%s ago)\n", st.LastError, since(*st.LastErrorAt))
+	}
+	fmt.Fprintln(w)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// since formats how long ago t was, to the second.
+func since(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
+
+// doctorChecks returns the checks for a tunnel from localAddr (empty = skip
+// the local service check) through server.
+func doctorChecks(server, token, localAddr string) []check {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, ""
+	}
+	isIP := net.ParseIP(host) != nil
+	authHint := "Check your API key, or run otun login again."
+	if token == "" {
+		authHint = "The server may require an API key: run otun login or pass --token."
+	}
+
+	return []check{
+		{
+			name:  "DNS",
+			fatal: true,
+			run: func(ctx context.Context) (string, error) {
+				if isIP {
+					return host + " is an IP address", nil
+				}
+				addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), nil
+			},
+			hint: "Check the server address (--server or \"server\" in the config file) and your DNS settings.",
+		},
+		{
+			name:  "Control",
+			fatal: true,
+			run: func(ctx context.Context) (string, error) {
+				var d net.Dialer
+				start := time.Now()
+				conn, err := d.DialContext(ctx, "tcp", server)
+				if err != nil {
+					return "", err
+				}
+				conn.Close()
+				return fmt.Sprintf("connected to %s in %s", server, time.Since(start).Round(time.Millisecond)), nil
+			},
+			hint: fmt.Sprintf("Is the server running? A firewall or proxy may be blocking outgoing connections to port %s.", port),
+		},
+		{
+			name: "TLS",
+			run: func(ctx context.Context) (string, error) {
+				if isIP || host == "localhost" {
+					return "", errSkipped
+				}
+				d := tls.Dialer{Config: &tls.Config{ServerName: host}}
+				conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, "443"))
+				if err != nil {
+					return "", err
+				}
+				defer conn.Close()
+				cert := conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+				left := time.Until(cert.NotAfter)
+				if left < certExpiryWarning {
+					return "", fmt.Errorf("certificate for %s expires in %s", host, left.Round(time.Hour))
+				}
+				return fmt.Sprintf("certificate for %s valid until %s", host, cert.NotAfter.Format(time.DateOnly)), nil
+			},
+			hint: "Visitors will see certificate errors. Check the server's -domain, ACME, or -tls-dir setup.",
+		},
+		{
+			name:  "Auth",
+			fatal: true,
+			run: func(ctx context.Context) (string, error) {
+				url, err := client.New(server, localAddr).WithToken(token).WithTLSConfig(controlTLSConfig()).Probe(ctx)
+				if err != nil {
+					return "", err
+				}
+				return "registered a test tunnel at " + url, nil
+			},
+			hint: authHint,
+		},
+		{
+			name: "Local",
+			run: func(ctx context.Context) (string, error) {
+				if localAddr == "" {
+					return "", errSkipped
+				}
+				conn, err := client.New(server, localAddr).DialLocal(ctx)
+				if err != nil {
+					return "", err
+				}
+				conn.Close()
+				return localAddr + " is accepting connections", nil
+			},
+			hint: fmt.Sprintf("Start your local service, or check that it listens on %s.", localAddr),
+		},
+	}
+}
+
+// runChecks runs checks in order, printing each result to w, and reports
+// whether they all passed.
+func runChecks(ctx context.Context, w io.Writer, checks []check, timeout time.Duration) bool {
+	ok := true
+	blocked := ""
+	for _, c := range checks {
+		if blocked != "" {
+			fmt.Fprintf(w, "- %-8s skipped: %s failed\n", c.name, blocked)
+			continue
+		}
+
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		detail, err := c.run(cctx)
+		cancel()
+
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Fprintf(w, "- %-8s skipped\n", c.name)
+		case err != nil:
+			ok = false
+			fmt.Fprintf(w, "✗ %-8s %v\n", c.name, err)
+			fmt.Fprintf(w, "  %-8s %s\n", "", c.hint)
+			if c.fatal {
+				blocked = c.name
+			}
+		default:
+			fmt.Fprintf(w, "✓ %-8s %s\n", c.name, detail)
+		}
+	}
+	return ok
+}
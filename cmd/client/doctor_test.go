@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunChecks(t *testing.T) {
+	pass := func(context.Context) (string, error) { return "fine", nil }
+	fail := func(context.Context) (string, error) { return "", errors.New("broken") }
+	skip := func(context.Context) (string, error) { return "", errSkipped }
+
+	tests := []struct {
+		name   string
+		checks []check
+		wantOK bool
+		want   []string
+	}{
+		{
+			name:   "all pass",
+			checks: []check{{name: "A", run: pass}, {name: "B", run: skip}},
+			wantOK: true,
+			want:   []string{"✓ A        fine", "- B        skipped"},
+		},
+		{
+			name:   "non-fatal failure continues",
+			checks: []check{{name: "A", run: fail, hint: "fix A"}, {name: "B", run: pass}},
+			want:   []string{"✗ A        broken", "fix A", "✓ B        fine"},
+		},
+		{
+			name:   "fatal failure skips the rest",
+			checks: []check{{name: "A", run: fail, fatal: true}, {name: "B", run: pass}},
+			want:   []string{"✗ A        broken", "- B        skipped: A failed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if ok := runChecks(context.Background(), &out, tt.checks, time.Second); ok != tt.wantOK {
+				t.Errorf("runChecks() = %v, want %v", ok, tt.wantOK)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output missing %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDoctorChecksLocalService(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+
+	byName := func(checks []check) map[string]check {
+		m := make(map[string]check)
+		for _, c := range checks {
+			m[c.name] = c
+		}
+		return m
+	}
+	checks := byName(doctorChecks(addr, "", addr))
+
+	for _, name := range []string{"DNS", "Control", "Local"} {
+		if _, err := checks[name].run(context.Background()); err != nil {
+			t.Errorf("%s check error = %v", name, err)
+		}
+	}
+	if _, err := checks["TLS"].run(context.Background()); !errors.Is(err, errSkipped) {
+		t.Errorf("TLS check for an IP address error = %v, want skipped", err)
+	}
+
+	ln.Close()
+	if _, err := checks["Local"].run(context.Background()); err == nil {
+		t.Error("Local check succeeded with nothing listening")
+	}
+}
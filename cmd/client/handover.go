@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// handoverToken returns the handover token of the tunnel recorded in the
+// state file, for --handover, and takes over its subdomain. It exits if no
+// tunnel is recorded or it doesn't match the server and subdomain flags.
+func handoverToken() string {
+	if !handover {
+		return ""
+	}
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "Error: --handover: "+format+"\n", args...)
+		os.Exit(1)
+	}
+
+	path, err := stateFile()
+	if err != nil {
+		fail("%v", err)
+	}
+	st, err := loadState(path)
+	if err != nil {
+		fail("%v", err)
+	}
+	switch {
+	case st == nil || st.HandoverToken == "":
+		fail("no running tunnel recorded in %s to take over", path)
+	case st.Server != serverAddr:
+		fail("the running tunnel is on %s, not %s", st.Server, serverAddr)
+	case subdomain != "" && subdomain != st.Subdomain:
+		fail("the running tunnel is %s, not %s", st.Subdomain, subdomain)
+	}
+	subdomain = st.Subdomain
+	return st.HandoverToken
+}
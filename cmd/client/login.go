@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bc183/otun/internal/deviceauth"
+	"github.com/bc183/otun/internal/keyring"
+	"github.com/bc183/otun/internal/secrets"
+	"github.com/charmbracelet/log"
+	"github.com/charmbracelet/x/term"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// plaintext stores the token in the config file instead of the keyring.
+	plaintext bool
+
+	// Identity provider for the device flow (empty issuer = ask for a key)
+	issuer   string
+	clientID string
+	scopes   []string
+)
+
+func runLogin(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	var key string
+	var err error
+	switch {
+	case len(args) > 0:
+		key = args[0]
+	case issuer != "":
+		key, err = deviceLogin(cmd.Context())
+	default:
+		key, err = readToken()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if key == "" {
+		fmt.Fprintln(os.Stderr, "Error: no API key given")
+		os.Exit(1)
+	}
+
+	if err := saveToken(serverAddr, key); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runLogout(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	removed := false
+	if err := keyring.Delete(serverAddr); err == nil {
+		removed = true
+	} else if !errors.Is(err, keyring.ErrNotFound) && !errors.Is(err, keyring.ErrUnavailable) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	path, err := configFile(configPath)
+	if err == nil {
+		had, err := setConfigToken(path, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		removed = removed || had
+	}
+
+	if removed {
+		log.Info("Logged out", "server", serverAddr)
+	} else {
+		log.Info("No stored API key", "server", serverAddr)
+	}
+}
+
+// readToken prompts for the API key, without echoing it when stdin is a
+// terminal so it stays out of the scrollback and shell history.
+func readToken() (string, error) {
+	if term.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprint(os.Stderr, "API key: ")
+		b, err := term.ReadPassword(os.Stdin.Fd())
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read API key: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read API key: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// deviceLogin has the user approve the login in a browser and returns the
+// access token the identity provider issues.
+func deviceLogin(ctx context.Context) (string, error) {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	cfg := &deviceauth.Config{Issuer: issuer, ClientID: clientID, Scopes: scopes}
+	auth, err := cfg.Start(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if auth.VerificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "Open %s to log in, and check it shows the code %s\n", auth.VerificationURIComplete, auth.UserCode)
+	} else {
+		fmt.Fprintf(os.Stderr, "Open %s and enter the code %s\n", auth.VerificationURI, auth.UserCode)
+	}
+	log.Info("Waiting for approval...")
+
+	token, err := cfg.Wait(ctx, auth)
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// saveToken stores the API key for server in the OS keyring, falling back to
+// the config file (readable only by the user) if there is no keyring or
+// --plaintext was given.
+func saveToken(server, key string) error {
+	path, err := configFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	if !plaintext {
+		err := keyring.Set(server, key)
+		if err == nil {
+			// A token left in the config file would take precedence
+			if had, err := setConfigToken(path, ""); err != nil {
+				return err
+			} else if had {
+				log.Info("Removed plaintext API key from config file", "path", path)
+			}
+			log.Info("API key saved to the system keyring", "server", server)
+			return nil
+		}
+		log.Warn("System keyring unavailable, storing API key in plaintext", "error", err)
+	}
+
+	if _, err := setConfigToken(path, key); err != nil {
+		return err
+	}
+	log.Info("API key saved", "path", path)
+	return nil
+}
+
+// storedToken returns the API key saved in the keyring for server, or "" if
+// there is none.
+func storedToken(server string) string {
+	key, err := keyring.Get(server)
+	if err != nil {
+		if !errors.Is(err, keyring.ErrNotFound) && !errors.Is(err, keyring.ErrUnavailable) {
+			log.Debug("failed to read API key from keyring", "error", err)
+		}
+		return ""
+	}
+	return key
+}
+
+// setConfigToken sets the token in the config file at path, or removes it if
+// token is empty, keeping the rest of the file (including comments) intact.
+// It reports whether the file had a token before.
+func setConfigToken(path, token string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if secrets.IsSOPS(data) {
+		return false, fmt.Errorf("config file %s is encrypted with sops; set its token with sops instead", path)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		if token == "" {
+			return false, nil
+		}
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return false, fmt.Errorf("invalid config file %s: not a mapping", path)
+	}
+
+	had := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "token" {
+			continue
+		}
+		had = true
+		if token == "" {
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		} else {
+			root.Content[i+1].SetString(token)
+		}
+		break
+	}
+	if !had {
+		if token == "" {
+			return false, nil
+		}
+		key := &yaml.Node{}
+		key.SetString("token")
+		value := &yaml.Node{}
+		value.SetString(token)
+		root.Content = append(root.Content, key, value)
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return had, err
+	}
+	if err := os.WriteFile(path, out, 0600); err != nil {
+		return had, err
+	}
+	// WriteFile keeps the mode of an existing file
+	return had, os.Chmod(path, 0600)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetConfigToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial string // "" = no file
+		token   string
+		wantHad bool
+		want    []string // substrings of the result
+		notWant []string
+	}{
+		{
+			name:  "new file",
+			token: "key1",
+			want:  []string{"token: key1"},
+		},
+		{
+			name:    "add to existing config",
+			initial: "# my settings\nserver: example.com:4443\n",
+			token:   "key1",
+			want:    []string{"# my settings", "server: example.com:4443", "token: key1"},
+		},
+		{
+			name:    "replace token",
+			initial: "server: example.com:4443\ntoken: old\n",
+			token:   "key1",
+			wantHad: true,
+			want:    []string{"token: key1"},
+			notWant: []string{"old"},
+		},
+		{
+			name:    "remove token",
+			initial: "server: example.com:4443\ntoken: old\ndebug: true\n",
+			wantHad: true,
+			want:    []string{"server: example.com:4443", "debug: true"},
+			notWant: []string{"token"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if tt.initial != "" {
+				if err := os.WriteFile(path, []byte(tt.initial), 0644); err != nil {
+					t.Fatalf("failed to write config: %v", err)
+				}
+			}
+
+			had, err := setConfigToken(path, tt.token)
+			if err != nil {
+				t.Fatalf("setConfigToken: %v", err)
+			}
+			if had != tt.wantHad {
+				t.Errorf("had = %v, want %v", had, tt.wantHad)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read config: %v", err)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(string(data), s) {
+					t.Errorf("config missing %q:\n%s", s, data)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(string(data), s) {
+					t.Errorf("config contains %q:\n%s", s, data)
+				}
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("stat: %v", err)
+			}
+			if perm := info.Mode().Perm(); perm != 0600 {
+				t.Errorf("mode = %v, want 0600", perm)
+			}
+
+			// The result must still load
+			cfg, err := loadConfig(path)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if cfg.Token != tt.token {
+				t.Errorf("loaded token = %q, want %q", cfg.Token, tt.token)
+			}
+		})
+	}
+}
+
+func TestSetConfigTokenRemoveWithoutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	had, err := setConfigToken(path, "")
+	if err != nil || had {
+		t.Fatalf("setConfigToken = %v, %v; want false, nil", had, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("removing a token created a config file")
+	}
+}
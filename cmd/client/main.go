@@ -3,31 +3,108 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	runtimedebug "runtime/debug"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/bc183/otun/internal/bytesize"
 	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/requestdb"
+	"github.com/bc183/otun/internal/secrets"
+	"github.com/bc183/otun/internal/transport"
 	"github.com/bc183/otun/internal/version"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
 
+// upstreamDetectTimeout bounds detecting the local service's protocol.
+const upstreamDetectTimeout = 3 * time.Second
+
+// liteMemoryLimit is the Go runtime's soft memory limit with --lite.
+const liteMemoryLimit = 32 << 20
+
 var (
-	configPath  string
-	serverAddr  string
-	subdomain   string
-	token       string
-	debug       bool
-	noReconnect bool
-	maxRetries  int
+	configPath   string
+	serverAddr   string
+	subdomain    string
+	token        string
+	debug        bool
+	noReconnect  bool
+	noNetMonitor bool
+	handover     bool
+	canary       bool
+	maxRetries   int
+
+	maxLocalConns     int
+	localQueueTimeout time.Duration
+	localDialTimeout  time.Duration
+	localDialRetries  int
+	hotReloadWait     time.Duration
+
+	knownHostsPath string
+	strictHostKey  bool
+	controlTLS     bool
+	insecureTLS    bool
+
+	summaryInterval time.Duration
+	inspectAddr     string
+	requestDBPath   string
+	requestDBMaxAge time.Duration
+	requestDBSize   string
+	maxResponseSize string
+	maxTransfer     string
+	upstreamProto   string
+	remotePort      int
+	labelFlags      []string
+	configLabels    map[string]string
+	denyPathFlags   []string
+	configDenyPaths []string
+	noDefaultDeny   bool
+	mockFlags       []string
+	configMocks     []client.MockResponse
+	rewriteFlags    []string
+	configRewrites  []client.Rewrite
+	configTunnels   []TunnelConfig
+	stripHeaders    []string
+	accessSecret    string
+	clientCAPath    string
+	ownerKeyPath    string
+	webhookSig      protocol.WebhookSignature
+	jwtPolicy       protocol.JWTPolicy
+	replayHeader    string
+	replayWindow    time.Duration
+	replayAction    string
+	abTest          string
+	allowCountries  []string
+	denyCountries   []string
+	allowASNs       []string
+	denyASNs        []string
+	challengeMode   string
+	challengeTTL    time.Duration
+	trapPaths       []string
+	trapBan         time.Duration
+	lite            bool
 )
 
+// resolverSpec is the DNS server to resolve the tunnel server with
+var resolverSpec string
+
+// viaServers are the otun servers that relay the connection to the tunnel
+// server, in order
+var viaServers []string
+
+// keepAlive tunes dead connection detection on the server connection
+var keepAlive = transport.DefaultKeepAlive()
+
 // Config represents the client configuration file.
 type Config struct {
 	Server     string `yaml:"server"`
@@ -36,18 +113,99 @@ type Config struct {
 	Debug      *bool  `yaml:"debug"`
 	Reconnect  *bool  `yaml:"reconnect"`
 	MaxRetries *int   `yaml:"max_retries"`
+
+	// DNS server for resolving the tunnel server, e.g. "1.1.1.1",
+	// "tls://dns.google" or "https://dns.google/dns-query"
+	Resolver string `yaml:"resolver"`
+
+	// otun servers that relay the connection to the server, in order
+	// (see --via)
+	Via []string `yaml:"via"`
+
+	// Connect to the server over TLS, verifying its certificate unless
+	// insecure is set (see --control-tls and --insecure)
+	ControlTLS *bool `yaml:"control_tls"`
+	Insecure   *bool `yaml:"insecure"`
+
+	// Connecting to the local service: the timeout of each attempt, e.g.
+	// "5s", and how often a failed one is retried
+	LocalDialTimeout *time.Duration `yaml:"local_dial_timeout"`
+	LocalDialRetries *int           `yaml:"local_dial_retries"`
+
+	// How long requests wait for a local service that is restarting
+	HotReloadWait *time.Duration `yaml:"hot_reload_wait"`
+
+	// Data a tunnel may carry before it closes, e.g. "2GB"
+	MaxTransfer string `yaml:"max_transfer"`
+
+	// Labels attached to every tunnel; --label overrides individual keys
+	Labels map[string]string `yaml:"labels"`
+
+	// Paths answered with 404 instead of being forwarded, on top of the
+	// defaults unless no_default_deny is set
+	DenyPaths     []string `yaml:"deny_paths"`
+	NoDefaultDeny *bool    `yaml:"no_default_deny"`
+
+	// Canned responses served instead of the local service's, before any
+	// --mock flags
+	Mocks []client.MockResponse `yaml:"mocks"`
+
+	// Find/replace rules for text responses, before any --rewrite flags
+	Rewrites []client.Rewrite `yaml:"rewrites"`
+
+	// Response headers the server strips, e.g. Server or X-Powered-By
+	StripHeaders []string `yaml:"strip_headers"`
+
+	// Make tunnels private to visitors with this secret or a client
+	// certificate signed by the CA bundle at this path
+	AccessSecret string `yaml:"access_secret"`
+	ClientCA     string `yaml:"client_ca"`
+
+	// Ed25519 private key the tunnel's subdomain is bound to, generated if
+	// missing
+	OwnerKey string `yaml:"owner_key"`
+
+	// A/B buckets visitors are assigned to, e.g. control=50,variant=50
+	ABTest string `yaml:"ab_test"`
+
+	// Trim memory use for small devices (see --lite)
+	Lite *bool `yaml:"lite"`
+
+	// Identity provider for otun login's device flow
+	Issuer   string `yaml:"issuer"`
+	ClientID string `yaml:"client_id"`
+
+	// Further tunnels registered over the connection of the one started
+	// on the command line
+	Tunnels []TunnelConfig `yaml:"tunnels"`
+}
+
+// TunnelConfig is a tunnel in the config file's tunnels list.
+type TunnelConfig struct {
+	Local      string `yaml:"local"` // port, host:port, unix:PATH or named pipe
+	Subdomain  string `yaml:"subdomain"`
+	Protocol   string `yaml:"protocol"`    // http (the default), tcp or tls
+	RemotePort int    `yaml:"remote_port"` // tcp only; 0 = any
+}
+
+// configFile returns path, or the default ~/.otun.yaml if path is empty.
+func configFile(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config file: %w", err)
+	}
+	return filepath.Join(home, ".otun.yaml"), nil
 }
 
 // loadConfig loads configuration from the config file.
 // Returns nil if no config file exists.
 func loadConfig(path string) (*Config, error) {
-	// If no explicit path, use default ~/.otun.yaml
-	if path == "" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return nil, nil
-		}
-		path = filepath.Join(home, ".otun.yaml")
+	path, err := configFile(path)
+	if err != nil {
+		return nil, nil
 	}
 
 	data, err := os.ReadFile(path)
@@ -58,8 +216,22 @@ func loadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if secrets.IsSOPS(data) {
+		if data, err = secrets.DecryptSOPS(path); err != nil {
+			return nil, fmt.Errorf("failed to decrypt config file %s: %w", path, err)
+		}
+	}
+
+	// Secrets may be referenced rather than written out
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if err := secrets.ExpandNode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
 	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := doc.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
 	}
 	return &cfg, nil
@@ -89,28 +261,356 @@ Examples:
   otun http 3000                      # Expose localhost:3000
   otun http 8080 -s myapp             # Expose localhost:8080 with subdomain "myapp"
   otun http localhost:8080            # Expose localhost:8080
-  otun http 192.168.1.10:3000         # Expose a service on your network`,
+  otun http 192.168.1.10:3000         # Expose a service on your network
+  otun http unix:/run/app.sock        # Expose a Unix socket
+  otun http //./pipe/app              # Expose a Windows named pipe`,
 		Args: cobra.ExactArgs(1),
 		Run:  runHTTP,
+
+		ValidArgsFunction: completeLocalAddr,
+	}
+
+	tcpCmd := &cobra.Command{
+		Use:   "tcp <port> or tcp <host:port>",
+		Short: "Expose a local TCP service",
+		Long: `Expose a local TCP service (SSH, databases, game servers) on a public port.
+
+Examples:
+  otun tcp 22                         # Expose localhost:22 on a port chosen by the server
+  otun tcp 5432 --remote-port 20432   # Ask for a specific public port`,
+		Args: cobra.ExactArgs(1),
+		Run:  runTCP,
+
+		ValidArgsFunction: completeLocalAddr,
+	}
+
+	tlsCmd := &cobra.Command{
+		Use:   "tls <port> or tls <host:port>",
+		Short: "Expose a local TLS service without decrypting it",
+		Long: `Expose a local service that terminates TLS itself. The server routes
+connections for the subdomain by SNI and passes them through undecrypted, so
+the local service needs a certificate for the tunnel's hostname. The server
+must be started with -tls-passthrough.
+
+Examples:
+  otun tls 8443 -s myapp              # https://myapp.<domain> -> localhost:8443`,
+		Args: cobra.ExactArgs(1),
+		Run:  runTLS,
+
+		ValidArgsFunction: completeLocalAddr,
+	}
+
+	forwardCmd := &cobra.Command{
+		Use:   "forward <subdomain> <port>",
+		Short: "Expose a remote tunnel's service locally",
+		Long: `Pull traffic from an existing tunnel down to a local port.
+
+Connections to the local port are carried through the tunnel server to the
+client serving the given subdomain, e.g. to access a teammate's tunneled
+service programmatically.
+
+Examples:
+  otun forward myapp 9000             # localhost:9000 -> myapp's local service
+  otun forward myapp 0.0.0.0:9000     # Listen on all interfaces`,
+		Args: cobra.ExactArgs(2),
+		Run:  runForward,
+
+		ValidArgsFunction: completeForwardArgs,
 	}
 
 	httpCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
 	httpCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	httpCmd.Flags().StringVar(&resolverSpec, "resolver", "", "DNS server to resolve the tunnel server with instead of the system's: an IP, tls://host for DNS over TLS, or https://host/dns-query for DNS over HTTPS")
+	httpCmd.Flags().StringSliceVar(&viaServers, "via", nil, "Reach the server through these otun servers, in order, e.g. us.tunnel.example.com:4443; each must relay to the next with -relay-to")
+	httpCmd.Flags().StringVar(&knownHostsPath, "known-hosts", "", "File the server's TLS key is recorded in on first connect and checked against later (default: ~/.otun/known_hosts)")
+	httpCmd.Flags().BoolVar(&strictHostKey, "strict-host-key", false, "Refuse to connect if the server's TLS key differs from the one in the known hosts file, instead of warning")
+	httpCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	httpCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one; the known hosts file still pins its key")
+	httpCmd.Flags().DurationVar(&keepAlive.Interval, "keepalive", transport.DefaultKeepAliveInterval, "TCP keepalive probe interval on the server connection; 3 missed probes drop it (0 = system default)")
+	httpCmd.Flags().DurationVar(&keepAlive.UserTimeout, "tcp-user-timeout", transport.DefaultUserTimeout, "Drop the server connection when sent data goes unacknowledged this long (0 = system default; Linux only)")
 	httpCmd.Flags().StringVarP(&subdomain, "subdomain", "s", "", "Custom subdomain (random if not specified)")
 	httpCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
 	httpCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
 	httpCmd.Flags().BoolVar(&noReconnect, "no-reconnect", false, "Disable automatic reconnection")
+	httpCmd.Flags().BoolVar(&noNetMonitor, "no-network-monitor", false, "Don't reconnect as soon as the network changes; wait for the connection to time out instead")
+	httpCmd.Flags().BoolVar(&handover, "handover", false, "Take the tunnel over from the otun process running it, which finishes its in-flight requests and exits, e.g. to upgrade or restart without dropping requests")
+	httpCmd.Flags().BoolVar(&canary, "canary", false, "Join the tunnel running on --subdomain as its canary, serving the share of its requests set with the admin API")
 	httpCmd.Flags().IntVar(&maxRetries, "max-retries", 0, "Maximum reconnection attempts (0 = unlimited)")
+	httpCmd.Flags().IntVar(&maxLocalConns, "max-local-conns", 0, "Maximum simultaneous connections to the local service (0 = unlimited)")
+	httpCmd.Flags().DurationVar(&localQueueTimeout, "local-queue-timeout", client.DefaultLocalQueueTimeout, "How long a connection over --max-local-conns waits before it is refused")
+	httpCmd.Flags().StringVar(&maxTransfer, "max-transfer", "", "Close the tunnel once it has carried this much data, both directions combined (e.g. 2GB), to protect metered connections")
+	httpCmd.Flags().DurationVar(&localDialTimeout, "local-dial-timeout", client.DefaultLocalDialTimeout, "Timeout for each attempt to connect to the local service")
+	httpCmd.Flags().IntVar(&localDialRetries, "local-dial-retries", client.DefaultLocalDialRetries, "Retries of a failed connection to the local service, e.g. while it restarts")
+	httpCmd.Flags().DurationVar(&hotReloadWait, "hot-reload-wait", 0, "Hold requests up to this long while the local service refuses connections, e.g. 10s for dev servers that restart on change")
+	httpCmd.Flags().StringArrayVarP(&labelFlags, "label", "l", nil, "Label the tunnel for filtering in the server's admin API, as key=value (repeatable)")
+	httpCmd.Flags().StringArrayVar(&denyPathFlags, "deny-path", nil, "Answer 404 for this path (\"/dir\" and below) or file name (anywhere) instead of forwarding (repeatable)")
+	httpCmd.Flags().BoolVar(&noDefaultDeny, "no-default-deny", false, "Forward /.git, /.env and .DS_Store requests instead of answering 404")
+	httpCmd.Flags().StringArrayVar(&mockFlags, "mock", nil, "Answer matching requests with a canned response instead of forwarding, as \"[METHOD ]PATH=STATUS[ BODY]\" (repeatable)")
+	httpCmd.Flags().StringArrayVar(&rewriteFlags, "rewrite", nil, "Replace text in HTML, JSON and other text responses, as FIND=REPLACE; {{url}} stands for the tunnel URL (repeatable)")
+	httpCmd.Flags().StringArrayVar(&stripHeaders, "strip-header", nil, "Have the server remove this response header, e.g. X-Powered-By or X-Debug-* (repeatable)")
+	httpCmd.Flags().StringVar(&accessSecret, "access-secret", "", "Make the tunnel private: visitors must send this secret (16+ characters) in the X-Otun-Access header")
+	httpCmd.Flags().StringVar(&ownerKeyPath, "owner-key", "", "Bind the subdomain to this Ed25519 private key (PEM, generated if missing), so only holders of the key can register it again")
+	httpCmd.Flags().StringVar(&clientCAPath, "client-ca", "", "Make the tunnel private: visitors may instead present a client certificate signed by a CA in this PEM file")
+	httpCmd.Flags().StringVar(&webhookSig.Secret, "webhook-secret", "", "Have the server reject requests whose body isn't HMAC-signed with this secret")
+	httpCmd.Flags().StringVar(&webhookSig.Header, "webhook-header", "X-Hub-Signature-256", "Header carrying the webhook signature")
+	httpCmd.Flags().StringVar(&webhookSig.Algorithm, "webhook-algorithm", "sha256", "Webhook signature HMAC hash: sha1, sha256, or sha512")
+	httpCmd.Flags().StringVar(&webhookSig.Prefix, "webhook-prefix", "sha256=", "Text before the signature in its header")
+	httpCmd.Flags().StringVar(&webhookSig.Encoding, "webhook-encoding", "hex", "Webhook signature encoding: hex or base64")
+	httpCmd.Flags().StringVar(&webhookSig.Path, "webhook-path", "", "Only verify signatures of requests under this path (default all)")
+	httpCmd.Flags().StringVar(&jwtPolicy.JWKSURL, "jwt-jwks-url", "", "Have the server answer 401 to requests without a valid bearer JWT signed with a key from this https JWKS URL")
+	httpCmd.Flags().StringVar(&jwtPolicy.Issuer, "jwt-issuer", "", "Only accept JWTs whose iss claim is this")
+	httpCmd.Flags().StringVar(&jwtPolicy.Audience, "jwt-audience", "", "Only accept JWTs whose aud claim includes this")
+	httpCmd.Flags().StringVar(&jwtPolicy.Path, "jwt-path", "", "Only require JWTs on requests under this path (default all)")
+	httpCmd.Flags().StringVar(&replayHeader, "replay-header", "", "Have the server detect redelivered webhooks by this delivery ID header, e.g. X-GitHub-Delivery")
+	httpCmd.Flags().DurationVar(&replayWindow, "replay-window", 10*time.Minute, "How long a delivered ID is remembered (max 24h)")
+	httpCmd.Flags().StringVar(&replayAction, "replay-action", protocol.ReplayDrop, "What to do with a replay: drop (answer at the edge) or flag (forward with X-Otun-Replay: 1)")
+	httpCmd.Flags().StringVar(&abTest, "ab-test", "", "Assign visitors to sticky A/B buckets at the edge, e.g. control=50,variant=50; the local service gets theirs in X-Otun-Bucket")
+	httpCmd.Flags().StringSliceVar(&allowCountries, "allow-country", nil, "Only admit visitors from these countries, as ISO codes, e.g. DE,FR (the server needs -geoip)")
+	httpCmd.Flags().StringSliceVar(&denyCountries, "deny-country", nil, "Refuse visitors from these countries, as ISO codes (the server needs -geoip)")
+	httpCmd.Flags().StringSliceVar(&allowASNs, "allow-asn", nil, "Only admit visitors from these networks, e.g. AS3320 (combines with --allow-country)")
+	httpCmd.Flags().StringSliceVar(&denyASNs, "deny-asn", nil, "Refuse visitors from these networks, e.g. AS16509")
+	httpCmd.Flags().StringVar(&challengeMode, "challenge", "", "Make visitors pass an interstitial challenge first: js, turnstile, or hcaptcha (the latter two need the server's keys)")
+	httpCmd.Flags().DurationVar(&challengeTTL, "challenge-ttl", 24*time.Hour, "How long a visitor who passed the challenge is exempt (max 720h)")
+	httpCmd.Flags().StringArrayVar(&trapPaths, "trap-path", nil, "Answer requests for this honeytoken path with 404 and raise an alert, e.g. /wp-login.php (repeatable)")
+	httpCmd.Flags().DurationVar(&trapBan, "trap-ban", 0, "Refuse visitors who request a --trap-path for this long (max 168h; 0 = no ban)")
+	httpCmd.Flags().StringVar(&maxResponseSize, "max-response-size", "", "Reject or cut off responses with bodies larger than this (e.g. 100MB)")
+	httpCmd.Flags().StringVar(&upstreamProto, "upstream-proto", "auto", "Protocol to speak to the local service: auto (detect http1 or https), http1, https, or h2c (HTTP/2 cleartext, e.g. for gRPC)")
+	httpCmd.Flags().StringVar(&inspectAddr, "inspect", "", "Serve the inspector API for captured requests on this address (e.g. 127.0.0.1:4040)")
+	httpCmd.Flags().StringVar(&requestDBPath, "request-db", "", "Persist captured requests to this SQLite file, restoring them into the inspector on restart")
+	httpCmd.Flags().DurationVar(&requestDBMaxAge, "request-db-max-age", 7*24*time.Hour, "Delete persisted requests older than this (0 = no limit)")
+	httpCmd.Flags().StringVar(&requestDBSize, "request-db-max-size", "100MB", "Delete the oldest persisted requests while the request database is larger than this (0 = no limit)")
+	httpCmd.Flags().BoolVar(&lite, "lite", false, "Trim memory use for small devices like a Raspberry Pi Zero: no inspector, at most 8 local connections unless --max-local-conns is set, and no per-request log lines")
+	httpCmd.Flags().DurationVar(&summaryInterval, "summary-interval", 0, "Print a request summary at this interval (0 = only on exit)")
+
+	tcpCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	tcpCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	tcpCmd.Flags().StringVar(&resolverSpec, "resolver", "", "DNS server to resolve the tunnel server with instead of the system's: an IP, tls://host for DNS over TLS, or https://host/dns-query for DNS over HTTPS")
+	tcpCmd.Flags().StringSliceVar(&viaServers, "via", nil, "Reach the server through these otun servers, in order, e.g. us.tunnel.example.com:4443; each must relay to the next with -relay-to")
+	tcpCmd.Flags().StringVar(&knownHostsPath, "known-hosts", "", "File the server's TLS key is recorded in on first connect and checked against later (default: ~/.otun/known_hosts)")
+	tcpCmd.Flags().BoolVar(&strictHostKey, "strict-host-key", false, "Refuse to connect if the server's TLS key differs from the one in the known hosts file, instead of warning")
+	tcpCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	tcpCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one; the known hosts file still pins its key")
+	tcpCmd.Flags().DurationVar(&keepAlive.Interval, "keepalive", transport.DefaultKeepAliveInterval, "TCP keepalive probe interval on the server connection; 3 missed probes drop it (0 = system default)")
+	tcpCmd.Flags().DurationVar(&keepAlive.UserTimeout, "tcp-user-timeout", transport.DefaultUserTimeout, "Drop the server connection when sent data goes unacknowledged this long (0 = system default; Linux only)")
+	tcpCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
+	tcpCmd.Flags().StringArrayVarP(&labelFlags, "label", "l", nil, "Label the tunnel for filtering in the server's admin API, as key=value (repeatable)")
+	tcpCmd.Flags().IntVarP(&remotePort, "remote-port", "p", 0, "Public port to request (0 = any allowed port)")
+	tcpCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	tcpCmd.Flags().BoolVar(&noReconnect, "no-reconnect", false, "Disable automatic reconnection")
+	tcpCmd.Flags().BoolVar(&noNetMonitor, "no-network-monitor", false, "Don't reconnect as soon as the network changes; wait for the connection to time out instead")
+	tcpCmd.Flags().IntVar(&maxRetries, "max-retries", 0, "Maximum reconnection attempts (0 = unlimited)")
+	tcpCmd.Flags().IntVar(&maxLocalConns, "max-local-conns", 0, "Maximum simultaneous connections to the local service (0 = unlimited)")
+	tcpCmd.Flags().DurationVar(&localQueueTimeout, "local-queue-timeout", client.DefaultLocalQueueTimeout, "How long a connection over --max-local-conns waits before it is refused")
+	tcpCmd.Flags().StringVar(&maxTransfer, "max-transfer", "", "Close the tunnel once it has carried this much data, both directions combined (e.g. 2GB), to protect metered connections")
+	tcpCmd.Flags().DurationVar(&localDialTimeout, "local-dial-timeout", client.DefaultLocalDialTimeout, "Timeout for each attempt to connect to the local service")
+	tcpCmd.Flags().IntVar(&localDialRetries, "local-dial-retries", client.DefaultLocalDialRetries, "Retries of a failed connection to the local service, e.g. while it restarts")
+	tcpCmd.Flags().BoolVar(&lite, "lite", false, "Trim memory use for small devices like a Raspberry Pi Zero: no inspector, at most 8 local connections unless --max-local-conns is set, and no per-request log lines")
+	tcpCmd.Flags().DurationVar(&hotReloadWait, "hot-reload-wait", 0, "Hold connections up to this long while the local service refuses them, e.g. 10s for dev servers that restart on change")
+
+	tlsCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	tlsCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	tlsCmd.Flags().StringVar(&resolverSpec, "resolver", "", "DNS server to resolve the tunnel server with instead of the system's: an IP, tls://host for DNS over TLS, or https://host/dns-query for DNS over HTTPS")
+	tlsCmd.Flags().StringSliceVar(&viaServers, "via", nil, "Reach the server through these otun servers, in order, e.g. us.tunnel.example.com:4443; each must relay to the next with -relay-to")
+	tlsCmd.Flags().StringVar(&knownHostsPath, "known-hosts", "", "File the server's TLS key is recorded in on first connect and checked against later (default: ~/.otun/known_hosts)")
+	tlsCmd.Flags().BoolVar(&strictHostKey, "strict-host-key", false, "Refuse to connect if the server's TLS key differs from the one in the known hosts file, instead of warning")
+	tlsCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	tlsCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one; the known hosts file still pins its key")
+	tlsCmd.Flags().DurationVar(&keepAlive.Interval, "keepalive", transport.DefaultKeepAliveInterval, "TCP keepalive probe interval on the server connection; 3 missed probes drop it (0 = system default)")
+	tlsCmd.Flags().DurationVar(&keepAlive.UserTimeout, "tcp-user-timeout", transport.DefaultUserTimeout, "Drop the server connection when sent data goes unacknowledged this long (0 = system default; Linux only)")
+	tlsCmd.Flags().StringVarP(&subdomain, "subdomain", "s", "", "Custom subdomain (random if not specified)")
+	tlsCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
+	tlsCmd.Flags().StringVar(&ownerKeyPath, "owner-key", "", "Bind the subdomain to this Ed25519 private key (PEM, generated if missing), so only holders of the key can register it again")
+	tlsCmd.Flags().StringArrayVarP(&labelFlags, "label", "l", nil, "Label the tunnel for filtering in the server's admin API, as key=value (repeatable)")
+	tlsCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	tlsCmd.Flags().BoolVar(&noReconnect, "no-reconnect", false, "Disable automatic reconnection")
+	tlsCmd.Flags().BoolVar(&noNetMonitor, "no-network-monitor", false, "Don't reconnect as soon as the network changes; wait for the connection to time out instead")
+	tlsCmd.Flags().BoolVar(&handover, "handover", false, "Take the tunnel over from the otun process running it, which finishes its in-flight connections and exits, e.g. to upgrade or restart without dropping connections")
+	tlsCmd.Flags().IntVar(&maxRetries, "max-retries", 0, "Maximum reconnection attempts (0 = unlimited)")
+	tlsCmd.Flags().IntVar(&maxLocalConns, "max-local-conns", 0, "Maximum simultaneous connections to the local service (0 = unlimited)")
+	tlsCmd.Flags().DurationVar(&localQueueTimeout, "local-queue-timeout", client.DefaultLocalQueueTimeout, "How long a connection over --max-local-conns waits before it is refused")
+	tlsCmd.Flags().StringVar(&maxTransfer, "max-transfer", "", "Close the tunnel once it has carried this much data, both directions combined (e.g. 2GB), to protect metered connections")
+	tlsCmd.Flags().DurationVar(&localDialTimeout, "local-dial-timeout", client.DefaultLocalDialTimeout, "Timeout for each attempt to connect to the local service")
+	tlsCmd.Flags().IntVar(&localDialRetries, "local-dial-retries", client.DefaultLocalDialRetries, "Retries of a failed connection to the local service, e.g. while it restarts")
+	tlsCmd.Flags().BoolVar(&lite, "lite", false, "Trim memory use for small devices like a Raspberry Pi Zero: no inspector, at most 8 local connections unless --max-local-conns is set, and no per-request log lines")
+	tlsCmd.Flags().DurationVar(&hotReloadWait, "hot-reload-wait", 0, "Hold connections up to this long while the local service refuses them, e.g. 10s for dev servers that restart on change")
+
+	forwardCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	forwardCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	forwardCmd.Flags().StringVar(&resolverSpec, "resolver", "", "DNS server to resolve the tunnel server with instead of the system's: an IP, tls://host for DNS over TLS, or https://host/dns-query for DNS over HTTPS")
+	forwardCmd.Flags().StringSliceVar(&viaServers, "via", nil, "Reach the server through these otun servers, in order, e.g. us.tunnel.example.com:4443; each must relay to the next with -relay-to")
+	forwardCmd.Flags().StringVar(&knownHostsPath, "known-hosts", "", "File the server's TLS key is recorded in on first connect and checked against later (default: ~/.otun/known_hosts)")
+	forwardCmd.Flags().BoolVar(&strictHostKey, "strict-host-key", false, "Refuse to connect if the server's TLS key differs from the one in the known hosts file, instead of warning")
+	forwardCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	forwardCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one; the known hosts file still pins its key")
+	forwardCmd.Flags().DurationVar(&keepAlive.Interval, "keepalive", transport.DefaultKeepAliveInterval, "TCP keepalive probe interval on the server connection; 3 missed probes drop it (0 = system default)")
+	forwardCmd.Flags().DurationVar(&keepAlive.UserTimeout, "tcp-user-timeout", transport.DefaultUserTimeout, "Drop the server connection when sent data goes unacknowledged this long (0 = system default; Linux only)")
+	forwardCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
+	forwardCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+
+	doctorCmd := &cobra.Command{
+		Use:   "doctor [port or host:port]",
+		Short: "Diagnose connection problems",
+		Long: `Show what the last tunnel run recorded and check each step a tunnel
+depends on: resolving the server, reaching its control port, its public TLS
+certificate, authenticating (by registering and closing a test tunnel), and
+reaching the local service.
+
+The local service defaults to the one the last tunnel exposed.
+
+Examples:
+  otun doctor                         # Check the configured server
+  otun doctor 3000                    # Also check localhost:3000
+  otun doctor -S tunnel.example.com:4443`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runDoctor,
+
+		ValidArgsFunction: completeLocalAddr,
+	}
+
+	doctorCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	doctorCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	doctorCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
+	doctorCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	doctorCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	doctorCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one")
+	doctorCmd.Flags().DurationVar(&doctorTimeout, "timeout", 10*time.Second, "Time limit for each check")
+
+	psCmd := &cobra.Command{
+		Use:   "ps",
+		Short: "List the tunnels running on this machine",
+		Long: `List the otun tunnels running on this machine under your user, with their
+URL, local service, connection state and uptime. Each tunnel answers on a
+status socket in ~/.otun/run.
+
+Examples:
+  otun ps
+  otun ps --json                      # For scripts`,
+		Args: cobra.NoArgs,
+		Run:  runPs,
+	}
+	psCmd.Flags().BoolVar(&psJSON, "json", false, "Print the tunnels as JSON")
+
+	speedTestCmd := &cobra.Command{
+		Use:   "speedtest",
+		Short: "Measure throughput and latency to the tunnel server",
+		Long: `Measure the round-trip time and upload and download throughput between
+this machine and the tunnel server. Your local service is not involved, so
+slow results point at the network path to the server rather than your app.
+
+Examples:
+  otun speedtest                      # Transfer 10MB each way
+  otun speedtest --size 100MB`,
+		Args: cobra.NoArgs,
+		Run:  runSpeedTest,
+	}
+
+	speedTestCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	speedTestCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	speedTestCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
+	speedTestCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	speedTestCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	speedTestCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one")
+	speedTestCmd.Flags().StringVar(&speedTestSize, "size", "10MB", "Data to transfer in each direction (the server may allow less)")
+
+	shareCmd := &cobra.Command{
+		Use:   "share <dir>",
+		Short: "Share a directory's files",
+		Long: `Serve a directory through a tunnel: browse its files, download
+directories as zip files, and, with --upload, let people with the upload
+token add files to it. Hidden files (names starting with a dot) aren't
+shared.
+
+Examples:
+  otun share .                        # Share the current directory read-only
+  otun share ~/exchange --upload      # Also accept uploads; prints the token
+  curl -T report.pdf -u :TOKEN https://<subdomain>.<domain>/`,
+		Args: cobra.ExactArgs(1),
+		Run:  runShare,
+
+		ValidArgsFunction: completeDir,
+	}
+
+	shareCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	shareCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	shareCmd.Flags().StringVar(&resolverSpec, "resolver", "", "DNS server to resolve the tunnel server with instead of the system's: an IP, tls://host for DNS over TLS, or https://host/dns-query for DNS over HTTPS")
+	shareCmd.Flags().StringSliceVar(&viaServers, "via", nil, "Reach the server through these otun servers, in order, e.g. us.tunnel.example.com:4443; each must relay to the next with -relay-to")
+	shareCmd.Flags().StringVar(&knownHostsPath, "known-hosts", "", "File the server's TLS key is recorded in on first connect and checked against later (default: ~/.otun/known_hosts)")
+	shareCmd.Flags().BoolVar(&strictHostKey, "strict-host-key", false, "Refuse to connect if the server's TLS key differs from the one in the known hosts file, instead of warning")
+	shareCmd.Flags().BoolVar(&controlTLS, "control-tls", false, "Connect to the server over TLS, verifying its certificate")
+	shareCmd.Flags().BoolVar(&insecureTLS, "insecure", false, "Connect to the server over TLS without verifying its certificate, e.g. a self-signed one; the known hosts file still pins its key")
+	shareCmd.Flags().StringVarP(&subdomain, "subdomain", "s", "", "Custom subdomain (random if not specified)")
+	shareCmd.Flags().StringVarP(&token, "token", "t", "", "API key for authentication")
+	shareCmd.Flags().StringArrayVarP(&labelFlags, "label", "l", nil, "Label the tunnel for filtering in the server's admin API, as key=value (repeatable)")
+	shareCmd.Flags().BoolVarP(&debug, "debug", "d", false, "Enable debug logging")
+	shareCmd.Flags().BoolVar(&noReconnect, "no-reconnect", false, "Disable automatic reconnection")
+	shareCmd.Flags().BoolVar(&noNetMonitor, "no-network-monitor", false, "Don't reconnect as soon as the network changes; wait for the connection to time out instead")
+	shareCmd.Flags().IntVar(&maxRetries, "max-retries", 0, "Maximum reconnection attempts (0 = unlimited)")
+	shareCmd.Flags().StringVar(&maxTransfer, "max-transfer", "", "Close the tunnel once it has carried this much data, both directions combined (e.g. 2GB), to protect metered connections")
+	shareCmd.Flags().BoolVar(&shareUpload, "upload", false, "Accept uploads from visitors with the upload token (HTTP basic auth password or bearer token)")
+	shareCmd.Flags().StringVar(&shareUploadToken, "upload-token", "", "Token uploads need, implies --upload (default: generated and printed)")
+	shareCmd.Flags().StringVar(&shareMaxUpload, "max-upload-size", "1GB", "Refuse uploads larger than this (0 = no limit)")
+
+	loginCmd := &cobra.Command{
+		Use:   "login [api-key]",
+		Short: "Save an API key for a server",
+		Long: `Save an API key so other commands don't need --token.
+
+The key is stored in the system keyring (macOS Keychain, Windows Credential
+Manager, or the Secret Service on Linux). Without a keyring, or with
+--plaintext, it is written to the config file instead, readable only by you.
+
+If no key is given, it is read from standard input, unless an identity
+provider is configured with --issuer (or "issuer" in the config file): then
+otun shows a code to approve in your browser and saves the token it gets.
+
+Examples:
+  otun login                          # Prompt for the key
+  otun login -S tunnel.example.com:4443
+  echo "$OTUN_KEY" | otun login       # Read the key from a pipe
+  otun login --issuer https://id.example.com  # Log in through your browser`,
+		Args: cobra.MaximumNArgs(1),
+		Run:  runLogin,
+	}
+
+	logoutCmd := &cobra.Command{
+		Use:   "logout",
+		Short: "Remove the saved API key for a server",
+		Args:  cobra.NoArgs,
+		Run:   runLogout,
+	}
+
+	loginCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	loginCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
+	loginCmd.Flags().StringVar(&issuer, "issuer", "", "Identity provider URL for browser-based login (OAuth device flow)")
+	loginCmd.Flags().StringVar(&clientID, "client-id", "otun", "OAuth client ID registered with the identity provider")
+	loginCmd.Flags().StringSliceVar(&scopes, "scope", nil, "OAuth scopes to request")
+	loginCmd.Flags().BoolVar(&plaintext, "plaintext", false, "Store the key in the config file instead of the system keyring")
+
+	logoutCmd.Flags().StringVarP(&configPath, "config", "c", "", "Path to config file (default: ~/.otun.yaml)")
+	logoutCmd.Flags().StringVarP(&serverAddr, "server", "S", "tunnel.otun.dev:4443", "Tunnel server address")
 
 	rootCmd.AddCommand(httpCmd)
+	rootCmd.AddCommand(tcpCmd)
+	rootCmd.AddCommand(tlsCmd)
+	rootCmd.AddCommand(forwardCmd)
+	rootCmd.AddCommand(shareCmd)
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(logoutCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(psCmd)
+	rootCmd.AddCommand(speedTestCmd)
 	rootCmd.AddCommand(versionCmd)
+	registerCompletions(rootCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
 }
 
-func runHTTP(cmd *cobra.Command, args []string) {
+// applyConfig loads the config file and applies its values where CLI flags
+// weren't explicitly set, configures logging, and falls back to the API key
+// saved by otun login if none was given.
+func applyConfig(cmd *cobra.Command) {
 	// Load config file
 	cfg, err := loadConfig(configPath)
 	if err != nil {
@@ -122,6 +622,18 @@ func runHTTP(cmd *cobra.Command, args []string) {
 		if cfg.Server != "" && !cmd.Flags().Changed("server") {
 			serverAddr = cfg.Server
 		}
+		if cfg.Resolver != "" && !cmd.Flags().Changed("resolver") {
+			resolverSpec = cfg.Resolver
+		}
+		if len(cfg.Via) > 0 && !cmd.Flags().Changed("via") {
+			viaServers = cfg.Via
+		}
+		if cfg.ControlTLS != nil && !cmd.Flags().Changed("control-tls") {
+			controlTLS = *cfg.ControlTLS
+		}
+		if cfg.Insecure != nil && !cmd.Flags().Changed("insecure") {
+			insecureTLS = *cfg.Insecure
+		}
 		if cfg.Token != "" && !cmd.Flags().Changed("token") {
 			token = cfg.Token
 		}
@@ -137,6 +649,50 @@ func runHTTP(cmd *cobra.Command, args []string) {
 		if cfg.MaxRetries != nil && !cmd.Flags().Changed("max-retries") {
 			maxRetries = *cfg.MaxRetries
 		}
+		if cfg.LocalDialTimeout != nil && !cmd.Flags().Changed("local-dial-timeout") {
+			localDialTimeout = *cfg.LocalDialTimeout
+		}
+		if cfg.LocalDialRetries != nil && !cmd.Flags().Changed("local-dial-retries") {
+			localDialRetries = *cfg.LocalDialRetries
+		}
+		if cfg.HotReloadWait != nil && !cmd.Flags().Changed("hot-reload-wait") {
+			hotReloadWait = *cfg.HotReloadWait
+		}
+		if cfg.MaxTransfer != "" && !cmd.Flags().Changed("max-transfer") {
+			maxTransfer = cfg.MaxTransfer
+		}
+		configLabels = cfg.Labels
+		configDenyPaths = cfg.DenyPaths
+		configMocks = cfg.Mocks
+		configRewrites = cfg.Rewrites
+		configTunnels = cfg.Tunnels
+		if cfg.AccessSecret != "" && !cmd.Flags().Changed("access-secret") {
+			accessSecret = cfg.AccessSecret
+		}
+		if cfg.ClientCA != "" && !cmd.Flags().Changed("client-ca") {
+			clientCAPath = cfg.ClientCA
+		}
+		if cfg.OwnerKey != "" && !cmd.Flags().Changed("owner-key") {
+			ownerKeyPath = cfg.OwnerKey
+		}
+		if cfg.ABTest != "" && !cmd.Flags().Changed("ab-test") {
+			abTest = cfg.ABTest
+		}
+		if len(cfg.StripHeaders) > 0 && !cmd.Flags().Changed("strip-header") {
+			stripHeaders = cfg.StripHeaders
+		}
+		if cfg.NoDefaultDeny != nil && !cmd.Flags().Changed("no-default-deny") {
+			noDefaultDeny = *cfg.NoDefaultDeny
+		}
+		if cfg.Issuer != "" && !cmd.Flags().Changed("issuer") {
+			issuer = cfg.Issuer
+		}
+		if cfg.ClientID != "" && !cmd.Flags().Changed("client-id") {
+			clientID = cfg.ClientID
+		}
+		if cfg.Lite != nil && !cmd.Flags().Changed("lite") {
+			lite = *cfg.Lite
+		}
 	}
 
 	// Setup logging
@@ -146,31 +702,601 @@ func runHTTP(cmd *cobra.Command, args []string) {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	// Parse the local address
-	localAddr := args[0]
-	if !strings.Contains(localAddr, ":") {
+	// Fall back to a key saved with otun login
+	if token == "" && cmd.Flags().Lookup("token") != nil {
+		token = storedToken(serverAddr)
+	}
+}
+
+// withConfigTunnels registers the config file's tunnels over c's
+// connection, with c's API key and the labels, deny paths and local dial
+// settings of the command line, exiting on an invalid one.
+func withConfigTunnels(c *client.Client) *client.Client {
+	tunnels, err := configuredTunnels(configTunnels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, t := range tunnels {
+		c = c.WithTunnel(t)
+	}
+	return c
+}
+
+// configuredTunnels builds the clients of the tunnels in cfgs.
+func configuredTunnels(cfgs []TunnelConfig) ([]*client.Client, error) {
+	if len(cfgs) >= protocol.MaxTunnelsPerSession {
+		return nil, fmt.Errorf("tunnels: at most %d tunnels besides the command line's", protocol.MaxTunnelsPerSession-1)
+	}
+	var tunnels []*client.Client
+	for i, tc := range cfgs {
+		if tc.Local == "" {
+			return nil, fmt.Errorf("tunnels[%d]: local is required", i)
+		}
+		t := client.New(serverAddr, parseLocalAddr(tc.Local)).
+			WithLocalDialTimeout(localDialTimeout).
+			WithLocalDialRetries(localDialRetries, client.DefaultLocalDialRetryDelay).
+			WithHotReloadWait(hotReloadWait).
+			WithLabels(tunnelLabels())
+		switch tc.Protocol {
+		case "", "http":
+			t = t.WithSubdomain(tc.Subdomain).WithDenyPaths(denyPaths())
+		case "tcp":
+			t = t.WithTCP(tc.RemotePort)
+		case "tls":
+			if tc.Subdomain == "" {
+				return nil, fmt.Errorf("tunnels[%d]: tls tunnels need a subdomain", i)
+			}
+			t = t.WithTLSPassthrough().WithSubdomain(tc.Subdomain)
+		default:
+			return nil, fmt.Errorf("tunnels[%d]: unknown protocol %q (want http, tcp or tls)", i, tc.Protocol)
+		}
+		if tc.RemotePort != 0 && tc.Protocol != "tcp" {
+			return nil, fmt.Errorf("tunnels[%d]: remote_port is for tcp tunnels", i)
+		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
+
+// tunnelLabels merges the config file's labels with --label flags, which
+// take precedence, exiting on an invalid label.
+func tunnelLabels() map[string]string {
+	labels := make(map[string]string, len(configLabels)+len(labelFlags))
+	for k, v := range configLabels {
+		labels[k] = v
+	}
+	for _, l := range labelFlags {
+		k, v, err := protocol.ParseLabel(l)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --label: %v\n", err)
+			os.Exit(1)
+		}
+		labels[k] = v
+	}
+	if err := protocol.ValidateLabels(labels); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: labels: %v\n", err)
+		os.Exit(1)
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// readClientCA reads the --client-ca bundle, if any, exiting if it isn't
+// usable.
+func readClientCA() string {
+	if clientCAPath == "" {
+		return ""
+	}
+	data, err := os.ReadFile(clientCAPath)
+	if err == nil {
+		_, err = protocol.ParseClientCA(string(data))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --client-ca: %v\n", err)
+		os.Exit(1)
+	}
+	return string(data)
+}
+
+// geoPolicy builds the policy set with the --allow-* and --deny-* country
+// and ASN flags, or returns nil if none are set, exiting on an invalid one.
+func geoPolicy() *protocol.GeoPolicy {
+	if len(allowCountries)+len(denyCountries)+len(allowASNs)+len(denyASNs) == 0 {
+		return nil
+	}
+	var p protocol.GeoPolicy
+	var err error
+	exit := func(flag string) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --%s: %v\n", flag, err)
+			os.Exit(1)
+		}
+	}
+	p.AllowCountries, err = protocol.ParseCountries(allowCountries)
+	exit("allow-country")
+	p.DenyCountries, err = protocol.ParseCountries(denyCountries)
+	exit("deny-country")
+	p.AllowASNs, err = protocol.ParseASNs(allowASNs)
+	exit("allow-asn")
+	p.DenyASNs, err = protocol.ParseASNs(denyASNs)
+	exit("deny-asn")
+	return &p
+}
+
+// maxTransferBytes parses --max-transfer, exiting if it is invalid.
+func maxTransferBytes() int64 {
+	if maxTransfer == "" {
+		return 0
+	}
+	n, err := bytesize.Parse(maxTransfer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --max-transfer: %v\n", err)
+		os.Exit(1)
+	}
+	return n
+}
+
+// denyPaths combines the default deny rules (unless disabled) with those
+// from the config file and --deny-path flags.
+func denyPaths() []string {
+	var rules []string
+	if !noDefaultDeny {
+		rules = append(rules, client.DefaultDenyPaths...)
+	}
+	rules = append(rules, configDenyPaths...)
+	return append(rules, denyPathFlags...)
+}
+
+// printError prints err and, if there is one, a hint on fixing it.
+func printError(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if hint := client.AsError(err).Hint; hint != "" {
+		fmt.Fprintf(os.Stderr, "Hint: %s\n", hint)
+	}
+}
+
+// mockResponses combines the mocks from the config file and --mock flags,
+// exiting on an invalid one.
+func mockResponses() []client.MockResponse {
+	mocks := make([]client.MockResponse, 0, len(configMocks)+len(mockFlags))
+	for _, m := range configMocks {
+		if err := m.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: mocks: %v\n", err)
+			os.Exit(1)
+		}
+		mocks = append(mocks, m)
+	}
+	for _, spec := range mockFlags {
+		m, err := client.ParseMockResponse(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --mock: %v\n", err)
+			os.Exit(1)
+		}
+		mocks = append(mocks, m)
+	}
+	return mocks
+}
+
+// serverResolver returns the resolver set with --resolver, or nil to use
+// the system's, exiting on an invalid one.
+func serverResolver() client.Resolver {
+	if resolverSpec == "" {
+		return nil
+	}
+	r, err := client.ParseResolver(resolverSpec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --resolver: %v\n", err)
+		os.Exit(1)
+	}
+	return r
+}
+
+// controlTLSConfig returns the TLS config of the server connection for
+// --control-tls or --insecure, or nil to connect over plain TCP.
+func controlTLSConfig() *tls.Config {
+	if !controlTLS && !insecureTLS {
+		return nil
+	}
+	return &tls.Config{InsecureSkipVerify: insecureTLS, MinVersion: tls.VersionTLS12}
+}
+
+// knownHostsFile returns --known-hosts, or the default ~/.otun/known_hosts.
+func knownHostsFile() string {
+	if knownHostsPath != "" {
+		return knownHostsPath
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to locate known hosts file: %v\n", err)
+		os.Exit(1)
+	}
+	return filepath.Join(home, ".otun", "known_hosts")
+}
+
+// rewrites combines the rewrites from the config file and --rewrite flags,
+// exiting on an invalid one.
+func rewrites() []client.Rewrite {
+	rules := append([]client.Rewrite(nil), configRewrites...)
+	for _, spec := range rewriteFlags {
+		r, err := client.ParseRewrite(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --rewrite: %v\n", err)
+			os.Exit(1)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// detectUpstream finds the protocol the local service speaks, warning if
+// it isn't HTTP. It falls back to plain HTTP.
+func detectUpstream(ctx context.Context, c *client.Client, localAddr string) client.UpstreamProto {
+	ctx, cancel := context.WithTimeout(ctx, upstreamDetectTimeout)
+	defer cancel()
+
+	proto, err := c.DetectUpstreamProto(ctx)
+	switch {
+	case errors.Is(err, client.ErrNotHTTP):
+		log.Warn("Local service doesn't speak HTTP; use otun tcp to expose it as a raw TCP service", "local", localAddr, "error", err)
+	case err != nil:
+		log.Debug("could not detect the local service's protocol", "local", localAddr, "error", err)
+	case proto == client.UpstreamHTTPS:
+		log.Info("Local service speaks HTTPS; forwarding over TLS (use otun tls to pass TLS through instead)", "local", localAddr)
+		return proto
+	}
+	return client.UpstreamHTTP1
+}
+
+// withLite puts c in lite mode and, unless GOMEMLIMIT sets one, gives the
+// process a soft memory limit, so the garbage collector runs before the heap
+// grows past what a small device can spare.
+func withLite(c *client.Client) *client.Client {
+	if os.Getenv("GOMEMLIMIT") == "" {
+		runtimedebug.SetMemoryLimit(liteMemoryLimit)
+	}
+	return c.WithLite()
+}
+
+// parseLocalAddr turns a port, host:port, unix:PATH or named pipe argument
+// into a local address.
+func parseLocalAddr(arg string) string {
+	if !strings.Contains(arg, ":") && !client.IsNamedPipe(arg) {
 		// Just a port number, assume localhost
-		localAddr = "localhost:" + localAddr
+		return "localhost:" + arg
 	}
+	return arg
+}
+
+func runHTTP(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	localAddr := parseLocalAddr(args[0])
 
 	// Create context that cancels on SIGINT/SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	if canary && (subdomain == "" || handover) {
+		fmt.Fprintln(os.Stderr, "Error: --canary needs --subdomain and can't be combined with --handover")
+		os.Exit(1)
+	}
+	handoverFrom := handoverToken()
+
 	// Create and configure client
 	c := client.New(serverAddr, localAddr).
 		WithReconnect(!noReconnect).
-		WithMaxRetries(maxRetries)
+		WithNetworkMonitor(!noNetMonitor).
+		WithMaxRetries(maxRetries).
+		WithMaxLocalConns(maxLocalConns, localQueueTimeout).
+		WithLocalDialTimeout(localDialTimeout).
+		WithLocalDialRetries(localDialRetries, client.DefaultLocalDialRetryDelay).
+		WithHotReloadWait(hotReloadWait).
+		WithResolver(serverResolver()).
+		WithVia(viaServers).
+		WithKeepAlive(keepAlive).
+		WithKnownHosts(knownHostsFile(), strictHostKey).
+		WithTLSConfig(controlTLSConfig()).
+		WithHandover(handoverFrom)
 
 	if subdomain != "" {
 		c = c.WithSubdomain(subdomain)
 	}
+	if canary {
+		c = c.WithCanary()
+	}
+	c = c.WithMaxTransfer(maxTransferBytes())
+	if maxResponseSize != "" {
+		n, err := bytesize.Parse(maxResponseSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --max-response-size: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithMaxResponseSize(n)
+	}
 	if token != "" {
 		c = c.WithToken(token)
 	}
+	c = c.WithLabels(tunnelLabels()).WithDenyPaths(denyPaths()).WithMockResponses(mockResponses()).WithRewrites(rewrites())
+	if err := protocol.ValidateStripHeaders(stripHeaders); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --strip-header: %v\n", err)
+		os.Exit(1)
+	}
+	c = c.WithStripHeaders(stripHeaders)
+	if accessSecret != "" || clientCAPath != "" {
+		c = c.WithAccess(accessSecret, readClientCA())
+	}
+	if key := readOwnerKey(); key != nil {
+		c = c.WithOwnerKey(key)
+	}
+	if webhookSig.Secret != "" {
+		if err := webhookSig.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --webhook-secret: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithWebhookSignature(webhookSig)
+	}
+	if jwtPolicy.JWKSURL != "" {
+		if err := jwtPolicy.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --jwt-jwks-url: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithJWT(jwtPolicy)
+	}
+	if replayHeader != "" {
+		replay := protocol.ReplayProtection{Header: replayHeader, Window: int(replayWindow / time.Second), Action: replayAction}
+		if err := replay.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --replay-header: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithReplayProtection(replay)
+	}
+	if abTest != "" {
+		t, err := protocol.ParseABTest(abTest)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --ab-test: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithABTest(*t)
+	}
+	if geo := geoPolicy(); geo != nil {
+		c = c.WithGeoPolicy(*geo)
+	}
+	if challengeMode != "" {
+		challenge := protocol.Challenge{Mode: challengeMode, TTL: int(challengeTTL / time.Second)}
+		if err := challenge.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --challenge: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithChallenge(challenge)
+	}
+	if len(trapPaths) > 0 {
+		traps := protocol.Honeytokens{Paths: trapPaths, Ban: int(trapBan / time.Second)}
+		if err := traps.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --trap-path: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithHoneytokens(traps)
+	}
+	proto, err := client.ParseUpstreamProto(upstreamProto)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --upstream-proto: %v\n", err)
+		os.Exit(1)
+	}
+	if proto == client.UpstreamAuto {
+		proto = detectUpstream(ctx, c, localAddr)
+	}
+	c = c.WithUpstreamProto(proto)
+	// The state file describes the tunnel, not its canary
+	var state *stateRecorder
+	if !canary {
+		state = newStateRecorder(serverAddr, localAddr)
+	}
+	if state != nil {
+		c = c.WithEventHandler(state.handle)
+	}
+
+	if lite {
+		if inspectAddr != "" || requestDBPath != "" {
+			fmt.Fprintln(os.Stderr, "Error: --lite can't be combined with --inspect or --request-db")
+			os.Exit(1)
+		}
+		c = withLite(c)
+	}
+
+	if inspectAddr != "" {
+		c = c.WithInspector(client.DefaultInspectorCapacity)
+		go func() {
+			if err := c.ServeInspector(ctx, inspectAddr); err != nil {
+				log.Warn("inspector API unavailable", "error", err)
+			}
+		}()
+	}
+	var history *requestdb.DB
+	if requestDBPath != "" {
+		maxBytes, err := bytesize.Parse(requestDBSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --request-db-max-size: %v\n", err)
+			os.Exit(1)
+		}
+		history, err = requestdb.Open(requestDBPath, requestdb.Retention{MaxAge: requestDBMaxAge, MaxBytes: maxBytes})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --request-db: %v\n", err)
+			os.Exit(1)
+		}
+		c = c.WithRequestDB(history)
+	}
+
+	if summaryInterval > 0 {
+		go printSummaries(ctx, c, summaryInterval)
+	}
+
+	c = withConfigTunnels(c)
 
 	// Run with reconnection support
+	stopStatus := serveStatusSocket(c, "http", localAddr)
 	err = c.RunWithReconnect(ctx)
+	stopStatus()
+	printSummary(c)
+	if history != nil {
+		history.Close() // flush before exiting
+	}
+
+	if errors.Is(err, client.ErrShutdown) {
+		log.Info("Shutting down...")
+		return
+	}
+	if errors.Is(err, client.ErrHandedOver) {
+		log.Info("Tunnel handed over; exiting")
+		return
+	}
+
+	if err != nil {
+		state.recordError(err)
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+func runTCP(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	localAddr := parseLocalAddr(args[0])
+
+	// Create context that cancels on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c := client.New(serverAddr, localAddr).
+		WithTCP(remotePort).
+		WithReconnect(!noReconnect).
+		WithNetworkMonitor(!noNetMonitor).
+		WithMaxRetries(maxRetries).
+		WithMaxLocalConns(maxLocalConns, localQueueTimeout).
+		WithLocalDialTimeout(localDialTimeout).
+		WithLocalDialRetries(localDialRetries, client.DefaultLocalDialRetryDelay).
+		WithHotReloadWait(hotReloadWait).
+		WithResolver(serverResolver()).
+		WithVia(viaServers).
+		WithKeepAlive(keepAlive).
+		WithKnownHosts(knownHostsFile(), strictHostKey).
+		WithTLSConfig(controlTLSConfig()).
+		WithLabels(tunnelLabels()).
+		WithMaxTransfer(maxTransferBytes())
+	if token != "" {
+		c = c.WithToken(token)
+	}
+	if lite {
+		c = withLite(c)
+	}
+	state := newStateRecorder(serverAddr, localAddr)
+	if state != nil {
+		c = c.WithEventHandler(state.handle)
+	}
+
+	c = withConfigTunnels(c)
+
+	stopStatus := serveStatusSocket(c, "tcp", localAddr)
+	err := c.RunWithReconnect(ctx)
+	stopStatus()
+	printSummary(c)
+
+	if errors.Is(err, client.ErrShutdown) {
+		log.Info("Shutting down...")
+		return
+	}
+
+	if err != nil {
+		state.recordError(err)
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+func runTLS(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	localAddr := parseLocalAddr(args[0])
+
+	// Create context that cancels on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	handoverFrom := handoverToken()
+
+	c := client.New(serverAddr, localAddr).
+		WithTLSPassthrough().
+		WithSubdomain(subdomain).
+		WithReconnect(!noReconnect).
+		WithNetworkMonitor(!noNetMonitor).
+		WithMaxRetries(maxRetries).
+		WithMaxLocalConns(maxLocalConns, localQueueTimeout).
+		WithLocalDialTimeout(localDialTimeout).
+		WithLocalDialRetries(localDialRetries, client.DefaultLocalDialRetryDelay).
+		WithHotReloadWait(hotReloadWait).
+		WithResolver(serverResolver()).
+		WithVia(viaServers).
+		WithKeepAlive(keepAlive).
+		WithKnownHosts(knownHostsFile(), strictHostKey).
+		WithTLSConfig(controlTLSConfig()).
+		WithLabels(tunnelLabels()).
+		WithMaxTransfer(maxTransferBytes()).
+		WithHandover(handoverFrom)
+	if token != "" {
+		c = c.WithToken(token)
+	}
+	if key := readOwnerKey(); key != nil {
+		c = c.WithOwnerKey(key)
+	}
+	if lite {
+		c = withLite(c)
+	}
+	state := newStateRecorder(serverAddr, localAddr)
+	if state != nil {
+		c = c.WithEventHandler(state.handle)
+	}
+
+	c = withConfigTunnels(c)
+
+	stopStatus := serveStatusSocket(c, "tls", localAddr)
+	err := c.RunWithReconnect(ctx)
+	stopStatus()
+	printSummary(c)
+
+	if errors.Is(err, client.ErrShutdown) {
+		log.Info("Shutting down...")
+		return
+	}
+	if errors.Is(err, client.ErrHandedOver) {
+		log.Info("Tunnel handed over; exiting")
+		return
+	}
+
+	if err != nil {
+		state.recordError(err)
+		printError(err)
+		os.Exit(1)
+	}
+}
+
+func runForward(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	target := args[0]
+	listenAddr := parseLocalAddr(args[1])
+
+	// Create context that cancels on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c := client.New(serverAddr, listenAddr).WithResolver(serverResolver()).WithVia(viaServers).WithKeepAlive(keepAlive).WithKnownHosts(knownHostsFile(), strictHostKey).WithTLSConfig(controlTLSConfig())
+	if token != "" {
+		c = c.WithToken(token)
+	}
+
+	err := c.Forward(ctx, target)
 
 	if errors.Is(err, client.ErrShutdown) {
 		log.Info("Shutting down...")
@@ -182,3 +1308,49 @@ func runHTTP(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 }
+
+// printSummaries logs a request summary every interval until ctx is done.
+func printSummaries(ctx context.Context, c *client.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			printSummary(c)
+		}
+	}
+}
+
+// printSummary logs what has hit the tunnel so far, if anything.
+func printSummary(c *client.Client) {
+	st := c.Status()
+	if st.BytesSent+st.BytesReceived > 0 {
+		kv := []any{"sent", bytesize.Format(st.BytesSent), "received", bytesize.Format(st.BytesReceived)}
+		if st.MaxTransfer > 0 {
+			kv = append(kv, "max", bytesize.Format(st.MaxTransfer))
+		}
+		log.Info("Transfer", kv...)
+	}
+	if l := st.Local; l.Waits+l.DialFailures > 0 {
+		kv := []any{"in_use", l.InUse, "dial_failures", l.DialFailures}
+		if l.Limit > 0 {
+			kv = append(kv, "limit", l.Limit, "waits", l.Waits, "timeouts", l.Timeouts, "max_wait", l.MaxWait.Round(time.Millisecond))
+		}
+		log.Info("Local connections", kv...)
+	}
+	s := c.Stats()
+	if s.Requests == 0 {
+		return
+	}
+	log.Info("Request summary",
+		"requests", s.Requests,
+		"status", s.StatusBreakdown(),
+		"p50", s.P50.Round(time.Millisecond),
+		"p95", s.P95.Round(time.Millisecond),
+		"up", bytesize.Format(s.BytesUp),
+		"down", bytesize.Format(s.BytesDown),
+	)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/charmbracelet/log"
+)
+
+// loadOwnerKey reads the Ed25519 private key at path, a PKCS #8 PEM file
+// such as openssl genpkey -algorithm ed25519 writes. If the file doesn't
+// exist, a new key is generated and saved there; created reports whether
+// that happened.
+func loadOwnerKey(path string) (key ed25519.PrivateKey, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = generateOwnerKey(path)
+		return key, err == nil, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, false, fmt.Errorf("%s is not a PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid private key %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, false, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return key, false, nil
+}
+
+// generateOwnerKey creates a key and saves it to path, readable only by the
+// user. It never overwrites an existing file.
+func generateOwnerKey(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// readOwnerKey loads the --owner-key file, if any, exiting if it can't.
+func readOwnerKey() ed25519.PrivateKey {
+	if ownerKeyPath == "" {
+		return nil
+	}
+	key, created, err := loadOwnerKey(ownerKeyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --owner-key: %v\n", err)
+		os.Exit(1)
+	}
+	if created {
+		log.Info("Generated owner key; keep it safe, it is the only way to register this subdomain again", "path", ownerKeyPath)
+	}
+	return key
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOwnerKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "demo.key")
+
+	key, created, err := loadOwnerKey(path)
+	if err != nil || !created || key == nil {
+		t.Fatalf("loadOwnerKey() on a missing file = %v, %v, %v; want a new key", key, created, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+
+	again, created, err := loadOwnerKey(path)
+	if err != nil || created || !again.Equal(key) {
+		t.Errorf("loadOwnerKey() = %v, %v; want the saved key", created, err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.key")
+	os.WriteFile(bad, []byte("not a key"), 0600)
+	if _, _, err := loadOwnerKey(bad); err == nil {
+		t.Error("loadOwnerKey() accepted a file that isn't a PEM key")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// psTimeout bounds querying each running tunnel for otun ps.
+const psTimeout = 2 * time.Second
+
+// psJSON prints otun ps as JSON
+var psJSON bool
+
+// tunnelProcess is what a running tunnel reports on its status socket.
+type tunnelProcess struct {
+	PID         int        `json:"pid"`
+	Kind        string     `json:"kind"` // http, tcp, tls or share
+	Server      string     `json:"server"`
+	Local       string     `json:"local"`
+	URL         string     `json:"url,omitempty"`
+	State       string     `json:"state"`
+	StartedAt   time.Time  `json:"started_at"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// runDir returns the directory of the tunnels' status sockets, ~/.otun/run.
+func runDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate run directory: %w", err)
+	}
+	return filepath.Join(home, ".otun", "run"), nil
+}
+
+// serveStatusSocket reports c's status for otun ps on a Unix socket named
+// after the process ID, until the returned function is called. A tunnel
+// that can't create the socket still runs; it just isn't listed.
+func serveStatusSocket(c *client.Client, kind, localAddr string) (stop func()) {
+	dir, err := runDir()
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		log.Debug("not serving tunnel status", "error", err)
+		return func() {}
+	}
+	path := filepath.Join(dir, strconv.Itoa(os.Getpid())+".sock")
+	os.Remove(path) // left behind by an earlier process with this ID
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Debug("not serving tunnel status", "error", err)
+		return func() {}
+	}
+
+	started := time.Now().UTC()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		st := c.Status()
+		p := tunnelProcess{
+			PID:       os.Getpid(),
+			Kind:      kind,
+			Server:    serverAddr,
+			Local:     localAddr,
+			URL:       st.URL,
+			State:     st.State.String(),
+			StartedAt: started,
+		}
+		if !st.ConnectedAt.IsZero() {
+			connected := st.ConnectedAt.UTC()
+			p.ConnectedAt = &connected
+		}
+		if st.LastError != nil {
+			p.LastError = st.LastError.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: psTimeout}
+	go srv.Serve(ln)
+	return func() {
+		srv.Close()
+		os.Remove(path)
+	}
+}
+
+func runPs(cmd *cobra.Command, args []string) {
+	dir, err := runDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	procs := listTunnels(cmd.Context(), dir)
+	if psJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(procs)
+		return
+	}
+	printTunnels(os.Stdout, procs)
+}
+
+// listTunnels queries the status sockets in dir, oldest tunnel first.
+// Sockets of processes that exited without removing theirs are deleted.
+func listTunnels(ctx context.Context, dir string) []tunnelProcess {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.sock"))
+	procs := []tunnelProcess{}
+	for _, path := range paths {
+		p, err := queryTunnel(ctx, path)
+		if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, fs.ErrNotExist) {
+			os.Remove(path)
+			continue
+		}
+		if err != nil {
+			log.Warn("failed to query tunnel", "socket", path, "error", err)
+			continue
+		}
+		procs = append(procs, p)
+	}
+	slices.SortFunc(procs, func(a, b tunnelProcess) int { return a.StartedAt.Compare(b.StartedAt) })
+	return procs
+}
+
+// queryTunnel asks the tunnel listening on the socket at path for its status.
+func queryTunnel(ctx context.Context, path string) (tunnelProcess, error) {
+	hc := &http.Client{
+		Timeout: psTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	defer hc.CloseIdleConnections()
+
+	var p tunnelProcess
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://otun/status", nil)
+	if err != nil {
+		return p, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return p, fmt.Errorf("invalid status: %w", err)
+	}
+	return p, nil
+}
+
+// printTunnels writes procs as a table.
+func printTunnels(w io.Writer, procs []tunnelProcess) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tTYPE\tURL\tLOCAL\tSTATE\tUPTIME")
+	for _, p := range procs {
+		state := p.State
+		if p.LastError != "" && p.State != client.StateConnected.String() {
+			state += " (" + p.LastError + ")"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", p.PID, p.Kind, orNone(p.URL), p.Local, state, since(p.StartedAt))
+	}
+	tw.Flush()
+}
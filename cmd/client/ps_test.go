@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/client"
+)
+
+func TestListTunnels(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	serverAddr = "tunnel.example.com:4443"
+
+	stop := serveStatusSocket(client.New(serverAddr, "localhost:3000"), "http", "localhost:3000")
+	defer stop()
+
+	// A socket left behind by a killed tunnel
+	dir, _ := runDir()
+	stale := filepath.Join(dir, "1.sock")
+	if err := os.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	procs := listTunnels(context.Background(), dir)
+	if len(procs) != 1 {
+		t.Fatalf("listTunnels() = %+v, want this process's tunnel", procs)
+	}
+	p := procs[0]
+	if p.PID != os.Getpid() || p.Kind != "http" || p.Local != "localhost:3000" || p.Server != serverAddr || p.State != "idle" {
+		t.Errorf("tunnel = %+v", p)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale socket wasn't removed")
+	}
+
+	stop()
+	if procs := listTunnels(context.Background(), dir); len(procs) != 0 {
+		t.Errorf("listTunnels() after stop = %+v", procs)
+	}
+}
+
+func TestPrintTunnels(t *testing.T) {
+	started := time.Now().Add(-90 * time.Second)
+	var sb strings.Builder
+	printTunnels(&sb, []tunnelProcess{
+		{PID: 10, Kind: "http", URL: "https://myapp.example.com", Local: "localhost:3000", State: "connected", StartedAt: started},
+		{PID: 11, Kind: "tcp", Local: "localhost:22", State: "reconnecting", LastError: "connection refused", StartedAt: started},
+	})
+
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "PID") {
+		t.Fatalf("output:\n%s", sb.String())
+	}
+	for _, want := range []string{"https://myapp.example.com", "connected", "1m30s"} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("row %q missing %q", lines[1], want)
+		}
+	}
+	for _, want := range []string{"(none)", "reconnecting (connection refused)"} {
+		if !strings.Contains(lines[2], want) {
+			t.Errorf("row %q missing %q", lines[2], want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/fileshare"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// shareUpload enables uploads to otun share
+	shareUpload bool
+
+	// shareUploadToken authenticates uploads (empty = generated)
+	shareUploadToken string
+
+	// shareMaxUpload limits each upload, e.g. "1GB"
+	shareMaxUpload string
+)
+
+func runShare(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	opts := fileshare.Options{}
+	if shareUpload || shareUploadToken != "" {
+		opts.UploadToken = shareUploadToken
+		if opts.UploadToken == "" {
+			opts.UploadToken = rand.Text()
+		}
+		n, err := bytesize.Parse(shareMaxUpload)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --max-upload-size: %v\n", err)
+			os.Exit(1)
+		}
+		opts.MaxUploadSize = n
+	}
+	share, err := fileshare.Open(args[0], opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer share.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// The tunnel forwards to the share like to any local service
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: share, ReadHeaderTimeout: 30 * time.Second}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	log.Info("Sharing directory", "dir", args[0], "uploads", share.Uploads())
+	if share.Uploads() {
+		log.Info("Upload with the token as the password, or: curl -T FILE -u :TOKEN <url>/", "token", opts.UploadToken)
+	}
+
+	c := client.New(serverAddr, ln.Addr().String()).
+		WithReconnect(!noReconnect).
+		WithNetworkMonitor(!noNetMonitor).
+		WithMaxRetries(maxRetries).
+		WithResolver(serverResolver()).
+		WithVia(viaServers).
+		WithKeepAlive(keepAlive).
+		WithKnownHosts(knownHostsFile(), strictHostKey).
+		WithTLSConfig(controlTLSConfig()).
+		WithUpstreamProto(client.UpstreamHTTP1).
+		WithMaxTransfer(maxTransferBytes()).
+		WithLabels(tunnelLabels())
+	if subdomain != "" {
+		c = c.WithSubdomain(subdomain)
+	}
+	if token != "" {
+		c = c.WithToken(token)
+	}
+
+	stopStatus := serveStatusSocket(c, "share", args[0])
+	err = c.RunWithReconnect(ctx)
+	stopStatus()
+	printSummary(c)
+	if errors.Is(err, client.ErrShutdown) {
+		log.Info("Shutting down...")
+		return
+	}
+	if err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+}
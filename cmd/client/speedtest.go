@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/client"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// speedTestSize is how much data otun speedtest sends each way.
+var speedTestSize string
+
+func runSpeedTest(cmd *cobra.Command, args []string) {
+	applyConfig(cmd)
+
+	size, err := bytesize.Parse(speedTestSize)
+	if err != nil || size <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: --size: must be a positive size, e.g. 10MB\n")
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c := client.New(serverAddr, "").WithTLSConfig(controlTLSConfig())
+	if token != "" {
+		c = c.WithToken(token)
+	}
+
+	log.Info("Running speed test", "server", serverAddr, "size", bytesize.Format(size))
+	result, err := c.SpeedTest(ctx, size)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Round trip  %s (min %s)\n", result.RTT.Round(100*time.Microsecond), result.MinRTT.Round(100*time.Microsecond))
+	fmt.Printf("Download    %s (%s in %s)\n", formatRate(result.DownloadRate()),
+		bytesize.Format(result.DownloadBytes), result.DownloadDuration.Round(time.Millisecond))
+	fmt.Printf("Upload      %s (%s in %s)\n", formatRate(result.UploadRate()),
+		bytesize.Format(result.UploadBytes), result.UploadDuration.Round(time.Millisecond))
+}
+
+// formatRate formats a throughput in bytes per second as megabits per second.
+func formatRate(bytesPerSec float64) string {
+	return fmt.Sprintf("%.1f Mbit/s", bytesPerSec*8/1e6)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/charmbracelet/log"
+)
+
+// State is what the client last knew about its tunnel. It is rewritten
+// atomically on every change, so it survives crashes for otun doctor.
+type State struct {
+	Server    string `json:"server"`
+	LocalAddr string `json:"local_addr"`
+	Subdomain string `json:"subdomain,omitempty"`
+	URL       string `json:"url,omitempty"`
+
+	// RecentSubdomains are the last subdomains registered, most recent
+	// first, for shell completion
+	RecentSubdomains []string `json:"recent_subdomains,omitempty"`
+
+	// HandoverToken lets otun --handover take the tunnel over
+	HandoverToken string `json:"handover_token,omitempty"`
+
+	LastConnected *time.Time `json:"last_connected,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// stateFile returns the path of the state file, ~/.otun/state.json.
+func stateFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate state file: %w", err)
+	}
+	return filepath.Join(home, ".otun", "state.json"), nil
+}
+
+// loadState reads the state file at path. Returns nil if it doesn't exist.
+func loadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return &st, nil
+}
+
+// saveState writes st to path through a synced temporary file and a rename,
+// so a crash leaves either the old state or the new one.
+func saveState(path string, st *State) error {
+	st.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// stateRecorder keeps the state file up to date from client events.
+type stateRecorder struct {
+	path string
+
+	mu    sync.Mutex
+	state State
+}
+
+// newStateRecorder starts recording the state of a tunnel from localAddr,
+// keeping what the previous run learned (e.g. the last successful connect).
+// It returns nil if the state file can't be located.
+func newStateRecorder(server, localAddr string) *stateRecorder {
+	path, err := stateFile()
+	if err != nil {
+		log.Debug("not recording tunnel state", "error", err)
+		return nil
+	}
+	r := &stateRecorder{path: path}
+	if prev, err := loadState(path); err == nil && prev != nil {
+		r.state = *prev
+	}
+	r.state.Server = server
+	r.state.LocalAddr = localAddr
+	r.save()
+	return r
+}
+
+// handle records the outcome of a client event.
+func (r *stateRecorder) handle(e client.Event) {
+	switch e.Type {
+	case client.EventRegistered:
+		now := time.Now().UTC()
+		r.update(func(st *State) {
+			st.URL, st.Subdomain, st.HandoverToken = e.URL, e.Subdomain, e.HandoverToken
+			st.RecentSubdomains = addRecent(st.RecentSubdomains, e.Subdomain)
+			st.LastConnected = &now
+		})
+	case client.EventDisconnected, client.EventReconnecting:
+		if errors.Is(e.Err, client.ErrHandedOver) {
+			return // the new client owns the state now
+		}
+		r.recordError(e.Err)
+	}
+}
+
+// recordError records err as the latest error.
+func (r *stateRecorder) recordError(err error) {
+	if r == nil || err == nil {
+		return
+	}
+	now := time.Now().UTC()
+	r.update(func(st *State) {
+		st.LastError = err.Error()
+		st.LastErrorAt = &now
+	})
+}
+
+// update applies fn to the state and saves it.
+func (r *stateRecorder) update(fn func(*State)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.state)
+	r.saveLocked()
+}
+
+func (r *stateRecorder) save() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.saveLocked()
+}
+
+// saveLocked writes the state file. Must be called with r.mu held.
+func (r *stateRecorder) saveLocked() {
+	if err := saveState(r.path, &r.state); err != nil {
+		log.Debug("failed to save tunnel state", "path", r.path, "error", err)
+	}
+}
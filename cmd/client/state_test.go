@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "state.json")
+
+	st, err := loadState(path)
+	if err != nil || st != nil {
+		t.Fatalf("loadState() on a missing file = %v, %v; want nil, nil", st, err)
+	}
+
+	if err := saveState(path, &State{Server: "example.com:4443", LocalAddr: "localhost:3000", LastError: "boom"}); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+	st, err = loadState(path)
+	if err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	if st.Server != "example.com:4443" || st.LocalAddr != "localhost:3000" || st.LastError != "boom" || st.UpdatedAt.IsZero() {
+		t.Errorf("loadState() = %+v", st)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("state directory has %d entries, want only the state file", len(entries))
+	}
+}
+
+func TestStateRecorder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	r := newStateRecorder("example.com:4443", "localhost:3000")
+	r.handle(client.Event{Type: client.EventRegistered, URL: "https://abc.example.com", Subdomain: "abc"})
+	r.handle(client.Event{Type: client.EventDisconnected, Err: errors.New("session closed: EOF")})
+
+	// A later run keeps what earlier runs learned
+	newStateRecorder("example.com:4443", "localhost:4000")
+	path, _ := stateFile()
+	st, err := loadState(path)
+	if err != nil || st == nil {
+		t.Fatalf("loadState() = %v, %v", st, err)
+	}
+	if st.URL != "https://abc.example.com" || st.LastConnected == nil {
+		t.Errorf("state lost the last connection: %+v", st)
+	}
+	if st.LastError != "session closed: EOF" || st.LastErrorAt == nil {
+		t.Errorf("state lost the last error: %+v", st)
+	}
+	if st.LocalAddr != "localhost:4000" {
+		t.Errorf("LocalAddr = %q, want the current run's", st.LocalAddr)
+	}
+}
+
+func TestStateRecorderHandedOver(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	// The new client registers before the old one learns it handed over
+	newStateRecorder("example.com:4443", "localhost:3000").
+		handle(client.Event{Type: client.EventRegistered, Subdomain: "abc", HandoverToken: "new"})
+	old := newStateRecorder("example.com:4443", "localhost:3000")
+	old.handle(client.Event{Type: client.EventDisconnected, Err: client.ErrHandedOver})
+
+	path, _ := stateFile()
+	st, err := loadState(path)
+	if err != nil || st == nil {
+		t.Fatalf("loadState() = %v, %v", st, err)
+	}
+	if st.HandoverToken != "new" || st.LastError != "" {
+		t.Errorf("state = %+v, want the new client's token and no error", st)
+	}
+}
@@ -4,21 +4,118 @@ package main
 import (
 	"flag"
 	"fmt"
+	"html/template"
 	"log/slog"
+	"net"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/dnsprovider"
+	"github.com/bc183/otun/internal/geoip"
+	"github.com/bc183/otun/internal/logsink"
+	"github.com/bc183/otun/internal/metrics"
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/requestdb"
+	"github.com/bc183/otun/internal/scan"
+	"github.com/bc183/otun/internal/secrets"
 	"github.com/bc183/otun/internal/server"
+	"github.com/bc183/otun/internal/transport"
 	"github.com/bc183/otun/internal/version"
 )
 
 func main() {
-	controlAddr := flag.String("control", ":4443", "Control port address for tunnel client connections")
-	httpsAddr := flag.String("https", ":443", "HTTPS port address for public traffic")
-	httpAddr := flag.String("http", ":80", "HTTP port address for ACME challenges (and HTTP-only mode)")
+	controlAddr := flag.String("control", ":4443", "Control port address(es) for tunnel client connections, comma-separated")
+	httpsAddr := flag.String("https", ":443", "HTTPS port address(es) for public traffic, comma-separated")
+	httpAddr := flag.String("http", ":80", "HTTP port address(es) for ACME challenges (and HTTP-only mode), comma-separated")
 	domain := flag.String("domain", "", "Base domain for tunnels (e.g., tunnel.example.com). If empty, runs in HTTP-only mode.")
 	certDir := flag.String("certs", "/var/lib/otun/certs", "Directory to store TLS certificates")
+	tlsDir := flag.String("tls-dir", "", "Directory with tls.crt and tls.key (e.g. a mounted cert-manager Secret) to serve instead of using ACME; reloaded when they change")
+	ocspStapling := flag.Bool("ocsp-stapling", true, "Staple OCSP responses to certificates that name an OCSP responder")
+	sessionTickets := flag.Bool("tls-session-tickets", true, "Let returning visitors resume TLS sessions with session tickets")
+	ticketKeys := flag.String("tls-ticket-keys", "", "File of session ticket keys shared by every server in a cluster, one 32-byte hex or base64 key per line (first encrypts); reloaded when it changes")
+	ticketRotation := flag.Duration("tls-ticket-rotation", 24*time.Hour, "How often to generate a new session ticket key when -tls-ticket-keys is not set")
 	apiKeys := flag.String("api-keys", "", "Comma-separated list of valid API keys (if set, authentication is required)")
+	adminAddr := flag.String("admin", "", "Address to serve the admin API on (e.g., 127.0.0.1:4040). Disabled if empty.")
+	adminKey := flag.String("admin-key", "", "Bearer token granting full access to the admin API")
+	captureRequests := flag.Int("capture-requests", 0, "Requests per subdomain whose metadata (no bodies) the admin key can view in the admin API (0 = disabled)")
+	captureRetention := flag.Duration("capture-retention", 15*time.Minute, "How long captured request metadata is kept")
+	requestDB := flag.String("request-db", "", "SQLite file to persist request metadata to, so the admin API can show it after a restart (empty = disabled)")
+	requestDBMaxAge := flag.Duration("request-db-max-age", 7*24*time.Hour, "Delete persisted requests older than this (0 = no limit)")
+	requestDBMaxSize := flag.String("request-db-max-size", "100MB", "Delete the oldest persisted requests while the request database is larger than this (0 = no limit)")
+	tunnelHistory := flag.Int("tunnel-history", 50, "Connects, disconnects, and errors kept per subdomain for the admin API (0 = disabled)")
+	tunnelStats := flag.Int("tunnel-stats", 1000, "Subdomains whose request, error, and bandwidth time series the admin API keeps (0 = disabled)")
+	reconnectGrace := flag.Duration("reconnect-grace", 0, "Hold requests for a tunnel that disconnected less than this long ago, waiting for it to reconnect (0 = disabled)")
+	reconnectQueue := flag.Int("reconnect-queue", 100, "Maximum number of requests held while tunnels reconnect")
+	resumeWindow := flag.Duration("resume-window", 5*time.Minute, "How long after disconnecting a client can resume its tunnel, keeping its subdomain, with the token from its last registration (0 = disabled)")
+	handoverDrain := flag.Duration("handover-drain", 30*time.Second, "How long a client that handed its tunnel over to another client may take to finish its in-flight requests")
+	maxRequestDuration := flag.Duration("max-request-duration", 0, "Cut off proxied requests after this long, returning 504 if no response started (0 = no limit; WebSockets are exempt once upgraded)")
+	rejectUnknownFields := flag.Bool("reject-unknown-fields", false, "Refuse control messages with fields this server doesn't know, to harden the control port (clients newer than the server may be refused)")
+	slowRequests := flag.Duration("slow-request-threshold", 0, "Log proxied requests taking longer than this, with a breakdown of where the time went (0 = off; WebSockets exempt)")
+	enableChaos := flag.Bool("chaos", false, "Allow faults (dropped streams, delayed registrations, killed sessions) to be injected through the admin API, to test client reconnects and alerting (requires -admin and -admin-key)")
+	maxStreamAge := flag.Duration("max-stream-age", 0, "Close tunnel streams (WebSockets and TCP connections included) open longer than this, freeing leaked proxy goroutines (0 = no limit)")
+	maxHeaderSize := flag.String("max-header-size", "32KB", "Maximum total header size of a request forwarded into a tunnel; larger requests get 431 (0 = net/http's 1MB default)")
+	maxHeaderCount := flag.Int("max-header-count", 100, "Maximum header lines in a request forwarded into a tunnel; more get 431 (0 = no limit)")
+	policyDir := flag.String("policy-dir", "", "Directory of YAML files with API keys, reservations and tunnel policies, reloaded when they change (see README)")
+	groupsFile := flag.String("groups", "", "YAML file of tunnel groups sharing rate limits, access requirements and header rules (see README)")
+	stripResponseHeaders := flag.String("strip-response-headers", "", "Comma-separated response headers removed from every tunnel's responses, e.g. Server,X-Powered-By,X-Debug-*")
+	maxResponseSize := flag.String("max-response-size", "", "Default and maximum response body size per tunnel, e.g. 1GB (empty = no limit; clients may set lower)")
+	speedTestMaxSize := flag.String("speedtest-max-size", "100MB", "Most data a client's otun speedtest may transfer each way (0 = speed tests disabled)")
+	jwksHosts := flag.String("jwks-hosts", "", "Comma-separated hosts tunnels may fetch JWT signing keys from, e.g. id.example.com,*.auth0.com (empty = tunnels can't require JWTs)")
+	relayTo := flag.String("relay-to", "", "Comma-separated control addresses of otun servers clients may chain through this one to, e.g. eu.tunnel.example.com:4443 (empty = relaying disabled)")
+	edgeCacheEntries := flag.Int("edge-cache-entries", 0, "Remember validators of up to this many cacheable responses and answer conditional requests for them with 304 without using the tunnel (0 = disabled)")
+	customDomains := flag.Bool("custom-domains", false, "Let clients add their own domains for tunnels through the admin API")
+	verifyDomains := flag.Bool("verify-domains", true, "Require a TXT record proving ownership before routing a custom domain")
+	dnsProvider := flag.String("dns-provider", "", "Create custom domain CNAMEs through this provider once verified: cloudflare (token from CLOUDFLARE_API_TOKEN)")
+	tcpPorts := flag.String("tcp-ports", "", "Port range for TCP tunnels, e.g. 20000-20100 (TCP tunnels disabled if empty)")
+	reservedPorts := flag.String("reserved-ports", "", "Comma-separated token=port pairs reserving TCP ports for specific API keys")
+	keepAliveInterval := flag.Duration("control-keepalive", transport.DefaultKeepAliveInterval, "TCP keepalive probe interval on tunnel client connections; 3 missed probes drop the client (0 = system default)")
+	userTimeout := flag.Duration("control-user-timeout", transport.DefaultUserTimeout, "Drop tunnel client connections whose sent data goes unacknowledged this long (0 = system default; Linux only)")
+	maxConnections := flag.Int("max-connections", 0, "Maximum public connections proxied at once; more get 503 (0 = no limit)")
+	maxStreams := flag.Int("max-streams-per-tunnel", 0, "Maximum concurrent connections per tunnel; more get 503 (0 = no limit)")
+	limitWarning := flag.Int("limit-warning", 80, "Warn tunnel clients when they reach this percentage of their concurrent connection or response size limit (0 = never)")
+	visitorMaxStreams := flag.Int("visitor-max-streams", 0, "Maximum concurrent requests per visitor IP per tunnel; more get 429 (0 = no limit)")
+	visitorRate := flag.Float64("visitor-rate", 0, "Maximum requests per second per visitor IP per tunnel; more get 429 (0 = no limit)")
+	visitorBurst := flag.Int("visitor-burst", 20, "Requests a visitor may make at once before -visitor-rate applies")
+	visitorTarpit := flag.Duration("visitor-tarpit", 0, "Hold throttled visitors' requests this long before answering 429, to slow scrapers down (0 = answer at once)")
+	geoipDBs := flag.String("geoip", "", "Comma-separated MaxMind DB files (e.g. GeoLite2-Country.mmdb,GeoLite2-ASN.mmdb) to locate visitors with for tunnels' geo policies (empty = geo policies refused)")
+	turnstileSiteKey := flag.String("turnstile-site-key", "", "Cloudflare Turnstile site key, letting tunnels challenge visitors with Turnstile (secret key in OTUN_TURNSTILE_SECRET)")
+	hcaptchaSiteKey := flag.String("hcaptcha-site-key", "", "hCaptcha site key, letting tunnels challenge visitors with hCaptcha (secret key in OTUN_HCAPTCHA_SECRET)")
+	maxSessions := flag.Int("max-sessions", 0, "Maximum connected tunnel clients (0 = no limit)")
+	registrationWorkers := flag.Int("registration-workers", 32, "Tunnel client registrations handled at once; others wait in a queue (0 = no limit)")
+	registrationQueue := flag.Int("registration-queue", 1000, "Tunnel clients waiting to register before new ones are told to retry later")
+	handshakeTimeout := flag.Duration("handshake-timeout", server.DefaultHandshakeTimeout, "Close tunnel client connections that don't send their registration within this long (0 = wait forever)")
+	ownerKeys := flag.String("owner-keys", "/var/lib/otun/owner-keys.json", "File subdomains bound to client owner keys are stored in, so the bindings survive restarts (empty = kept in memory)")
+	identityKey := flag.String("identity-key", "", "Ed25519 PEM key signing the X-Otun-User-JWT identities forwarded by private tunnels, generated if missing (empty = new key each start)")
+	takeover := flag.String("takeover", "never", "Whether a registration may evict the client holding its subdomain: never, same-token, or always")
+	enableHTTP3 := flag.Bool("http3", false, "Also serve HTTP/3 (QUIC) on the HTTPS port over UDP (requires -domain)")
+	controlTLS := flag.Bool("control-tls", false, "Serve TLS on the control port with the -tls-dir certificate or, through ACME, one for -domain; clients must connect with --control-tls")
+	tlsPassthrough := flag.Bool("tls-passthrough", false, "Route HTTPS connections by SNI so clients can register tunnels that terminate TLS themselves (requires -domain)")
+	signupAddr := flag.String("signup", "", "Address to serve the self-service signup API on (e.g., :8443). Disabled if empty.")
+	signupStore := flag.String("signup-store", "/var/lib/otun/signup.json", "File issued signup tokens are stored in")
+	signupDomains := flag.String("signup-domains", "", "Comma-separated email domains allowed to sign up (empty = any)")
+	signupOIDC := flag.String("signup-oidc", "", "OIDC issuer URL; signups must present an access token from it instead of verifying an email")
+	smtpAddr := flag.String("smtp", "", "SMTP server (host:port) for signup verification emails; credentials from OTUN_SMTP_USERNAME and OTUN_SMTP_PASSWORD")
+	smtpFrom := flag.String("smtp-from", "", "From address for signup verification emails")
+	anonymous := flag.Bool("anonymous", false, "Let clients without an API key open tunnels, limited by the -anonymous-* flags (HTTP only, random subdomains)")
+	anonymousLifetime := flag.Duration("anonymous-lifetime", time.Hour, "Close tunnels opened without an API key after this long (0 = no limit)")
+	anonymousBandwidth := flag.String("anonymous-bandwidth", "256KB", "Bandwidth per second of each tunnel opened without an API key, both directions combined (0 = no limit)")
+	anonymousHTMLBanner := flag.Bool("anonymous-html-banner", false, "Inject an HTML banner naming this server and the tunnel's limits into pages served by tunnels opened without an API key")
+	anonymousHTMLTemplate := flag.String("anonymous-html-banner-template", "", "html/template file to render the anonymous HTML banner from (empty = built-in)")
+	anonymousBanner := flag.String("anonymous-banner", "Free otun tunnel with limited bandwidth and lifetime", "X-Otun-Notice header added to responses of tunnels opened without an API key (empty = none)")
+	errorPages := flag.String("error-pages", "", "Directory of html/template error pages (404.html, 5xx.html, error.html, ...) shown to browsers instead of plain-text edge errors")
+	supportURL := flag.String("support-url", "", "Where error pages tell visitors to get help, as {{.SupportURL}}")
+	scanner := flag.String("scan", "", "Scan request bodies before forwarding: an icap://host:1344/service REQMOD URL, or a command given the body on stdin (exit 0 = clean, 1 = reject)")
+	scanThreshold := flag.String("scan-threshold", "0", "Only scan request bodies larger than this, e.g. 1MB")
+	scanMaxSize := flag.String("scan-max-size", "100MB", "Refuse request bodies larger than this when scanning is enabled (0 = no limit)")
+	metricsAddr := flag.String("metrics", "", "Address to serve Prometheus metrics on (e.g., 127.0.0.1:9090). Disabled if empty.")
+	metricsPushURL := flag.String("metrics-push", "", "Push metrics to this remote-write endpoint or Pushgateway URL, for servers that can't be scraped (disabled if empty)")
+	metricsPushFormat := flag.String("metrics-push-format", "remote-write", "How to push metrics: remote-write or pushgateway")
+	metricsPushInterval := flag.Duration("metrics-push-interval", 30*time.Second, "How often to push metrics")
+	metricsPushJob := flag.String("metrics-push-job", "otun", "job label of pushed metrics; instance is the host name")
+	logSinks := flag.String("log-sinks", "", "Comma-separated access/audit log sinks: syslog://host:514, loki://host:3100, s3://bucket/prefix?region=...")
+	logBuffer := flag.Int("log-buffer", 10000, "Log entries buffered while sinks catch up; entries beyond this are dropped")
 	debug := flag.Bool("debug", false, "Enable debug logging")
 	showVersion := flag.Bool("version", false, "Print version information and exit")
 	flag.Parse()
@@ -38,6 +135,184 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
+	takeoverPolicy, err := server.ParseTakeoverPolicy(*takeover)
+	if err != nil {
+		slog.Error("invalid flag", "error", err)
+		os.Exit(1)
+	}
+
+	pushFormat, err := metrics.ParsePushFormat(*metricsPushFormat)
+	if err != nil {
+		slog.Error("invalid flag", "error", err)
+		os.Exit(1)
+	}
+
+	maxResponseBytes, err := bytesize.Parse(*maxResponseSize)
+	if err != nil {
+		slog.Error("invalid flag", "flag", "max-response-size", "error", err)
+		os.Exit(1)
+	}
+
+	maxHeaderBytes, err := bytesize.Parse(*maxHeaderSize)
+	if err != nil {
+		slog.Error("invalid flag", "flag", "max-header-size", "error", err)
+		os.Exit(1)
+	}
+
+	var stripRules []string
+	if *stripResponseHeaders != "" {
+		stripRules = strings.Split(*stripResponseHeaders, ",")
+		if err := protocol.ValidateStripHeaders(stripRules); err != nil {
+			slog.Error("invalid flag", "flag", "strip-response-headers", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var groups []server.Group
+	if *groupsFile != "" {
+		groups, err = server.LoadGroups(*groupsFile)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "groups", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("tunnel groups loaded", "group_count", len(groups))
+	}
+
+	speedTestMaxBytes, err := bytesize.Parse(*speedTestMaxSize)
+	if err != nil {
+		slog.Error("invalid flag", "flag", "speedtest-max-size", "error", err)
+		os.Exit(1)
+	}
+
+	var jwksHostList []string
+	if *jwksHosts != "" {
+		jwksHostList = strings.Split(*jwksHosts, ",")
+	}
+
+	var relayTargets []string
+	if *relayTo != "" {
+		relayTargets = strings.Split(*relayTo, ",")
+		for _, target := range relayTargets {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				slog.Error("invalid flag", "flag", "relay-to", "error", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Keys may be given as ${env:VAR}, ${file:PATH} or ${age:PATH} references,
+	// keeping them out of unit files and process listings
+	for name, value := range map[string]*string{"api-keys": apiKeys, "admin-key": adminKey, "reserved-ports": reservedPorts} {
+		if *value, err = secrets.Expand(*value); err != nil {
+			slog.Error("invalid flag", "flag", name, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *turnstileSiteKey != "" && os.Getenv("OTUN_TURNSTILE_SECRET") == "" {
+		slog.Error("invalid flag", "flag", "turnstile-site-key", "error", "OTUN_TURNSTILE_SECRET is not set")
+		os.Exit(1)
+	}
+	if *hcaptchaSiteKey != "" && os.Getenv("OTUN_HCAPTCHA_SECRET") == "" {
+		slog.Error("invalid flag", "flag", "hcaptcha-site-key", "error", "OTUN_HCAPTCHA_SECRET is not set")
+		os.Exit(1)
+	}
+
+	if *enableChaos && (*adminAddr == "" || *adminKey == "") {
+		slog.Error("invalid flag", "flag", "chaos", "error", "requires -admin and -admin-key")
+		os.Exit(1)
+	}
+
+	if *controlTLS && *domain == "" && *tlsDir == "" {
+		slog.Error("invalid flag", "flag", "control-tls", "error", "requires -domain or -tls-dir")
+		os.Exit(1)
+	}
+
+	if *ticketKeys == "" && *ticketRotation <= 0 {
+		slog.Error("invalid flag", "flag", "tls-ticket-rotation", "error", "must be positive")
+		os.Exit(1)
+	}
+
+	var contentScanner scan.Scanner
+	var scanThresholdBytes, scanMaxBytes int64
+	if *scanner != "" {
+		contentScanner, err = scan.Parse(*scanner)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "scan", "error", err)
+			os.Exit(1)
+		}
+		scanThresholdBytes, err = bytesize.Parse(*scanThreshold)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "scan-threshold", "error", err)
+			os.Exit(1)
+		}
+		scanMaxBytes, err = bytesize.Parse(*scanMaxSize)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "scan-max-size", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("content scanning enabled", "scanner", *scanner, "threshold", *scanThreshold)
+	}
+
+	var provider dnsprovider.Provider
+	if *dnsProvider != "" {
+		provider, err = dnsprovider.Parse(*dnsProvider)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "dns-provider", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	var portRange server.PortRange
+	if *tcpPorts != "" {
+		portRange, err = server.ParsePortRange(*tcpPorts)
+		if err != nil {
+			slog.Error("invalid flag", "error", err)
+			os.Exit(1)
+		}
+	}
+	reserved, err := server.ParseReservedPorts(*reservedPorts)
+	if err != nil {
+		slog.Error("invalid flag", "error", err)
+		os.Exit(1)
+	}
+
+	var sinks []logsink.Sink
+	if *logSinks != "" {
+		for _, spec := range strings.Split(*logSinks, ",") {
+			sink, err := logsink.Parse(spec)
+			if err != nil {
+				slog.Error("invalid flag", "error", err)
+				os.Exit(1)
+			}
+			sinks = append(sinks, sink)
+		}
+		slog.Info("log shipping enabled", "sink_count", len(sinks))
+	}
+	shipperConfig := logsink.DefaultShipperConfig()
+	shipperConfig.BufferSize = *logBuffer
+
+	var signupConfig server.SignupConfig
+	if *signupAddr != "" {
+		if *signupOIDC == "" && (*smtpAddr == "" || *smtpFrom == "") {
+			slog.Error("invalid flag", "error", "-signup requires -signup-oidc, or -smtp and -smtp-from")
+			os.Exit(1)
+		}
+		signupConfig = server.SignupConfig{
+			StorePath:    *signupStore,
+			OIDCIssuer:   *signupOIDC,
+			SMTPAddr:     *smtpAddr,
+			SMTPFrom:     *smtpFrom,
+			SMTPUsername: os.Getenv("OTUN_SMTP_USERNAME"),
+			SMTPPassword: os.Getenv("OTUN_SMTP_PASSWORD"),
+		}
+		if *signupDomains != "" {
+			signupConfig.AllowedDomains = strings.Split(*signupDomains, ",")
+		} else if *signupOIDC == "" {
+			slog.Warn("signup is open to any email address; consider -signup-domains")
+		}
+	}
+
 	// Parse API keys
 	var keys []string
 	if *apiKeys != "" {
@@ -46,7 +321,127 @@ func main() {
 	}
 
 	// Create and run server
-	srv := server.New(*controlAddr, *httpsAddr, *httpAddr, *domain, *certDir, keys)
+	srv := server.New(*controlAddr, *httpsAddr, *httpAddr, *domain, *certDir, keys).
+		WithMetricsAddr(*metricsAddr).
+		WithAdmin(*adminAddr, *adminKey).
+		WithTunnelHistory(*tunnelHistory).
+		WithTunnelStats(*tunnelStats).
+		WithRequestCapture(*captureRequests, *captureRetention).
+		WithHTTP3(*enableHTTP3).
+		WithTLSPassthrough(*tlsPassthrough).
+		WithControlTLS(*controlTLS).
+		WithOCSPStapling(*ocspStapling).
+		WithSessionTickets(*sessionTickets, *ticketRotation, *ticketKeys).
+		WithReconnectQueue(*reconnectGrace, *reconnectQueue).
+		WithResumeWindow(*resumeWindow).
+		WithHandoverDrain(*handoverDrain).
+		WithOwnerKeyStore(*ownerKeys).
+		WithIdentityKey(*identityKey).
+		WithTakeoverPolicy(takeoverPolicy).
+		WithMaxRequestDuration(*maxRequestDuration).
+		WithSlowRequestLog(*slowRequests).
+		WithRejectUnknownFields(*rejectUnknownFields).
+		WithMaxStreamAge(*maxStreamAge).
+		WithChaos(*enableChaos).
+		WithMaxResponseSize(maxResponseBytes).
+		WithHeaderLimits(maxHeaderBytes, *maxHeaderCount).
+		WithStripResponseHeaders(stripRules).
+		WithGroups(groups).
+		WithEdgeCache(*edgeCacheEntries).
+		WithSpeedTest(speedTestMaxBytes).
+		WithRelayTargets(relayTargets).
+		WithJWKSHosts(jwksHostList).
+		WithTCPPorts(portRange, reserved).
+		WithConnectionLimits(*maxConnections, *maxStreams, *maxSessions).
+		WithVisitorLimits(*visitorMaxStreams, *visitorRate, *visitorBurst, *visitorTarpit).
+		WithCaptcha(protocol.ChallengeTurnstile, *turnstileSiteKey, os.Getenv("OTUN_TURNSTILE_SECRET")).
+		WithCaptcha(protocol.ChallengeHCaptcha, *hcaptchaSiteKey, os.Getenv("OTUN_HCAPTCHA_SECRET")).
+		WithKeepAlive(transport.KeepAlive{Interval: *keepAliveInterval, UserTimeout: *userTimeout}).
+		WithLimitWarnings(*limitWarning).
+		WithRegistrationQueue(*registrationWorkers, *registrationQueue).
+		WithHandshakeTimeout(*handshakeTimeout).
+		WithLogSinks(sinks, shipperConfig)
+	if *customDomains {
+		srv = srv.WithCustomDomains(*verifyDomains, provider)
+	}
+	if *tlsDir != "" {
+		srv = srv.WithCertificateDir(*tlsDir)
+	}
+	if *policyDir != "" {
+		srv = srv.WithPolicyDir(*policyDir)
+	}
+	if contentScanner != nil {
+		srv = srv.WithContentScanner(contentScanner, scanThresholdBytes, scanMaxBytes)
+	}
+	if *signupAddr != "" {
+		srv = srv.WithSignup(*signupAddr, signupConfig)
+	}
+	if *anonymous {
+		bandwidth, err := bytesize.Parse(*anonymousBandwidth)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "anonymous-bandwidth", "error", err)
+			os.Exit(1)
+		}
+		srv = srv.WithAnonymousTier(server.AnonymousTier{
+			MaxLifetime:    *anonymousLifetime,
+			BytesPerSecond: bandwidth,
+			Banner:         *anonymousBanner,
+		})
+		if *anonymousHTMLBanner {
+			text := server.DefaultBannerTemplate
+			if *anonymousHTMLTemplate != "" {
+				b, err := os.ReadFile(*anonymousHTMLTemplate)
+				if err != nil {
+					slog.Error("invalid flag", "flag", "anonymous-html-banner-template", "error", err)
+					os.Exit(1)
+				}
+				text = string(b)
+			}
+			tmpl, err := template.New("banner").Parse(text)
+			if err != nil {
+				slog.Error("invalid flag", "flag", "anonymous-html-banner-template", "error", err)
+				os.Exit(1)
+			}
+			srv = srv.WithHTMLBanner(tmpl)
+		}
+	}
+	if *errorPages != "" {
+		templates, err := server.LoadErrorPages(*errorPages)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "error-pages", "error", err)
+			os.Exit(1)
+		}
+		srv = srv.WithErrorPages(templates, *supportURL)
+	}
+	if *requestDB != "" {
+		maxBytes, err := bytesize.Parse(*requestDBMaxSize)
+		if err != nil {
+			slog.Error("invalid flag", "flag", "request-db-max-size", "error", err)
+			os.Exit(1)
+		}
+		db, err := requestdb.Open(*requestDB, requestdb.Retention{MaxAge: *requestDBMaxAge, MaxBytes: maxBytes})
+		if err != nil {
+			slog.Error("failed to open request database", "error", err)
+			os.Exit(1)
+		}
+		srv = srv.WithRequestDB(db)
+	}
+	if *geoipDBs != "" {
+		db, err := geoip.Open(strings.Split(*geoipDBs, ",")...)
+		if err != nil {
+			slog.Error("failed to open GeoIP database", "error", err)
+			os.Exit(1)
+		}
+		srv = srv.WithGeoIP(db)
+	}
+	if *metricsPushURL != "" {
+		srv = srv.WithMetricsPush(metrics.PushConfig{
+			Format:   pushFormat,
+			URL:      *metricsPushURL,
+			Interval: *metricsPushInterval,
+			Job:      *metricsPushJob,
+		})
+	}
 	if err := srv.Run(); err != nil {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
@@ -79,6 +79,17 @@ func (b *Backoff) NextDelay() time.Duration {
 	return time.Duration(delay)
 }
 
+// NextDelayAtLeast is like NextDelay, but waits at least min when the server
+// asked for a longer pause. The jitter is added on top of min, so clients
+// told to wait the same time don't all come back at once.
+func (b *Backoff) NextDelayAtLeast(min time.Duration) time.Duration {
+	delay := b.NextDelay()
+	if delay >= min {
+		return delay
+	}
+	return min + time.Duration(b.rng.Float64()*b.config.Jitter*float64(min))
+}
+
 // Reset resets the backoff state after a successful connection.
 func (b *Backoff) Reset() {
 	b.attempt = 0
@@ -172,3 +172,20 @@ func TestDefaultBackoffConfig(t *testing.T) {
 		t.Errorf("MaxRetries: got %v, want 0", config.MaxRetries)
 	}
 }
+
+func TestBackoff_NextDelayAtLeast(t *testing.T) {
+	config := BackoffConfig{
+		InitialDelay: 1 * time.Second,
+		MaxDelay:     60 * time.Second,
+		Multiplier:   2.0,
+		Jitter:       0.25,
+	}
+
+	b := NewBackoff(config)
+	for i := 0; i < 20; i++ {
+		delay := b.NextDelayAtLeast(10 * time.Second)
+		if delay < 10*time.Second || delay > 75*time.Second {
+			t.Errorf("attempt %d: delay %v outside [10s, 75s]", b.Attempt(), delay)
+		}
+	}
+}
@@ -4,21 +4,34 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bc183/otun/internal/bytesize"
 	"github.com/bc183/otun/internal/protocol"
 	"github.com/bc183/otun/internal/proxy"
+	"github.com/bc183/otun/internal/requestdb"
+	"github.com/bc183/otun/internal/transport"
 	"github.com/charmbracelet/log"
-	"github.com/hashicorp/yamux"
 )
 
 const (
 	// HeartbeatInterval is how often to send heartbeat messages.
 	HeartbeatInterval = 30 * time.Second
+
+	// happyEyeballsDelay is how long a dial waits on the preferred address
+	// family before racing the other one (RFC 8305), so a broken IPv6 route
+	// to a dual-stack server or local service costs a fraction of a second.
+	happyEyeballsDelay = 250 * time.Millisecond
 )
 
 // Client is the otun tunnel client.
@@ -28,16 +41,173 @@ type Client struct {
 	subdomain  string
 	token      string
 
-	session       *yamux.Session
+	// maxResponseBytes asks the server to cap response bodies (0 = server default)
+	maxResponseBytes int64
+
+	// labels are sent at registration for filtering in admin surfaces
+	labels map[string]string
+
+	// stripHeaders asks the server to remove these response headers
+	stripHeaders []string
+
+	// Private tunnels: the visitors' shared secret and client CA bundle
+	accessSecret string
+	clientCA     string
+
+	// webhookSignature asks the server to verify request signatures
+	webhookSignature *protocol.WebhookSignature
+
+	// replayProtection asks the server to detect redelivered webhooks
+	replayProtection *protocol.ReplayProtection
+
+	// abTest asks the server to assign visitors to A/B buckets
+	abTest *protocol.ABTest
+
+	// geoPolicy asks the server to refuse visitors by country or network
+	geoPolicy *protocol.GeoPolicy
+
+	// challenge asks the server to challenge visitors before forwarding
+	// their requests
+	challenge *protocol.Challenge
+
+	// jwt asks the server to require a valid bearer JWT
+	jwt *protocol.JWTPolicy
+
+	// honeytokens asks the server to alert on requests for trap paths
+	honeytokens *protocol.Honeytokens
+
+	// TCP tunnels: the requested public port (0 = any)
+	tcp        bool
+	remotePort int
+
+	// denyPaths are answered with 404 instead of being forwarded
+	denyPaths []string
+
+	// mocks are answered by the client instead of the local service
+	mocks []MockResponse
+
+	// rewrites are applied to the bodies of text responses
+	rewrites []Rewrite
+
+	// localSlots limits simultaneous local connections (nil = unlimited);
+	// streams wait up to localQueueTimeout for a slot
+	localSlots        chan struct{}
+	localQueueTimeout time.Duration
+	localConns        localConnCounters
+
+	// Local dials: the timeout of each attempt and how often, and how far
+	// apart, failed ones are retried
+	localDialTimeout    time.Duration
+	localDialRetries    int
+	localDialRetryDelay time.Duration
+
+	// hotReloadWait is how long refused local dials keep being retried
+	hotReloadWait time.Duration
+
+	// interceptors wrap the handling of each stream
+	interceptors []Interceptor
+
+	// tlsPassthrough makes the server hand over TLS connections undecrypted
+	// for the local service to terminate
+	tlsPassthrough bool
+
+	// upstreamProto is the protocol spoken to the local service; h2c sends
+	// requests through the h2c transport
+	upstreamProto UpstreamProto
+	h2c           *http.Transport
+
+	// Transport settings
+	serverDialer Dialer
+	localDialer  Dialer
+	tlsConfig    *tls.Config
+	muxer        transport.Muxer
+
+	// keepAlive tunes dead connection detection on the server connection
+	keepAlive transport.KeepAlive
+
+	// knownHosts pins the server's TLS key (nil = not checked)
+	knownHosts *knownHosts
+
+	// resolver resolves the server's host (nil = left to serverDialer);
+	// serverAddrs remembers what it last resolved to
+	resolver    Resolver
+	serverAddrs serverAddrs
+
+	// tunnels are registered over this client's connection too, tunnelID
+	// telling them apart ("" = this client's tunnel only)
+	tunnels  []*Client
+	tunnelID string
+
+	// via are the otun servers that relay the connection to the server,
+	// first dialed first (empty = connect directly)
+	via []string
+
+	session       transport.Session
 	controlStream *protocol.ControlStream
 
 	// Registration info received from server
 	tunnelURL         string
 	assignedSubdomain string
+	assignedPort      int
+
+	// resumeToken from the last registration lets the server restore the
+	// tunnel on reconnect
+	resumeToken string
+
+	// ownerKey binds the subdomain to its public half (nil = none)
+	ownerKey ed25519.PrivateKey
+
+	// handoverFrom is the token of the client to take the tunnel over from
+	// on the first registration; handoverToken is the one the server gave
+	// this client
+	handoverFrom  string
+	handoverToken string
+
+	// canary joins the tunnel serving the subdomain instead of replacing it
+	canary bool
+
+	// transfer counts the bytes carried by tunnel streams against the cap
+	transfer transferMeter
+
+	// closeReason is set when the server ends the tunnel with an error message
+	closeReason atomic.Pointer[protocol.ErrorMessage]
 
 	// Reconnection settings
 	backoffConfig BackoffConfig
 	reconnect     bool
+
+	// networkMonitor enables netmon while reconnecting; networkChanged is
+	// set when a network change killed the session
+	networkMonitor bool
+	netmon         *netMonitor
+	networkChanged atomic.Bool
+
+	// serverLocalAddr is the local address of the server connection
+	serverLocalAddr net.Addr
+
+	// stats accumulates request statistics for Stats
+	stats *requestStats
+
+	// counters count reconnects and streams for RegisterMetrics
+	counters sessionCounters
+
+	// lite trims memory use and per-request logging (see WithLite)
+	lite bool
+
+	// inspector captures traffic for the inspector API (nil = disabled)
+	inspector *inspector
+
+	// requestDB persists the inspector's exchanges (nil = disabled)
+	requestDB *requestdb.DB
+
+	// Lifecycle notification
+	onEvent   func(Event)
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// status is the snapshot returned by Status
+	statusMu sync.Mutex
+	status   Status
 }
 
 // New creates a new tunnel client.
@@ -45,8 +215,18 @@ func New(serverAddr, localAddr string) *Client {
 	return &Client{
 		serverAddr:    serverAddr,
 		localAddr:     localAddr,
+		serverDialer:  &net.Dialer{FallbackDelay: happyEyeballsDelay},
+		localDialer:   &net.Dialer{FallbackDelay: happyEyeballsDelay},
+		muxer:         transport.Default(),
 		backoffConfig: DefaultBackoffConfig(),
-		reconnect:     true,
+
+		keepAlive:           transport.DefaultKeepAlive(),
+		localDialTimeout:    DefaultLocalDialTimeout,
+		localDialRetries:    DefaultLocalDialRetries,
+		localDialRetryDelay: DefaultLocalDialRetryDelay,
+		reconnect:           true,
+		stats:               newRequestStats(),
+		ready:               make(chan struct{}),
 	}
 }
 
@@ -62,6 +242,105 @@ func (c *Client) WithToken(token string) *Client {
 	return c
 }
 
+// WithMaxResponseSize asks the server to reject or cut off responses whose
+// body exceeds n bytes. The server may enforce a lower limit of its own.
+func (c *Client) WithMaxResponseSize(n int64) *Client {
+	c.maxResponseBytes = n
+	return c
+}
+
+// WithLabels attaches key=value labels (e.g. team=payments) to the tunnel,
+// which the server's admin API and metrics can filter and group by.
+func (c *Client) WithLabels(labels map[string]string) *Client {
+	c.labels = labels
+	return c
+}
+
+// WithStripHeaders asks the server to remove the named headers (e.g.
+// Server, X-Powered-By) from responses before they reach visitors. A
+// trailing "*" matches a prefix, e.g. "X-Debug-*".
+func (c *Client) WithStripHeaders(names []string) *Client {
+	c.stripHeaders = names
+	return c
+}
+
+// WithAccess makes the tunnel private. Visitors must send secret in the
+// X-Otun-Access header or present a client certificate signed by a CA in the
+// PEM bundle clientCA; either may be empty.
+func (c *Client) WithAccess(secret, clientCA string) *Client {
+	c.accessSecret = secret
+	c.clientCA = clientCA
+	return c
+}
+
+// WithWebhookSignature makes the server verify the HMAC signature of each
+// request body and reject forged calls before they reach the tunnel.
+func (c *Client) WithWebhookSignature(sig protocol.WebhookSignature) *Client {
+	c.webhookSignature = &sig
+	return c
+}
+
+// WithReplayProtection makes the server detect requests that repeat a
+// recent delivery ID, so webhooks redelivered while the tunnel was down
+// are dropped or flagged instead of handled twice.
+func (c *Client) WithReplayProtection(p protocol.ReplayProtection) *Client {
+	c.replayProtection = &p
+	return c
+}
+
+// WithABTest makes the server assign each visitor to one of t's buckets,
+// kept with a cookie, and tell the local service theirs in the
+// X-Otun-Bucket request header.
+func (c *Client) WithABTest(t protocol.ABTest) *Client {
+	c.abTest = &t
+	return c
+}
+
+// WithGeoPolicy makes the server refuse visitors from denied countries or
+// networks, or from outside the allowed ones, with a 403.
+func (c *Client) WithGeoPolicy(p protocol.GeoPolicy) *Client {
+	c.geoPolicy = &p
+	return c
+}
+
+// WithChallenge makes the server show visitors an interstitial challenge
+// and only forward requests from those who passed it.
+func (c *Client) WithChallenge(ch protocol.Challenge) *Client {
+	c.challenge = &ch
+	return c
+}
+
+// WithJWT makes the server answer 401 to requests without a valid bearer
+// JWT signed with a key from p's JWKS URL.
+func (c *Client) WithJWT(p protocol.JWTPolicy) *Client {
+	c.jwt = &p
+	return c
+}
+
+// WithHoneytokens makes the server answer requests for h's trap paths
+// with 404 instead of forwarding them, and raise an alert: an
+// EventIntrusion here, and a webhook if the API key has one.
+func (c *Client) WithHoneytokens(h protocol.Honeytokens) *Client {
+	c.honeytokens = &h
+	return c
+}
+
+// WithTCP makes the tunnel carry raw TCP instead of HTTP. The server exposes
+// it on remotePort, or on a port it picks if remotePort is 0.
+func (c *Client) WithTCP(remotePort int) *Client {
+	c.tcp = true
+	c.remotePort = remotePort
+	return c
+}
+
+// WithTLSPassthrough makes the tunnel carry TLS connections for its
+// subdomain undecrypted: the server routes them by SNI and the local service
+// terminates TLS with its own certificate.
+func (c *Client) WithTLSPassthrough() *Client {
+	c.tlsPassthrough = true
+	return c
+}
+
 // WithBackoff sets the backoff configuration for reconnection.
 func (c *Client) WithBackoff(config BackoffConfig) *Client {
 	c.backoffConfig = config
@@ -80,95 +359,378 @@ func (c *Client) WithMaxRetries(maxRetries int) *Client {
 	return c
 }
 
-// Run connects to the server and handles incoming streams.
-// It returns when the connection is closed or the context is cancelled.
-func (c *Client) Run(ctx context.Context) error {
-	log.Debug("connecting to server", "server", c.serverAddr)
+// WithServerDialer sets the dialer used to connect to the tunnel server.
+func (c *Client) WithServerDialer(d Dialer) *Client {
+	c.serverDialer = d
+	return c
+}
 
-	// Connect to the tunnel server
-	conn, err := net.Dial("tcp", c.serverAddr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to server %s: %w", c.serverAddr, err)
-	}
+// WithKeepAlive sets the TCP keepalive and user timeout of the connection to
+// the server, so a connection dropped by a NAT or middlebox is noticed within
+// seconds instead of at the next missed heartbeat.
+func (c *Client) WithKeepAlive(k transport.KeepAlive) *Client {
+	c.keepAlive = k
+	return c
+}
 
-	log.Debug("tcp connection established", "server", c.serverAddr)
+// WithLocalDialer sets the dialer used to connect to the local service.
+func (c *Client) WithLocalDialer(d Dialer) *Client {
+	c.localDialer = d
+	return c
+}
 
-	// Create yamux session (client side)
-	session, err := yamux.Client(conn, nil)
-	if err != nil {
-		conn.Close()
-		return fmt.Errorf("failed to create yamux session: %w", err)
+// WithTLSConfig enables TLS on the server connection using cfg.
+// If cfg.ServerName is empty, the host part of the server address is used.
+func (c *Client) WithTLSConfig(cfg *tls.Config) *Client {
+	c.tlsConfig = cfg
+	return c
+}
+
+// WithMuxer sets the stream multiplexer used over the server connection.
+// The server must support the muxer; the default is yamux.
+func (c *Client) WithMuxer(m transport.Muxer) *Client {
+	c.muxer = m
+	return c
+}
+
+// WithEventHandler sets a callback invoked on registration, disconnect, and
+// each reconnection attempt. The callback runs synchronously on the client's
+// goroutine and should not block.
+func (c *Client) WithEventHandler(fn func(Event)) *Client {
+	c.onEvent = fn
+	return c
+}
+
+// WithInspector enables capturing the most recent capacity request/response
+// exchanges for the inspector API (see InspectorHandler).
+func (c *Client) WithInspector(capacity int) *Client {
+	c.inspector = newInspector(capacity)
+	if c.requestDB != nil {
+		c.inspector.restore(c.requestDB, func() string { return c.Status().Subdomain })
 	}
-	c.session = session
+	return c
+}
 
-	// Watch for context cancellation and close session
-	go func() {
-		<-ctx.Done()
-		session.Close()
+// WithRequestDB persists captured exchanges to db and restores the most
+// recent ones from it, so the inspector API shows them after a restart. It
+// enables the inspector with the default capacity if WithInspector wasn't
+// called. The caller closes db after the client stops.
+func (c *Client) WithRequestDB(db *requestdb.DB) *Client {
+	c.requestDB = db
+	if c.inspector == nil {
+		c.inspector = newInspector(DefaultInspectorCapacity)
+	}
+	c.inspector.restore(db, func() string { return c.Status().Subdomain })
+	return c
+}
+
+// WithOwnerKey binds the tunnel's subdomain to key's public half when the
+// tunnel first claims it. From then on, the server only lets clients that
+// prove they hold key register the subdomain, whatever their API key.
+func (c *Client) WithOwnerKey(key ed25519.PrivateKey) *Client {
+	c.ownerKey = key
+	return c
+}
+
+// WithHandover takes the tunnel over from the client that was given token
+// in its registration (see Event.HandoverToken), e.g. the process being
+// upgraded or restarted. The server switches requests to this client as
+// soon as it registers and lets the old client finish the requests it is
+// serving, so none are dropped. The subdomain must be that of the old
+// client's tunnel.
+func (c *Client) WithHandover(token string) *Client {
+	c.handoverFrom = token
+	return c
+}
+
+// WithCanary registers the client as the canary of the HTTP tunnel already
+// serving the subdomain, e.g. a new build of the local service, instead of
+// taking the subdomain over. The tunnel's client must use the same API key.
+// The canary gets the share of requests set with the server's admin API,
+// and the tunnel's client the rest.
+func (c *Client) WithCanary() *Client {
+	c.canary = true
+	return c
+}
+
+// Ready returns a channel that is closed once the tunnel is first registered.
+func (c *Client) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Run connects to the server and handles incoming streams.
+// It returns when the connection is closed or the context is cancelled.
+func (c *Client) Run(ctx context.Context) (err error) {
+	defer func() {
+		for _, t := range c.group() {
+			t.setStopped(err)
+		}
 	}()
+	return c.run(ctx)
+}
 
-	// Open Stream 0 (control stream)
-	stream, err := session.OpenStream()
+func (c *Client) run(ctx context.Context) error {
+	for _, t := range c.group() {
+		t.updateStatus(func(st *Status) { st.State = StateConnecting })
+	}
+	session, err := c.connect(ctx)
+	if errors.Is(err, ErrHostKeyChanged) {
+		return newError(CodeHostKeyChanged, "", err)
+	}
+	if hopErr := (*Error)(nil); errors.As(err, &hopErr) {
+		return err // a relay hop refused, with its own code
+	}
+	if err != nil {
+		return newError(CodeConnect, "", err)
+	}
+
+	timing, err := c.register()
 	if err != nil {
 		session.Close()
-		return fmt.Errorf("failed to open control stream: %w", err)
+		return err
+	}
+	routes := map[string]tunnelRoute{c.tunnelID: {c, timing}}
+	for _, t := range c.tunnels {
+		timing, err := c.openTunnel(ctx, session, t)
+		if err != nil {
+			session.Close()
+			return err
+		}
+		routes[t.tunnelID] = tunnelRoute{t, timing}
 	}
 
-	log.Debug("control stream opened", "stream_id", stream.StreamID())
+	// Start heartbeat sender and control message reader
+	c.closeReason.Store(nil)
+	go c.sendHeartbeats(ctx)
+	go c.readControl(session)
+	if c.netmon != nil {
+		watchDone := make(chan struct{})
+		defer close(watchDone)
+		go c.watchNetwork(session, c.serverLocalAddr, watchDone)
+	}
 
-	c.controlStream = protocol.NewControlStream(stream)
+	log.Info("Forwarding requests", "to", c.localAddr)
+
+	// Accept and handle streams from the server
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrShutdown
+			}
+			log.Debug("failed to accept stream", "error", err)
+			err = newError(CodeSessionLost, "", fmt.Errorf("session closed: %w", err))
+			for _, t := range c.group() {
+				if t.transfer.exceeded.Load() {
+					err = newError(CodeTransferLimit, "", fmt.Errorf("%w: %s", ErrTransferLimit, bytesize.Format(t.transfer.max)))
+					break
+				}
+				if reason := t.closeReason.Load(); reason != nil {
+					// The server ended the tunnel deliberately; don't reconnect
+					code := reason.Code
+					if code == "" {
+						code = CodeClosedByServer
+					}
+					cause := ErrPermanentFailure
+					if code == protocol.ErrCodeHandedOver {
+						cause = ErrHandedOver
+					}
+					err = newError(code, reason.Message, fmt.Errorf("%w: %s", cause, reason.Message))
+					break
+				}
+			}
+			for _, t := range c.group() {
+				t.emit(Event{Type: EventDisconnected, Err: err})
+			}
+			return err
+		}
+
+		log.Debug("accepted stream from server", "stream_id", stream.StreamID())
+
+		// Handle each stream concurrently
+		go c.serveStream(ctx, session, stream, routes)
+	}
+}
 
+// register registers the tunnel over the control stream, returning whether
+// responses start with a timing line. The caller closes the session if it
+// fails.
+func (c *Client) register() (timing bool, err error) {
 	// Send register message - use assigned subdomain if reconnecting
 	subdomain := c.subdomain
 	if c.assignedSubdomain != "" {
 		subdomain = c.assignedSubdomain
 	}
-	if err := c.controlStream.SendRegister(subdomain, c.token); err != nil {
-		session.Close()
-		return fmt.Errorf("failed to send register message: %w", err)
+	register := &protocol.RegisterMessage{
+		Subdomain:        subdomain,
+		Token:            c.token,
+		MaxResponseBytes: c.maxResponseBytes,
+		Warnings:         true,
+		Timing:           !c.tcp && !c.tlsPassthrough,
+		Labels:           c.labels,
+		StripHeaders:     c.stripHeaders,
+		AccessSecret:     c.accessSecret,
+		ClientCA:         c.clientCA,
+		WebhookSignature: c.webhookSignature,
+		ReplayProtection: c.replayProtection,
+		ABTest:           c.abTest,
+		GeoPolicy:        c.geoPolicy,
+		Challenge:        c.challenge,
+		Honeytokens:      c.honeytokens,
+		JWT:              c.jwt,
+		ResumeToken:      c.resumeToken,
+		HandoverToken:    c.handoverFrom,
+		Canary:           c.canary,
+		TunnelID:         c.tunnelID,
+	}
+	if c.ownerKey != nil {
+		register.OwnerKey = protocol.EncodeOwnerKey(c.ownerKey.Public().(ed25519.PublicKey))
+	}
+	if c.tlsPassthrough {
+		register.Protocol = protocol.ProtocolTLS
+	}
+	if c.tcp {
+		register.Protocol = protocol.ProtocolTCP
+		register.RemotePort = c.remotePort
+		if register.RemotePort == 0 {
+			// Keep the same public port across reconnects
+			register.RemotePort = c.assignedPort
+		}
+	}
+	if err := c.controlStream.SendRegisterMessage(register); err != nil {
+		return false, newError(CodeConnect, "", fmt.Errorf("failed to send register message: %w", err))
 	}
 
-	// Wait for registered message
+	// Wait for registered message, proving ownership of the subdomain first
+	// if the server asks
 	msg, err := c.controlStream.ReadMessage()
+	if challenge, ok := msg.(*protocol.ChallengeMessage); ok && c.ownerKey != nil {
+		err = c.controlStream.SendChallengeReply(protocol.SignOwnership(c.ownerKey, challenge.Subdomain, challenge.Nonce))
+		if err == nil {
+			msg, err = c.controlStream.ReadMessage()
+		}
+	}
 	if err != nil {
-		session.Close()
-		return fmt.Errorf("failed to read registered message: %w", err)
+		return false, newError(CodeConnect, "", fmt.Errorf("failed to read registered message: %w", err))
 	}
 
 	switch m := msg.(type) {
 	case *protocol.RegisteredMessage:
 		c.tunnelURL = m.URL
 		c.assignedSubdomain = m.Subdomain
+		c.assignedPort = m.RemotePort
+		c.resumeToken = m.ResumeToken
+		c.handoverFrom = "" // the tunnel is ours now
+		c.handoverToken = m.HandoverToken
 		log.Info("Tunnel ready!", "url", c.tunnelURL)
+		if a := m.Anonymous; a != nil {
+			logAnonymousLimits(a)
+		}
+		c.emit(Event{Type: EventRegistered, URL: m.URL, Subdomain: m.Subdomain, HandoverToken: m.HandoverToken})
+		return m.Timing, nil
 	case *protocol.ErrorMessage:
-		session.Close()
-		return fmt.Errorf("registration failed: %s", m.Message)
+		c.resumeToken = "" // spent on this attempt
+		if m.Code == protocol.ErrCodePortInUse && c.remotePort == 0 {
+			// The previously assigned port was taken; accept any port next time
+			c.assignedPort = 0
+		}
+		return false, registrationError(m)
 	default:
+		return false, fmt.Errorf("unexpected message type: %T", msg)
+	}
+}
+
+// connect dials the server, creates the multiplexed session, and opens the
+// control stream. The session is closed when ctx is cancelled.
+func (c *Client) connect(ctx context.Context) (transport.Session, error) {
+	log.Debug("connecting to server", "server", c.serverAddr)
+
+	// Connect to the tunnel server
+	conn, err := c.dialServer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server %s: %w", c.serverAddr, err)
+	}
+
+	log.Debug("tcp connection established", "server", c.serverAddr)
+
+	// Select the muxer and create the session (client side)
+	if err := transport.WritePreface(conn, c.muxer); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send muxer preface: %w", err)
+	}
+	session, err := c.muxer.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.session = session
+	c.serverLocalAddr = conn.LocalAddr()
+
+	// Watch for context cancellation and close session
+	go func() {
+		<-ctx.Done()
 		session.Close()
-		return fmt.Errorf("unexpected message type: %T", msg)
+	}()
+
+	// Open Stream 0 (control stream)
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open control stream: %w", err)
 	}
 
-	// Start heartbeat sender
-	go c.sendHeartbeats(ctx)
+	log.Debug("control stream opened", "stream_id", stream.StreamID())
 
-	log.Info("Forwarding requests", "to", c.localAddr)
+	c.controlStream = protocol.NewControlStream(stream)
+	return session, nil
+}
 
-	// Accept and handle streams from the server
+// readControl reads control messages from the server after registration.
+// An error message means the server is ending the tunnel (e.g. another
+// client took over the subdomain): the reason is recorded and the session
+// closed so Run returns.
+func (c *Client) readControl(session transport.Session) {
 	for {
-		stream, err := session.AcceptStream()
+		msg, err := c.controlStream.ReadMessage()
 		if err != nil {
-			if ctx.Err() != nil {
-				return ErrShutdown
-			}
-			log.Debug("failed to accept stream", "error", err)
-			return fmt.Errorf("session closed: %w", err)
+			return
 		}
 
-		log.Debug("accepted stream from server", "stream_id", stream.StreamID())
+		switch m := msg.(type) {
+		case *protocol.HeartbeatAckMessage:
+			log.Debug("heartbeat ack received")
+		case *protocol.WarningMessage:
+			log.Warn(m.Message, "limit", m.Limit, "used", m.Used, "max", m.Max)
+			c.emit(Event{Type: EventLimitWarning, Limit: m.Limit, Message: m.Message})
+		case *protocol.IntrusionMessage:
+			log.Warn("Honeytoken touched; the tunnel URL may have leaked", "method", m.Method, "path", m.Path, "ip", m.RemoteAddr)
+			c.emit(Event{Type: EventIntrusion, Message: m.Method + " " + m.Path, RemoteAddr: m.RemoteAddr})
+		case *protocol.ErrorMessage:
+			if m.Code == protocol.ErrCodeHandedOver {
+				log.Info("Tunnel handed over to another client")
+			} else {
+				log.Error("tunnel closed by server", "reason", m.Message)
+			}
+			c.closeReason.Store(m)
+			session.Close()
+			return
+		default:
+			log.Debug("unexpected control message", "type", fmt.Sprintf("%T", msg))
+		}
+	}
+}
 
-		// Handle each stream concurrently
-		go c.handleStream(stream)
+// logAnonymousLimits tells the user about the limits the server puts on a
+// tunnel opened without an API key.
+func logAnonymousLimits(a *protocol.AnonymousLimits) {
+	var attrs []any
+	if a.Lifetime > 0 {
+		attrs = append(attrs, "closes_in", time.Duration(a.Lifetime)*time.Second)
 	}
+	if a.BytesPerSecond > 0 {
+		attrs = append(attrs, "bandwidth", bytesize.Format(a.BytesPerSecond)+"/s")
+	}
+	log.Warn("No API key; the server limits this tunnel (pass --token to lift them)", attrs...)
 }
 
 // sendHeartbeats sends periodic heartbeat messages to the server.
@@ -193,18 +755,28 @@ func (c *Client) sendHeartbeats(ctx context.Context) {
 }
 
 // RunWithReconnect runs the client with automatic reconnection on transient failures.
-func (c *Client) RunWithReconnect(ctx context.Context) error {
+func (c *Client) RunWithReconnect(ctx context.Context) (err error) {
+	defer func() {
+		for _, t := range c.group() {
+			t.setStopped(err)
+		}
+	}()
 	if !c.reconnect {
-		return c.Run(ctx)
+		return c.run(ctx)
 	}
 
 	backoff := NewBackoff(c.backoffConfig)
+	var networkChanges func() <-chan struct{}
+	if c.networkMonitor {
+		c.netmon = startNetMonitor(ctx)
+		networkChanges = c.netmon.changed
+	}
 
 	for {
 		// Clear tunnelURL to detect successful registration
 		c.tunnelURL = ""
 
-		err := c.Run(ctx)
+		err := c.run(ctx)
 
 		// If we connected successfully before failing, reset backoff
 		if c.tunnelURL != "" {
@@ -223,16 +795,32 @@ func (c *Client) RunWithReconnect(ctx context.Context) error {
 		}
 
 		delay := backoff.NextDelay()
+		var retryAfter *RetryAfterError
+		if errors.As(err, &retryAfter) {
+			delay = backoff.NextDelayAtLeast(retryAfter.After)
+		} else if c.networkChanged.Swap(false) {
+			// The old network is gone; the new one is worth trying at once
+			delay = 0
+		}
+		for _, t := range c.group() {
+			t.emit(Event{Type: EventReconnecting, Err: err, Attempt: backoff.Attempt(), Delay: delay})
+		}
 		log.Warn("connection lost, reconnecting...",
 			"error", err,
 			"attempt", backoff.Attempt(),
 			"delay", delay.Round(time.Millisecond),
 		)
 
+		var changed <-chan struct{}
+		if networkChanges != nil {
+			changed = networkChanges()
+		}
 		select {
 		case <-ctx.Done():
 			return ErrShutdown
 		case <-time.After(delay):
+		case <-changed:
+			log.Info("Network changed, retrying now")
 		}
 
 		log.Info("attempting to reconnect",
@@ -242,27 +830,80 @@ func (c *Client) RunWithReconnect(ctx context.Context) error {
 	}
 }
 
-// handleStream handles a single stream by proxying it to the local service.
-func (c *Client) handleStream(stream *yamux.Stream) {
+// handleStream handles a single stream through the interceptors.
+func (c *Client) handleStream(ctx context.Context, stream transport.Stream) {
+	c.counters.streams.Add(1)
+	c.counters.activeStreams.Add(1)
+	defer c.counters.activeStreams.Add(-1)
+	c.streamHandler()(ctx, stream)
+}
+
+// proxyStream proxies a single stream to the local service.
+func (c *Client) proxyStream(ctx context.Context, stream transport.Stream) {
+	if c.tcp || c.tlsPassthrough {
+		c.handleTCPStream(ctx, stream)
+		return
+	}
+
 	// Read only the first line to log the request (e.g., "GET /path HTTP/1.1")
+	start := time.Now()
 	reader := bufio.NewReader(stream)
 	requestLine, err := reader.ReadString('\n')
+	var method string
 	if err == nil {
-		method, path := parseRequestLine(requestLine)
-		if method != "" {
+		var path string
+		method, path = parseRequestLine(requestLine)
+		if method != "" && c.verbose() {
 			log.Info("Request", "method", method, "path", path)
 		}
 	}
 
+	dialStart := time.Now()
+	release, err := c.acquireLocal(ctx)
+	recordDial(ctx, time.Since(dialStart))
+	if err != nil {
+		log.Warn("local service busy", "error", err, "local", c.localAddr)
+		if method != "" {
+			c.stats.record(http.StatusServiceUnavailable, time.Since(start), 0, 0)
+			io.WriteString(stream, busyResponse)
+		}
+		stream.Close()
+		return
+	}
+	defer release()
+
 	// Connect to the local service
-	localConn, err := net.Dial("tcp", c.localAddr)
+	dialed, err := c.dialLocal(ctx)
+	recordDial(ctx, time.Since(dialStart))
 	if err != nil {
 		log.Error("failed to connect to local service", "error", err, "local", c.localAddr)
+		if method != "" {
+			c.stats.record(http.StatusBadGateway, time.Since(start), 0, 0)
+			io.WriteString(stream, unavailableResponse)
+		}
 		stream.Close()
 		return
 	}
+	localConn := &meteredConn{Conn: dialed}
+	if method != "" {
+		if c.inspector != nil {
+			localConn.reqCapture = &captureBuffer{}
+			localConn.respCapture = &captureBuffer{}
+		}
+		defer func() {
+			latency := localConn.firstByte.Sub(start)
+			c.stats.record(localConn.status, latency, localConn.up.Load(), localConn.down.Load())
+			if c.inspector != nil {
+				for _, r := range parseExchanges(localConn.reqCapture, localConn.respCapture, start, max(latency, 0)) {
+					c.inspector.add(r)
+				}
+			}
+		}()
+	}
 
-	log.Debug("connected to local service", "local", c.localAddr, "stream_id", stream.StreamID())
+	if c.verbose() {
+		log.Debug("connected to local service", "local", c.localAddr, "stream_id", stream.StreamID())
+	}
 
 	// Write the request line we already read
 	if _, err := localConn.Write([]byte(requestLine)); err != nil {
@@ -276,7 +917,42 @@ func (c *Client) handleStream(stream *yamux.Stream) {
 	streamReader := io.MultiReader(reader, stream)
 	combinedStream := &readerConn{Reader: streamReader, Conn: stream}
 
-	if err := proxy.Bidirectional(combinedStream, localConn); err != nil {
+	err = proxy.BidirectionalContext(ctx, combinedStream, localConn)
+	if !c.verbose() {
+		return
+	}
+	if err != nil {
+		log.Debug("stream completed", "stream_id", stream.StreamID(), "error", err)
+	} else {
+		log.Debug("stream completed", "stream_id", stream.StreamID())
+	}
+}
+
+// handleTCPStream proxies a raw TCP stream to the local service.
+func (c *Client) handleTCPStream(ctx context.Context, stream transport.Stream) {
+	release, err := c.acquireLocal(ctx)
+	if err != nil {
+		log.Warn("local service busy", "error", err, "local", c.localAddr)
+		stream.Close()
+		return
+	}
+	defer release()
+
+	localConn, err := c.dialLocalService(ctx)
+	if err != nil {
+		log.Error("failed to connect to local service", "error", err, "local", c.localAddr)
+		stream.Close()
+		return
+	}
+
+	if c.verbose() {
+		log.Info("Connection", "stream_id", stream.StreamID())
+	}
+	err = proxy.BidirectionalContext(ctx, stream, localConn)
+	if !c.verbose() {
+		return
+	}
+	if err != nil {
 		log.Debug("stream completed", "stream_id", stream.StreamID(), "error", err)
 	} else {
 		log.Debug("stream completed", "stream_id", stream.StreamID())
@@ -302,6 +978,17 @@ func (r *readerConn) Read(p []byte) (int, error) {
 	return r.Reader.Read(p)
 }
 
+// CloseWrite half-closes the connection if it supports it, which
+// embedding net.Conn would hide. Without it the server never learns the
+// local service finished, and the stream (and its local connection slot)
+// stays open.
+func (r *readerConn) CloseWrite() error {
+	if hc, ok := r.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
 // Close closes the client session.
 func (c *Client) Close() error {
 	if c.session != nil {
@@ -315,6 +1002,11 @@ func (c *Client) TunnelURL() string {
 	return c.tunnelURL
 }
 
+// RemotePort returns the public port of a TCP tunnel.
+func (c *Client) RemotePort() int {
+	return c.assignedPort
+}
+
 // Subdomain returns the assigned subdomain.
 func (c *Client) Subdomain() string {
 	return c.assignedSubdomain
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/transport"
+	"github.com/charmbracelet/log"
+)
+
+// DefaultDenyPaths are the paths commonly exposed by accident when
+// tunneling a project directory or framework dev server.
+var DefaultDenyPaths = []string{"/.git", "/.env", ".DS_Store"}
+
+// deniedResponse answers requests for denied paths without reaching the
+// local service.
+const deniedResponse = "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 10\r\nConnection: close\r\n\r\nNot Found\n"
+
+// WithDenyPaths makes the client answer 404 itself for requests matching
+// any of rules instead of forwarding them. A rule starting with "/" matches
+// that path and everything below it; any other rule matches a path segment
+// anywhere (e.g. ".DS_Store"). Matching ignores case and is done on the
+// decoded, cleaned path, so "/a/../.ENV" is caught by "/.env".
+func (c *Client) WithDenyPaths(rules []string) *Client {
+	c.denyPaths = rules
+	return c
+}
+
+// pathDenied reports whether the request target matches any of rules.
+func pathDenied(rules []string, target string) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return false
+	}
+	p := strings.ToLower(path.Clean("/" + u.Path))
+
+	for _, rule := range rules {
+		rule = strings.ToLower(rule)
+		if strings.HasPrefix(rule, "/") {
+			rule = path.Clean(rule)
+			if p == rule || strings.HasPrefix(p, rule+"/") {
+				return true
+			}
+			continue
+		}
+		for _, segment := range strings.Split(p, "/") {
+			if segment == rule {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denyPathsInterceptor answers requests for denied paths with 404.
+func (c *Client) denyPathsInterceptor(next StreamHandler) StreamHandler {
+	return func(ctx context.Context, stream transport.Stream) {
+		start := time.Now()
+		req, replay, err := PeekRequest(stream)
+		if err == nil && pathDenied(c.denyPaths, req.RequestURI) {
+			log.Warn("Denied request", "method", req.Method, "path", req.RequestURI)
+			c.stats.record(http.StatusNotFound, time.Since(start), 0, 0)
+			io.WriteString(stream, deniedResponse)
+			stream.Close()
+			return
+		}
+		next(ctx, replay)
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestPathDenied(t *testing.T) {
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"/", false},
+		{"/index.html", false},
+		{"/.git", true},
+		{"/.git/config", true},
+		{"/.github/workflows", false},
+		{"/.env", true},
+		{"/.ENV", true},
+		{"/.env.local", false},
+		{"/static/../.env", true},
+		{"/%2egit/HEAD", true},
+		{"/assets/.DS_Store", true},
+		{"/assets/.ds_store", true},
+		{"/sub/.git/config", false},
+		{"http://app.example.com/.git/config", true},
+		{"/?file=/.env", false},
+		{"*", false},
+	}
+	for _, tt := range tests {
+		if got := pathDenied(DefaultDenyPaths, tt.target); got != tt.want {
+			t.Errorf("pathDenied(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+
+	if pathDenied(nil, "/.git") {
+		t.Error("pathDenied with no rules denied a request")
+	}
+}
+
+func TestHandleStreamDeniesPath(t *testing.T) {
+	// Nothing listens locally: a denied request must not be forwarded
+	c := New("", "127.0.0.1:1").WithDenyPaths(DefaultDenyPaths)
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	io.WriteString(server, "GET /.env HTTP/1.1\r\nHost: app\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+	if got := c.Stats().Statuses[http.StatusNotFound]; got != 1 {
+		t.Errorf("recorded 404s = %d, want 1", got)
+	}
+}
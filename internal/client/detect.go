@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// bannerWait is how long detection waits for a service that speaks
+	// first, such as SSH or SMTP.
+	bannerWait = 250 * time.Millisecond
+
+	// detectHandshakeTimeout bounds the TLS handshake tried during
+	// detection; a plain HTTP server may never answer it.
+	detectHandshakeTimeout = time.Second
+)
+
+// ErrNotHTTP is returned by DetectUpstreamProto for a local service that
+// speaks neither HTTP nor HTTPS.
+var ErrNotHTTP = errors.New("local service does not speak HTTP")
+
+// DetectUpstreamProto probes the local service to find whether it speaks
+// plain HTTP (UpstreamHTTP1) or HTTPS (UpstreamHTTPS). Services that send
+// something before the client does, or don't answer an HTTP request, get
+// ErrNotHTTP. Probing sends the service one HEAD request; ctx should have
+// a deadline.
+func (c *Client) DetectUpstreamProto(ctx context.Context) (UpstreamProto, error) {
+	conn, err := c.dialLocalAddr(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to local service: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(bannerWait))
+	if n, _ := conn.Read(make([]byte, 1)); n > 0 {
+		return "", fmt.Errorf("%w: it sends data before the client", ErrNotHTTP)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	hsCtx, cancel := context.WithTimeout(ctx, detectHandshakeTimeout)
+	err = tls.Client(conn, c.localTLSConfig()).HandshakeContext(hsCtx)
+	cancel()
+	if err == nil {
+		return UpstreamHTTPS, nil
+	}
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	plain, err := c.dialLocalAddr(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to local service: %w", err)
+	}
+	defer plain.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		plain.SetDeadline(deadline)
+	}
+	fmt.Fprintf(plain, "HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", c.localHost())
+	resp, err := http.ReadResponse(bufio.NewReader(plain), nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNotHTTP, err)
+	}
+	resp.Body.Close()
+	return UpstreamHTTP1, nil
+}
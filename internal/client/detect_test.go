@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// bannerServer listens for a service that greets clients before they send
+// anything, like SSH.
+func bannerServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "SSH-2.0-test\r\n")
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDetectUpstreamProto(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	tests := []struct {
+		name    string
+		addr    string
+		want    UpstreamProto
+		wantErr error
+	}{
+		{name: "http", addr: plain.Listener.Addr().String(), want: UpstreamHTTP1},
+		{name: "https", addr: secure.Listener.Addr().String(), want: UpstreamHTTPS},
+		{name: "server speaks first", addr: bannerServer(t), wantErr: ErrNotHTTP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := New("", tt.addr).DetectUpstreamProto(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DetectUpstreamProto() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DetectUpstreamProto() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleStreamHTTPSUpstream(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure "+r.URL.Path)
+	}))
+	defer local.Close()
+
+	c := New("", local.Listener.Addr().String()).WithUpstreamProto(UpstreamHTTPS)
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	io.WriteString(server, "GET /page HTTP/1.1\r\nHost: app\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secure /page" {
+		t.Errorf("body = %q, want the local service's body", body)
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/charmbracelet/log"
+)
+
+// Dialer establishes network connections. *net.Dialer satisfies it, as do
+// SOCKS dialers from golang.org/x/net/proxy and in-memory test dialers.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialServer connects to the tunnel server, directly or through the relay
+// hops set with WithVia, performing a TLS handshake if a TLS config was
+// provided.
+func (c *Client) dialServer(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if len(c.via) > 0 {
+		conn, err = c.dialVia(ctx)
+	} else {
+		conn, err = c.dialServerTCP(ctx)
+		if err == nil {
+			if err := c.keepAlive.Apply(conn); err != nil {
+				log.Warn("failed to tune server connection", "error", err)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.secureConn(ctx, conn, c.serverAddr)
+}
+
+// dialServerTCP connects to the server's address, trying each address the
+// resolver (if set) found for it in turn.
+func (c *Client) dialServerTCP(ctx context.Context) (net.Conn, error) {
+	if c.resolver == nil {
+		return c.serverDialer.DialContext(ctx, "tcp", c.serverAddr)
+	}
+
+	addrs, err := c.resolveServer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server: %w", err)
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := c.serverDialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			c.serverAddrWorked(addr)
+			return conn, nil
+		}
+		log.Debug("failed to connect to server address", "addr", addr, "error", err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
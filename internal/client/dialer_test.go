@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+// pipeDialer hands out in-memory connections, delivering the far end on conns.
+type pipeDialer struct {
+	conns chan net.Conn
+	addrs chan string
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{
+		conns: make(chan net.Conn, 1),
+		addrs: make(chan string, 1),
+	}
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	near, far := net.Pipe()
+	d.addrs <- address
+	d.conns <- far
+	return near, nil
+}
+
+func TestInMemoryDialers(t *testing.T) {
+	serverDialer := newPipeDialer()
+	localDialer := newPipeDialer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := New("tunnel.test:4443", "app.test:3000").
+		WithServerDialer(serverDialer).
+		WithLocalDialer(localDialer)
+	go c.Run(ctx)
+
+	if addr := <-serverDialer.addrs; addr != "tunnel.test:4443" {
+		t.Errorf("server dialer got address %q, want %q", addr, "tunnel.test:4443")
+	}
+
+	// Act as the tunnel server
+	session, err := yamux.Server(<-serverDialer.conns, nil)
+	if err != nil {
+		t.Fatalf("failed to create yamux session: %v", err)
+	}
+	defer session.Close()
+
+	control, err := session.AcceptStream()
+	if err != nil {
+		t.Fatalf("failed to accept control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(control)
+	if _, err := cs.ReadMessage(); err != nil {
+		t.Fatalf("failed to read register message: %v", err)
+	}
+	if err := cs.SendRegistered("http://mem.test", "mem"); err != nil {
+		t.Fatalf("failed to send registered message: %v", err)
+	}
+
+	select {
+	case <-c.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not register")
+	}
+
+	// Send a request through the tunnel
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer stream.Close()
+	if _, err := io.WriteString(stream, "GET /hello HTTP/1.1\r\nHost: mem.test\r\n\r\n"); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+
+	// Act as the local service
+	if addr := <-localDialer.addrs; addr != "app.test:3000" {
+		t.Errorf("local dialer got address %q, want %q", addr, "app.test:3000")
+	}
+	local := <-localDialer.conns
+	req, err := http.ReadRequest(bufio.NewReader(local))
+	if err != nil {
+		t.Fatalf("local service failed to read request: %v", err)
+	}
+	if req.URL.Path != "/hello" {
+		t.Errorf("local service got path %q, want /hello", req.URL.Path)
+	}
+	io.WriteString(local, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi")
+	local.Close()
+
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hi" {
+		t.Errorf("response body = %q, want %q", body, "hi")
+	}
+}
+
+func TestDialServerTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name    string
+		cfg     *tls.Config
+		wantErr bool
+	}{
+		{"trusted certificate", &tls.Config{RootCAs: pool, ServerName: "example.com"}, false},
+		{"untrusted certificate", &tls.Config{ServerName: "example.com"}, true},
+		{"wrong server name", &tls.Config{RootCAs: pool, ServerName: "other.test"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(srv.Listener.Addr().String(), "").WithTLSConfig(tt.cfg)
+
+			conn, err := c.dialServer(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				if _, ok := conn.(*tls.Conn); !ok {
+					t.Errorf("expected *tls.Conn, got %T", conn)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"syscall"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
 )
 
 // Sentinel errors for client operations.
@@ -19,8 +23,169 @@ var (
 
 	// ErrMaxRetriesExceeded indicates the maximum number of reconnection attempts was reached.
 	ErrMaxRetriesExceeded = errors.New("maximum reconnection attempts exceeded")
+
+	// ErrHandedOver indicates another client took the tunnel over with its
+	// handover token, after this one finished its in-flight requests.
+	ErrHandedOver = errors.New("tunnel handed over")
+
+	// ErrTransferLimit indicates the tunnel carried as much data as
+	// WithMaxTransfer allows.
+	ErrTransferLimit = errors.New("transfer cap reached")
+)
+
+// RetryAfterError is a transient failure for which the server asked the
+// client to wait before reconnecting, e.g. while it is overloaded.
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.After)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// Error codes for failures that don't come from the server. Errors the
+// server reports carry its code, one of the protocol.ErrCode constants, or
+// CodeRegistration if it sent none.
+const (
+	CodeConnect        = "connect_failed"
+	CodeRegistration   = "registration_failed"
+	CodeSessionLost    = "session_lost"
+	CodeClosedByServer = "closed_by_server"
+	CodeMaxRetries     = "max_retries_exceeded"
+	CodeTransferLimit  = "transfer_limit_reached"
+	CodeHostKeyChanged = "host_key_changed"
+	CodeShutdown       = "shutdown"
+	CodeUnknown        = "unknown"
 )
 
+// hints suggest what to do about an error, by code.
+var hints = map[string]string{
+	protocol.ErrCodePortInUse:              "Another tunnel holds this public port; request a different port or none",
+	protocol.ErrCodePortReserved:           "The server reserves this port; request a different one",
+	protocol.ErrCodePortNotAllowed:         "The port is outside the range the server allows; request a different port or none",
+	protocol.ErrCodeTCPDisabled:            "This server does not offer TCP tunnels",
+	protocol.ErrCodeServerFull:             "The server has reached its tunnel limit; try again later or use another server",
+	protocol.ErrCodeServerBusy:             "The server is overloaded; the client keeps retrying",
+	protocol.ErrCodeTunnelBlocked:          "The server operator took this subdomain down; contact them",
+	protocol.ErrCodeInvalidLabels:          "Fix the tunnel labels",
+	protocol.ErrCodeInvalidHeaders:         "Fix the response header names to strip",
+	protocol.ErrCodeInvalidAccess:          "Check the access secret (16+ characters) and client CA bundle",
+	protocol.ErrCodeUnauthorized:           "Check the API key",
+	protocol.ErrCodeSubdomainTaken:         "Another client is using this subdomain; pick a different one",
+	protocol.ErrCodeSubdomainReserved:      "This subdomain belongs to another API key; pick a different one",
+	protocol.ErrCodeInvalidSignature:       "Check the webhook signature settings",
+	protocol.ErrCodeInvalidReplay:          "Check the replay protection settings",
+	protocol.ErrCodeInvalidABTest:          "Check the A/B buckets: 2 to 10 names with percentages adding up to 100",
+	protocol.ErrCodeInvalidGeoPolicy:       "Check the countries and ASNs; geo policies also need a server started with -geoip",
+	protocol.ErrCodeInvalidChallenge:       "Check the challenge settings; turnstile and hcaptcha need the server operator's keys, js always works",
+	protocol.ErrCodeInvalidHoneytoken:      "Check the trap paths: absolute paths other than /, up to 100, and a ban of at most 168h",
+	protocol.ErrCodeInvalidJWTPolicy:       "Check the JWT settings: the JWKS URL must be https and serve keys the server can read",
+	protocol.ErrCodeTLSPassthroughDisabled: "This server does not offer TLS passthrough tunnels",
+	protocol.ErrCodeInvalidOwnerKey:        "Owner keys only apply to HTTP and TLS tunnels",
+	protocol.ErrCodeOwnerKeyMismatch:       "This subdomain is bound to an owner key; run with --owner-key set to its key file, or pick a different subdomain",
+	protocol.ErrCodeInvalidMessage:         "The server refused a control message; if it runs with -reject-unknown-fields, it may be older than this client",
+	protocol.ErrCodeInvalidHandover:        "The handover token doesn't belong to the client serving this subdomain; run without --handover",
+	protocol.ErrCodeInvalidCanary:          "A canary joins a running HTTP tunnel; start that tunnel first, with the same API key and --subdomain",
+	protocol.ErrCodeAnonymousRestricted:    "Without an API key this server only offers HTTP tunnels on a random subdomain; pass --token for the rest",
+	protocol.ErrCodeLifetimeExpired:        "Tunnels without an API key only last so long on this server; restart for a new one, or pass --token",
+	protocol.ErrCodeRelayNotAllowed:        "A --via server doesn't relay to the next server; its operator must add it to -relay-to",
+	protocol.ErrCodeRelayFailed:            "A --via server couldn't reach the next server; check that it is up",
+	protocol.ErrCodeTooManyTunnels:         "The server limits the tunnels one connection carries; run some of them as a separate otun process",
+	protocol.ErrCodeGroupPolicy:            "The server's operator requires tunnels like this one to be private; add --access-secret, --client-ca or --jwt-jwks-url",
+	CodeConnect:                            "Check the server address and your network connection",
+	CodeMaxRetries:                         "The server stayed unreachable; check that it is up",
+	CodeTransferLimit:                      "The tunnel carried as much data as --max-transfer allows; raise it or restart the tunnel to start counting again",
+	CodeHostKeyChanged:                     "The server's key differs from the one in the known hosts file; if its operator confirms the change, delete the server's line from the file",
+}
+
+// Error is a client failure with what a UI needs to present it: a stable
+// code, whether reconnecting may help, and a hint for the user. Errors
+// returned by Run, RunWithReconnect and events can be inspected with
+// AsError.
+type Error struct {
+	// Code is one of the Code constants or a protocol.ErrCode constant
+	Code string
+
+	// Message is the server's message, if the server reported the error
+	Message string
+
+	// Retryable is false if reconnecting can't fix the error
+	Retryable bool
+
+	// Hint suggests what to do, if there is anything
+	Hint string
+
+	Err error
+}
+
+func newError(code, message string, err error) *Error {
+	return &Error{Code: code, Message: message, Retryable: !isPermanentError(err), Hint: hints[code], Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// AsError returns err as an *Error, classifying errors that don't carry one
+// by what they wrap. It returns nil for a nil err.
+func AsError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	switch {
+	case errors.Is(err, ErrShutdown):
+		return newError(CodeShutdown, "", err)
+	case errors.Is(err, ErrMaxRetriesExceeded):
+		return newError(CodeMaxRetries, "", err)
+	}
+	return newError(CodeUnknown, "", err)
+}
+
+// registrationError converts a registration error from the server. Errors
+// that retrying can't fix (reserved or disallowed ports, TCP or TLS
+// passthrough disabled, a blocked subdomain, a bad API key, a subdomain
+// owned by another key or bound to another owner key, another client's
+// handover token, a tunnel the anonymous tier doesn't allow, invalid labels, header rules, private tunnel, webhook
+// signature, JWT, replay protection or A/B test settings, too many tunnels
+// on the connection) are permanent; a port or
+// subdomain in use may free up, and the tunnel a canary joins may come up,
+// so they are retried. If the server says when
+// to retry, the error wraps a *RetryAfterError.
+func registrationError(m *protocol.ErrorMessage) *Error {
+	code := m.Code
+	if code == "" {
+		code = CodeRegistration
+	}
+	switch m.Code {
+	case protocol.ErrCodePortReserved, protocol.ErrCodePortNotAllowed, protocol.ErrCodeTCPDisabled, protocol.ErrCodeTunnelBlocked, protocol.ErrCodeInvalidLabels,
+		protocol.ErrCodeInvalidHeaders, protocol.ErrCodeInvalidAccess, protocol.ErrCodeInvalidSignature,
+		protocol.ErrCodeInvalidReplay, protocol.ErrCodeInvalidABTest, protocol.ErrCodeInvalidGeoPolicy, protocol.ErrCodeInvalidChallenge, protocol.ErrCodeInvalidHoneytoken,
+		protocol.ErrCodeInvalidJWTPolicy, protocol.ErrCodeTLSPassthroughDisabled, protocol.ErrCodeUnauthorized, protocol.ErrCodeSubdomainReserved,
+		protocol.ErrCodeInvalidOwnerKey, protocol.ErrCodeOwnerKeyMismatch, protocol.ErrCodeInvalidHandover, protocol.ErrCodeInvalidMessage,
+		protocol.ErrCodeAnonymousRestricted, protocol.ErrCodeInvalidTunnelID, protocol.ErrCodeTooManyTunnels,
+		protocol.ErrCodeGroupPolicy:
+		return newError(code, m.Message, fmt.Errorf("%w: registration failed: %s", ErrPermanentFailure, m.Message))
+	}
+	var err error = fmt.Errorf("registration failed: %s", m.Message)
+	if m.RetryAfter > 0 {
+		err = &RetryAfterError{Err: err, After: time.Duration(m.RetryAfter) * time.Second}
+	}
+	return newError(code, m.Message, err)
+}
+
 // isPermanentError returns true if the error should not trigger a reconnection attempt.
 func isPermanentError(err error) bool {
 	if err == nil {
@@ -31,6 +196,9 @@ func isPermanentError(err error) bool {
 	if errors.Is(err, ErrShutdown) ||
 		errors.Is(err, ErrPermanentFailure) ||
 		errors.Is(err, ErrSubdomainTaken) ||
+		errors.Is(err, ErrHandedOver) ||
+		errors.Is(err, ErrTransferLimit) ||
+		errors.Is(err, ErrHostKeyChanged) ||
 		errors.Is(err, ErrMaxRetriesExceeded) {
 		return true
 	}
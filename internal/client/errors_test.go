@@ -6,6 +6,9 @@ import (
 	"net"
 	"syscall"
 	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
 )
 
 func TestIsPermanentError(t *testing.T) {
@@ -19,6 +22,8 @@ func TestIsPermanentError(t *testing.T) {
 		{"ErrPermanentFailure", ErrPermanentFailure, true},
 		{"ErrSubdomainTaken", ErrSubdomainTaken, true},
 		{"ErrMaxRetriesExceeded", ErrMaxRetriesExceeded, true},
+		{"ErrTransferLimit", ErrTransferLimit, true},
+		{"ErrHostKeyChanged", ErrHostKeyChanged, true},
 		{"wrapped ErrShutdown", fmt.Errorf("outer: %w", ErrShutdown), true},
 		{"wrapped ErrSubdomainTaken", fmt.Errorf("outer: %w", ErrSubdomainTaken), true},
 		{"generic error", errors.New("some error"), false},
@@ -131,3 +136,97 @@ func TestIsTransientError_NetOpError(t *testing.T) {
 		t.Error("timeout OpError should be transient")
 	}
 }
+
+func TestRegistrationError(t *testing.T) {
+	tests := []struct {
+		code      string
+		permanent bool
+	}{
+		{"", false},
+		{protocol.ErrCodePortInUse, false},
+		{protocol.ErrCodePortReserved, true},
+		{protocol.ErrCodePortNotAllowed, true},
+		{protocol.ErrCodeTCPDisabled, true},
+		{protocol.ErrCodeTunnelBlocked, true},
+		{protocol.ErrCodeInvalidHeaders, true},
+		{protocol.ErrCodeInvalidAccess, true},
+		{protocol.ErrCodeInvalidSignature, true},
+		{protocol.ErrCodeInvalidReplay, true},
+		{protocol.ErrCodeInvalidABTest, true},
+		{protocol.ErrCodeInvalidGeoPolicy, true},
+		{protocol.ErrCodeInvalidChallenge, true},
+		{protocol.ErrCodeInvalidHoneytoken, true},
+		{protocol.ErrCodeInvalidMessage, true},
+		{protocol.ErrCodeTLSPassthroughDisabled, true},
+		{protocol.ErrCodeUnauthorized, true},
+		{protocol.ErrCodeSubdomainReserved, true},
+		{protocol.ErrCodeInvalidOwnerKey, true},
+		{protocol.ErrCodeOwnerKeyMismatch, true},
+		{protocol.ErrCodeInvalidHandover, true},
+		{protocol.ErrCodeAnonymousRestricted, true},
+		{protocol.ErrCodeInvalidCanary, false},
+		{protocol.ErrCodeSubdomainTaken, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			err := registrationError(&protocol.ErrorMessage{Message: "nope", Code: tt.code})
+			if isPermanentError(err) != tt.permanent {
+				t.Errorf("registrationError(%q) permanent = %v, want %v", tt.code, !tt.permanent, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestRegistrationErrorRetryAfter(t *testing.T) {
+	err := registrationError(&protocol.ErrorMessage{Message: "busy", Code: protocol.ErrCodeServerBusy, RetryAfter: 5})
+	var retryAfter *RetryAfterError
+	if !errors.As(err, &retryAfter) {
+		t.Fatalf("got %v, want RetryAfterError", err)
+	}
+	if retryAfter.After != 5*time.Second {
+		t.Errorf("After = %v, want 5s", retryAfter.After)
+	}
+	if isPermanentError(err) {
+		t.Error("retry-after error should not be permanent")
+	}
+}
+
+func TestAsError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		code      string
+		retryable bool
+		hint      bool
+	}{
+		{"registration", registrationError(&protocol.ErrorMessage{Message: "bad key", Code: protocol.ErrCodeUnauthorized}), protocol.ErrCodeUnauthorized, false, true},
+		{"registration without code", registrationError(&protocol.ErrorMessage{Message: "nope"}), CodeRegistration, true, false},
+		{"wrapped", fmt.Errorf("outer: %w", newError(CodeConnect, "", syscall.ECONNREFUSED)), CodeConnect, true, true},
+		{"shutdown", ErrShutdown, CodeShutdown, false, false},
+		{"max retries", ErrMaxRetriesExceeded, CodeMaxRetries, false, true},
+		{"other", errors.New("boom"), CodeUnknown, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := AsError(tt.err)
+			if e.Code != tt.code || e.Retryable != tt.retryable || (e.Hint != "") != tt.hint {
+				t.Errorf("AsError() = {Code: %q, Retryable: %v, Hint: %q}, want code %q, retryable %v, hint %v", e.Code, e.Retryable, e.Hint, tt.code, tt.retryable, tt.hint)
+			}
+		})
+	}
+	if AsError(nil) != nil {
+		t.Error("AsError(nil) != nil")
+	}
+}
+
+func TestRegistrationErrorMessage(t *testing.T) {
+	e := registrationError(&protocol.ErrorMessage{Message: "port 22 is reserved", Code: protocol.ErrCodePortReserved})
+	if e.Message != "port 22 is reserved" {
+		t.Errorf("Message = %q, want the server's message", e.Message)
+	}
+	if !errors.Is(e, ErrPermanentFailure) {
+		t.Error("permanent registration error does not wrap ErrPermanentFailure")
+	}
+}
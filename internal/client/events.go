@@ -0,0 +1,85 @@
+package client
+
+import "time"
+
+// EventType identifies a client lifecycle event.
+type EventType int
+
+const (
+	// EventRegistered fires when the server confirms the tunnel registration.
+	EventRegistered EventType = iota
+
+	// EventDisconnected fires when an established session is lost.
+	EventDisconnected
+
+	// EventReconnecting fires before each reconnection attempt is scheduled.
+	EventReconnecting
+
+	// EventLimitWarning fires when the server warns that the tunnel is
+	// nearing or has reached one of its limits.
+	EventLimitWarning
+
+	// EventIntrusion fires when a visitor requests one of the tunnel's
+	// honeytoken paths.
+	EventIntrusion
+)
+
+// String returns the event type name.
+func (t EventType) String() string {
+	switch t {
+	case EventRegistered:
+		return "registered"
+	case EventDisconnected:
+		return "disconnected"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventLimitWarning:
+		return "limit_warning"
+	case EventIntrusion:
+		return "intrusion"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change in the client's connection state.
+type Event struct {
+	Type EventType
+
+	// URL and Subdomain are set for EventRegistered.
+	URL       string
+	Subdomain string
+
+	// HandoverToken is set for EventRegistered: another client given it
+	// with WithHandover can take the tunnel over without dropping requests.
+	HandoverToken string
+
+	// Err is the cause of EventDisconnected and EventReconnecting.
+	Err error
+
+	// Attempt and Delay are set for EventReconnecting.
+	Attempt int
+	Delay   time.Duration
+
+	// Limit names the limit (one of the protocol.Limit constants) and
+	// Message describes it for EventLimitWarning. For EventIntrusion,
+	// Message is the request for the trap path.
+	Limit   string
+	Message string
+
+	// RemoteAddr is the visitor that requested a trap path, for
+	// EventIntrusion.
+	RemoteAddr string
+}
+
+// emit delivers an event to the registered handler, updates the status and
+// closes the ready channel on the first registration.
+func (c *Client) emit(e Event) {
+	if e.Type == EventRegistered {
+		c.readyOnce.Do(func() { close(c.ready) })
+	}
+	c.recordEvent(e)
+	if c.onEvent != nil {
+		c.onEvent(e)
+	}
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+// fakeServer accepts one tunnel client, registers it, then drops the session.
+func fakeServer(t *testing.T, ln net.Listener, url, subdomain string) {
+	t.Helper()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		t.Errorf("failed to create yamux session: %v", err)
+		return
+	}
+	defer session.Close()
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Errorf("failed to accept control stream: %v", err)
+		return
+	}
+	cs := protocol.NewControlStream(stream)
+	if _, err := cs.ReadMessage(); err != nil {
+		t.Errorf("failed to read register message: %v", err)
+		return
+	}
+	if err := cs.SendRegistered(url, subdomain); err != nil {
+		t.Errorf("failed to send registered message: %v", err)
+	}
+}
+
+// eventRecorder collects events delivered to a handler.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) handle(e Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+func (r *eventRecorder) types() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make([]EventType, len(r.events))
+	for i, e := range r.events {
+		types[i] = e.Type
+	}
+	return types
+}
+
+func TestReadyAndRegisteredEvent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go fakeServer(t, ln, "http://abc.localhost:8080", "abc")
+
+	rec := &eventRecorder{}
+	c := New(ln.Addr().String(), "127.0.0.1:1").WithEventHandler(rec.handle)
+
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+
+	select {
+	case <-c.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Ready() was not closed after registration")
+	}
+	if c.TunnelURL() != "http://abc.localhost:8080" {
+		t.Errorf("TunnelURL() = %q, want %q", c.TunnelURL(), "http://abc.localhost:8080")
+	}
+
+	// The fake server closes the session after registering
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after session closed")
+	}
+
+	got := rec.types()
+	want := []EventType{EventRegistered, EventDisconnected}
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	rec.mu.Lock()
+	registered := rec.events[0]
+	rec.mu.Unlock()
+	if registered.URL != "http://abc.localhost:8080" || registered.Subdomain != "abc" {
+		t.Errorf("registered event = %+v", registered)
+	}
+}
+
+func TestReconnectingEvents(t *testing.T) {
+	// Reserve a port with nothing listening on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	rec := &eventRecorder{}
+	c := New(addr, "127.0.0.1:1").
+		WithEventHandler(rec.handle).
+		WithBackoff(BackoffConfig{
+			InitialDelay: time.Millisecond,
+			MaxDelay:     time.Millisecond,
+			Multiplier:   1,
+			MaxRetries:   2,
+		})
+
+	err = c.RunWithReconnect(context.Background())
+	if err != ErrMaxRetriesExceeded {
+		t.Fatalf("RunWithReconnect() error = %v, want ErrMaxRetriesExceeded", err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.events) != 2 {
+		t.Fatalf("got %d events, want 2", len(rec.events))
+	}
+	for i, e := range rec.events {
+		if e.Type != EventReconnecting {
+			t.Errorf("event[%d] type = %v, want %v", i, e.Type, EventReconnecting)
+		}
+		if e.Attempt != i+1 {
+			t.Errorf("event[%d] attempt = %d, want %d", i, e.Attempt, i+1)
+		}
+		if e.Err == nil {
+			t.Errorf("event[%d] has nil error", i)
+		}
+	}
+
+	select {
+	case <-c.Ready():
+		t.Error("Ready() closed without a registration")
+	default:
+	}
+}
+
+func TestLimitWarningEvent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	registered := make(chan *protocol.RegisterMessage, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		session, _ := yamux.Server(conn, nil)
+		defer session.Close()
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		cs := protocol.NewControlStream(stream)
+		msg, _ := cs.ReadMessage()
+		reg, _ := msg.(*protocol.RegisterMessage)
+		registered <- reg
+		cs.SendRegistered("http://abc.localhost:8080", "abc")
+		cs.SendWarning(protocol.LimitStreams, "8 of 10 concurrent connections in use", 8, 10)
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	rec := &eventRecorder{}
+	c := New(ln.Addr().String(), "127.0.0.1:1").WithEventHandler(rec.handle)
+	// Run returns once the fake server drops the session
+	c.Run(context.Background())
+
+	if reg := <-registered; reg == nil || !reg.Warnings {
+		t.Errorf("register message = %+v, want warnings accepted", reg)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var warning *Event
+	for i := range rec.events {
+		if rec.events[i].Type == EventLimitWarning {
+			warning = &rec.events[i]
+		}
+	}
+	if warning == nil || warning.Limit != protocol.LimitStreams || warning.Message != "8 of 10 concurrent connections in use" {
+		t.Errorf("events = %+v, want a streams limit warning", rec.events)
+	}
+}
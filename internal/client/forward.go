@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/proxy"
+	"github.com/charmbracelet/log"
+)
+
+// Forward runs the client in reverse mode: it listens on the client's local
+// address and carries each accepted connection to the tunnel registered for
+// subdomain, exposing that tunnel's service locally.
+// It returns when the connection is closed or the context is cancelled.
+func (c *Client) Forward(ctx context.Context, subdomain string) error {
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err := c.controlStream.SendForward(subdomain, c.token); err != nil {
+		return fmt.Errorf("failed to send forward message: %w", err)
+	}
+
+	msg, err := c.controlStream.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read forwarding message: %w", err)
+	}
+
+	switch m := msg.(type) {
+	case *protocol.ForwardingMessage:
+	case *protocol.ErrorMessage:
+		return fmt.Errorf("%w: forward failed: %s", ErrPermanentFailure, m.Message)
+	default:
+		return fmt.Errorf("unexpected message type: %T", msg)
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", c.localAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", c.localAddr, err)
+	}
+	defer ln.Close()
+
+	log.Info("Forwarding", "from", ln.Addr().String(), "to", subdomain)
+
+	go c.sendHeartbeats(ctx)
+
+	// Drain heartbeat acks; stop listening once the control stream closes
+	go func() {
+		defer ln.Close()
+		for {
+			if _, err := c.controlStream.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrShutdown
+			}
+			return fmt.Errorf("session closed: %w", err)
+		}
+
+		go func() {
+			stream, err := session.OpenStream()
+			if err != nil {
+				log.Error("failed to open stream", "error", err)
+				conn.Close()
+				return
+			}
+			log.Debug("forwarding connection", "remote", conn.RemoteAddr(), "stream_id", stream.StreamID())
+
+			if err := proxy.BidirectionalContext(ctx, conn, stream); err != nil {
+				log.Debug("forward completed", "stream_id", stream.StreamID(), "error", err)
+			}
+		}()
+	}
+}
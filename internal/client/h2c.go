@@ -0,0 +1,285 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// UpstreamProto is the protocol the client speaks to the local service of
+// an HTTP tunnel.
+type UpstreamProto string
+
+const (
+	// UpstreamHTTP1 passes the tunnel's HTTP/1.1 traffic through unchanged.
+	UpstreamHTTP1 UpstreamProto = "http1"
+
+	// UpstreamH2C translates requests to HTTP/2 over cleartext (prior
+	// knowledge), for services such as gRPC servers that only speak h2c.
+	UpstreamH2C UpstreamProto = "h2c"
+
+	// UpstreamHTTPS passes the tunnel's HTTP/1.1 traffic through over TLS,
+	// for dev servers that only listen for HTTPS. Their certificate is not
+	// verified, as it is usually self-signed.
+	UpstreamHTTPS UpstreamProto = "https"
+
+	// UpstreamAuto stands for the protocol DetectUpstreamProto finds. It
+	// must be resolved before it is passed to WithUpstreamProto.
+	UpstreamAuto UpstreamProto = "auto"
+)
+
+// ParseUpstreamProto parses an upstream protocol name.
+func ParseUpstreamProto(s string) (UpstreamProto, error) {
+	switch p := UpstreamProto(s); p {
+	case UpstreamHTTP1, UpstreamH2C, UpstreamHTTPS, UpstreamAuto:
+		return p, nil
+	case "":
+		return UpstreamHTTP1, nil
+	}
+	return "", fmt.Errorf("invalid upstream protocol %q (want auto, http1, https or h2c)", s)
+}
+
+// WithUpstreamProto sets the protocol spoken to the local service.
+func (c *Client) WithUpstreamProto(p UpstreamProto) *Client {
+	c.upstreamProto = p
+	if p == UpstreamH2C {
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		c.h2c = &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return c.dialLocalService(ctx)
+			},
+		}
+	}
+	return c
+}
+
+// localTLSConfig returns the TLS config for an HTTPS local service.
+func (c *Client) localTLSConfig() *tls.Config {
+	host, _, _ := net.SplitHostPort(c.localAddr)
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	return &tls.Config{ServerName: host, InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}
+}
+
+// dialLocal connects to the local service. With an h2c upstream, it returns
+// an in-memory connection to a bridge that translates the tunnel's HTTP/1.1
+// into HTTP/2 requests, so stats and the inspector see HTTP/1.1 either way.
+// With rewrites, that connection is in turn put behind a bridge that
+// rewrites text responses.
+func (c *Client) dialLocal(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	if c.upstreamProto != UpstreamH2C {
+		var err error
+		if conn, err = c.dialLocalService(ctx); err != nil {
+			return nil, err
+		}
+		if c.upstreamProto == UpstreamHTTPS {
+			conn = tls.Client(conn, c.localTLSConfig())
+		}
+	} else {
+		local, bridge := newPipeConns()
+		go c.serveH2C(ctx, bridge)
+		conn = local
+	}
+	if len(c.rewrites) == 0 {
+		return conn, nil
+	}
+	local, bridge := newPipeConns()
+	go c.serveRewrites(bridge, conn)
+	return local, nil
+}
+
+// hopHeaders are connection-specific headers, which HTTP/2 forbids.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// serveH2C reads HTTP/1.1 requests from conn and answers each by forwarding
+// it to the local service over h2c.
+func (c *Client) serveH2C(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if !c.forwardH2C(ctx, bw, req) {
+			return
+		}
+	}
+}
+
+// forwardH2C forwards req over h2c and writes the response to w as
+// HTTP/1.1. It reports whether the connection may be reused.
+func (c *Client) forwardH2C(ctx context.Context, w *bufio.Writer, req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		writeBridgeError(w, http.StatusNotImplemented, "Protocol upgrades are not supported with an h2c upstream")
+		return false
+	}
+
+	keepAlive := !req.Close
+	wantsTrailers := strings.Contains(strings.ToLower(req.Header.Get("Te")), "trailers")
+
+	// Pass interim responses (100 Continue, 103 Early Hints) straight through
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+			http.Header(header).Write(w)
+			w.WriteString("\r\n")
+			return w.Flush()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = c.localAddr
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Close = false
+
+	resp, err := c.h2c.RoundTrip(req)
+	if err != nil {
+		log.Error("failed to forward request over h2c", "error", err, "local", c.localAddr)
+		writeBridgeError(w, http.StatusBadGateway, "Failed to reach the local service over h2c")
+		return false
+	}
+	defer resp.Body.Close()
+
+	if err := writeHTTP1Response(w, req, resp, wantsTrailers); err != nil {
+		log.Debug("h2c response failed", "error", err)
+		return false
+	}
+	return keepAlive
+}
+
+// writeHTTP1Response writes resp as an HTTP/1.1 response. HTTP/2 may send
+// trailers (e.g. grpc-status) after a body of any length, so the response is
+// chunked when its length is unknown, it declares trailers, or the visitor
+// accepts them (TE: trailers). Body data is flushed as it arrives, for
+// streaming responses.
+func writeHTTP1Response(w *bufio.Writer, req *http.Request, resp *http.Response, wantsTrailers bool) error {
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	resp.Header.Del("Content-Length")
+
+	bodyless := req.Method == http.MethodHead ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified
+	chunked := !bodyless && (resp.ContentLength < 0 || len(resp.Trailer) > 0 || wantsTrailers)
+	switch {
+	case chunked:
+		resp.Header.Set("Transfer-Encoding", "chunked")
+	case resp.ContentLength >= 0 && resp.StatusCode != http.StatusNoContent:
+		resp.Header.Set("Content-Length", fmt.Sprint(resp.ContentLength))
+	}
+
+	fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	w.WriteString("\r\n")
+	if bodyless {
+		return w.Flush()
+	}
+
+	var body io.Writer = w
+	var cw io.WriteCloser
+	if chunked {
+		cw = httputil.NewChunkedWriter(w)
+		body = cw
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := body.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if werr := w.Flush(); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if chunked {
+		cw.Close()
+		// Trailers are only known once the body has been read
+		if err := resp.Trailer.Write(w); err != nil {
+			return err
+		}
+		w.WriteString("\r\n")
+	}
+	return w.Flush()
+}
+
+// writeBridgeError writes a plain-text error response that closes the connection.
+func writeBridgeError(w *bufio.Writer, status int, msg string) {
+	fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n",
+		status, http.StatusText(status), len(msg)+1, msg)
+	w.Flush()
+}
+
+// pipeConn is one end of an in-memory connection. Unlike net.Pipe, it
+// supports half-close, so the proxy can signal the end of a request.
+type pipeConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+// newPipeConns returns the two ends of an in-memory connection.
+func newPipeConns() (*pipeConn, *pipeConn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &pipeConn{r: r1, w: w2}, &pipeConn{r: r2, w: w1}
+}
+
+func (p *pipeConn) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipeConn) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *pipeConn) CloseWrite() error           { return p.w.Close() }
+
+func (p *pipeConn) Close() error {
+	p.r.Close()
+	return p.w.Close()
+}
+
+func (p *pipeConn) LocalAddr() net.Addr              { return pipeAddr{} }
+func (p *pipeConn) RemoteAddr() net.Addr             { return pipeAddr{} }
+func (p *pipeConn) SetDeadline(time.Time) error      { return nil }
+func (p *pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (p *pipeConn) SetWriteDeadline(time.Time) error { return nil }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "bridge" }
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseUpstreamProto(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    UpstreamProto
+		wantErr bool
+	}{
+		{in: "", want: UpstreamHTTP1},
+		{in: "http1", want: UpstreamHTTP1},
+		{in: "h2c", want: UpstreamH2C},
+		{in: "h2", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseUpstreamProto(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseUpstreamProto(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+// newH2CServer starts a local service that only speaks HTTP/2 cleartext.
+func newH2CServer(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestH2CUpstream(t *testing.T) {
+	addr := newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Link", "</app.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(r.Host + " " + string(body)))
+	})
+
+	c := New("", addr).WithUpstreamProto(UpstreamH2C)
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	br := bufio.NewReader(server)
+	// Two requests on one stream, as with a keep-alive visitor connection
+	for _, body := range []string{"first", "second"} {
+		req := "POST /svc/Method HTTP/1.1\r\nHost: app.example.com\r\nTE: trailers\r\nContent-Length: " +
+			strconv.Itoa(len(body)) + "\r\n\r\n" + body
+		if _, err := io.WriteString(server, req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		if resp.StatusCode != http.StatusEarlyHints || resp.Header.Get("Link") == "" {
+			t.Fatalf("first response = %d %v, want 103 Early Hints", resp.StatusCode, resp.Header)
+		}
+		if resp, err = http.ReadResponse(br, nil); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d (%s)", resp.StatusCode, got)
+		}
+		if want := "app.example.com " + body; string(got) != want {
+			t.Errorf("body = %q, want %q", got, want)
+		}
+		if s := resp.Trailer.Get("Grpc-Status"); s != "0" {
+			t.Errorf("Grpc-Status trailer = %q, want 0", s)
+		}
+	}
+}
+
+func TestH2CUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		localAddr  string
+		request    string
+		wantStatus int
+	}{
+		{
+			name:       "upgrade is refused",
+			request:    "GET /ws HTTP/1.1\r\nHost: app\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "unreachable service",
+			localAddr:  "127.0.0.1:1",
+			request:    "GET / HTTP/1.1\r\nHost: app\r\n\r\n",
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := tt.localAddr
+			if addr == "" {
+				addr = newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {})
+			}
+			c := New("", addr).WithUpstreamProto(UpstreamH2C)
+			server, tunnel := net.Pipe()
+			defer server.Close()
+			go c.handleStream(context.Background(), pipeStream{tunnel})
+
+			io.WriteString(server, tt.request)
+			resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/requestdb"
+)
+
+const (
+	// DefaultInspectorCapacity is the number of exchanges kept by default.
+	DefaultInspectorCapacity = 100
+
+	// maxCaptureBytes bounds how much of each direction of a stream is kept.
+	// Bodies beyond this are marked truncated.
+	maxCaptureBytes = 256 << 10
+)
+
+// CapturedRequest is a request/response exchange seen by the client.
+type CapturedRequest struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// Duration is the time to the first response byte, in nanoseconds. It
+	// is only known for the first request on a connection.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// ReplayOf is the ID of the request this one replayed, if any.
+	ReplayOf string `json:"replay_of,omitempty"`
+
+	Request  CapturedHTTPRequest   `json:"request"`
+	Response *CapturedHTTPResponse `json:"response,omitempty"`
+}
+
+// CapturedHTTPRequest is the captured request half of an exchange.
+type CapturedHTTPRequest struct {
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"`
+	Proto     string      `json:"proto"`
+	Host      string      `json:"host"`
+	Headers   http.Header `json:"headers"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// CapturedHTTPResponse is the captured response half of an exchange.
+type CapturedHTTPResponse struct {
+	Status    int         `json:"status"`
+	Proto     string      `json:"proto"`
+	Headers   http.Header `json:"headers"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// inspector keeps the most recent captured exchanges.
+type inspector struct {
+	mu       sync.RWMutex
+	capacity int
+	requests []*CapturedRequest // oldest first
+	nextID   int
+
+	// db persists exchanges across restarts (nil = disabled); subdomain
+	// returns the tunnel's subdomain to file them under
+	db        *requestdb.DB
+	subdomain func() string
+}
+
+func newInspector(capacity int) *inspector {
+	return &inspector{capacity: capacity}
+}
+
+// add stores an exchange, assigning its ID and evicting the oldest if full.
+func (in *inspector) add(r *CapturedRequest) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.nextID++
+	r.ID = strconv.Itoa(in.nextID)
+	if len(in.requests) >= in.capacity {
+		in.requests = in.requests[1:]
+	}
+	in.requests = append(in.requests, r)
+	in.persist(r)
+}
+
+// list returns the stored exchanges, newest first.
+func (in *inspector) list() []*CapturedRequest {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	out := make([]*CapturedRequest, len(in.requests))
+	for i, r := range in.requests {
+		out[len(out)-1-i] = r
+	}
+	return out
+}
+
+// get returns the exchange with the given ID, or nil.
+func (in *inspector) get(id string) *CapturedRequest {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	for _, r := range in.requests {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// captureBuffer keeps up to maxCaptureBytes of a stream.
+type captureBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) {
+	if room := maxCaptureBytes - b.buf.Len(); len(p) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+}
+
+// parseExchanges parses the HTTP requests and responses captured from one
+// stream. Parsing stops at the first incomplete message or protocol upgrade.
+func parseExchanges(req, resp *captureBuffer, start time.Time, firstByte time.Duration) []*CapturedRequest {
+	reqReader := bufio.NewReader(bytes.NewReader(req.buf.Bytes()))
+	respReader := bufio.NewReader(bytes.NewReader(resp.buf.Bytes()))
+
+	var out []*CapturedRequest
+	for {
+		r, err := http.ReadRequest(reqReader)
+		if err != nil {
+			return out
+		}
+		body, err := io.ReadAll(r.Body)
+		captured := &CapturedRequest{
+			Time: start,
+			Request: CapturedHTTPRequest{
+				Method:    r.Method,
+				URI:       r.RequestURI,
+				Proto:     r.Proto,
+				Host:      r.Host,
+				Headers:   r.Header,
+				Body:      body,
+				Truncated: err != nil || (req.truncated && exhausted(reqReader)),
+			},
+		}
+		if len(out) == 0 {
+			captured.Duration = firstByte
+		}
+		out = append(out, captured)
+
+		if captured.Response = readCapturedResponse(respReader, r, resp.truncated); captured.Response == nil {
+			return out
+		}
+		if err != nil || captured.Response.Truncated || captured.Response.Status == http.StatusSwitchingProtocols {
+			return out
+		}
+	}
+}
+
+// readCapturedResponse parses the next response for r, or returns nil if
+// none was captured.
+func readCapturedResponse(br *bufio.Reader, r *http.Request, truncated bool) *CapturedHTTPResponse {
+	resp, err := http.ReadResponse(br, r)
+	// Skip interim responses such as 100 Continue
+	for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		resp, err = http.ReadResponse(br, r)
+	}
+	if err != nil {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return &CapturedHTTPResponse{
+		Status:    resp.StatusCode,
+		Proto:     resp.Proto,
+		Headers:   resp.Header,
+		Body:      body,
+		Truncated: err != nil || (truncated && exhausted(br)),
+	}
+}
+
+// exhausted reports whether br has no more data.
+func exhausted(br *bufio.Reader) bool {
+	_, err := br.Peek(1)
+	return err != nil
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// replayTimeout bounds a replayed request to the local service.
+const replayTimeout = 30 * time.Second
+
+// InspectorHeader must be sent with POST requests to the inspector API. Web
+// pages can't add it to cross-origin requests without a CORS preflight,
+// which the inspector doesn't answer, so a page the developer visits can't
+// trigger replays.
+const InspectorHeader = "X-Otun-Inspector"
+
+// InspectorHandler returns the inspector REST API:
+//
+//	GET  /api/requests                 captured exchanges, newest first
+//	GET  /api/requests/{id}            a single exchange
+//	POST /api/requests/{id}/replay     resend a request to the local service
+//
+// WithInspector must be set; otherwise every endpoint returns 404. Requests
+// must be addressed to localhost or a loopback IP, which keeps DNS
+// rebinding pages out, and POSTs must carry InspectorHeader.
+func (c *Client) InspectorHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/requests", c.handleListRequests)
+	mux.HandleFunc("GET /api/requests/{id}", c.handleGetRequest)
+	mux.HandleFunc("POST /api/requests/{id}/replay", c.handleReplayRequest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoopbackHost(r.Host) {
+			writeJSONError(w, http.StatusForbidden, "the inspector only answers requests for localhost")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(InspectorHeader) == "" {
+			writeJSONError(w, http.StatusForbidden, "missing "+InspectorHeader+" header")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether host, a Host header, names localhost or a
+// loopback IP.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// ServeInspector serves the inspector API on addr until ctx is cancelled.
+func (c *Client) ServeInspector(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on inspector address %s: %w", addr, err)
+	}
+	srv := &http.Server{Handler: c.InspectorHandler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Info("Inspector API", "url", "http://"+ln.Addr().String()+"/api/requests")
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	if c.inspector == nil {
+		writeJSONError(w, http.StatusNotFound, "inspector is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"requests": c.inspector.list()})
+}
+
+func (c *Client) handleGetRequest(w http.ResponseWriter, r *http.Request) {
+	captured := c.lookupCaptured(w, r)
+	if captured == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, captured)
+}
+
+func (c *Client) handleReplayRequest(w http.ResponseWriter, r *http.Request) {
+	captured := c.lookupCaptured(w, r)
+	if captured == nil {
+		return
+	}
+	if captured.Request.Truncated {
+		writeJSONError(w, http.StatusConflict, "request body was truncated and can't be replayed")
+		return
+	}
+
+	replayed, err := c.replay(r.Context(), captured)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, replayed)
+}
+
+// lookupCaptured finds the exchange named in the path, writing a 404 if
+// there is none.
+func (c *Client) lookupCaptured(w http.ResponseWriter, r *http.Request) *CapturedRequest {
+	if c.inspector == nil {
+		writeJSONError(w, http.StatusNotFound, "inspector is disabled")
+		return nil
+	}
+	captured := c.inspector.get(r.PathValue("id"))
+	if captured == nil {
+		writeJSONError(w, http.StatusNotFound, "request not found")
+	}
+	return captured
+}
+
+// replay resends a captured request to the local service and captures the
+// new exchange.
+func (c *Client) replay(ctx context.Context, orig *CapturedRequest) (*CapturedRequest, error) {
+	ctx, cancel := context.WithTimeout(ctx, replayTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, orig.Request.Method, "http://"+c.localHost()+orig.Request.URI, bytes.NewReader(orig.Request.Body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.Header = orig.Request.Headers.Clone()
+	req.Host = orig.Request.Host
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return c.dialLocalAddr(ctx)
+		},
+		DisableKeepAlives: true,
+	}
+	client := &http.Client{
+		Transport: transport,
+		// Return redirects to the caller as the tunnel would
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach local service: %w", err)
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCaptureBytes+1))
+	truncated := err != nil || len(body) > maxCaptureBytes
+	if len(body) > maxCaptureBytes {
+		body = body[:maxCaptureBytes]
+	}
+
+	replayed := &CapturedRequest{
+		Time:     start,
+		Duration: latency,
+		ReplayOf: orig.ID,
+		Request:  orig.Request,
+		Response: &CapturedHTTPResponse{
+			Status:    resp.StatusCode,
+			Proto:     resp.Proto,
+			Headers:   resp.Header,
+			Body:      body,
+			Truncated: truncated,
+		},
+	}
+	c.inspector.add(replayed)
+	log.Info("Replayed request", "id", orig.ID, "method", orig.Request.Method, "path", orig.Request.URI, "status", resp.StatusCode)
+	return replayed, nil
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes a JSON error body.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
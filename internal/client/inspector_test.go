@@ -0,0 +1,251 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captured(s string) *captureBuffer {
+	b := &captureBuffer{}
+	b.Write([]byte(s))
+	return b
+}
+
+func TestParseExchanges(t *testing.T) {
+	tests := []struct {
+		name          string
+		request       string
+		response      string
+		wantStatuses  []int
+		wantReqBody   string
+		wantTruncated bool
+	}{
+		{
+			name:         "single exchange",
+			request:      "POST /items HTTP/1.1\r\nHost: app\r\nContent-Length: 5\r\n\r\nhello",
+			response:     "HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok",
+			wantStatuses: []int{201},
+			wantReqBody:  "hello",
+		},
+		{
+			name:         "keep-alive",
+			request:      "GET /a HTTP/1.1\r\nHost: app\r\n\r\nGET /b HTTP/1.1\r\nHost: app\r\n\r\n",
+			response:     "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\naHTTP/1.1 404 Not Found\r\nContent-Length: 1\r\n\r\nb",
+			wantStatuses: []int{200, 404},
+		},
+		{
+			name:         "interim response skipped",
+			request:      "PUT /f HTTP/1.1\r\nHost: app\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi",
+			response:     "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n",
+			wantStatuses: []int{204},
+			wantReqBody:  "hi",
+		},
+		{
+			name:          "incomplete body",
+			request:       "POST /big HTTP/1.1\r\nHost: app\r\nContent-Length: 100\r\n\r\npartial",
+			response:      "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n",
+			wantStatuses:  []int{200},
+			wantReqBody:   "partial",
+			wantTruncated: true,
+		},
+		{
+			name:         "no response",
+			request:      "GET / HTTP/1.1\r\nHost: app\r\n\r\n",
+			wantStatuses: []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseExchanges(captured(tt.request), captured(tt.response), time.Now(), time.Millisecond)
+			if len(got) != len(tt.wantStatuses) {
+				t.Fatalf("got %d exchanges, want %d", len(got), len(tt.wantStatuses))
+			}
+			for i, want := range tt.wantStatuses {
+				status := 0
+				if got[i].Response != nil {
+					status = got[i].Response.Status
+				}
+				if status != want {
+					t.Errorf("exchange %d status = %d, want %d", i, status, want)
+				}
+			}
+			if string(got[0].Request.Body) != tt.wantReqBody {
+				t.Errorf("request body = %q, want %q", got[0].Request.Body, tt.wantReqBody)
+			}
+			if got[0].Request.Truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v, want %v", got[0].Request.Truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestInspectorEvictsOldest(t *testing.T) {
+	in := newInspector(2)
+	for i := 0; i < 3; i++ {
+		in.add(&CapturedRequest{})
+	}
+	list := in.list()
+	if len(list) != 2 || list[0].ID != "3" || list[1].ID != "2" {
+		t.Errorf("ids = %s, %s; want 3, 2", list[0].ID, list[1].ID)
+	}
+	if in.get("1") != nil {
+		t.Error("evicted request still found")
+	}
+}
+
+func TestInspectorAPI(t *testing.T) {
+	var hits int
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo-Host", r.Host)
+		w.Write(body)
+	}))
+	defer local.Close()
+
+	c := New("", local.Listener.Addr().String()).WithInspector(10)
+
+	// Send a request through the tunnel path
+	server, tunnel := net.Pipe()
+	go c.handleStream(t.Context(), pipeStream{tunnel})
+	io.WriteString(server, "POST /echo HTTP/1.1\r\nHost: app.example.com\r\nContent-Length: 4\r\nConnection: close\r\n\r\nping")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	server.Close()
+	waitForCapture(t, c, 1)
+
+	api := httptest.NewServer(c.InspectorHandler())
+	defer api.Close()
+
+	var list struct {
+		Requests []CapturedRequest `json:"requests"`
+	}
+	getJSON(t, api.URL+"/api/requests", http.StatusOK, &list)
+	if len(list.Requests) != 1 || list.Requests[0].Request.URI != "/echo" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+	id := list.Requests[0].ID
+
+	var one CapturedRequest
+	getJSON(t, api.URL+"/api/requests/"+id, http.StatusOK, &one)
+	if string(one.Request.Body) != "ping" || string(one.Response.Body) != "ping" {
+		t.Errorf("bodies = %q / %q, want ping / ping", one.Request.Body, one.Response.Body)
+	}
+
+	getJSON(t, api.URL+"/api/requests/999", http.StatusNotFound, nil)
+
+	// Replays need the inspector header, so web pages can't send them
+	resp, err = http.Post(api.URL+"/api/requests/"+id+"/replay", "", nil)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("replay without %s = %d, want 403", InspectorHeader, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("POST", api.URL+"/api/requests/"+id+"/replay", nil)
+	req.Header.Set(InspectorHeader, "1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var replayed CapturedRequest
+	json.NewDecoder(resp.Body).Decode(&replayed)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("replay status = %d", resp.StatusCode)
+	}
+	if replayed.ReplayOf != id || string(replayed.Response.Body) != "ping" {
+		t.Errorf("unexpected replay: %+v", replayed)
+	}
+	if got := replayed.Response.Headers.Get("X-Echo-Host"); got != "app.example.com" {
+		t.Errorf("replayed Host = %q, want app.example.com", got)
+	}
+	if hits != 2 {
+		t.Errorf("local service hit %d times, want 2", hits)
+	}
+	if len(c.inspector.list()) != 2 {
+		t.Error("replay was not captured")
+	}
+}
+
+func TestInspectorHost(t *testing.T) {
+	api := httptest.NewServer(New("", "127.0.0.1:1").WithInspector(10).InspectorHandler())
+	defer api.Close()
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{host: "localhost:4040", want: http.StatusOK},
+		{host: "LOCALHOST", want: http.StatusOK},
+		{host: "127.0.0.1:4040", want: http.StatusOK},
+		{host: "[::1]:4040", want: http.StatusOK},
+		{host: "attacker.example.com:4040", want: http.StatusForbidden},
+		{host: "localhost.attacker.example.com", want: http.StatusForbidden},
+		{host: "192.168.1.10:4040", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", api.URL+"/api/requests", nil)
+			req.Host = tt.host
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestInspectorDisabled(t *testing.T) {
+	api := httptest.NewServer(New("", "127.0.0.1:1").InspectorHandler())
+	defer api.Close()
+	getJSON(t, api.URL+"/api/requests", http.StatusNotFound, nil)
+}
+
+func waitForCapture(t *testing.T, c *Client, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.inspector.list()) < n {
+		if time.Now().After(deadline) {
+			t.Fatal("request was not captured")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func getJSON(t *testing.T, url string, wantStatus int, v any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s status = %d, want %d", url, resp.StatusCode, wantStatus)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/bc183/otun/internal/transport"
+)
+
+// StreamHandler handles a stream from the server. Streams of HTTP tunnels
+// carry a visitor's raw HTTP/1.1 connection; those of TCP and TLS tunnels
+// carry raw bytes.
+type StreamHandler func(ctx context.Context, stream transport.Stream)
+
+// Interceptor wraps the handling of each stream. It can inspect or rewrite
+// the traffic by passing next a wrapped stream, or answer the visitor
+// itself and close the stream without calling next.
+type Interceptor func(next StreamHandler) StreamHandler
+
+// WithInterceptor adds interceptors that see every stream before it is
+// proxied to the local service. Interceptors run in the order added, the
+// first being the outermost.
+func (c *Client) WithInterceptor(interceptors ...Interceptor) *Client {
+	c.interceptors = append(c.interceptors, interceptors...)
+	return c
+}
+
+// streamHandler returns the handler for new streams: the interceptors,
+// then the built-in ones, around the proxy to the local service.
+func (c *Client) streamHandler() StreamHandler {
+	h := c.proxyStream
+	if !c.tcp && !c.tlsPassthrough {
+		if len(c.mocks) > 0 {
+			h = c.mockInterceptor(h)
+		}
+		if len(c.denyPaths) > 0 {
+			h = c.denyPathsInterceptor(h)
+		}
+	}
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		h = c.interceptors[i](h)
+	}
+	return h
+}
+
+// PeekRequest reads the head of the first request on an HTTP tunnel's
+// stream. It returns the request, without a body, and a stream that
+// replays everything read, to be passed on instead of stream.
+func PeekRequest(stream transport.Stream) (*http.Request, transport.Stream, error) {
+	var buf bytes.Buffer
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(stream, &buf)))
+	replay := &replayStream{Stream: stream, r: io.MultiReader(&buf, stream)}
+	if err != nil {
+		return nil, replay, err
+	}
+	req.Body = http.NoBody
+	return req, replay, nil
+}
+
+// replayStream is a stream whose first bytes were already read; it reads
+// them again before the rest of the stream.
+type replayStream struct {
+	transport.Stream
+	r io.Reader
+}
+
+func (s *replayStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+// CloseWrite half-closes the stream if it supports it, so wrapping doesn't
+// hide it from the proxy.
+func (s *replayStream) CloseWrite() error {
+	if hc, ok := s.Stream.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
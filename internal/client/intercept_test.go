@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bc183/otun/internal/transport"
+)
+
+func TestPeekRequest(t *testing.T) {
+	const raw = "POST /hooks HTTP/1.1\r\nHost: app\r\nContent-Length: 4\r\n\r\nbody"
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go io.WriteString(server, raw)
+
+	req, replay, err := PeekRequest(pipeStream{tunnel})
+	if err != nil {
+		t.Fatalf("PeekRequest: %v", err)
+	}
+	if req.Method != "POST" || req.RequestURI != "/hooks" || req.Host != "app" {
+		t.Errorf("request = %s %s (host %s), want POST /hooks (host app)", req.Method, req.RequestURI, req.Host)
+	}
+
+	got := make([]byte, len(raw))
+	if _, err := io.ReadFull(replay, got); err != nil {
+		t.Fatalf("failed to read replayed stream: %v", err)
+	}
+	if string(got) != raw {
+		t.Errorf("replayed %q, want %q", got, raw)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "local "+r.URL.Path)
+	}))
+	defer local.Close()
+
+	var order []string
+	trace := func(name string) Interceptor {
+		return func(next StreamHandler) StreamHandler {
+			return func(ctx context.Context, stream transport.Stream) {
+				order = append(order, name)
+				next(ctx, stream)
+			}
+		}
+	}
+	mock := func(next StreamHandler) StreamHandler {
+		return func(ctx context.Context, stream transport.Stream) {
+			req, replay, err := PeekRequest(stream)
+			if err != nil || req.URL.Path != "/mocked" {
+				next(ctx, replay)
+				return
+			}
+			io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nConnection: close\r\n\r\nmock")
+			stream.Close()
+		}
+	}
+	c := New("", local.Listener.Addr().String()).WithInterceptor(trace("first"), trace("second"), mock)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/mocked", want: "mock"},
+		{path: "/real", want: "local /real"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			order = nil
+			server, tunnel := net.Pipe()
+			defer server.Close()
+			go c.handleStream(context.Background(), pipeStream{tunnel})
+
+			io.WriteString(server, "GET "+tt.path+" HTTP/1.1\r\nHost: app\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+			if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+				t.Errorf("interceptor order = %v, want [first second]", order)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+// ErrHostKeyChanged indicates the server presented a different key than the
+// one recorded for it in the known hosts file, and strict checking is on.
+var ErrHostKeyChanged = errors.New("server key changed")
+
+// knownHosts pins each server's public key on first connect, SSH style.
+// The file has a line per server address: "<host:port> SHA256:<base64>".
+type knownHosts struct {
+	path   string
+	strict bool // refuse, rather than warn about, a changed key
+
+	mu sync.Mutex // serializes reading and appending to the file
+}
+
+// WithKnownHosts records the public key of the server's TLS certificate in
+// the file at path the first time the client connects, and checks it on
+// every later connection. A changed key, which a man-in-the-middle of the
+// control connection would present, is warned about loudly, or refused if
+// strict is set. It only applies with WithTLSConfig.
+func (c *Client) WithKnownHosts(path string, strict bool) *Client {
+	c.knownHosts = &knownHosts{path: path, strict: strict}
+	return c
+}
+
+// fingerprint returns the SSH-style fingerprint of cert's public key. The
+// key, not the certificate, is pinned, so renewals that keep it (as ACME
+// clients like autocert do) don't look like an attack.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// check verifies the key cert presents for addr against the file, recording
+// it if addr isn't known yet.
+func (k *knownHosts) check(addr string, cert *x509.Certificate) error {
+	got := fingerprint(cert)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	want, err := k.lookup(addr)
+	if err != nil {
+		return err
+	}
+	switch want {
+	case "":
+		if err := k.add(addr, got); err != nil {
+			return err
+		}
+		log.Info("Recorded the server's key", "server", addr, "fingerprint", got, "file", k.path)
+		return nil
+	case got:
+		return nil
+	}
+
+	if k.strict {
+		return fmt.Errorf("%w: %s presented %s, but %s has %s", ErrHostKeyChanged, addr, got, k.path, want)
+	}
+	log.Warn("THE SERVER'S KEY HAS CHANGED! Someone may be intercepting the tunnel connection, or the server got a new key. "+
+		"If the operator confirms the new key, delete the server's line from the known hosts file; use --strict-host-key to refuse such connections",
+		"server", addr, "recorded", want, "presented", got, "file", k.path)
+	return nil
+}
+
+// lookup returns the fingerprint recorded for addr, or "" if there is none.
+func (k *knownHosts) lookup(addr string) (string, error) {
+	f, err := os.Open(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") && fields[0] == addr {
+			return fields[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	return "", nil
+}
+
+// add appends addr's fingerprint to the file, creating it if needed.
+func (k *knownHosts) add(addr, fp string) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0o700); err != nil {
+		return fmt.Errorf("failed to record server key: %w", err)
+	}
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to record server key: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", addr, fp); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to record server key: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otun", "known_hosts")
+	original := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("original key")}
+	replaced := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("replaced key")}
+
+	steps := []struct {
+		name    string
+		addr    string
+		cert    *x509.Certificate
+		strict  bool
+		wantErr error
+	}{
+		{"first connect records the key", "a.example.com:4443", original, true, nil},
+		{"same key", "a.example.com:4443", original, true, nil},
+		{"changed key warns", "a.example.com:4443", replaced, false, nil},
+		{"changed key refused when strict", "a.example.com:4443", replaced, true, ErrHostKeyChanged},
+		{"other servers are pinned separately", "b.example.com:4443", replaced, true, nil},
+	}
+	for _, step := range steps {
+		k := &knownHosts{path: path, strict: step.strict}
+		if err := k.check(step.addr, step.cert); !errors.Is(err, step.wantErr) {
+			t.Errorf("%s: check() error = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read known hosts: %v", err)
+	}
+	want := "a.example.com:4443 " + fingerprint(original) + "\nb.example.com:4443 " + fingerprint(replaced) + "\n"
+	if string(data) != want {
+		t.Errorf("known hosts = %q, want %q", data, want)
+	}
+}
+
+func TestDialServerKnownHosts(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	addr := srv.Listener.Addr().String()
+
+	// A different key recorded for the server, as after a MITM
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte("# pinned\n"+addr+" SHA256:AAAA\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(addr, "").
+		WithTLSConfig(&tls.Config{RootCAs: pool, ServerName: "example.com"}).
+		WithKnownHosts(path, true)
+	_, err := c.connect(context.Background())
+	if !errors.Is(err, ErrHostKeyChanged) {
+		t.Fatalf("connect() error = %v, want %v", err, ErrHostKeyChanged)
+	}
+	if !strings.Contains(err.Error(), fingerprint(srv.Certificate())) {
+		t.Errorf("error %q doesn't name the presented key", err)
+	}
+	if !isPermanentError(err) {
+		t.Error("a changed key should not be retried")
+	}
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLocalQueueTimeout is how long a stream waits for a free local
+// connection by default.
+const DefaultLocalQueueTimeout = 10 * time.Second
+
+// busyResponse answers requests that waited too long for a local connection.
+const busyResponse = "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain; charset=utf-8\r\nRetry-After: 1\r\nContent-Length: 41\r\nConnection: close\r\n\r\nLocal service is busy, try again shortly\n"
+
+// errLocalBusy is returned when no local connection freed up in time.
+var errLocalBusy = errors.New("too many connections to the local service")
+
+// LocalConnStats describes the client's connections to its local service,
+// to help size WithMaxLocalConns.
+type LocalConnStats struct {
+	// InUse is the number of streams connected to (or dialing) the local
+	// service now, and Limit the most allowed at once (0 = unlimited)
+	InUse int
+	Limit int
+
+	// DialFailures counts failed connection attempts, retries included
+	DialFailures uint64
+
+	// Waits counts streams that had to wait for a free connection, and
+	// WaitTime and MaxWait how long they waited in all and at most.
+	// Timeouts counts those that gave up waiting.
+	Waits    uint64
+	WaitTime time.Duration
+	MaxWait  time.Duration
+	Timeouts uint64
+}
+
+// localConnCounters are the live counters behind LocalConnStats.
+type localConnCounters struct {
+	inUse        atomic.Int64
+	dialFailures atomic.Uint64
+	waits        atomic.Uint64
+	waitTime     atomic.Int64 // nanoseconds
+	maxWait      atomic.Int64 // nanoseconds
+	timeouts     atomic.Uint64
+}
+
+// recordWait adds a wait for a free local connection that took d.
+func (l *localConnCounters) recordWait(d time.Duration) {
+	l.waits.Add(1)
+	l.waitTime.Add(int64(d))
+	for {
+		longest := l.maxWait.Load()
+		if int64(d) <= longest || l.maxWait.CompareAndSwap(longest, int64(d)) {
+			return
+		}
+	}
+}
+
+// localConnStats returns statistics on the client's local connections.
+func (c *Client) localConnStats() LocalConnStats {
+	l := &c.localConns
+	return LocalConnStats{
+		InUse:        int(l.inUse.Load()),
+		Limit:        cap(c.localSlots),
+		DialFailures: l.dialFailures.Load(),
+		Waits:        l.waits.Load(),
+		WaitTime:     time.Duration(l.waitTime.Load()),
+		MaxWait:      time.Duration(l.maxWait.Load()),
+		Timeouts:     l.timeouts.Load(),
+	}
+}
+
+// WithMaxLocalConns limits the simultaneous connections to the local
+// service to n (0 = unlimited), so a burst of public traffic doesn't
+// overwhelm a single-threaded dev server. Streams over the limit wait up
+// to queueTimeout for a connection to free up, then HTTP visitors get 503.
+func (c *Client) WithMaxLocalConns(n int, queueTimeout time.Duration) *Client {
+	c.localSlots = nil
+	if n > 0 {
+		c.localSlots = make(chan struct{}, n)
+	}
+	c.localQueueTimeout = queueTimeout
+	return c
+}
+
+// acquireLocal waits for a free local connection slot. The returned
+// function releases it.
+func (c *Client) acquireLocal(ctx context.Context) (release func(), err error) {
+	l := &c.localConns
+	if c.localSlots == nil {
+		l.inUse.Add(1)
+		return func() { l.inUse.Add(-1) }, nil
+	}
+	release = func() {
+		l.inUse.Add(-1)
+		<-c.localSlots
+	}
+	select {
+	case c.localSlots <- struct{}{}:
+		l.inUse.Add(1)
+		return release, nil
+	default:
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(c.localQueueTimeout)
+	defer timer.Stop()
+	select {
+	case c.localSlots <- struct{}{}:
+		l.recordWait(time.Since(start))
+		l.inUse.Add(1)
+		return release, nil
+	case <-timer.C:
+		l.recordWait(time.Since(start))
+		l.timeouts.Add(1)
+		return nil, errLocalBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLocal(t *testing.T) {
+	c := New("", "").WithMaxLocalConns(1, 50*time.Millisecond)
+
+	release, err := c.acquireLocal(context.Background())
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	if _, err := c.acquireLocal(context.Background()); err != errLocalBusy {
+		t.Fatalf("acquire over the limit = %v, want errLocalBusy", err)
+	}
+
+	// A queued stream gets the slot once it is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release()
+	}()
+	release, err = c.acquireLocal(context.Background())
+	if err != nil {
+		t.Fatalf("queued acquire: %v", err)
+	}
+	if st := c.localConnStats(); st.InUse != 1 || st.Limit != 1 || st.Waits != 2 || st.Timeouts != 1 || st.MaxWait < 10*time.Millisecond {
+		t.Errorf("stats = %+v, want 1/1 in use after 2 waits, 1 timed out", st)
+	}
+	release()
+	if st := c.localConnStats(); st.InUse != 0 {
+		t.Errorf("in use after release = %d, want 0", st.InUse)
+	}
+
+	unlimited := New("", "")
+	for range 3 {
+		if _, err := unlimited.acquireLocal(context.Background()); err != nil {
+			t.Fatalf("unlimited acquire: %v", err)
+		}
+	}
+}
+
+func TestHandleStreamLocalBusy(t *testing.T) {
+	// Nothing listens locally: a refused request must not be forwarded
+	c := New("", "127.0.0.1:1").WithMaxLocalConns(1, 10*time.Millisecond)
+	release, _ := c.acquireLocal(context.Background())
+	defer release()
+
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	io.WriteString(server, "GET / HTTP/1.1\r\nHost: app\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", resp.StatusCode)
+	}
+	if got := c.Stats().Statuses[http.StatusServiceUnavailable]; got != 1 {
+		t.Errorf("recorded 503s = %d, want 1", got)
+	}
+}
+
+// tcpStream adapts a TCP connection, which can half-close, to
+// transport.Stream.
+type tcpStream struct {
+	*net.TCPConn
+}
+
+func (tcpStream) StreamID() uint32 { return 1 }
+
+func TestHandleStreamReleasesLocalConn(t *testing.T) {
+	// The local service answers and closes, while the visitor's side of the
+	// stream stays open
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		http.ReadRequest(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		conn.Close()
+	}()
+
+	// Deny paths wrap the stream, which must not hide its CloseWrite
+	c := New("", ln.Addr().String()).
+		WithMaxLocalConns(1, 10*time.Millisecond).
+		WithDenyPaths(DefaultDenyPaths)
+	server, tunnel := tcpPair(t)
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		c.handleStream(context.Background(), tcpStream{tunnel})
+		close(done)
+	}()
+
+	io.WriteString(server, "GET / HTTP/1.1\r\nHost: app\r\n\r\n")
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("reading until the stream is half-closed: %v", err)
+	}
+	if !strings.HasSuffix(string(resp), "ok") {
+		t.Errorf("response = %q", resp)
+	}
+
+	// The server closes the stream once the response is complete
+	server.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream wasn't released")
+	}
+	if st := c.localConnStats(); st.InUse != 0 {
+		t.Errorf("in use = %d, want 0", st.InUse)
+	}
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("failed to accept")
+	}
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
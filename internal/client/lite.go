@@ -0,0 +1,42 @@
+package client
+
+import "github.com/charmbracelet/log"
+
+// Lite mode settings.
+const (
+	// LiteMaxLocalConns is the default limit of simultaneous connections
+	// to the local service in lite mode. yamux buffers up to 256 KiB per
+	// stream, its protocol's initial window and the smallest it allows, so
+	// limiting streams is what bounds that memory.
+	LiteMaxLocalConns = 8
+
+	// liteLatencySamples is how many latency samples the request summary
+	// keeps for percentiles.
+	liteLatencySamples = 500
+)
+
+// WithLite trims the client's memory use for small devices such as a
+// Raspberry Pi Zero: no inspector or request database, at most
+// LiteMaxLocalConns local connections unless WithMaxLocalConns set a limit,
+// fewer latency samples, and no per-request log lines unless debug logging
+// is on. Call it after WithMaxLocalConns and WithInspector.
+func (c *Client) WithLite() *Client {
+	c.lite = true
+	c.inspector = nil
+	c.requestDB = nil
+	if c.localSlots == nil {
+		queueTimeout := c.localQueueTimeout
+		if queueTimeout == 0 {
+			queueTimeout = DefaultLocalQueueTimeout
+		}
+		c.WithMaxLocalConns(LiteMaxLocalConns, queueTimeout)
+	}
+	c.stats.maxSize = liteLatencySamples
+	return c
+}
+
+// verbose reports whether per-request log lines are written: always, except
+// in lite mode without debug logging, where their allocations add up.
+func (c *Client) verbose() bool {
+	return !c.lite || log.GetLevel() <= log.DebugLevel
+}
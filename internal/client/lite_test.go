@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestWithLite(t *testing.T) {
+	c := New("", "").WithInspector(10).WithLite()
+	if c.inspector != nil {
+		t.Error("lite mode kept the inspector")
+	}
+	if st := c.localConnStats(); st.Limit != LiteMaxLocalConns {
+		t.Errorf("local conn limit = %d, want %d", st.Limit, LiteMaxLocalConns)
+	}
+	if c.localQueueTimeout != DefaultLocalQueueTimeout {
+		t.Errorf("queue timeout = %v, want %v", c.localQueueTimeout, DefaultLocalQueueTimeout)
+	}
+
+	for i := 0; i < liteLatencySamples+10; i++ {
+		c.stats.record(http.StatusOK, time.Second, 0, 0)
+	}
+	if n := len(c.stats.latencies); n != liteLatencySamples {
+		t.Errorf("kept %d latency samples, want %d", n, liteLatencySamples)
+	}
+
+	// An explicit limit wins
+	c = New("", "").WithMaxLocalConns(2, time.Second).WithLite()
+	if st := c.localConnStats(); st.Limit != 2 || c.localQueueTimeout != time.Second {
+		t.Errorf("limit = %d, %v; want 2, 1s", st.Limit, c.localQueueTimeout)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+
+	if !New("", "").verbose() {
+		t.Error("regular client isn't verbose")
+	}
+	c := New("", "").WithLite()
+	if c.verbose() {
+		t.Error("lite client is verbose at info level")
+	}
+	log.SetLevel(log.DebugLevel)
+	if !c.verbose() {
+		t.Error("lite client isn't verbose at debug level")
+	}
+}
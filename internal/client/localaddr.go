@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// UnixPrefix marks a local address as a Unix domain socket path, e.g.
+// "unix:/run/app.sock".
+const UnixPrefix = "unix:"
+
+// IsNamedPipe reports whether addr is a Windows named pipe, such as
+// `\\.\pipe\app` or "//./pipe/app".
+func IsNamedPipe(addr string) bool {
+	addr = strings.ReplaceAll(addr, `/`, `\`)
+	return strings.HasPrefix(addr, `\\`) && strings.Contains(strings.ToLower(addr), `\pipe\`)
+}
+
+// DialLocal makes one connection to the local service, without the
+// client's retries, e.g. to check that it is up.
+func (c *Client) DialLocal(ctx context.Context) (net.Conn, error) {
+	return c.dialLocalAddr(ctx)
+}
+
+// dialLocalAddr makes one connection to the local address: a TCP
+// host:port, a Unix socket, or a Windows named pipe.
+func (c *Client) dialLocalAddr(ctx context.Context) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(c.localAddr, UnixPrefix); ok {
+		return c.localDialer.DialContext(ctx, "unix", path)
+	}
+	if IsNamedPipe(c.localAddr) {
+		return dialPipe(ctx, strings.ReplaceAll(c.localAddr, `/`, `\`))
+	}
+	return c.localDialer.DialContext(ctx, "tcp", c.localAddr)
+}
+
+// localHost returns the Host to send the local service when the client
+// makes its own requests: its address, or "localhost" for sockets and
+// pipes.
+func (c *Client) localHost() string {
+	if strings.HasPrefix(c.localAddr, UnixPrefix) || IsNamedPipe(c.localAddr) {
+		return "localhost"
+	}
+	return c.localAddr
+}
+
+// isRefused reports whether err means nothing is listening at the local
+// address, as while a local service restarts: a refused TCP or Unix socket
+// connection, or a missing socket file or pipe.
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, fs.ErrNotExist)
+}
+
+// namedPipeAddr is the address of a named pipe.
+type namedPipeAddr string
+
+func (a namedPipeAddr) Network() string { return "pipe" }
+func (a namedPipeAddr) String() string  { return string(a) }
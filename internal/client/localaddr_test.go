@@ -0,0 +1,72 @@
+package client
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestIsNamedPipe(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{`\\.\pipe\app`, true},
+		{`//./pipe/app`, true},
+		{`\\server\PIPE\app`, true},
+		{"localhost:3000", false},
+		{"unix:/run/app.sock", false},
+		{`C:\pipe\app`, false},
+	}
+	for _, tt := range tests {
+		if got := IsNamedPipe(tt.addr); got != tt.want {
+			t.Errorf("IsNamedPipe(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDialLocalUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	c := New("", UnixPrefix+path)
+
+	// Nothing listening yet counts as refused, so hot reload waits for it
+	if _, err := c.DialLocal(context.Background()); !isRefused(err) {
+		t.Fatalf("DialLocal() before listening = %v, want a refused error", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Write([]byte("hi"))
+			conn.Close()
+		}
+	}()
+
+	conn, err := c.dialLocalService(context.Background())
+	if err != nil {
+		t.Fatalf("dialLocalService() error = %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "hi" {
+		t.Errorf("read %q, %v from the socket", buf, err)
+	}
+	if got := c.localHost(); got != "localhost" {
+		t.Errorf("localHost() = %q, want localhost", got)
+	}
+}
+
+func TestDialLocalNamedPipeUnsupported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes are supported on Windows")
+	}
+	if _, err := New("", `\\.\pipe\app`).DialLocal(context.Background()); err == nil {
+		t.Error("DialLocal() of a named pipe succeeded")
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Defaults for dialing the local service.
+const (
+	DefaultLocalDialTimeout    = 5 * time.Second
+	DefaultLocalDialRetries    = 2
+	DefaultLocalDialRetryDelay = 500 * time.Millisecond
+)
+
+// hotReloadPoll is how often a refused local service is tried again while
+// waiting for it to restart.
+const hotReloadPoll = 250 * time.Millisecond
+
+// unavailableResponse answers HTTP requests when the local service can't be
+// reached, instead of dropping the visitor's connection.
+const unavailableResponse = "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nRetry-After: 1\r\nContent-Length: 61\r\nConnection: close\r\n\r\nThe tunnel's local service is unavailable, try again shortly\n"
+
+// WithLocalDialTimeout bounds each attempt to connect to the local service
+// (0 = no limit beyond the system's).
+func (c *Client) WithLocalDialTimeout(d time.Duration) *Client {
+	c.localDialTimeout = d
+	return c
+}
+
+// WithLocalDialRetries makes the client retry a failed connection to the
+// local service up to n times, delay apart, so requests that arrive while
+// a dev server restarts on hot reload still get through.
+func (c *Client) WithLocalDialRetries(n int, delay time.Duration) *Client {
+	c.localDialRetries = n
+	c.localDialRetryDelay = delay
+	return c
+}
+
+// WithHotReloadWait makes the client hold requests for up to d while the
+// local service refuses connections, retrying until it is back, to cover
+// the restart window of dev servers that rebuild on every change (air,
+// nodemon and the like). 0 disables waiting beyond the dial retries.
+func (c *Client) WithHotReloadWait(d time.Duration) *Client {
+	c.hotReloadWait = d
+	return c
+}
+
+// dialLocalService connects to the local service's address, retrying per
+// the client's policy.
+func (c *Client) dialLocalService(ctx context.Context) (net.Conn, error) {
+	start := time.Now()
+	waiting := false
+	for attempt := 0; ; attempt++ {
+		conn, err := c.dialLocalOnce(ctx)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+
+		delay := c.localDialRetryDelay
+		if attempt >= c.localDialRetries {
+			if !isRefused(err) || time.Since(start) >= c.hotReloadWait {
+				return nil, err
+			}
+			if !waiting {
+				log.Info("Local service is down, waiting for it to restart", "local", c.localAddr, "for", c.hotReloadWait)
+				waiting = true
+			}
+			delay = min(hotReloadPoll, c.hotReloadWait-time.Since(start))
+		}
+		log.Debug("failed to connect to local service, retrying", "error", err, "local", c.localAddr, "attempt", attempt+1)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) dialLocalOnce(ctx context.Context) (net.Conn, error) {
+	dialCtx := ctx
+	if c.localDialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, c.localDialTimeout)
+		defer cancel()
+	}
+	conn, err := c.dialLocalAddr(dialCtx)
+	if err != nil && ctx.Err() == nil { // not just shutting down
+		c.localConns.dialFailures.Add(1)
+	}
+	return conn, err
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyDialer fails the first failures dials with err (or a generic
+// error), then connects.
+type flakyDialer struct {
+	failures int32
+	err      error
+	dials    atomic.Int32
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.dials.Add(1) <= d.failures {
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, errors.New("connection failed")
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestDialLocalRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		retries   int
+		wantErr   bool
+		wantDials int32
+	}{
+		{name: "first try", failures: 0, retries: 2, wantDials: 1},
+		{name: "after restart", failures: 2, retries: 2, wantDials: 3},
+		{name: "still down", failures: 5, retries: 2, wantErr: true, wantDials: 3},
+		{name: "no retries", failures: 1, retries: 0, wantErr: true, wantDials: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &flakyDialer{failures: tt.failures}
+			c := New("", "localhost:3000").WithLocalDialer(d).WithLocalDialRetries(tt.retries, time.Millisecond)
+
+			conn, err := c.dialLocalService(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialLocalService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if got := d.dials.Load(); got != tt.wantDials {
+				t.Errorf("dials = %d, want %d", got, tt.wantDials)
+			}
+			if got, want := c.localConnStats().DialFailures, uint64(min(tt.failures, tt.wantDials)); got != want {
+				t.Errorf("dial failures = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDialLocalHotReloadWait(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	tests := []struct {
+		name     string
+		failures int32
+		err      error
+		wait     time.Duration
+		wantErr  bool
+	}{
+		{name: "back within wait", failures: 3, err: refused, wait: 5 * time.Second},
+		{name: "down past wait", failures: 100, err: refused, wait: 300 * time.Millisecond, wantErr: true},
+		{name: "not waiting", failures: 1, err: refused, wantErr: true},
+		{name: "other error", failures: 1, wait: 5 * time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &flakyDialer{failures: tt.failures, err: tt.err}
+			c := New("", "localhost:3000").WithLocalDialer(d).WithLocalDialRetries(0, 0).WithHotReloadWait(tt.wait)
+
+			conn, err := c.dialLocalService(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialLocalService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestDialLocalTimeout(t *testing.T) {
+	blocking := dialerFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	c := New("", "localhost:3000").WithLocalDialer(blocking).WithLocalDialTimeout(20*time.Millisecond).WithLocalDialRetries(0, 0)
+
+	start := time.Now()
+	if _, err := c.dialLocalService(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dialLocalService() error = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial took %v, want it cut off at the timeout", elapsed)
+	}
+}
+
+// dialerFunc adapts a function to Dialer.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
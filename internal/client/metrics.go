@@ -0,0 +1,81 @@
+package client
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/bc183/otun/internal/metrics"
+)
+
+// sessionCounters count the client's reconnects and tunnel streams for
+// RegisterMetrics.
+type sessionCounters struct {
+	reconnects    atomic.Uint64
+	streams       atomic.Uint64
+	activeStreams atomic.Int64
+}
+
+// RegisterMetrics adds the client's metrics to r, so applications that
+// embed the client can include tunnel health in their own /metrics: the
+// connection state, reconnects, tunnel streams, connections to the local
+// service, and bytes transferred. Values are read from the client at
+// scrape time. A registry takes the metrics of one client only; names are
+// registered once and a second client's would panic as duplicates.
+func (c *Client) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("otun_client_connected", "Whether the tunnel is registered with the server (1) or not (0).", func() float64 {
+		if c.Status().State == StateConnected {
+			return 1
+		}
+		return 0
+	})
+	r.NewCounterFunc("otun_client_reconnects_total", "Reconnection attempts after the connection to the server was lost.", func() float64 {
+		return float64(c.counters.reconnects.Load())
+	})
+
+	r.NewCounterFunc("otun_client_streams_total", "Tunnel streams opened by the server for visitors.", func() float64 {
+		return float64(c.counters.streams.Load())
+	})
+	r.NewGaugeFunc("otun_client_streams_active", "Tunnel streams being served.", func() float64 {
+		return float64(c.counters.activeStreams.Load())
+	})
+
+	l := &c.localConns
+	r.NewGaugeFunc("otun_client_local_connections", "Connections to the local service open or being dialed.", func() float64 {
+		return float64(l.inUse.Load())
+	})
+	r.NewGaugeFunc("otun_client_local_connections_limit", "Most connections to the local service allowed at once (0 = unlimited).", func() float64 {
+		return float64(cap(c.localSlots))
+	})
+	r.NewCounterFunc("otun_client_local_dial_failures_total", "Failed connection attempts to the local service, retries included.", func() float64 {
+		return float64(l.dialFailures.Load())
+	})
+	r.NewCounterFunc("otun_client_local_waits_total", "Streams that waited for a free connection to the local service.", func() float64 {
+		return float64(l.waits.Load())
+	})
+	r.NewCounterFunc("otun_client_local_wait_seconds_total", "Time streams spent waiting for a free connection to the local service.", func() float64 {
+		return float64(l.waitTime.Load()) / 1e9
+	})
+	r.NewCounterFunc("otun_client_local_queue_timeouts_total", "Streams that gave up waiting for a free connection to the local service.", func() float64 {
+		return float64(l.timeouts.Load())
+	})
+
+	r.NewCounterFunc("otun_client_sent_bytes_total", "Bytes sent to the server over tunnel streams.", func() float64 {
+		return float64(c.transfer.sent.Load())
+	})
+	r.NewCounterFunc("otun_client_received_bytes_total", "Bytes received from the server over tunnel streams.", func() float64 {
+		return float64(c.transfer.received.Load())
+	})
+
+	r.NewCounterVecFunc("otun_client_requests_total", "HTTP requests served, by response status (\"error\" when there was no response).", func() []metrics.Sample {
+		statuses := c.stats.statusCounts()
+		samples := make([]metrics.Sample, 0, len(statuses))
+		for code, n := range statuses {
+			label := strconv.Itoa(code)
+			if code == 0 {
+				label = "error"
+			}
+			samples = append(samples, metrics.Sample{Labels: map[string]string{"status": label}, Value: float64(n)})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/metrics"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	// Nothing listens locally, so the request fails with 502
+	c := New("", "127.0.0.1:1").
+		WithLocalDialRetries(0, 0).
+		WithMaxLocalConns(4, time.Second)
+	r := metrics.NewRegistry()
+	c.RegisterMetrics(r)
+
+	c.emit(Event{Type: EventReconnecting, Err: errors.New("connection reset"), Attempt: 1})
+
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		c.handleStream(context.Background(), pipeStream{tunnel})
+		close(done)
+	}()
+	io.WriteString(server, "GET / HTTP/1.1\r\nHost: app\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	resp.Body.Close()
+	<-done
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	for _, want := range []string{
+		"otun_client_connected 0\n",
+		"otun_client_reconnects_total 1\n",
+		"otun_client_streams_total 1\n",
+		"otun_client_streams_active 0\n",
+		"otun_client_local_connections 0\n",
+		"otun_client_local_connections_limit 4\n",
+		"otun_client_local_dial_failures_total 1\n",
+		`otun_client_requests_total{status="502"} 1` + "\n",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, sb.String())
+		}
+	}
+}
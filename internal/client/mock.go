@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/transport"
+	"github.com/charmbracelet/log"
+)
+
+// MockHeader marks responses served from a MockResponse.
+const MockHeader = "X-Otun-Mock"
+
+// MockResponse is a canned response the client serves itself for matching
+// requests, without reaching the local service.
+type MockResponse struct {
+	// Method limits the mock to one request method (empty = any)
+	Method string `yaml:"method"`
+
+	// Path is matched against the request path; a trailing "*" matches
+	// a prefix, e.g. "/api/*"
+	Path string `yaml:"path"`
+
+	// Status is the response status (0 = 200)
+	Status int `yaml:"status"`
+
+	// ContentType defaults to application/json for bodies that look like
+	// JSON and text/plain otherwise
+	ContentType string `yaml:"content_type"`
+
+	Body string `yaml:"body"`
+}
+
+// ParseMockResponse parses a mock written as "[METHOD ]PATH=STATUS[ BODY]",
+// e.g. `/api/flags=200 {"beta":true}` or "DELETE /api/items/*=204".
+func ParseMockResponse(spec string) (MockResponse, error) {
+	target, response, ok := strings.Cut(spec, "=")
+	if !ok {
+		return MockResponse{}, fmt.Errorf("invalid mock %q: want [METHOD ]PATH=STATUS[ BODY]", spec)
+	}
+	var m MockResponse
+	if method, p, ok := strings.Cut(strings.TrimSpace(target), " "); ok {
+		m.Method, m.Path = strings.ToUpper(method), strings.TrimSpace(p)
+	} else {
+		m.Path = method
+	}
+	status, body, _ := strings.Cut(strings.TrimSpace(response), " ")
+	n, err := strconv.Atoi(status)
+	if err != nil {
+		return MockResponse{}, fmt.Errorf("invalid mock %q: status %q is not a number", spec, status)
+	}
+	m.Status, m.Body = n, body
+	if err := m.Validate(); err != nil {
+		return MockResponse{}, err
+	}
+	return m, nil
+}
+
+// Validate checks that the mock can be served.
+func (m *MockResponse) Validate() error {
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("mock path %q must start with /", m.Path)
+	}
+	if m.Status != 0 && (m.Status < 200 || m.Status > 599) {
+		return fmt.Errorf("mock status %d out of range (200 to 599)", m.Status)
+	}
+	return nil
+}
+
+// WithMockResponses makes the client answer requests matching any of mocks
+// itself, the first match winning, so frontends can be demoed against
+// endpoints the backend doesn't have yet.
+func (c *Client) WithMockResponses(mocks []MockResponse) *Client {
+	c.mocks = mocks
+	return c
+}
+
+// matches reports whether the mock answers req.
+func (m *MockResponse) matches(req *http.Request) bool {
+	if m.Method != "" && m.Method != req.Method {
+		return false
+	}
+	p := path.Clean("/" + req.URL.Path)
+	if prefix, ok := strings.CutSuffix(m.Path, "*"); ok {
+		return strings.HasPrefix(p, prefix)
+	}
+	return p == m.Path
+}
+
+// status returns the response status.
+func (m *MockResponse) status() int {
+	if m.Status == 0 {
+		return http.StatusOK
+	}
+	return m.Status
+}
+
+// write sends the mock response on stream.
+func (m *MockResponse) write(stream transport.Stream) {
+	status := m.status()
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+		if body := strings.TrimSpace(m.Body); strings.HasPrefix(body, "{") || strings.HasPrefix(body, "[") {
+			contentType = "application/json"
+		}
+	}
+	fmt.Fprintf(stream, "HTTP/1.1 %d %s\r\nContent-Type: %s\r\nContent-Length: %d\r\n%s: 1\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), contentType, len(m.Body), MockHeader, m.Body)
+}
+
+// mockInterceptor answers requests matching a mock response.
+func (c *Client) mockInterceptor(next StreamHandler) StreamHandler {
+	return func(ctx context.Context, stream transport.Stream) {
+		start := time.Now()
+		req, replay, err := PeekRequest(stream)
+		if err == nil {
+			for i := range c.mocks {
+				if m := &c.mocks[i]; m.matches(req) {
+					log.Info("Mocked request", "method", req.Method, "path", req.RequestURI, "status", m.status())
+					c.stats.record(m.status(), time.Since(start), 0, 0)
+					m.write(stream)
+					stream.Close()
+					return
+				}
+			}
+		}
+		next(ctx, replay)
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseMockResponse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    MockResponse
+		wantErr bool
+	}{
+		{spec: `/api/flags=200 {"beta":true}`, want: MockResponse{Path: "/api/flags", Status: 200, Body: `{"beta":true}`}},
+		{spec: "delete /api/items/*=204", want: MockResponse{Method: "DELETE", Path: "/api/items/*", Status: 204}},
+		{spec: "/health=503 down for maintenance", want: MockResponse{Path: "/health", Status: 503, Body: "down for maintenance"}},
+		{spec: "/api/flags", wantErr: true},
+		{spec: "api/flags=200", wantErr: true},
+		{spec: "/api/flags=ok", wantErr: true},
+		{spec: "/api/flags=99", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseMockResponse(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMockResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseMockResponse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleStreamMocksResponse(t *testing.T) {
+	// Nothing listens locally: a mocked request must not be forwarded
+	c := New("", "127.0.0.1:1").WithMockResponses([]MockResponse{
+		{Method: "POST", Path: "/api/flags", Status: http.StatusCreated},
+		{Path: "/api/*", Body: `{"beta":true}`},
+	})
+
+	tests := []struct {
+		method      string
+		path        string
+		status      int
+		contentType string
+	}{
+		{method: "GET", path: "/api/flags", status: http.StatusOK, contentType: "application/json"},
+		{method: "POST", path: "/api/flags", status: http.StatusCreated, contentType: "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			server, tunnel := net.Pipe()
+			defer server.Close()
+			go c.handleStream(context.Background(), pipeStream{tunnel})
+
+			io.WriteString(server, tt.method+" "+tt.path+" HTTP/1.1\r\nHost: app\r\nContent-Length: 0\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != tt.contentType {
+				t.Errorf("response = %d %q, want %d %q", resp.StatusCode, resp.Header.Get("Content-Type"), tt.status, tt.contentType)
+			}
+			if resp.Header.Get(MockHeader) != "1" {
+				t.Errorf("%s header missing", MockHeader)
+			}
+		})
+	}
+	if got := c.Stats().Requests; got != 2 {
+		t.Errorf("recorded requests = %d, want 2", got)
+	}
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/transport"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// netPollInterval is how often interface addresses and the clock are
+	// checked for changes the platform doesn't report as events.
+	netPollInterval = 2 * time.Second
+
+	// netSettleDelay coalesces the burst of events a single change (e.g.
+	// joining a Wi-Fi network) produces into one notification.
+	netSettleDelay = 500 * time.Millisecond
+
+	// sleepThreshold is how far the wall clock must run ahead of the
+	// monotonic clock between polls for the machine to count as having
+	// slept.
+	sleepThreshold = 5 * time.Second
+
+	// netCheckTimeout bounds the ping that checks whether the server
+	// connection survived a network change.
+	netCheckTimeout = 3 * time.Second
+)
+
+// WithNetworkMonitor makes RunWithReconnect watch for network changes,
+// such as switching Wi-Fi networks or waking from sleep, and reconnect as
+// soon as one leaves the server connection dead instead of waiting for
+// heartbeats to fail.
+func (c *Client) WithNetworkMonitor(enabled bool) *Client {
+	c.networkMonitor = enabled
+	return c
+}
+
+// netMonitor reports changes to the machine's network.
+type netMonitor struct {
+	mu      sync.Mutex
+	changes chan struct{}
+	settle  *time.Timer
+}
+
+// startNetMonitor watches the network until ctx is done.
+func startNetMonitor(ctx context.Context) *netMonitor {
+	m := &netMonitor{changes: make(chan struct{})}
+	go m.poll(ctx)
+	go func() {
+		if err := watchInterfaces(ctx, m.trigger); err != nil {
+			log.Debug("network events unavailable, polling instead", "error", err)
+		}
+	}()
+	return m
+}
+
+// changed returns a channel that is closed at the next network change.
+func (m *netMonitor) changed() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.changes
+}
+
+// trigger reports a change once no further ones arrive for netSettleDelay.
+func (m *netMonitor) trigger() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.settle != nil {
+		m.settle.Stop()
+	}
+	m.settle = time.AfterFunc(netSettleDelay, m.notify)
+}
+
+// notify wakes everyone waiting on changed.
+func (m *netMonitor) notify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	close(m.changes)
+	m.changes = make(chan struct{})
+}
+
+// poll checks for address changes and sleep until ctx is done.
+func (m *netMonitor) poll(ctx context.Context) {
+	ticker := time.NewTicker(netPollInterval)
+	defer ticker.Stop()
+	addrs := interfaceAddrs()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// The monotonic clock stops while the machine sleeps; the wall
+			// clock doesn't
+			slept := now.Round(0).Sub(last.Round(0))-now.Sub(last) > sleepThreshold
+			last = now
+			current := interfaceAddrs()
+			if slept || !slices.Equal(current, addrs) {
+				addrs = current
+				m.trigger()
+			}
+		}
+	}
+}
+
+// interfaceAddrs returns the machine's interface addresses, sorted.
+func interfaceAddrs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	slices.Sort(out)
+	return out
+}
+
+// watchNetwork closes session if a network change leaves it dead, until
+// done is closed.
+func (c *Client) watchNetwork(session transport.Session, localAddr net.Addr, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-c.netmon.changed():
+		}
+		if connectionAlive(session, localAddr) {
+			log.Debug("network changed, server connection still alive")
+			continue
+		}
+		log.Info("Network changed, reconnecting")
+		c.networkChanged.Store(true)
+		session.Close()
+		return
+	}
+}
+
+// connectionAlive reports whether the connection from localAddr still
+// works: its address must still belong to an interface and the server must
+// answer a ping.
+func connectionAlive(session transport.Session, localAddr net.Addr) bool {
+	if tcp, ok := localAddr.(*net.TCPAddr); ok && !hasInterfaceIP(tcp.IP) {
+		return false
+	}
+	pinger, ok := session.(transport.Pinger)
+	if !ok {
+		return true
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := pinger.Ping()
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(netCheckTimeout):
+		return false
+	}
+}
+
+// hasInterfaceIP reports whether ip is assigned to one of the machine's
+// interfaces.
+func hasInterfaceIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true // can't tell; assume so
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
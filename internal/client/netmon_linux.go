@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// rtnetlink multicast groups (from linux/rtnetlink.h), which syscall
+// doesn't define.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// watchInterfaces calls changed whenever a link or address changes, as
+// reported by rtnetlink, until ctx is done.
+func watchInterfaces(ctx context.Context, changed func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so
+	// closing the file interrupts the read
+	f := os.NewFile(uintptr(fd), "netlink")
+	defer f.Close()
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := f.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		changed()
+	}
+}
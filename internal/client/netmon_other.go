@@ -0,0 +1,14 @@
+//go:build !linux
+
+package client
+
+import (
+	"context"
+	"errors"
+)
+
+// watchInterfaces reports that this platform has no interface change
+// events; changes are picked up by polling instead.
+func watchInterfaces(context.Context, func()) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/transport"
+)
+
+func TestNetMonitorCoalescesChanges(t *testing.T) {
+	m := &netMonitor{changes: make(chan struct{})}
+	changed := m.changed()
+
+	for range 3 {
+		m.trigger()
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * netSettleDelay):
+		t.Fatal("change not reported")
+	}
+
+	// The burst was reported once: the next channel stays open
+	select {
+	case <-m.changed():
+		t.Error("burst of changes reported more than once")
+	case <-time.After(2 * netSettleDelay):
+	}
+}
+
+// sessionPair returns both ends of an in-memory session.
+func sessionPair(t *testing.T) (client, server transport.Session) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	client, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	server, err = transport.Default().Server(serverConn)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestWatchNetwork(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverDown bool
+		wantClosed bool
+	}{
+		{name: "connection survived", serverDown: false, wantClosed: false},
+		{name: "connection lost", serverDown: true, wantClosed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, server := sessionPair(t)
+			if tt.serverDown {
+				server.Close()
+			}
+			c := New("", "")
+			c.netmon = &netMonitor{changes: make(chan struct{})}
+
+			done := make(chan struct{})
+			defer close(done)
+			exited := make(chan struct{})
+			go func() {
+				c.watchNetwork(session, nil, done)
+				close(exited)
+			}()
+			// Keep reporting changes: the first may come before the watcher
+			// is waiting
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			deadline := time.After(time.Second)
+		wait:
+			for {
+				select {
+				case <-exited:
+					break wait
+				case <-ticker.C:
+					c.netmon.notify()
+				case <-deadline:
+					if tt.wantClosed {
+						t.Fatal("session not closed after the network changed")
+					}
+					break wait
+				}
+			}
+			if session.IsClosed() != tt.wantClosed {
+				t.Errorf("session closed = %v, want %v", session.IsClosed(), tt.wantClosed)
+			}
+			if c.networkChanged.Load() != tt.wantClosed {
+				t.Errorf("networkChanged = %v, want %v", c.networkChanged.Load(), tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestConnectionAliveChecksLocalAddress(t *testing.T) {
+	session, _ := sessionPair(t)
+	gone := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}
+	if connectionAlive(session, gone) {
+		t.Error("connection from an address no interface has reported alive")
+	}
+	if !connectionAlive(session, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}) {
+		t.Error("connection from loopback reported dead")
+	}
+}
+
+func TestWatchInterfacesStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watchInterfaces(ctx, func() {}) }()
+
+	select {
+	case err := <-done:
+		t.Skipf("network events unavailable: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watchInterfaces() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchInterfaces did not stop")
+	}
+}
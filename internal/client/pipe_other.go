@@ -0,0 +1,14 @@
+//go:build !windows
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// dialPipe fails: named pipes are a Windows feature.
+func dialPipe(ctx context.Context, name string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: namedPipeAddr(name), Err: errors.New("named pipes are only supported on Windows")}
+}
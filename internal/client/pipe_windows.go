@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// pipeBusyPoll is how often a named pipe whose instances are all in use is
+// tried again.
+const pipeBusyPoll = 10 * time.Millisecond
+
+// dialPipe connects to the Windows named pipe name. The handle is opened
+// for overlapped I/O, so reads and writes can run at the same time and
+// deadlines work.
+func dialPipe(ctx context.Context, name string) (net.Conn, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: namedPipeAddr(name), Err: err}
+	}
+	for {
+		// SECURITY_IDENTIFICATION keeps the pipe's server from
+		// impersonating the client's user
+		h, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return &namedPipeConn{File: os.NewFile(uintptr(h), name), addr: namedPipeAddr(name)}, nil
+		}
+		if err != windows.ERROR_PIPE_BUSY {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: namedPipeAddr(name), Err: os.NewSyscallError("CreateFile", err)}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: namedPipeAddr(name), Err: fmt.Errorf("all pipe instances are busy: %w", ctx.Err())}
+		case <-time.After(pipeBusyPoll):
+		}
+	}
+}
+
+// namedPipeConn is a connection to a named pipe.
+type namedPipeConn struct {
+	*os.File
+	addr namedPipeAddr
+}
+
+func (c *namedPipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *namedPipeConn) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestDialPipe(t *testing.T) {
+	name := fmt.Sprintf(`\\.\pipe\otun-test-%d`, os.Getpid())
+	path, _ := windows.UTF16PtrFromString(name)
+	h, err := windows.CreateNamedPipe(path, windows.PIPE_ACCESS_DUPLEX, windows.PIPE_TYPE_BYTE|windows.PIPE_WAIT, 1, 4096, 4096, 0, nil)
+	if err != nil {
+		t.Fatalf("CreateNamedPipe() error = %v", err)
+	}
+	server := os.NewFile(uintptr(h), name)
+	defer server.Close()
+	go func() {
+		if err := windows.ConnectNamedPipe(h, nil); err != nil && err != windows.ERROR_PIPE_CONNECTED {
+			return
+		}
+		io.Copy(server, server) // echo
+	}()
+
+	c := New("", "//./pipe/"+name[len(`\\.\pipe\`):])
+	conn, err := c.dialLocalService(context.Background())
+	if err != nil {
+		t.Fatalf("dialLocalService() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Reads and writes run at the same time when proxying
+	done := make(chan []byte)
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+		done <- buf
+	}()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := <-done; string(got) != "hello" {
+		t.Errorf("echoed %q, want hello", got)
+	}
+	if got := conn.RemoteAddr().String(); got != name {
+		t.Errorf("RemoteAddr() = %q, want %q", got, name)
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// Probe checks that the server accepts the client's credentials by
+// registering a tunnel on a server-chosen subdomain (or port, for TCP
+// tunnels) and closing it straight away. It returns the URL the server
+// assigned, or the registration error.
+func (c *Client) Probe(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session, err := c.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	register := &protocol.RegisterMessage{Token: c.token}
+	if c.tcp {
+		register.Protocol = protocol.ProtocolTCP
+	}
+	if err := c.controlStream.SendRegisterMessage(register); err != nil {
+		return "", fmt.Errorf("failed to send register message: %w", err)
+	}
+	msg, err := c.controlStream.ReadMessage()
+	if err != nil {
+		return "", fmt.Errorf("failed to read registered message: %w", err)
+	}
+
+	switch m := msg.(type) {
+	case *protocol.RegisteredMessage:
+		return m.URL, nil
+	case *protocol.ErrorMessage:
+		return "", registrationError(m)
+	default:
+		return "", fmt.Errorf("unexpected message type: %T", msg)
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+func TestProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go fakeServer(t, ln, "http://abc.localhost:8080", "abc")
+
+	url, err := New(ln.Addr().String(), "127.0.0.1:1").WithSubdomain("mine").Probe(context.Background())
+	if err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+	if url != "http://abc.localhost:8080" {
+		t.Errorf("Probe() = %q, want the assigned URL", url)
+	}
+}
+
+func TestProbeRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		session, err := yamux.Server(conn, nil)
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		cs := protocol.NewControlStream(stream)
+		cs.ReadMessage()
+		cs.SendError("invalid or missing API key")
+		cs.ReadMessage()
+	}()
+
+	_, err = New(ln.Addr().String(), "127.0.0.1:1").WithToken("bad").Probe(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "invalid or missing API key") {
+		t.Errorf("Probe() error = %v, want the server's error", err)
+	}
+}
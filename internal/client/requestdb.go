@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/bc183/otun/internal/requestdb"
+	"github.com/charmbracelet/log"
+)
+
+// restoreTimeout bounds loading persisted exchanges at startup.
+const restoreTimeout = 5 * time.Second
+
+// restore loads the most recent exchanges from db and persists new ones to
+// it. IDs continue from the highest restored one, so they stay unique.
+func (in *inspector) restore(db *requestdb.DB, subdomain func() string) {
+	ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+	defer cancel()
+	records, err := db.Recent(ctx, requestdb.Query{Limit: in.capacity})
+	if err != nil {
+		log.Warn("failed to load request history", "error", err)
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.db, in.subdomain = db, subdomain
+	in.requests = in.requests[:0]
+	for i := len(records) - 1; i >= 0; i-- { // oldest first
+		var r CapturedRequest
+		if err := json.Unmarshal(records[i].Data, &r); err != nil {
+			continue
+		}
+		if id, err := strconv.Atoi(r.ID); err == nil && id > in.nextID {
+			in.nextID = id
+		}
+		in.requests = append(in.requests, &r)
+	}
+}
+
+// persist queues r for the request database, if enabled.
+// Must be called with in.mu held.
+func (in *inspector) persist(r *CapturedRequest) {
+	if in.db == nil {
+		return
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	rec := requestdb.Record{
+		Time:      r.Time,
+		Subdomain: in.subdomain(),
+		Method:    r.Request.Method,
+		Host:      r.Request.Host,
+		Path:      r.Request.URI,
+		Duration:  r.Duration,
+		Data:      data,
+	}
+	if r.Response != nil {
+		rec.Status = r.Response.Status
+	}
+	in.db.Log(rec)
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/requestdb"
+)
+
+func TestInspectorRestoresRequestDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.db")
+
+	db, err := requestdb.Open(path, requestdb.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New("server:4443", "localhost:3000").WithInspector(2).WithRequestDB(db)
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		c.inspector.add(&CapturedRequest{
+			Time:     time.Now(),
+			Request:  CapturedHTTPRequest{Method: "GET", URI: uri, Host: "app.tunnel.example.com"},
+			Response: &CapturedHTTPResponse{Status: 200},
+		})
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = requestdb.Open(path, requestdb.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	records, err := db.Recent(context.Background(), requestdb.Query{})
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Recent() = %d records, %v; want all 3", len(records), err)
+	}
+	if records[0].Path != "/c" || records[0].Status != 200 {
+		t.Errorf("newest record = %+v, want /c with status 200", records[0])
+	}
+
+	// A restarted client shows the last capacity exchanges and continues
+	// their IDs
+	restarted := New("server:4443", "localhost:3000").WithInspector(2).WithRequestDB(db)
+	got := restarted.inspector.list()
+	if len(got) != 2 || got[0].Request.URI != "/c" || got[1].Request.URI != "/b" {
+		t.Fatalf("restored %+v, want /c and /b", got)
+	}
+	next := &CapturedRequest{Request: CapturedHTTPRequest{URI: "/d"}}
+	restarted.inspector.add(next)
+	if next.ID != "4" {
+		t.Errorf("next ID = %q, want 4", next.ID)
+	}
+}
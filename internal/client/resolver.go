@@ -0,0 +1,250 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// dohTimeout bounds DNS-over-HTTPS queries whose connection has no deadline.
+const dohTimeout = 10 * time.Second
+
+// Resolver looks up the addresses of a host. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// WithResolver makes the client resolve the server's host name with r
+// instead of leaving it to the server dialer. The addresses found are
+// remembered: reconnects re-resolve but fall back to them if resolution
+// fails, and each address is tried in turn, starting with the last one that
+// worked, so a dead server behind a round-robin record is skipped.
+func (c *Client) WithResolver(r Resolver) *Client {
+	c.resolver = r
+	return c
+}
+
+// ParseResolver builds a resolver that queries a specific DNS server:
+//
+//	1.1.1.1, 1.1.1.1:53, udp://1.1.1.1  plain DNS over UDP
+//	tcp://1.1.1.1                        plain DNS over TCP
+//	tls://1.1.1.1, tls://dns.google:853  DNS over TLS
+//	https://dns.google/dns-query         DNS over HTTPS
+func ParseResolver(spec string) (*net.Resolver, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid resolver %q", spec)
+	}
+
+	var dial func(ctx context.Context) (net.Conn, error)
+	switch u.Scheme {
+	case "udp", "tcp":
+		addr := withDefaultPort(u.Host, "53")
+		dial = func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, u.Scheme, addr)
+		}
+	case "tls":
+		addr := withDefaultPort(u.Host, "853")
+		d := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	case "https":
+		endpoint := u.String()
+		dial = func(context.Context) (net.Conn, error) {
+			return &dohConn{endpoint: endpoint}, nil
+		}
+	default:
+		return nil, fmt.Errorf("invalid resolver %q: scheme must be udp, tcp, tls or https", spec)
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}, nil
+}
+
+// withDefaultPort adds port to host if it has none.
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// serverAddrs remembers the addresses the server's host last resolved to.
+type serverAddrs struct {
+	mu    sync.Mutex
+	addrs []string
+	first int // index of the address to try first
+}
+
+// resolveServer returns the addresses to dial for the server, starting with
+// the one to try first.
+func (c *Client) resolveServer(ctx context.Context) ([]string, error) {
+	host, port, err := net.SplitHostPort(c.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{c.serverAddr}, nil
+	}
+
+	ips, err := c.resolver.LookupHost(ctx, host)
+	c.serverAddrs.mu.Lock()
+	defer c.serverAddrs.mu.Unlock()
+	switch {
+	case err == nil && len(ips) > 0:
+		if !sameAddrs(ips, c.serverAddrs.addrs) {
+			c.serverAddrs.addrs = ips
+			c.serverAddrs.first = 0
+		}
+	case len(c.serverAddrs.addrs) > 0:
+		log.Warn("failed to resolve server, using last known addresses", "server", host, "error", err)
+	case err == nil:
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	default:
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(c.serverAddrs.addrs))
+	for i := range c.serverAddrs.addrs {
+		ip := c.serverAddrs.addrs[(c.serverAddrs.first+i)%len(c.serverAddrs.addrs)]
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+// serverAddrWorked records that addr, as returned by resolveServer, was
+// connected to, so it is tried first next time.
+func (c *Client) serverAddrWorked(addr string) {
+	host, _, _ := net.SplitHostPort(addr)
+	c.serverAddrs.mu.Lock()
+	defer c.serverAddrs.mu.Unlock()
+	for i, ip := range c.serverAddrs.addrs {
+		if ip == host {
+			c.serverAddrs.first = i
+			return
+		}
+	}
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dohConn carries the resolver's DNS-over-TCP exchanges over HTTPS: each
+// length-prefixed query written is POSTed to the endpoint (RFC 8484) and
+// the answer is read back with the same framing.
+type dohConn struct {
+	endpoint string
+
+	mu       sync.Mutex
+	query    bytes.Buffer
+	response bytes.Reader
+	deadline time.Time
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.response.Len() == 0 {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.response.Read(b)
+}
+
+// exchange sends the buffered query and buffers its framed answer.
+func (c *dohConn) exchange() error {
+	raw := c.query.Bytes()
+	if len(raw) < 2 || len(raw) < 2+int(binary.BigEndian.Uint16(raw)) {
+		return io.ErrUnexpectedEOF
+	}
+	msg := raw[2 : 2+int(binary.BigEndian.Uint16(raw))]
+	c.query.Next(2 + len(msg))
+
+	deadline := c.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(dohTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS-over-HTTPS query failed: %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 65535+1))
+	if err != nil {
+		return err
+	}
+	if len(answer) > 65535 {
+		return errors.New("DNS-over-HTTPS answer too large")
+	}
+
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(answer)))
+	c.response.Reset(append(framed, answer...))
+	return nil
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "https" }
+func (dohAddr) String() string  { return "doh" }
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseResolver(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: "1.1.1.1"},
+		{spec: "1.1.1.1:5353"},
+		{spec: "[2606:4700:4700::1111]:53"},
+		{spec: "udp://9.9.9.9"},
+		{spec: "tcp://9.9.9.9"},
+		{spec: "tls://dns.google"},
+		{spec: "https://cloudflare-dns.com/dns-query"},
+		{spec: "", wantErr: true},
+		{spec: "ftp://dns.example", wantErr: true},
+		{spec: "https:///dns-query", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := ParseResolver(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseResolver(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// dnsAnswer answers an A query with ip, and any other query with no records.
+func dnsAnswer(query []byte, ip net.IP) []byte {
+	// Keep the header and the question, dropping any EDNS record
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	msg := append([]byte(nil), query[:end]...)
+	binary.BigEndian.PutUint16(msg[2:], 0x8180) // response, recursion available
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], 0)
+	binary.BigEndian.PutUint32(msg[8:], 0)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(msg[6:], 1)
+		msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		msg = append(msg, ip.To4()...)
+	}
+	return msg
+}
+
+func TestDoHResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, net.IPv4(192, 0, 2, 7)))
+	}))
+	defer ts.Close()
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			return &dohConn{endpoint: ts.URL}, nil
+		},
+	}
+	addrs, err := r.LookupHost(context.Background(), "tunnel.example.test")
+	if err != nil {
+		t.Fatalf("LookupHost() error = %v", err)
+	}
+	if !slices.Equal(addrs, []string{"192.0.2.7"}) {
+		t.Errorf("LookupHost() = %v, want [192.0.2.7]", addrs)
+	}
+}
+
+// resolverFunc adapts a function to Resolver.
+type resolverFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f resolverFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+func TestResolveServerCachesAndRotates(t *testing.T) {
+	dnsUp := true
+	resolver := resolverFunc(func(ctx context.Context, host string) ([]string, error) {
+		if !dnsUp {
+			return nil, errors.New("no such host")
+		}
+		return []string{"10.0.0.1", "10.0.0.2"}, nil
+	})
+	var dialed []string
+	dialer := dialerFunc(func(ctx context.Context, _, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if address == "10.0.0.1:4443" {
+			return nil, errors.New("connection refused")
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	c := New("tunnel.example.test:4443", "").WithServerDialer(dialer).WithResolver(resolver)
+
+	// The first address is down, so the second is used...
+	conn, err := c.dialServerTCP(context.Background())
+	if err != nil {
+		t.Fatalf("dialServerTCP() error = %v", err)
+	}
+	conn.Close()
+	if want := []string{"10.0.0.1:4443", "10.0.0.2:4443"}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+
+	// ...and tried first on reconnect, even once DNS fails
+	dnsUp = false
+	dialed = nil
+	conn, err = c.dialServerTCP(context.Background())
+	if err != nil {
+		t.Fatalf("dialServerTCP() with DNS down error = %v", err)
+	}
+	conn.Close()
+	if want := []string{"10.0.0.2:4443"}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
+
+func TestResolveServerFailsWithoutCache(t *testing.T) {
+	resolver := resolverFunc(func(context.Context, string) ([]string, error) {
+		return nil, errors.New("no such host")
+	})
+	c := New("tunnel.example.test:4443", "").WithResolver(resolver)
+	if _, err := c.dialServerTCP(context.Background()); err == nil {
+		t.Error("dialServerTCP() succeeded without any resolved address")
+	}
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bc183/otun/internal/proxy"
+	"github.com/charmbracelet/log"
+)
+
+// maxRewriteBytes bounds the response bodies buffered for rewriting; larger
+// responses are passed through unchanged.
+const maxRewriteBytes = 4 << 20
+
+// TunnelURLPlaceholder in a rewrite's replacement stands for the tunnel's
+// public URL.
+const TunnelURLPlaceholder = "{{url}}"
+
+// Rewrite replaces text in the bodies of the local service's text
+// responses, e.g. a localhost URL embedded in HTML or JSON.
+type Rewrite struct {
+	Find    string `yaml:"find"`
+	Replace string `yaml:"replace"`
+}
+
+// ParseRewrite parses a rewrite written as "FIND=REPLACE", e.g.
+// "http://localhost:3000={{url}}".
+func ParseRewrite(spec string) (Rewrite, error) {
+	find, replace, ok := strings.Cut(spec, "=")
+	if !ok || find == "" {
+		return Rewrite{}, fmt.Errorf("invalid rewrite %q: want FIND=REPLACE", spec)
+	}
+	return Rewrite{Find: find, Replace: replace}, nil
+}
+
+// WithRewrites makes the client apply rules, in order, to the bodies of
+// text responses (HTML, CSS, JavaScript, JSON, XML and plain text) up to
+// 4MB. Requests are sent without Accept-Encoding so responses arrive
+// uncompressed; compressed or larger responses are passed through as is.
+func (c *Client) WithRewrites(rules []Rewrite) *Client {
+	c.rewrites = rules
+	return c
+}
+
+// rewritable reports whether a response with these headers may have its
+// body rewritten.
+func rewritable(h http.Header) bool {
+	if enc := h.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// rewriteBody applies the rewrites to body.
+func (c *Client) rewriteBody(body []byte) []byte {
+	url := c.Status().URL
+	for _, r := range c.rewrites {
+		replace := strings.ReplaceAll(r.Replace, TunnelURLPlaceholder, url)
+		body = bytes.ReplaceAll(body, []byte(r.Find), []byte(replace))
+	}
+	return body
+}
+
+// serveRewrites reads HTTP/1.1 requests from conn, forwards each to the
+// local service over upstream and writes back the response, rewritten if
+// it is text. Protocol upgrades are proxied unchanged once switched.
+func (c *Client) serveRewrites(conn, upstream net.Conn) {
+	defer conn.Close()
+	defer upstream.Close()
+
+	br := bufio.NewReader(conn)
+	ubr := bufio.NewReader(upstream)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		// The request body is sent right away, so answer the Expect here
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			io.WriteString(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		}
+		req.Header.Del("Accept-Encoding")
+		if err := req.Write(upstream); err != nil {
+			log.Debug("failed to forward request for rewriting", "error", err)
+			return
+		}
+
+		resp, err := readFinalResponse(ubr, conn, req)
+		if err != nil {
+			log.Debug("failed to read response for rewriting", "error", err)
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if err := resp.Write(conn); err != nil {
+				return
+			}
+			proxy.Bidirectional(&readerConn{Reader: br, Conn: conn}, &readerConn{Reader: ubr, Conn: upstream})
+			return
+		}
+		if err := c.writeRewritten(conn, resp); err != nil {
+			log.Debug("failed to write rewritten response", "error", err)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// readFinalResponse reads the response to req from r, passing interim
+// responses (103 Early Hints and the like) through to w.
+func readFinalResponse(r *bufio.Reader, w io.Writer, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if resp.StatusCode == http.StatusContinue {
+			// Already sent for the body above
+			continue
+		}
+		fmt.Fprintf(w, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+		resp.Header.Write(w)
+		io.WriteString(w, "\r\n")
+	}
+}
+
+// writeRewritten writes resp to w, rewriting its body if it is text and
+// no larger than maxRewriteBytes.
+func (c *Client) writeRewritten(w io.Writer, resp *http.Response) error {
+	defer resp.Body.Close()
+	if !rewritable(resp.Header) || resp.ContentLength > maxRewriteBytes {
+		return resp.Write(w)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRewriteBytes {
+		// Too large after all; send it unchanged
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), resp.Body))
+		return resp.Write(w)
+	}
+
+	body = c.rewriteBody(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Length")
+	return resp.Write(w)
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewritable(t *testing.T) {
+	tests := []struct {
+		contentType string
+		encoding    string
+		want        bool
+	}{
+		{contentType: "text/html; charset=utf-8", want: true},
+		{contentType: "application/json", want: true},
+		{contentType: "application/vnd.api+json", want: true},
+		{contentType: "application/javascript", want: true},
+		{contentType: "text/html", encoding: "gzip"},
+		{contentType: "image/png"},
+		{contentType: ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("Content-Type", tt.contentType)
+		if tt.encoding != "" {
+			h.Set("Content-Encoding", tt.encoding)
+		}
+		if got := rewritable(h); got != tt.want {
+			t.Errorf("rewritable(%q, %q) = %v, want %v", tt.contentType, tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestParseRewrite(t *testing.T) {
+	r, err := ParseRewrite("http://localhost:3000={{url}}")
+	if err != nil || r.Find != "http://localhost:3000" || r.Replace != TunnelURLPlaceholder {
+		t.Errorf("ParseRewrite() = %+v, %v", r, err)
+	}
+	if _, err := ParseRewrite("=x"); err == nil {
+		t.Error("ParseRewrite accepted an empty find")
+	}
+}
+
+func TestHandleStreamRewritesResponses(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("Accept-Encoding = %q, want it removed", r.Header.Get("Accept-Encoding"))
+		}
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="http://localhost:3000/next">next</a>`)
+		case "/logo.png":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, "http://localhost:3000")
+		}
+	}))
+	defer local.Close()
+
+	c := New("", local.Listener.Addr().String()).WithRewrites([]Rewrite{{Find: "http://localhost:3000", Replace: "{{url}}"}})
+	c.emit(Event{Type: EventRegistered, URL: "https://demo.example.com", Subdomain: "demo"})
+
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	// Both requests go over one keep-alive connection
+	br := bufio.NewReader(server)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/page", want: `<a href="https://demo.example.com/next">next</a>`},
+		{path: "/logo.png", want: "http://localhost:3000"},
+	}
+	for _, tt := range tests {
+		io.WriteString(server, "GET "+tt.path+" HTTP/1.1\r\nHost: app\r\nAccept-Encoding: gzip\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("failed to read response for %s: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.want {
+			t.Errorf("%s body = %q, want %q", tt.path, body, tt.want)
+		}
+		if resp.ContentLength != int64(len(tt.want)) {
+			t.Errorf("%s Content-Length = %d, want %d", tt.path, resp.ContentLength, len(tt.want))
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// speedTestPings is how many round trips a speed test measures.
+const speedTestPings = 10
+
+// SpeedTestResult is the outcome of a speed test.
+type SpeedTestResult struct {
+	// RTT is the median and MinRTT the fastest round trip to the server.
+	RTT    time.Duration
+	MinRTT time.Duration
+
+	// Bytes sent in each direction and how long it took.
+	DownloadBytes    int64
+	DownloadDuration time.Duration
+	UploadBytes      int64
+	UploadDuration   time.Duration
+}
+
+// DownloadRate returns the server-to-client throughput in bytes per second.
+func (r *SpeedTestResult) DownloadRate() float64 {
+	return rate(r.DownloadBytes, r.DownloadDuration)
+}
+
+// UploadRate returns the client-to-server throughput in bytes per second.
+func (r *SpeedTestResult) UploadRate() float64 {
+	return rate(r.UploadBytes, r.UploadDuration)
+}
+
+func rate(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// SpeedTest measures the round-trip time and throughput between the client
+// and the server, transferring size bytes each way (less if the server
+// allows less). The local service is not involved.
+func (c *Client) SpeedTest(ctx context.Context, size int64) (*SpeedTestResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	if err := c.controlStream.SendSpeedTest(c.token); err != nil {
+		return nil, fmt.Errorf("failed to send speedtest message: %w", err)
+	}
+	msg, err := c.controlStream.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read speedtest_ready message: %w", err)
+	}
+	switch m := msg.(type) {
+	case *protocol.SpeedTestReadyMessage:
+		size = min(size, m.MaxBytes)
+	case *protocol.ErrorMessage:
+		return nil, fmt.Errorf("%w: speed test failed: %s", ErrPermanentFailure, m.Message)
+	default:
+		return nil, fmt.Errorf("unexpected message type: %T", msg)
+	}
+
+	result := &SpeedTestResult{}
+	if err := c.measureRTT(result); err != nil {
+		return nil, err
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	start := time.Now()
+	if err := protocol.WriteSpeedTestHeader(stream, protocol.SpeedTestDownload, size); err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+	result.DownloadBytes, err = io.Copy(io.Discard, stream)
+	result.DownloadDuration = time.Since(start)
+	stream.Close()
+	if err != nil {
+		return nil, fmt.Errorf("download failed: %w", err)
+	}
+
+	stream, err = session.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+	start = time.Now()
+	if err := protocol.WriteSpeedTestHeader(stream, protocol.SpeedTestUpload, size); err != nil {
+		return nil, fmt.Errorf("upload failed: %w", err)
+	}
+	buf := make([]byte, 32<<10)
+	for sent := int64(0); sent < size; {
+		n, err := stream.Write(buf[:min(int64(len(buf)), size-sent)])
+		sent += int64(n)
+		if err != nil {
+			return nil, fmt.Errorf("upload failed: %w", err)
+		}
+	}
+	// The server acknowledges once it has received everything
+	var ack [8]byte
+	if _, err := io.ReadFull(stream, ack[:]); err != nil {
+		return nil, fmt.Errorf("upload failed: %w", err)
+	}
+	result.UploadDuration = time.Since(start)
+	result.UploadBytes = int64(binary.BigEndian.Uint64(ack[:]))
+
+	return result, nil
+}
+
+// measureRTT times heartbeat round trips on the control stream.
+func (c *Client) measureRTT(result *SpeedTestResult) error {
+	rtts := make([]time.Duration, 0, speedTestPings)
+	for range speedTestPings {
+		start := time.Now()
+		if err := c.controlStream.SendHeartbeat(); err != nil {
+			return fmt.Errorf("failed to send heartbeat: %w", err)
+		}
+		msg, err := c.controlStream.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read heartbeat ack: %w", err)
+		}
+		if _, ok := msg.(*protocol.HeartbeatAckMessage); !ok {
+			return fmt.Errorf("unexpected message type: %T", msg)
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	slices.Sort(rtts)
+	result.RTT, result.MinRTT = rtts[len(rtts)/2], rtts[0]
+	return nil
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLatencySamples bounds the latency samples kept for percentiles by
+// default; older samples are overwritten once the limit is reached.
+const maxLatencySamples = 10000
+
+// Summary describes the traffic a client has served.
+type Summary struct {
+	Requests int
+
+	// Statuses counts responses by status code. Status 0 counts requests
+	// that got no response (e.g. the local service was unreachable).
+	Statuses map[int]int
+
+	// P50 and P95 are time-to-first-response-byte percentiles.
+	P50 time.Duration
+	P95 time.Duration
+
+	// BytesUp is sent to the local service; BytesDown is returned from it.
+	BytesUp   int64
+	BytesDown int64
+}
+
+// StatusBreakdown formats Statuses as "200=12 404=3", sorted by code.
+func (s Summary) StatusBreakdown() string {
+	codes := make([]int, 0, len(s.Statuses))
+	for code := range s.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		label := strconv.Itoa(code)
+		if code == 0 {
+			label = "error"
+		}
+		parts = append(parts, fmt.Sprintf("%s=%d", label, s.Statuses[code]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// requestStats accumulates per-request statistics.
+type requestStats struct {
+	mu        sync.Mutex
+	requests  int
+	statuses  map[int]int
+	latencies []time.Duration
+	maxSize   int // latency samples kept
+	next      int // next slot to overwrite once latencies is full
+	bytesUp   int64
+	bytesDown int64
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{statuses: make(map[int]int), maxSize: maxLatencySamples}
+}
+
+// record adds a completed request. latency is ignored if status is 0.
+func (s *requestStats) record(status int, latency time.Duration, up, down int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.statuses[status]++
+	s.bytesUp += up
+	s.bytesDown += down
+	if status == 0 {
+		return
+	}
+	if len(s.latencies) < s.maxSize {
+		s.latencies = append(s.latencies, latency)
+	} else {
+		s.latencies[s.next] = latency
+		s.next = (s.next + 1) % s.maxSize
+	}
+}
+
+// summary returns a snapshot of the statistics.
+func (s *requestStats) summary() Summary {
+	s.mu.Lock()
+	statuses := make(map[int]int, len(s.statuses))
+	for code, n := range s.statuses {
+		statuses[code] = n
+	}
+	latencies := append([]time.Duration(nil), s.latencies...)
+	sum := Summary{
+		Requests:  s.requests,
+		Statuses:  statuses,
+		BytesUp:   s.bytesUp,
+		BytesDown: s.bytesDown,
+	}
+	s.mu.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	sum.P50 = percentile(latencies, 50)
+	sum.P95 = percentile(latencies, 95)
+	return sum
+}
+
+// statusCounts returns a copy of the response counts by status code.
+func (s *requestStats) statusCounts() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[int]int, len(s.statuses))
+	for code, n := range s.statuses {
+		statuses[code] = n
+	}
+	return statuses
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// meteredConn counts bytes through a local service connection and records
+// the status code of the first final response (skipping 1xx interim
+// responses such as 103 Early Hints) and the arrival time of its first byte.
+type meteredConn struct {
+	net.Conn
+	up, down  atomic.Int64
+	head      []byte // first bytes of the response, until the status is known
+	status    int
+	firstByte time.Time
+
+	// Interim responses are skipped by looking for the end of their head
+	done    bool
+	interim bool
+	tail    uint32
+
+	// Captured traffic for the inspector (nil when disabled)
+	reqCapture, respCapture *captureBuffer
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.up.Add(int64(n))
+	if c.reqCapture != nil {
+		c.reqCapture.Write(b[:n])
+	}
+	return n, err
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.firstByte.IsZero() {
+			c.firstByte = time.Now()
+		}
+		c.observe(b[:n])
+	}
+	c.down.Add(int64(n))
+	if c.respCapture != nil {
+		c.respCapture.Write(b[:n])
+	}
+	return n, err
+}
+
+// observe scans response bytes for the final status code.
+func (c *meteredConn) observe(b []byte) {
+	for _, ch := range b {
+		if c.done {
+			return
+		}
+		if c.interim {
+			c.tail = c.tail<<8 | uint32(ch)
+			if c.tail == 0x0d0a0d0a { // "\r\n\r\n"
+				c.interim = false
+				c.head = c.head[:0]
+			}
+			continue
+		}
+		// "HTTP/1.1 200" is 12 bytes
+		c.head = append(c.head, ch)
+		if len(c.head) == 12 {
+			status, _ := strconv.Atoi(string(c.head[9:12]))
+			if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+				c.interim = true
+				c.tail = 0
+				continue
+			}
+			c.status = status
+			c.done = true
+		}
+	}
+}
+
+// CloseWrite half-closes the underlying connection if it supports it, so
+// wrapping doesn't hide half-close from the proxy.
+func (c *meteredConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// Stats returns a summary of the requests served so far.
+func (c *Client) Stats() Summary {
+	return c.stats.summary()
+}
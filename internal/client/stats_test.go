@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatsSummary(t *testing.T) {
+	s := newRequestStats()
+	for i := 1; i <= 100; i++ {
+		s.record(http.StatusOK, time.Duration(i)*time.Millisecond, 10, 100)
+	}
+	s.record(http.StatusNotFound, 500*time.Millisecond, 10, 20)
+	s.record(0, 0, 0, 0)
+
+	sum := s.summary()
+	if sum.Requests != 102 {
+		t.Errorf("Requests = %d, want 102", sum.Requests)
+	}
+	if got := sum.StatusBreakdown(); got != "error=1 200=100 404=1" {
+		t.Errorf("StatusBreakdown() = %q", got)
+	}
+	if sum.P50 != 51*time.Millisecond {
+		t.Errorf("P50 = %v, want 51ms", sum.P50)
+	}
+	if sum.P95 != 96*time.Millisecond {
+		t.Errorf("P95 = %v, want 96ms", sum.P95)
+	}
+	if sum.BytesUp != 1010 || sum.BytesDown != 10020 {
+		t.Errorf("bytes = %d up / %d down, want 1010 / 10020", sum.BytesUp, sum.BytesDown)
+	}
+}
+
+func TestStatsLatencySamplesBounded(t *testing.T) {
+	s := newRequestStats()
+	for i := 0; i < maxLatencySamples+10; i++ {
+		s.record(http.StatusOK, time.Second, 0, 0)
+	}
+	if len(s.latencies) != maxLatencySamples {
+		t.Errorf("kept %d samples, want %d", len(s.latencies), maxLatencySamples)
+	}
+}
+
+// pipeStream adapts a net.Conn to transport.Stream.
+type pipeStream struct {
+	net.Conn
+}
+
+func (pipeStream) StreamID() uint32 { return 1 }
+
+func TestHandleStreamRecordsStats(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	}))
+	defer local.Close()
+
+	c := New("", local.Listener.Addr().String())
+	server, tunnel := net.Pipe()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	io.WriteString(server, "POST /items HTTP/1.1\r\nHost: app\r\nContent-Length: 4\r\nConnection: close\r\n\r\nbody")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	server.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats().Requests == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("request was not recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sum := c.Stats()
+	if sum.Statuses[http.StatusCreated] != 1 {
+		t.Errorf("Statuses = %v, want one 201", sum.Statuses)
+	}
+	if sum.BytesUp == 0 || sum.BytesDown == 0 {
+		t.Errorf("bytes = %d up / %d down, want both non-zero", sum.BytesUp, sum.BytesDown)
+	}
+}
+
+func TestHandleStreamRecordsDialFailure(t *testing.T) {
+	c := New("", "127.0.0.1:1").WithLocalDialRetries(0, 0)
+	server, tunnel := net.Pipe()
+	defer server.Close()
+	go c.handleStream(context.Background(), pipeStream{tunnel})
+
+	io.WriteString(server, "GET / HTTP/1.1\r\nHost: app\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(server), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if got := c.Stats().Statuses[http.StatusBadGateway]; got != 1 {
+		t.Errorf("failed requests = %d, want 1", got)
+	}
+}
+
+func TestMeteredConnSkipsInterimResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     int
+	}{
+		{name: "final only", response: "HTTP/1.1 204 No Content\r\n\r\n", want: 204},
+		{name: "after early hints", response: "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 200 OK\r\n\r\n", want: 200},
+		{name: "after 100 continue", response: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\n\r\n", want: 201},
+		{name: "switching protocols", response: "HTTP/1.1 101 Switching Protocols\r\n\r\n", want: 101},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, w := net.Pipe()
+			go func() {
+				// Byte at a time, so heads span reads
+				for _, b := range []byte(tt.response) {
+					w.Write([]byte{b})
+				}
+				w.Close()
+			}()
+			c := &meteredConn{Conn: local}
+			io.Copy(io.Discard, c)
+			if c.status != tt.want {
+				t.Errorf("status = %d, want %d", c.status, tt.want)
+			}
+		})
+	}
+}
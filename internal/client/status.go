@@ -0,0 +1,140 @@
+package client
+
+import (
+	"errors"
+	"time"
+)
+
+// State is the connection state of a client.
+type State int
+
+const (
+	// StateIdle is the state before Run is called.
+	StateIdle State = iota
+
+	// StateConnecting is set while connecting and registering the tunnel.
+	StateConnecting
+
+	// StateConnected is set while the tunnel is registered.
+	StateConnected
+
+	// StateDisconnected is set when the session is lost, until the client
+	// reconnects or stops.
+	StateDisconnected
+
+	// StateReconnecting is set while waiting for the next reconnection
+	// attempt.
+	StateReconnecting
+
+	// StateStopped is set once Run or RunWithReconnect returns.
+	StateStopped
+)
+
+// String returns the state name.
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Status is a snapshot of the client's connection, for UIs that poll
+// rather than handle events.
+type Status struct {
+	State State
+
+	// URL, Subdomain and RemotePort are those of the last registration.
+	URL        string
+	Subdomain  string
+	RemotePort int
+
+	// ConnectedAt is when the tunnel was registered (zero unless connected).
+	ConnectedAt time.Time
+
+	// Attempt and NextAttempt are the reconnection attempt and when it is
+	// made, while reconnecting.
+	Attempt     int
+	NextAttempt time.Time
+
+	// LastError is the most recent failure (nil if none) and LastErrorAt
+	// when it happened. A shutdown is not a failure.
+	LastError   *Error
+	LastErrorAt time.Time
+
+	// BytesSent and BytesReceived count what the tunnel's streams carried
+	// to and from the server since the client was created, reconnects
+	// included. MaxTransfer is the cap on their sum (0 = none).
+	BytesSent     int64
+	BytesReceived int64
+	MaxTransfer   int64
+
+	// Local describes the connections to the local service.
+	Local LocalConnStats
+}
+
+// Status returns a snapshot of the client's connection.
+func (c *Client) Status() Status {
+	c.statusMu.Lock()
+	st := c.status
+	c.statusMu.Unlock()
+	st.BytesSent = c.transfer.sent.Load()
+	st.BytesReceived = c.transfer.received.Load()
+	st.MaxTransfer = c.transfer.max
+	st.Local = c.localConnStats()
+	return st
+}
+
+// updateStatus applies fn to the status.
+func (c *Client) updateStatus(fn func(*Status)) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	fn(&c.status)
+}
+
+// recordEvent updates the status for an event.
+func (c *Client) recordEvent(e Event) {
+	if e.Type == EventReconnecting {
+		c.counters.reconnects.Add(1)
+	}
+	now := time.Now()
+	c.updateStatus(func(st *Status) {
+		switch e.Type {
+		case EventRegistered:
+			st.State = StateConnected
+			st.URL, st.Subdomain, st.RemotePort = e.URL, e.Subdomain, c.assignedPort
+			st.ConnectedAt = now
+			st.Attempt, st.NextAttempt = 0, time.Time{}
+		case EventDisconnected:
+			st.State = StateDisconnected
+			st.ConnectedAt = time.Time{}
+			st.LastError, st.LastErrorAt = AsError(e.Err), now
+		case EventReconnecting:
+			st.State = StateReconnecting
+			st.Attempt, st.NextAttempt = e.Attempt, now.Add(e.Delay)
+			st.LastError, st.LastErrorAt = AsError(e.Err), now
+		}
+	})
+}
+
+// setStopped records that the client stopped because of err.
+func (c *Client) setStopped(err error) {
+	c.updateStatus(func(st *Status) {
+		st.State = StateStopped
+		st.ConnectedAt, st.NextAttempt = time.Time{}, time.Time{}
+		if err != nil && !errors.Is(err, ErrShutdown) {
+			st.LastError, st.LastErrorAt = AsError(err), time.Now()
+		}
+	})
+}
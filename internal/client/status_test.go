@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	c := New("server:4443", "localhost:3000")
+	if st := c.Status(); st.State != StateIdle {
+		t.Fatalf("initial state = %v, want idle", st.State)
+	}
+
+	c.emit(Event{Type: EventRegistered, URL: "https://demo.example.com", Subdomain: "demo"})
+	st := c.Status()
+	if st.State != StateConnected || st.URL != "https://demo.example.com" || st.Subdomain != "demo" || st.ConnectedAt.IsZero() {
+		t.Errorf("after registration = %+v", st)
+	}
+
+	lost := newError(CodeSessionLost, "", errors.New("session closed: EOF"))
+	c.emit(Event{Type: EventDisconnected, Err: lost})
+	if st := c.Status(); st.State != StateDisconnected || st.LastError != lost || !st.ConnectedAt.IsZero() {
+		t.Errorf("after disconnect = %+v", st)
+	}
+
+	c.emit(Event{Type: EventReconnecting, Err: lost, Attempt: 2, Delay: time.Minute})
+	st = c.Status()
+	if st.State != StateReconnecting || st.Attempt != 2 || time.Until(st.NextAttempt) < 50*time.Second {
+		t.Errorf("while reconnecting = %+v", st)
+	}
+	if st.URL != "https://demo.example.com" {
+		t.Errorf("URL = %q, want the last registration's", st.URL)
+	}
+
+	// A shutdown keeps the last failure
+	c.setStopped(ErrShutdown)
+	if st := c.Status(); st.State != StateStopped || st.LastError != lost {
+		t.Errorf("after shutdown = %+v", st)
+	}
+	c.setStopped(ErrMaxRetriesExceeded)
+	if st := c.Status(); st.LastError == nil || st.LastError.Code != CodeMaxRetries {
+		t.Errorf("after giving up = %+v", st)
+	}
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// timingStream starts the response on a tunnel stream with the line
+// reporting how long the client took to reach its local service, for the
+// server's slow request log. Responses written without dialing (mocks,
+// denied paths, custom handlers) report no dial time.
+type timingStream struct {
+	transport.Stream
+	dial atomic.Int64 // nanoseconds
+	once sync.Once
+}
+
+// timingKey is the context key under which a stream's *timingStream is
+// stored for its handler.
+type timingKey struct{}
+
+// withTiming wraps stream to send its timing line, and returns a context
+// recordDial reports into.
+func withTiming(ctx context.Context, stream transport.Stream) (context.Context, transport.Stream) {
+	ts := &timingStream{Stream: stream}
+	return context.WithValue(ctx, timingKey{}, ts), ts
+}
+
+// recordDial notes d as the time taken to reach the local service for the
+// stream handled with ctx, if the server asked for timing.
+func recordDial(ctx context.Context, d time.Duration) {
+	if ts, ok := ctx.Value(timingKey{}).(*timingStream); ok {
+		ts.dial.Store(int64(d))
+	}
+}
+
+func (s *timingStream) Write(b []byte) (int, error) {
+	first := false
+	s.once.Do(func() { first = true })
+	if !first {
+		return s.Stream.Write(b)
+	}
+	line := protocol.AppendStreamTiming(nil, time.Duration(s.dial.Load()))
+	n, err := s.Stream.Write(append(line, b...))
+	return max(n-len(line), 0), err
+}
+
+// CloseWrite half-closes the stream if it supports it, so wrapping doesn't
+// hide half-close from the proxy.
+func (s *timingStream) CloseWrite() error {
+	if hc, ok := s.Stream.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestStreamTiming(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+
+	for _, tt := range []struct {
+		path     string
+		status   int
+		wantDial bool
+	}{
+		{"/", http.StatusOK, true},
+		{"/.env", http.StatusNotFound, false}, // answered without dialing
+	} {
+		c := New("", local.Listener.Addr().String()).WithDenyPaths(DefaultDenyPaths)
+		server, tunnel := net.Pipe()
+		ctx, stream := withTiming(context.Background(), pipeStream{tunnel})
+		go c.handleStream(ctx, stream)
+
+		io.WriteString(server, "GET "+tt.path+" HTTP/1.1\r\nHost: app\r\n\r\n")
+		reader := bufio.NewReader(server)
+		dial, err := protocol.ReadStreamTiming(reader)
+		if err != nil {
+			t.Fatalf("%s: failed to read timing: %v", tt.path, err)
+		}
+		if (dial > 0) != tt.wantDial {
+			t.Errorf("%s: dial = %v, want dialed %v", tt.path, dial, tt.wantDial)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %v", tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+		server.Close()
+	}
+}
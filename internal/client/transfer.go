@@ -0,0 +1,79 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/transport"
+	"github.com/charmbracelet/log"
+)
+
+// transferWarnPercent is the share of the transfer cap at which the client
+// warns that the tunnel will close soon.
+const transferWarnPercent = 80
+
+// transferMeter counts the bytes carried by a client's tunnel streams over
+// its lifetime, reconnects included, against an optional cap.
+type transferMeter struct {
+	sent     atomic.Int64 // to the server
+	received atomic.Int64 // from the server
+	max      int64        // 0 = unlimited
+
+	warned   atomic.Bool
+	exceeded atomic.Bool
+}
+
+// WithMaxTransfer closes the tunnel for good once n bytes have crossed it,
+// both directions combined (0 = unlimited), to protect metered
+// connections. The client gives up with ErrTransferLimit instead of
+// reconnecting.
+func (c *Client) WithMaxTransfer(n int64) *Client {
+	c.transfer.max = n
+	return c
+}
+
+// countTransfer adds bytes sent and received on session, warning as the
+// cap nears and closing session once it is reached.
+func (c *Client) countTransfer(session transport.Session, sent, received int) {
+	t := &c.transfer
+	total := t.sent.Add(int64(sent)) + t.received.Add(int64(received))
+	if t.max <= 0 {
+		return
+	}
+	if total >= t.max*transferWarnPercent/100 && t.warned.CompareAndSwap(false, true) {
+		log.Warn("Nearing the transfer cap; the tunnel will close when it is reached",
+			"transferred", bytesize.Format(total), "max", bytesize.Format(t.max))
+	}
+	if total >= t.max && t.exceeded.CompareAndSwap(false, true) {
+		log.Error("Transfer cap reached; closing the tunnel", "transferred", bytesize.Format(total), "max", bytesize.Format(t.max))
+		session.Close()
+	}
+}
+
+// transferStream counts the bytes read from and written to a tunnel stream.
+type transferStream struct {
+	transport.Stream
+	client  *Client
+	session transport.Session
+}
+
+func (s *transferStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	s.client.countTransfer(s.session, 0, n)
+	return n, err
+}
+
+func (s *transferStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	s.client.countTransfer(s.session, n, 0)
+	return n, err
+}
+
+// CloseWrite half-closes the stream if it supports it, so wrapping doesn't
+// hide half-close from the proxy.
+func (s *transferStream) CloseWrite() error {
+	if hc, ok := s.Stream.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/hashicorp/yamux"
+)
+
+func TestMaxTransfer(t *testing.T) {
+	// The local service echoes what it gets
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// The server registers the tunnel and sends a kilobyte through it,
+	// which comes back for 2KB in all
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		session, _ := yamux.Server(conn, nil)
+		defer session.Close()
+		control, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		cs := protocol.NewControlStream(control)
+		cs.ReadMessage()
+		cs.SendRegisteredMessage(&protocol.RegisteredMessage{Type: protocol.TypeRegistered, URL: "tcp://localhost:20000", RemotePort: 20000})
+		stream, err := session.OpenStream()
+		if err != nil {
+			return
+		}
+		stream.Write([]byte(strings.Repeat("x", 1024)))
+		io.Copy(io.Discard, stream)
+	}()
+
+	c := New(ln.Addr().String(), local.Addr().String()).WithTCP(0).WithMaxTransfer(1500)
+	done := make(chan error, 1)
+	go func() { done <- c.Run(context.Background()) }()
+
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return at the transfer cap")
+	}
+	if !errors.Is(err, ErrTransferLimit) {
+		t.Fatalf("Run() error = %v, want %v", err, ErrTransferLimit)
+	}
+	if e := AsError(err); e == nil || e.Code != CodeTransferLimit || e.Retryable {
+		t.Errorf("AsError() = %+v, want permanent %s", e, CodeTransferLimit)
+	}
+	if st := c.Status(); st.BytesReceived < 1024 || st.BytesSent+st.BytesReceived < 1500 || st.MaxTransfer != 1500 {
+		t.Errorf("status: sent %d, received %d, max %d; want 1500+ in all with 1024+ received", st.BytesSent, st.BytesReceived, st.MaxTransfer)
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+	"github.com/charmbracelet/log"
+)
+
+// tunnelRoute is where the streams of one of a connection's tunnels go.
+type tunnelRoute struct {
+	client *Client
+	timing bool // responses start with a timing line
+}
+
+// WithTunnel registers t's tunnel over c's connection as well, e.g. to
+// expose an API and a web app from one process. t keeps its own local
+// service and tunnel settings, events and status, and uses c's API key
+// unless it has one; the connection, its transport settings and
+// reconnection are c's, and t is not run itself. A tunnel the server
+// refuses, or ends, ends the connection and so all of its tunnels. A
+// server allows protocol.MaxTunnelsPerSession tunnels per connection.
+func (c *Client) WithTunnel(t *Client) *Client {
+	c.tunnels = append(c.tunnels, t)
+	c.tunnelID = "0"
+	t.tunnelID = strconv.Itoa(len(c.tunnels))
+	return c
+}
+
+// group returns c and the clients of the other tunnels on its connection.
+func (c *Client) group() []*Client {
+	return append([]*Client{c}, c.tunnels...)
+}
+
+// openTunnel registers t's tunnel on a control stream of its own over
+// session, returning whether its responses start with a timing line.
+func (c *Client) openTunnel(ctx context.Context, session transport.Session, t *Client) (timing bool, err error) {
+	if t.token == "" {
+		t.token = c.token
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return false, newError(CodeConnect, "", fmt.Errorf("failed to open control stream: %w", err))
+	}
+	t.session = session
+	t.controlStream = protocol.NewControlStream(stream)
+	if timing, err = t.register(); err != nil {
+		return false, err
+	}
+
+	t.closeReason.Store(nil)
+	go t.sendHeartbeats(ctx)
+	go t.readControl(session)
+	log.Info("Forwarding requests", "to", t.localAddr)
+	return timing, nil
+}
+
+// serveStream hands a stream accepted on session to the tunnel it is for.
+// With more than one tunnel on the connection, the server starts each
+// stream with the tunnel's ID.
+func (c *Client) serveStream(ctx context.Context, session transport.Session, stream transport.Stream, routes map[string]tunnelRoute) {
+	route := routes[c.tunnelID]
+	if len(c.tunnels) > 0 {
+		id, err := protocol.ReadStreamTunnel(stream)
+		r, ok := routes[id]
+		if err != nil || !ok {
+			log.Debug("dropping stream for no known tunnel", "stream_id", stream.StreamID(), "tunnel_id", id, "error", err)
+			stream.Close()
+			return
+		}
+		route = r
+	}
+
+	t := route.client
+	var tunnelStream transport.Stream = &transferStream{Stream: stream, client: t, session: session}
+	streamCtx := ctx
+	if route.timing {
+		streamCtx, tunnelStream = withTiming(ctx, tunnelStream)
+	}
+	t.handleStream(streamCtx, tunnelStream)
+}
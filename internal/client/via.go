@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+	"github.com/charmbracelet/log"
+)
+
+// WithVia reaches the server through the otun servers at hops (host:port),
+// in order: the client connects to the first, each relays it to the next,
+// and the last to the server. Only the control connection takes this route,
+// e.g. out of a network that can reach just the first hop; visitors still
+// reach the tunnel at the server itself. Every hop must
+// accept the client's API key and allow relaying to the next (see the
+// server's -relay-to). TLS settings and known hosts apply to each hop.
+func (c *Client) WithVia(hops []string) *Client {
+	c.via = hops
+	return c
+}
+
+// relayError converts a hop's refusal to relay. A bad API key or a target
+// the hop doesn't relay to is permanent; a target it couldn't reach may
+// come back.
+func relayError(hop string, m *protocol.ErrorMessage) *Error {
+	code := m.Code
+	if code == "" {
+		code = CodeConnect
+	}
+	switch m.Code {
+	case protocol.ErrCodeUnauthorized, protocol.ErrCodeRelayNotAllowed, protocol.ErrCodeInvalidMessage:
+		return newError(code, m.Message, fmt.Errorf("%w: relay via %s failed: %s", ErrPermanentFailure, hop, m.Message))
+	}
+	return newError(code, m.Message, fmt.Errorf("relay via %s failed: %s", hop, m.Message))
+}
+
+// dialVia connects to the first hop and has each hop relay the connection
+// to the next, returning a connection to the server's control port.
+func (c *Client) dialVia(ctx context.Context) (net.Conn, error) {
+	conn, err := c.serverDialer.DialContext(ctx, "tcp", c.via[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", c.via[0], err)
+	}
+	if err := c.keepAlive.Apply(conn); err != nil {
+		log.Warn("failed to tune server connection", "error", err)
+	}
+
+	for i, hop := range c.via {
+		target := c.serverAddr
+		if i+1 < len(c.via) {
+			target = c.via[i+1]
+		}
+		if conn, err = c.relay(ctx, conn, hop, target); err != nil {
+			return nil, err
+		}
+		log.Debug("relayed", "via", hop, "to", target)
+	}
+	return conn, nil
+}
+
+// relay asks the hop at the other end of conn to relay to target, and
+// returns the relayed stream. Closing it closes conn.
+func (c *Client) relay(ctx context.Context, conn net.Conn, hop, target string) (net.Conn, error) {
+	conn, err := c.secureConn(ctx, conn, hop)
+	if err != nil {
+		return nil, err
+	}
+	if err := transport.WritePreface(conn, c.muxer); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send muxer preface to %s: %w", hop, err)
+	}
+	session, err := c.muxer.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Don't outlive ctx while waiting for the hop
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open control stream to %s: %w", hop, err)
+	}
+	control := protocol.NewControlStream(stream)
+	if err := control.SendRelay(target, c.token); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to send relay message to %s: %w", hop, err)
+	}
+	msg, err := control.ReadMessage()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to read relaying message from %s: %w", hop, err)
+	}
+	switch m := msg.(type) {
+	case *protocol.RelayingMessage:
+	case *protocol.ErrorMessage:
+		session.Close()
+		return nil, relayError(hop, m)
+	default:
+		session.Close()
+		return nil, fmt.Errorf("unexpected message type from %s: %T", hop, msg)
+	}
+
+	relayed, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open relay stream to %s: %w", hop, err)
+	}
+	return &relayConn{Stream: relayed, session: session}, nil
+}
+
+// relayConn is a stream relayed by a hop, which takes the hop's session
+// down with it when closed.
+type relayConn struct {
+	transport.Stream
+	session transport.Session
+}
+
+func (r *relayConn) Close() error {
+	err := r.Stream.Close()
+	r.session.Close()
+	return err
+}
+
+// secureConn performs the TLS handshake with the otun server at addr over
+// conn, if a TLS config was provided, and checks its key against the known
+// hosts.
+func (c *Client) secureConn(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if c.tlsConfig == nil {
+		return conn, nil
+	}
+
+	// The server name is sent even when the certificate isn't verified, for
+	// servers that pick their certificate by it
+	cfg := c.tlsConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if errors.As(err, new(tls.RecordHeaderError)) {
+			return nil, fmt.Errorf("tls handshake failed: %w (the server doesn't seem to serve TLS on %s)", err, addr)
+		}
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	if c.knownHosts != nil {
+		if err := c.knownHosts.check(addr, tlsConn.ConnectionState().PeerCertificates[0]); err != nil {
+			tlsConn.Close()
+			return nil, err
+		}
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,222 @@
+// Package deviceauth implements the OAuth 2.0 device authorization grant
+// (RFC 8628), letting the CLI obtain a token by having the user approve the
+// login in a browser, possibly on another device.
+package deviceauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// grantType is the token request grant type for device codes.
+const grantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// defaultInterval is the polling interval, in seconds, when the server
+// doesn't give one.
+const defaultInterval = 5
+
+// second is the unit of the intervals given by the server (shortened in tests).
+var second = time.Second
+
+var (
+	// ErrAccessDenied is returned when the user declines the login.
+	ErrAccessDenied = errors.New("login was denied")
+
+	// ErrExpired is returned when the user didn't approve the login before
+	// the device code expired.
+	ErrExpired = errors.New("login code expired")
+)
+
+// Config identifies the identity provider and the client logging in.
+type Config struct {
+	// Issuer is the identity provider's base URL; its endpoints are read
+	// from Issuer/.well-known/openid-configuration.
+	Issuer   string
+	ClientID string
+	Scopes   []string
+
+	// HTTPClient is used for all requests (default: http.DefaultClient).
+	HTTPClient *http.Client
+}
+
+// Authorization is a pending login the user has to approve.
+type Authorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+
+	tokenEndpoint string
+	expiresAt     time.Time
+}
+
+// Token is the result of an approved login.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// endpoints are the parts of the provider metadata the flow needs.
+type endpoints struct {
+	DeviceAuthorization string `json:"device_authorization_endpoint"`
+	Token               string `json:"token_endpoint"`
+}
+
+// oauthError is an RFC 6749 error response.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *oauthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+func (c *Config) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// discover fetches the provider's endpoints.
+func (c *Config) discover(ctx context.Context) (*endpoints, error) {
+	u := strings.TrimSuffix(c.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch provider metadata: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch provider metadata: %s", resp.Status)
+	}
+
+	var ep endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, fmt.Errorf("invalid provider metadata: %w", err)
+	}
+	if ep.DeviceAuthorization == "" || ep.Token == "" {
+		return nil, fmt.Errorf("identity provider %s does not support device authorization", c.Issuer)
+	}
+	return &ep, nil
+}
+
+// Start begins a login. Show the returned Authorization's verification URI
+// and user code to the user, then call Wait.
+func (c *Config) Start(ctx context.Context) (*Authorization, error) {
+	ep, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{"client_id": {c.ClientID}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	var auth Authorization
+	if err := c.post(ctx, ep.DeviceAuthorization, form, &auth); err != nil {
+		return nil, fmt.Errorf("failed to start login: %w", err)
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, errors.New("failed to start login: incomplete response from identity provider")
+	}
+	auth.tokenEndpoint = ep.Token
+	auth.expiresAt = time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	return &auth, nil
+}
+
+// Wait polls until the user approves or denies the login, the code expires,
+// or ctx is done.
+func (c *Config) Wait(ctx context.Context, auth *Authorization) (*Token, error) {
+	interval := time.Duration(auth.Interval) * second
+	if interval <= 0 {
+		interval = defaultInterval * second
+	}
+	form := url.Values{
+		"grant_type":  {grantType},
+		"device_code": {auth.DeviceCode},
+		"client_id":   {c.ClientID},
+	}
+
+	for {
+		if auth.ExpiresIn > 0 && time.Now().After(auth.expiresAt) {
+			return nil, ErrExpired
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var token Token
+		err := c.post(ctx, auth.tokenEndpoint, form, &token)
+		var oe *oauthError
+		switch {
+		case err == nil:
+			if token.AccessToken == "" {
+				return nil, errors.New("identity provider returned no access token")
+			}
+			return &token, nil
+		case errors.As(err, &oe) && oe.Code == "authorization_pending":
+		case errors.As(err, &oe) && oe.Code == "slow_down":
+			interval += 5 * second
+		case errors.As(err, &oe) && oe.Code == "access_denied":
+			return nil, ErrAccessDenied
+		case errors.As(err, &oe) && oe.Code == "expired_token":
+			return nil, ErrExpired
+		default:
+			return nil, fmt.Errorf("login failed: %w", err)
+		}
+	}
+}
+
+// post sends a form to endpoint and decodes a successful JSON response into
+// v. OAuth error responses are returned as *oauthError.
+func (c *Config) post(ctx context.Context, endpoint string, form url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var oe oauthError
+		if json.Unmarshal(body, &oe) == nil && oe.Code != "" {
+			return &oe
+		}
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
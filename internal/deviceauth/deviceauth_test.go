@@ -0,0 +1,109 @@
+package deviceauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newProvider serves provider metadata, a device authorization endpoint, and
+// a token endpoint that answers polls with the given error codes in order,
+// then with a token.
+func newProvider(t *testing.T, pollErrors ...string) *httptest.Server {
+	t.Helper()
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"device_authorization_endpoint": srv.URL + "/device",
+			"token_endpoint":                srv.URL + "/token",
+		})
+	})
+	mux.HandleFunc("POST /device", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "otun-cli" || r.FormValue("scope") != "tunnels" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "dev-123",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": "https://id.example.com/device",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != grantType || r.FormValue("device_code") != "dev-123" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		n := int(polls.Add(1)) - 1
+		if n < len(pollErrors) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": pollErrors[n]})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "tok-456", "token_type": "Bearer"})
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDeviceFlow(t *testing.T) {
+	second = time.Millisecond
+	defer func() { second = time.Second }()
+
+	tests := []struct {
+		name       string
+		pollErrors []string
+		wantErr    error
+	}{
+		{name: "approved", pollErrors: []string{"authorization_pending", "slow_down", "authorization_pending"}},
+		{name: "denied", pollErrors: []string{"authorization_pending", "access_denied"}, wantErr: ErrAccessDenied},
+		{name: "expired", pollErrors: []string{"expired_token"}, wantErr: ErrExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newProvider(t, tt.pollErrors...)
+			cfg := &Config{Issuer: srv.URL + "/", ClientID: "otun-cli", Scopes: []string{"tunnels"}}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			auth, err := cfg.Start(ctx)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if auth.UserCode != "ABCD-EFGH" || auth.VerificationURI != "https://id.example.com/device" {
+				t.Errorf("authorization = %+v", auth)
+			}
+
+			token, err := cfg.Wait(ctx, auth)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Wait error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && token.AccessToken != "tok-456" {
+				t.Errorf("access token = %q, want tok-456", token.AccessToken)
+			}
+		})
+	}
+}
+
+func TestDiscoverWithoutDeviceSupport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"token_endpoint": "https://id.example.com/token"})
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Issuer: srv.URL, ClientID: "otun-cli"}
+	if _, err := cfg.Start(context.Background()); err == nil {
+		t.Error("Start succeeded against a provider without a device endpoint")
+	}
+}
@@ -0,0 +1,134 @@
+package dnsprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudflareAPI is the Cloudflare v4 API base URL.
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// Cloudflare manages records through the Cloudflare API. The token needs
+// Zone:Read and DNS:Edit permissions on the zones custom domains live in.
+type Cloudflare struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+// NewCloudflare creates a Cloudflare provider authenticating with token.
+func NewCloudflare(token string) *Cloudflare {
+	return &Cloudflare{
+		token:   token,
+		baseURL: cloudflareAPI,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name implements Provider.
+func (c *Cloudflare) Name() string { return "cloudflare" }
+
+// cloudflareResponse is the envelope of every Cloudflare API response.
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// cloudflareRecord is a DNS record as sent to and returned by the API.
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+// SetCNAME implements Provider.
+func (c *Cloudflare) SetCNAME(ctx context.Context, name, target string) error {
+	zoneID, err := c.findZone(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	var existing []cloudflareRecord
+	query := url.Values{"type": {"CNAME"}, "name": {name}}
+	if err := c.do(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &existing); err != nil {
+		return err
+	}
+
+	// Proxying through Cloudflare would terminate TLS there, so it's off
+	record := cloudflareRecord{Type: "CNAME", Name: name, Content: target, TTL: 1}
+	if len(existing) > 0 {
+		return c.do(ctx, http.MethodPut, "/zones/"+zoneID+"/dns_records/"+existing[0].ID, record, nil)
+	}
+	return c.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", record, nil)
+}
+
+// findZone returns the ID of the most specific zone containing name.
+func (c *Cloudflare) findZone(ctx context.Context, name string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		query := url.Values{"name": {strings.Join(labels[i:], ".")}}
+		if err := c.do(ctx, http.MethodGet, "/zones?"+query.Encode(), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoZone, name)
+}
+
+// do sends an API request and decodes its result into out, if non-nil.
+func (c *Cloudflare) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloudflare request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare returned %s: %w", resp.Status, err)
+	}
+	if !envelope.Success {
+		if len(envelope.Errors) > 0 {
+			return fmt.Errorf("cloudflare error %d: %s", envelope.Errors[0].Code, envelope.Errors[0].Message)
+		}
+		return fmt.Errorf("cloudflare returned %s", resp.Status)
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Result, out)
+	}
+	return nil
+}
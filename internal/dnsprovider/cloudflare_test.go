@@ -0,0 +1,104 @@
+package dnsprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeCloudflare serves the zones and DNS records endpoints for the zone
+// "example.org", recording writes.
+func fakeCloudflare(t *testing.T, existing bool) (*Cloudflare, *[]string) {
+	t.Helper()
+	var writes []string
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, result any) {
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "errors": []any{}, "result": result})
+	}
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{"success": false, "errors": []any{map[string]any{"code": 9109, "message": "Invalid access token"}}})
+			return
+		}
+		if r.URL.Query().Get("name") == "example.org" {
+			reply(w, []any{map[string]string{"id": "zone1"}})
+			return
+		}
+		reply(w, []any{})
+	})
+	mux.HandleFunc("GET /zones/zone1/dns_records", func(w http.ResponseWriter, r *http.Request) {
+		if existing {
+			reply(w, []any{map[string]string{"id": "rec1"}})
+			return
+		}
+		reply(w, []any{})
+	})
+	record := func(w http.ResponseWriter, r *http.Request) {
+		var rec cloudflareRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		writes = append(writes, fmt.Sprintf("%s %s %s %s->%s", r.Method, r.URL.Path, rec.Type, rec.Name, rec.Content))
+		reply(w, rec)
+	}
+	mux.HandleFunc("POST /zones/zone1/dns_records", record)
+	mux.HandleFunc("PUT /zones/zone1/dns_records/rec1", record)
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	c := NewCloudflare("test-token")
+	c.baseURL = srv.URL
+	return c, &writes
+}
+
+func TestCloudflareSetCNAME(t *testing.T) {
+	tests := []struct {
+		name      string
+		existing  bool
+		wantWrite string
+	}{
+		{name: "create", wantWrite: "POST /zones/zone1/dns_records CNAME app.dev.example.org->demo.tunnel.example.com"},
+		{name: "update", existing: true, wantWrite: "PUT /zones/zone1/dns_records/rec1 CNAME app.dev.example.org->demo.tunnel.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, writes := fakeCloudflare(t, tt.existing)
+			if err := c.SetCNAME(context.Background(), "app.dev.example.org", "demo.tunnel.example.com"); err != nil {
+				t.Fatalf("SetCNAME() error = %v", err)
+			}
+			if len(*writes) != 1 || (*writes)[0] != tt.wantWrite {
+				t.Errorf("writes = %q, want %q", *writes, tt.wantWrite)
+			}
+		})
+	}
+}
+
+func TestCloudflareErrors(t *testing.T) {
+	c, _ := fakeCloudflare(t, false)
+	if err := c.SetCNAME(context.Background(), "app.other.net", "demo.tunnel.example.com"); !errors.Is(err, ErrNoZone) {
+		t.Errorf("SetCNAME() outside managed zones error = %v, want ErrNoZone", err)
+	}
+
+	c.token = "wrong"
+	err := c.SetCNAME(context.Background(), "app.example.org", "demo.tunnel.example.com")
+	if err == nil || err.Error() != "cloudflare error 9109: Invalid access token" {
+		t.Errorf("SetCNAME() with a bad token error = %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Setenv("CLOUDFLARE_API_TOKEN", "")
+	if _, err := Parse("cloudflare"); err == nil {
+		t.Error("Parse(cloudflare) succeeded without a token")
+	}
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	if p, err := Parse("cloudflare"); err != nil || p.Name() != "cloudflare" {
+		t.Errorf("Parse(cloudflare) = %v, %v", p, err)
+	}
+	if _, err := Parse("route53"); err == nil {
+		t.Error("Parse(route53) succeeded")
+	}
+}
@@ -0,0 +1,37 @@
+// Package dnsprovider manages DNS records through provider APIs, so custom
+// domains can be pointed at the server without editing DNS by hand.
+package dnsprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Provider creates DNS records in zones it has access to.
+type Provider interface {
+	// Name identifies the provider in logs and API responses.
+	Name() string
+
+	// SetCNAME creates or updates the CNAME record for name to point at target.
+	SetCNAME(ctx context.Context, name, target string) error
+}
+
+// ErrNoZone is returned when the provider doesn't manage a zone containing
+// the record.
+var ErrNoZone = errors.New("no zone found for domain")
+
+// Parse creates a provider by name. Credentials are read from the
+// environment: CLOUDFLARE_API_TOKEN for cloudflare.
+func Parse(name string) (Provider, error) {
+	switch name {
+	case "cloudflare":
+		token := os.Getenv("CLOUDFLARE_API_TOKEN")
+		if token == "" {
+			return nil, errors.New("cloudflare requires CLOUDFLARE_API_TOKEN")
+		}
+		return NewCloudflare(token), nil
+	}
+	return nil, fmt.Errorf("unsupported DNS provider %q (supported: cloudflare)", name)
+}
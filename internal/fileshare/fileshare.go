@@ -0,0 +1,435 @@
+// Package fileshare serves a directory over HTTP for otun share: files,
+// directory listings, directories as zip downloads, and optionally uploads
+// authenticated with a token.
+package fileshare
+
+import (
+	"archive/zip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/charmbracelet/log"
+)
+
+// maxNameAttempts is how many "name (n).ext" variants an upload tries
+// before giving up on finding a free file name.
+const maxNameAttempts = 100
+
+// Options configures a Share.
+type Options struct {
+	// UploadToken enables uploads, authenticated with this token as the
+	// password of HTTP basic auth (any user name) or a bearer token
+	// (empty = read-only)
+	UploadToken string
+
+	// MaxUploadSize limits each upload request's body (0 = no limit)
+	MaxUploadSize int64
+}
+
+// Share serves a directory. Files and directories whose names start with a
+// dot are hidden, and symlinks may not lead outside the directory.
+type Share struct {
+	root *os.Root
+	opts Options
+}
+
+// Open shares dir.
+func Open(dir string, opts Options) (*Share, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared directory: %w", err)
+	}
+	return &Share{root: root, opts: opts}, nil
+}
+
+// Close releases the shared directory.
+func (s *Share) Close() error {
+	return s.root.Close()
+}
+
+// Uploads reports whether the share accepts uploads.
+func (s *Share) Uploads() bool {
+	return s.opts.UploadToken != ""
+}
+
+// ServeHTTP serves GET and HEAD of files and directories, with ?zip
+// downloading a directory, and, with uploads enabled, POST of multipart
+// "file" fields into a directory and PUT of a new file.
+func (s *Share) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := sharedName(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.serveGet(w, r, name)
+	case http.MethodPost, http.MethodPut:
+		if !s.Uploads() {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Uploads are disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="otun share", charset="UTF-8"`)
+			http.Error(w, "Uploading needs the share's upload token", http.StatusUnauthorized)
+			return
+		}
+		if s.opts.MaxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxUploadSize)
+		}
+		if r.Method == http.MethodPost {
+			s.servePost(w, r, name)
+		} else {
+			s.servePut(w, r, name)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sharedName turns a URL path into a name in the shared directory, "." for
+// the directory itself. It reports false for hidden names.
+func sharedName(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		return ".", true
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// authorized reports whether r carries the upload token.
+func (s *Share) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.UploadToken)) == 1
+}
+
+func (s *Share) serveGet(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := s.root.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !info.IsDir() {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+	// Relative links in listings need the trailing slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+	if r.URL.Query().Has("zip") {
+		s.serveZip(w, name)
+		return
+	}
+	s.serveListing(w, r, name, f)
+}
+
+// listingEntry is a row of a directory listing.
+type listingEntry struct {
+	Name    string
+	Href    string // Name as a relative URL
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"size": bytesize.Format,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Path}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em auto; max-width: 50em; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: .3em .5em; border-bottom: 1px solid #eee; }
+td.n { text-align: right; white-space: nowrap; color: #666; }
+form { margin: 1.5em 0; }
+</style>
+</head>
+<body>
+<h1>{{.Path}}</h1>
+<p><a href="?zip">Download as zip</a></p>
+{{if .Uploads}}<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple required> <button type="submit">Upload</button>
+</form>{{end}}
+<table>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>{{end}}
+{{range .Entries}}<tr>
+<td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td>
+<td class="n">{{if not .IsDir}}{{size .Size}}{{end}}</td>
+<td class="n">{{.ModTime.Format "2006-01-02 15:04"}}</td>
+</tr>{{end}}
+</table>
+</body>
+</html>
+`))
+
+func (s *Share) serveListing(w http.ResponseWriter, r *http.Request, name string, dir *os.File) {
+	dirEntries, err := dir.ReadDir(-1)
+	if err != nil {
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+	var entries []listingEntry
+	for _, e := range dirEntries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		href := "./" + url.PathEscape(e.Name())
+		if e.IsDir() {
+			href += "/"
+		}
+		entries = append(entries, listingEntry{Name: e.Name(), Href: href, IsDir: e.IsDir(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	// Directories first, then by name
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	listingTemplate.Execute(w, struct {
+		Path    string
+		Uploads bool
+		Entries []listingEntry
+	}{path.Clean("/" + name), s.Uploads(), entries})
+}
+
+// serveZip streams the directory name as a zip file. Hidden files and
+// anything but regular files and directories are left out.
+func (s *Share) serveZip(w http.ResponseWriter, name string) {
+	base := path.Base(name)
+	if name == "." {
+		base = filepath.Base(s.root.Name())
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, strings.ReplaceAll(base, `"`, "")))
+
+	zw := zip.NewWriter(w)
+	fsys := s.root.FS()
+	err := fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != name && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, name), "/")
+		if name == "." {
+			rel = p
+		}
+		if rel == "." || rel == "" {
+			return nil
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if d.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		dst, err := zw.CreateHeader(header)
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(dst, f)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// The status was sent with the first bytes; the client sees a
+		// truncated zip
+		log.Warn("Zip download failed", "path", name, "error", err)
+	}
+}
+
+// servePost saves the "file" fields of a multipart form into the directory
+// name, renaming uploads whose names are taken.
+func (s *Share) servePost(w http.ResponseWriter, r *http.Request, name string) {
+	if info, err := s.root.Stat(name); err != nil || !info.IsDir() {
+		http.Error(w, "Upload into a directory", http.StatusNotFound)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Upload files as multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	var saved []string
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		fileName := path.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+		if fileName == "/" || fileName == "." || strings.HasPrefix(fileName, ".") {
+			http.Error(w, fmt.Sprintf("Invalid file name %q", part.FileName()), http.StatusBadRequest)
+			return
+		}
+		f, created, err := s.createFree(path.Join(name, fileName))
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+		if err := s.save(f, created, part); err != nil {
+			uploadError(w, err)
+			return
+		}
+		saved = append(saved, path.Base(created))
+	}
+	if len(saved) == 0 {
+		http.Error(w, `No "file" fields in the upload`, http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	for _, n := range saved {
+		fmt.Fprintln(w, n)
+	}
+}
+
+// servePut saves the request body as the new file name.
+func (s *Share) servePut(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "." {
+		http.Error(w, "PUT a file name, e.g. /notes.txt", http.StatusBadRequest)
+		return
+	}
+	if info, err := s.root.Stat(path.Dir(name)); err != nil || !info.IsDir() {
+		http.Error(w, "Upload into a directory", http.StatusNotFound)
+		return
+	}
+	f, err := s.root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		http.Error(w, "File exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	if err := s.save(f, name, r.Body); err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.Header().Set("Location", r.URL.Path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// createFree creates name, or "name (n).ext" if name is taken, and returns
+// the name it created.
+func (s *Share) createFree(name string) (*os.File, string, error) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; i < maxNameAttempts; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		f, err := s.root.OpenFile(candidate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, candidate, err
+		}
+	}
+	return nil, "", fmt.Errorf("no free name for %s", name)
+}
+
+// save copies r into the new file f, created as name, removing it if that
+// fails.
+func (s *Share) save(f *os.File, name string, r io.Reader) error {
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.root.Remove(name)
+		return err
+	}
+	log.Info("Received upload", "file", name, "size", n)
+	return nil
+}
+
+// uploadError answers a failed upload.
+func uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Upload larger than %s", bytesize.Format(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Warn("Upload failed", "error", err)
+	http.Error(w, "Upload failed", http.StatusInternalServerError)
+}
@@ -0,0 +1,223 @@
+package fileshare
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestShare shares a directory holding a.txt, docs/b.txt, and hidden
+// files.
+func newTestShare(t *testing.T, opts Options) (*Share, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.txt":          "alpha",
+		"docs/b.txt":     "bravo",
+		".env":           "SECRET=1",
+		"docs/.git/HEAD": "ref",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, dir
+}
+
+func serve(s *Share, r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestShareGet(t *testing.T) {
+	s, _ := newTestShare(t, Options{})
+
+	tests := []struct {
+		path     string
+		wantCode int
+		want     string
+	}{
+		{"/a.txt", http.StatusOK, "alpha"},
+		{"/docs/b.txt", http.StatusOK, "bravo"},
+		{"/", http.StatusOK, `href="./docs/"`},
+		{"/docs", http.StatusMovedPermanently, ""},
+		{"/.env", http.StatusNotFound, ""},
+		{"/docs/.git/HEAD", http.StatusNotFound, ""},
+		{"/../../etc/passwd", http.StatusNotFound, ""},
+		{"/missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(s, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("body %q doesn't contain %q", rec.Body, tt.want)
+			}
+		})
+	}
+
+	rec := serve(s, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(rec.Body.String(), ".env") {
+		t.Error("listing shows hidden files")
+	}
+	if strings.Contains(rec.Body.String(), "<form") {
+		t.Error("read-only listing has an upload form")
+	}
+}
+
+func TestShareZip(t *testing.T) {
+	s, _ := newTestShare(t, Options{})
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/?zip", []string{"a.txt", "docs/", "docs/b.txt"}},
+		{"/docs/?zip", []string{"b.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := serve(s, httptest.NewRequest("GET", tt.path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d", rec.Code)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("zip holds %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestShareUpload(t *testing.T) {
+	s, dir := newTestShare(t, Options{UploadToken: "secret", MaxUploadSize: 1024})
+
+	multipartBody := func(name, content string) (io.Reader, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write([]byte(content))
+		mw.Close()
+		return &buf, mw.FormDataContentType()
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		file     string // multipart file name for POST
+		body     string
+		auth     func(r *http.Request)
+		wantCode int
+		wantFile string // created file, relative to dir
+	}{
+		{
+			name: "no token", method: "PUT", path: "/new.txt", body: "x",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong token", method: "PUT", path: "/new.txt", body: "x",
+			auth:     func(r *http.Request) { r.SetBasicAuth("", "guess") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "put", method: "PUT", path: "/docs/new.txt", body: "charlie",
+			auth:     func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+			wantCode: http.StatusCreated, wantFile: "docs/new.txt",
+		},
+		{
+			name: "put existing", method: "PUT", path: "/a.txt", body: "x",
+			auth:     func(r *http.Request) { r.SetBasicAuth("", "secret") },
+			wantCode: http.StatusConflict,
+		},
+		{
+			name: "post", method: "POST", path: "/", file: "delta.txt", body: "delta",
+			auth:     func(r *http.Request) { r.SetBasicAuth("me", "secret") },
+			wantCode: http.StatusCreated, wantFile: "delta.txt",
+		},
+		{
+			name: "post existing name", method: "POST", path: "/", file: "a.txt", body: "echo",
+			auth:     func(r *http.Request) { r.SetBasicAuth("me", "secret") },
+			wantCode: http.StatusCreated, wantFile: "a (1).txt",
+		},
+		{
+			name: "post hidden name", method: "POST", path: "/", file: "../.bashrc", body: "x",
+			auth:     func(r *http.Request) { r.SetBasicAuth("me", "secret") },
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "too large", method: "PUT", path: "/big.bin", body: strings.Repeat("x", 1025),
+			auth:     func(r *http.Request) { r.SetBasicAuth("", "secret") },
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r *http.Request
+			if tt.method == "POST" {
+				body, contentType := multipartBody(tt.file, tt.body)
+				r = httptest.NewRequest(tt.method, tt.path, body)
+				r.Header.Set("Content-Type", contentType)
+			} else {
+				r = httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			}
+			if tt.auth != nil {
+				tt.auth(r)
+			}
+			rec := serve(s, r)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantFile != "" {
+				got, err := os.ReadFile(filepath.Join(dir, tt.wantFile))
+				if err != nil || string(got) != tt.body {
+					t.Errorf("%s = %q, %v; want %q", tt.wantFile, got, err, tt.body)
+				}
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); !os.IsNotExist(err) {
+		t.Error("partial upload wasn't removed")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(got) != "alpha" {
+		t.Errorf("a.txt = %q, was overwritten", got)
+	}
+}
+
+func TestShareReadOnly(t *testing.T) {
+	s, _ := newTestShare(t, Options{})
+	r := httptest.NewRequest("PUT", "/new.txt", strings.NewReader("x"))
+	r.SetBasicAuth("", "")
+	if rec := serve(s, r); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,197 @@
+// Package geoip looks up the country and autonomous system of IP addresses
+// in MaxMind DB files, such as GeoLite2-Country and GeoLite2-ASN, or the
+// equivalent databases from DB-IP and IPinfo.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker precedes the metadata section at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// Info is what the databases know about an address.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country the address is
+	// in ("" = unknown)
+	Country string
+
+	// ASN is the number of the autonomous system announcing the address
+	// (0 = unknown)
+	ASN uint32
+}
+
+// DB looks addresses up in one or more databases, e.g. a country and an
+// ASN database.
+type DB struct {
+	readers []*reader
+}
+
+// Open reads the databases at paths into memory.
+func Open(paths ...string) (*DB, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no GeoIP database given")
+	}
+	db := &DB{}
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read GeoIP database: %w", err)
+		}
+		r, err := newReader(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoIP database %s: %w", path, err)
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Lookup returns what the databases know about ip; the first database with
+// an answer wins for each field.
+func (db *DB) Lookup(ip netip.Addr) Info {
+	var info Info
+	ip = ip.Unmap()
+	for _, r := range db.readers {
+		record, err := r.lookup(ip)
+		if err != nil || record == nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = country(record)
+		}
+		if info.ASN == 0 {
+			if asn, ok := record["autonomous_system_number"].(uint64); ok {
+				info.ASN = uint32(asn)
+			}
+		}
+	}
+	return info
+}
+
+// country returns the ISO code of record's country, or of the country it
+// is registered to if its location is unknown.
+func country(record map[string]any) string {
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := record[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	// DB-IP and IPinfo lite databases keep the code at the top level
+	if code, ok := record["country_code"].(string); ok {
+		return code
+	}
+	return ""
+}
+
+// reader is one database: a binary search tree over address bits, whose
+// leaves point into a data section of typed values.
+type reader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	data       decoder
+	ipv4Start  uint // the node IPv4 addresses start at in an IPv6 tree
+}
+
+func newReader(buf []byte) (*reader, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("no metadata")
+	}
+	meta, _, err := decoder{buf: buf[i+len(metadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata: %w", err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("bad metadata")
+	}
+	r := &reader{buf: buf}
+	for key, dst := range map[string]*uint{"node_count": &r.nodeCount, "record_size": &r.recordSize, "ip_version": &r.ipVersion} {
+		v, ok := m[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata lacks %s", key)
+		}
+		*dst = uint(v)
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("search tree larger than the file")
+	}
+	r.data = decoder{buf: buf[treeSize+16 : i]}
+
+	// IPv4 addresses live under ::/96 in IPv6 trees
+	if r.ipVersion == 6 {
+		for bit := 0; bit < 96 && r.ipv4Start < r.nodeCount; bit++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// lookup returns the record for ip, or nil if the database has none.
+func (r *reader) lookup(ip netip.Addr) (map[string]any, error) {
+	var addr []byte
+	node := uint(0)
+	switch {
+	case ip.Is4():
+		a := ip.As4()
+		addr = a[:]
+		node = r.ipv4Start
+	case r.ipVersion == 6:
+		a := ip.As16()
+		addr = a[:]
+	default:
+		return nil, nil // IPv6 address in an IPv4 database
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil // no data
+	}
+	v, _, err := r.data.decode(node-r.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := v.(map[string]any)
+	return record, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *reader) record(node, bit uint) uint {
+	b := r.buf
+	switch r.recordSize {
+	case 24:
+		o := node*6 + bit*3
+		return uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+	case 28:
+		o := node * 7
+		if bit == 0 {
+			return uint(b[o+3]&0xF0)<<20 | uint(b[o])<<16 | uint(b[o+1])<<8 | uint(b[o+2])
+		}
+		return uint(b[o+3]&0x0F)<<24 | uint(b[o+4])<<16 | uint(b[o+5])<<8 | uint(b[o+6])
+	default:
+		o := node*8 + bit*4
+		return uint(b[o])<<24 | uint(b[o+1])<<16 | uint(b[o+2])<<8 | uint(b[o+3])
+	}
+}
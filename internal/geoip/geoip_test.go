@@ -0,0 +1,217 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testNode is a search tree node of a database built by writeTestDB.
+type testNode struct {
+	children [2]*testNode
+	data     []byte // set on leaves
+}
+
+// writeTestDB writes an IPv6 database with 24-bit records mapping each
+// prefix to its record, and returns its path.
+func writeTestDB(t *testing.T, records map[string]map[string]any) string {
+	t.Helper()
+	root := &testNode{}
+	for prefix, record := range records {
+		p := netip.MustParsePrefix(prefix)
+		var addr [16]byte
+		bits := p.Bits()
+		if p.Addr().Is4() {
+			v4 := p.Addr().As4()
+			copy(addr[12:], v4[:]) // IPv4 lives under ::/96
+			bits += 96
+		} else {
+			addr = p.Addr().As16()
+		}
+		n := root
+		for i := 0; i < bits; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &testNode{}
+			}
+			n = n.children[bit]
+		}
+		n.data = encode(record)
+	}
+
+	// Number the inner nodes breadth first, and lay the records out in the
+	// data section
+	var nodes []*testNode
+	ids := map[*testNode]int{}
+	queue := []*testNode{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.data != nil {
+			continue
+		}
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	var data []byte
+	offsets := map[*testNode]int{}
+	for _, n := range nodes {
+		for _, c := range n.children {
+			if c != nil && c.data != nil {
+				offsets[c] = len(data)
+				data = append(data, c.data...)
+			}
+		}
+	}
+
+	var buf []byte
+	for _, n := range nodes {
+		for _, c := range n.children {
+			v := len(nodes) // no data
+			switch {
+			case c == nil:
+			case c.data != nil:
+				v = len(nodes) + 16 + offsets[c]
+			default:
+				v = ids[c]
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encode(map[string]any{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(6),
+		"database_type": "Test",
+	})...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encode encodes strings, uint32s, and maps of them in the data section
+// format.
+func encode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		if len(v) >= 29 {
+			return append([]byte{typeString<<5 | 29, byte(len(v) - 29)}, v...)
+		}
+		return append([]byte{typeString<<5 | byte(len(v))}, v...)
+	case uint32:
+		return binary.BigEndian.AppendUint32([]byte{typeUint32<<5 | 4}, v)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := []byte{typeMap<<5 | byte(len(v))}
+		for _, k := range keys {
+			b = append(b, encode(k)...)
+			b = append(b, encode(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+func TestLookup(t *testing.T) {
+	countries := writeTestDB(t, map[string]map[string]any{
+		"192.0.2.0/24":  {"country": map[string]any{"iso_code": "DE", "geoname_id": uint32(2921044)}},
+		"198.51.0.0/16": {"registered_country": map[string]any{"iso_code": "US"}},
+		"2001:db8::/32": {"country": map[string]any{"iso_code": "FR"}},
+	})
+	asns := writeTestDB(t, map[string]map[string]any{
+		"192.0.2.0/25": {"autonomous_system_number": uint32(64500), "autonomous_system_organization": "Example"},
+	})
+	db, err := Open(countries, asns)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want Info
+	}{
+		{"192.0.2.1", Info{Country: "DE", ASN: 64500}},
+		{"192.0.2.200", Info{Country: "DE"}},
+		{"::ffff:192.0.2.1", Info{Country: "DE", ASN: 64500}},
+		{"198.51.100.7", Info{Country: "US"}},
+		{"2001:db8::1", Info{Country: "FR"}},
+		{"203.0.113.1", Info{}},
+		{"2001:db9::1", Info{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := db.Lookup(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Error("Open() error = nil, want error for a file without metadata")
+	}
+	if _, err := Open(); err == nil {
+		t.Error("Open() error = nil, want error without paths")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		at   uint
+		want any
+	}{
+		{"uint16", []byte{typeUint16<<5 | 2, 0x01, 0x02}, 0, uint64(0x0102)},
+		{"extended uint64", []byte{3, typeUint64 - 7, 0x01, 0x00, 0x00}, 0, uint64(0x010000)},
+		{"int32", []byte{4, typeInt32 - 7, 0xFF, 0xFF, 0xFF, 0xFE}, 0, int64(-2)},
+		{"bool", []byte{1, typeBool - 7}, 0, true},
+		{"long string", append([]byte{typeString<<5 | 29, 1}, "abcdefghijklmnopqrstuvwxyz1234"...), 0, "abcdefghijklmnopqrstuvwxyz1234"},
+		{"pointer", []byte{typeString<<5 | 2, 'h', 'i', typePointer << 5, 0x00}, 3, "hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := decoder{buf: tt.buf}.decode(tt.at, 0)
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("decode() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	// Truncated values and pointer loops are errors, not panics
+	for _, buf := range [][]byte{
+		{typeString<<5 | 5, 'a'},
+		{typeMap<<5 | 1},
+		{typePointer << 5, 0x00},
+	} {
+		if _, _, err := (decoder{buf: buf}).decode(0, 0); err == nil {
+			t.Errorf("decode(%x) error = nil, want error", buf)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Package keyring stores secrets in the operating system's credential store:
+// the macOS Keychain, Windows Credential Manager, or the Secret Service
+// (GNOME Keyring, KWallet) on Linux and the BSDs.
+package keyring
+
+import "errors"
+
+// service is the name secrets are filed under in the credential store.
+const service = "otun"
+
+var (
+	// ErrNotFound is returned when no secret is stored for an account.
+	ErrNotFound = errors.New("secret not found in keyring")
+
+	// ErrUnavailable is returned when the platform has no usable
+	// credential store.
+	ErrUnavailable = errors.New("no keyring available")
+)
+
+// Get returns the secret stored for account.
+func Get(account string) (string, error) {
+	return get(account)
+}
+
+// Set stores secret for account, replacing any existing secret.
+func Set(account, secret string) error {
+	return set(account, secret)
+}
+
+// Delete removes the secret stored for account. Deleting a secret that
+// doesn't exist returns ErrNotFound.
+func Delete(account string) error {
+	return del(account)
+}
@@ -0,0 +1,65 @@
+package keyring
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// securityNotFound is the exit status of security(1) when no matching item exists.
+const securityNotFound = 44
+
+// encodedPrefix marks secrets stored base64-encoded, which keeps them free of
+// characters that would need quoting in security's interactive mode.
+const encodedPrefix = "base64:"
+
+func get(account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		return "", securityError(err)
+	}
+	secret := strings.TrimSuffix(string(out), "\n")
+	if encoded, ok := strings.CutPrefix(secret, encodedPrefix); ok {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("corrupt keychain item: %w", err)
+		}
+		secret = string(decoded)
+	}
+	return secret, nil
+}
+
+func set(account, secret string) error {
+	// Pass the secret on stdin rather than the command line, where other
+	// processes could see it
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		strconv.Quote(service), strconv.Quote(account),
+		encodedPrefix+base64.StdEncoding.EncodeToString([]byte(secret))))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store secret in keychain: %w: %s", securityError(err), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func del(account string) error {
+	if err := exec.Command("security", "delete-generic-password", "-s", service, "-a", account).Run(); err != nil {
+		return securityError(err)
+	}
+	return nil
+}
+
+// securityError maps a failed security(1) invocation to the package errors.
+func securityError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == securityNotFound {
+		return ErrNotFound
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrUnavailable
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package keyring
+
+func get(string) (string, error) {
+	return "", ErrUnavailable
+}
+
+func set(string, string) error {
+	return ErrUnavailable
+}
+
+func del(string) error {
+	return ErrUnavailable
+}
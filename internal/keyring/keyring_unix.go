@@ -0,0 +1,67 @@
+//go:build unix && !darwin
+
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The Secret Service is reached through secret-tool(1) from libsecret, which
+// avoids a D-Bus dependency and works with any compliant keyring daemon.
+
+func get(account string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// lookup exits 1 with no output when nothing matches
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && stderr.Len() == 0 {
+			return "", ErrNotFound
+		}
+		return "", secretToolError(err, stderr.String())
+	}
+	return string(out), nil
+}
+
+func set(account, secret string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "store", "--label", "otun ("+account+")", "service", service, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return secretToolError(err, stderr.String())
+	}
+	return nil
+}
+
+func del(account string) error {
+	if _, err := get(account); err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "clear", "service", service, "account", account)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return secretToolError(err, stderr.String())
+	}
+	return nil
+}
+
+// secretToolError maps a failed secret-tool invocation to the package errors.
+// A missing binary or an unreachable Secret Service (e.g. no D-Bus session on
+// a headless box) both mean there is no keyring to use.
+func secretToolError(err error, stderr string) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrUnavailable
+	}
+	if msg := strings.TrimSpace(stderr); msg != "" {
+		return fmt.Errorf("%w: %s", ErrUnavailable, msg)
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+// Package logsink ships access and audit log entries to external systems
+// (syslog, Loki, S3) in batches, without blocking the request path.
+package logsink
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log streams.
+const (
+	StreamAccess = "access"
+	StreamAudit  = "audit"
+)
+
+// Entry is a single log record.
+type Entry struct {
+	Time    time.Time      `json:"time"`
+	Stream  string         `json:"stream"`
+	Message string         `json:"msg"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// JSON returns the entry encoded as a single JSON line (without newline).
+func (e Entry) JSON() []byte {
+	data, err := json.Marshal(e)
+	if err != nil {
+		// Fields hold plain values; fall back to the message alone
+		data, _ = json.Marshal(Entry{Time: e.Time, Stream: e.Stream, Message: e.Message})
+	}
+	return data
+}
+
+// Sink delivers batches of entries to an external system.
+type Sink interface {
+	// Name identifies the sink in logs.
+	Name() string
+
+	// Write delivers a batch. It is never called concurrently.
+	Write(ctx context.Context, batch []Entry) error
+}
+
+// ShipperConfig configures batching and buffering.
+type ShipperConfig struct {
+	// BufferSize is the number of entries held while sinks catch up.
+	// Entries logged while the buffer is full are dropped.
+	BufferSize int
+
+	// BatchSize is the maximum number of entries per Write.
+	BatchSize int
+
+	// FlushInterval is the longest an entry waits before being written.
+	FlushInterval time.Duration
+
+	// WriteTimeout bounds each Write call.
+	WriteTimeout time.Duration
+}
+
+// DefaultShipperConfig returns sensible defaults.
+func DefaultShipperConfig() ShipperConfig {
+	return ShipperConfig{
+		BufferSize:    10000,
+		BatchSize:     500,
+		FlushInterval: 5 * time.Second,
+		WriteTimeout:  30 * time.Second,
+	}
+}
+
+// Shipper buffers entries and writes them to sinks in batches.
+type Shipper struct {
+	sinks   []Sink
+	config  ShipperConfig
+	entries chan Entry
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+	lost    atomic.Uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewShipper creates a shipper and starts its background writer.
+func NewShipper(sinks []Sink, config ShipperConfig) *Shipper {
+	s := &Shipper{
+		sinks:   sinks,
+		config:  config,
+		entries: make(chan Entry, config.BufferSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Log queues an entry without blocking. It returns false if the buffer is
+// full and the entry was dropped.
+func (s *Shipper) Log(e Entry) bool {
+	select {
+	case s.entries <- e:
+		return true
+	default:
+		s.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped returns the number of entries dropped because the buffer was full.
+func (s *Shipper) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Failed returns the number of batches a sink failed to write.
+func (s *Shipper) Failed() uint64 {
+	return s.failed.Load()
+}
+
+// Lost returns the number of entries in batches a sink failed to write,
+// counted once per failing sink. Failed batches are not retried.
+func (s *Shipper) Lost() uint64 {
+	return s.lost.Load()
+}
+
+// Close flushes buffered entries and stops the shipper. Log must not be
+// called after Close.
+func (s *Shipper) Close() {
+	s.closeOnce.Do(func() {
+		close(s.entries)
+		<-s.done
+	})
+}
+
+// run batches entries until the channel is closed.
+func (s *Shipper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Entry, 0, s.config.BatchSize)
+	for {
+		select {
+		case e, ok := <-s.entries:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= s.config.BatchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch to every sink.
+func (s *Shipper) flush(batch []Entry) {
+	if len(batch) == 0 {
+		return
+	}
+	for _, sink := range s.sinks {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.WriteTimeout)
+		if err := sink.Write(ctx, batch); err != nil {
+			s.failed.Add(1)
+			s.lost.Add(uint64(len(batch)))
+			slog.Warn("failed to ship logs, dropping batch", "sink", sink.Name(), "entries", len(batch), "lost_total", s.lost.Load(), "error", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,266 @@
+package logsink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSink records the batches it receives. If block is set, Write waits on it.
+type memSink struct {
+	mu      sync.Mutex
+	batches [][]Entry
+	block   chan struct{}
+}
+
+func (m *memSink) Name() string { return "memory" }
+
+func (m *memSink) Write(_ context.Context, batch []Entry) error {
+	if m.block != nil {
+		<-m.block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, append([]Entry(nil), batch...))
+	return nil
+}
+
+func (m *memSink) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, b := range m.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func testEntry(msg string) Entry {
+	return Entry{Time: time.Unix(1700000000, 0), Stream: StreamAccess, Message: msg, Fields: map[string]any{"path": "/"}}
+}
+
+func TestShipperBatches(t *testing.T) {
+	sink := &memSink{}
+	s := NewShipper([]Sink{sink}, ShipperConfig{BufferSize: 100, BatchSize: 3, FlushInterval: time.Hour, WriteTimeout: time.Second})
+
+	for i := 0; i < 7; i++ {
+		s.Log(testEntry("request"))
+	}
+	s.Close()
+
+	var sizes []int
+	for _, b := range sink.batches {
+		sizes = append(sizes, len(b))
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("batch sizes = %v, want [3 3 1]", sizes)
+	}
+}
+
+func TestShipperFlushesOnInterval(t *testing.T) {
+	sink := &memSink{}
+	s := NewShipper([]Sink{sink}, ShipperConfig{BufferSize: 100, BatchSize: 100, FlushInterval: 10 * time.Millisecond, WriteTimeout: time.Second})
+	defer s.Close()
+
+	s.Log(testEntry("request"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sink.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("entry was not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestShipperDropsWhenFull(t *testing.T) {
+	sink := &memSink{block: make(chan struct{})}
+	s := NewShipper([]Sink{sink}, ShipperConfig{BufferSize: 2, BatchSize: 1, FlushInterval: time.Hour, WriteTimeout: time.Second})
+
+	// The first entry is taken by the writer, which then blocks in the sink;
+	// two more fill the buffer and the rest are dropped.
+	s.Log(testEntry("request"))
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		s.Log(testEntry("request"))
+	}
+
+	if got := s.Dropped(); got != 3 {
+		t.Errorf("Dropped() = %d, want 3", got)
+	}
+	close(sink.block)
+	s.Close()
+	if got := sink.count(); got != 3 {
+		t.Errorf("shipped %d entries, want 3", got)
+	}
+}
+
+// failingSink always fails.
+type failingSink struct{}
+
+func (failingSink) Name() string                         { return "failing" }
+func (failingSink) Write(context.Context, []Entry) error { return errors.New("unavailable") }
+
+func TestShipperCountsFailures(t *testing.T) {
+	sink := &memSink{}
+	s := NewShipper([]Sink{failingSink{}, sink}, ShipperConfig{BufferSize: 10, BatchSize: 2, FlushInterval: time.Hour, WriteTimeout: time.Second})
+	s.Log(testEntry("a"))
+	s.Log(testEntry("b"))
+	s.Log(testEntry("c"))
+	s.Close()
+
+	if got := s.Failed(); got != 2 {
+		t.Errorf("Failed() = %d, want 2", got)
+	}
+	if got := s.Lost(); got != 3 {
+		t.Errorf("Lost() = %d, want 3", got)
+	}
+	// A failing sink must not stop delivery to the others
+	if got := sink.count(); got != 3 {
+		t.Errorf("shipped %d entries, want 3", got)
+	}
+}
+
+func TestLokiSink(t *testing.T) {
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/loki/api/v1/push" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Errorf("invalid push body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	audit := testEntry("tunnel registered")
+	audit.Stream = StreamAudit
+	sink := NewLokiSink(ts.URL, nil)
+	if err := sink.Write(context.Background(), []Entry{testEntry("request"), audit, testEntry("request")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if len(push.Streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(push.Streams))
+	}
+	access := push.Streams[0]
+	if access.Stream["job"] != "otun" || access.Stream["stream"] != StreamAccess {
+		t.Errorf("labels = %v", access.Stream)
+	}
+	if len(access.Values) != 2 || access.Values[0][0] != "1700000000000000000" {
+		t.Errorf("values = %v", access.Values)
+	}
+	if !strings.Contains(access.Values[0][1], `"msg":"request"`) {
+		t.Errorf("line = %s", access.Values[0][1])
+	}
+}
+
+func TestLokiSinkError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	err := NewLokiSink(ts.URL, nil).Write(context.Background(), []Entry{testEntry("request")})
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("err = %v, want rate limited error", err)
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	var gotPath, gotAuth string
+	var lines []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			t.Error("payload hash does not match body")
+		}
+		gz, err := gzip.NewReader(strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("body is not gzipped: %v", err)
+		}
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+	}))
+	defer ts.Close()
+
+	sink := NewS3Sink(S3Config{
+		Bucket:          "logs",
+		Prefix:          "/otun/",
+		Region:          "eu-west-1",
+		Endpoint:        ts.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+	}, nil)
+	sink.now = func() time.Time { return time.Date(2024, 3, 5, 10, 20, 30, 0, time.UTC) }
+
+	if err := sink.Write(context.Background(), []Entry{testEntry("a"), testEntry("b")}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if want := "/logs/otun/2024/03/05/20240305T102030.000000000Z.ndjson.gz"; gotPath != want {
+		t.Errorf("path = %s, want %s", gotPath, want)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=AKID/20240305/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("Authorization = %s", gotAuth)
+	}
+	if len(lines) != 2 {
+		t.Errorf("got %d lines, want 2", len(lines))
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "")
+
+	tests := []struct {
+		spec     string
+		wantName string
+		wantErr  bool
+	}{
+		{spec: "loki://loki:3100", wantName: "loki http://loki:3100/loki/api/v1/push"},
+		{spec: "loki+https://logs.example.com/", wantName: "loki https://logs.example.com/loki/api/v1/push"},
+		{spec: "s3://bucket/otun?region=us-east-1", wantName: "s3://bucket/otun"},
+		{spec: "s3://bucket/otun", wantErr: true},
+		{spec: "s3:///otun?region=us-east-1", wantErr: true},
+		{spec: "kafka://broker:9092", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			sink, err := Parse(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Parse(%q) succeeded, want error", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.spec, err)
+			}
+			if sink.Name() != tt.wantName {
+				t.Errorf("Name() = %q, want %q", sink.Name(), tt.wantName)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// LokiSink pushes entries to a Loki server using the JSON push API.
+// Entries are grouped into one Loki stream per log stream, labelled
+// job="otun" and stream="access" or "audit".
+type LokiSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewLokiSink creates a sink that pushes to baseURL (e.g. http://loki:3100).
+func NewLokiSink(baseURL string, client *http.Client) *LokiSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &LokiSink{url: baseURL + "/loki/api/v1/push", client: client}
+}
+
+// lokiStream is one stream in a Loki push request.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// Name implements Sink.
+func (s *LokiSink) Name() string {
+	return "loki " + s.url
+}
+
+// Write implements Sink.
+func (s *LokiSink) Write(ctx context.Context, batch []Entry) error {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, e := range batch {
+		ls, ok := streams[e.Stream]
+		if !ok {
+			ls = &lokiStream{Stream: map[string]string{"job": "otun", "stream": e.Stream}}
+			streams[e.Stream] = ls
+			order = append(order, e.Stream)
+		}
+		ts := strconv.FormatInt(e.Time.UnixNano(), 10)
+		ls.Values = append(ls.Values, [2]string{ts, string(e.JSON())})
+	}
+
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, name := range order {
+		push.Streams = append(push.Streams, streams[name])
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("loki push failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package logsink
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Parse creates a sink from a URL-style spec:
+//
+//	syslog://host:514          syslog over UDP
+//	syslog+tcp://host:514      syslog over TCP
+//	syslog:                    local syslog daemon
+//	loki://host:3100           Loki push API over HTTP
+//	loki+https://host          Loki push API over HTTPS
+//	s3://bucket/prefix?region=us-east-1[&endpoint=https://minio:9000]
+//
+// S3 credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// and AWS_SESSION_TOKEN; the region falls back to AWS_REGION.
+func Parse(spec string) (Sink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log sink %q: %w", spec, err)
+	}
+
+	switch u.Scheme {
+	case "syslog":
+		if u.Host == "" {
+			return NewSyslogSink("", "", "otun")
+		}
+		return NewSyslogSink("udp", u.Host, "otun")
+	case "syslog+tcp":
+		return NewSyslogSink("tcp", u.Host, "otun")
+	case "loki", "loki+http":
+		return NewLokiSink("http://"+u.Host+strings.TrimSuffix(u.Path, "/"), nil), nil
+	case "loki+https":
+		return NewLokiSink("https://"+u.Host+strings.TrimSuffix(u.Path, "/"), nil), nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid log sink %q: missing bucket", spec)
+		}
+		config := S3Config{
+			Bucket:          u.Host,
+			Prefix:          u.Path,
+			Region:          u.Query().Get("region"),
+			Endpoint:        u.Query().Get("endpoint"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if config.Region == "" {
+			config.Region = os.Getenv("AWS_REGION")
+		}
+		if config.Region == "" {
+			return nil, fmt.Errorf("invalid log sink %q: missing region", spec)
+		}
+		if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+			return nil, fmt.Errorf("log sink %q: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", spec)
+		}
+		return NewS3Sink(config, nil), nil
+	default:
+		return nil, fmt.Errorf("invalid log sink %q: unknown scheme %q", spec, u.Scheme)
+	}
+}
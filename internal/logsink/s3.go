@@ -0,0 +1,167 @@
+package logsink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3 sink.
+type S3Config struct {
+	Bucket string
+	Prefix string
+	Region string
+
+	// Endpoint overrides the S3 endpoint for S3-compatible stores (e.g.
+	// MinIO). Defaults to https://s3.<region>.amazonaws.com.
+	Endpoint string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// S3Sink uploads each batch as a gzipped NDJSON object. Objects are keyed
+// <prefix>/<yyyy>/<mm>/<dd>/<timestamp>.ndjson.gz using path-style URLs.
+type S3Sink struct {
+	config S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3Sink creates an S3 sink.
+func NewS3Sink(config S3Config, client *http.Client) *S3Sink {
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Sink{config: config, client: client, now: time.Now}
+}
+
+// Name implements Sink.
+func (s *S3Sink) Name() string {
+	return "s3://" + s.config.Bucket + "/" + s.config.Prefix
+}
+
+// Write implements Sink.
+func (s *S3Sink) Write(ctx context.Context, batch []Entry) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, e := range batch {
+		gz.Write(e.JSON())
+		gz.Write([]byte{'\n'})
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	now := s.now().UTC()
+	key := now.Format("2006/01/02/20060102T150405.000000000Z") + ".ndjson.gz"
+	if s.config.Prefix != "" {
+		key = s.config.Prefix + "/" + key
+	}
+
+	path := "/" + s.config.Bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.config.Endpoint+escapePath(path), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	s.sign(req, buf.Bytes(), now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 upload failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3Sink) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := []string{req.URL.Host, payloadHash, amzDate}
+	if s.config.SessionToken != "" {
+		headers = append(headers, "x-amz-security-token")
+		values = append(values, s.config.SessionToken)
+	}
+	var canonicalHeaders strings.Builder
+	for i, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[i] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// escapePath percent-encodes every byte of p outside the unreserved set,
+// as SigV4 requires, leaving '/' separators intact.
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
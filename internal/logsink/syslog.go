@@ -0,0 +1,46 @@
+//go:build !windows && !plan9
+
+package logsink
+
+import (
+	"context"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogSink writes each entry as a JSON syslog message.
+type SyslogSink struct {
+	writer *syslog.Writer
+	addr   string
+}
+
+// NewSyslogSink connects to a syslog daemon. network is "udp", "tcp", or ""
+// for the local daemon.
+func NewSyslogSink(network, addr, tag string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &SyslogSink{writer: w, addr: addr}, nil
+}
+
+// Name implements Sink.
+func (s *SyslogSink) Name() string {
+	if s.addr == "" {
+		return "syslog"
+	}
+	return "syslog " + s.addr
+}
+
+// Write implements Sink.
+func (s *SyslogSink) Write(ctx context.Context, batch []Entry) error {
+	for _, e := range batch {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.writer.Info(string(e.JSON())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
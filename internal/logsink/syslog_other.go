@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package logsink
+
+import "errors"
+
+// NewSyslogSink is not supported on this platform.
+func NewSyslogSink(network, addr, tag string) (Sink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
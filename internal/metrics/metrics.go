@@ -0,0 +1,345 @@
+// Package metrics provides a minimal, dependency-free metrics registry
+// that renders in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current counter value.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+// Add adds n (which may be negative) to the gauge.
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+// Value returns the current gauge value.
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upper  []float64       // bucket upper bounds, ascending
+	counts []atomic.Uint64 // per bucket, the last one +Inf
+	sum    atomic.Uint64   // float64 bits
+}
+
+// NewHistogram creates a histogram with the given ascending bucket upper
+// bounds. A +Inf bucket is always added.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upper:  buckets,
+		counts: make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+// ExponentialBuckets returns count bucket bounds, the first start and
+// each after it factor times the one before.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v) // first bound >= v
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for i := range h.counts {
+		n += h.counts[i].Load()
+	}
+	return n
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(h.sum.Load())
+}
+
+// samples expands the histogram into its _bucket, _sum, and _count series.
+func (h *Histogram) samples(labels map[string]string) []Sample {
+	samples := make([]Sample, 0, len(h.counts)+2)
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.upper) {
+			le = fmt.Sprintf("%g", h.upper[i])
+		}
+		bucketLabels := map[string]string{"le": le}
+		for k, v := range labels {
+			bucketLabels[k] = v
+		}
+		samples = append(samples, Sample{Labels: bucketLabels, Value: float64(cumulative), suffix: "_bucket"})
+	}
+	// _count matches the +Inf bucket even if observations land mid-scrape
+	return append(samples,
+		Sample{Labels: labels, Value: h.Sum(), suffix: "_sum"},
+		Sample{Labels: labels, Value: float64(cumulative), suffix: "_count"},
+	)
+}
+
+// HistogramSample is one labeled histogram of a metric with several series.
+type HistogramSample struct {
+	Labels    map[string]string
+	Histogram *Histogram
+}
+
+// Sample is one labeled value of a metric with several series.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+
+	suffix string // appended to the metric name, for histogram series
+}
+
+// metric is a single registered metric.
+type metric struct {
+	name    string
+	help    string
+	kind    string // "counter", "gauge", or "histogram"
+	value   func() float64
+	samples func() []Sample // set instead of value for labeled series
+}
+
+// Registry holds a set of named metrics.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*metric
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*metric),
+	}
+}
+
+// register adds a metric, panicking on duplicate names (a programming error).
+func (r *Registry) register(m *metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.metrics[m.name]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric name %q", m.name))
+	}
+	r.metrics[m.name] = m
+}
+
+// NewCounter creates and registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&metric{name: name, help: help, kind: "counter", value: func() float64 {
+		return float64(c.Value())
+	}})
+	return c
+}
+
+// NewGauge creates and registers a gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(&metric{name: name, help: help, kind: "gauge", value: func() float64 {
+		return float64(g.Value())
+	}})
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&metric{name: name, help: help, kind: "gauge", value: fn})
+}
+
+// NewGaugeVecFunc registers a gauge whose labeled series are computed by fn
+// at scrape time.
+func (r *Registry) NewGaugeVecFunc(name, help string, fn func() []Sample) {
+	r.register(&metric{name: name, help: help, kind: "gauge", samples: fn})
+}
+
+// NewCounterFunc registers a counter whose value is read from fn at scrape
+// time. fn must be monotonically non-decreasing.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&metric{name: name, help: help, kind: "counter", value: fn})
+}
+
+// NewCounterVecFunc registers a counter whose labeled series are computed
+// by fn at scrape time. Each series must be monotonically non-decreasing
+// for as long as it is reported.
+func (r *Registry) NewCounterVecFunc(name, help string, fn func() []Sample) {
+	r.register(&metric{name: name, help: help, kind: "counter", samples: fn})
+}
+
+// NewHistogramVecFunc registers a histogram whose labeled series are
+// returned by fn at scrape time. Each histogram keeps counting for as long
+// as it is reported.
+func (r *Registry) NewHistogramVecFunc(name, help string, fn func() []HistogramSample) {
+	r.register(&metric{name: name, help: help, kind: "histogram", samples: func() []Sample {
+		histograms := fn()
+		sort.Slice(histograms, func(i, j int) bool {
+			return formatLabels(histograms[i].Labels) < formatLabels(histograms[j].Labels)
+		})
+		var samples []Sample
+		for _, h := range histograms {
+			samples = append(samples, h.Histogram.samples(h.Labels)...)
+		}
+		return samples
+	}})
+}
+
+// family is the samples of one metric at one point in time.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labeled bool
+	samples []Sample
+}
+
+// gather reads every metric, sorted by name.
+func (r *Registry) gather() []family {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+
+	families := make([]family, 0, len(names))
+	for _, name := range names {
+		r.mu.RLock()
+		m := r.metrics[name]
+		r.mu.RUnlock()
+
+		f := family{name: m.name, help: m.help, kind: m.kind, labeled: m.samples != nil}
+		switch {
+		case m.samples == nil:
+			f.samples = []Sample{{Value: m.value()}}
+		case m.kind == "histogram":
+			f.samples = m.samples() // already ordered, buckets ascending
+		default:
+			f.samples = sortedSamples(m.samples)
+		}
+		families = append(families, f)
+	}
+	return families
+}
+
+// WriteTo writes all metrics in the Prometheus text format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, f := range r.gather() {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, sample := range f.samples {
+			if f.labeled {
+				fmt.Fprintf(&sb, "%s%s{%s} %g\n", f.name, sample.suffix, formatLabels(sample.Labels), sample.Value)
+			} else {
+				fmt.Fprintf(&sb, "%s%s %g\n", f.name, sample.suffix, sample.Value)
+			}
+		}
+		n, err := io.WriteString(w, sb.String())
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// sortedSamples returns fn's samples ordered by their labels, so output is
+// stable between scrapes.
+func sortedSamples(fn func() []Sample) []Sample {
+	if fn == nil {
+		return nil
+	}
+	samples := fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return formatLabels(samples[i].Labels) < formatLabels(samples[j].Labels)
+	})
+	return samples
+}
+
+// labelEscaper escapes label values for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels as k1="v1",k2="v2", sorted by key.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf(`%s="%s"`, k, labelEscaper.Replace(labels[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Handler returns an http.Handler that serves the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A test counter.")
+	g := r.NewGauge("test_current", "A test gauge.")
+
+	c.Inc()
+	c.Add(4)
+	g.Inc()
+	g.Add(10)
+	g.Dec()
+
+	if got := c.Value(); got != 5 {
+		t.Errorf("counter = %d, want 5", got)
+	}
+	if got := g.Value(); got != 10 {
+		t.Errorf("gauge = %d, want 10", got)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("b_total", "Second metric.").Add(3)
+	r.NewGaugeFunc("a_value", "First metric.", func() float64 { return 1.5 })
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := "# HELP a_value First metric.\n" +
+		"# TYPE a_value gauge\n" +
+		"a_value 1.5\n" +
+		"# HELP b_total Second metric.\n" +
+		"# TYPE b_total counter\n" +
+		"b_total 3\n"
+	if sb.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestGaugeVecFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeVecFunc("info", "Labeled metric.", func() []Sample {
+		return []Sample{
+			{Labels: map[string]string{"name": "b", "team": `say "hi"`}, Value: 1},
+			{Labels: map[string]string{"name": "a"}, Value: 2},
+		}
+	})
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := "# HELP info Labeled metric.\n" +
+		"# TYPE info gauge\n" +
+		"info{name=\"a\"} 2\n" +
+		"info{name=\"b\",team=\"say \\\"hi\\\"\"} 1\n"
+	if sb.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestCounterVecFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVecFunc("events_total", "Labeled counter.", func() []Sample {
+		return []Sample{{Labels: map[string]string{"name": "a"}, Value: 3}}
+	})
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := "# HELP events_total Labeled counter.\n" +
+		"# TYPE events_total counter\n" +
+		"events_total{name=\"a\"} 3\n"
+	if sb.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestHistogramVecFunc(t *testing.T) {
+	r := NewRegistry()
+	small := NewHistogram([]float64{10, 100})
+	small.Observe(5)
+	small.Observe(10)
+	small.Observe(50)
+	small.Observe(500)
+	empty := NewHistogram([]float64{10, 100})
+	r.NewHistogramVecFunc("size_bytes", "Labeled histogram.", func() []HistogramSample {
+		return []HistogramSample{
+			{Labels: map[string]string{"name": "b"}, Histogram: empty},
+			{Labels: map[string]string{"name": "a"}, Histogram: small},
+		}
+	})
+
+	if got := small.Count(); got != 4 {
+		t.Errorf("Count() = %d, want 4", got)
+	}
+	if got := small.Sum(); got != 565 {
+		t.Errorf("Sum() = %g, want 565", got)
+	}
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := "# HELP size_bytes Labeled histogram.\n" +
+		"# TYPE size_bytes histogram\n" +
+		"size_bytes_bucket{le=\"10\",name=\"a\"} 2\n" +
+		"size_bytes_bucket{le=\"100\",name=\"a\"} 3\n" +
+		"size_bytes_bucket{le=\"+Inf\",name=\"a\"} 4\n" +
+		"size_bytes_sum{name=\"a\"} 565\n" +
+		"size_bytes_count{name=\"a\"} 4\n" +
+		"size_bytes_bucket{le=\"10\",name=\"b\"} 0\n" +
+		"size_bytes_bucket{le=\"100\",name=\"b\"} 0\n" +
+		"size_bytes_bucket{le=\"+Inf\",name=\"b\"} 0\n" +
+		"size_bytes_sum{name=\"b\"} 0\n" +
+		"size_bytes_count{name=\"b\"} 0\n"
+	if sb.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	got := ExponentialBuckets(256, 4, 3)
+	if len(got) != 3 || got[0] != 256 || got[1] != 1024 || got[2] != 4096 {
+		t.Errorf("ExponentialBuckets(256, 4, 3) = %v, want [256 1024 4096]", got)
+	}
+}
+
+func TestDuplicateNamePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("dup_total", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on duplicate metric name")
+		}
+	}()
+	r.NewGauge("dup_total", "")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "requests_total 1\n") {
+		t.Errorf("unexpected body: %s", rec.Body.String())
+	}
+}
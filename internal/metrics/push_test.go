@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeSnappyLiterals decodes a snappy block made only of literals.
+func decodeSnappyLiterals(t *testing.T, b []byte) []byte {
+	t.Helper()
+	size, n := binary.Uvarint(b)
+	b = b[n:]
+	var out []byte
+	for len(b) > 0 {
+		tag := b[0]
+		if tag&3 != 0 {
+			t.Fatalf("tag %#x is not a literal", tag)
+		}
+		length := int(tag>>2) + 1
+		b = b[1:]
+		if extra := int(tag>>2) - 59; extra > 0 {
+			length = 1
+			for i := range extra {
+				length += int(b[i]) << (8 * i)
+			}
+			b = b[extra:]
+		}
+		out = append(out, b[:length]...)
+		b = b[length:]
+	}
+	if uint64(len(out)) != size {
+		t.Fatalf("decoded %d bytes, header says %d", len(out), size)
+	}
+	return out
+}
+
+func TestSnappyLiteral(t *testing.T) {
+	for _, size := range []int{0, 1, 60, 61, 256, 257, 1 << 16, 1<<16 + 1, 200000} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		if got := decodeSnappyLiterals(t, snappyLiteral(data)); !bytes.Equal(got, data) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+	}
+}
+
+func TestPushRemoteWrite(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Add(7)
+	r.NewGaugeVecFunc("tunnels", "Tunnels.", func() []Sample {
+		return []Sample{{Labels: map[string]string{"region": "eu"}, Value: 2}}
+	})
+
+	var got []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("headers = %v, want snappy protobuf", req.Header)
+		}
+		if user, pass, _ := req.BasicAuth(); user != "u" || pass != "p" {
+			t.Errorf("basic auth = %q:%q, want u:p", user, pass)
+		}
+		body, _ := io.ReadAll(req.Body)
+		got = decodeSnappyLiterals(t, body)
+	}))
+	defer ts.Close()
+
+	p, err := NewPusher(r, PushConfig{Format: PushRemoteWrite, URL: strings.Replace(ts.URL, "://", "://u:p@", 1) + "/api/v1/write", Interval: time.Minute, Instance: "edge-1"})
+	if err != nil {
+		t.Fatalf("NewPusher() error = %v", err)
+	}
+	if err := p.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	for _, want := range []string{"__name__", "requests_total", "tunnels", "region", "eu", "job", "otun", "instance", "edge-1"} {
+		if !bytes.Contains(got, []byte(want)) {
+			t.Errorf("write request missing %q", want)
+		}
+	}
+}
+
+func TestPushGateway(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Add(7)
+
+	var method, path, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		method, path, body = req.Method, req.URL.Path, string(b)
+	}))
+	defer ts.Close()
+
+	p, err := NewPusher(r, PushConfig{Format: PushGateway, URL: ts.URL + "/", Interval: time.Minute, Instance: "edge-1"})
+	if err != nil {
+		t.Fatalf("NewPusher() error = %v", err)
+	}
+	if err := p.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/otun/instance/edge-1" {
+		t.Errorf("request = %s %s, want PUT /metrics/job/otun/instance/edge-1", method, path)
+	}
+	if !strings.Contains(body, "requests_total 7\n") {
+		t.Errorf("body = %q, want requests_total 7", body)
+	}
+}
+
+func TestPushError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	p, err := NewPusher(NewRegistry(), PushConfig{Format: PushRemoteWrite, URL: ts.URL, Interval: time.Minute})
+	if err != nil {
+		t.Fatalf("NewPusher() error = %v", err)
+	}
+	if err := p.Push(context.Background()); err == nil || !strings.Contains(err.Error(), "out of order sample") {
+		t.Errorf("Push() error = %v, want the server's message", err)
+	}
+}
+
+func TestNewPusherValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  PushConfig
+	}{
+		{"bad format", PushConfig{Format: "statsd", URL: "http://localhost", Interval: time.Minute}},
+		{"bad URL", PushConfig{Format: PushRemoteWrite, URL: "localhost:9090", Interval: time.Minute}},
+		{"no interval", PushConfig{Format: PushRemoteWrite, URL: "http://localhost"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPusher(NewRegistry(), tt.cfg); err == nil {
+				t.Error("NewPusher() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ABHeader carries a visitor's A/B bucket to the local service.
+const ABHeader = "X-Otun-Bucket"
+
+// ABCookie keeps a visitor in the same A/B bucket across requests.
+const ABCookie = "otun_bucket"
+
+// MaxABBuckets is the most buckets an ABTest may have.
+const MaxABBuckets = 10
+
+// abBucketPattern restricts bucket names to characters that are safe in
+// both a header and a cookie value.
+var abBucketPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ABTest asks the server to assign each visitor to a bucket at random,
+// weighted by percentage, and to keep them there with a cookie, so the
+// local service can run A/B tests without its own assignment logic.
+type ABTest struct {
+	Buckets []ABBucket `json:"buckets"`
+}
+
+// ABBucket is one variant of an ABTest.
+type ABBucket struct {
+	Name    string `json:"name"`
+	Percent int    `json:"percent"`
+}
+
+// ParseABTest parses "name=percent,name=percent,...", e.g. "a=50,b=50".
+func ParseABTest(s string) (*ABTest, error) {
+	t := &ABTest{}
+	for _, spec := range strings.Split(s, ",") {
+		name, percent, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid A/B bucket %q: expected name=percent", spec)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(percent, "%"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid A/B bucket %q: percent is not a number", spec)
+		}
+		t.Buckets = append(t.Buckets, ABBucket{Name: name, Percent: n})
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Validate checks that the buckets are well-formed, distinct, and their
+// percentages add up to 100.
+func (t *ABTest) Validate() error {
+	if len(t.Buckets) < 2 || len(t.Buckets) > MaxABBuckets {
+		return fmt.Errorf("an A/B test needs 2 to %d buckets, not %d", MaxABBuckets, len(t.Buckets))
+	}
+	seen := make(map[string]bool, len(t.Buckets))
+	total := 0
+	for _, b := range t.Buckets {
+		if !abBucketPattern.MatchString(b.Name) {
+			return fmt.Errorf("invalid A/B bucket name %q (letters, digits, _ and -, up to 32)", b.Name)
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("duplicate A/B bucket %q", b.Name)
+		}
+		seen[b.Name] = true
+		if b.Percent <= 0 {
+			return fmt.Errorf("A/B bucket %q needs a positive percentage", b.Name)
+		}
+		total += b.Percent
+	}
+	if total != 100 {
+		return fmt.Errorf("A/B bucket percentages add up to %d, not 100", total)
+	}
+	return nil
+}
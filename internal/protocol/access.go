@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// AccessHeader carries the shared secret visitors of a private tunnel
+// present. The server removes it before forwarding the request.
+const AccessHeader = "X-Otun-Access"
+
+// MinAccessSecretLen is the shortest shared secret a private tunnel may use.
+const MinAccessSecretLen = 16
+
+// ParseClientCA parses a PEM bundle of CA certificates that may sign the
+// client certificates of a private tunnel's visitors.
+func ParseClientCA(pem string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(pem)) {
+		return nil, errors.New("client CA contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+// ValidateAccess checks the private tunnel settings of a RegisterMessage.
+func ValidateAccess(msg *RegisterMessage) error {
+	if msg.AccessSecret == "" && msg.ClientCA == "" {
+		return nil
+	}
+	if msg.Protocol != "" && msg.Protocol != ProtocolHTTP {
+		return fmt.Errorf("private tunnels must use the %s protocol", ProtocolHTTP)
+	}
+	if msg.AccessSecret != "" && len(msg.AccessSecret) < MinAccessSecretLen {
+		return fmt.Errorf("access secret is too short (min %d bytes)", MinAccessSecretLen)
+	}
+	if msg.ClientCA != "" {
+		if _, err := ParseClientCA(msg.ClientCA); err != nil {
+			return err
+		}
+	}
+	return nil
+}
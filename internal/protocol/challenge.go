@@ -0,0 +1,52 @@
+package protocol
+
+import "fmt"
+
+// Modes for Challenge.
+const (
+	// ChallengeJS has the visitor's browser solve a small proof of work,
+	// which clients that don't run JavaScript can't
+	ChallengeJS = "js"
+
+	// ChallengeTurnstile shows a Cloudflare Turnstile widget
+	ChallengeTurnstile = "turnstile"
+
+	// ChallengeHCaptcha shows an hCaptcha widget
+	ChallengeHCaptcha = "hcaptcha"
+)
+
+// ChallengePath is where the interstitial posts its answer. The server
+// answers requests for it itself.
+const ChallengePath = "/.otun/challenge"
+
+// ChallengeCookie exempts visitors who passed the challenge.
+const ChallengeCookie = "otun_challenge"
+
+// MaxChallengeTTL is the longest a passed challenge exempts a visitor, in
+// seconds.
+const MaxChallengeTTL = 30 * 24 * 60 * 60
+
+// Challenge asks the server to put an interstitial in front of the tunnel
+// that visitors must pass before their requests are forwarded, to keep bots
+// off a tunnel under pressure.
+type Challenge struct {
+	// Mode is ChallengeJS (the default if empty), ChallengeTurnstile, or
+	// ChallengeHCaptcha
+	Mode string `json:"mode,omitempty"`
+
+	// TTL is how long, in seconds, a visitor who passed is exempt
+	TTL int `json:"ttl"`
+}
+
+// Validate checks that the challenge can be served.
+func (c *Challenge) Validate() error {
+	switch c.Mode {
+	case "", ChallengeJS, ChallengeTurnstile, ChallengeHCaptcha:
+	default:
+		return fmt.Errorf("unsupported challenge %q (want js, turnstile, or hcaptcha)", c.Mode)
+	}
+	if c.TTL <= 0 || c.TTL > MaxChallengeTTL {
+		return fmt.Errorf("challenge TTL %ds out of range (1s to %ds)", c.TTL, MaxChallengeTTL)
+	}
+	return nil
+}
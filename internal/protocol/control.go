@@ -2,15 +2,23 @@ package protocol
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 )
 
 // ControlStream handles reading and writing control messages over a stream.
+// Sends are safe for concurrent use; reads must happen from a single goroutine.
 type ControlStream struct {
+	writeMu sync.Mutex
 	encoder *json.Encoder
 	decoder *json.Decoder
 	stream  io.ReadWriteCloser
+
+	// limits are enforced on messages read (nil = none)
+	limits *Limits
 }
 
 // NewControlStream creates a new control stream handler.
@@ -22,29 +30,114 @@ func NewControlStream(stream io.ReadWriteCloser) *ControlStream {
 	}
 }
 
+// send encodes a message, serializing concurrent writers.
+func (c *ControlStream) send(msg any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.encoder.Encode(msg)
+}
+
 // SendRegister sends a register message.
 func (c *ControlStream) SendRegister(subdomain, token string) error {
-	return c.encoder.Encode(NewRegisterMessage(subdomain, token))
+	return c.send(NewRegisterMessage(subdomain, token))
+}
+
+// SendRegisterMessage sends a register message with optional fields set.
+func (c *ControlStream) SendRegisterMessage(msg *RegisterMessage) error {
+	msg.Type = TypeRegister
+	return c.send(msg)
 }
 
 // SendRegistered sends a registered message.
 func (c *ControlStream) SendRegistered(url, subdomain string) error {
-	return c.encoder.Encode(NewRegisteredMessage(url, subdomain))
+	return c.send(NewRegisteredMessage(url, subdomain))
+}
+
+// SendRegisteredMessage sends a registered message with optional fields set.
+func (c *ControlStream) SendRegisteredMessage(msg *RegisteredMessage) error {
+	msg.Type = TypeRegistered
+	return c.send(msg)
 }
 
 // SendHeartbeat sends a heartbeat message.
 func (c *ControlStream) SendHeartbeat() error {
-	return c.encoder.Encode(NewHeartbeatMessage())
+	return c.send(NewHeartbeatMessage())
 }
 
 // SendHeartbeatAck sends a heartbeat acknowledgment message.
 func (c *ControlStream) SendHeartbeatAck() error {
-	return c.encoder.Encode(NewHeartbeatAckMessage())
+	return c.send(NewHeartbeatAckMessage())
 }
 
 // SendError sends an error message.
 func (c *ControlStream) SendError(message string) error {
-	return c.encoder.Encode(NewErrorMessage(message))
+	return c.send(NewErrorMessage(message))
+}
+
+// SendErrorCode sends an error message with a machine-readable code.
+func (c *ControlStream) SendErrorCode(code, message string) error {
+	msg := NewErrorMessage(message)
+	msg.Code = code
+	return c.send(msg)
+}
+
+// SendRetryAfter sends an error message telling the client to wait at
+// least retryAfter (rounded up to whole seconds) before reconnecting.
+func (c *ControlStream) SendRetryAfter(code, message string, retryAfter time.Duration) error {
+	msg := NewErrorMessage(message)
+	msg.Code = code
+	msg.RetryAfter = int((retryAfter + time.Second - 1) / time.Second)
+	return c.send(msg)
+}
+
+// SendWarning sends a warning about a tunnel nearing limit.
+func (c *ControlStream) SendWarning(limit, message string, used, max int64) error {
+	return c.send(NewWarningMessage(limit, message, used, max))
+}
+
+// SendForward sends a forward message.
+func (c *ControlStream) SendForward(subdomain, token string) error {
+	return c.send(NewForwardMessage(subdomain, token))
+}
+
+// SendForwarding sends a forwarding message.
+func (c *ControlStream) SendForwarding(subdomain string) error {
+	return c.send(NewForwardingMessage(subdomain))
+}
+
+// SendSpeedTest sends a speed test message.
+func (c *ControlStream) SendSpeedTest(token string) error {
+	return c.send(NewSpeedTestMessage(token))
+}
+
+// SendSpeedTestReady sends a speed test ready message.
+func (c *ControlStream) SendSpeedTestReady(maxBytes int64) error {
+	return c.send(NewSpeedTestReadyMessage(maxBytes))
+}
+
+// SendRelay sends a relay message.
+func (c *ControlStream) SendRelay(target, token string) error {
+	return c.send(NewRelayMessage(target, token))
+}
+
+// SendRelaying sends a relaying message.
+func (c *ControlStream) SendRelaying(target string) error {
+	return c.send(NewRelayingMessage(target))
+}
+
+// SendChallenge sends a challenge message.
+func (c *ControlStream) SendChallenge(subdomain, nonce string) error {
+	return c.send(NewChallengeMessage(subdomain, nonce))
+}
+
+// SendChallengeReply sends a challenge reply message.
+func (c *ControlStream) SendChallengeReply(signature string) error {
+	return c.send(NewChallengeReplyMessage(signature))
+}
+
+// SendIntrusion sends an intrusion message.
+func (c *ControlStream) SendIntrusion(method, path, remoteAddr string, banned int) error {
+	return c.send(NewIntrusionMessage(method, path, remoteAddr, banned))
 }
 
 // messageType is used to peek at the type field.
@@ -54,60 +147,20 @@ type messageType struct {
 
 // ReadMessage reads and returns the next control message.
 // Returns one of: *RegisterMessage, *RegisteredMessage, *HeartbeatMessage,
-// *HeartbeatAckMessage, or *ErrorMessage.
+// *HeartbeatAckMessage, *ErrorMessage, *ForwardMessage, *ForwardingMessage,
+// *WarningMessage, *SpeedTestMessage, *SpeedTestReadyMessage,
+// *ChallengeMessage, *ChallengeReplyMessage, *IntrusionMessage,
+// *RelayMessage, or *RelayingMessage.
 func (c *ControlStream) ReadMessage() (any, error) {
-	// Decode into raw JSON first to peek at type
 	var raw json.RawMessage
 	if err := c.decoder.Decode(&raw); err != nil {
-		return nil, fmt.Errorf("failed to read message: %w", err)
-	}
-
-	// Get the type
-	var mt messageType
-	if err := json.Unmarshal(raw, &mt); err != nil {
-		return nil, fmt.Errorf("failed to parse message type: %w", err)
-	}
-
-	// Parse based on type
-	switch mt.Type {
-	case TypeRegister:
-		var msg RegisterMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			return nil, fmt.Errorf("failed to parse register message: %w", err)
-		}
-		return &msg, nil
-
-	case TypeRegistered:
-		var msg RegisteredMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			return nil, fmt.Errorf("failed to parse registered message: %w", err)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || errors.Is(err, errMessageTooLarge) {
+			return nil, fmt.Errorf("%w: failed to read message: %w", ErrInvalidMessage, err)
 		}
-		return &msg, nil
-
-	case TypeHeartbeat:
-		var msg HeartbeatMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			return nil, fmt.Errorf("failed to parse heartbeat message: %w", err)
-		}
-		return &msg, nil
-
-	case TypeHeartbeatAck:
-		var msg HeartbeatAckMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			return nil, fmt.Errorf("failed to parse heartbeat_ack message: %w", err)
-		}
-		return &msg, nil
-
-	case TypeError:
-		var msg ErrorMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			return nil, fmt.Errorf("failed to parse error message: %w", err)
-		}
-		return &msg, nil
-
-	default:
-		return nil, fmt.Errorf("unknown message type: %s", mt.Type)
+		return nil, fmt.Errorf("failed to read message: %w", err)
 	}
+	return ParseMessage(raw, c.limits)
 }
 
 // Close closes the underlying stream.
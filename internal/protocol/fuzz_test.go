@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// FuzzParseMessage feeds arbitrary bytes to the control message parser, as
+// a hostile client on the control port could. Run it with
+//
+//	go test ./internal/protocol -fuzz FuzzParseMessage
+func FuzzParseMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"register","subdomain":"app","token":"key","labels":{"team":"payments"},"strip_headers":["Server"]}`,
+		`{"type":"register","protocol":"tcp","remote_port":20000,"geo_policy":{"deny_countries":["XX"]}}`,
+		`{"type":"heartbeat"}`,
+		`{"type":"forward","subdomain":"app"}`,
+		`{"type":"speedtest","token":"key"}`,
+		`{"type":"challenge_reply","signature":"c2ln"}`,
+		`{"type":"error","message":"boom","code":"server_full","retry_after":5}`,
+		`{"type":"register","labels":{"a":[[[[[[[[[]]]]]]]]]}}`,
+		`[]`,
+		`"register"`,
+	} {
+		f.Add([]byte(seed), false)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, disallowUnknown bool) {
+		limits := DefaultLimits
+		limits.DisallowUnknownFields = disallowUnknown
+
+		msg, err := ParseMessage(data, &limits)
+		if err != nil {
+			return
+		}
+
+		// What the strict parser accepts must survive a round trip
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("failed to encode %T: %v", msg, err)
+		}
+		again, err := ParseMessage(encoded, nil)
+		if err != nil {
+			t.Fatalf("failed to parse re-encoded %s: %v", encoded, err)
+		}
+		if reencoded, _ := json.Marshal(again); !bytes.Equal(encoded, reencoded) {
+			t.Errorf("round trip changed %s to %s", encoded, reencoded)
+		}
+
+		// And read the same from a stream
+		cs := NewControlStream(nopCloser{bytes.NewBuffer(data)}).WithLimits(limits)
+		if _, err := cs.ReadMessage(); err != nil {
+			t.Errorf("ReadMessage() = %v, but ParseMessage accepted %q", err, data)
+		}
+	})
+}
+
+// nopCloser adapts a buffer to io.ReadWriteCloser.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaxGeoPolicyEntries is the most countries and ASNs a GeoPolicy may list.
+const MaxGeoPolicyEntries = 1000
+
+// countryPattern matches ISO 3166-1 alpha-2 country codes.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// GeoPolicy restricts a tunnel's visitors by the country and autonomous
+// system (ASN) the server's GeoIP databases place them in. A visitor in a
+// denied country or ASN is refused; if any allow list is set, so is every
+// visitor in neither an allowed country nor an allowed ASN, including
+// visitors the databases can't place.
+type GeoPolicy struct {
+	AllowCountries []string `json:"allow_countries,omitempty"`
+	DenyCountries  []string `json:"deny_countries,omitempty"`
+	AllowASNs      []uint32 `json:"allow_asns,omitempty"`
+	DenyASNs       []uint32 `json:"deny_asns,omitempty"`
+}
+
+// ParseCountries parses ISO country codes, e.g. "de" or "US", into their
+// upper-case form.
+func ParseCountries(specs []string) ([]string, error) {
+	countries := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		c := strings.ToUpper(strings.TrimSpace(spec))
+		if !countryPattern.MatchString(c) {
+			return nil, fmt.Errorf("invalid country %q: expected a two-letter ISO code, e.g. DE", spec)
+		}
+		countries = append(countries, c)
+	}
+	return countries, nil
+}
+
+// ParseASNs parses autonomous system numbers, with or without an "AS"
+// prefix, e.g. "AS13335" or "13335".
+func ParseASNs(specs []string) ([]uint32, error) {
+	asns := make([]uint32, 0, len(specs))
+	for _, spec := range specs {
+		s := strings.TrimSpace(spec)
+		if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+			s = s[2:]
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid ASN %q: expected a number, e.g. AS13335", spec)
+		}
+		asns = append(asns, uint32(n))
+	}
+	return asns, nil
+}
+
+// Validate checks that the policy lists something and that its country
+// codes are upper-case ISO codes.
+func (p *GeoPolicy) Validate() error {
+	n := len(p.AllowCountries) + len(p.DenyCountries) + len(p.AllowASNs) + len(p.DenyASNs)
+	if n == 0 {
+		return errors.New("a geo policy needs at least one country or ASN")
+	}
+	if n > MaxGeoPolicyEntries {
+		return fmt.Errorf("a geo policy may list at most %d countries and ASNs, not %d", MaxGeoPolicyEntries, n)
+	}
+	for _, c := range slices.Concat(p.AllowCountries, p.DenyCountries) {
+		if !countryPattern.MatchString(c) {
+			return fmt.Errorf("invalid country %q in geo policy", c)
+		}
+	}
+	for _, asn := range slices.Concat(p.AllowASNs, p.DenyASNs) {
+		if asn == 0 {
+			return errors.New("invalid ASN 0 in geo policy")
+		}
+	}
+	return nil
+}
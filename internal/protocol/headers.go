@@ -0,0 +1,27 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MaxStripHeaders is the most response header rules a tunnel may carry.
+const MaxStripHeaders = 32
+
+// headerRulePattern matches an HTTP header name, optionally ending in "*"
+// to match every header with that prefix.
+var headerRulePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'+.^_`|~-]{1,64}\\*?$")
+
+// ValidateStripHeaders checks the response header rules sent in a
+// RegisterMessage: few enough, each a header name or a "Prefix-*" pattern.
+func ValidateStripHeaders(rules []string) error {
+	if len(rules) > MaxStripHeaders {
+		return fmt.Errorf("too many response header rules: %d (max %d)", len(rules), MaxStripHeaders)
+	}
+	for _, rule := range rules {
+		if !headerRulePattern.MatchString(rule) {
+			return fmt.Errorf("invalid response header rule %q: use a header name, optionally ending in *", rule)
+		}
+	}
+	return nil
+}
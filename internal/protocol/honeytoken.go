@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// MaxHoneytokenPaths is the most trap paths a tunnel may have.
+	MaxHoneytokenPaths = 100
+
+	// MaxHoneytokenBan is the longest a visitor who touched a trap path may
+	// be banned, in seconds.
+	MaxHoneytokenBan = 7 * 24 * 60 * 60
+)
+
+// Honeytokens are trap paths nobody with a legitimate link to the tunnel
+// requests, e.g. /wp-login.php on a site that isn't WordPress. The server
+// answers them with 404 without forwarding them and raises an alert, giving
+// early warning that a development URL has leaked.
+type Honeytokens struct {
+	// Paths are matched like the client's deny paths: each matches itself
+	// and everything below it, ignoring case
+	Paths []string `json:"paths"`
+
+	// Ban is how long, in seconds, the server refuses all requests to the
+	// tunnel from a visitor who touched a trap path (0 = no ban)
+	Ban int `json:"ban,omitempty"`
+}
+
+// Validate checks that the trap paths are absolute and the ban in range.
+func (h *Honeytokens) Validate() error {
+	if len(h.Paths) == 0 || len(h.Paths) > MaxHoneytokenPaths {
+		return fmt.Errorf("honeytokens need 1 to %d paths, not %d", MaxHoneytokenPaths, len(h.Paths))
+	}
+	for _, p := range h.Paths {
+		if !strings.HasPrefix(p, "/") || p == "/" || strings.ContainsAny(p, " \t\r\n?#") {
+			return fmt.Errorf("invalid honeytoken path %q: expected an absolute path below /, e.g. /wp-login.php", p)
+		}
+	}
+	if h.Ban < 0 || h.Ban > MaxHoneytokenBan {
+		return fmt.Errorf("honeytoken ban %ds out of range (0 to %ds)", h.Ban, MaxHoneytokenBan)
+	}
+	return nil
+}
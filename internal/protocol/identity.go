@@ -0,0 +1,16 @@
+package protocol
+
+// UserHeader names the visitor a private tunnel authenticated, for the
+// local service. The server removes any the visitor sent.
+const UserHeader = "X-Otun-User"
+
+// UserJWTHeader carries the same identity as a JWT signed by the server
+// with Ed25519 ("alg": "EdDSA"), so the local service can verify it came
+// from the server. Claims are iss, sub (the user), aud (the tunnel's URL),
+// iat, exp and, for certificates naming one, email.
+const UserJWTHeader = "X-Otun-User-JWT"
+
+// JWKSPath is where private tunnels serve the JSON Web Key Set the local
+// service verifies UserJWTHeader with. The server answers requests for it
+// itself, without requiring visitors to authenticate.
+const JWKSPath = "/.otun/jwks.json"
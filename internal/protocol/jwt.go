@@ -0,0 +1,42 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// JWTPolicy asks the server to refuse requests that don't carry a valid
+// JWT as an "Authorization: Bearer" token, answering 401 at the edge. This
+// lets a tunnel expose an internal API to a partner whose identity provider
+// issues the tokens. The Authorization header is still forwarded, so the
+// local service can read the token's claims.
+type JWTPolicy struct {
+	// JWKSURL is the https URL of the JSON Web Key Set tokens are signed
+	// with, e.g. https://id.example.com/.well-known/jwks.json
+	JWKSURL string `json:"jwks_url"`
+
+	// Issuer must match the iss claim, if set
+	Issuer string `json:"issuer,omitempty"`
+
+	// Audience must be one of the aud claim's values, if set
+	Audience string `json:"audience,omitempty"`
+
+	// Path limits validation to requests under this path (empty = all)
+	Path string `json:"path,omitempty"`
+}
+
+// Validate checks that the policy can be enforced.
+func (p *JWTPolicy) Validate() error {
+	if p.JWKSURL == "" {
+		return errors.New("JWKS URL is empty")
+	}
+	u, err := url.Parse(p.JWKSURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid JWKS URL %q: expected an https URL", p.JWKSURL)
+	}
+	if p.Path != "" && p.Path[0] != '/' {
+		return fmt.Errorf("JWT path %q must start with /", p.Path)
+	}
+	return nil
+}
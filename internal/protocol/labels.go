@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// MaxLabels is the most labels a tunnel may carry.
+const MaxLabels = 16
+
+// maxLabelValueLen bounds a label value's length.
+const maxLabelValueLen = 128
+
+// labelKeyPattern restricts label keys to names that are also valid
+// Prometheus label names.
+var labelKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// ParseLabel splits a "key=value" label.
+func ParseLabel(s string) (key, value string, err error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid label %q: expected key=value", s)
+	}
+	if err := validateLabel(key, value); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// ValidateLabels checks that labels are few enough and well-formed: keys
+// are lowercase letters, digits and underscores starting with a letter, and
+// values are short and printable.
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("too many labels: %d (max %d)", len(labels), MaxLabels)
+	}
+	for key, value := range labels {
+		if err := validateLabel(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLabel(key, value string) error {
+	if !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label key %q: use lowercase letters, digits and underscores, starting with a letter", key)
+	}
+	if len(value) > maxLabelValueLen {
+		return fmt.Errorf("label %q value is too long (max %d bytes)", key, maxLabelValueLen)
+	}
+	if strings.IndexFunc(value, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return fmt.Errorf("label %q value contains unprintable characters", key)
+	}
+	return nil
+}
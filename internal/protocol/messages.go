@@ -3,11 +3,86 @@ package protocol
 
 // Message types for the control protocol.
 const (
-	TypeRegister     = "register"
-	TypeRegistered   = "registered"
-	TypeHeartbeat    = "heartbeat"
-	TypeHeartbeatAck = "heartbeat_ack"
-	TypeError        = "error"
+	TypeRegister       = "register"
+	TypeRegistered     = "registered"
+	TypeHeartbeat      = "heartbeat"
+	TypeHeartbeatAck   = "heartbeat_ack"
+	TypeError          = "error"
+	TypeForward        = "forward"
+	TypeForwarding     = "forwarding"
+	TypeWarning        = "warning"
+	TypeSpeedTest      = "speedtest"
+	TypeSpeedTestReady = "speedtest_ready"
+	TypeChallenge      = "challenge"
+	TypeChallengeReply = "challenge_reply"
+	TypeIntrusion      = "intrusion"
+	TypeRelay          = "relay"
+	TypeRelaying       = "relaying"
+)
+
+// Tunnel protocols requested in RegisterMessage.
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+	ProtocolTLS  = "tls"
+)
+
+// Error codes carried by ErrorMessage so clients can react to specific
+// failures without matching on message text.
+const (
+	ErrCodePortInUse      = "port_in_use"
+	ErrCodePortReserved   = "port_reserved"
+	ErrCodePortNotAllowed = "port_not_allowed"
+	ErrCodeTCPDisabled    = "tcp_disabled"
+	ErrCodeServerFull     = "server_full"
+	ErrCodeServerBusy     = "server_busy"
+	ErrCodeTunnelBlocked  = "tunnel_blocked"
+	ErrCodeInvalidLabels  = "invalid_labels"
+	ErrCodeInvalidHeaders = "invalid_headers"
+	ErrCodeInvalidAccess  = "invalid_access"
+	ErrCodeUnauthorized   = "unauthorized"
+
+	ErrCodeSubdomainTaken    = "subdomain_taken"
+	ErrCodeSubdomainReserved = "subdomain_reserved"
+
+	ErrCodeInvalidSignature  = "invalid_signature"
+	ErrCodeInvalidReplay     = "invalid_replay"
+	ErrCodeInvalidABTest     = "invalid_ab_test"
+	ErrCodeInvalidGeoPolicy  = "invalid_geo_policy"
+	ErrCodeInvalidChallenge  = "invalid_challenge"
+	ErrCodeInvalidHoneytoken = "invalid_honeytoken"
+	ErrCodeInvalidJWTPolicy  = "invalid_jwt_policy"
+
+	ErrCodeTLSPassthroughDisabled = "tls_passthrough_disabled"
+
+	ErrCodeInvalidOwnerKey  = "invalid_owner_key"
+	ErrCodeOwnerKeyMismatch = "owner_key_mismatch"
+
+	ErrCodeInvalidMessage = "invalid_message"
+
+	ErrCodeInvalidHandover = "invalid_handover"
+	ErrCodeHandedOver      = "handed_over"
+
+	ErrCodeInvalidCanary = "invalid_canary"
+
+	ErrCodeAnonymousRestricted = "anonymous_restricted"
+	ErrCodeLifetimeExpired     = "lifetime_expired"
+
+	ErrCodeRelayNotAllowed = "relay_not_allowed"
+	ErrCodeRelayFailed     = "relay_failed"
+
+	ErrCodeForwardRefused = "forward_refused"
+
+	ErrCodeInvalidTunnelID = "invalid_tunnel_id"
+	ErrCodeTooManyTunnels  = "too_many_tunnels"
+
+	ErrCodeGroupPolicy = "group_policy"
+)
+
+// Limits named in WarningMessage.
+const (
+	LimitStreams      = "streams"
+	LimitResponseSize = "response_size"
 )
 
 // RegisterMessage is sent by the client to request a tunnel.
@@ -15,6 +90,101 @@ type RegisterMessage struct {
 	Type      string `json:"type"` // always "register"
 	Subdomain string `json:"subdomain,omitempty"`
 	Token     string `json:"token,omitempty"`
+
+	// MaxResponseBytes caps the body size of each response served through
+	// the tunnel (0 = server default)
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+
+	// Protocol is ProtocolHTTP (the default if empty), ProtocolTCP, or
+	// ProtocolTLS for a subdomain whose TLS connections are passed through
+	// to the client undecrypted.
+	Protocol string `json:"protocol,omitempty"`
+
+	// RemotePort requests a specific public port for TCP tunnels
+	// (0 = any free port).
+	RemotePort int `json:"remote_port,omitempty"`
+
+	// Warnings tells the server the client understands WarningMessage.
+	Warnings bool `json:"warnings,omitempty"`
+
+	// Timing tells the server the client can report its local dial time
+	// on each stream (see AppendStreamTiming).
+	Timing bool `json:"timing,omitempty"`
+
+	// Labels are arbitrary key=value pairs (e.g. team=payments) the admin
+	// API and metrics can filter and group tunnels by.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// StripHeaders names response headers (e.g. Server, X-Powered-By) the
+	// server removes before responses leave the edge; a trailing "*"
+	// matches a prefix, e.g. "X-Debug-*".
+	StripHeaders []string `json:"strip_headers,omitempty"`
+
+	// AccessSecret and ClientCA make the tunnel private: visitors must
+	// send AccessSecret in the AccessHeader or present a client certificate
+	// signed by one of the PEM certificates in ClientCA.
+	AccessSecret string `json:"access_secret,omitempty"`
+	ClientCA     string `json:"client_ca,omitempty"`
+
+	// WebhookSignature makes the server reject requests whose body isn't
+	// signed with the shared secret.
+	WebhookSignature *WebhookSignature `json:"webhook_signature,omitempty"`
+
+	// JWT makes the server reject requests without a valid bearer JWT
+	// with a 401.
+	JWT *JWTPolicy `json:"jwt,omitempty"`
+
+	// ReplayProtection makes the server detect requests that repeat a
+	// recent delivery ID.
+	ReplayProtection *ReplayProtection `json:"replay_protection,omitempty"`
+
+	// ABTest makes the server assign visitors to sticky A/B buckets and
+	// tell the local service theirs in the ABHeader.
+	ABTest *ABTest `json:"ab_test,omitempty"`
+
+	// GeoPolicy makes the server refuse visitors by the country or
+	// network their address is in, with a 403.
+	GeoPolicy *GeoPolicy `json:"geo_policy,omitempty"`
+
+	// Challenge makes visitors pass an interstitial challenge before their
+	// requests reach the tunnel.
+	Challenge *Challenge `json:"challenge,omitempty"`
+
+	// Honeytokens makes the server treat requests for trap paths as signs
+	// the tunnel URL leaked: they are never forwarded, and the client is
+	// sent an IntrusionMessage.
+	Honeytokens *Honeytokens `json:"honeytokens,omitempty"`
+
+	// ResumeToken is the token from the client's last RegisteredMessage.
+	// If it is still valid, the server restores that tunnel without
+	// looking the API key up again.
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	// OwnerKey is an Ed25519 public key (see EncodeOwnerKey) to bind the
+	// subdomain to on its first claim. Once bound, a subdomain can only be
+	// registered by clients that answer a ChallengeMessage with the
+	// matching private key.
+	OwnerKey string `json:"owner_key,omitempty"`
+
+	// HandoverToken is the token from the RegisteredMessage of the client
+	// currently serving the subdomain. The server switches the subdomain
+	// to the new client at once and lets the old one finish its in-flight
+	// requests before disconnecting it with ErrCodeHandedOver.
+	HandoverToken string `json:"handover_token,omitempty"`
+
+	// Canary registers the client alongside the one serving Subdomain,
+	// which must use the same API key, instead of replacing it. The canary
+	// receives the share of the subdomain's HTTP requests set with the
+	// admin API, none until then.
+	Canary bool `json:"canary,omitempty"`
+
+	// TunnelID lets a client register several tunnels over one
+	// connection: the first on the control stream, the rest on control
+	// streams of their own it opens afterwards, each with a TunnelID unique
+	// on the connection (see ValidateTunnelID). Every stream the server
+	// opens for such a tunnel starts with a line naming it (see
+	// ReadStreamTunnel). Empty for a client with a single tunnel.
+	TunnelID string `json:"tunnel_id,omitempty"`
 }
 
 // RegisteredMessage is sent by the server to confirm tunnel registration.
@@ -22,6 +192,40 @@ type RegisteredMessage struct {
 	Type      string `json:"type"` // always "registered"
 	URL       string `json:"url"`
 	Subdomain string `json:"subdomain"`
+
+	// RemotePort is the public port of a TCP tunnel.
+	RemotePort int `json:"remote_port,omitempty"`
+
+	// ResumeToken lets the client resume this tunnel when it reconnects,
+	// by sending it in its next RegisterMessage. Empty if the server
+	// doesn't support resumption.
+	ResumeToken string `json:"resume_token,omitempty"`
+
+	// HandoverToken lets another client take over this tunnel without
+	// dropping requests, e.g. a restarted or upgraded client, by sending
+	// it in its RegisterMessage. Empty for TCP tunnels.
+	HandoverToken string `json:"handover_token,omitempty"`
+
+	// Timing asks the client to start its response on every stream with
+	// a timing line (see AppendStreamTiming). Only set if the client
+	// offered it.
+	Timing bool `json:"timing,omitempty"`
+
+	// Anonymous is set if the tunnel was opened without an API key, and
+	// holds the limits the server puts on such tunnels.
+	Anonymous *AnonymousLimits `json:"anonymous,omitempty"`
+
+	// TunnelID is the TunnelID of the RegisterMessage.
+	TunnelID string `json:"tunnel_id,omitempty"`
+}
+
+// AnonymousLimits are the limits on a tunnel opened without an API key.
+type AnonymousLimits struct {
+	// Lifetime is how many seconds the tunnel stays open (0 = no limit).
+	Lifetime int64 `json:"lifetime,omitempty"`
+
+	// BytesPerSecond is the tunnel's bandwidth (0 = no limit).
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
 }
 
 // HeartbeatMessage is sent by the client as a keepalive ping.
@@ -38,6 +242,100 @@ type HeartbeatAckMessage struct {
 type ErrorMessage struct {
 	Type    string `json:"type"` // always "error"
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"` // one of the ErrCode constants, if any
+
+	// RetryAfter asks the client to wait this many seconds before
+	// reconnecting (0 = use its own backoff).
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// WarningMessage is sent by the server when a tunnel nears one of its
+// limits, so the developer hears about it before requests start failing.
+type WarningMessage struct {
+	Type    string `json:"type"`  // always "warning"
+	Limit   string `json:"limit"` // one of the Limit constants
+	Message string `json:"message"`
+
+	// Used and Max are the current usage and the limit, in the limit's
+	// unit (streams or bytes).
+	Used int64 `json:"used"`
+	Max  int64 `json:"max"`
+}
+
+// ForwardMessage is sent by the client to pull traffic from an existing
+// tunnel down to a local port.
+type ForwardMessage struct {
+	Type      string `json:"type"` // always "forward"
+	Subdomain string `json:"subdomain"`
+	Token     string `json:"token,omitempty"`
+}
+
+// ForwardingMessage is sent by the server to confirm a forward request.
+type ForwardingMessage struct {
+	Type      string `json:"type"` // always "forwarding"
+	Subdomain string `json:"subdomain"`
+}
+
+// SpeedTestMessage is sent by the client instead of registering, to measure
+// the round-trip time and throughput between it and the server.
+type SpeedTestMessage struct {
+	Type  string `json:"type"` // always "speedtest"
+	Token string `json:"token,omitempty"`
+}
+
+// SpeedTestReadyMessage is sent by the server to accept a speed test.
+type SpeedTestReadyMessage struct {
+	Type string `json:"type"` // always "speedtest_ready"
+
+	// MaxBytes is the most the server will send or receive per transfer.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// RelayMessage is sent by the client instead of registering, to reach the
+// control port of another otun server through this one. Once the server
+// confirms with a RelayingMessage, the first stream the client opens is
+// spliced onto a connection to Target, over which the client connects as
+// if directly.
+type RelayMessage struct {
+	Type   string `json:"type"`   // always "relay"
+	Target string `json:"target"` // host:port
+	Token  string `json:"token,omitempty"`
+}
+
+// RelayingMessage is sent by the server once it has connected to a relay
+// request's target.
+type RelayingMessage struct {
+	Type   string `json:"type"` // always "relaying"
+	Target string `json:"target"`
+}
+
+// ChallengeMessage is sent by the server in reply to a RegisterMessage with
+// an OwnerKey, asking the client to prove it holds the private key.
+type ChallengeMessage struct {
+	Type      string `json:"type"` // always "challenge"
+	Subdomain string `json:"subdomain"`
+	Nonce     string `json:"nonce"`
+}
+
+// ChallengeReplyMessage is sent by the client in reply to a
+// ChallengeMessage, with the signature made by SignOwnership.
+type ChallengeReplyMessage struct {
+	Type      string `json:"type"` // always "challenge_reply"
+	Signature string `json:"signature"`
+}
+
+// IntrusionMessage is sent by the server when a visitor requests one of
+// the tunnel's honeytoken paths. Only clients that set Honeytokens are sent
+// one.
+type IntrusionMessage struct {
+	Type       string `json:"type"` // always "intrusion"
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remote_addr"`
+
+	// Banned is how long, in seconds, the visitor's IP is refused
+	// (0 = not banned)
+	Banned int `json:"banned,omitempty"`
 }
 
 // NewRegisterMessage creates a register message.
@@ -79,3 +377,92 @@ func NewErrorMessage(message string) *ErrorMessage {
 		Message: message,
 	}
 }
+
+// NewWarningMessage creates a warning message.
+func NewWarningMessage(limit, message string, used, max int64) *WarningMessage {
+	return &WarningMessage{
+		Type:    TypeWarning,
+		Limit:   limit,
+		Message: message,
+		Used:    used,
+		Max:     max,
+	}
+}
+
+// NewForwardMessage creates a forward message.
+func NewForwardMessage(subdomain, token string) *ForwardMessage {
+	return &ForwardMessage{
+		Type:      TypeForward,
+		Subdomain: subdomain,
+		Token:     token,
+	}
+}
+
+// NewForwardingMessage creates a forwarding message.
+func NewForwardingMessage(subdomain string) *ForwardingMessage {
+	return &ForwardingMessage{
+		Type:      TypeForwarding,
+		Subdomain: subdomain,
+	}
+}
+
+// NewSpeedTestMessage creates a speed test message.
+func NewSpeedTestMessage(token string) *SpeedTestMessage {
+	return &SpeedTestMessage{
+		Type:  TypeSpeedTest,
+		Token: token,
+	}
+}
+
+// NewSpeedTestReadyMessage creates a speed test ready message.
+func NewSpeedTestReadyMessage(maxBytes int64) *SpeedTestReadyMessage {
+	return &SpeedTestReadyMessage{
+		Type:     TypeSpeedTestReady,
+		MaxBytes: maxBytes,
+	}
+}
+
+// NewRelayMessage creates a relay message.
+func NewRelayMessage(target, token string) *RelayMessage {
+	return &RelayMessage{
+		Type:   TypeRelay,
+		Target: target,
+		Token:  token,
+	}
+}
+
+// NewRelayingMessage creates a relaying message.
+func NewRelayingMessage(target string) *RelayingMessage {
+	return &RelayingMessage{
+		Type:   TypeRelaying,
+		Target: target,
+	}
+}
+
+// NewChallengeMessage creates a challenge message.
+func NewChallengeMessage(subdomain, nonce string) *ChallengeMessage {
+	return &ChallengeMessage{
+		Type:      TypeChallenge,
+		Subdomain: subdomain,
+		Nonce:     nonce,
+	}
+}
+
+// NewChallengeReplyMessage creates a challenge reply message.
+func NewChallengeReplyMessage(signature string) *ChallengeReplyMessage {
+	return &ChallengeReplyMessage{
+		Type:      TypeChallengeReply,
+		Signature: signature,
+	}
+}
+
+// NewIntrusionMessage creates an intrusion message.
+func NewIntrusionMessage(method, path, remoteAddr string, banned int) *IntrusionMessage {
+	return &IntrusionMessage{
+		Type:       TypeIntrusion,
+		Method:     method,
+		Path:       path,
+		RemoteAddr: remoteAddr,
+		Banned:     banned,
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+// ownershipContext separates ownership signatures from any other use of the
+// key.
+const ownershipContext = "otun subdomain ownership v1"
+
+// EncodeOwnerKey encodes an owner public key for RegisterMessage.OwnerKey.
+func EncodeOwnerKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// ParseOwnerKey decodes an owner public key encoded by EncodeOwnerKey.
+func ParseOwnerKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("owner key must be a base64 Ed25519 public key")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// SignOwnership signs a ChallengeMessage's nonce for subdomain, proving the
+// client holds key.
+func SignOwnership(key ed25519.PrivateKey, subdomain, nonce string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, ownershipPayload(subdomain, nonce)))
+}
+
+// VerifyOwnership checks a signature made by SignOwnership.
+func VerifyOwnership(key ed25519.PublicKey, subdomain, nonce, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && ed25519.Verify(key, ownershipPayload(subdomain, nonce), sig)
+}
+
+// ownershipPayload is what is signed: the nonce, bound to the subdomain so a
+// signature can't be replayed for another one.
+func ownershipPayload(subdomain, nonce string) []byte {
+	return []byte(ownershipContext + "\x00" + subdomain + "\x00" + nonce)
+}
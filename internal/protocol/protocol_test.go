@@ -1,8 +1,13 @@
 package protocol
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"io"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // mockStream wraps two io.Pipe connections for bidirectional communication.
@@ -72,6 +77,36 @@ func TestControlStreamRegister(t *testing.T) {
 	}
 }
 
+func TestControlStreamRegisterMessage(t *testing.T) {
+	stream1, stream2 := newMockStreamPair()
+	defer stream1.Close()
+	defer stream2.Close()
+
+	client := NewControlStream(stream1)
+	server := NewControlStream(stream2)
+
+	done := make(chan error)
+	go func() {
+		done <- client.SendRegisterMessage(&RegisterMessage{Subdomain: "app", MaxResponseBytes: 1024})
+	}()
+
+	msg, err := server.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	regMsg, ok := msg.(*RegisterMessage)
+	if !ok {
+		t.Fatalf("expected RegisterMessage, got %T", msg)
+	}
+	if regMsg.Type != TypeRegister || regMsg.Subdomain != "app" || regMsg.MaxResponseBytes != 1024 {
+		t.Errorf("unexpected register message: %+v", regMsg)
+	}
+}
+
 func TestControlStreamRegistered(t *testing.T) {
 	stream1, stream2 := newMockStreamPair()
 	defer stream1.Close()
@@ -186,6 +221,86 @@ func TestControlStreamError(t *testing.T) {
 	}
 }
 
+func TestControlStreamWarning(t *testing.T) {
+	stream1, stream2 := newMockStreamPair()
+	defer stream1.Close()
+	defer stream2.Close()
+
+	server := NewControlStream(stream1)
+	client := NewControlStream(stream2)
+
+	done := make(chan error)
+	go func() {
+		done <- server.SendWarning(LimitStreams, "8 of 10 concurrent connections in use", 8, 10)
+	}()
+
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	<-done
+
+	warning, ok := msg.(*WarningMessage)
+	if !ok {
+		t.Fatalf("expected WarningMessage, got %T", msg)
+	}
+	if warning.Limit != LimitStreams || warning.Used != 8 || warning.Max != 10 {
+		t.Errorf("unexpected warning message: %+v", warning)
+	}
+}
+
+func TestControlStreamForward(t *testing.T) {
+	stream1, stream2 := newMockStreamPair()
+	defer stream1.Close()
+	defer stream2.Close()
+
+	client := NewControlStream(stream1)
+	server := NewControlStream(stream2)
+
+	// Client sends forward
+	done := make(chan error)
+	go func() {
+		done <- client.SendForward("teammate", "testtoken")
+	}()
+
+	// Server reads forward
+	msg, err := server.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	<-done
+
+	fwdMsg, ok := msg.(*ForwardMessage)
+	if !ok {
+		t.Fatalf("expected ForwardMessage, got %T", msg)
+	}
+	if fwdMsg.Subdomain != "teammate" || fwdMsg.Token != "testtoken" {
+		t.Errorf("unexpected forward message: %+v", fwdMsg)
+	}
+
+	// Server confirms
+	go func() {
+		done <- server.SendForwarding("teammate")
+	}()
+
+	msg, err = client.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	<-done
+
+	fwdingMsg, ok := msg.(*ForwardingMessage)
+	if !ok {
+		t.Fatalf("expected ForwardingMessage, got %T", msg)
+	}
+	if fwdingMsg.Subdomain != "teammate" {
+		t.Errorf("expected subdomain 'teammate', got '%s'", fwdingMsg.Subdomain)
+	}
+}
+
 func TestMessageConstructors(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -197,6 +312,11 @@ func TestMessageConstructors(t *testing.T) {
 		{"heartbeat", NewHeartbeatMessage(), TypeHeartbeat},
 		{"heartbeat_ack", NewHeartbeatAckMessage(), TypeHeartbeatAck},
 		{"error", NewErrorMessage("oops"), TypeError},
+		{"forward", NewForwardMessage("sub", "token"), TypeForward},
+		{"forwarding", NewForwardingMessage("sub"), TypeForwarding},
+		{"warning", NewWarningMessage(LimitStreams, "busy", 8, 10), TypeWarning},
+		{"relay", NewRelayMessage("eu.example.com:4443", "token"), TypeRelay},
+		{"relaying", NewRelayingMessage("eu.example.com:4443"), TypeRelaying},
 	}
 
 	for _, tt := range tests {
@@ -213,6 +333,16 @@ func TestMessageConstructors(t *testing.T) {
 				gotType = m.Type
 			case *ErrorMessage:
 				gotType = m.Type
+			case *ForwardMessage:
+				gotType = m.Type
+			case *ForwardingMessage:
+				gotType = m.Type
+			case *WarningMessage:
+				gotType = m.Type
+			case *RelayMessage:
+				gotType = m.Type
+			case *RelayingMessage:
+				gotType = m.Type
 			}
 
 			if gotType != tt.wantType {
@@ -221,3 +351,423 @@ func TestMessageConstructors(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLabel(t *testing.T) {
+	tests := []struct {
+		in        string
+		wantKey   string
+		wantValue string
+		wantErr   bool
+	}{
+		{in: "team=payments", wantKey: "team", wantValue: "payments"},
+		{in: "env=", wantKey: "env", wantValue: ""},
+		{in: "url=a=b", wantKey: "url", wantValue: "a=b"},
+		{in: "team", wantErr: true},
+		{in: "Team=x", wantErr: true},
+		{in: "1team=x", wantErr: true},
+		{in: "team-name=x", wantErr: true},
+		{in: "team=a\nb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			key, value, err := ParseLabel(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLabel(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if key != tt.wantKey || value != tt.wantValue {
+				t.Errorf("ParseLabel(%q) = %q, %q; want %q, %q", tt.in, key, value, tt.wantKey, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestValidateLabelsLimit(t *testing.T) {
+	labels := make(map[string]string)
+	for i := 0; i <= MaxLabels; i++ {
+		labels[string(rune('a'+i))] = "x"
+	}
+	if err := ValidateLabels(labels); err == nil {
+		t.Errorf("ValidateLabels() with %d labels succeeded, want error", len(labels))
+	}
+}
+
+func TestValidateStripHeaders(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"Server", "X-Powered-By", "X-Debug-*"}, false},
+		{[]string{"X Debug"}, true},
+		{[]string{"X-*-Id"}, true},
+		{[]string{""}, true},
+		{[]string{"Bad:Name"}, true},
+		{make([]string, MaxStripHeaders+1), true},
+	}
+	for _, tt := range tests {
+		if err := ValidateStripHeaders(tt.rules); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateStripHeaders(%q) error = %v, wantErr %v", tt.rules, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     RegisterMessage
+		wantErr bool
+	}{
+		{name: "public", msg: RegisterMessage{}},
+		{name: "secret", msg: RegisterMessage{AccessSecret: "0123456789abcdef"}},
+		{name: "short secret", msg: RegisterMessage{AccessSecret: "hunter2"}, wantErr: true},
+		{name: "invalid CA", msg: RegisterMessage{ClientCA: "not a certificate"}, wantErr: true},
+		{name: "TCP tunnel", msg: RegisterMessage{Protocol: ProtocolTCP, AccessSecret: "0123456789abcdef"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateAccess(&tt.msg); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookSignatureValidate(t *testing.T) {
+	valid := WebhookSignature{Header: "X-Hub-Signature-256", Algorithm: "sha256", Secret: "s3cret", Prefix: "sha256="}
+	tests := []struct {
+		name    string
+		modify  func(*WebhookSignature)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*WebhookSignature) {}},
+		{name: "base64", modify: func(p *WebhookSignature) { p.Encoding = SignatureBase64 }},
+		{name: "bad header", modify: func(p *WebhookSignature) { p.Header = "X Sig" }, wantErr: true},
+		{name: "wildcard header", modify: func(p *WebhookSignature) { p.Header = "X-Sig-*" }, wantErr: true},
+		{name: "bad algorithm", modify: func(p *WebhookSignature) { p.Algorithm = "md5" }, wantErr: true},
+		{name: "no secret", modify: func(p *WebhookSignature) { p.Secret = "" }, wantErr: true},
+		{name: "bad encoding", modify: func(p *WebhookSignature) { p.Encoding = "base32" }, wantErr: true},
+		{name: "relative path", modify: func(p *WebhookSignature) { p.Path = "hooks" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.modify(&p)
+			if err := p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayProtectionValidate(t *testing.T) {
+	valid := ReplayProtection{Header: "X-GitHub-Delivery", Window: 600}
+	tests := []struct {
+		name    string
+		modify  func(*ReplayProtection)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*ReplayProtection) {}},
+		{name: "flag", modify: func(p *ReplayProtection) { p.Action = ReplayFlag }},
+		{name: "bad header", modify: func(p *ReplayProtection) { p.Header = "" }, wantErr: true},
+		{name: "wildcard header", modify: func(p *ReplayProtection) { p.Header = "X-Id-*" }, wantErr: true},
+		{name: "no window", modify: func(p *ReplayProtection) { p.Window = 0 }, wantErr: true},
+		{name: "window too long", modify: func(p *ReplayProtection) { p.Window = MaxReplayWindow + 1 }, wantErr: true},
+		{name: "bad action", modify: func(p *ReplayProtection) { p.Action = "reject" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := valid
+			tt.modify(&p)
+			if err := p.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseABTest(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []ABBucket
+		wantErr bool
+	}{
+		{input: "a=50,b=50", want: []ABBucket{{"a", 50}, {"b", 50}}},
+		{input: "control=80%, new-checkout=20%", want: []ABBucket{{"control", 80}, {"new-checkout", 20}}},
+		{input: "a=100", wantErr: true},
+		{input: "a=50,b=40", wantErr: true},
+		{input: "a=50,a=50", wantErr: true},
+		{input: "a=120,b=-20", wantErr: true},
+		{input: "a b=50,c=50", wantErr: true},
+		{input: "a=half,b=50", wantErr: true},
+		{input: "a,b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseABTest(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseABTest(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got.Buckets, tt.want) {
+				t.Errorf("ParseABTest(%q) = %+v, want %+v", tt.input, got.Buckets, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGeoPolicy(t *testing.T) {
+	countries, err := ParseCountries([]string{"de", " FR"})
+	if err != nil || !reflect.DeepEqual(countries, []string{"DE", "FR"}) {
+		t.Errorf("ParseCountries() = %v, %v, want [DE FR]", countries, err)
+	}
+	for _, bad := range []string{"DEU", "D", "1A", ""} {
+		if _, err := ParseCountries([]string{bad}); err == nil {
+			t.Errorf("ParseCountries(%q) error = nil, want error", bad)
+		}
+	}
+
+	asns, err := ParseASNs([]string{"AS13335", "as3320", "16509"})
+	if err != nil || !reflect.DeepEqual(asns, []uint32{13335, 3320, 16509}) {
+		t.Errorf("ParseASNs() = %v, %v, want [13335 3320 16509]", asns, err)
+	}
+	for _, bad := range []string{"AS", "AS0", "ASx", "-1", "4294967296"} {
+		if _, err := ParseASNs([]string{bad}); err == nil {
+			t.Errorf("ParseASNs(%q) error = nil, want error", bad)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		policy  GeoPolicy
+		wantErr bool
+	}{
+		{name: "countries", policy: GeoPolicy{AllowCountries: []string{"DE"}, DenyASNs: []uint32{64500}}},
+		{name: "empty", policy: GeoPolicy{}, wantErr: true},
+		{name: "lower-case country", policy: GeoPolicy{DenyCountries: []string{"us"}}, wantErr: true},
+		{name: "zero ASN", policy: GeoPolicy{AllowASNs: []uint32{0}}, wantErr: true},
+		{name: "too many", policy: GeoPolicy{DenyASNs: make([]uint32, MaxGeoPolicyEntries+1)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChallengeValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge Challenge
+		wantErr   bool
+	}{
+		{name: "default", challenge: Challenge{TTL: 3600}},
+		{name: "turnstile", challenge: Challenge{Mode: ChallengeTurnstile, TTL: MaxChallengeTTL}},
+		{name: "unknown mode", challenge: Challenge{Mode: "recaptcha", TTL: 3600}, wantErr: true},
+		{name: "no TTL", challenge: Challenge{Mode: ChallengeJS}, wantErr: true},
+		{name: "TTL too long", challenge: Challenge{TTL: MaxChallengeTTL + 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.challenge.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHoneytokensValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		traps   Honeytokens
+		wantErr bool
+	}{
+		{name: "paths", traps: Honeytokens{Paths: []string{"/wp-login.php", "/.env"}}},
+		{name: "ban", traps: Honeytokens{Paths: []string{"/admin"}, Ban: MaxHoneytokenBan}},
+		{name: "no paths", traps: Honeytokens{Ban: 60}, wantErr: true},
+		{name: "relative path", traps: Honeytokens{Paths: []string{"wp-login.php"}}, wantErr: true},
+		{name: "root", traps: Honeytokens{Paths: []string{"/"}}, wantErr: true},
+		{name: "query", traps: Honeytokens{Paths: []string{"/login?admin=1"}}, wantErr: true},
+		{name: "ban too long", traps: Honeytokens{Paths: []string{"/admin"}, Ban: MaxHoneytokenBan + 1}, wantErr: true},
+		{name: "negative ban", traps: Honeytokens{Paths: []string{"/admin"}, Ban: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.traps.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  JWTPolicy
+		wantErr bool
+	}{
+		{name: "JWKS URL", policy: JWTPolicy{JWKSURL: "https://id.example.com/jwks.json"}},
+		{name: "all settings", policy: JWTPolicy{JWKSURL: "https://id.example.com/jwks.json", Issuer: "https://id.example.com", Audience: "partner-api", Path: "/api"}},
+		{name: "no JWKS URL", policy: JWTPolicy{Issuer: "https://id.example.com"}, wantErr: true},
+		{name: "plain http", policy: JWTPolicy{JWKSURL: "http://id.example.com/jwks.json"}, wantErr: true},
+		{name: "relative URL", policy: JWTPolicy{JWKSURL: "/jwks.json"}, wantErr: true},
+		{name: "relative path", policy: JWTPolicy{JWKSURL: "https://id.example.com/jwks.json", Path: "api"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOwnershipSignature(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	sig := SignOwnership(priv, "demo", "nonce")
+
+	tests := []struct {
+		name      string
+		key       ed25519.PublicKey
+		subdomain string
+		nonce     string
+		signature string
+		want      bool
+	}{
+		{name: "valid", key: pub, subdomain: "demo", nonce: "nonce", signature: sig, want: true},
+		{name: "other key", key: other, subdomain: "demo", nonce: "nonce", signature: sig},
+		{name: "other subdomain", key: pub, subdomain: "demo2", nonce: "nonce", signature: sig},
+		{name: "other nonce", key: pub, subdomain: "demo", nonce: "nonce2", signature: sig},
+		{name: "not base64", key: pub, subdomain: "demo", nonce: "nonce", signature: "!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyOwnership(tt.key, tt.subdomain, tt.nonce, tt.signature); got != tt.want {
+				t.Errorf("VerifyOwnership() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	parsed, err := ParseOwnerKey(EncodeOwnerKey(pub))
+	if err != nil || !parsed.Equal(pub) {
+		t.Errorf("ParseOwnerKey(EncodeOwnerKey()) = %v, %v", parsed, err)
+	}
+	if _, err := ParseOwnerKey("c2hvcnQ="); err == nil {
+		t.Error("ParseOwnerKey accepted a short key")
+	}
+}
+
+func TestStreamTiming(t *testing.T) {
+	r := strings.NewReader(string(AppendStreamTiming(nil, 1500*time.Microsecond)) + "HTTP/1.1 200 OK\r\n")
+	dial, err := ReadStreamTiming(r)
+	if err != nil || dial != 1500*time.Microsecond {
+		t.Errorf("ReadStreamTiming() = %v, %v; want 1.5ms", dial, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "HTTP/1.1 200 OK\r\n" {
+		t.Errorf("response after timing = %q", rest)
+	}
+
+	for _, in := range []string{"HTTP/1.1 200 OK\r\n", "OTUN-TIMING dial=-1\n", "OTUN-TIMING dial=" + strings.Repeat("1", 64)} {
+		if _, err := ReadStreamTiming(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadStreamTiming(%q) succeeded", in)
+		}
+	}
+	if _, err := ReadStreamTiming(strings.NewReader("")); err != io.EOF {
+		t.Errorf("ReadStreamTiming() on an empty stream = %v, want EOF", err)
+	}
+}
+
+func TestStreamTunnel(t *testing.T) {
+	r := strings.NewReader(string(AppendStreamTunnel(nil, "api")) + "GET / HTTP/1.1\r\n")
+	id, err := ReadStreamTunnel(r)
+	if err != nil || id != "api" {
+		t.Errorf("ReadStreamTunnel() = %q, %v; want api", id, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("request after tunnel line = %q", rest)
+	}
+
+	for _, in := range []string{"GET / HTTP/1.1\r\n", "OTUN-TUNNEL \n", "OTUN-TUNNEL a b\n", "OTUN-TUNNEL " + strings.Repeat("a", 64)} {
+		if _, err := ReadStreamTunnel(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadStreamTunnel(%q) succeeded", in)
+		}
+	}
+	if _, err := ReadStreamTunnel(strings.NewReader("")); err != io.EOF {
+		t.Errorf("ReadStreamTunnel() on an empty stream = %v, want EOF", err)
+	}
+}
+
+func TestValidateTunnelID(t *testing.T) {
+	for _, id := range []string{"0", "web", "my-api_2", strings.Repeat("a", 32)} {
+		if err := ValidateTunnelID(id); err != nil {
+			t.Errorf("ValidateTunnelID(%q) = %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "a b", "web\n", "ü", strings.Repeat("a", 33)} {
+		if err := ValidateTunnelID(id); err == nil {
+			t.Errorf("ValidateTunnelID(%q) succeeded", id)
+		}
+	}
+}
+
+func TestParseMessageLimits(t *testing.T) {
+	strict := DefaultLimits
+	strict.DisallowUnknownFields = true
+
+	tests := []struct {
+		name    string
+		msg     string
+		limits  *Limits
+		wantErr bool
+	}{
+		{"register", `{"type":"register","subdomain":"app","labels":{"team":"x"}}`, &strict, false},
+		{"long client CA", `{"type":"register","client_ca":"` + strings.Repeat("A", 10000) + `"}`, &strict, false},
+		{"long token", `{"type":"register","token":"` + strings.Repeat("A", 10000) + `"}`, &strict, true},
+		{"long key", `{"type":"register","labels":{"` + strings.Repeat("k", 10000) + `":"v"}}`, &strict, true},
+		{"long label under client_ca", `{"type":"register","labels":{"client_ca":"` + strings.Repeat("A", 10000) + `"}}`, &strict, false},
+		{"too many items", `{"type":"register","strip_headers":[` + strings.Repeat(`"X",`, 1000) + `"X"]}`, &strict, true},
+		{"too deep", `{"type":"heartbeat","x":` + strings.Repeat("[", 10) + strings.Repeat("]", 10) + `}`, &DefaultLimits, true},
+		{"unknown field allowed", `{"type":"heartbeat","sent_at":1}`, &DefaultLimits, false},
+		{"unknown field rejected", `{"type":"heartbeat","sent_at":1}`, &strict, true},
+		{"no limits", `{"type":"register","token":"` + strings.Repeat("A", 10000) + `"}`, nil, false},
+		{"unknown type", `{"type":"bogus"}`, nil, true},
+		{"wrong field type", `{"type":"register","subdomain":1}`, nil, true},
+	}
+	for _, tt := range tests {
+		_, err := ParseMessage([]byte(tt.msg), tt.limits)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: ParseMessage() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: error %v doesn't wrap ErrInvalidMessage", tt.name, err)
+		}
+	}
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	client, server := newMockStreamPair()
+	limits := DefaultLimits
+	limits.MaxMessageBytes = 1024
+	cs := NewControlStream(server).WithLimits(limits)
+
+	go func() {
+		NewControlStream(client).SendHeartbeat()
+		io.WriteString(client, `{"type":"register","labels":{`)
+		for {
+			if _, err := io.WriteString(client, `"k":"v",`); err != nil {
+				return
+			}
+		}
+	}()
+	defer client.Close()
+
+	if msg, err := cs.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage() = %v, want heartbeat", err)
+	} else if _, ok := msg.(*HeartbeatMessage); !ok {
+		t.Fatalf("ReadMessage() = %T, want heartbeat", msg)
+	}
+	if _, err := cs.ReadMessage(); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("ReadMessage() of an endless message = %v, want ErrInvalidMessage", err)
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import "fmt"
+
+// Actions for ReplayProtection.
+const (
+	// ReplayDrop answers a replay at the edge without forwarding it
+	ReplayDrop = "drop"
+
+	// ReplayFlag forwards a replay with the ReplayHeader set
+	ReplayFlag = "flag"
+)
+
+// ReplayHeader marks requests forwarded by a ReplayFlag policy that repeat
+// an earlier delivery, and responses to dropped replays.
+const ReplayHeader = "X-Otun-Replay"
+
+// MaxReplayWindow is the longest a delivery ID is remembered, in seconds.
+const MaxReplayWindow = 24 * 60 * 60
+
+// ReplayProtection asks the server to detect redelivered webhooks by a
+// delivery ID header, e.g. X-GitHub-Delivery or Stripe-Id, so a provider
+// retrying while the tunnel flaps doesn't trigger the same work twice.
+type ReplayProtection struct {
+	// Header carries the delivery ID
+	Header string `json:"header"`
+
+	// Window is how long, in seconds, a delivered ID is remembered
+	Window int `json:"window"`
+
+	// Action is ReplayDrop (the default if empty) or ReplayFlag
+	Action string `json:"action,omitempty"`
+}
+
+// Validate checks that the policy can be enforced.
+func (p *ReplayProtection) Validate() error {
+	if !headerRulePattern.MatchString(p.Header) || p.Header[len(p.Header)-1] == '*' {
+		return fmt.Errorf("invalid replay header %q", p.Header)
+	}
+	if p.Window <= 0 || p.Window > MaxReplayWindow {
+		return fmt.Errorf("replay window %ds out of range (1s to %ds)", p.Window, MaxReplayWindow)
+	}
+	switch p.Action {
+	case "", ReplayDrop, ReplayFlag:
+	default:
+		return fmt.Errorf("unsupported replay action %q (want drop or flag)", p.Action)
+	}
+	return nil
+}
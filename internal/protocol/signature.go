@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Signature encodings for WebhookSignature.
+const (
+	SignatureHex    = "hex"
+	SignatureBase64 = "base64"
+)
+
+// WebhookSignature asks the server to check an HMAC of each request body
+// before forwarding it, as webhook providers such as GitHub and Shopify
+// sign their deliveries.
+type WebhookSignature struct {
+	// Header carries the signature, e.g. X-Hub-Signature-256
+	Header string `json:"header"`
+
+	// Algorithm is the HMAC hash: sha1, sha256, or sha512
+	Algorithm string `json:"algorithm"`
+
+	// Secret is the key shared with the provider
+	Secret string `json:"secret"`
+
+	// Prefix precedes the signature in the header, e.g. "sha256="
+	Prefix string `json:"prefix,omitempty"`
+
+	// Encoding is SignatureHex (the default if empty) or SignatureBase64
+	Encoding string `json:"encoding,omitempty"`
+
+	// Path limits verification to requests under this path (empty = all)
+	Path string `json:"path,omitempty"`
+}
+
+// SignatureHash returns the hash constructor for an HMAC algorithm name.
+func SignatureHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %q (want sha1, sha256, or sha512)", algorithm)
+}
+
+// Validate checks that the policy can be enforced.
+func (p *WebhookSignature) Validate() error {
+	if !headerRulePattern.MatchString(p.Header) || p.Header[len(p.Header)-1] == '*' {
+		return fmt.Errorf("invalid signature header %q", p.Header)
+	}
+	if _, err := SignatureHash(p.Algorithm); err != nil {
+		return err
+	}
+	if p.Secret == "" {
+		return errors.New("signature secret is empty")
+	}
+	switch p.Encoding {
+	case "", SignatureHex, SignatureBase64:
+	default:
+		return fmt.Errorf("unsupported signature encoding %q (want hex or base64)", p.Encoding)
+	}
+	if p.Path != "" && p.Path[0] != '/' {
+		return fmt.Errorf("signature path %q must start with /", p.Path)
+	}
+	return nil
+}
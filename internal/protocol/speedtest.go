@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Speed test transfer directions, sent as the first byte of each stream a
+// speed test client opens.
+const (
+	// SpeedTestUpload streams the given number of bytes to the server,
+	// which replies with the number it received once it has them all.
+	SpeedTestUpload byte = 'u'
+
+	// SpeedTestDownload asks the server to send the given number of bytes
+	// and close the stream.
+	SpeedTestDownload byte = 'd'
+)
+
+// WriteSpeedTestHeader starts a speed test transfer of n bytes.
+func WriteSpeedTestHeader(w io.Writer, direction byte, n int64) error {
+	var hdr [9]byte
+	hdr[0] = direction
+	binary.BigEndian.PutUint64(hdr[1:], uint64(n))
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// ReadSpeedTestHeader reads the header written by WriteSpeedTestHeader.
+func ReadSpeedTestHeader(r io.Reader) (direction byte, n int64, err error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, fmt.Errorf("failed to read speed test header: %w", err)
+	}
+	direction, n = hdr[0], int64(binary.BigEndian.Uint64(hdr[1:]))
+	if direction != SpeedTestUpload && direction != SpeedTestDownload {
+		return 0, 0, fmt.Errorf("unknown speed test direction %q", direction)
+	}
+	if n < 0 {
+		return 0, 0, fmt.Errorf("invalid speed test size %d", n)
+	}
+	return direction, n, nil
+}
@@ -0,0 +1,223 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidMessage is wrapped by the errors ReadMessage returns for
+// messages that are malformed or break its limits, as opposed to failures
+// of the stream.
+var ErrInvalidMessage = errors.New("invalid control message")
+
+// Limits bound the control messages a ControlStream accepts, to protect a
+// server from hostile clients on its public control port.
+type Limits struct {
+	// MaxMessageBytes bounds a message's encoded size
+	MaxMessageBytes int64
+
+	// MaxStringBytes bounds every string, object keys included, except the
+	// PEM bundle in RegisterMessage.ClientCA
+	MaxStringBytes int
+
+	// MaxItems bounds the elements of every array and the members of
+	// every object
+	MaxItems int
+
+	// MaxDepth bounds how deeply arrays and objects nest
+	MaxDepth int
+
+	// DisallowUnknownFields rejects messages with fields this version of
+	// the protocol doesn't define. Newer peers may send some.
+	DisallowUnknownFields bool
+}
+
+// DefaultLimits are generous enough for any message a client sends.
+var DefaultLimits = Limits{
+	MaxMessageBytes: 1 << 20,
+	MaxStringBytes:  4096,
+	MaxItems:        1000,
+	MaxDepth:        8,
+}
+
+// longStringFields may exceed MaxStringBytes, bounded by MaxMessageBytes.
+var longStringFields = map[string]bool{
+	"client_ca": true,
+}
+
+// WithLimits makes c reject messages that break limits. It must be called
+// before the first ReadMessage.
+func (c *ControlStream) WithLimits(limits Limits) *ControlStream {
+	c.limits = &limits
+	reader := &messageLimiter{r: c.stream, max: limits.MaxMessageBytes}
+	c.decoder = json.NewDecoder(reader)
+	reader.decoder = c.decoder
+	return c
+}
+
+// messageLimiter fails reads once the decoder holds more than max bytes it
+// hasn't consumed yet, so a client can't make it buffer an endless message.
+type messageLimiter struct {
+	r       io.Reader
+	decoder *json.Decoder
+	max     int64
+	read    int64
+}
+
+// errMessageTooLarge is returned by messageLimiter.
+var errMessageTooLarge = errors.New("message too large")
+
+func (l *messageLimiter) Read(b []byte) (int, error) {
+	if l.max > 0 && l.read-l.decoder.InputOffset() > l.max {
+		return 0, errMessageTooLarge
+	}
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+	return n, err
+}
+
+// ParseMessage parses one encoded control message, returning the same
+// types as ReadMessage. With limits non-nil, it enforces them.
+func ParseMessage(data []byte, limits *Limits) (any, error) {
+	strict := false
+	if limits != nil {
+		if err := checkLimits(data, *limits); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+		}
+		strict = limits.DisallowUnknownFields
+	}
+
+	var mt messageType
+	if err := json.Unmarshal(data, &mt); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse message type: %w", ErrInvalidMessage, err)
+	}
+
+	switch mt.Type {
+	case TypeRegister:
+		return parse[RegisterMessage](data, mt.Type, strict)
+	case TypeRegistered:
+		return parse[RegisteredMessage](data, mt.Type, strict)
+	case TypeHeartbeat:
+		return parse[HeartbeatMessage](data, mt.Type, strict)
+	case TypeHeartbeatAck:
+		return parse[HeartbeatAckMessage](data, mt.Type, strict)
+	case TypeError:
+		return parse[ErrorMessage](data, mt.Type, strict)
+	case TypeForward:
+		return parse[ForwardMessage](data, mt.Type, strict)
+	case TypeForwarding:
+		return parse[ForwardingMessage](data, mt.Type, strict)
+	case TypeWarning:
+		return parse[WarningMessage](data, mt.Type, strict)
+	case TypeSpeedTest:
+		return parse[SpeedTestMessage](data, mt.Type, strict)
+	case TypeSpeedTestReady:
+		return parse[SpeedTestReadyMessage](data, mt.Type, strict)
+	case TypeChallenge:
+		return parse[ChallengeMessage](data, mt.Type, strict)
+	case TypeChallengeReply:
+		return parse[ChallengeReplyMessage](data, mt.Type, strict)
+	case TypeIntrusion:
+		return parse[IntrusionMessage](data, mt.Type, strict)
+	case TypeRelay:
+		return parse[RelayMessage](data, mt.Type, strict)
+	case TypeRelaying:
+		return parse[RelayingMessage](data, mt.Type, strict)
+	default:
+		return nil, fmt.Errorf("%w: unknown message type: %.64q", ErrInvalidMessage, mt.Type)
+	}
+}
+
+// parse decodes data as a message of type T, named name in errors.
+func parse[T any](data []byte, name string, disallowUnknown bool) (*T, error) {
+	var msg T
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if disallowUnknown {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&msg); err != nil {
+		return nil, fmt.Errorf("%w: failed to parse %s message: %w", ErrInvalidMessage, name, err)
+	}
+	return &msg, nil
+}
+
+// checkLimits walks an encoded message and reports the first limit it
+// breaks.
+func checkLimits(data []byte, limits Limits) error {
+	if limits.MaxMessageBytes > 0 && int64(len(data)) > limits.MaxMessageBytes {
+		return errMessageTooLarge
+	}
+
+	type container struct {
+		object  bool
+		wantKey bool // the next token in the object is a key
+		items   int
+	}
+	var stack []container
+	key := "" // the key of the value being read, in an object
+
+	// valueDone counts a complete value in the enclosing container
+	valueDone := func() error {
+		if len(stack) == 0 {
+			return nil
+		}
+		top := &stack[len(stack)-1]
+		top.items++
+		top.wantKey = top.object
+		if limits.MaxItems > 0 && top.items > limits.MaxItems {
+			return fmt.Errorf("more than %d items", limits.MaxItems)
+		}
+		return nil
+	}
+	checkString := func(s string, long bool) error {
+		if limits.MaxStringBytes > 0 && len(s) > limits.MaxStringBytes && !long {
+			return fmt.Errorf("string longer than %d bytes", limits.MaxStringBytes)
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		inObject := len(stack) > 0 && stack[len(stack)-1].object
+		if inObject && stack[len(stack)-1].wantKey {
+			if k, ok := tok.(string); ok {
+				if err := checkString(k, false); err != nil {
+					return err
+				}
+				key = k
+				stack[len(stack)-1].wantKey = false
+				continue
+			}
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			if v == '{' || v == '[' {
+				stack = append(stack, container{object: v == '{', wantKey: v == '{'})
+				if limits.MaxDepth > 0 && len(stack) > limits.MaxDepth {
+					return fmt.Errorf("nested deeper than %d", limits.MaxDepth)
+				}
+				continue
+			}
+			stack = stack[:len(stack)-1]
+		case string:
+			if err := checkString(v, inObject && longStringFields[key]); err != nil {
+				return err
+			}
+		}
+		if err := valueDone(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timingPrefix starts the line a client writes ahead of its response on
+// each stream of a tunnel registered with Timing, e.g.
+// "OTUN-TIMING dial=1500000\n" (nanoseconds).
+const timingPrefix = "OTUN-TIMING dial="
+
+// maxTimingLine bounds the timing line, newline included.
+const maxTimingLine = 64
+
+// AppendStreamTiming appends the timing line reporting how long the client
+// took to reach its local service to b.
+func AppendStreamTiming(b []byte, dial time.Duration) []byte {
+	b = append(b, timingPrefix...)
+	b = strconv.AppendInt(b, int64(dial), 10)
+	return append(b, '\n')
+}
+
+// ReadStreamTiming reads a timing line from r, byte by byte so nothing after
+// it is consumed. It returns io.EOF if the stream ended before any of it.
+func ReadStreamTiming(r io.Reader) (time.Duration, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxTimingLine {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if len(line) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b[0] == '\n' {
+			value, ok := strings.CutPrefix(string(line), timingPrefix)
+			dial, err := strconv.ParseInt(value, 10, 64)
+			if !ok || err != nil || dial < 0 {
+				return 0, fmt.Errorf("invalid stream timing %q", line)
+			}
+			return time.Duration(dial), nil
+		}
+		line = append(line, b[0])
+	}
+	return 0, errors.New("stream timing line too long")
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// MaxTunnelsPerSession is how many tunnels a client may register over one
+// connection.
+const MaxTunnelsPerSession = 32
+
+// tunnelIDPattern is what a TunnelID may look like.
+var tunnelIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// tunnelPrefix starts the line the server writes ahead of everything else
+// on each stream it opens for a tunnel registered with a TunnelID, e.g.
+// "OTUN-TUNNEL web\n", so the client knows which of its tunnels the stream
+// is for.
+const tunnelPrefix = "OTUN-TUNNEL "
+
+// maxTunnelLine bounds the tunnel line, newline included.
+const maxTunnelLine = 64
+
+// ValidateTunnelID checks id is usable as a TunnelID: 1 to 32 letters,
+// digits, dashes or underscores.
+func ValidateTunnelID(id string) error {
+	if !tunnelIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid tunnel ID %.40q: use 1 to 32 letters, digits, - or _", id)
+	}
+	return nil
+}
+
+// AppendStreamTunnel appends the line naming the tunnel a stream is for
+// to b.
+func AppendStreamTunnel(b []byte, id string) []byte {
+	b = append(b, tunnelPrefix...)
+	b = append(b, id...)
+	return append(b, '\n')
+}
+
+// ReadStreamTunnel reads a tunnel line from r, byte by byte so nothing
+// after it is consumed. It returns io.EOF if the stream ended before any of
+// it.
+func ReadStreamTunnel(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxTunnelLine {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if len(line) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b[0] == '\n' {
+			id, ok := strings.CutPrefix(string(line), tunnelPrefix)
+			if !ok || ValidateTunnelID(id) != nil {
+				return "", fmt.Errorf("invalid stream tunnel line %q", line)
+			}
+			return id, nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("stream tunnel line too long")
+}
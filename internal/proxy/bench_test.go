@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// opaqueConn hides the io.ReaderFrom and io.WriterTo methods of a
+// *net.TCPConn, forcing the generic copy loop.
+type opaqueConn struct {
+	net.Conn
+}
+
+func (c opaqueConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(b testing.TB) (*net.TCPConn, *net.TCPConn) {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatalf("failed to dial: %v", err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		b.Fatal("failed to accept")
+	}
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+// BenchmarkBidirectionalTCP measures throughput of proxying between two TCP
+// connections, with the kernel fast path (splice on Linux) and without.
+func BenchmarkBidirectionalTCP(b *testing.B) {
+	const chunk = 1 << 20
+	for _, bc := range []struct {
+		name string
+		wrap func(*net.TCPConn) io.ReadWriteCloser
+	}{
+		{name: "splice", wrap: func(c *net.TCPConn) io.ReadWriteCloser { return c }},
+		{name: "generic", wrap: func(c *net.TCPConn) io.ReadWriteCloser { return opaqueConn{c} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			src, proxyIn := tcpPair(b)
+			proxyOut, dst := tcpPair(b)
+			go Bidirectional(bc.wrap(proxyIn), bc.wrap(proxyOut))
+			defer src.Close()
+			defer dst.Close()
+
+			data := make([]byte, chunk)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if _, err := src.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			if _, err := io.CopyN(io.Discard, dst, int64(b.N)*chunk); err != nil {
+				b.Fatalf("failed to read: %v", err)
+			}
+		})
+	}
+}
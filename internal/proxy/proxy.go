@@ -2,11 +2,25 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"io"
+	"net"
 	"sync"
 )
 
+// copyBufferSize is the size of the buffers used when neither side of a
+// copy offers a faster path.
+const copyBufferSize = 32 * 1024
+
+// bufferPool recycles copy buffers across connections.
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
 // halfCloser is implemented by connections that support closing the write side
 // while keeping the read side open (TCP, TLS, yamux streams).
 type halfCloser interface {
@@ -32,7 +46,7 @@ func Bidirectional(conn1, conn2 io.ReadWriteCloser) error {
 	// conn1 -> conn2
 	go func() {
 		defer wg.Done()
-		_, err1 = io.Copy(conn2, conn1)
+		_, err1 = copyConn(conn2, conn1)
 		// Signal EOF to conn2's reader by closing write side
 		closeWrite(conn2)
 	}()
@@ -40,7 +54,7 @@ func Bidirectional(conn1, conn2 io.ReadWriteCloser) error {
 	// conn2 -> conn1
 	go func() {
 		defer wg.Done()
-		_, err2 = io.Copy(conn1, conn2)
+		_, err2 = copyConn(conn1, conn2)
 		// Signal EOF to conn1's reader by closing write side
 		closeWrite(conn1)
 	}()
@@ -55,6 +69,68 @@ func Bidirectional(conn1, conn2 io.ReadWriteCloser) error {
 	return firstError(err1, err2)
 }
 
+// BidirectionalContext is like Bidirectional, but aborts the copies when ctx
+// is cancelled or its deadline passes by closing both connections, and then
+// returns ctx's error. A ctx that can't be cancelled behaves exactly like
+// Bidirectional.
+func BidirectionalContext(ctx context.Context, conn1, conn2 io.ReadWriteCloser) error {
+	if ctx.Done() == nil {
+		return Bidirectional(conn1, conn2)
+	}
+	if err := ctx.Err(); err != nil {
+		conn1.Close()
+		conn2.Close()
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn1.Close()
+		conn2.Close()
+	})
+	err := Bidirectional(conn1, conn2)
+	if !stop() {
+		// The copies were cut short by ctx
+		return ctx.Err()
+	}
+	return err
+}
+
+// copyConn copies src to dst until EOF or an error. A copy between two TCP
+// connections is left to the kernel: on Linux, (*net.TCPConn).ReadFrom
+// splices the data from one socket to the other without it passing through
+// user space. Any other copy goes through a pooled buffer, bypassing the
+// ReadFrom and WriteTo methods of either side, as for anything but another
+// socket they fall back to a copy loop allocating its own buffer.
+func copyConn(dst io.Writer, src io.Reader) (int64, error) {
+	if tcpDst, tcpSrc, ok := spliceable(dst, src); ok {
+		return tcpDst.ReadFrom(tcpSrc)
+	}
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+// spliceable returns dst and src as TCP connections if both are, so the
+// copy between them can be spliced.
+func spliceable(dst io.Writer, src io.Reader) (*net.TCPConn, *net.TCPConn, bool) {
+	tcpDst, ok := dst.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	tcpSrc, ok := src.(*net.TCPConn)
+	return tcpDst, tcpSrc, ok
+}
+
+// writerOnly hides any ReadFrom method of a Writer from io.CopyBuffer.
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides any WriteTo method of a Reader from io.CopyBuffer.
+type readerOnly struct {
+	io.Reader
+}
+
 // closeWrite attempts to half-close the write side of a connection.
 func closeWrite(c io.ReadWriteCloser) {
 	if hc, ok := c.(halfCloser); ok {
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"testing"
 	"time"
@@ -193,6 +195,77 @@ func TestBidirectional(t *testing.T) {
 	})
 }
 
+func TestBidirectionalContext(t *testing.T) {
+	t.Run("aborts on cancellation", func(t *testing.T) {
+		_, conn1b := mockConnPair()
+		conn2a, _ := mockConnPair()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan error, 1)
+		go func() {
+			done <- BidirectionalContext(ctx, conn1b, conn2a)
+		}()
+		cancel()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("BidirectionalContext returned %v, want context.Canceled", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("BidirectionalContext did not return after cancellation")
+		}
+	})
+
+	t.Run("aborts at deadline", func(t *testing.T) {
+		_, conn1b := mockConnPair()
+		conn2a, _ := mockConnPair()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		if err := BidirectionalContext(ctx, conn1b, conn2a); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("BidirectionalContext returned %v, want context.DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("already cancelled", func(t *testing.T) {
+		_, conn1b := mockConnPair()
+		conn2a, _ := mockConnPair()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := BidirectionalContext(ctx, conn1b, conn2a); !errors.Is(err, context.Canceled) {
+			t.Errorf("BidirectionalContext returned %v, want context.Canceled", err)
+		}
+		if _, err := conn1b.Write([]byte("test")); err == nil {
+			t.Error("expected conn1b to be closed")
+		}
+	})
+
+	t.Run("completes normally", func(t *testing.T) {
+		conn1a, conn1b := mockConnPair()
+		conn2a, conn2b := mockConnPair()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- BidirectionalContext(ctx, conn1b, conn2a)
+		}()
+		conn1a.Close()
+		conn2b.Close()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("BidirectionalContext returned %v, want nil", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("BidirectionalContext did not complete in time")
+		}
+	})
+}
+
 func TestFirstError(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -233,3 +306,29 @@ func TestFirstError(t *testing.T) {
 		})
 	}
 }
+
+func TestSpliceable(t *testing.T) {
+	tcp1, tcp2 := tcpPair(t)
+	defer tcp1.Close()
+	defer tcp2.Close()
+	mock, _ := mockConnPair()
+
+	tests := []struct {
+		name string
+		dst  io.Writer
+		src  io.Reader
+		want bool
+	}{
+		{name: "both TCP", dst: tcp1, src: tcp2, want: true},
+		{name: "TCP to other", dst: mock, src: tcp2},
+		{name: "other to TCP", dst: tcp1, src: mock},
+		{name: "wrapped TCP", dst: opaqueConn{tcp1}, src: tcp2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, got := spliceable(tt.dst, tt.src); got != tt.want {
+				t.Errorf("spliceable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
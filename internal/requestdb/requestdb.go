@@ -0,0 +1,322 @@
+// Package requestdb persists request records to a local SQLite file, so they
+// survive restarts for post-mortem debugging, pruning them by age and size.
+package requestdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+const (
+	// bufferSize is the number of records held while the writer catches up.
+	// Records logged while the buffer is full are dropped.
+	bufferSize = 10000
+
+	// batchSize is the maximum number of records written per transaction.
+	batchSize = 500
+
+	// flushInterval is the longest a record waits before being written.
+	flushInterval = time.Second
+
+	// pruneInterval is how often records past the retention are deleted.
+	pruneInterval = time.Minute
+)
+
+// schema creates the records table. auto_vacuum must be set before the
+// first table is created for pruning to shrink the file.
+const schema = `
+PRAGMA auto_vacuum = INCREMENTAL;
+CREATE TABLE IF NOT EXISTS requests (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	time        INTEGER NOT NULL, -- unix nanoseconds
+	subdomain   TEXT NOT NULL,
+	method      TEXT NOT NULL,
+	host        TEXT NOT NULL,
+	path        TEXT NOT NULL,
+	status      INTEGER NOT NULL, -- 0 if unknown
+	duration_ms INTEGER NOT NULL,
+	remote_addr TEXT NOT NULL,
+	data        TEXT -- the full record as JSON, if any
+);
+CREATE INDEX IF NOT EXISTS requests_subdomain_time ON requests (subdomain, time);
+CREATE INDEX IF NOT EXISTS requests_time ON requests (time);
+`
+
+// Record is one request.
+type Record struct {
+	ID         int64
+	Time       time.Time
+	Subdomain  string
+	Method     string
+	Host       string
+	Path       string
+	Status     int
+	Duration   time.Duration
+	RemoteAddr string
+
+	// Data is the full record as JSON, e.g. an inspector exchange with its
+	// headers and bodies (nil = metadata only)
+	Data json.RawMessage
+}
+
+// Retention bounds what the database keeps. Zero values mean no limit.
+type Retention struct {
+	// MaxAge deletes records older than this.
+	MaxAge time.Duration
+
+	// MaxBytes deletes the oldest records while the data in the file
+	// exceeds this many bytes.
+	MaxBytes int64
+}
+
+// DB writes records to a SQLite file in the background.
+type DB struct {
+	db        *sql.DB
+	retention Retention
+	records   chan Record
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Open opens or creates the database at path and starts its background
+// writer.
+func Open(path string, retention Retention) (*DB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open request database: %w", err)
+	}
+	db.SetMaxOpenConns(1) // one writer; SQLite serializes writes anyway
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open request database %s: %w", path, err)
+	}
+
+	d := &DB{
+		db:        db,
+		retention: retention,
+		records:   make(chan Record, bufferSize),
+		done:      make(chan struct{}),
+	}
+	d.prune(time.Now())
+	go d.run()
+	return d, nil
+}
+
+// Log queues a record without blocking. It returns false if the buffer is
+// full and the record was dropped.
+func (d *DB) Log(r Record) bool {
+	select {
+	case d.records <- r:
+		return true
+	default:
+		d.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped returns the number of records dropped because the buffer was
+// full.
+func (d *DB) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Failed returns the number of batches that failed to be written.
+func (d *DB) Failed() uint64 {
+	return d.failed.Load()
+}
+
+// Close writes buffered records and closes the database. Log must not be
+// called after Close.
+func (d *DB) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.records)
+		<-d.done
+		err = d.db.Close()
+	})
+	return err
+}
+
+// Query selects records.
+type Query struct {
+	Subdomain string    // "" = all
+	Since     time.Time // zero = all
+	Limit     int       // 0 = no limit
+}
+
+// Recent returns the records matching q, newest first. Records still
+// buffered are not included.
+func (d *DB) Recent(ctx context.Context, q Query) ([]Record, error) {
+	query := `SELECT id, time, subdomain, method, host, path, status, duration_ms, remote_addr, data
+		FROM requests WHERE time >= ?`
+	args := []any{q.Since.UnixNano()}
+	if q.Since.IsZero() {
+		args[0] = int64(0)
+	}
+	if q.Subdomain != "" {
+		query += ` AND subdomain = ?`
+		args = append(args, q.Subdomain)
+	}
+	query += ` ORDER BY time DESC, id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query request database: %w", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		var at, durationMS int64
+		var data sql.NullString
+		if err := rows.Scan(&r.ID, &at, &r.Subdomain, &r.Method, &r.Host, &r.Path, &r.Status, &durationMS, &r.RemoteAddr, &data); err != nil {
+			return nil, fmt.Errorf("failed to read request database: %w", err)
+		}
+		r.Time = time.Unix(0, at)
+		r.Duration = time.Duration(durationMS) * time.Millisecond
+		if data.Valid {
+			r.Data = json.RawMessage(data.String)
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// run writes records in batches and prunes the database until the channel
+// is closed.
+func (d *DB) run() {
+	defer close(d.done)
+
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	batch := make([]Record, 0, batchSize)
+	for {
+		select {
+		case r, ok := <-d.records:
+			if !ok {
+				d.write(batch)
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= batchSize {
+				d.write(batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			d.write(batch)
+			batch = batch[:0]
+		case now := <-prune.C:
+			d.prune(now)
+		}
+	}
+}
+
+// write inserts a batch in one transaction.
+func (d *DB) write(batch []Record) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := d.insert(batch); err != nil {
+		d.failed.Add(1)
+		slog.Error("failed to write request database", "records", len(batch), "error", err)
+	}
+}
+
+func (d *DB) insert(batch []Record) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO requests
+		(time, subdomain, method, host, path, status, duration_ms, remote_addr, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		var data any
+		if r.Data != nil {
+			data = string(r.Data)
+		}
+		if _, err := stmt.Exec(r.Time.UnixNano(), r.Subdomain, r.Method, r.Host, r.Path, r.Status,
+			r.Duration.Milliseconds(), r.RemoteAddr, data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes records past the retention and returns their space to the
+// file system.
+func (d *DB) prune(now time.Time) {
+	if err := d.pruneAge(now); err != nil {
+		slog.Error("failed to prune request database", "error", err)
+	}
+	if err := d.pruneSize(); err != nil {
+		slog.Error("failed to prune request database", "error", err)
+	}
+	if _, err := d.db.Exec(`PRAGMA incremental_vacuum`); err != nil {
+		slog.Error("failed to vacuum request database", "error", err)
+	}
+}
+
+func (d *DB) pruneAge(now time.Time) error {
+	if d.retention.MaxAge <= 0 {
+		return nil
+	}
+	_, err := d.db.Exec(`DELETE FROM requests WHERE time < ?`, now.Add(-d.retention.MaxAge).UnixNano())
+	return err
+}
+
+// pruneSize deletes the oldest tenth of the records until the data fits in
+// MaxBytes.
+func (d *DB) pruneSize() error {
+	if d.retention.MaxBytes <= 0 {
+		return nil
+	}
+	for {
+		used, err := d.usedBytes()
+		if err != nil || used <= d.retention.MaxBytes {
+			return err
+		}
+		res, err := d.db.Exec(`DELETE FROM requests WHERE id IN
+			(SELECT id FROM requests ORDER BY time LIMIT max(1, (SELECT count(*) FROM requests) / 10))`)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil // what's left is the schema
+		}
+	}
+}
+
+// usedBytes returns the size of the pages holding data, excluding free
+// pages not yet vacuumed.
+func (d *DB) usedBytes() (int64, error) {
+	var pages, free, pageSize int64
+	err := d.db.QueryRow(`SELECT p.page_count, f.freelist_count, s.page_size
+		FROM pragma_page_count() p, pragma_freelist_count() f, pragma_page_size() s`).Scan(&pages, &free, &pageSize)
+	return (pages - free) * pageSize, err
+}
@@ -0,0 +1,100 @@
+package requestdb
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, path string, retention Retention) *DB {
+	t.Helper()
+	d, err := Open(path, retention)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestRecordsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.db")
+	now := time.Now()
+
+	d := openTestDB(t, path, Retention{})
+	d.Log(Record{Time: now.Add(-time.Second), Subdomain: "app", Method: "GET", Path: "/old", Status: 200, Duration: 12 * time.Millisecond})
+	d.Log(Record{Time: now, Subdomain: "app", Method: "POST", Path: "/new", Status: 502, Data: json.RawMessage(`{"id":"2"}`)})
+	d.Log(Record{Time: now, Subdomain: "other", Method: "GET", Path: "/"})
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	d = openTestDB(t, path, Retention{})
+	records, err := d.Recent(context.Background(), Query{Subdomain: "app"})
+	if err != nil {
+		t.Fatalf("Recent() error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	newest, oldest := records[0], records[1]
+	if newest.Path != "/new" || newest.Status != 502 || string(newest.Data) != `{"id":"2"}` || !newest.Time.Equal(now) {
+		t.Errorf("newest record = %+v", newest)
+	}
+	if oldest.Path != "/old" || oldest.Duration != 12*time.Millisecond || oldest.Data != nil {
+		t.Errorf("oldest record = %+v", oldest)
+	}
+
+	limited, err := d.Recent(context.Background(), Query{Limit: 1, Since: now})
+	if err != nil || len(limited) != 1 {
+		t.Errorf("Recent(limit 1) = %d records, %v; want 1", len(limited), err)
+	}
+}
+
+func TestPruneByAge(t *testing.T) {
+	d := openTestDB(t, filepath.Join(t.TempDir(), "requests.db"), Retention{MaxAge: time.Hour})
+	now := time.Now()
+	d.write([]Record{
+		{Time: now.Add(-2 * time.Hour), Path: "/expired"},
+		{Time: now.Add(-time.Minute), Path: "/kept"},
+	})
+	d.prune(now)
+
+	records, err := d.Recent(context.Background(), Query{})
+	if err != nil {
+		t.Fatalf("Recent() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Path != "/kept" {
+		t.Errorf("records = %+v, want only /kept", records)
+	}
+}
+
+func TestPruneBySize(t *testing.T) {
+	const maxBytes = 256 << 10
+	d := openTestDB(t, filepath.Join(t.TempDir(), "requests.db"), Retention{MaxBytes: maxBytes})
+	now := time.Now()
+	body := json.RawMessage(`"` + strings.Repeat("x", 4096) + `"`)
+	batch := make([]Record, 200)
+	for i := range batch {
+		batch[i] = Record{Time: now.Add(time.Duration(i) * time.Millisecond), Path: "/", Data: body}
+	}
+	d.write(batch)
+	d.prune(now)
+
+	used, err := d.usedBytes()
+	if err != nil {
+		t.Fatalf("usedBytes() error = %v", err)
+	}
+	if used > maxBytes {
+		t.Errorf("database holds %d bytes after pruning, want at most %d", used, maxBytes)
+	}
+	records, _ := d.Recent(context.Background(), Query{})
+	if len(records) == 0 || len(records) == len(batch) {
+		t.Fatalf("%d of %d records kept, want some pruned", len(records), len(batch))
+	}
+	if !records[0].Time.Equal(batch[len(batch)-1].Time) {
+		t.Error("newest record was pruned")
+	}
+}
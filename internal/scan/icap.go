@@ -0,0 +1,123 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// icapDefaultPort is the standard ICAP port.
+const icapDefaultPort = "1344"
+
+// ICAP sends bodies to an ICAP server's REQMOD service (RFC 3507). A 204
+// reply means clean; a 200 reply means the server replaced the request,
+// which scanners do to block it.
+type ICAP struct {
+	url    *url.URL
+	dialer net.Dialer
+}
+
+// NewICAP creates a scanner for the REQMOD service at u, e.g.
+// icap://127.0.0.1:1344/avscan.
+func NewICAP(u *url.URL) *ICAP {
+	return &ICAP{url: u}
+}
+
+// Scan implements Scanner.
+func (s *ICAP) Scan(ctx context.Context, req *http.Request, body io.Reader) (Verdict, error) {
+	host := s.url.Host
+	if s.url.Port() == "" {
+		host = net.JoinHostPort(s.url.Hostname(), icapDefaultPort)
+	}
+	conn, err := s.dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to connect to ICAP server: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := s.writeRequest(conn, req, body); err != nil {
+		return Verdict{}, fmt.Errorf("failed to send to ICAP server: %w", err)
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	status, err := tp.ReadLine()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to read ICAP response: %w", err)
+	}
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return Verdict{}, fmt.Errorf("failed to read ICAP response: %w", err)
+	}
+
+	var code int
+	var text string
+	if _, err := fmt.Sscanf(status, "ICAP/1.0 %d", &code); err != nil {
+		return Verdict{}, fmt.Errorf("invalid ICAP status line %q", status)
+	}
+	if _, after, ok := strings.Cut(status, fmt.Sprint(code)); ok {
+		text = strings.TrimSpace(after)
+	}
+
+	switch code {
+	case 204:
+		return Verdict{Clean: true}, nil
+	case 200:
+		reason := headers.Get("X-Infection-Found")
+		if reason == "" {
+			reason = headers.Get("X-Violations-Found")
+		}
+		if reason == "" {
+			reason = "blocked by ICAP server"
+		}
+		return Verdict{Reason: reason}, nil
+	default:
+		return Verdict{}, fmt.Errorf("ICAP server returned %d %s", code, text)
+	}
+}
+
+// writeRequest sends a REQMOD request encapsulating req's headers and body.
+func (s *ICAP) writeRequest(w io.Writer, req *http.Request, body io.Reader) error {
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(&hdr, "Host: %s\r\n", req.Host)
+	req.Header.Write(&hdr)
+	hdr.WriteString("\r\n")
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "REQMOD %s ICAP/1.0\r\n", s.url.String())
+	fmt.Fprintf(bw, "Host: %s\r\n", s.url.Host)
+	bw.WriteString("Allow: 204\r\n")
+	fmt.Fprintf(bw, "Encapsulated: req-hdr=0, req-body=%d\r\n\r\n", hdr.Len())
+	bw.Write(hdr.Bytes())
+
+	// The body is sent chunked
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	bw.WriteString("0\r\n\r\n")
+	return bw.Flush()
+}
@@ -0,0 +1,76 @@
+// Package scan passes request bodies through an external content scanner,
+// either a command (e.g. clamdscan) or an ICAP server, before they are
+// forwarded.
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// Verdict is the outcome of a scan.
+type Verdict struct {
+	Clean  bool
+	Reason string // why the body was rejected, if the scanner said
+}
+
+// Scanner inspects request bodies.
+type Scanner interface {
+	// Scan reads body, the body of req (whose own Body is not read), and
+	// reports whether it may be forwarded.
+	Scan(ctx context.Context, req *http.Request, body io.Reader) (Verdict, error)
+}
+
+// Parse creates a scanner from a spec: an icap:// URL naming the REQMOD
+// service, or a command line that is passed the body on stdin.
+func Parse(spec string) (Scanner, error) {
+	if strings.HasPrefix(spec, "icap://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ICAP URL %q: %w", spec, err)
+		}
+		return NewICAP(u), nil
+	}
+	args := strings.Fields(spec)
+	if len(args) == 0 {
+		return nil, errors.New("empty scanner command")
+	}
+	return &Command{Path: args[0], Args: args[1:]}, nil
+}
+
+// Command runs a program with the body on stdin. Exit status 0 means clean
+// and 1 means rejected, following clamdscan and most virus scanners; anything
+// else is an error. The first line of output is used as the reason.
+type Command struct {
+	Path string
+	Args []string
+}
+
+// Scan implements Scanner.
+func (c *Command) Scan(ctx context.Context, req *http.Request, body io.Reader) (Verdict, error) {
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Stdin = body
+	cmd.Env = append(cmd.Environ(),
+		"OTUN_METHOD="+req.Method,
+		"OTUN_HOST="+req.Host,
+		"OTUN_PATH="+req.URL.Path,
+		"OTUN_CONTENT_TYPE="+req.Header.Get("Content-Type"),
+	)
+	out, err := cmd.Output()
+	if err == nil {
+		return Verdict{Clean: true}, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		reason, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return Verdict{Reason: reason}, nil
+	}
+	return Verdict{}, fmt.Errorf("scanner %s failed: %w", c.Path, err)
+}
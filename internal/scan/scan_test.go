@@ -0,0 +1,162 @@
+package scan
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse("icap://127.0.0.1:1344/avscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*ICAP); !ok {
+		t.Errorf("Parse(icap://...) = %T, want *ICAP", s)
+	}
+
+	s, err = Parse("clamdscan --no-summary -")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, ok := s.(*Command)
+	if !ok || cmd.Path != "clamdscan" || len(cmd.Args) != 2 {
+		t.Errorf("Parse(command) = %+v", s)
+	}
+
+	if _, err := Parse("  "); err == nil {
+		t.Error("Parse of an empty command succeeded")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	scanner := &Command{
+		Path: "sh",
+		Args: []string{"-c", `if grep -q EVIL; then echo "Evil.Test FOUND"; exit 1; fi; [ "$OTUN_PATH" = /upload ] || exit 2`},
+	}
+	req := httptest.NewRequest("POST", "http://app.localhost/upload", nil)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantClean  bool
+		wantReason string
+	}{
+		{name: "clean", body: "hello", wantClean: true},
+		{name: "rejected", body: "some EVIL bytes", wantReason: "Evil.Test FOUND"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := scanner.Scan(context.Background(), req, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+			if v.Clean != tt.wantClean || v.Reason != tt.wantReason {
+				t.Errorf("Scan() = %+v, want clean=%v reason=%q", v, tt.wantClean, tt.wantReason)
+			}
+		})
+	}
+
+	other := httptest.NewRequest("POST", "http://app.localhost/other", nil)
+	if _, err := scanner.Scan(context.Background(), other, strings.NewReader("hello")); err == nil {
+		t.Error("Scan() succeeded for exit status 2")
+	}
+}
+
+// fakeICAP answers REQMOD requests, rejecting bodies containing "EVIL".
+func fakeICAP(t *testing.T) *url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				tp := textproto.NewReader(br)
+				line, _ := tp.ReadLine()
+				if !strings.HasPrefix(line, "REQMOD icap://") {
+					io.WriteString(conn, "ICAP/1.0 400 Bad Request\r\n\r\n")
+					return
+				}
+				if _, err := tp.ReadMIMEHeader(); err != nil {
+					return
+				}
+				// Encapsulated HTTP request head, then the chunked body
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Header.Get("Content-Type") != "text/plain" {
+					io.WriteString(conn, "ICAP/1.0 400 Bad Request\r\n\r\n")
+					return
+				}
+				body, _ := io.ReadAll(httputil.NewChunkedReader(br))
+				if strings.Contains(string(body), "EVIL") {
+					io.WriteString(conn, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=Evil.Test;\r\nEncapsulated: null-body=0\r\n\r\n")
+					return
+				}
+				io.WriteString(conn, "ICAP/1.0 204 No Content\r\n\r\n")
+			}()
+		}
+	}()
+
+	u, _ := url.Parse("icap://" + ln.Addr().String() + "/avscan")
+	return u
+}
+
+func TestICAP(t *testing.T) {
+	scanner := NewICAP(fakeICAP(t))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantClean  bool
+		wantReason string
+	}{
+		{name: "clean", body: strings.Repeat("a", 100000), wantClean: true},
+		{name: "rejected", body: "some EVIL bytes", wantReason: "Type=0; Resolution=2; Threat=Evil.Test;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://app.localhost/upload?x=1", nil)
+			req.Header.Set("Content-Type", "text/plain")
+
+			v, err := scanner.Scan(context.Background(), req, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("Scan() error = %v", err)
+			}
+			if v.Clean != tt.wantClean || v.Reason != tt.wantReason {
+				t.Errorf("Scan() = %+v, want clean=%v reason=%q", v, tt.wantClean, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestICAPUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	u, _ := url.Parse("icap://" + addr + "/avscan")
+	req := httptest.NewRequest("POST", "http://app.localhost/", nil)
+	if _, err := NewICAP(u).Scan(context.Background(), req, strings.NewReader("x")); err == nil {
+		t.Error("Scan() succeeded with no ICAP server")
+	}
+}
@@ -0,0 +1,182 @@
+// Package secrets resolves references to secrets in configuration, so
+// configs holding API keys can live in a dotfiles repository: ${env:VAR}
+// reads an environment variable, ${file:PATH} a file, and ${age:PATH} a file
+// encrypted with age. Whole config files encrypted with sops are decrypted
+// too. Encryption is left to the age and sops commands, which must be
+// installed to use it.
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownReference is returned for a ${kind:...} reference of a kind
+// Expand doesn't know.
+var ErrUnknownReference = errors.New("unknown secret reference")
+
+// Expand returns s with each ${env:VAR}, ${file:PATH} and ${age:PATH}
+// reference replaced by the secret it names. "$${" stands for a literal
+// "${". A leading ~/ in paths is the home directory.
+func Expand(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var out strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			out.WriteString(s)
+			return out.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			out.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated secret reference %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		value, err := resolve(ref)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(s[:i])
+		out.WriteString(value)
+		s = s[i+end+1:]
+	}
+}
+
+// ExpandNode expands the references in every scalar value of node, a
+// parsed YAML document. Mapping keys are left alone.
+func ExpandNode(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := Expand(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		node.Value = value
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := ExpandNode(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := ExpandNode(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve returns the secret ref ("kind:argument") names.
+func resolve(ref string) (string, error) {
+	kind, arg, ok := strings.Cut(ref, ":")
+	if !ok || arg == "" {
+		return "", fmt.Errorf("%w: ${%s}", ErrUnknownReference, ref)
+	}
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(expandHome(arg))
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret: %w", err)
+		}
+		return trimNewline(string(data)), nil
+	case "age":
+		data, err := decryptAge(expandHome(arg))
+		if err != nil {
+			return "", err
+		}
+		return trimNewline(string(data)), nil
+	}
+	return "", fmt.Errorf("%w: ${%s}", ErrUnknownReference, ref)
+}
+
+// AgeIdentity returns the age identity file used to decrypt ${age:...}
+// secrets: $OTUN_AGE_IDENTITY, else $SOPS_AGE_KEY_FILE, else the file sops
+// uses by default, so one key serves both.
+func AgeIdentity() string {
+	for _, env := range []string{"OTUN_AGE_IDENTITY", "SOPS_AGE_KEY_FILE"} {
+		if path := os.Getenv(env); path != "" {
+			return expandHome(path)
+		}
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sops", "age", "keys.txt")
+}
+
+// decryptAge decrypts the age-encrypted file at path with AgeIdentity.
+func decryptAge(path string) ([]byte, error) {
+	return run("age", "--decrypt", "--identity", AgeIdentity(), path)
+}
+
+// IsSOPS reports whether data is a YAML document encrypted with sops, which
+// keeps its metadata under a top-level "sops" key.
+func IsSOPS(data []byte) bool {
+	var doc struct {
+		SOPS map[string]any `yaml:"sops"`
+	}
+	return yaml.Unmarshal(data, &doc) == nil && doc.SOPS["mac"] != nil
+}
+
+// DecryptSOPS decrypts the sops-encrypted YAML file at path.
+func DecryptSOPS(path string) ([]byte, error) {
+	return run("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path)
+}
+
+// run runs a decryption command and returns its output.
+func run(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%s is not installed: %w", name, err)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed: %s", name, msg)
+		}
+		return nil, fmt.Errorf("%s failed: %w", name, err)
+	}
+	return out, nil
+}
+
+// expandHome replaces a leading ~/ (or ~\ on Windows) in path with the home
+// directory.
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(filepath.ToSlash(path), "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// trimNewline removes the line ending files usually end with.
+func trimNewline(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
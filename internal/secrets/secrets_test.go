@@ -0,0 +1,74 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := os.WriteFile(path, []byte("from-file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OTUN_TEST_SECRET", "from-env")
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "no references", in: "plain-token", want: "plain-token"},
+		{name: "env", in: "${env:OTUN_TEST_SECRET}", want: "from-env"},
+		{name: "file", in: "${file:" + path + "}", want: "from-file"},
+		{name: "embedded", in: "a=${env:OTUN_TEST_SECRET},b=${file:" + path + "}", want: "a=from-env,b=from-file"},
+		{name: "escaped", in: "$${env:OTUN_TEST_SECRET}", want: "${env:OTUN_TEST_SECRET}"},
+		{name: "lone dollar", in: "$5 ${env:OTUN_TEST_SECRET}", want: "$5 from-env"},
+		{name: "unset variable", in: "${env:OTUN_TEST_UNSET}", wantErr: true},
+		{name: "missing file", in: "${file:" + filepath.Join(dir, "missing") + "}", wantErr: true},
+		{name: "unknown kind", in: "${vault:secret/otun}", wantErr: true},
+		{name: "no kind", in: "${OTUN_TEST_SECRET}", wantErr: true},
+		{name: "unterminated", in: "${env:OTUN_TEST_SECRET", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Expand(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Expand(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Expand("${vault:x}"); !errors.Is(err, ErrUnknownReference) {
+		t.Errorf("unknown kind error = %v, want %v", err, ErrUnknownReference)
+	}
+}
+
+func TestIsSOPS(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"encrypted", "token: ENC[AES256_GCM,data:abc]\nsops:\n  mac: ENC[AES256_GCM,data:def]\n  version: 3.9.0\n", true},
+		{"plain", "server: tunnel.example.com:4443\ntoken: key\n", false},
+		{"sops key without metadata", "sops: true\n", false},
+		{"empty", "", false},
+		{"not yaml", "token: [", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSOPS([]byte(tt.data)); got != tt.want {
+				t.Errorf("IsSOPS() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// abCookieMaxAge is how long a visitor stays in their A/B bucket.
+const abCookieMaxAge = 30 * 24 * time.Hour
+
+// abPolicy assigns a tunnel's visitors to A/B buckets.
+type abPolicy struct {
+	*protocol.ABTest
+}
+
+// newABPolicy returns the A/B test requested in msg, or nil if there is
+// none. The test must have passed Validate.
+func newABPolicy(msg *protocol.RegisterMessage) *abPolicy {
+	if msg.ABTest == nil {
+		return nil
+	}
+	return &abPolicy{ABTest: msg.ABTest}
+}
+
+// assign returns the bucket r belongs to: the one in its cookie if that is
+// still a bucket, otherwise a new one picked by the buckets' percentages.
+// isNew reports the latter.
+func (p *abPolicy) assign(r *http.Request) (bucket string, isNew bool) {
+	if c, err := r.Cookie(protocol.ABCookie); err == nil {
+		for _, b := range p.Buckets {
+			if b.Name == c.Value {
+				return b.Name, false
+			}
+		}
+	}
+	n := rand.IntN(100)
+	for _, b := range p.Buckets {
+		if n < b.Percent {
+			return b.Name, true
+		}
+		n -= b.Percent
+	}
+	return p.Buckets[len(p.Buckets)-1].Name, true
+}
+
+// apply tells the local service r's bucket in the ABHeader, replacing any
+// the visitor sent. A newly assigned bucket is also added to r's cookies,
+// so later requests on the connection can rely on the cookie alone, and
+// the Set-Cookie value to remember it by is returned ("" if there is none
+// to set).
+func (p *abPolicy) apply(r *http.Request) string {
+	if p == nil {
+		return ""
+	}
+	bucket, isNew := p.assign(r)
+	r.Header.Set(protocol.ABHeader, bucket)
+	if !isNew {
+		return ""
+	}
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != protocol.ABCookie { // a stale bucket
+			r.AddCookie(c)
+		}
+	}
+	r.AddCookie(&http.Cookie{Name: protocol.ABCookie, Value: bucket})
+	cookie := &http.Cookie{
+		Name:     protocol.ABCookie,
+		Value:    bucket,
+		Path:     "/",
+		MaxAge:   int(abCookieMaxAge / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie.String()
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func newTestABPolicy() *abPolicy {
+	return newABPolicy(&protocol.RegisterMessage{ABTest: &protocol.ABTest{Buckets: []protocol.ABBucket{
+		{Name: "a", Percent: 50}, {Name: "b", Percent: 50},
+	}}})
+}
+
+func TestABPolicyApply(t *testing.T) {
+	tests := []struct {
+		name       string
+		cookie     string
+		header     string
+		wantBucket string // "" = any
+		wantSet    bool
+	}{
+		{name: "new visitor", wantSet: true},
+		{name: "returning visitor", cookie: "b", wantBucket: "b"},
+		{name: "removed bucket", cookie: "c", wantSet: true},
+		{name: "spoofed header", cookie: "a", header: "b", wantBucket: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "session", Value: "xyz"})
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: protocol.ABCookie, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(protocol.ABHeader, tt.header)
+			}
+
+			setCookie := newTestABPolicy().apply(r)
+			bucket := r.Header.Get(protocol.ABHeader)
+			if (bucket != "a" && bucket != "b") || (tt.wantBucket != "" && bucket != tt.wantBucket) {
+				t.Errorf("bucket = %q, want %q", bucket, tt.wantBucket)
+			}
+			if (setCookie != "") != tt.wantSet {
+				t.Errorf("Set-Cookie = %q, want set %v", setCookie, tt.wantSet)
+			}
+			if c, err := r.Cookie(protocol.ABCookie); err != nil || c.Value != bucket {
+				t.Errorf("bucket cookie = %v, %v; want %q", c, err, bucket)
+			}
+			if c, err := r.Cookie("session"); err != nil || c.Value != "xyz" {
+				t.Errorf("other cookies lost: %q", r.Header.Get("Cookie"))
+			}
+		})
+	}
+}
+
+func TestABPolicyAssignment(t *testing.T) {
+	p := newABPolicy(&protocol.RegisterMessage{ABTest: &protocol.ABTest{Buckets: []protocol.ABBucket{
+		{Name: "control", Percent: 90}, {Name: "variant", Percent: 10},
+	}}})
+
+	counts := map[string]int{}
+	for range 10000 {
+		bucket, isNew := p.assign(httptest.NewRequest("GET", "/", nil))
+		if !isNew {
+			t.Fatal("visitor without a cookie kept a bucket")
+		}
+		counts[bucket]++
+	}
+	if n := counts["variant"]; n < 800 || n > 1200 {
+		t.Errorf("variant got %d of 10000 visitors, want about 1000", n)
+	}
+}
+
+func TestABTestSetsCookie(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	s.clients["demo"].ab = newTestABPolicy()
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Host = "demo.localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Set-Cookie"); !strings.HasPrefix(got, protocol.ABCookie+"=") {
+		t.Errorf("Set-Cookie = %q, want an %s cookie", got, protocol.ABCookie)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// webhookTimeout bounds each webhook delivery.
+const webhookTimeout = 10 * time.Second
+
+// takedownPage is served in place of a blocked tunnel.
+const takedownPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Tunnel disabled</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto;">
+<h1>This tunnel has been disabled</h1>
+<p>The content at this address was reported and removed for violating the
+server's terms of use. If you were sent here by a link asking for passwords or
+payment details, do not enter them.</p>
+</body>
+</html>
+`
+
+// blockInfo records why a subdomain was taken down.
+type blockInfo struct {
+	Reason    string    `json:"reason"`
+	BlockedAt time.Time `json:"blocked_at"`
+	By        string    `json:"by"`
+}
+
+// blockRequest is the body of a block request.
+type blockRequest struct {
+	Reason string `json:"reason"`
+}
+
+// webhookRequest is the body of a webhook registration.
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+// webhookEvent is posted to a token's webhook.
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	Subdomain string    `json:"subdomain"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"time"`
+
+	// RemoteAddr is the visitor that touched a honeytoken
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Labels of the tunnel's client, if it was connected
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// isBlocked returns why subdomain was blocked, or nil if it isn't.
+func (s *Server) isBlocked(subdomain string) *blockInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.blocked[subdomain]
+}
+
+// serveTakedown answers a request for a blocked tunnel.
+func serveTakedown(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, takedownPage)
+}
+
+func (s *Server) handleBlockTunnel(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || !caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "admin key required")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	var req blockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Reason == "" {
+		writeJSONError(w, http.StatusBadRequest, "a reason is required")
+		return
+	}
+
+	block := &blockInfo{Reason: req.Reason, BlockedAt: time.Now().UTC(), By: caller.id()}
+	s.mu.Lock()
+	s.blocked[subdomain] = block
+	client := s.clients[subdomain]
+	var owner string
+	if o := s.owners[subdomain]; o != nil {
+		owner = o.owner
+	} else if client != nil {
+		owner = client.token
+	}
+	webhook := s.webhooks[owner]
+	var labels map[string]string
+	if client != nil {
+		labels = client.labels
+		client.closeReason = "blocked: " + req.Reason
+	}
+	s.mu.Unlock()
+
+	if client != nil {
+		client.controlStream.SendErrorCode(protocol.ErrCodeTunnelBlocked, "tunnel blocked by the server operator: "+req.Reason)
+		client.session.Close()
+	}
+
+	slog.Warn("tunnel blocked", "subdomain", subdomain, "reason", req.Reason)
+	s.history.record(subdomain, tunnelEvent{Time: block.BlockedAt, Type: eventBlocked, Reason: req.Reason})
+	s.audit("tunnel blocked", "subdomain", subdomain, "reason", req.Reason, "token_id", tokenID(owner), "by", caller.id())
+	if webhook != "" {
+		go s.deliverWebhook(webhook, webhookEvent{
+			Event:     "tunnel.blocked",
+			Subdomain: subdomain,
+			Reason:    req.Reason,
+			Time:      block.BlockedAt,
+			Labels:    labels,
+		})
+	}
+	writeJSON(w, http.StatusOK, block)
+}
+
+func (s *Server) handleUnblockTunnel(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || !caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "admin key required")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	s.mu.Lock()
+	_, found := s.blocked[subdomain]
+	delete(s.blocked, subdomain)
+	s.mu.Unlock()
+
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "tunnel is not blocked")
+		return
+	}
+
+	slog.Info("tunnel unblocked", "subdomain", subdomain)
+	s.history.record(subdomain, tunnelEvent{Type: eventUnblocked})
+	s.audit("tunnel unblocked", "subdomain", subdomain, "by", caller.id())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "a client API key is required")
+		return
+	}
+
+	s.mu.RLock()
+	u := s.webhooks[caller.token]
+	s.mu.RUnlock()
+
+	if u == "" {
+		writeJSONError(w, http.StatusNotFound, "no webhook set")
+		return
+	}
+	writeJSON(w, http.StatusOK, webhookRequest{URL: u})
+}
+
+func (s *Server) handleSetWebhook(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "a client API key is required")
+		return
+	}
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		writeJSONError(w, http.StatusBadRequest, "url must be an http or https URL")
+		return
+	}
+
+	s.mu.Lock()
+	s.webhooks[caller.token] = req.URL
+	s.mu.Unlock()
+
+	s.audit("webhook set", "token_id", caller.id())
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "a client API key is required")
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.webhooks, caller.token)
+	s.mu.Unlock()
+
+	s.audit("webhook removed", "token_id", caller.id())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deliverWebhook posts event to url, logging rather than retrying failures.
+func (s *Server) deliverWebhook(url string, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("webhook delivery failed", "event", event.Event, "subdomain", event.Subdomain, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("webhook delivery failed", "event", event.Event, "subdomain", event.Subdomain, "status", resp.StatusCode)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+func TestBlockTunnel(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	session := registerTestTunnel(t, s, "demo")
+	go serveTunnelStreams(session, okResponse)
+
+	// The block notice is sent on the control stream
+	notice := make(chan any, 1)
+	serverEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	s.lookupClient("demo").controlStream = protocol.NewControlStream(serverEnd)
+	go func() {
+		msg, _ := protocol.NewControlStream(clientEnd).ReadMessage()
+		notice <- msg
+	}()
+
+	events := make(chan webhookEvent, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e webhookEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer hook.Close()
+
+	if rec := adminRequest(t, h, "PUT", "/api/webhook", "owner-key", `{"url": "`+hook.URL+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("set webhook: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, h, "PUT", "/api/webhook", "owner-key", `{"url": "ftp://example.com"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("set invalid webhook: status %d, want 400", rec.Code)
+	}
+
+	// Only the admin key may block
+	if rec := adminRequest(t, h, "POST", "/api/tunnels/demo/block", "owner-key", `{"reason": "x"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("block by client key: status %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, h, "POST", "/api/tunnels/demo/block", "root-key", `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("block without reason: status %d, want 400", rec.Code)
+	}
+	if rec := adminRequest(t, h, "POST", "/api/tunnels/demo/block", "root-key", `{"reason": "phishing"}`); rec.Code != http.StatusOK {
+		t.Fatalf("block: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if msg, ok := (<-notice).(*protocol.ErrorMessage); !ok || msg.Code != protocol.ErrCodeTunnelBlocked {
+		t.Errorf("block notice = %+v", msg)
+	}
+	waitFor(t, 2*time.Second, func() bool { return session.IsClosed() })
+
+	select {
+	case e := <-events:
+		if e.Event != "tunnel.blocked" || e.Subdomain != "demo" || e.Reason != "phishing" {
+			t.Errorf("webhook event = %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("webhook not delivered")
+	}
+
+	// Visitors get the takedown page
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "http://demo.localhost/login", nil))
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "has been disabled") {
+		t.Errorf("blocked tunnel served %d: %s", rec.Code, rec.Body)
+	}
+
+	// The block shows in the admin API
+	var info tunnelInfo
+	json.Unmarshal(adminRequest(t, h, "GET", "/api/tunnels/demo", "root-key", "").Body.Bytes(), &info)
+	if info.Blocked == nil || info.Blocked.Reason != "phishing" {
+		t.Errorf("tunnel info = %+v", info)
+	}
+
+	// The subdomain can't be registered again
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+	clientSession, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	defer clientSession.Close()
+	stream, _ := clientSession.OpenStream()
+	cs := protocol.NewControlStream(stream)
+	cs.SendRegisterMessage(&protocol.RegisterMessage{Subdomain: "demo", Token: "owner-key"})
+	msg, err := cs.ReadMessage()
+	if errMsg, ok := msg.(*protocol.ErrorMessage); !ok || errMsg.Code != protocol.ErrCodeTunnelBlocked {
+		t.Errorf("re-registration reply = %+v, %v", msg, err)
+	}
+
+	if rec := adminRequest(t, h, "DELETE", "/api/tunnels/demo/block", "root-key", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("unblock: status %d, want 204", rec.Code)
+	}
+	if s.isBlocked("demo") != nil {
+		t.Error("still blocked after unblock")
+	}
+}
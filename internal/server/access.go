@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"net/http"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// accessPolicy restricts a private tunnel to visitors presenting its shared
+// secret or a client certificate signed by one of its CAs.
+type accessPolicy struct {
+	secret    string
+	clientCAs *x509.CertPool
+}
+
+// newAccessPolicy returns the policy requested in msg, or nil for a public
+// tunnel. msg must have passed protocol.ValidateAccess.
+func newAccessPolicy(msg *protocol.RegisterMessage) *accessPolicy {
+	if msg.AccessSecret == "" && msg.ClientCA == "" {
+		return nil
+	}
+	p := &accessPolicy{secret: msg.AccessSecret}
+	if msg.ClientCA != "" {
+		p.clientCAs, _ = protocol.ParseClientCA(msg.ClientCA)
+	}
+	return p
+}
+
+// allows reports whether r may visit the tunnel. cert is the visitor's
+// verified client certificate if that's what let them in.
+func (p *accessPolicy) allows(r *http.Request) (cert *x509.Certificate, ok bool) {
+	if p.secret != "" {
+		for _, v := range r.Header.Values(protocol.AccessHeader) {
+			if subtle.ConstantTimeCompare([]byte(v), []byte(p.secret)) == 1 {
+				return nil, true
+			}
+		}
+	}
+	if p.clientCAs != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		// Verified here rather than in the handshake, as the CAs belong
+		// to the tunnel the request is for, not the one named by SNI
+		opts := x509.VerifyOptions{
+			Roots:         p.clientCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := r.TLS.PeerCertificates[0].Verify(opts); err == nil {
+			return r.TLS.PeerCertificates[0], true
+		}
+	}
+	return nil, false
+}
+
+// checksEachRequest reports whether the edge checks on client's requests
+// look at each request rather than only at the visitor's connection, so a
+// kept-alive connection must not carry a second request past them.
+func (s *Server) checksEachRequest(client *tunnelClient) bool {
+	return s.visitors != nil || s.maxHeaderBytes > 0 || s.maxHeaderCount > 0 || s.filtersEachRequest(client)
+}
+
+// filtersEachRequest reports whether a request to client must pass content
+// scanning or one of the tunnel's own policies before reaching it. A raw
+// stream, such as one from otun forward, would skip them.
+func (s *Server) filtersEachRequest(client *tunnelClient) bool {
+	return s.scanner != nil || client.access != nil || client.honeytokens != nil || client.challenge != nil ||
+		client.jwt != nil || client.signature != nil || client.replay != nil
+}
+
+// checkAccess answers 403 and reports false if client is private and r
+// doesn't satisfy its policy. The access header is removed either way so it
+// never reaches the local service, and the identity of a visitor who
+// presented a client certificate is forwarded in its place. Tunnels that
+// accept client certificates answer requests for their JWKS themselves.
+func (s *Server) checkAccess(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	if client.access != nil && client.access.clientCAs != nil && r.URL.Path == protocol.JWKSPath {
+		s.identity.serveJWKS(w)
+		return false
+	}
+	var cert *x509.Certificate
+	allowed := client.access == nil
+	if !allowed {
+		cert, allowed = client.access.allows(r)
+	}
+	r.Header.Del(protocol.AccessHeader)
+	s.forwardIdentity(r, client, cert)
+	if allowed {
+		return true
+	}
+	s.metrics.privateDenied.Inc()
+	slog.Debug("private tunnel visitor denied", "subdomain", client.subdomain, "remote_addr", r.RemoteAddr)
+	s.httpError(w, r, "This tunnel is private", http.StatusForbidden)
+	return false
+}
+
+// requestClientCerts makes handshakes for tunnels that accept client
+// certificates ask for one, without prompting visitors of other tunnels.
+func (s *Server) requestClientCerts(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		client := s.lookupClient(s.subdomainForHost(hello.ServerName))
+		if client == nil || client.access == nil || client.access.clientCAs == nil {
+			return nil, nil
+		}
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = tls.RequestClientCert
+		return cfg, nil
+	}
+}
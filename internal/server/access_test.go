@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// newTestCA returns a CA certificate, its PEM encoding, and a signer for
+// client certificates.
+func newTestCA(t *testing.T) (string, func(usage x509.ExtKeyUsage) *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	issue := func(usage x509.ExtKeyUsage) *x509.Certificate {
+		leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "visitor"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &leafKey.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), issue
+}
+
+func TestAccessPolicyClientCert(t *testing.T) {
+	caPEM, issue := newTestCA(t)
+	_, otherIssue := newTestCA(t)
+	p := newAccessPolicy(&protocol.RegisterMessage{ClientCA: caPEM})
+
+	tests := []struct {
+		name  string
+		certs []*x509.Certificate
+		want  bool
+	}{
+		{name: "no certificate"},
+		{name: "signed by the CA", certs: []*x509.Certificate{issue(x509.ExtKeyUsageClientAuth)}, want: true},
+		{name: "server certificate", certs: []*x509.Certificate{issue(x509.ExtKeyUsageServerAuth)}},
+		{name: "other CA", certs: []*x509.Certificate{otherIssue(x509.ExtKeyUsageClientAuth)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://private.example.com/", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: tt.certs}
+			if _, got := p.allows(r); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// serveAccessHeaders answers every stream with whether the request carried
+// the access header.
+func serveAccessHeaders(session transport.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			req, err := http.ReadRequest(bufio.NewReader(stream))
+			if err != nil {
+				return
+			}
+			body := "absent"
+			if req.Header.Get(protocol.AccessHeader) != "" {
+				body = "present"
+			}
+			fmt.Fprintf(stream, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}()
+	}
+}
+
+func TestPrivateTunnelSecret(t *testing.T) {
+	const secret = "0123456789abcdef"
+	s := New("", "", "", "", "", nil)
+	go serveAccessHeaders(registerTestTunnel(t, s, "private"))
+	s.clients["private"].access = newAccessPolicy(&protocol.RegisterMessage{AccessSecret: secret})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "no secret", want: http.StatusForbidden},
+		{name: "wrong secret", header: "not-the-secret!!", want: http.StatusForbidden},
+		{name: "secret", header: secret, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			req.Host = "private.localhost"
+			if tt.header != "" {
+				req.Header.Set(protocol.AccessHeader, tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if resp.StatusCode == http.StatusOK && string(body) != "absent" {
+				t.Error("access header was forwarded to the local service")
+			}
+		})
+	}
+	if got := s.metrics.privateDenied.Value(); got != 2 {
+		t.Errorf("denied = %d, want 2", got)
+	}
+}
+
+// serveKeepAlive answers every request on each stream until the visitor asks
+// to close it, like a local service honouring keep-alive.
+func serveKeepAlive(session transport.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			reader := bufio.NewReader(stream)
+			for {
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, req.Body)
+				io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				if req.Close {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// keepAliveForwards sends first and then second over one connection to the
+// server at addr, and reports whether second was forwarded rather than the
+// connection being closed after first.
+func keepAliveForwards(t *testing.T, addr, first, second string) bool {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	io.WriteString(conn, first)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("first response: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first response = %d, want 200", resp.StatusCode)
+	}
+	io.WriteString(conn, second)
+	resp, err = http.ReadResponse(reader, nil)
+	return err == nil && resp.StatusCode == http.StatusOK
+}
+
+func TestPrivateTunnelKeepAlive(t *testing.T) {
+	const secret = "0123456789abcdef"
+	s := New("", "", "", "", "", nil)
+	go serveKeepAlive(registerTestTunnel(t, s, "private"))
+	s.clients["private"].access = newAccessPolicy(&protocol.RegisterMessage{AccessSecret: secret})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		pipelined bool // send the second request before reading the first response
+	}{
+		{name: "sequential"},
+		{name: "pipelined", pipelined: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			allowed := "GET / HTTP/1.1\r\nHost: private.localhost\r\n" + protocol.AccessHeader + ": " + secret + "\r\n\r\n"
+			denied := "GET / HTTP/1.1\r\nHost: private.localhost\r\n\r\n"
+			if tt.pipelined {
+				io.WriteString(conn, allowed+denied)
+			} else {
+				io.WriteString(conn, allowed)
+			}
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("first response: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			if resp.StatusCode != http.StatusOK || !resp.Close {
+				t.Fatalf("first response = %d, close %v; want 200 closing the connection", resp.StatusCode, resp.Close)
+			}
+
+			// The request without the secret never reaches the local service
+			if !tt.pipelined {
+				io.WriteString(conn, denied)
+			}
+			if resp, err := http.ReadResponse(reader, nil); err == nil && resp.StatusCode == http.StatusOK {
+				t.Error("second request on the kept-alive connection skipped the access check")
+			}
+		})
+	}
+}
+
+func TestPrivateTunnelUpgradeRefused(t *testing.T) {
+	const secret = "0123456789abcdef"
+	s := New("", "", "", "", "", nil)
+	go serveKeepAlive(registerTestTunnel(t, s, "private"))
+	s.clients["private"].access = newAccessPolicy(&protocol.RegisterMessage{AccessSecret: secret})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// Claiming an upgrade the local service doesn't make keeps the
+	// connection open, but nothing more reaches the local service
+	upgrade := "GET / HTTP/1.1\r\nHost: private.localhost\r\nConnection: Upgrade\r\nUpgrade: x\r\n" + protocol.AccessHeader + ": " + secret + "\r\n\r\n"
+	denied := "GET / HTTP/1.1\r\nHost: private.localhost\r\n\r\n"
+	if keepAliveForwards(t, ts.Listener.Addr().String(), upgrade, denied) {
+		t.Error("request after a refused upgrade skipped the access check")
+	}
+}
+
+func TestRequestClientCertsOnlyForPrivateTunnels(t *testing.T) {
+	caPEM, _ := newTestCA(t)
+	s := New("", "", "", "example.com", "", nil)
+	registerTestTunnel(t, s, "public")
+	registerTestTunnel(t, s, "private")
+	s.clients["private"].access = newAccessPolicy(&protocol.RegisterMessage{ClientCA: caPEM})
+
+	get := s.configureTLS(&tls.Config{}).GetConfigForClient
+	if cfg, _ := get(&tls.ClientHelloInfo{ServerName: "public.example.com"}); cfg != nil {
+		t.Error("public tunnel asks for a client certificate")
+	}
+	cfg, _ := get(&tls.ClientHelloInfo{ServerName: "private.example.com"})
+	if cfg == nil || cfg.ClientAuth != tls.RequestClientCert {
+		t.Errorf("private tunnel config = %+v, want RequestClientCert", cfg)
+	}
+}
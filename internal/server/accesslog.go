@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bc183/otun/internal/logsink"
+)
+
+// WithLogSinks ships access and audit logs to sinks in batches. Entries are
+// dropped (and counted) rather than slowing requests when sinks fall behind.
+func (s *Server) WithLogSinks(sinks []logsink.Sink, config logsink.ShipperConfig) *Server {
+	if len(sinks) == 0 {
+		return s
+	}
+	s.shipper = logsink.NewShipper(sinks, config)
+	s.metrics.registry.NewCounterFunc("otun_log_entries_dropped_total",
+		"Access and audit log entries dropped because the shipping buffer was full.",
+		func() float64 { return float64(s.shipper.Dropped()) })
+	s.metrics.registry.NewCounterFunc("otun_log_batches_failed_total",
+		"Log batches a sink failed to write.",
+		func() float64 { return float64(s.shipper.Failed()) })
+	s.metrics.registry.NewCounterFunc("otun_log_entries_lost_total",
+		"Log entries in batches a sink failed to write, once per failing sink.",
+		func() float64 { return float64(s.shipper.Lost()) })
+	return s
+}
+
+// recordsEachRequest reports whether requests are logged, captured or
+// counted one by one. Visitor connections are then closed after each
+// response, so a kept-alive connection can't fold later requests into the
+// first one's record.
+func (s *Server) recordsEachRequest() bool {
+	return s.shipper != nil || s.capture != nil || s.requestDB != nil || s.stats != nil
+}
+
+// audit records an audit event (registrations, takeovers, grant changes).
+// fields are alternating keys and values, as with slog.
+func (s *Server) audit(msg string, fields ...any) {
+	if s.shipper == nil {
+		return
+	}
+	s.shipper.Log(logsink.Entry{
+		Time:    time.Now(),
+		Stream:  logsink.StreamAudit,
+		Message: msg,
+		Fields:  fieldMap(fields),
+	})
+}
+
+// logAccess records a completed request. status is 0 if the response
+// status could not be determined.
+func (s *Server) logAccess(r *http.Request, subdomain string, status int, start time.Time) {
+	fields := map[string]any{
+		"subdomain":   subdomain,
+		"host":        r.Host,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"proto":       r.Proto,
+		"remote_addr": r.RemoteAddr,
+		"user_agent":  r.UserAgent(),
+		"duration_ms": time.Since(start).Milliseconds(),
+	}
+	if status != 0 {
+		fields["status"] = status
+	}
+	s.shipper.Log(logsink.Entry{
+		Time:    start,
+		Stream:  logsink.StreamAccess,
+		Message: "request",
+		Fields:  fields,
+	})
+}
+
+// fieldMap converts alternating keys and values to a map.
+func fieldMap(kv []any) map[string]any {
+	m := make(map[string]any, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if key, ok := kv[i].(string); ok {
+			m[key] = kv[i+1]
+		}
+	}
+	return m
+}
+
+// statusRecorder captures the status code written through a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+
+	// onStatus, if set, is called with the status before it is written
+	onStatus func(status int)
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 && !isInterim(code) {
+		w.record(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.record(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// record sets the status and reports it to onStatus.
+func (w *statusRecorder) record(status int) {
+	w.status = status
+	if w.onStatus != nil {
+		w.onStatus(status)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusLineLen is the length of "HTTP/1.1 200", enough to read a status code.
+const statusLineLen = 12
+
+// statusConn records the status code of the first final response read from
+// a raw upstream connection, skipping interim (1xx) responses.
+type statusConn struct {
+	net.Conn
+	head    []byte
+	status  int
+	done    bool
+	interim bool   // inside an interim response head
+	tail    uint32 // last four bytes, to find the end of an interim head
+
+	// onStatus, if set, is called with the status as soon as it is read,
+	// before the response is passed on
+	onStatus func(status int)
+}
+
+func (c *statusConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, ch := range b[:n] {
+		if c.done {
+			break
+		}
+		if c.interim {
+			c.tail = c.tail<<8 | uint32(ch)
+			if c.tail == 0x0d0a0d0a { // "\r\n\r\n"
+				c.interim = false
+				c.head = c.head[:0]
+			}
+			continue
+		}
+		c.head = append(c.head, ch)
+		if len(c.head) == statusLineLen {
+			status, _ := strconv.Atoi(string(c.head[9:12]))
+			if isInterim(status) {
+				c.interim = true
+				c.tail = 0
+				continue
+			}
+			c.status = status
+			c.done = true
+			if c.onStatus != nil {
+				c.onStatus(status)
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/logsink"
+)
+
+// memSink collects shipped entries in memory.
+type memSink struct {
+	mu      sync.Mutex
+	entries []logsink.Entry
+}
+
+func (m *memSink) Name() string { return "memory" }
+
+func (m *memSink) Write(_ context.Context, batch []logsink.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, batch...)
+	return nil
+}
+
+func (m *memSink) stream(name string) []logsink.Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []logsink.Entry
+	for _, e := range m.entries {
+		if e.Stream == name {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestAccessLogStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		subdomain  string
+		hijack     bool // serve over a real connection so the request is hijacked
+		wantStatus int
+	}{
+		{name: "round trip", subdomain: "app", wantStatus: http.StatusOK},
+		{name: "hijacked", subdomain: "app", hijack: true, wantStatus: http.StatusOK},
+		{name: "unknown tunnel", subdomain: "missing", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &memSink{}
+			config := logsink.ShipperConfig{BufferSize: 10, BatchSize: 10, FlushInterval: 10 * time.Millisecond, WriteTimeout: time.Second}
+			s := New("", "", "", "", "", nil).WithLogSinks([]logsink.Sink{sink}, config)
+			go serveTunnelStreams(registerTestTunnel(t, s, "app"), okResponse)
+
+			url := "http://" + tt.subdomain + ".localhost/path"
+			if tt.hijack {
+				ts := httptest.NewServer(s)
+				defer ts.Close()
+				req, _ := http.NewRequest("GET", ts.URL+"/path", nil)
+				req.Host = tt.subdomain + ".localhost"
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				resp.Body.Close()
+				ts.CloseClientConnections()
+			} else {
+				s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+			}
+
+			// The hijacked handler logs once the proxy finishes
+			waitFor(t, 2*time.Second, func() bool {
+				return len(sink.stream(logsink.StreamAccess)) > 0
+			})
+			s.shipper.Close()
+			entries := sink.stream(logsink.StreamAccess)
+			if len(entries) != 1 {
+				t.Fatalf("got %d access entries, want 1", len(entries))
+			}
+			fields := entries[0].Fields
+			if fields["status"] != tt.wantStatus {
+				t.Errorf("status = %v, want %d", fields["status"], tt.wantStatus)
+			}
+			if fields["subdomain"] != tt.subdomain || fields["path"] != "/path" || fields["method"] != "GET" {
+				t.Errorf("unexpected fields: %v", fields)
+			}
+		})
+	}
+}
+
+func TestAccessLogKeepAlive(t *testing.T) {
+	sink := &memSink{}
+	config := logsink.ShipperConfig{BufferSize: 10, BatchSize: 10, FlushInterval: 10 * time.Millisecond, WriteTimeout: time.Second}
+	s := New("", "", "", "", "", nil).WithLogSinks([]logsink.Sink{sink}, config)
+	go serveKeepAlive(registerTestTunnel(t, s, "app"))
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// The client reuses its connection unless the server closes it
+	for _, path := range []string{"/first", "/second"} {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Host = "app.localhost"
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("request %s failed: %v", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return len(sink.stream(logsink.StreamAccess)) >= 2
+	})
+	s.shipper.Close()
+	entries := sink.stream(logsink.StreamAccess)
+	if len(entries) != 2 {
+		t.Fatalf("got %d access entries, want 2", len(entries))
+	}
+	for i, want := range []string{"/first", "/second"} {
+		if got := entries[i].Fields["path"]; got != want {
+			t.Errorf("entry %d path = %v, want %s", i, got, want)
+		}
+	}
+}
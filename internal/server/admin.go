@@ -0,0 +1,338 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tunnelInfo is the admin API representation of a tunnel.
+type tunnelInfo struct {
+	Subdomain     string     `json:"subdomain"`
+	URL           string     `json:"url"`
+	Online        bool       `json:"online"`
+	RemoteAddr    string     `json:"remote_addr,omitempty"`
+	ConnectedAt   *time.Time `json:"connected_at,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+	OwnerID       string     `json:"owner_id,omitempty"`
+	Blocked       *blockInfo `json:"blocked,omitempty"`
+
+	// Labels attached by the connected client
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Private is set if the connected client requires a secret or client
+	// certificate from visitors
+	Private bool `json:"private,omitempty"`
+
+	// Group is the group whose policies the connected tunnel is held to
+	Group string `json:"group,omitempty"`
+
+	// Canary is the traffic split with a canary client, if any
+	Canary *canaryInfo `json:"canary,omitempty"`
+}
+
+// grantInfo is the admin API representation of a grant.
+type grantInfo struct {
+	TokenID string   `json:"token_id"`
+	Rights  []string `json:"rights"`
+}
+
+// grantRequest is the body of a grant creation request.
+type grantRequest struct {
+	Token  string   `json:"token"`
+	Rights []string `json:"rights"`
+}
+
+// adminCaller identifies the client of an admin API request.
+type adminCaller struct {
+	token string
+	admin bool
+}
+
+// id identifies the caller in audit logs without revealing its key.
+func (c adminCaller) id() string {
+	if c.admin {
+		return "admin"
+	}
+	return tokenID(c.token)
+}
+
+// adminHandler returns the admin API handler.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tunnels", s.handleListTunnels)
+	mux.HandleFunc("GET /api/tunnels/{subdomain}", s.handleGetTunnel)
+	mux.HandleFunc("GET /api/tunnels/{subdomain}/events", s.handleTunnelEvents)
+	mux.HandleFunc("GET /api/tunnels/{subdomain}/requests", s.handleTunnelRequests)
+	mux.HandleFunc("GET /api/tunnels/{subdomain}/stats", s.handleTunnelStats)
+	mux.HandleFunc("GET /api/tunnels/{subdomain}/grants", s.handleListGrants)
+	mux.HandleFunc("POST /api/tunnels/{subdomain}/grants", s.handleCreateGrant)
+	mux.HandleFunc("DELETE /api/tunnels/{subdomain}/grants/{tokenID}", s.handleDeleteGrant)
+	mux.HandleFunc("POST /api/tunnels/{subdomain}/block", s.handleBlockTunnel)
+	mux.HandleFunc("DELETE /api/tunnels/{subdomain}/block", s.handleUnblockTunnel)
+	mux.HandleFunc("DELETE /api/tunnels/{subdomain}/owner-key", s.handleDeleteOwnerKey)
+	mux.HandleFunc("PUT /api/tunnels/{subdomain}/split", s.handleSetSplit)
+	mux.HandleFunc("GET /api/tokens/{tokenID}", s.handleIntrospectToken)
+	mux.HandleFunc("GET /api/domains", s.handleListDomains)
+	mux.HandleFunc("POST /api/domains", s.handleAddDomain)
+	mux.HandleFunc("GET /api/domains/{domain}", s.handleGetDomain)
+	mux.HandleFunc("POST /api/domains/{domain}/verify", s.handleVerifyDomain)
+	mux.HandleFunc("DELETE /api/domains/{domain}", s.handleDeleteDomain)
+	mux.HandleFunc("GET /api/webhook", s.handleGetWebhook)
+	mux.HandleFunc("PUT /api/webhook", s.handleSetWebhook)
+	mux.HandleFunc("DELETE /api/webhook", s.handleDeleteWebhook)
+	mux.HandleFunc("GET /api/chaos", s.handleGetChaos)
+	mux.HandleFunc("PUT /api/chaos", s.handleSetChaos)
+	mux.HandleFunc("DELETE /api/chaos", s.handleResetChaos)
+	mux.HandleFunc("POST /api/chaos/kill", s.handleChaosKill)
+	return mux
+}
+
+// serveAdmin serves the admin API on addr.
+func (s *Server) serveAdmin(addr string) {
+	slog.Info("admin API started", "addr", addr)
+	if err := http.ListenAndServe(addr, s.adminHandler()); err != nil {
+		slog.Error("admin API error", "error", err)
+	}
+}
+
+// authenticateAdmin identifies the caller from the bearer token. Client API
+// keys are only accepted when authentication is enabled.
+func (s *Server) authenticateAdmin(r *http.Request) (adminCaller, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return adminCaller{}, false
+	}
+	if s.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminKey)) == 1 {
+		return adminCaller{token: token, admin: true}, true
+	}
+	if s.authRequired() && s.validateToken(token) {
+		return adminCaller{token: token}, true
+	}
+	return adminCaller{}, false
+}
+
+// canInspect reports whether the caller may view subdomain.
+// Must be called with s.mu held.
+func (s *Server) canInspect(c adminCaller, subdomain string) bool {
+	return c.admin ||
+		s.hasRight(subdomain, c.token, RightInspect) ||
+		s.hasRight(subdomain, c.token, RightPublish)
+}
+
+// canManage reports whether the caller may change grants on subdomain.
+// Must be called with s.mu held.
+func (s *Server) canManage(c adminCaller, subdomain string) bool {
+	if c.admin {
+		return true
+	}
+	o := s.owners[subdomain]
+	return o != nil && o.owner == c.token
+}
+
+// tunnelInfoLocked builds the API view of subdomain. Must be called with s.mu held.
+func (s *Server) tunnelInfoLocked(subdomain string) tunnelInfo {
+	info := tunnelInfo{
+		Subdomain: subdomain,
+		URL:       s.tunnelURL(subdomain),
+	}
+	if client := s.clients[subdomain]; client != nil {
+		connectedAt, lastHeartbeat := client.connectedAt, client.lastHeartbeat
+		info.Online = true
+		info.RemoteAddr = client.remoteAddr
+		info.ConnectedAt = &connectedAt
+		info.LastHeartbeat = &lastHeartbeat
+		info.Labels = client.labels
+		info.Private = client.access != nil
+		info.Group = client.groupName()
+	}
+	if o := s.owners[subdomain]; o != nil {
+		info.OwnerID = tokenID(o.owner)
+	}
+	info.Blocked = s.blocked[subdomain]
+	info.Canary = s.canaryInfoLocked(subdomain)
+	return info
+}
+
+func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	filters, err := parseLabelFilters(r.URL.Query()["label"])
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	seen := make(map[string]struct{}, len(s.clients)+len(s.owners))
+	for subdomain := range s.clients {
+		seen[subdomain] = struct{}{}
+	}
+	for subdomain := range s.owners {
+		seen[subdomain] = struct{}{}
+	}
+	for subdomain := range s.blocked {
+		seen[subdomain] = struct{}{}
+	}
+	tunnels := make([]tunnelInfo, 0, len(seen))
+	for subdomain := range seen {
+		if !s.canInspect(caller, subdomain) {
+			continue
+		}
+		if info := s.tunnelInfoLocked(subdomain); filters.match(info.Labels) {
+			tunnels = append(tunnels, info)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Subdomain < tunnels[j].Subdomain })
+	if key := r.URL.Query().Get("group_by"); key != "" {
+		writeJSON(w, http.StatusOK, groupByLabel(tunnels, key))
+		return
+	}
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+func (s *Server) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	s.mu.RLock()
+	_, online := s.clients[subdomain]
+	_, owned := s.owners[subdomain]
+	_, blocked := s.blocked[subdomain]
+	allowed := s.canInspect(caller, subdomain)
+	info := s.tunnelInfoLocked(subdomain)
+	s.mu.RUnlock()
+
+	if (!online && !owned && !blocked) || !allowed {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) handleListGrants(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	s.mu.RLock()
+	o := s.owners[subdomain]
+	if o == nil || !s.canManage(caller, subdomain) {
+		s.mu.RUnlock()
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	grants := make([]grantInfo, 0, len(o.grants))
+	for token, rights := range o.grants {
+		grants = append(grants, grantInfo{TokenID: tokenID(token), Rights: rights})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(grants, func(i, j int) bool { return grants[i].TokenID < grants[j].TokenID })
+	writeJSON(w, http.StatusOK, grants)
+}
+
+func (s *Server) handleCreateGrant(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	var req grantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if !validRights(req.Rights) {
+		writeJSONError(w, http.StatusBadRequest, "rights must be a non-empty list of \"inspect\" and \"publish\"")
+		return
+	}
+	if req.Token == "" || !s.validateToken(req.Token) {
+		writeJSONError(w, http.StatusBadRequest, "token is not a valid API key")
+		return
+	}
+
+	s.mu.Lock()
+	o := s.owners[subdomain]
+	if o == nil || !s.canManage(caller, subdomain) {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	if req.Token == o.owner {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusBadRequest, "token already owns this tunnel")
+		return
+	}
+	o.grants[req.Token] = req.Rights
+	s.mu.Unlock()
+
+	slog.Info("tunnel access granted", "subdomain", subdomain, "token_id", tokenID(req.Token), "rights", req.Rights)
+	s.audit("tunnel access granted", "subdomain", subdomain, "token_id", tokenID(req.Token), "rights", req.Rights, "by", caller.id())
+	writeJSON(w, http.StatusOK, grantInfo{TokenID: tokenID(req.Token), Rights: req.Rights})
+}
+
+func (s *Server) handleDeleteGrant(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+	id := r.PathValue("tokenID")
+
+	s.mu.Lock()
+	o := s.owners[subdomain]
+	if o == nil || !s.canManage(caller, subdomain) {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	found := false
+	for token := range o.grants {
+		if tokenID(token) == id {
+			delete(o.grants, token)
+			found = true
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "grant not found")
+		return
+	}
+
+	slog.Info("tunnel access revoked", "subdomain", subdomain, "token_id", id)
+	s.audit("tunnel access revoked", "subdomain", subdomain, "token_id", id, "by", caller.id())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an error response in the admin API's format.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest performs an admin API request authenticated with token.
+func adminRequest(t *testing.T, h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// newSharingTestServer creates a server where "owner-key" owns the "demo" subdomain.
+func newSharingTestServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	s := New("", "", ":8080", "", "", []string{"owner-key", "team-key", "other-key"}).
+		WithAdmin("", "root-key")
+
+	s.mu.Lock()
+	if err := s.claimSubdomain("demo", "owner-key"); err != nil {
+		t.Fatalf("claimSubdomain() error = %v", err)
+	}
+	s.mu.Unlock()
+
+	return s, s.adminHandler()
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	_, h := newSharingTestServer(t)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"unknown token", "nope", http.StatusUnauthorized},
+		{"client API key", "owner-key", http.StatusOK},
+		{"admin key", "root-key", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(t, h, "GET", "/api/tunnels", tt.token, "")
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTunnelSharing(t *testing.T) {
+	s, h := newSharingTestServer(t)
+
+	// Strangers can't see the tunnel
+	if rec := adminRequest(t, h, "GET", "/api/tunnels/demo", "team-key", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("teammate before grant: status = %d, want 404", rec.Code)
+	}
+
+	// Owner grants inspect rights
+	rec := adminRequest(t, h, "POST", "/api/tunnels/demo/grants", "owner-key",
+		`{"token": "team-key", "rights": ["inspect"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create grant: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var grant grantInfo
+	json.NewDecoder(rec.Body).Decode(&grant)
+	if grant.TokenID != tokenID("team-key") {
+		t.Errorf("grant token_id = %q, want %q", grant.TokenID, tokenID("team-key"))
+	}
+	if strings.Contains(rec.Body.String(), "team-key") {
+		t.Error("grant response leaked the raw token")
+	}
+
+	// Teammate can now inspect, but not manage grants
+	if rec := adminRequest(t, h, "GET", "/api/tunnels/demo", "team-key", ""); rec.Code != http.StatusOK {
+		t.Errorf("teammate inspect: status = %d, want 200", rec.Code)
+	}
+	if rec := adminRequest(t, h, "GET", "/api/tunnels/demo/grants", "team-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("teammate list grants: status = %d, want 404", rec.Code)
+	}
+
+	var tunnels []tunnelInfo
+	json.NewDecoder(adminRequest(t, h, "GET", "/api/tunnels", "team-key", "").Body).Decode(&tunnels)
+	if len(tunnels) != 1 || tunnels[0].Subdomain != "demo" || tunnels[0].Online {
+		t.Errorf("teammate tunnel list = %+v, want offline demo", tunnels)
+	}
+
+	// Inspect rights don't allow publishing
+	s.mu.Lock()
+	err := s.claimSubdomain("demo", "team-key")
+	s.mu.Unlock()
+	if err == nil {
+		t.Error("teammate with inspect rights could claim subdomain")
+	}
+
+	// Upgrade to publish rights
+	rec = adminRequest(t, h, "POST", "/api/tunnels/demo/grants", "owner-key",
+		`{"token": "team-key", "rights": ["inspect", "publish"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update grant: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	s.mu.Lock()
+	err = s.claimSubdomain("demo", "team-key")
+	s.mu.Unlock()
+	if err != nil {
+		t.Errorf("teammate with publish rights could not claim subdomain: %v", err)
+	}
+
+	// Revoke
+	rec = adminRequest(t, h, "DELETE", "/api/tunnels/demo/grants/"+tokenID("team-key"), "owner-key", "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete grant: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, h, "GET", "/api/tunnels/demo", "team-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("teammate after revoke: status = %d, want 404", rec.Code)
+	}
+	if rec := adminRequest(t, h, "DELETE", "/api/tunnels/demo/grants/"+tokenID("team-key"), "owner-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("delete missing grant: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestCreateGrantValidation(t *testing.T) {
+	_, h := newSharingTestServer(t)
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"malformed body", "owner-key", `{`, http.StatusBadRequest},
+		{"unknown right", "owner-key", `{"token": "team-key", "rights": ["admin"]}`, http.StatusBadRequest},
+		{"no rights", "owner-key", `{"token": "team-key", "rights": []}`, http.StatusBadRequest},
+		{"grantee not an API key", "owner-key", `{"token": "bogus", "rights": ["inspect"]}`, http.StatusBadRequest},
+		{"grant to owner", "owner-key", `{"token": "owner-key", "rights": ["inspect"]}`, http.StatusBadRequest},
+		{"non-owner", "other-key", `{"token": "team-key", "rights": ["inspect"]}`, http.StatusNotFound},
+		{"admin", "root-key", `{"token": "team-key", "rights": ["inspect"]}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(t, h, "POST", "/api/tunnels/demo/grants", tt.token, tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (body: %s)", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestClaimSubdomainWithoutAuth(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.claimSubdomain("open", ""); err != nil {
+		t.Errorf("claimSubdomain() error = %v", err)
+	}
+	if len(s.owners) != 0 {
+		t.Error("ownership recorded without authentication enabled")
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// AnonymousHeader is added to responses of anonymous tunnels, carrying the
+// tier's banner.
+const AnonymousHeader = "X-Otun-Notice"
+
+// AnonymousTier constrains tunnels opened without an API key, so a server
+// can offer a public free tier while token holders stay unconstrained.
+type AnonymousTier struct {
+	// MaxLifetime closes anonymous tunnels after this long (0 = no limit).
+	MaxLifetime time.Duration
+
+	// BytesPerSecond caps each anonymous tunnel's bandwidth, both
+	// directions combined (0 = no limit).
+	BytesPerSecond int64
+
+	// Banner is sent in the AnonymousHeader of every response ("" = none).
+	Banner string
+}
+
+// WithAnonymousTier lets clients without an API key open tunnels, even if
+// the server otherwise requires one. Anonymous tunnels get a random
+// subdomain, carry HTTP only, and are held to tier's lifetime and bandwidth
+// limits. Clients presenting a key are unaffected.
+func (s *Server) WithAnonymousTier(tier AnonymousTier) *Server {
+	tier.Banner = strings.Join(strings.Fields(tier.Banner), " ") // a header value is one line
+	s.anonymous = &tier
+	return s
+}
+
+// isAnonymous reports whether msg registers an anonymous tunnel.
+func (s *Server) isAnonymous(msg *protocol.RegisterMessage) bool {
+	return s.anonymous != nil && msg.Token == ""
+}
+
+// checkAnonymous returns why msg can't register an anonymous tunnel, if it
+// can't.
+func checkAnonymous(msg *protocol.RegisterMessage) error {
+	switch {
+	case msg.Protocol != "" && msg.Protocol != protocol.ProtocolHTTP:
+		return errors.New("tunnels without an API key can only carry HTTP")
+	case msg.Subdomain != "":
+		return errors.New("tunnels without an API key get a random subdomain")
+	case msg.OwnerKey != "":
+		return errors.New("tunnels without an API key can't be bound to an owner key")
+	case msg.Canary:
+		return errors.New("canaries need an API key")
+	case msg.JWT != nil:
+		return errors.New("tunnels without an API key can't require JWTs")
+	}
+	return nil
+}
+
+// anonymousLimits describes the tier's limits to the client.
+func (s *Server) anonymousLimits() *protocol.AnonymousLimits {
+	return &protocol.AnonymousLimits{
+		Lifetime:       int64(s.anonymous.MaxLifetime / time.Second),
+		BytesPerSecond: s.anonymous.BytesPerSecond,
+	}
+}
+
+// anonymousBanner returns the banner to add to client's responses, if any.
+func (s *Server) anonymousBanner(client *tunnelClient) string {
+	if !client.anonymous {
+		return ""
+	}
+	return s.anonymous.Banner
+}
+
+// expireAfter closes client's session once the anonymous tier's lifetime
+// has passed. The returned function stops the timer.
+func (s *Server) expireAfter(client *tunnelClient) (stop func()) {
+	if s.anonymous.MaxLifetime <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(s.anonymous.MaxLifetime, func() {
+		s.mu.Lock()
+		client.closeReason = "anonymous tunnel lifetime reached"
+		s.mu.Unlock()
+
+		s.metrics.anonymousExpired.Inc()
+		slog.Info("anonymous tunnel expired", "subdomain", client.subdomain, "lifetime", s.anonymous.MaxLifetime)
+		client.controlStream.SendErrorCode(protocol.ErrCodeLifetimeExpired, "tunnels without an API key close after "+s.anonymous.MaxLifetime.String())
+		client.session.Close()
+	})
+	return func() { timer.Stop() }
+}
+
+// bandwidthLimiter is a token bucket of bytes shared by a tunnel's streams.
+// Transfers larger than the bucket run it into debt, which later transfers
+// wait out, so the average rate holds whatever the buffer sizes.
+type bandwidthLimiter struct {
+	rate float64 // bytes per second; also the bucket size
+
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// newBandwidthLimiter returns a limiter for bytesPerSecond, or nil if it
+// isn't positive.
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), updated: time.Now()}
+}
+
+// take spends n bytes at now, returning how long to wait before they may be
+// sent.
+func (l *bandwidthLimiter) take(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.updated).Seconds()*l.rate)
+	l.updated = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be sent.
+func (l *bandwidthLimiter) wait(n int) {
+	if d := l.take(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limit throttles stream to l's rate. A nil l returns stream unchanged.
+func (l *bandwidthLimiter) limit(stream net.Conn) net.Conn {
+	if l == nil {
+		return stream
+	}
+	return &throttledConn{Conn: stream, limiter: l}
+}
+
+// throttledConn holds reads and writes on a tunnel stream to its tunnel's
+// bandwidth.
+type throttledConn struct {
+	net.Conn
+	limiter *bandwidthLimiter
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	c.limiter.wait(len(b))
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestAnonymousRegistration(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *protocol.RegisterMessage
+		want string // error code, or "" if registered
+	}{
+		{"anonymous", &protocol.RegisterMessage{}, ""},
+		{"api key", &protocol.RegisterMessage{Token: "key", Subdomain: "mine"}, ""},
+		{"invalid api key", &protocol.RegisterMessage{Token: "wrong"}, protocol.ErrCodeUnauthorized},
+		{"chosen subdomain", &protocol.RegisterMessage{Subdomain: "mine"}, protocol.ErrCodeAnonymousRestricted},
+		{"tcp", &protocol.RegisterMessage{Protocol: protocol.ProtocolTCP}, protocol.ErrCodeAnonymousRestricted},
+		{"jwt", &protocol.RegisterMessage{JWT: &protocol.JWTPolicy{JWKSURL: "https://id.example.com/jwks.json"}}, protocol.ErrCodeAnonymousRestricted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", []string{"key"}).WithAnonymousTier(AnonymousTier{MaxLifetime: time.Hour, BytesPerSecond: 1024})
+
+			reply, _ := registerSession(t, s, tt.msg)
+			if tt.want != "" {
+				if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != tt.want {
+					t.Fatalf("reply = %+v, want error %s", reply, tt.want)
+				}
+				return
+			}
+			registered, ok := reply.(*protocol.RegisteredMessage)
+			if !ok {
+				t.Fatalf("reply = %+v, want registered", reply)
+			}
+
+			anonymous := tt.msg.Token == ""
+			if got := registered.Anonymous != nil; got != anonymous {
+				t.Errorf("registered as anonymous = %v, want %v", got, anonymous)
+			}
+			if anonymous && (registered.Anonymous.Lifetime != 3600 || registered.Anonymous.BytesPerSecond != 1024) {
+				t.Errorf("limits = %+v, want 1h at 1024 B/s", registered.Anonymous)
+			}
+			if got := registered.ResumeToken != ""; got == anonymous {
+				t.Errorf("resume token issued = %v, want %v", got, !anonymous)
+			}
+			if client := s.lookupClient(registered.Subdomain); client == nil || (client.bandwidth != nil) != anonymous {
+				t.Errorf("tunnel throttled = %v, want %v", client != nil && client.bandwidth != nil, anonymous)
+			}
+		})
+	}
+}
+
+func TestAnonymousLifetime(t *testing.T) {
+	s := New("", "", "", "", "", []string{"key"}).WithAnonymousTier(AnonymousTier{MaxLifetime: 50 * time.Millisecond})
+
+	registered, session := mustRegister(t, s, &protocol.RegisterMessage{})
+	waitFor(t, time.Second, func() bool { return s.lookupClient(registered.Subdomain) == nil })
+	if got := s.metrics.anonymousExpired.Value(); got != 1 {
+		t.Errorf("expired tunnels = %d, want 1", got)
+	}
+	// The client's end of the pipe notices the close asynchronously, after
+	// the server has already unregistered the tunnel
+	waitFor(t, time.Second, session.IsClosed)
+}
+
+func TestAnonymousBanner(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithAnonymousTier(AnonymousTier{Banner: "free\n  tier"})
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	go serveTunnelStreams(registerTestTunnel(t, s, "paid"), okResponse)
+	s.clients["demo"].anonymous = true
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for subdomain, want := range map[string]string{"demo": "free tier", "paid": ""} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Host = subdomain + ".localhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get(AnonymousHeader); got != want {
+			t.Errorf("%s: %s = %q, want %q", subdomain, AnonymousHeader, got, want)
+		}
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := newBandwidthLimiter(1000)
+	now := l.updated
+
+	steps := []struct {
+		after time.Duration
+		bytes int
+		want  time.Duration
+	}{
+		{0, 600, 0},
+		{0, 400, 0},
+		{0, 500, 500 * time.Millisecond},
+		{time.Second, 500, 0},
+		{0, 2000, 2 * time.Second},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := l.take(step.bytes, now); got != step.want {
+			t.Errorf("step %d: wait = %v, want %v", i, got, step.want)
+		}
+	}
+
+	if newBandwidthLimiter(0) != nil {
+		t.Error("limiter for 0 B/s, want none")
+	}
+}
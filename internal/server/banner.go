@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/metrics"
+)
+
+// DefaultBannerTemplate is the HTML banner injected into anonymous tunnels'
+// pages unless the operator provides their own.
+const DefaultBannerTemplate = `<div style="position:fixed;left:0;right:0;bottom:0;z-index:2147483647;padding:6px 12px;background:#1f2328;color:#fff;font:13px/1.4 system-ui,sans-serif;text-align:center">
+Free tunnel by {{.Provider}}
+{{- with .Bandwidth}} &middot; limited to {{.}}{{end}}
+{{- if .Lifetime}} &middot; closes at {{.ExpiresAt.Format "15:04 MST"}}{{end}}
+</div>`
+
+// maxBannerScan bounds how much of a page is held back waiting for the end
+// of its <body> tag. Pages whose tag runs longer, like those without one,
+// get the banner at the end.
+const maxBannerScan = 16 << 10
+
+// bannerData is what banner templates are rendered with.
+type bannerData struct {
+	Provider  string        // the server's domain
+	Subdomain string        // the tunnel's subdomain
+	Lifetime  time.Duration // how long the tunnel lasts (0 = no limit)
+	ExpiresAt time.Time     // when it closes, if Lifetime is set
+	Bandwidth string        // its bandwidth, e.g. "256.0 KiB/s" ("" = no limit)
+}
+
+// WithHTMLBanner injects tmpl, rendered for each anonymous tunnel, after
+// the <body> tag of its uncompressed text/html responses, so visitors see
+// who provides the tunnel and its limits. Requires WithAnonymousTier.
+func (s *Server) WithHTMLBanner(tmpl *template.Template) *Server {
+	s.htmlBanner = tmpl
+	return s
+}
+
+// renderBanner renders the HTML banner for client, or returns nil if it
+// gets none.
+func (s *Server) renderBanner(client *tunnelClient) []byte {
+	if s.htmlBanner == nil || !client.anonymous {
+		return nil
+	}
+	data := bannerData{
+		Provider:  s.domain,
+		Subdomain: client.subdomain,
+		Lifetime:  s.anonymous.MaxLifetime,
+		ExpiresAt: client.connectedAt.Add(s.anonymous.MaxLifetime),
+	}
+	if data.Provider == "" {
+		data.Provider = "otun"
+	}
+	if s.anonymous.BytesPerSecond > 0 {
+		data.Bandwidth = bytesize.Format(s.anonymous.BytesPerSecond) + "/s"
+	}
+	var buf bytes.Buffer
+	if err := s.htmlBanner.Execute(&buf, data); err != nil {
+		slog.Error("failed to render HTML banner", "subdomain", client.subdomain, "error", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// injectBanner wraps upstream to add client's HTML banner to its pages, or
+// returns it as is if client gets no banner.
+func (s *Server) injectBanner(upstream net.Conn, client *tunnelClient, method string) net.Conn {
+	if len(client.htmlBanner) == 0 {
+		return upstream
+	}
+	return &bannerConn{
+		Conn:     upstream,
+		banner:   client.htmlBanner,
+		method:   method,
+		injected: s.metrics.bannersInjected,
+		readBuf:  make([]byte, 32<<10),
+	}
+}
+
+// Framing states of a bannerConn.
+const (
+	bannerHead        = iota // buffering a response head
+	bannerBody               // body with a known length
+	bannerChunkSize          // reading a chunk size line
+	bannerChunkData          // reading chunk data
+	bannerChunkEnd           // reading the CRLF after chunk data
+	bannerTrailer            // reading trailer lines
+	bannerUntilClose         // body delimited by connection close
+	bannerPassthrough        // not HTTP any more, or framing we can't follow
+)
+
+// bannerConn is a streaming HTML rewriter for the response side of a tunnel
+// stream: it inserts a banner after the <body> tag of each text/html
+// response that isn't compressed, or at the end of those without one.
+// Bodies with a Content-Length get it raised by the banner's size; chunked
+// bodies are re-chunked. Other responses pass through unchanged.
+type bannerConn struct {
+	net.Conn
+	banner   []byte
+	method   string // method of the first request, for HEAD responses
+	injected *metrics.Counter
+
+	state     int
+	head      []byte
+	line      []byte // partial chunk size or trailer line
+	remaining int64  // body bytes left in bannerBody, chunk bytes in bannerChunkData
+	chunked   bool   // the current response's body is chunked
+	responses int    // responses seen
+
+	rewrite bool   // the current response gets the banner
+	done    bool   // the banner was inserted into the current response
+	atEnd   bool   // the banner goes at the end of the current response
+	scan    []byte // body held back while looking for <body>
+
+	pending []byte
+	readBuf []byte
+	err     error
+}
+
+func (c *bannerConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.Conn.Read(c.readBuf)
+		c.process(c.readBuf[:n])
+		if err != nil && c.err == nil {
+			if c.state == bannerUntilClose {
+				c.finishBody()
+			}
+			c.err = err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// process runs data through the framing state machine, queueing what may
+// be passed on.
+func (c *bannerConn) process(data []byte) {
+	for len(data) > 0 {
+		switch c.state {
+		case bannerHead:
+			data = c.processHead(data)
+		case bannerBody:
+			n := min(int64(len(data)), c.remaining)
+			c.body(data[:n])
+			data = data[n:]
+			if c.remaining -= n; c.remaining == 0 {
+				c.finishBody()
+				c.state = bannerHead
+			}
+		case bannerChunkSize:
+			line, rest, ok := c.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(string(line), ";", 2)[0]), 16, 64)
+			if err != nil || size < 0 {
+				// Not chunking we understand; leave the rest alone
+				c.pending = append(c.pending, line...)
+				c.state = bannerPassthrough
+				continue
+			}
+			c.remaining = size
+			c.state = bannerChunkData
+			if size == 0 {
+				c.finishBody()
+				c.pending = append(c.pending, "0\r\n"...)
+				c.state = bannerTrailer
+			}
+		case bannerChunkData:
+			n := min(int64(len(data)), c.remaining)
+			c.body(data[:n])
+			data = data[n:]
+			if c.remaining -= n; c.remaining == 0 {
+				c.state = bannerChunkEnd
+			}
+		case bannerChunkEnd:
+			_, rest, ok := c.readLine(data)
+			data = rest
+			if ok {
+				c.state = bannerChunkSize
+			}
+		case bannerTrailer:
+			line, rest, ok := c.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+			c.pending = append(c.pending, line...)
+			if string(line) == "\r\n" {
+				c.state = bannerHead
+			}
+		case bannerUntilClose:
+			c.body(data)
+			data = nil
+		case bannerPassthrough:
+			c.pending = append(c.pending, data...)
+			data = nil
+		}
+	}
+}
+
+// readLine buffers data up to and including a line feed. It returns the
+// line once complete, and the unconsumed data.
+func (c *bannerConn) readLine(data []byte) (line, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		c.line = append(c.line, data...)
+		if len(c.line) > maxResponseHeaderBytes {
+			// Not framing we can follow
+			c.pending = append(c.pending, c.line...)
+			c.line = nil
+			c.state = bannerPassthrough
+		}
+		return nil, nil, false
+	}
+	line = append(c.line, data[:i+1]...)
+	c.line = nil
+	return line, data[i+1:], true
+}
+
+// processHead buffers a response head and decides how its body is framed
+// and whether it gets the banner. It returns the unconsumed data.
+func (c *bannerConn) processHead(data []byte) []byte {
+	start := len(c.head)
+	c.head = append(c.head, data...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(c.head) > maxResponseHeaderBytes {
+			c.pending = append(c.pending, c.head...)
+			c.head = nil
+			c.state = bannerPassthrough
+		}
+		return nil
+	}
+	end += 4
+	head := c.head[:end]
+	rest := data[end-start:]
+	c.head = nil
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		c.pending = append(c.pending, head...)
+		c.state = bannerPassthrough
+		return rest
+	}
+	c.responses++
+	c.rewrite, c.done, c.atEnd, c.scan = false, false, false, nil
+	c.chunked = len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+
+	switch {
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		c.state = bannerPassthrough
+	case resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(c.responses == 1 && c.method == http.MethodHead):
+		c.state = bannerHead
+	case c.chunked:
+		c.rewrite = isHTML(resp)
+		c.state = bannerChunkSize
+	case resp.ContentLength > 0:
+		c.rewrite = isHTML(resp)
+		if c.rewrite {
+			head = setContentLength(head, resp.ContentLength+int64(len(c.banner)))
+		}
+		c.remaining = resp.ContentLength
+		c.state = bannerBody
+	case resp.ContentLength == 0:
+		c.state = bannerHead
+	default:
+		c.rewrite = isHTML(resp)
+		c.state = bannerUntilClose
+	}
+	c.pending = append(c.pending, head...)
+	return rest
+}
+
+// isHTML reports whether resp's body is an uncompressed HTML page.
+func isHTML(resp *http.Response) bool {
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	encoding := resp.Header.Get("Content-Encoding")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/html") && (encoding == "" || strings.EqualFold(encoding, "identity"))
+}
+
+// body passes on part of a response body, inserting the banner after the
+// <body> tag if the response gets one.
+func (c *bannerConn) body(data []byte) {
+	if !c.rewrite || c.done || c.atEnd {
+		c.emit(data)
+		return
+	}
+	c.scan = append(c.scan, data...)
+	if at := bodyTagEnd(c.scan); at >= 0 {
+		c.emit(c.scan[:at])
+		c.insert()
+		c.emit(c.scan[at:])
+		c.scan = nil
+		return
+	}
+
+	// Hold back what may be the start of the tag
+	keep := min(len(c.scan), len("<body")-1)
+	if i := indexFold(c.scan, "<body"); i >= 0 {
+		keep = len(c.scan) - i
+	}
+	if keep > maxBannerScan {
+		c.atEnd = true
+		keep = 0
+	}
+	c.emit(c.scan[:len(c.scan)-keep])
+	c.scan = append([]byte(nil), c.scan[len(c.scan)-keep:]...)
+}
+
+// finishBody ends the current response's body, adding the banner at the
+// end if it had no <body> tag.
+func (c *bannerConn) finishBody() {
+	if !c.rewrite || c.done {
+		return
+	}
+	c.emit(c.scan)
+	c.scan = nil
+	c.insert()
+}
+
+// insert passes on the banner.
+func (c *bannerConn) insert() {
+	c.done = true
+	c.injected.Inc()
+	c.emit(c.banner)
+}
+
+// emit queues body bytes, as a chunk if the body is chunked.
+func (c *bannerConn) emit(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if c.chunked {
+		c.pending = strconv.AppendInt(c.pending, int64(len(data)), 16)
+		c.pending = append(c.pending, "\r\n"...)
+		c.pending = append(c.pending, data...)
+		c.pending = append(c.pending, "\r\n"...)
+		return
+	}
+	c.pending = append(c.pending, data...)
+}
+
+// bodyTagEnd returns the index just past the first <body> start tag in
+// page, or -1 if page doesn't contain a complete one.
+func bodyTagEnd(page []byte) int {
+	for offset := 0; ; {
+		i := indexFold(page[offset:], "<body")
+		if i < 0 {
+			return -1
+		}
+		i += offset + len("<body")
+		if i == len(page) {
+			return -1
+		}
+		switch page[i] {
+		case '>', '/', ' ', '\t', '\n', '\r', '\f':
+			if end := bytes.IndexByte(page[i:], '>'); end >= 0 {
+				return i + end + 1
+			}
+			return -1
+		}
+		offset = i
+	}
+}
+
+// indexFold returns the index of the first ASCII case-insensitive match of
+// substr in s, or -1.
+func indexFold(s []byte, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(string(s[i:i+len(substr)]), substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// setContentLength returns a response head with its Content-Length set to
+// n.
+func setContentLength(head []byte, n int64) []byte {
+	statusEnd := bytes.Index(head, []byte("\r\n"))
+	out := make([]byte, 0, len(head)+8)
+	out = append(out, head[:statusEnd+2]...)
+	for rest := head[statusEnd+2:]; len(rest) > 0; {
+		end := bytes.Index(rest, []byte("\r\n"))
+		line := rest[:end+2]
+		rest = rest[end+2:]
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(name), "Content-Length") {
+			line = []byte("Content-Length: " + strconv.FormatInt(n, 10) + "\r\n")
+		}
+		out = append(out, line...)
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBannerConn(t *testing.T) {
+	const banner = "<div>free</div>"
+	html := "HTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\n"
+	tests := []struct {
+		name     string
+		method   string
+		upstream string
+		want     string
+	}{
+		{
+			name:     "after the body tag",
+			upstream: html + "Content-Length: 44\r\n\r\n<html><head></head><body class=\"x\">hi</body>",
+			want:     html + "Content-Length: 59\r\n\r\n<html><head></head><body class=\"x\">" + banner + "hi</body>",
+		},
+		{
+			name:     "no body tag",
+			upstream: html + "Content-Length: 11\r\n\r\n<p>hello</p",
+			want:     html + "Content-Length: 26\r\n\r\n<p>hello</p" + banner,
+		},
+		{
+			name:     "after a lookalike tag",
+			upstream: html + "Content-Length: 17\r\n\r\n<bodyguard><BODY>",
+			want:     html + "Content-Length: 32\r\n\r\n<bodyguard><BODY>" + banner,
+		},
+		{
+			name:     "chunked",
+			upstream: html + "Transfer-Encoding: chunked\r\n\r\n4\r\n<bod\r\n5\r\ny>hi!\r\n0\r\n\r\n",
+			want:     html + "Transfer-Encoding: chunked\r\n\r\n6\r\n<body>\r\nf\r\n" + banner + "\r\n3\r\nhi!\r\n0\r\n\r\n",
+		},
+		{
+			name:     "close-delimited",
+			upstream: html + "Connection: close\r\n\r\nhi",
+			want:     html + "Connection: close\r\n\r\nhi" + banner,
+		},
+		{
+			name:     "not html",
+			upstream: "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}",
+			want:     "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}",
+		},
+		{
+			name:     "compressed",
+			upstream: html + "Content-Encoding: gzip\r\nContent-Length: 6\r\n\r\n<body>",
+			want:     html + "Content-Encoding: gzip\r\nContent-Length: 6\r\n\r\n<body>",
+		},
+		{
+			name:     "HEAD",
+			method:   http.MethodHead,
+			upstream: html + "Content-Length: 100\r\n\r\n",
+			want:     html + "Content-Length: 100\r\n\r\n",
+		},
+		{
+			name:     "keep-alive",
+			upstream: "HTTP/1.1 204 No Content\r\n\r\n" + html + "Content-Length: 6\r\n\r\n<body>",
+			want:     "HTTP/1.1 204 No Content\r\n\r\n" + html + "Content-Length: 21\r\n\r\n<body>" + banner,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil)
+			client := &tunnelClient{htmlBanner: []byte(banner)}
+			conn := s.injectBanner(&chunkedConn{r: bytes.NewReader([]byte(tt.upstream))}, client, tt.method)
+
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+
+			// What the visitor gets must still parse
+			br := bufio.NewReader(bytes.NewReader(got))
+			for br.Buffered() > 0 || !isEOF(br) {
+				resp, err := http.ReadResponse(br, &http.Request{Method: tt.method})
+				if err != nil {
+					t.Fatalf("rewritten response doesn't parse: %v", err)
+				}
+				if _, err := io.ReadAll(resp.Body); err != nil {
+					t.Fatalf("rewritten body doesn't parse: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// isEOF reports whether br has nothing left to read.
+func isEOF(br *bufio.Reader) bool {
+	_, err := br.Peek(1)
+	return err != nil
+}
+
+func TestRenderBanner(t *testing.T) {
+	s := New("", "", "", "tunnel.example.com", "", nil).
+		WithAnonymousTier(AnonymousTier{MaxLifetime: time.Hour, BytesPerSecond: 256 << 10}).
+		WithHTMLBanner(template.Must(template.New("banner").Parse(DefaultBannerTemplate)))
+
+	connected := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	got := string(s.renderBanner(&tunnelClient{subdomain: "demo", anonymous: true, connectedAt: connected}))
+	for _, want := range []string{"tunnel.example.com", "256.0 KiB/s", "11:00 UTC"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("banner %q doesn't mention %q", got, want)
+		}
+	}
+
+	if got := s.renderBanner(&tunnelClient{subdomain: "paid"}); got != nil {
+		t.Errorf("banner for a tunnel with an API key = %q, want none", got)
+	}
+}
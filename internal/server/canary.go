@@ -0,0 +1,207 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// canaryInfo is the admin API representation of a subdomain's traffic
+// split.
+type canaryInfo struct {
+	// Percent of the subdomain's requests sent to the canary
+	Percent int `json:"percent"`
+
+	// The canary client, if one is connected
+	Online      bool       `json:"online"`
+	RemoteAddr  string     `json:"remote_addr,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+}
+
+// splitRequest is the body of a traffic split update.
+type splitRequest struct {
+	Percent *int `json:"percent"`
+}
+
+// handleCanaryRegister registers a client as the canary of the HTTP tunnel
+// serving msg.Subdomain, replacing any canary it had. The tunnel's own
+// client keeps serving the requests not sent to the canary.
+func (s *Server) handleCanaryRegister(conn net.Conn, session transport.Session, controlStream *protocol.ControlStream, msg *protocol.RegisterMessage, registered func()) {
+	subdomain := msg.Subdomain
+	reject := func(code, message string) {
+		slog.Warn("canary refused", "subdomain", subdomain, "remote_addr", conn.RemoteAddr(), "reason", message)
+		if subdomain != "" {
+			s.rejectRegistration(subdomain, conn, msg.Token, message)
+		}
+		controlStream.SendErrorCode(code, message)
+		session.Close()
+	}
+	if subdomain == "" {
+		reject(protocol.ErrCodeInvalidCanary, "a canary needs the subdomain of the tunnel it joins")
+		return
+	}
+
+	// A canary proves it holds the subdomain's owner key like any client,
+	// but never binds one
+	if _, code, err := s.proveOwnership(controlStream, subdomain, msg.OwnerKey); err != nil {
+		if code != "" {
+			reject(code, err.Error())
+		} else {
+			session.Close()
+		}
+		return
+	}
+
+	s.mu.Lock()
+	primary := s.clients[subdomain]
+	switch {
+	case s.blocked[subdomain] != nil:
+		s.mu.Unlock()
+		reject(protocol.ErrCodeTunnelBlocked, fmt.Sprintf("subdomain '%s' has been blocked by the server operator", subdomain))
+		return
+	case primary == nil || primary.passthrough:
+		s.mu.Unlock()
+		reject(protocol.ErrCodeInvalidCanary, fmt.Sprintf("no HTTP tunnel is serving '%s' to add a canary to", subdomain))
+		return
+	case subtle.ConstantTimeCompare([]byte(primary.token), []byte(msg.Token)) != 1:
+		s.mu.Unlock()
+		reject(protocol.ErrCodeInvalidCanary, "a canary needs the API key of the tunnel it joins")
+		return
+	}
+
+	client := s.newTunnelClient(subdomain, conn, session, controlStream, msg)
+	client.canary = true
+	s.applyGroup(client)
+	previous := s.canaries[subdomain]
+	s.canaries[subdomain] = client
+	if previous != nil {
+		previous.closeReason = "canary replaced by " + client.remoteAddr
+	}
+	percent := s.splits[subdomain]
+	s.mu.Unlock()
+
+	if previous != nil {
+		previous.controlStream.SendError("canary replaced by another client")
+		previous.session.Close()
+	}
+
+	slog.Info("canary registered", "subdomain", subdomain, "remote_addr", conn.RemoteAddr(), "percent", percent)
+	s.history.record(subdomain, tunnelEvent{Type: eventCanaryJoined, RemoteAddr: client.remoteAddr, TokenID: tokenID(client.token)})
+	s.audit("canary registered", "subdomain", subdomain, "token_id", tokenID(msg.Token), "remote_addr", client.remoteAddr)
+
+	if err := controlStream.SendRegisteredMessage(&protocol.RegisteredMessage{
+		URL:       s.tunnelURL(subdomain),
+		Subdomain: subdomain,
+		Timing:    client.timing,
+		TunnelID:  msg.TunnelID,
+	}); err != nil {
+		slog.Error("failed to send registered message", "error", err)
+		s.removeClient(client, err)
+		session.Close()
+		return
+	}
+
+	registered()
+	s.handleControlStream(client)
+}
+
+// removeCanary removes a canary client, unless it has already been
+// replaced.
+func (s *Server) removeCanary(client *tunnelClient, cause error) {
+	s.mu.Lock()
+	if s.canaries[client.subdomain] != client {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.canaries, client.subdomain)
+	reason := client.closeReason
+	s.mu.Unlock()
+	if reason == "" && cause != nil {
+		reason = cause.Error()
+	}
+	slog.Info("canary unregistered", "subdomain", client.subdomain)
+	s.history.record(client.subdomain, tunnelEvent{Type: eventCanaryLeft, RemoteAddr: client.remoteAddr, TokenID: tokenID(client.token),
+		Reason: reason})
+	s.audit("canary unregistered", "subdomain", client.subdomain, "remote_addr", client.remoteAddr)
+}
+
+// splitTraffic picks the client to serve a request for subdomain: its
+// canary for the subdomain's split percentage of requests, client
+// otherwise.
+func (s *Server) splitTraffic(subdomain string, client *tunnelClient) *tunnelClient {
+	s.mu.RLock()
+	canary, percent := s.canaries[subdomain], s.splits[subdomain]
+	s.mu.RUnlock()
+	if canary == nil || percent <= 0 || rand.IntN(100) >= percent {
+		return client
+	}
+	return canary
+}
+
+// canaryInfoLocked builds the API view of subdomain's traffic split, or nil
+// if it has neither a split nor a canary.
+// Must be called with s.mu held.
+func (s *Server) canaryInfoLocked(subdomain string) *canaryInfo {
+	canary, percent := s.canaries[subdomain], s.splits[subdomain]
+	if canary == nil && percent == 0 {
+		return nil
+	}
+	info := &canaryInfo{Percent: percent}
+	if canary != nil {
+		connectedAt := canary.connectedAt
+		info.Online = true
+		info.RemoteAddr = canary.remoteAddr
+		info.ConnectedAt = &connectedAt
+	}
+	return info
+}
+
+func (s *Server) handleSetSplit(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	var req splitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Percent == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if *req.Percent < 0 || *req.Percent > 100 {
+		writeJSONError(w, http.StatusBadRequest, "percent must be between 0 and 100")
+		return
+	}
+
+	s.mu.Lock()
+	_, online := s.clients[subdomain]
+	_, owned := s.owners[subdomain]
+	if (!online && !owned) || !s.canManage(caller, subdomain) {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	if *req.Percent == 0 {
+		delete(s.splits, subdomain)
+	} else {
+		s.splits[subdomain] = *req.Percent
+	}
+	info := s.canaryInfoLocked(subdomain)
+	s.mu.Unlock()
+
+	slog.Info("traffic split changed", "subdomain", subdomain, "percent", *req.Percent)
+	s.audit("traffic split changed", "subdomain", subdomain, "percent", *req.Percent, "by", caller.id())
+	if info == nil {
+		info = &canaryInfo{}
+	}
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestCanaryRegistration(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary bool // whether a client serves the subdomain
+		token   string
+		wantOK  bool
+	}{
+		{name: "same key", primary: true, token: "key", wantOK: true},
+		{name: "other key", primary: true, token: "other"},
+		{name: "no tunnel", token: "key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", []string{"key", "other"})
+			if tt.primary {
+				mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key"})
+			}
+			primary := s.lookupClient("app")
+
+			reply, _ := registerSession(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: tt.token, Canary: true})
+			if !tt.wantOK {
+				if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeInvalidCanary {
+					t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeInvalidCanary)
+				}
+				return
+			}
+			if _, ok := reply.(*protocol.RegisteredMessage); !ok {
+				t.Fatalf("reply = %+v, want registered", reply)
+			}
+			if s.lookupClient("app") != primary {
+				t.Error("canary replaced the tunnel's client")
+			}
+			s.mu.RLock()
+			canary := s.canaries["app"]
+			s.mu.RUnlock()
+			if canary == nil || !canary.canary {
+				t.Error("canary not registered")
+			}
+		})
+	}
+}
+
+func TestCanaryLeaves(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app"})
+	_, session := mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", Canary: true})
+
+	session.Close()
+	waitFor(t, time.Second, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.canaries["app"] == nil
+	})
+	if s.lookupClient("app") == nil {
+		t.Error("tunnel unregistered when its canary left")
+	}
+}
+
+func TestSplitTraffic(t *testing.T) {
+	tests := []struct {
+		name       string
+		percent    int
+		wantCanary int // of 100 requests
+	}{
+		{name: "none", percent: 0, wantCanary: 0},
+		{name: "all", percent: 100, wantCanary: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil)
+			primary := &tunnelClient{subdomain: "app"}
+			canary := &tunnelClient{subdomain: "app", canary: true}
+			s.clients["app"] = primary
+			s.canaries["app"] = canary
+			s.splits["app"] = tt.percent
+
+			got := 0
+			for range 100 {
+				if s.splitTraffic("app", primary) == canary {
+					got++
+				}
+			}
+			if got != tt.wantCanary {
+				t.Errorf("canary served %d of 100 requests, want %d", got, tt.wantCanary)
+			}
+		})
+	}
+}
+
+func TestSetSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"owner", "owner-key", `{"percent": 25}`, http.StatusOK},
+		{"admin", "root-key", `{"percent": 25}`, http.StatusOK},
+		{"other key", "other-key", `{"percent": 25}`, http.StatusNotFound},
+		{"out of range", "owner-key", `{"percent": 101}`, http.StatusBadRequest},
+		{"missing percent", "owner-key", `{}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, h := newSharingTestServer(t)
+
+			rec := adminRequest(t, h, http.MethodPut, "/api/tunnels/demo/split", tt.token, tt.body)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var info canaryInfo
+			if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil || info.Percent != 25 {
+				t.Errorf("response = %s, want percent 25", rec.Body)
+			}
+			if s.splits["demo"] != 25 {
+				t.Errorf("split = %d, want 25", s.splits["demo"])
+			}
+		})
+	}
+}
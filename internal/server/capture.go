@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCaptureSubdomains bounds how many subdomains have captured requests;
+// the subdomain with the oldest latest request is forgotten first.
+const maxCaptureSubdomains = 10000
+
+// capturedRequest is the metadata of one request served through a tunnel.
+// Bodies and headers other than the user agent are never kept.
+type capturedRequest struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// requestCapture keeps the most recent requests of each subdomain for a
+// short time, so operators can look into abuse or misrouting reports
+// without access to the client.
+type requestCapture struct {
+	size      int
+	retention time.Duration
+
+	mu       sync.Mutex
+	requests map[string][]capturedRequest // subdomain -> requests, oldest first
+}
+
+// WithRequestCapture keeps the metadata of the last size requests of each
+// subdomain for up to retention, visible to the admin key in the admin
+// API. 0 disables capture.
+func (s *Server) WithRequestCapture(size int, retention time.Duration) *Server {
+	s.capture = nil
+	if size > 0 && retention > 0 {
+		s.capture = &requestCapture{size: size, retention: retention, requests: make(map[string][]capturedRequest)}
+	}
+	return s
+}
+
+// record adds a request to subdomain's capture, dropping requests that are
+// too old or over the size.
+func (c *requestCapture) record(subdomain string, req capturedRequest) {
+	if c == nil || subdomain == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	requests, ok := c.requests[subdomain]
+	if !ok && len(c.requests) >= maxCaptureSubdomains {
+		c.evictLocked(req.Time)
+	}
+	requests = c.expire(requests, req.Time)
+	if len(requests) >= c.size {
+		requests = append(requests[:0], requests[len(requests)-c.size+1:]...)
+	}
+	c.requests[subdomain] = append(requests, req)
+}
+
+// expire drops requests captured more than the retention before now.
+func (c *requestCapture) expire(requests []capturedRequest, now time.Time) []capturedRequest {
+	i := 0
+	for i < len(requests) && now.Sub(requests[i].Time) > c.retention {
+		i++
+	}
+	return requests[i:]
+}
+
+// evictLocked forgets every subdomain whose requests have all expired, or
+// if there are none, the one whose latest request is oldest.
+// Must be called with c.mu held.
+func (c *requestCapture) evictLocked(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	for subdomain, requests := range c.requests {
+		at := requests[len(requests)-1].Time
+		if now.Sub(at) > c.retention {
+			delete(c.requests, subdomain)
+		} else if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = subdomain, at
+		}
+	}
+	if len(c.requests) >= maxCaptureSubdomains {
+		delete(c.requests, oldest)
+	}
+}
+
+// get returns subdomain's unexpired requests, newest first.
+func (c *requestCapture) get(subdomain string) []capturedRequest {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	requests := c.expire(c.requests[subdomain], time.Now())
+	if len(requests) == 0 {
+		delete(c.requests, subdomain)
+	}
+	out := make([]capturedRequest, len(requests))
+	for i, req := range requests {
+		out[len(requests)-1-i] = req
+	}
+	return out
+}
+
+// captureRequest records r's metadata in the request capture and the
+// request database, if enabled.
+func (s *Server) captureRequest(r *http.Request, subdomain string, status int, start time.Time) {
+	req := capturedRequest{
+		Time:       start.UTC(),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Proto:      r.Proto,
+		Status:     status,
+		DurationMS: time.Since(start).Milliseconds(),
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}
+	s.capture.record(subdomain, req)
+	s.persistRequest(subdomain, req)
+}
+
+func (s *Server) handleTunnelRequests(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || !caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "admin key required")
+		return
+	}
+	if s.requestDB != nil {
+		s.handlePersistedRequests(w, r)
+		return
+	}
+	if s.capture == nil {
+		writeJSONError(w, http.StatusNotFound, "request capture is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.capture.get(r.PathValue("subdomain")))
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestCaptureRetention(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithRequestCapture(3, time.Minute)
+	c := s.capture
+	now := time.Now()
+
+	c.record("demo", capturedRequest{Time: now.Add(-2 * time.Minute), Path: "/expired"})
+	for i := range 4 {
+		c.record("demo", capturedRequest{Time: now.Add(time.Duration(i) * time.Millisecond), Path: fmt.Sprint("/", i)})
+	}
+
+	requests := c.get("demo")
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(requests))
+	}
+	for i, want := range []string{"/3", "/2", "/1"} {
+		if requests[i].Path != want {
+			t.Errorf("requests[%d].Path = %q, want %q (newest first)", i, requests[i].Path, want)
+		}
+	}
+
+	if New("", "", "", "", "", nil).WithRequestCapture(0, time.Minute).capture != nil {
+		t.Error("WithRequestCapture(0) should disable capture")
+	}
+}
+
+func TestRequestCaptureEvictsExpiredSubdomains(t *testing.T) {
+	c := &requestCapture{size: 1, retention: time.Minute, requests: make(map[string][]capturedRequest)}
+	old := time.Now().Add(-time.Hour)
+	for i := range maxCaptureSubdomains {
+		c.record(fmt.Sprint("sub", i), capturedRequest{Time: old})
+	}
+	c.record("new", capturedRequest{Time: time.Now()})
+
+	if len(c.requests) != 1 || len(c.get("new")) != 1 {
+		t.Errorf("kept %d subdomains, want only the new one", len(c.requests))
+	}
+}
+
+func TestCapturedRequestsAPI(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	s.WithRequestCapture(10, time.Minute)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL+"/report?secret=1", nil)
+	req.Host = "demo.localhost"
+	req.Header.Set("User-Agent", "probe/1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	waitFor(t, time.Second, func() bool { return len(s.capture.get("demo")) == 1 })
+
+	rec := adminRequest(t, h, "GET", "/api/tunnels/demo/requests", "root-key", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var requests []capturedRequest
+	if err := json.NewDecoder(rec.Body).Decode(&requests); err != nil {
+		t.Fatal(err)
+	}
+	if got := requests[0]; got.Method != "GET" || got.Path != "/report" || got.Status != http.StatusOK || got.UserAgent != "probe/1.0" {
+		t.Errorf("captured request = %+v", got)
+	}
+
+	if rec := adminRequest(t, h, "GET", "/api/tunnels/demo/requests", "owner-key", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("owner status = %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often a mounted certificate is checked for
+// changes. Kubelet syncs updated Secrets into pods about once a minute.
+const certReloadInterval = 30 * time.Second
+
+// Files in a Kubernetes TLS Secret (type kubernetes.io/tls).
+const (
+	certFileName = "tls.crt"
+	keyFileName  = "tls.key"
+)
+
+// certReloader serves the certificate in a directory, reloading it when the
+// files change.
+type certReloader struct {
+	dir string
+
+	mu            sync.RWMutex
+	cert          *tls.Certificate
+	certPEM       []byte
+	keyPEM        []byte
+	lastReloadErr error
+}
+
+// WithCertificateDir serves the TLS certificate in dir's tls.crt and tls.key
+// instead of obtaining certificates through ACME. This is the layout of a
+// Kubernetes TLS Secret mounted as a volume, so a wildcard certificate kept
+// renewed by cert-manager is picked up without restarting the pod.
+func (s *Server) WithCertificateDir(dir string) *Server {
+	s.certs = &certReloader{dir: dir}
+	s.metrics.registry.NewGaugeFunc("otun_tls_certificate_expiry_timestamp_seconds", "Expiry of the TLS certificate loaded from the certificate directory, as a Unix timestamp.", s.certs.expiry)
+	return s
+}
+
+// reload reads the certificate files, reporting whether they changed. A
+// failed reload keeps the previous certificate, since the files may be
+// caught mid-update.
+func (c *certReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(filepath.Join(c.dir, certFileName))
+	if err != nil {
+		return false, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(c.dir, keyFileName))
+	if err != nil {
+		return false, fmt.Errorf("failed to read private key: %w", err)
+	}
+
+	c.mu.RLock()
+	unchanged := bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("invalid certificate in %s: %w", c.dir, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, fmt.Errorf("invalid certificate in %s: %w", c.dir, err)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert, c.certPEM, c.keyPEM = &cert, certPEM, keyPEM
+	c.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the certificate every certReloadInterval until done is closed.
+func (c *certReloader) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := c.reload()
+		c.mu.Lock()
+		repeated := err != nil && c.lastReloadErr != nil && err.Error() == c.lastReloadErr.Error()
+		c.lastReloadErr = err
+		c.mu.Unlock()
+
+		switch {
+		case err != nil && !repeated:
+			slog.Warn("failed to reload TLS certificate, keeping the current one", "dir", c.dir, "error", err)
+		case changed:
+			c.logLoaded("TLS certificate reloaded")
+		}
+	}
+}
+
+// logLoaded logs the subject and expiry of the current certificate.
+func (c *certReloader) logLoaded(msg string) {
+	leaf := c.leaf()
+	slog.Info(msg, "dir", c.dir, "names", leaf.DNSNames, "not_after", leaf.NotAfter)
+}
+
+// leaf returns the parsed current certificate.
+func (c *certReloader) leaf() *x509.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil
+	}
+	return c.cert.Leaf
+}
+
+// GetCertificate returns the current certificate for every handshake.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// expiry returns the current certificate's expiry as a Unix timestamp.
+func (c *certReloader) expiry() float64 {
+	leaf := c.leaf()
+	if leaf == nil {
+		return 0
+	}
+	return float64(leaf.NotAfter.Unix())
+}
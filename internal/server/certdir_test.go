@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name to dir, as a
+// mounted TLS Secret would look.
+func writeTestCert(t *testing.T, dir, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, certFileName), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, keyFileName), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	c := &certReloader{dir: dir}
+
+	if _, err := c.reload(); err == nil {
+		t.Fatal("reload() succeeded with no certificate")
+	}
+
+	writeTestCert(t, dir, "*.one.example.com")
+	if changed, err := c.reload(); err != nil || !changed {
+		t.Fatalf("reload() = %v, %v, want changed", changed, err)
+	}
+	if changed, err := c.reload(); err != nil || changed {
+		t.Errorf("reload() of unchanged files = %v, %v, want unchanged", changed, err)
+	}
+
+	// A renewed certificate replaces the current one
+	writeTestCert(t, dir, "*.two.example.com")
+	if changed, err := c.reload(); err != nil || !changed {
+		t.Fatalf("reload() = %v, %v, want changed", changed, err)
+	}
+	cert, _ := c.GetCertificate(nil)
+	if got := cert.Leaf.DNSNames[0]; got != "*.two.example.com" {
+		t.Errorf("serving %q, want *.two.example.com", got)
+	}
+	if c.expiry() == 0 {
+		t.Error("expiry() = 0")
+	}
+
+	// A key that doesn't match, as if caught mid-update, keeps the old one
+	other := t.TempDir()
+	writeTestCert(t, other, "other.example.com")
+	key, _ := os.ReadFile(filepath.Join(other, keyFileName))
+	os.WriteFile(filepath.Join(dir, keyFileName), key, 0o600)
+	if _, err := c.reload(); err == nil {
+		t.Error("reload() succeeded with a mismatched key")
+	}
+	cert, _ = c.GetCertificate(nil)
+	if got := cert.Leaf.DNSNames[0]; got != "*.two.example.com" {
+		t.Errorf("serving %q after failed reload, want *.two.example.com", got)
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"log/slog"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+const (
+	// challengeDifficulty is the leading zero bits the JS challenge's
+	// proof of work needs: about a million hashes, well under a second in
+	// a browser.
+	challengeDifficulty = 20
+
+	// challengeNonceTTL is how long a visitor has to answer a challenge.
+	challengeNonceTTL = 5 * time.Minute
+
+	// captchaTimeout bounds each CAPTCHA verification.
+	captchaTimeout = 10 * time.Second
+
+	// maxChallengeFormBytes bounds the answers read from visitors.
+	maxChallengeFormBytes = 64 << 10
+)
+
+// captchaProvider is a CAPTCHA service visitors can be challenged with.
+type captchaProvider struct {
+	siteKey   string
+	secretKey string
+
+	script    string // the widget's JavaScript
+	widget    string // class of the element the widget renders into
+	field     string // form field the widget puts its token in
+	verifyURL string
+}
+
+// newCaptchaProvider returns the provider for mode with the operator's keys,
+// or nil if mode isn't a CAPTCHA.
+func newCaptchaProvider(mode, siteKey, secretKey string) *captchaProvider {
+	p := &captchaProvider{siteKey: siteKey, secretKey: secretKey}
+	switch mode {
+	case protocol.ChallengeTurnstile:
+		p.script = "https://challenges.cloudflare.com/turnstile/v0/api.js"
+		p.widget = "cf-turnstile"
+		p.field = "cf-turnstile-response"
+		p.verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	case protocol.ChallengeHCaptcha:
+		p.script = "https://js.hcaptcha.com/1/api.js"
+		p.widget = "h-captcha"
+		p.field = "h-captcha-response"
+		p.verifyURL = "https://api.hcaptcha.com/siteverify"
+	default:
+		return nil
+	}
+	return p
+}
+
+// verify asks the provider whether token is a solved CAPTCHA.
+func (p *captchaProvider) verify(r *http.Request, token, ip string) (bool, error) {
+	form := url.Values{"secret": {p.secretKey}, "response": {token}, "remoteip": {ip}}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := (&http.Client{Timeout: captchaTimeout}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("invalid verification response: %w", err)
+	}
+	return result.Success, nil
+}
+
+// WithCaptcha lets tunnels challenge visitors with mode's CAPTCHA
+// (protocol.ChallengeTurnstile or protocol.ChallengeHCaptcha), using the
+// operator's site and secret keys. Without it, such tunnels are refused.
+func (s *Server) WithCaptcha(mode, siteKey, secretKey string) *Server {
+	if p := newCaptchaProvider(mode, siteKey, secretKey); p != nil && siteKey != "" && secretKey != "" {
+		s.captchas[mode] = p
+	}
+	return s
+}
+
+// challengePolicy puts an interstitial in front of a tunnel.
+type challengePolicy struct {
+	mode string
+	ttl  time.Duration
+}
+
+// newChallengePolicy returns the challenge requested in msg, or nil if
+// there is none. The challenge must have passed Validate.
+func newChallengePolicy(msg *protocol.RegisterMessage) *challengePolicy {
+	if msg.Challenge == nil {
+		return nil
+	}
+	mode := msg.Challenge.Mode
+	if mode == "" {
+		mode = protocol.ChallengeJS
+	}
+	return &challengePolicy{mode: mode, ttl: time.Duration(msg.Challenge.TTL) * time.Second}
+}
+
+// checkChallenge admits visitors of client's tunnel who passed its
+// challenge, if it has one. Others get the interstitial, and answers to it
+// are handled here; checkChallenge returns false for both.
+func (s *Server) checkChallenge(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	p := client.challenge
+	if p == nil {
+		return true
+	}
+	if r.URL.Path == protocol.ChallengePath {
+		s.handleChallengeAnswer(w, r, client)
+		return false
+	}
+	if c, err := r.Cookie(protocol.ChallengeCookie); err == nil && s.validPass(client.subdomain, c.Value, time.Now()) {
+		return true
+	}
+
+	back := "/"
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		back = r.URL.RequestURI()
+	}
+	s.metrics.challengesServed.Inc()
+	s.serveChallenge(w, client, back, http.StatusForbidden)
+	return false
+}
+
+// handleChallengeAnswer checks a visitor's answer to the interstitial. A
+// visitor who passed gets a cookie exempting them and is sent back where
+// they were going; one who didn't gets a new challenge.
+func (s *Server) handleChallengeAnswer(w http.ResponseWriter, r *http.Request, client *tunnelClient) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxChallengeFormBytes)
+	if err := r.ParseForm(); err != nil {
+		s.httpError(w, r, "Invalid challenge answer", http.StatusBadRequest)
+		return
+	}
+	back := r.PostForm.Get("return")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		back = "/" // only ever back into the tunnel
+	}
+
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	now := time.Now()
+	passed := false
+	if p := s.captchas[client.challenge.mode]; p != nil {
+		var err error
+		passed, err = p.verify(r, r.PostForm.Get(p.field), ip)
+		if err != nil {
+			slog.Warn("CAPTCHA verification failed", "subdomain", client.subdomain, "error", err)
+		}
+	} else if client.challenge.mode == protocol.ChallengeJS {
+		passed = s.validProofOfWork(client.subdomain, r.PostForm.Get("nonce"), r.PostForm.Get("solution"), now)
+	}
+	if !passed {
+		s.metrics.challengesFailed.Inc()
+		slog.Debug("visitor failed challenge", "subdomain", client.subdomain, "ip", ip)
+		s.serveChallenge(w, client, back, http.StatusForbidden)
+		return
+	}
+
+	s.metrics.challengesPassed.Inc()
+	expires := now.Add(client.challenge.ttl)
+	http.SetCookie(w, &http.Cookie{
+		Name:     protocol.ChallengeCookie,
+		Value:    s.issuePass(client.subdomain, expires),
+		Path:     "/",
+		MaxAge:   int(client.challenge.ttl / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// challengePage is the interstitial. The JS challenge finds a counter
+// whose FNV-1a hash with the nonce has challengeDifficulty leading zero
+// bits; FNV because crypto.subtle is missing on plain HTTP pages.
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title>
+{{- if .Captcha}}
+<script src="{{.Captcha.Script}}" async defer></script>
+{{- end}}
+</head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto;">
+<h1>Checking your browser</h1>
+<form id="challenge" method="POST" action="{{.Path}}">
+<input type="hidden" name="return" value="{{.Return}}">
+{{- if .Captcha}}
+<p>Confirm you are human to continue to this site.</p>
+<div class="{{.Captcha.Widget}}" data-sitekey="{{.Captcha.SiteKey}}" data-callback="otunSolved"></div>
+<script>function otunSolved() { document.getElementById("challenge").submit(); }</script>
+{{- else}}
+<p>This takes a moment and needs JavaScript.</p>
+<input type="hidden" name="nonce" value="{{.Nonce}}">
+<input type="hidden" name="solution" id="solution">
+<script>
+setTimeout(function () {
+  var nonce = {{.Nonce}}, difficulty = {{.Difficulty}};
+  for (var i = 0; ; i++) {
+    var s = nonce + ":" + i, h = 0x811c9dc5;
+    for (var j = 0; j < s.length; j++) {
+      h = Math.imul(h ^ s.charCodeAt(j), 0x01000193);
+    }
+    if (Math.clz32(h) >= difficulty) {
+      document.getElementById("solution").value = i;
+      document.getElementById("challenge").submit();
+      return;
+    }
+  }
+}, 0);
+</script>
+<noscript><p>Enable JavaScript to continue.</p></noscript>
+{{- end}}
+</form>
+</body>
+</html>
+`))
+
+// serveChallenge answers with the interstitial for client's tunnel, which
+// sends the visitor to back once they pass.
+func (s *Server) serveChallenge(w http.ResponseWriter, client *tunnelClient, back string, status int) {
+	data := map[string]any{
+		"Path":       protocol.ChallengePath,
+		"Return":     back,
+		"Difficulty": challengeDifficulty,
+	}
+	if p := s.captchas[client.challenge.mode]; p != nil {
+		data["Captcha"] = map[string]string{"Script": p.script, "Widget": p.widget, "SiteKey": p.siteKey}
+	} else {
+		data["Nonce"] = s.issueNonce(client.subdomain, time.Now())
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := challengePage.Execute(w, data); err != nil {
+		slog.Debug("failed to write challenge", "error", err)
+	}
+}
+
+// challengeMAC signs fields with the server's challenge key.
+func (s *Server) challengeMAC(fields ...string) string {
+	mac := hmac.New(sha256.New, s.challengeKey)
+	mac.Write([]byte(strings.Join(fields, "|")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issuePass returns a cookie value exempting visitors of subdomain from its
+// challenge until expires.
+func (s *Server) issuePass(subdomain string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + s.challengeMAC("pass", subdomain, exp)
+}
+
+// validPass reports whether value is a pass for subdomain that hasn't
+// expired at now.
+func (s *Server) validPass(subdomain, value string, now time.Time) bool {
+	exp, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= unix {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(s.challengeMAC("pass", subdomain, exp)))
+}
+
+// issueNonce returns a signed nonce for a JS challenge of subdomain.
+func (s *Server) issueNonce(subdomain string, now time.Time) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	issued := strconv.FormatInt(now.Unix(), 10)
+	random := base64.RawURLEncoding.EncodeToString(b)
+	return issued + "." + random + "." + s.challengeMAC("nonce", subdomain, issued, random)
+}
+
+// validProofOfWork reports whether solution solves a JS challenge of
+// subdomain issued with nonce less than challengeNonceTTL before now.
+func (s *Server) validProofOfWork(subdomain, nonce, solution string, now time.Time) bool {
+	parts := strings.Split(nonce, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(s.challengeMAC("nonce", subdomain, parts[0], parts[1]))) {
+		return false
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Sub(time.Unix(issued, 0)) > challengeNonceTTL {
+		return false
+	}
+	if _, err := strconv.ParseUint(solution, 10, 64); err != nil {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(nonce + ":" + solution))
+	return bits.LeadingZeros32(h.Sum32()) >= challengeDifficulty
+}
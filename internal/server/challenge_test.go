@@ -0,0 +1,208 @@
+package server
+
+import (
+	"hash/fnv"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// solveProofOfWork does what the JS challenge page does.
+func solveProofOfWork(nonce string) string {
+	for i := 0; ; i++ {
+		h := fnv.New32a()
+		h.Write([]byte(nonce + ":" + strconv.Itoa(i)))
+		if bits.LeadingZeros32(h.Sum32()) >= challengeDifficulty {
+			return strconv.Itoa(i)
+		}
+	}
+}
+
+func TestChallengePass(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	now := time.Now()
+	pass := s.issuePass("demo", now.Add(time.Hour))
+
+	tests := []struct {
+		name      string
+		subdomain string
+		value     string
+		at        time.Time
+		want      bool
+	}{
+		{"valid", "demo", pass, now, true},
+		{"expired", "demo", pass, now.Add(2 * time.Hour), false},
+		{"other tunnel", "other", pass, now, false},
+		{"extended", "demo", strconv.FormatInt(now.Add(48*time.Hour).Unix(), 10) + pass[strings.Index(pass, "."):], now, false},
+		{"garbage", "demo", "nope", now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.validPass(tt.subdomain, tt.value, tt.at); got != tt.want {
+				t.Errorf("validPass() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	now := time.Now()
+	nonce := s.issueNonce("demo", now)
+	solution := solveProofOfWork(nonce)
+
+	if !s.validProofOfWork("demo", nonce, solution, now) {
+		t.Error("valid solution refused")
+	}
+	if s.validProofOfWork("other", nonce, solution, now) {
+		t.Error("solution accepted for another tunnel")
+	}
+	if s.validProofOfWork("demo", nonce, solution, now.Add(challengeNonceTTL+time.Minute)) {
+		t.Error("solution accepted after the nonce expired")
+	}
+	if s.validProofOfWork("demo", nonce, "x", now) {
+		t.Error("non-numeric solution accepted")
+	}
+}
+
+// challengeClient is an HTTP client for the demo tunnel of a test server
+// that keeps cookies and doesn't follow redirects.
+type challengeClient struct {
+	t      *testing.T
+	url    string
+	cookie string
+}
+
+func (c *challengeClient) do(method, path string, form url.Values) *http.Response {
+	c.t.Helper()
+	req, _ := http.NewRequest(method, c.url+path, strings.NewReader(form.Encode()))
+	req.Host = "demo.localhost"
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.cookie != "" {
+		req.Header.Set("Cookie", c.cookie)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		c.t.Fatalf("request failed: %v", err)
+	}
+	for _, ck := range resp.Cookies() {
+		c.cookie = ck.Name + "=" + ck.Value
+	}
+	return resp
+}
+
+var noncePattern = regexp.MustCompile(`name="nonce" value="([^"]+)"`)
+
+func TestJSChallenge(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	s.clients["demo"].challenge = &challengePolicy{mode: protocol.ChallengeJS, ttl: time.Hour}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c := &challengeClient{t: t, url: ts.URL}
+
+	resp := c.do("GET", "/dashboard?tab=1", nil)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	m := noncePattern.FindSubmatch(body)
+	if m == nil {
+		t.Fatalf("no nonce in challenge page:\n%s", body)
+	}
+	nonce := string(m[1])
+
+	resp = c.do("POST", protocol.ChallengePath, url.Values{"nonce": {nonce}, "solution": {"0"}, "return": {"/dashboard?tab=1"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || c.cookie != "" {
+		t.Fatalf("wrong answer: status = %d, cookie %q; want %d and none", resp.StatusCode, c.cookie, http.StatusForbidden)
+	}
+
+	resp = c.do("POST", protocol.ChallengePath, url.Values{"nonce": {nonce}, "solution": {solveProofOfWork(nonce)}, "return": {"/dashboard?tab=1"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/dashboard?tab=1" {
+		t.Fatalf("answer: status = %d, Location %q; want %d to /dashboard?tab=1", resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+	if !strings.HasPrefix(c.cookie, protocol.ChallengeCookie+"=") {
+		t.Fatalf("cookie = %q, want a %s cookie", c.cookie, protocol.ChallengeCookie)
+	}
+
+	resp = c.do("GET", "/dashboard?tab=1", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("with pass: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestCaptchaChallenge(t *testing.T) {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ok := r.PostForm.Get("secret") == "secret" && r.PostForm.Get("response") == "solved"
+		io.WriteString(w, `{"success": `+strconv.FormatBool(ok)+`}`)
+	}))
+	defer verifier.Close()
+
+	s := New("", "", "", "", "", nil).WithCaptcha(protocol.ChallengeTurnstile, "site", "secret")
+	s.captchas[protocol.ChallengeTurnstile].verifyURL = verifier.URL
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	s.clients["demo"].challenge = &challengePolicy{mode: protocol.ChallengeTurnstile, ttl: time.Hour}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	c := &challengeClient{t: t, url: ts.URL}
+
+	resp := c.do("GET", "/", nil)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `data-sitekey="site"`) {
+		t.Fatalf("challenge page lacks the Turnstile widget:\n%s", body)
+	}
+
+	for _, tt := range []struct {
+		token  string
+		back   string
+		status int
+		to     string
+	}{
+		{"forged", "/", http.StatusForbidden, ""},
+		{"solved", "//evil.example", http.StatusSeeOther, "/"},
+	} {
+		resp := c.do("POST", protocol.ChallengePath, url.Values{"cf-turnstile-response": {tt.token}, "return": {tt.back}})
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || resp.Header.Get("Location") != tt.to {
+			t.Errorf("token %q: status = %d, Location %q; want %d, %q", tt.token, resp.StatusCode, resp.Header.Get("Location"), tt.status, tt.to)
+		}
+	}
+
+	resp = c.do("GET", "/", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("with pass: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestChallengeRegistration(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	reply, _ := registerSession(t, s, &protocol.RegisterMessage{Challenge: &protocol.Challenge{Mode: protocol.ChallengeHCaptcha, TTL: 3600}})
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeInvalidChallenge {
+		t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeInvalidChallenge)
+	}
+
+	registered, _ := mustRegister(t, s, &protocol.RegisterMessage{Challenge: &protocol.Challenge{TTL: 3600}})
+	if client := s.lookupClient(registered.Subdomain); client == nil || client.challenge == nil || client.challenge.mode != protocol.ChallengeJS {
+		t.Error("registered tunnel has no JS challenge")
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxChaosDelay bounds the registration delay, which holds a session
+	// slot and the client's connection for its whole length.
+	maxChaosDelay = 5 * time.Minute
+
+	// minChaosKillInterval is the shortest interval at which sessions may
+	// be killed, so a typo can't keep every client from staying connected.
+	minChaosKillInterval = time.Second
+)
+
+// errChaosDrop is returned for streams dropped by fault injection.
+var errChaosDrop = errors.New("stream dropped by chaos testing")
+
+// chaosSettings are the faults the server injects. The zero value injects
+// none.
+type chaosSettings struct {
+	// DropStreams is the percentage of tunnel streams reset right after
+	// being opened
+	DropStreams int `json:"drop_streams"`
+
+	// RegistrationDelayMS holds each registration this long before
+	// answering it
+	RegistrationDelayMS int64 `json:"registration_delay_ms"`
+
+	// KillIntervalMS kills a random client session this often (0 = never)
+	KillIntervalMS int64 `json:"kill_interval_ms"`
+}
+
+// validate checks that the settings are in range.
+func (c chaosSettings) validate() error {
+	switch {
+	case c.DropStreams < 0 || c.DropStreams > 100:
+		return errors.New("drop_streams must be between 0 and 100")
+	case c.RegistrationDelayMS < 0 || time.Duration(c.RegistrationDelayMS)*time.Millisecond > maxChaosDelay:
+		return errors.New("registration_delay_ms must be between 0 and 300000")
+	case c.KillIntervalMS < 0 || (c.KillIntervalMS > 0 && time.Duration(c.KillIntervalMS)*time.Millisecond < minChaosKillInterval):
+		return errors.New("kill_interval_ms must be 0 or at least 1000")
+	}
+	return nil
+}
+
+// chaos injects faults to let operators check how clients and alerting
+// cope with failures. A nil *chaos injects none.
+type chaos struct {
+	metrics *serverMetrics
+
+	mu       sync.Mutex
+	settings chaosSettings
+	changed  chan struct{} // wakes run when the kill interval changes
+}
+
+// WithChaos enables fault injection, controlled through the admin API. It
+// starts out injecting nothing.
+func (s *Server) WithChaos(enabled bool) *Server {
+	if enabled {
+		s.chaos = &chaos{metrics: s.metrics, changed: make(chan struct{}, 1)}
+	} else {
+		s.chaos = nil
+	}
+	return s
+}
+
+// get returns the current settings.
+func (c *chaos) get() chaosSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+// set replaces the settings.
+func (c *chaos) set(settings chaosSettings) {
+	c.mu.Lock()
+	c.settings = settings
+	c.mu.Unlock()
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// dropStream reports whether to drop a newly opened stream.
+func (c *chaos) dropStream() bool {
+	if c == nil {
+		return false
+	}
+	percent := c.get().DropStreams
+	if percent == 0 || rand.IntN(100) >= percent {
+		return false
+	}
+	c.metrics.chaosStreamsDropped.Inc()
+	return true
+}
+
+// delayRegistration waits out the registration delay, if any.
+func (c *chaos) delayRegistration() {
+	if c == nil {
+		return
+	}
+	delay := time.Duration(c.get().RegistrationDelayMS) * time.Millisecond
+	if delay == 0 {
+		return
+	}
+	c.metrics.chaosRegistrationsDelayed.Inc()
+	time.Sleep(delay)
+}
+
+// run calls kill at the kill interval until done is closed.
+func (c *chaos) run(done <-chan struct{}, kill func()) {
+	for {
+		interval := time.Duration(c.get().KillIntervalMS) * time.Millisecond
+		timer := time.NewTimer(interval)
+		tick := timer.C
+		if interval == 0 {
+			timer.Stop()
+			tick = nil
+		}
+		select {
+		case <-tick:
+			kill()
+		case <-c.changed:
+			timer.Stop()
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// killRandomSession closes the session of a random connected client, as
+// though its connection had failed, and returns the subdomain or port it
+// served ("" if none is connected).
+func (s *Server) killRandomSession() string {
+	s.mu.Lock()
+	var victims []*tunnelClient
+	for _, client := range s.clients {
+		victims = append(victims, client)
+	}
+	for _, client := range s.canaries {
+		victims = append(victims, client)
+	}
+	for _, client := range s.tcpTunnels {
+		victims = append(victims, client)
+	}
+	if len(victims) == 0 {
+		s.mu.Unlock()
+		return ""
+	}
+	victim := victims[rand.IntN(len(victims))]
+	victim.closeReason = "killed by chaos testing"
+	s.mu.Unlock()
+
+	name := victim.subdomain
+	if victim.remotePort != 0 {
+		name = strconv.Itoa(victim.remotePort)
+	}
+	slog.Warn("chaos: killing session", "tunnel", name, "remote_addr", victim.remoteAddr)
+	s.metrics.chaosSessionsKilled.Inc()
+	victim.session.Close()
+	return name
+}
+
+// handleGetChaos returns the fault injection settings.
+func (s *Server) handleGetChaos(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeChaos(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.chaos.get())
+}
+
+// handleSetChaos replaces the fault injection settings. Omitted fields are
+// turned off.
+func (s *Server) handleSetChaos(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeChaos(w, r) {
+		return
+	}
+	var settings chaosSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := settings.validate(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.chaos.set(settings)
+	slog.Warn("chaos settings changed", "drop_streams", settings.DropStreams,
+		"registration_delay_ms", settings.RegistrationDelayMS, "kill_interval_ms", settings.KillIntervalMS)
+	s.audit("chaos settings changed", "drop_streams", settings.DropStreams,
+		"registration_delay_ms", settings.RegistrationDelayMS, "kill_interval_ms", settings.KillIntervalMS)
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// handleResetChaos turns all fault injection off.
+func (s *Server) handleResetChaos(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeChaos(w, r) {
+		return
+	}
+	s.chaos.set(chaosSettings{})
+	slog.Info("chaos settings reset")
+	s.audit("chaos settings reset")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleChaosKill kills a random client session right away.
+func (s *Server) handleChaosKill(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeChaos(w, r) {
+		return
+	}
+	killed := s.killRandomSession()
+	if killed == "" {
+		writeJSONError(w, http.StatusNotFound, "no tunnels connected")
+		return
+	}
+	s.audit("chaos session killed", "tunnel", killed)
+	writeJSON(w, http.StatusOK, map[string]string{"killed": killed})
+}
+
+// authorizeChaos answers requests to the chaos endpoints that aren't from
+// the admin, or when fault injection is disabled, and reports whether the
+// request may proceed.
+func (s *Server) authorizeChaos(w http.ResponseWriter, r *http.Request) bool {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || !caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "admin key required")
+		return false
+	}
+	if s.chaos == nil {
+		writeJSONError(w, http.StatusNotFound, "chaos testing is disabled; start the server with -chaos")
+		return false
+	}
+	return true
+}
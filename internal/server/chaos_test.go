@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestChaosSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings chaosSettings
+		wantErr  bool
+	}{
+		{name: "none", settings: chaosSettings{}},
+		{name: "all", settings: chaosSettings{DropStreams: 100, RegistrationDelayMS: 300000, KillIntervalMS: 1000}},
+		{name: "drop over 100", settings: chaosSettings{DropStreams: 101}, wantErr: true},
+		{name: "negative drop", settings: chaosSettings{DropStreams: -1}, wantErr: true},
+		{name: "delay too long", settings: chaosSettings{RegistrationDelayMS: 300001}, wantErr: true},
+		{name: "kill too often", settings: chaosSettings{KillIntervalMS: 10}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChaosAPI(t *testing.T) {
+	if rec := adminRequest(t, New("", "", "", "", "", nil).WithAdmin("", "root-key").adminHandler(), "GET", "/api/chaos", "root-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("without -chaos: status %d, want 404", rec.Code)
+	}
+
+	s, h := newSharingTestServer(t)
+	s.WithChaos(true)
+
+	if rec := adminRequest(t, h, "PUT", "/api/chaos", "owner-key", `{"drop_streams": 10}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("set by client key: status %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, h, "PUT", "/api/chaos", "root-key", `{"drop_streams": 200}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("set invalid: status %d, want 400", rec.Code)
+	}
+	if rec := adminRequest(t, h, "PUT", "/api/chaos", "root-key", `{"drop_streams": 10, "kill_interval_ms": 60000}`); rec.Code != http.StatusOK {
+		t.Fatalf("set: status %d: %s", rec.Code, rec.Body)
+	}
+	var got chaosSettings
+	json.NewDecoder(adminRequest(t, h, "GET", "/api/chaos", "root-key", "").Body).Decode(&got)
+	if want := (chaosSettings{DropStreams: 10, KillIntervalMS: 60000}); got != want {
+		t.Errorf("settings = %+v, want %+v", got, want)
+	}
+
+	if rec := adminRequest(t, h, "DELETE", "/api/chaos", "root-key", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("reset: status %d, want 204", rec.Code)
+	}
+	if got := s.chaos.get(); got != (chaosSettings{}) {
+		t.Errorf("settings after reset = %+v, want none", got)
+	}
+}
+
+func TestChaosKill(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	s.WithChaos(true)
+
+	if rec := adminRequest(t, h, "POST", "/api/chaos/kill", "root-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("kill without tunnels: status %d, want 404", rec.Code)
+	}
+
+	session := registerTestTunnel(t, s, "demo")
+	rec := adminRequest(t, h, "POST", "/api/chaos/kill", "root-key", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("kill: status %d: %s", rec.Code, rec.Body)
+	}
+	var body map[string]string
+	json.NewDecoder(rec.Body).Decode(&body)
+	if body["killed"] != "demo" {
+		t.Errorf("killed = %q, want demo", body["killed"])
+	}
+	waitFor(t, 2*time.Second, func() bool { return session.IsClosed() })
+}
+
+func TestChaosKillInterval(t *testing.T) {
+	c := &chaos{metrics: newServerMetrics(), changed: make(chan struct{}, 1)}
+	kills := make(chan struct{}, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go c.run(done, func() { kills <- struct{}{} })
+
+	select {
+	case <-kills:
+		t.Fatal("killed with no kill interval")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.set(chaosSettings{KillIntervalMS: 10})
+	select {
+	case <-kills:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no kill after the kill interval was set")
+	}
+}
+
+func TestChaosDropStreams(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithChaos(true)
+	hs, _ := registerHealthTunnel(t, s, "demo")
+
+	s.chaos.set(chaosSettings{DropStreams: 100})
+	if _, err := hs.OpenStream(); !errors.Is(err, errChaosDrop) {
+		t.Errorf("OpenStream() error = %v, want %v", err, errChaosDrop)
+	}
+
+	s.chaos.set(chaosSettings{})
+	stream, err := hs.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream() error = %v", err)
+	}
+	stream.Close()
+	if got := s.metrics.chaosStreamsDropped.Value(); got != 1 {
+		t.Errorf("streams dropped = %v, want 1", got)
+	}
+}
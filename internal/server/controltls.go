@@ -0,0 +1,21 @@
+package server
+
+import "crypto/tls"
+
+// WithControlTLS makes the control listeners serve TLS, so API keys and
+// tunnel traffic aren't readable on the wire. The certificate is the one
+// HTTPS serves from the certificate directory or, through ACME, one for the
+// server's domain itself, which clients must connect to by name. Clients
+// must then connect with TLS too.
+func (s *Server) WithControlTLS(enabled bool) *Server {
+	s.controlTLS = enabled
+	return s
+}
+
+// newControlTLSConfig returns the TLS config of the control listeners.
+func newControlTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+)
+
+func TestControlTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "tunnel.localhost")
+	pem, err := os.ReadFile(filepath.Join(dir, certFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	s := New("", "", "", "", "", nil).WithCertificateDir(dir).WithControlTLS(true).WithSpeedTest(1 << 16)
+	getCertificate, _, err := s.certificateSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.controlTLSConfig = newControlTLSConfig(getCertificate)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &controlListener{addr: ln.Addr().String()}
+	cl.set(ln)
+	go s.acceptTunnelClients(cl)
+	t.Cleanup(func() {
+		close(s.done)
+		cl.close()
+	})
+
+	tests := []struct {
+		name    string
+		cfg     *tls.Config
+		wantErr bool
+	}{
+		{"verified", &tls.Config{RootCAs: pool, ServerName: "tunnel.localhost"}, false},
+		{"insecure", &tls.Config{InsecureSkipVerify: true}, false},
+		{"untrusted certificate", &tls.Config{ServerName: "tunnel.localhost"}, true},
+		{"plain TCP", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client.New(cl.addr, "localhost:1").WithTLSConfig(tt.cfg)
+			_, err := c.SpeedTest(context.Background(), 1<<16)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SpeedTest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/dnsprovider"
+)
+
+// challengeLabel is prepended to a custom domain to name its ownership
+// challenge TXT record.
+const challengeLabel = "_otun-challenge."
+
+// dnsTimeout bounds TXT lookups and DNS provider calls.
+const dnsTimeout = 30 * time.Second
+
+// customDomain maps a domain the user controls to one of their tunnels.
+type customDomain struct {
+	Domain     string        `json:"domain"`
+	Subdomain  string        `json:"subdomain"`
+	Target     string        `json:"cname_target"`
+	Challenge  *dnsChallenge `json:"challenge,omitempty"`
+	Verified   bool          `json:"verified"`
+	VerifiedAt *time.Time    `json:"verified_at,omitempty"`
+	DNSRecord  string        `json:"dns_record,omitempty"` // status of automatic CNAME creation
+	LastError  string        `json:"last_error,omitempty"`
+
+	owner string // token that added the domain
+}
+
+// dnsChallenge is the TXT record that proves control of a domain.
+type dnsChallenge struct {
+	Name  string `json:"txt_name"`
+	Value string `json:"txt_value"`
+}
+
+// domainRequest is the body of a custom domain request.
+type domainRequest struct {
+	Domain    string `json:"domain"`
+	Subdomain string `json:"subdomain"`
+}
+
+// WithCustomDomains lets clients serve tunnels on domains they own, added
+// through the admin API. If verify is set, the domain must publish a TXT
+// challenge before traffic is routed to it. If provider is non-nil, the
+// domain's CNAME is created through it once verified.
+func (s *Server) WithCustomDomains(verify bool, provider dnsprovider.Provider) *Server {
+	s.customDomains = true
+	s.verifyDomains = verify
+	s.dnsProvider = provider
+	return s
+}
+
+// normalizeHost lowercases host and strips any port and trailing dot.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(stripPort(host)), ".")
+}
+
+// subdomainForHost returns the subdomain serving host: the tunnel a verified
+// custom domain points at, or the first label of a host under the server's
+// domain.
+func (s *Server) subdomainForHost(host string) string {
+	if s.customDomains {
+		s.mu.RLock()
+		d := s.domains[normalizeHost(host)]
+		s.mu.RUnlock()
+		if d != nil && d.Verified {
+			return d.Subdomain
+		}
+	}
+	return extractSubdomain(host)
+}
+
+// cnameTarget returns the hostname a custom domain for subdomain must point at.
+func (s *Server) cnameTarget(subdomain string) string {
+	if s.domain == "" {
+		return subdomain + ".localhost"
+	}
+	return subdomain + "." + s.domain
+}
+
+// validCustomDomain reports whether name may be added as a custom domain.
+func (s *Server) validCustomDomain(name string) bool {
+	if !strings.Contains(name, ".") || strings.ContainsAny(name, "/:@ ") || net.ParseIP(name) != nil {
+		return false
+	}
+	return s.domain == "" || (name != s.domain && !strings.HasSuffix(name, "."+s.domain))
+}
+
+// domainView returns a copy of d safe to encode after s.mu is released.
+// Must be called with s.mu held.
+func domainView(d *customDomain) customDomain {
+	v := *d
+	if d.Challenge != nil {
+		c := *d.Challenge
+		v.Challenge = &c
+	}
+	return v
+}
+
+// canManageDomain reports whether caller may change d.
+// Must be called with s.mu held.
+func (s *Server) canManageDomain(caller adminCaller, d *customDomain) bool {
+	return caller.admin || d.owner == caller.token
+}
+
+func (s *Server) handleListDomains(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+
+	s.mu.RLock()
+	domains := make([]customDomain, 0, len(s.domains))
+	for _, d := range s.domains {
+		if s.canManageDomain(caller, d) || s.canInspect(caller, d.Subdomain) {
+			domains = append(domains, domainView(d))
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(domains, func(a, b customDomain) int { return strings.Compare(a.Domain, b.Domain) })
+	writeJSON(w, http.StatusOK, domains)
+}
+
+func (s *Server) handleGetDomain(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+
+	s.mu.RLock()
+	d := s.domains[normalizeHost(r.PathValue("domain"))]
+	visible := d != nil && (s.canManageDomain(caller, d) || s.canInspect(caller, d.Subdomain))
+	var view customDomain
+	if visible {
+		view = domainView(d)
+	}
+	s.mu.RUnlock()
+
+	if !visible {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (s *Server) handleAddDomain(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	if !s.customDomains {
+		writeJSONError(w, http.StatusNotFound, "custom domains are disabled on this server")
+		return
+	}
+
+	var req domainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	name := normalizeHost(req.Domain)
+	if !s.validCustomDomain(name) || req.Subdomain == "" {
+		writeJSONError(w, http.StatusBadRequest, "a domain outside the server's domain and a subdomain are required")
+		return
+	}
+
+	value := make([]byte, 16)
+	rand.Read(value)
+	d := &customDomain{
+		Domain:    name,
+		Subdomain: req.Subdomain,
+		Target:    s.cnameTarget(req.Subdomain),
+		Challenge: &dnsChallenge{Name: challengeLabel + name, Value: hex.EncodeToString(value)},
+		owner:     caller.token,
+	}
+	if !s.verifyDomains {
+		d.Challenge = nil
+	}
+
+	s.mu.Lock()
+	if !caller.admin && !s.hasRight(req.Subdomain, caller.token, RightPublish) {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusForbidden, "you may only add domains for tunnels you can publish")
+		return
+	}
+	if _, exists := s.domains[name]; exists {
+		s.mu.Unlock()
+		writeJSONError(w, http.StatusConflict, "domain already added")
+		return
+	}
+	s.domains[name] = d
+	s.mu.Unlock()
+
+	slog.Info("custom domain added", "domain", name, "subdomain", req.Subdomain)
+	s.audit("custom domain added", "domain", name, "subdomain", req.Subdomain, "by", caller.id())
+
+	if !s.verifyDomains {
+		s.activateDomain(r.Context(), d)
+	}
+
+	s.mu.RLock()
+	view := domainView(d)
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusCreated, view)
+}
+
+func (s *Server) handleVerifyDomain(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+
+	s.mu.RLock()
+	d := s.domains[normalizeHost(r.PathValue("domain"))]
+	allowed := d != nil && s.canManageDomain(caller, d)
+	var challenge *dnsChallenge
+	if allowed {
+		challenge = d.Challenge
+	}
+	s.mu.RUnlock()
+
+	if !allowed {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+
+	if challenge != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), dnsTimeout)
+		records, err := s.lookupTXT(ctx, challenge.Name)
+		cancel()
+		if err != nil || !slices.Contains(records, challenge.Value) {
+			s.mu.Lock()
+			d.LastError = "TXT record " + challenge.Name + " not found or doesn't match"
+			view := domainView(d)
+			s.mu.Unlock()
+			writeJSON(w, http.StatusOK, view)
+			return
+		}
+		slog.Info("custom domain verified", "domain", d.Domain)
+		s.audit("custom domain verified", "domain", d.Domain, "subdomain", d.Subdomain, "by", caller.id())
+	}
+
+	s.activateDomain(r.Context(), d)
+
+	s.mu.RLock()
+	view := domainView(d)
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, view)
+}
+
+// activateDomain marks d verified, so traffic to it is routed, and creates
+// its CNAME through the DNS provider, if one is configured.
+func (s *Server) activateDomain(ctx context.Context, d *customDomain) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	d.Verified = true
+	d.VerifiedAt = &now
+	d.Challenge = nil
+	d.LastError = ""
+	s.mu.Unlock()
+
+	if s.dnsProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	status := "created by " + s.dnsProvider.Name()
+	if err := s.dnsProvider.SetCNAME(ctx, d.Domain, d.Target); err != nil {
+		slog.Warn("failed to create CNAME for custom domain", "domain", d.Domain, "provider", s.dnsProvider.Name(), "error", err)
+		status = "not created: " + err.Error()
+	}
+	s.mu.Lock()
+	d.DNSRecord = status
+	s.mu.Unlock()
+}
+
+func (s *Server) handleDeleteDomain(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	name := normalizeHost(r.PathValue("domain"))
+
+	s.mu.Lock()
+	d := s.domains[name]
+	allowed := d != nil && s.canManageDomain(caller, d)
+	if allowed {
+		delete(s.domains, name)
+	}
+	s.mu.Unlock()
+
+	if !allowed {
+		writeJSONError(w, http.StatusNotFound, "domain not found")
+		return
+	}
+	slog.Info("custom domain removed", "domain", name)
+	s.audit("custom domain removed", "domain", name, "by", caller.id())
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// fakeDNSProvider records the CNAMEs it was asked to create.
+type fakeDNSProvider struct {
+	records map[string]string
+	err     error
+}
+
+func (p *fakeDNSProvider) Name() string { return "fake" }
+
+func (p *fakeDNSProvider) SetCNAME(_ context.Context, name, target string) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.records[name] = target
+	return nil
+}
+
+func TestCustomDomainVerification(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	provider := &fakeDNSProvider{records: make(map[string]string)}
+	s.WithCustomDomains(true, provider)
+	txt := map[string][]string{}
+	s.lookupTXT = func(_ context.Context, name string) ([]string, error) {
+		if v, ok := txt[name]; ok {
+			return v, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	const body = `{"domain": "App.Example.org", "subdomain": "demo"}`
+	if rec := adminRequest(t, h, "POST", "/api/domains", "other-key", body); rec.Code != http.StatusForbidden {
+		t.Fatalf("add by non-owner: status = %d, want 403", rec.Code)
+	}
+	if rec := adminRequest(t, h, "POST", "/api/domains", "owner-key", `{"domain": "x.demo.localhost", "subdomain": ""}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("add without subdomain: status = %d, want 400", rec.Code)
+	}
+
+	rec := adminRequest(t, h, "POST", "/api/domains", "owner-key", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	var added customDomain
+	json.Unmarshal(rec.Body.Bytes(), &added)
+	if added.Domain != "app.example.org" || added.Verified || added.Challenge == nil {
+		t.Fatalf("added = %+v", added)
+	}
+	if added.Challenge.Name != "_otun-challenge.app.example.org" {
+		t.Errorf("challenge name = %q", added.Challenge.Name)
+	}
+	if rec := adminRequest(t, h, "POST", "/api/domains", "owner-key", body); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate add: status = %d, want 409", rec.Code)
+	}
+
+	// Unverified domains aren't routed
+	if got := s.subdomainForHost("app.example.org"); got == "demo" {
+		t.Error("unverified domain routed to its tunnel")
+	}
+
+	// Verification fails until the TXT record is published
+	rec = adminRequest(t, h, "POST", "/api/domains/app.example.org/verify", "owner-key", "")
+	var status customDomain
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if status.Verified || status.LastError == "" {
+		t.Fatalf("verify without TXT = %+v, want unverified with an error", status)
+	}
+
+	txt[added.Challenge.Name] = []string{"unrelated", added.Challenge.Value}
+	if rec := adminRequest(t, h, "POST", "/api/domains/app.example.org/verify", "other-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("verify by non-owner: status = %d, want 404", rec.Code)
+	}
+	rec = adminRequest(t, h, "POST", "/api/domains/app.example.org/verify", "owner-key", "")
+	status = customDomain{}
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if !status.Verified || status.LastError != "" || status.DNSRecord != "created by fake" {
+		t.Fatalf("verify = %+v", status)
+	}
+	if got := provider.records["app.example.org"]; got != "demo.localhost" {
+		t.Errorf("CNAME target = %q, want demo.localhost", got)
+	}
+
+	if got := s.subdomainForHost("APP.example.org:443"); got != "demo" {
+		t.Errorf("subdomainForHost() = %q, want demo", got)
+	}
+
+	// Only the owner (or an admin) sees and manages the domain
+	var list []customDomain
+	json.Unmarshal(adminRequest(t, h, "GET", "/api/domains", "other-key", "").Body.Bytes(), &list)
+	if len(list) != 0 {
+		t.Errorf("other-key sees %d domains, want 0", len(list))
+	}
+	json.Unmarshal(adminRequest(t, h, "GET", "/api/domains", "root-key", "").Body.Bytes(), &list)
+	if len(list) != 1 {
+		t.Errorf("admin sees %d domains, want 1", len(list))
+	}
+	if rec := adminRequest(t, h, "DELETE", "/api/domains/app.example.org", "other-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("delete by non-owner: status = %d, want 404", rec.Code)
+	}
+	if rec := adminRequest(t, h, "DELETE", "/api/domains/app.example.org", "owner-key", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: status = %d, want 204", rec.Code)
+	}
+	if got := s.subdomainForHost("app.example.org"); got == "demo" {
+		t.Error("removed domain still routed")
+	}
+}
+
+func TestCustomDomainWithoutVerification(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	provider := &fakeDNSProvider{err: errors.New("zone not found")}
+	s.WithCustomDomains(false, provider)
+
+	rec := adminRequest(t, h, "POST", "/api/domains", "owner-key", `{"domain": "app.example.org", "subdomain": "demo"}`)
+	var added customDomain
+	json.Unmarshal(rec.Body.Bytes(), &added)
+	if !added.Verified || added.Challenge != nil {
+		t.Errorf("added = %+v, want verified without a challenge", added)
+	}
+	if added.DNSRecord != "not created: zone not found" {
+		t.Errorf("dns_record = %q", added.DNSRecord)
+	}
+}
+
+func TestCustomDomainsDisabled(t *testing.T) {
+	_, h := newSharingTestServer(t)
+	rec := adminRequest(t, h, "POST", "/api/domains", "owner-key", `{"domain": "app.example.org", "subdomain": "demo"}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+}
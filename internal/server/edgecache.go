@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedHeadBytes bounds the response head read to find validators;
+// larger responses aren't cached.
+const maxCachedHeadBytes = 64 << 10
+
+// cachedHeaders are copied from the cached response into 304 responses.
+var cachedHeaders = []string{"Cache-Control", "Content-Location", "ETag", "Expires", "Last-Modified"}
+
+// edgeCache remembers the validators (ETag and Last-Modified) of fresh,
+// publicly cacheable responses, so conditional requests for them can be
+// answered with 304 Not Modified at the edge without a trip through the
+// tunnel. Response bodies are never stored.
+type edgeCache struct {
+	maxEntries int
+	metrics    *serverMetrics
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // cache key -> element holding *cacheEntry
+	lru     *list.List               // most recently used first
+}
+
+// cacheEntry holds the validators of one response.
+type cacheEntry struct {
+	key          string
+	client       *tunnelClient // tunnel that served the response
+	header       http.Header
+	etag         string
+	lastModified time.Time
+	stored       time.Time
+	expires      time.Time
+	age          time.Duration // Age the response already had when stored
+}
+
+// WithEdgeCache remembers the validators of up to maxEntries responses that
+// are fresh and publicly cacheable per their Cache-Control, answering
+// matching If-None-Match and If-Modified-Since requests with 304 directly.
+// 0 disables the cache.
+func (s *Server) WithEdgeCache(maxEntries int) *Server {
+	s.edgeCache = nil
+	if maxEntries > 0 {
+		s.edgeCache = &edgeCache{
+			maxEntries: maxEntries,
+			metrics:    s.metrics,
+			entries:    make(map[string]*list.Element),
+			lru:        list.New(),
+		}
+	}
+	s.metrics.registry.NewGaugeFunc("otun_edge_cache_entries", "Responses whose validators are held in the edge cache.", s.edgeCache.len)
+	return s
+}
+
+// cacheKey identifies a resource; GET and HEAD share validators.
+func cacheKey(r *http.Request) string {
+	return normalizeHost(r.Host) + r.URL.RequestURI()
+}
+
+// cacheableRequest reports whether r may be answered from, or fill, a
+// shared cache.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || isUpgrade(r) {
+		return false
+	}
+	// The visitor asked for the origin to revalidate
+	cc := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := cc["no-cache"]
+	return !noCache && r.Header.Get("Pragma") != "no-cache"
+}
+
+// serveNotModified answers a conditional request with 304 if the cached
+// validators for client's resource satisfy it, reporting whether it did.
+func (c *edgeCache) serveNotModified(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	if c == nil || !cacheableRequest(r) {
+		return false
+	}
+	if r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		return false
+	}
+
+	now := time.Now()
+	e := c.get(cacheKey(r))
+	if e == nil || e.client != client || !now.Before(e.expires) || !e.notModified(r) || tooOld(r, e.currentAge(now)) {
+		c.metrics.edgeCacheMisses.Inc()
+		return false
+	}
+
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(e.currentAge(now).Seconds())))
+	w.WriteHeader(http.StatusNotModified)
+	c.metrics.edgeCacheNotModified.Inc()
+	return true
+}
+
+// currentAge returns how old the cached response is now.
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.stored)
+}
+
+// tooOld reports whether the visitor's Cache-Control max-age rules out an
+// answer of the given age; browsers send max-age=0 when reloading.
+func tooOld(r *http.Request, age time.Duration) bool {
+	v, ok := parseCacheControl(r.Header.Get("Cache-Control"))["max-age"]
+	if !ok {
+		return false
+	}
+	secs, err := strconv.Atoi(v)
+	return err != nil || age > time.Duration(secs)*time.Second
+}
+
+// observer returns a function that stores the validators of the response
+// head it's given, or nil if r's response can't be cached.
+func (c *edgeCache) observer(r *http.Request, client *tunnelClient) func(head []byte) {
+	if c == nil || !cacheableRequest(r) {
+		return nil
+	}
+	return func(head []byte) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), r)
+		if err != nil {
+			return
+		}
+		c.store(cacheKey(r), client, resp, time.Now())
+	}
+}
+
+// store caches resp's validators under key if resp is cacheable, and
+// otherwise drops whatever was cached for key, since it's been superseded.
+func (c *edgeCache) store(key string, client *tunnelClient, resp *http.Response, now time.Time) {
+	e := newCacheEntry(resp, now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	if e == nil {
+		return
+	}
+
+	e.key, e.client = key, client
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.metrics.edgeCacheStores.Inc()
+}
+
+// get returns the entry for key, marking it recently used.
+func (c *edgeCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// len returns the number of cached entries.
+func (c *edgeCache) len() float64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return float64(c.lru.Len())
+}
+
+// newCacheEntry returns the validators of resp, or nil if a shared cache
+// may not reuse them: the response must be a 200 with a validator and an
+// explicit freshness lifetime, and mustn't be private, set cookies or vary.
+func newCacheEntry(resp *http.Response, now time.Time) *cacheEntry {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	h := resp.Header
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") != "" {
+		return nil
+	}
+	cc := parseCacheControl(h.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+
+	e := &cacheEntry{header: make(http.Header), etag: h.Get("ETag"), stored: now}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		e.lastModified = lm
+	}
+	if e.etag == "" && e.lastModified.IsZero() {
+		return nil
+	}
+	if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+		e.age = time.Duration(age) * time.Second
+	}
+
+	lifetime := freshnessLifetime(h, cc)
+	if lifetime <= e.age {
+		return nil
+	}
+	e.expires = now.Add(lifetime - e.age)
+
+	for _, k := range cachedHeaders {
+		if v := h.Values(k); len(v) > 0 {
+			e.header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	return e
+}
+
+// freshnessLifetime returns how long a response stays fresh in a shared
+// cache: s-maxage, then max-age, then Expires relative to Date.
+func freshnessLifetime(h http.Header, cc map[string]string) time.Duration {
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	expires, err := http.ParseTime(h.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	return expires.Sub(date)
+}
+
+// notModified reports whether r's preconditions say the visitor's copy
+// matches e. If-None-Match takes precedence over If-Modified-Since.
+func (e *cacheEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Values("If-None-Match"); len(inm) > 0 {
+		return e.etag != "" && etagMatches(strings.Join(inm, ","), e.etag)
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !e.lastModified.IsZero() && !e.lastModified.After(ims)
+}
+
+// etagMatches weakly compares etag against a list of entity tags.
+func etagMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase
+// directives and their (unquoted) values.
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if name == "" {
+			continue
+		}
+		cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return cc
+}
+
+// headConn passes the head of the first final response read from a raw
+// upstream connection to onHead, skipping interim (1xx) responses. Heads
+// over maxCachedHeadBytes are ignored.
+type headConn struct {
+	net.Conn
+	onHead func(head []byte)
+	head   []byte
+	done   bool
+	tail   uint32 // last four bytes, to find the end of a head
+}
+
+func (c *headConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, ch := range b[:n] {
+		if c.done {
+			break
+		}
+		c.head = append(c.head, ch)
+		c.tail = c.tail<<8 | uint32(ch)
+		if len(c.head) > maxCachedHeadBytes {
+			c.done, c.head = true, nil
+			break
+		}
+		if c.tail != 0x0d0a0d0a { // "\r\n\r\n"
+			continue
+		}
+		if len(c.head) >= statusLineLen {
+			status, _ := strconv.Atoi(string(c.head[9:12]))
+			if !isInterim(status) {
+				c.done = true
+				c.onHead(c.head)
+				c.head = nil
+				break
+			}
+		}
+		c.head = c.head[:0]
+	}
+	return n, err
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEdgeCacheConditionalRequests(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithEdgeCache(10)
+	session := registerTestTunnel(t, s, "app")
+	go serveTunnelStreams(session, "HTTP/1.1 200 OK\r\n"+
+		"ETag: \"v1\"\r\n"+
+		"Last-Modified: Mon, 02 Jan 2006 15:04:05 GMT\r\n"+
+		"Cache-Control: public, max-age=60\r\n"+
+		"Content-Length: 2\r\n\r\nok")
+
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://app.localhost/app.js", nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Nothing cached yet
+	if rec := get("If-None-Match", `"v1"`); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200 from the tunnel", rec.Code)
+	}
+
+	tests := []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{name: "matching etag", header: []string{"If-None-Match", `"v1"`}, want: http.StatusNotModified},
+		{name: "weak etag in list", header: []string{"If-None-Match", `"v0", W/"v1"`}, want: http.StatusNotModified},
+		{name: "other etag", header: []string{"If-None-Match", `"v2"`}, want: http.StatusOK},
+		{name: "not modified since", header: []string{"If-Modified-Since", "Tue, 03 Jan 2006 00:00:00 GMT"}, want: http.StatusNotModified},
+		{name: "modified since", header: []string{"If-Modified-Since", "Sun, 01 Jan 2006 00:00:00 GMT"}, want: http.StatusOK},
+		{name: "reload", header: []string{"If-None-Match", `"v1"`, "Cache-Control", "max-age=0"}, want: http.StatusOK},
+		{name: "authorized", header: []string{"If-None-Match", `"v1"`, "Authorization", "Bearer x"}, want: http.StatusOK},
+		{name: "unconditional", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(tt.header...)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusNotModified {
+				if got := rec.Header().Get("ETag"); got != `"v1"` {
+					t.Errorf("ETag = %q, want \"v1\"", got)
+				}
+				if rec.Header().Get("Age") == "" || rec.Header().Get("Cache-Control") == "" {
+					t.Errorf("304 missing caching headers: %v", rec.Header())
+				}
+			}
+		})
+	}
+
+	if got := s.metrics.edgeCacheNotModified.Value(); got != 3 {
+		t.Errorf("not modified = %d, want 3", got)
+	}
+	if got := s.metrics.edgeCacheMisses.Value(); got != 4 {
+		t.Errorf("misses = %d, want 4", got)
+	}
+
+	// A new client for the subdomain may serve different content
+	unregisterTestTunnel(s, "app")
+	go serveTunnelStreams(registerTestTunnel(t, s, "app"), "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	if rec := get("If-None-Match", `"v1"`); rec.Code != http.StatusOK {
+		t.Errorf("status after reconnect = %d, want 200 from the tunnel", rec.Code)
+	}
+}
+
+func TestNewCacheEntry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		want   bool
+	}{
+		{name: "max-age with etag", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}}, want: true},
+		{name: "s-maxage overrides max-age", status: 200, header: http.Header{"Cache-Control": {"max-age=60, s-maxage=0"}, "Etag": {`"a"`}}},
+		{name: "expires", status: 200, header: http.Header{"Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Expires": {"Mon, 02 Jan 2006 16:04:05 GMT"}, "Etag": {`"a"`}}, want: true},
+		{name: "no freshness", status: 200, header: http.Header{"Etag": {`"a"`}}},
+		{name: "no validator", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{name: "private", status: 200, header: http.Header{"Cache-Control": {"private, max-age=60"}, "Etag": {`"a"`}}},
+		{name: "no-store", status: 200, header: http.Header{"Cache-Control": {"No-Store, max-age=60"}, "Etag": {`"a"`}}},
+		{name: "sets cookie", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}, "Set-Cookie": {"a=b"}}},
+		{name: "varies", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}, "Vary": {"Accept-Encoding"}}},
+		{name: "already stale", status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}, "Age": {"60"}}},
+		{name: "not found", status: 404, header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"a"`}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newCacheEntry(&http.Response{StatusCode: tt.status, Header: tt.header}, time.Now())
+			if (e != nil) != tt.want {
+				t.Errorf("cacheable = %v, want %v", e != nil, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadConnSkipsInterimResponses(t *testing.T) {
+	raw := "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nETag: \"a\"\r\n\r\nbody"
+	var head string
+	c := &headConn{Conn: newMockConn([]byte(raw)), onHead: func(b []byte) { head = string(b) }}
+
+	out, err := io.ReadAll(io.LimitReader(c, int64(len(raw))))
+	if err != nil || string(out) != raw {
+		t.Fatalf("ReadAll() = %q, %v; want the stream unchanged", out, err)
+	}
+	if !strings.HasPrefix(head, "HTTP/1.1 200 OK") || !strings.HasSuffix(head, "\r\n\r\n") {
+		t.Errorf("head = %q, want the final response head", head)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errorPages holds the operator's templates for errors the server answers
+// itself, such as a missing tunnel or an unreachable client.
+type errorPages struct {
+	templates  map[string]*template.Template // "404", "5xx", "error" or "de/404", ... -> template
+	supportURL string
+}
+
+// errorPageData is what error page templates are rendered with.
+type errorPageData struct {
+	Status     int    // e.g. 502
+	StatusText string // e.g. "Bad Gateway"
+	Message    string // what went wrong, as plain-text responses say it
+	Host       string
+	Subdomain  string
+	RequestID  string // also logged, to find the request from a support ticket
+	SupportURL string
+	Provider   string // the server's domain
+	Language   string // the page's language directory, e.g. "de" (empty = default)
+}
+
+// LoadErrorPages parses the html/template files in dir an error page is
+// picked from: <status>.html (e.g. 404.html), else <class>.html (e.g.
+// 5xx.html), else error.html. Subdirectories named after a language (e.g.
+// de, pt-BR) hold translations of them, keyed as "de/404". Other files are
+// ignored.
+func LoadErrorPages(dir string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	if err := loadErrorPages(templates, dir, ""); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read error pages: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && isLanguageTag(e.Name()) {
+			lang := strings.ToLower(e.Name())
+			if err := loadErrorPages(templates, filepath.Join(dir, e.Name()), lang+"/"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no error pages (404.html, 5xx.html, error.html, ...) in %s", dir)
+	}
+	return templates, nil
+}
+
+// loadErrorPages adds the error pages in dir to templates, with prefix
+// prepended to their names.
+func loadErrorPages(templates map[string]*template.Template, dir, prefix string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read error pages: %w", err)
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".html")
+		if !ok || e.IsDir() || !isErrorPageName(name) {
+			continue
+		}
+		tmpl, err := template.ParseFiles(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("invalid error page: %w", err)
+		}
+		templates[prefix+name] = tmpl
+	}
+	return nil
+}
+
+// isLanguageTag reports whether name looks like a BCP 47 language tag,
+// such as "de", "pt-BR" or "zh-Hant-TW".
+func isLanguageTag(name string) bool {
+	for i, part := range strings.Split(name, "-") {
+		if len(part) < 1 || len(part) > 8 || (i == 0 && (len(part) < 2 || len(part) > 3)) {
+			return false
+		}
+		for _, c := range part {
+			isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+			if !isLetter && (i == 0 || c < '0' || c > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isErrorPageName reports whether name is a status, a status class, or
+// "error".
+func isErrorPageName(name string) bool {
+	if name == "error" {
+		return true
+	}
+	if len(name) != 3 || name[0] < '4' || name[0] > '5' {
+		return false
+	}
+	if strings.HasSuffix(name, "xx") {
+		return true
+	}
+	_, err := strconv.Atoi(name)
+	return err == nil
+}
+
+// WithErrorPages renders the errors the server answers browsers with
+// itself from templates (see LoadErrorPages), instead of plain text, with
+// supportURL offered as the place to get help. Other clients still get
+// plain text.
+func (s *Server) WithErrorPages(templates map[string]*template.Template, supportURL string) *Server {
+	s.errorPages = &errorPages{templates: templates, supportURL: supportURL}
+	return s
+}
+
+// lookup returns the template for status in the first of languages there
+// is a translation for, else the default one, and the language it is in.
+// It returns nil if there is none.
+func (p *errorPages) lookup(status int, languages []string) (*template.Template, string) {
+	if p == nil {
+		return nil, ""
+	}
+	code := strconv.Itoa(status)
+	for _, lang := range append(languages, "") {
+		prefix := ""
+		if lang != "" {
+			prefix = lang + "/"
+		}
+		for _, name := range []string{code, code[:1] + "xx", "error"} {
+			if tmpl := p.templates[prefix+name]; tmpl != nil {
+				return tmpl, lang
+			}
+		}
+	}
+	return nil, ""
+}
+
+// acceptedLanguages returns the languages r's Accept-Language header asks
+// for, most preferred first, each followed by its more general forms
+// ("pt-br", "pt"). Tags are lowercased.
+func acceptedLanguages(r *http.Request) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if tag == "" || tag == "*" || q <= 0 || !isLanguageTag(tag) {
+			continue
+		}
+		tags = append(tags, weighted{tag, q})
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	var languages []string
+	for _, t := range tags {
+		for tag := t.tag; ; {
+			languages = append(languages, tag)
+			i := strings.LastIndexByte(tag, '-')
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return languages
+}
+
+// acceptsHTML reports whether r comes from a browser rather than an API
+// client, which is better served plain text.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// httpError answers r with status and message like http.Error, rendering
+// the operator's error page instead for browsers if there is one.
+func (s *Server) httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if s.errorPages == nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Add("Vary", "Accept, Accept-Language")
+	if !acceptsHTML(r) {
+		http.Error(w, message, status)
+		return
+	}
+	tmpl, lang := s.errorPages.lookup(status, acceptedLanguages(r))
+	if tmpl == nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		Host:       r.Host,
+		Subdomain:  s.subdomainForHost(r.Host),
+		RequestID:  hex.EncodeToString(id),
+		SupportURL: s.errorPages.supportURL,
+		Provider:   s.domain,
+		Language:   lang,
+	}
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		slog.Error("failed to render error page", "status", status, "error", err)
+		http.Error(w, message, status)
+		return
+	}
+	slog.Info("served error page", "status", status, "subdomain", data.Subdomain, "request_id", data.RequestID, "language", lang, "message", message)
+
+	h := w.Header()
+	if lang != "" {
+		h.Set("Content-Language", lang)
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
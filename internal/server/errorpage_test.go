@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"404.html":         `<h1>{{.Subdomain}} isn't running</h1><p>{{.Message}}</p><p>Ref {{.RequestID}}, <a href="{{.SupportURL}}">help</a></p>`,
+		"5xx.html":         `<h1>{{.Status}} {{.StatusText}}</h1>`,
+		"error.html":       `<h1>Error {{.Status}}</h1>`,
+		"notes.txt":        `ignored`,
+		"home.html":        `{{ignored`,
+		"de/404.html":      `<html lang="{{.Language}}"><h1>{{.Subdomain}} läuft nicht</h1>`,
+		"pt-BR/error.html": `<h1>Erro {{.Status}}</h1>`,
+		"assets/404.html":  `{{ignored`,
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	templates, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatalf("LoadErrorPages() error = %v", err)
+	}
+	s := New("", "", "", "tunnel.example.com", "", nil).WithErrorPages(templates, "https://help.example.com")
+
+	tests := []struct {
+		name     string
+		host     string
+		accept   string
+		language string
+		wantCode int
+		want     []string
+	}{
+		{
+			name:     "browser",
+			host:     "demo.tunnel.example.com",
+			accept:   "text/html,application/xhtml+xml,*/*;q=0.8",
+			wantCode: http.StatusNotFound,
+			want:     []string{"<h1>demo isn't running</h1>", "No tunnel found for subdomain: demo", `href="https://help.example.com"`},
+		},
+		{
+			name:     "translated",
+			host:     "demo.tunnel.example.com",
+			accept:   "text/html",
+			language: "fr;q=0.9, de-AT, en;q=0.8",
+			wantCode: http.StatusNotFound,
+			want:     []string{`<html lang="de"><h1>demo läuft nicht</h1>`},
+		},
+		{
+			name:     "translation falls back to the language's error page",
+			host:     "127.0.0.1",
+			accept:   "text/html",
+			language: "pt-BR",
+			wantCode: http.StatusBadRequest,
+			want:     []string{"<h1>Erro 400</h1>"},
+		},
+		{
+			name:     "untranslated",
+			host:     "127.0.0.1",
+			accept:   "text/html",
+			language: "de",
+			wantCode: http.StatusBadRequest,
+			want:     []string{"<h1>Error 400</h1>"},
+		},
+		{
+			name:     "API client",
+			host:     "demo.tunnel.example.com",
+			accept:   "application/json",
+			wantCode: http.StatusNotFound,
+			want:     []string{"No tunnel found for subdomain: demo\n"},
+		},
+		{
+			name:     "class page",
+			host:     "127.0.0.1",
+			accept:   "text/html",
+			wantCode: http.StatusBadRequest,
+			want:     []string{"<h1>Error 400</h1>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = tt.host
+			r.Header.Set("Accept", tt.accept)
+			if tt.language != "" {
+				r.Header.Set("Accept-Language", tt.language)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("body %q doesn't contain %q", rec.Body, want)
+				}
+			}
+		})
+	}
+
+	if got, _ := s.errorPages.lookup(http.StatusBadGateway, nil); got != templates["5xx"] {
+		t.Error("502 didn't use 5xx.html")
+	}
+}
+
+func TestLoadErrorPagesEmpty(t *testing.T) {
+	if _, err := LoadErrorPages(t.TempDir()); err == nil {
+		t.Error("LoadErrorPages() of a directory without error pages succeeded")
+	}
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"de", []string{"de"}},
+		{"pt-BR, en;q=0.5", []string{"pt-br", "pt", "en"}},
+		{"en;q=0.5, fr;q=0.8, *;q=0.1", []string{"fr", "en"}},
+		{"zh-Hant-TW", []string{"zh-hant-tw", "zh-hant", "zh"}},
+		{"de;q=0, nl, <script>", []string{"nl"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", tt.header)
+		if got := acceptedLanguages(r); !slices.Equal(got, tt.want) {
+			t.Errorf("acceptedLanguages(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
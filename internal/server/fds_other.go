@@ -0,0 +1,13 @@
+//go:build !unix
+
+package server
+
+// fdLimit returns -1 as the descriptor limit is unknown on this platform.
+func fdLimit() float64 {
+	return -1
+}
+
+// openFDs returns -1 as the open descriptor count is unknown on this platform.
+func openFDs() float64 {
+	return -1
+}
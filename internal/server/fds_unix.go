@@ -0,0 +1,27 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdLimit returns the soft limit on open file descriptors, or -1 if unknown.
+func fdLimit() float64 {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return -1
+	}
+	return float64(rl.Cur)
+}
+
+// openFDs returns the number of open file descriptors, or -1 if unknown.
+func openFDs() float64 {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return float64(len(entries))
+		}
+	}
+	return -1
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/proxy"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// handleForward serves a reverse-mode client: every stream it opens is
+// spliced onto a new stream to the tunnel registered for the requested
+// subdomain, letting the forwarding client reach that tunnel's local service.
+func (s *Server) handleForward(remoteAddr net.Addr, session transport.Session, controlStream *protocol.ControlStream, msg *protocol.ForwardMessage, registered func()) {
+	defer session.Close()
+
+	if !s.validateToken(msg.Token) {
+		slog.Warn("invalid API key", "remote_addr", remoteAddr)
+		controlStream.SendErrorCode(protocol.ErrCodeUnauthorized, "invalid or missing API key")
+		return
+	}
+
+	if _, code, err := s.forwardTarget(msg.Subdomain, msg.Token); err != nil {
+		slog.Warn("forward refused", "subdomain", msg.Subdomain, "remote_addr", remoteAddr, "error", err)
+		controlStream.SendErrorCode(code, err.Error())
+		return
+	}
+
+	if err := controlStream.SendForwarding(msg.Subdomain); err != nil {
+		slog.Error("failed to send forwarding message", "error", err)
+		return
+	}
+
+	slog.Info("forward started", "subdomain", msg.Subdomain, "remote_addr", remoteAddr)
+	registered()
+
+	// Answer heartbeats until the control stream closes
+	go func() {
+		defer session.Close()
+		for {
+			msg, err := controlStream.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*protocol.HeartbeatMessage); ok {
+				if err := controlStream.SendHeartbeatAck(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			slog.Info("forward stopped", "subdomain", msg.Subdomain, "remote_addr", remoteAddr)
+			return
+		}
+		go s.forwardStream(msg.Subdomain, msg.Token, stream)
+	}
+}
+
+// forwardTarget returns the tunnel token may reach at subdomain through
+// otun forward, or the error code and reason it may not. A forwarded stream
+// skips the edge, so the token must own the tunnel or hold an inspect grant
+// for it, and tunnels behind a takedown, a geo policy or per-request checks
+// are refused outright.
+func (s *Server) forwardTarget(subdomain, token string) (*tunnelClient, string, error) {
+	if s.isBlocked(subdomain) != nil {
+		return nil, protocol.ErrCodeTunnelBlocked, fmt.Errorf("tunnel %s has been blocked", subdomain)
+	}
+
+	s.mu.RLock()
+	target := s.clients[subdomain]
+	allowed := !s.authRequired() || s.hasRight(subdomain, token, RightInspect)
+	s.mu.RUnlock()
+
+	switch {
+	case target == nil:
+		return nil, "", fmt.Errorf("no tunnel found for subdomain: %s", subdomain)
+	case !allowed:
+		return nil, protocol.ErrCodeUnauthorized, fmt.Errorf("this API key may not reach tunnel %s", subdomain)
+	case s.filtersEachRequest(target) || target.geo != nil:
+		return nil, protocol.ErrCodeForwardRefused, fmt.Errorf("tunnel %s checks its visitors, so it can't be reached through forward", subdomain)
+	}
+	return target, "", nil
+}
+
+// forwardStream splices a stream from a forwarding client onto a new stream
+// to the target tunnel, re-checking the target since it may have been
+// blocked or replaced after the forward started.
+func (s *Server) forwardStream(subdomain, token string, stream transport.Stream) {
+	target, _, err := s.forwardTarget(subdomain, token)
+	if err != nil {
+		slog.Warn("forward stream refused", "subdomain", subdomain, "error", err)
+		stream.Close()
+		return
+	}
+
+	if !target.streams.acquire(s.streamLimit(target)) {
+		s.metrics.streamsRejected.Inc()
+		slog.Warn("connection limit reached", "subdomain", subdomain, "error", errTooManyStreams)
+		stream.Close()
+		return
+	}
+	defer target.streams.release()
+
+	targetStream, err := target.session.OpenStream()
+	if err != nil {
+		slog.Error("failed to open stream to forward target", "subdomain", subdomain, "error", err)
+		stream.Close()
+		return
+	}
+
+	if err := proxy.BidirectionalContext(s.ctx, stream, stripTiming(targetStream, target)); err != nil {
+		slog.Debug("forward stream completed", "subdomain", subdomain, "error", err)
+	}
+}
+
+// lookupClient returns the tunnel registered for subdomain, or nil.
+func (s *Server) lookupClient(subdomain string) *tunnelClient {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clients[subdomain]
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+func TestForwardTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		apiKeys  []string
+		token    string
+		setup    func(s *Server, client *tunnelClient)
+		wantCode string
+		wantErr  bool
+	}{
+		{name: "open server", token: ""},
+		{
+			name:     "blocked tunnel",
+			setup:    func(s *Server, _ *tunnelClient) { s.blocked["demo"] = &blockInfo{} },
+			wantCode: protocol.ErrCodeTunnelBlocked,
+			wantErr:  true,
+		},
+		{
+			name:     "private tunnel",
+			setup:    func(_ *Server, client *tunnelClient) { client.access = &accessPolicy{} },
+			wantCode: protocol.ErrCodeForwardRefused,
+			wantErr:  true,
+		},
+		{
+			name:     "jwt policy",
+			setup:    func(_ *Server, client *tunnelClient) { client.jwt = &jwtPolicy{} },
+			wantCode: protocol.ErrCodeForwardRefused,
+			wantErr:  true,
+		},
+		{
+			name:     "geo policy",
+			setup:    func(_ *Server, client *tunnelClient) { client.geo = &geoPolicy{} },
+			wantCode: protocol.ErrCodeForwardRefused,
+			wantErr:  true,
+		},
+		{
+			name:     "content scanning",
+			setup:    func(s *Server, _ *tunnelClient) { s.scanner = &fakeScanner{} },
+			wantCode: protocol.ErrCodeForwardRefused,
+			wantErr:  true,
+		},
+		{name: "owner", apiKeys: []string{"owner-key", "team-key"}, token: "owner-key"},
+		{
+			name:    "inspect grant",
+			apiKeys: []string{"owner-key", "team-key"},
+			token:   "team-key",
+			setup: func(s *Server, _ *tunnelClient) {
+				s.owners["demo"].grants["team-key"] = []string{RightInspect}
+			},
+		},
+		{
+			name:     "other key",
+			apiKeys:  []string{"owner-key", "team-key"},
+			token:    "team-key",
+			wantCode: protocol.ErrCodeUnauthorized,
+			wantErr:  true,
+		},
+		{
+			name:    "publish grant",
+			apiKeys: []string{"owner-key", "team-key"},
+			token:   "team-key",
+			setup: func(s *Server, _ *tunnelClient) {
+				s.owners["demo"].grants["team-key"] = []string{RightPublish}
+			},
+			wantCode: protocol.ErrCodeUnauthorized,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown tunnel",
+			setup:    func(s *Server, _ *tunnelClient) { delete(s.clients, "demo") },
+			wantCode: "",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", ":8080", "", "", tt.apiKeys)
+			client := &tunnelClient{subdomain: "demo"}
+			s.mu.Lock()
+			if err := s.claimSubdomain("demo", "owner-key"); err != nil {
+				t.Fatalf("claimSubdomain() error = %v", err)
+			}
+			s.clients["demo"] = client
+			if tt.setup != nil {
+				tt.setup(s, client)
+			}
+			s.mu.Unlock()
+
+			target, code, err := s.forwardTarget("demo", tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("forwardTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if code != tt.wantCode {
+				t.Errorf("forwardTarget() code = %q, want %q", code, tt.wantCode)
+			}
+			if !tt.wantErr && target != client {
+				t.Errorf("forwardTarget() = %p, want %p", target, client)
+			}
+		})
+	}
+}
+
+// startForward sends a forward request for subdomain to s and returns the
+// forwarding client's session and the server's reply.
+func startForward(t *testing.T, s *Server, subdomain string) (transport.Session, any) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+	if err := cs.SendForward(subdomain, ""); err != nil {
+		t.Fatalf("failed to send forward: %v", err)
+	}
+	reply, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return session, reply
+}
+
+func TestForwardRefusesPrivateTunnel(t *testing.T) {
+	s := New("", "", ":8080", "", "", nil)
+	registerTestTunnel(t, s, "app")
+	s.lookupClient("app").access = &accessPolicy{}
+
+	_, reply := startForward(t, s, "app")
+	msg, ok := reply.(*protocol.ErrorMessage)
+	if !ok {
+		t.Fatalf("reply = %+v, want error", reply)
+	}
+	if msg.Code != protocol.ErrCodeForwardRefused {
+		t.Errorf("error code = %q, want %q", msg.Code, protocol.ErrCodeForwardRefused)
+	}
+}
+
+func TestForwardStreamRechecksTarget(t *testing.T) {
+	s := New("", "", ":8080", "", "", nil)
+	go serveTunnelStreams(registerTestTunnel(t, s, "app"), okResponse)
+
+	session, reply := startForward(t, s, "app")
+	if _, ok := reply.(*protocol.ForwardingMessage); !ok {
+		t.Fatalf("reply = %+v, want forwarding", reply)
+	}
+
+	get := func() error {
+		stream, err := session.OpenStream()
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		if _, err := io.WriteString(stream, "GET / HTTP/1.1\r\nHost: app\r\n\r\n"); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(stream), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(); err != nil {
+		t.Fatalf("forwarded request before takedown: %v", err)
+	}
+
+	s.mu.Lock()
+	s.blocked["app"] = &blockInfo{}
+	s.mu.Unlock()
+
+	if err := get(); err == nil {
+		t.Error("forwarded request after takedown succeeded")
+	}
+}
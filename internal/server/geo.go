@@ -0,0 +1,91 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/bc183/otun/internal/geoip"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// geoLocator places visitor addresses, e.g. a *geoip.DB.
+type geoLocator interface {
+	Lookup(ip netip.Addr) geoip.Info
+}
+
+// geoPolicy refuses a tunnel's visitors by country or network.
+type geoPolicy struct {
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	allowASNs      map[uint32]bool
+	denyASNs       map[uint32]bool
+}
+
+// newGeoPolicy returns the policy requested in msg, or nil if there is
+// none. The policy must have passed Validate.
+func newGeoPolicy(msg *protocol.RegisterMessage) *geoPolicy {
+	p := msg.GeoPolicy
+	if p == nil {
+		return nil
+	}
+	return &geoPolicy{
+		allowCountries: set(p.AllowCountries),
+		denyCountries:  set(p.DenyCountries),
+		allowASNs:      set(p.AllowASNs),
+		denyASNs:       set(p.DenyASNs),
+	}
+}
+
+func set[T comparable](items []T) map[T]bool {
+	m := make(map[T]bool, len(items))
+	for _, item := range items {
+		m[item] = true
+	}
+	return m
+}
+
+// allows reports whether a visitor located at info may use the tunnel.
+// Deny lists win over allow lists.
+func (p *geoPolicy) allows(info geoip.Info) bool {
+	if p.denyCountries[info.Country] || p.denyASNs[info.ASN] {
+		return false
+	}
+	if len(p.allowCountries) == 0 && len(p.allowASNs) == 0 {
+		return true
+	}
+	return p.allowCountries[info.Country] || p.allowASNs[info.ASN]
+}
+
+// WithGeoIP locates visitors in db, letting clients register tunnels with
+// geo policies. Without it, such registrations are refused.
+func (s *Server) WithGeoIP(db *geoip.DB) *Server {
+	s.geoip = db
+	return s
+}
+
+// checkGeo enforces client's geo policy, if any. A refused visitor gets a
+// 403 and an audit entry, and checkGeo returns false.
+func (s *Server) checkGeo(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	if client.geo == nil || s.geoip == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	var info geoip.Info
+	if ip, err := netip.ParseAddr(host); err == nil {
+		info = s.geoip.Lookup(ip)
+	}
+	if client.geo.allows(info) {
+		return true
+	}
+
+	s.metrics.geoDenied.Inc()
+	slog.Debug("visitor denied by geo policy", "subdomain", client.subdomain, "ip", host, "country", info.Country, "asn", info.ASN)
+	s.audit("visitor denied by geo policy", "subdomain", client.subdomain, "ip", host, "country", info.Country, "asn", info.ASN)
+	s.httpError(w, r, "This tunnel is not available from your location", http.StatusForbidden)
+	return false
+}
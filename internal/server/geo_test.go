@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/bc183/otun/internal/geoip"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// fakeLocator places every address at the same location.
+type fakeLocator geoip.Info
+
+func (l fakeLocator) Lookup(netip.Addr) geoip.Info {
+	return geoip.Info(l)
+}
+
+func TestGeoPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy protocol.GeoPolicy
+		info   geoip.Info
+		want   bool
+	}{
+		{"allowed country", protocol.GeoPolicy{AllowCountries: []string{"DE", "FR"}}, geoip.Info{Country: "FR"}, true},
+		{"other country", protocol.GeoPolicy{AllowCountries: []string{"DE"}}, geoip.Info{Country: "US"}, false},
+		{"unknown country", protocol.GeoPolicy{AllowCountries: []string{"DE"}}, geoip.Info{}, false},
+		{"allowed ASN", protocol.GeoPolicy{AllowCountries: []string{"DE"}, AllowASNs: []uint32{64500}}, geoip.Info{Country: "US", ASN: 64500}, true},
+		{"denied country", protocol.GeoPolicy{DenyCountries: []string{"US"}}, geoip.Info{Country: "US"}, false},
+		{"not denied", protocol.GeoPolicy{DenyCountries: []string{"US"}}, geoip.Info{}, true},
+		{"denied ASN wins", protocol.GeoPolicy{AllowCountries: []string{"DE"}, DenyASNs: []uint32{64500}}, geoip.Info{Country: "DE", ASN: 64500}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newGeoPolicy(&protocol.RegisterMessage{GeoPolicy: &tt.policy})
+			if got := p.allows(tt.info); got != tt.want {
+				t.Errorf("allows(%+v) = %v, want %v", tt.info, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoPolicyEnforced(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	s.geoip = fakeLocator{Country: "US", ASN: 64500}
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	go serveTunnelStreams(registerTestTunnel(t, s, "open"), okResponse)
+	s.clients["demo"].geo = newGeoPolicy(&protocol.RegisterMessage{GeoPolicy: &protocol.GeoPolicy{AllowCountries: []string{"DE"}}})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for subdomain, want := range map[string]int{"demo": http.StatusForbidden, "open": http.StatusOK} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Host = subdomain + ".localhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: status = %d, want %d", subdomain, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestGeoPolicyRegistration(t *testing.T) {
+	policy := &protocol.GeoPolicy{DenyCountries: []string{"US"}}
+
+	// Without a GeoIP database the policy can't be enforced
+	s := New("", "", "", "", "", nil)
+	reply, _ := registerSession(t, s, &protocol.RegisterMessage{GeoPolicy: policy})
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeInvalidGeoPolicy {
+		t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeInvalidGeoPolicy)
+	}
+
+	s.geoip = fakeLocator{}
+	reply, _ = registerSession(t, s, &protocol.RegisterMessage{GeoPolicy: &protocol.GeoPolicy{DenyCountries: []string{"usa"}}})
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeInvalidGeoPolicy {
+		t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeInvalidGeoPolicy)
+	}
+
+	registered, _ := mustRegister(t, s, &protocol.RegisterMessage{GeoPolicy: policy})
+	if client := s.lookupClient(registered.Subdomain); client == nil || client.geo == nil {
+		t.Error("registered tunnel has no geo policy")
+	}
+}
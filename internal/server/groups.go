@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// groupNamePattern is what group names look like.
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Group is a named set of tunnels, those registered with some API keys or
+// on some subdomains, that share policies, so operators manage policy per
+// group rather than per tunnel. A group's limits apply on top of the
+// server's; the lower one wins.
+type Group struct {
+	Name string `yaml:"name"`
+
+	// Tokens and Subdomains select the group's tunnels: those registered
+	// with one of the API keys, or on a subdomain matching one of the
+	// patterns (e.g. "partner-*", see path.Match). TCP tunnels have no
+	// subdomain and are selected by API key only.
+	Tokens     []string `yaml:"tokens"`
+	Subdomains []string `yaml:"subdomains"`
+
+	// MaxStreams caps each tunnel's concurrent streams (0 = the server's
+	// cap only)
+	MaxStreams int `yaml:"max_streams"`
+
+	// Bandwidth caps each tunnel's throughput per second, e.g. "1MB", and
+	// MaxResponseSize its response bodies ("" = no cap)
+	Bandwidth       string `yaml:"bandwidth"`
+	MaxResponseSize string `yaml:"max_response_size"`
+
+	// RequireAccess refuses tunnels that let anyone in: they must ask
+	// visitors for an access secret, client certificate or JWT
+	RequireAccess bool `yaml:"require_access"`
+
+	// StripResponseHeaders are removed from the tunnels' responses, on top
+	// of the server's and the tunnels' own rules
+	StripResponseHeaders []string `yaml:"strip_response_headers"`
+
+	// Parsed from the fields above by validate
+	tokens           map[string]bool
+	bandwidth        int64
+	maxResponseBytes int64
+}
+
+// LoadGroups reads groups from the YAML file at path, which lists them
+// under "groups".
+func LoadGroups(path string) ([]Group, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups: %w", err)
+	}
+	groups, err := parseGroups(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid groups file %s: %w", path, err)
+	}
+	return groups, nil
+}
+
+// parseGroups parses and validates a groups file.
+func parseGroups(data []byte) ([]Group, error) {
+	var file struct {
+		Groups []Group `yaml:"groups"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	names := make(map[string]bool, len(file.Groups))
+	for i := range file.Groups {
+		g := &file.Groups[i]
+		if err := g.validate(); err != nil {
+			return nil, fmt.Errorf("group %d: %w", i+1, err)
+		}
+		if names[g.Name] {
+			return nil, fmt.Errorf("group %q defined twice", g.Name)
+		}
+		names[g.Name] = true
+	}
+	return file.Groups, nil
+}
+
+// validate checks g and fills in its parsed fields.
+func (g *Group) validate() error {
+	if !groupNamePattern.MatchString(g.Name) {
+		return fmt.Errorf("invalid name %q (want lowercase letters, digits, - and _)", g.Name)
+	}
+	if len(g.Tokens) == 0 && len(g.Subdomains) == 0 {
+		return fmt.Errorf("group %q selects no tunnels; list tokens or subdomains", g.Name)
+	}
+	g.tokens = make(map[string]bool, len(g.Tokens))
+	for _, token := range g.Tokens {
+		if token == "" {
+			return fmt.Errorf("group %q: empty token", g.Name)
+		}
+		g.tokens[token] = true
+	}
+	for _, pattern := range g.Subdomains {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("group %q: invalid subdomain pattern %q", g.Name, pattern)
+		}
+	}
+	if g.MaxStreams < 0 {
+		return fmt.Errorf("group %q: max_streams must not be negative", g.Name)
+	}
+	var err error
+	if g.Bandwidth != "" {
+		if g.bandwidth, err = bytesize.Parse(g.Bandwidth); err != nil || g.bandwidth <= 0 {
+			return fmt.Errorf("group %q: invalid bandwidth %q", g.Name, g.Bandwidth)
+		}
+	}
+	if g.MaxResponseSize != "" {
+		if g.maxResponseBytes, err = bytesize.Parse(g.MaxResponseSize); err != nil || g.maxResponseBytes <= 0 {
+			return fmt.Errorf("group %q: invalid max_response_size %q", g.Name, g.MaxResponseSize)
+		}
+	}
+	if err := protocol.ValidateStripHeaders(g.StripResponseHeaders); err != nil {
+		return fmt.Errorf("group %q: %w", g.Name, err)
+	}
+	return nil
+}
+
+// WithGroups applies groups' policies to their tunnels. A tunnel belongs
+// to the first group that selects it. Groups must have been validated, as
+// LoadGroups does.
+func (s *Server) WithGroups(groups []Group) *Server {
+	s.groups = make([]*Group, len(groups))
+	for i := range groups {
+		s.groups[i] = &groups[i]
+	}
+	return s
+}
+
+// groupFor returns the group of a tunnel registered with token on
+// subdomain, or nil if it has none. The policy directory's tunnel policies
+// and groups come before those of WithGroups.
+func (s *Server) groupFor(token, subdomain string) *Group {
+	var groups []*Group
+	if p := s.policies.load(); p != nil {
+		groups = p.groups
+	}
+	for _, g := range slices.Concat(groups, s.groups) {
+		if g.selects(token, subdomain) {
+			return g
+		}
+	}
+	return nil
+}
+
+// selects reports whether g selects the tunnel registered with token on
+// subdomain.
+func (g *Group) selects(token, subdomain string) bool {
+	if token != "" && g.tokens[token] {
+		return true
+	}
+	if subdomain == "" {
+		return false
+	}
+	return slices.ContainsFunc(g.Subdomains, func(pattern string) bool {
+		ok, _ := path.Match(pattern, subdomain)
+		return ok
+	})
+}
+
+// check returns why msg's tunnel may not join g, if it may not. A nil g
+// accepts every tunnel.
+func (g *Group) check(msg *protocol.RegisterMessage) error {
+	if g == nil {
+		return nil
+	}
+	if g.RequireAccess && msg.AccessSecret == "" && msg.ClientCA == "" && msg.JWT == nil {
+		return fmt.Errorf("tunnels in group '%s' must be private: set an access secret, client CA or JWT policy", g.Name)
+	}
+	return nil
+}
+
+// applyGroup puts client in its group and holds it to the group's limits
+// and header rules.
+func (s *Server) applyGroup(client *tunnelClient) {
+	g := s.groupFor(client.token, client.subdomain)
+	if g == nil {
+		return
+	}
+	client.group = g
+	if g.bandwidth > 0 && (client.bandwidth == nil || float64(g.bandwidth) < client.bandwidth.rate) {
+		client.bandwidth = newBandwidthLimiter(g.bandwidth)
+	}
+	if g.maxResponseBytes > 0 && (client.maxResponseBytes <= 0 || g.maxResponseBytes < client.maxResponseBytes) {
+		client.maxResponseBytes = g.maxResponseBytes
+	}
+	if len(g.StripResponseHeaders) > 0 {
+		client.stripHeaders = slices.Concat(client.stripHeaders, g.StripResponseHeaders)
+	}
+}
+
+// streamLimit returns client's cap on concurrent streams (0 = none): the
+// server's, or its group's if that is lower.
+func (s *Server) streamLimit(client *tunnelClient) int {
+	limit := s.maxStreamsPerTunnel
+	if g := client.group; g != nil && g.MaxStreams > 0 && (limit <= 0 || g.MaxStreams < limit) {
+		limit = g.MaxStreams
+	}
+	return limit
+}
+
+// groupName returns the name of client's group, or "" if it has none.
+func (c *tunnelClient) groupName() string {
+	if c.group == nil {
+		return ""
+	}
+	return c.group.Name
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestParseGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			yaml: `groups:
+  - name: partners
+    tokens: [key-a]
+    subdomains: ["partner-*"]
+    max_streams: 10
+    bandwidth: 1MB
+    max_response_size: 10MB
+    require_access: true
+    strip_response_headers: [Server, X-Debug-*]
+`,
+		},
+		{name: "empty", yaml: ""},
+		{name: "bad name", yaml: "groups:\n  - name: Partners\n    tokens: [a]\n", wantErr: "invalid name"},
+		{name: "selects nothing", yaml: "groups:\n  - name: partners\n", wantErr: "selects no tunnels"},
+		{name: "bad pattern", yaml: "groups:\n  - name: partners\n    subdomains: [\"[\"]\n", wantErr: "invalid subdomain pattern"},
+		{name: "bad bandwidth", yaml: "groups:\n  - name: partners\n    tokens: [a]\n    bandwidth: fast\n", wantErr: "invalid bandwidth"},
+		{name: "negative streams", yaml: "groups:\n  - name: partners\n    tokens: [a]\n    max_streams: -1\n", wantErr: "max_streams"},
+		{name: "unknown field", yaml: "groups:\n  - name: partners\n    tokens: [a]\n    rate: 5\n", wantErr: "rate"},
+		{name: "duplicate", yaml: "groups:\n  - name: a\n    tokens: [x]\n  - name: a\n    tokens: [y]\n", wantErr: "defined twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGroups([]byte(tt.yaml))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parseGroups() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseGroups() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGroupFor(t *testing.T) {
+	groups, err := parseGroups([]byte(`groups:
+  - name: partners
+    tokens: [key-a]
+    subdomains: ["partner-*"]
+  - name: staff
+    tokens: [key-b]
+    subdomains: ["*"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", "", "", "", "", nil).WithGroups(groups)
+
+	tests := []struct {
+		token, subdomain string
+		want             string
+	}{
+		{token: "key-a", subdomain: "abc", want: "partners"},
+		{token: "", subdomain: "partner-acme", want: "partners"},
+		{token: "key-b", subdomain: "partner-acme", want: "partners"}, // first match wins
+		{token: "key-b", subdomain: "", want: "staff"},
+		{token: "", subdomain: "abc", want: "staff"},
+		{token: "key-c", subdomain: "", want: ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if g := s.groupFor(tt.token, tt.subdomain); g != nil {
+			got = g.Name
+		}
+		if got != tt.want {
+			t.Errorf("groupFor(%q, %q) = %q, want %q", tt.token, tt.subdomain, got, tt.want)
+		}
+	}
+}
+
+func TestApplyGroup(t *testing.T) {
+	groups, err := parseGroups([]byte(`groups:
+  - name: partners
+    tokens: [key-a]
+    max_streams: 10
+    bandwidth: 1MB
+    max_response_size: 1MB
+    strip_response_headers: [X-Debug-*]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", "", "", "", "", nil).WithGroups(groups).WithMaxResponseSize(10 << 20)
+	s.maxStreamsPerTunnel = 100
+
+	client := &tunnelClient{token: "key-a", maxResponseBytes: 10 << 20, stripHeaders: []string{"Server"}}
+	s.applyGroup(client)
+	if client.groupName() != "partners" {
+		t.Errorf("group = %q, want partners", client.groupName())
+	}
+	if got := s.streamLimit(client); got != 10 {
+		t.Errorf("streamLimit() = %d, want 10", got)
+	}
+	if client.bandwidth == nil {
+		t.Error("bandwidth isn't limited")
+	}
+	if client.maxResponseBytes != 1<<20 {
+		t.Errorf("maxResponseBytes = %d, want %d", client.maxResponseBytes, 1<<20)
+	}
+	if strings.Join(client.stripHeaders, ",") != "Server,X-Debug-*" {
+		t.Errorf("stripHeaders = %v", client.stripHeaders)
+	}
+
+	// The lower of the tunnel's and the group's bandwidth wins
+	for _, tt := range []struct{ tunnel, want int64 }{{10 << 20, 1 << 20}, {512 << 10, 512 << 10}} {
+		limited := &tunnelClient{token: "key-a", bandwidth: newBandwidthLimiter(tt.tunnel)}
+		s.applyGroup(limited)
+		if got := int64(limited.bandwidth.rate); got != tt.want {
+			t.Errorf("bandwidth of a tunnel limited to %d = %d, want %d", tt.tunnel, got, tt.want)
+		}
+	}
+
+	// Tunnels outside every group keep the server's limits
+	other := &tunnelClient{token: "key-b"}
+	s.applyGroup(other)
+	if other.group != nil || other.bandwidth != nil || s.streamLimit(other) != 100 {
+		t.Errorf("ungrouped tunnel got group %q, bandwidth %v, stream limit %d", other.groupName(), other.bandwidth, s.streamLimit(other))
+	}
+}
+
+func TestGroupRequireAccess(t *testing.T) {
+	groups, err := parseGroups([]byte("groups:\n  - name: partners\n    tokens: [key-a]\n    require_access: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New("", "", "", "", "", []string{"key-a", "key-b"}).WithGroups(groups)
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode string
+	}{
+		{name: "public", token: "key-a", wantCode: protocol.ErrCodeGroupPolicy},
+		{name: "other group", token: "key-b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client.New("server:4443", "localhost:1").
+				WithServerDialer(pipeDialer{s}).
+				WithToken(tt.token)
+			_, err := c.Probe(context.Background())
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("Probe() error = %v", err)
+				}
+				return
+			}
+			if e := client.AsError(err); e == nil || e.Code != tt.wantCode {
+				t.Fatalf("Probe() error = %v, want code %s", err, tt.wantCode)
+			}
+		})
+	}
+
+	// Canaries are held to the group too
+	mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key-a", AccessSecret: "0123456789abcdef"})
+	reply, _ := registerSession(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key-a", Canary: true})
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeGroupPolicy {
+		t.Errorf("public canary reply = %+v, want %s error", reply, protocol.ErrCodeGroupPolicy)
+	}
+
+	// Private tunnels may join
+	for _, msg := range []*protocol.RegisterMessage{
+		{Token: "key-a", AccessSecret: "0123456789abcdef"},
+		{Token: "key-a", ClientCA: "-----BEGIN CERTIFICATE-----"},
+		{Token: "key-a", JWT: &protocol.JWTPolicy{JWKSURL: "https://idp.example.com/jwks"}},
+	} {
+		if err := s.groupFor(msg.Token, "").check(msg); err != nil {
+			t.Errorf("check(%+v) error = %v", msg, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+const (
+	// defaultHandoverDrain is how long a client that handed its tunnel over
+	// may take to finish its in-flight requests, unless changed with
+	// WithHandoverDrain.
+	defaultHandoverDrain = 30 * time.Second
+
+	// handoverPollInterval is how often a draining session's open streams
+	// are counted.
+	handoverPollInterval = 100 * time.Millisecond
+)
+
+// WithHandoverDrain sets how long a client that handed its tunnel over to
+// another client keeps its session to finish the requests it was serving.
+// Requests still running after that are cut off.
+func (s *Server) WithHandoverDrain(d time.Duration) *Server {
+	s.handoverDrain = d
+	return s
+}
+
+// newHandoverToken returns a random token for a client to hand its tunnel
+// over with.
+func newHandoverToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// canHandOver reports whether msg presents the handover token of existing,
+// the client it would replace, with the same API key.
+func canHandOver(existing *tunnelClient, msg *protocol.RegisterMessage) bool {
+	return msg.HandoverToken != "" && existing.handoverToken != "" &&
+		subtle.ConstantTimeCompare([]byte(existing.handoverToken), []byte(msg.HandoverToken)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(existing.token), []byte(msg.Token)) == 1
+}
+
+// drainHandedOver waits for the client a tunnel was handed over from to
+// finish its in-flight requests, for at most the handover drain, then tells
+// it the tunnel was handed over and disconnects it. New requests already
+// go to the new client.
+func (s *Server) drainHandedOver(client *tunnelClient) {
+	start := time.Now()
+	if hs := healthOf(client.session); hs != nil {
+		// Count only the tunnel's streams if it shares its session
+		openStreams := hs.openStreams
+		if ts, ok := client.session.(*tunnelSession); ok {
+			openStreams = ts.openStreams
+		}
+		ticker := time.NewTicker(handoverPollInterval)
+		defer ticker.Stop()
+		// Wait at least one interval for requests routed just before the
+		// switch to open their streams
+		for range ticker.C {
+			if client.session.IsClosed() || openStreams() <= 1 || time.Since(start) >= s.handoverDrain {
+				break
+			}
+		}
+		if n := openStreams() - 1; n > 0 && !client.session.IsClosed() {
+			slog.Warn("handover drain timed out", "subdomain", client.subdomain, "open_streams", n)
+		}
+	}
+
+	slog.Info("handed over tunnel drained", "subdomain", client.subdomain, "remote_addr", client.remoteAddr,
+		"duration", time.Since(start).Round(time.Millisecond))
+	client.controlStream.SendErrorCode(protocol.ErrCodeHandedOver, "tunnel handed over to another client")
+	client.session.Close()
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// registerControl registers msg with s like mustRegister, also returning
+// the client's control stream.
+func registerControl(t *testing.T, s *Server, msg *protocol.RegisterMessage) (*protocol.RegisteredMessage, transport.Session, *protocol.ControlStream) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+	if err := cs.SendRegisterMessage(msg); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	reply, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	registered, ok := reply.(*protocol.RegisteredMessage)
+	if !ok {
+		t.Fatalf("reply = %+v, want registered", reply)
+	}
+	return registered, session, cs
+}
+
+func TestHandover(t *testing.T) {
+	s := New("", "", "", "", "", []string{"key", "other"}).WithHandoverDrain(time.Second)
+
+	first, oldSession, oldControl := registerControl(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key"})
+	if first.HandoverToken == "" {
+		t.Fatal("no handover token issued")
+	}
+	old := s.lookupClient("app")
+
+	// A request in flight on the old client when the tunnel is handed over
+	stream, err := old.session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	accepted, err := oldSession.AcceptStream()
+	if err != nil {
+		t.Fatalf("failed to accept stream: %v", err)
+	}
+
+	second, _ := mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key", HandoverToken: first.HandoverToken})
+	if second.Subdomain != "app" {
+		t.Errorf("subdomain = %q, want app", second.Subdomain)
+	}
+	if second.HandoverToken == "" || second.HandoverToken == first.HandoverToken {
+		t.Errorf("handover token = %q, want a fresh one", second.HandoverToken)
+	}
+	if s.lookupClient("app") == old {
+		t.Fatal("tunnel still routed to the old client")
+	}
+
+	// The old client keeps its session until its request finishes
+	time.Sleep(3 * handoverPollInterval)
+	if old.session.IsClosed() {
+		t.Fatal("old session closed with a request in flight")
+	}
+	stream.Close()
+	accepted.Close()
+
+	reply, err := oldControl.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read old control stream: %v", err)
+	}
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeHandedOver {
+		t.Errorf("old client got %+v, want %s error", reply, protocol.ErrCodeHandedOver)
+	}
+	waitFor(t, time.Second, old.session.IsClosed)
+
+	// The new client still has the tunnel once the old one is gone
+	if s.lookupClient("app") == nil {
+		t.Error("tunnel unregistered when the old client disconnected")
+	}
+}
+
+func TestHandoverRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		handover func(first *protocol.RegisteredMessage) string
+	}{
+		{name: "wrong token", token: "key", handover: func(*protocol.RegisteredMessage) string { return "bogus" }},
+		{name: "other API key", token: "other", handover: func(first *protocol.RegisteredMessage) string { return first.HandoverToken }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", []string{"key", "other"})
+			first, _ := mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key"})
+
+			reply, _ := registerSession(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: tt.token, HandoverToken: tt.handover(first)})
+			if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeInvalidHandover {
+				t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeInvalidHandover)
+			}
+		})
+	}
+}
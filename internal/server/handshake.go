@@ -0,0 +1,35 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"time"
+)
+
+// DefaultHandshakeTimeout is how long a tunnel client has by default to
+// send each step of its registration.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// WithHandshakeTimeout closes tunnel client connections that take longer
+// than d to open their session and send a registration (or, for subdomains
+// bound to an owner key, to answer the ownership challenge), so idle
+// connections can't pin sessions and registration workers. 0 waits forever.
+func (s *Server) WithHandshakeTimeout(d time.Duration) *Server {
+	s.handshakeTimeout = d
+	return s
+}
+
+// handshakeDeadline closes c unless the returned stop function is called
+// within the handshake timeout. waitingFor and attrs describe the step in
+// the log.
+func (s *Server) handshakeDeadline(c io.Closer, waitingFor string, attrs ...any) (stop func()) {
+	if s.handshakeTimeout <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(s.handshakeTimeout, func() {
+		s.metrics.handshakeTimeouts.Inc()
+		slog.Warn("registration handshake timed out", append([]any{"waiting_for", waitingFor, "timeout", s.handshakeTimeout}, attrs...)...)
+		c.Close()
+	})
+	return func() { timer.Stop() }
+}
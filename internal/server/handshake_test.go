@@ -0,0 +1,36 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithHandshakeTimeout(50 * time.Millisecond)
+
+	// A client that connects and says nothing is cut off
+	serverConn, idle := net.Pipe()
+	defer idle.Close()
+	go s.handleTunnelClient(serverConn, func() {})
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection read = %v, want EOF", err)
+	}
+	if got := s.metrics.handshakeTimeouts.Value(); got != 1 {
+		t.Errorf("handshake timeouts = %d, want 1", got)
+	}
+
+	// One that registers in time keeps its tunnel
+	registered, _ := mustRegister(t, s, &protocol.RegisterMessage{})
+	time.Sleep(100 * time.Millisecond)
+	if s.lookupClient(registered.Subdomain) == nil {
+		t.Error("tunnel closed after registering in time")
+	}
+	if got := s.metrics.handshakeTimeouts.Value(); got != 1 {
+		t.Errorf("handshake timeouts = %d, want still 1", got)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// WithHeaderLimits caps the header bytes and header lines of requests
+// forwarded into tunnels; larger requests get 431 at the edge. Zero means
+// no limit (header bytes are then bounded only by net/http's 1MB default).
+// While either limit is set, visitor connections are closed after each
+// response, so that every request is checked.
+func (s *Server) WithHeaderLimits(maxBytes int64, maxCount int) *Server {
+	s.maxHeaderBytes = maxBytes
+	s.maxHeaderCount = maxCount
+	return s
+}
+
+// serverMaxHeaderBytes is the MaxHeaderBytes for the public HTTP servers, so
+// hostile headers are cut off while reading rather than after.
+func (s *Server) serverMaxHeaderBytes() int {
+	return int(s.maxHeaderBytes)
+}
+
+// headerSize returns the bytes and lines r's headers take on the wire.
+func headerSize(h http.Header) (size int64, count int) {
+	for name, values := range h {
+		for _, v := range values {
+			size += int64(len(name) + len(v) + len(": \r\n"))
+			count++
+		}
+	}
+	return size, count
+}
+
+// checkHeaders answers 431 and reports false if r's headers exceed the
+// configured limits.
+func (s *Server) checkHeaders(w http.ResponseWriter, r *http.Request, subdomain string) bool {
+	if s.maxHeaderBytes <= 0 && s.maxHeaderCount <= 0 {
+		return true
+	}
+	size, count := headerSize(r.Header)
+	if (s.maxHeaderBytes <= 0 || size <= s.maxHeaderBytes) && (s.maxHeaderCount <= 0 || count <= s.maxHeaderCount) {
+		return true
+	}
+	s.metrics.headersRejected.Inc()
+	slog.Warn("request headers over limit", "subdomain", subdomain, "header_bytes", size, "header_count", count)
+	s.httpError(w, r, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+	return false
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxCount int
+		headers  map[string]string
+		want     int
+	}{
+		{name: "no limits", headers: map[string]string{"X-Big": strings.Repeat("a", 4096)}, want: http.StatusOK},
+		{name: "within limits", maxBytes: 1024, maxCount: 10, headers: map[string]string{"X-A": "1"}, want: http.StatusOK},
+		{name: "too many bytes", maxBytes: 1024, headers: map[string]string{"X-Big": strings.Repeat("a", 2048)}, want: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "too many headers", maxCount: 3, headers: map[string]string{"X-A": "1", "X-B": "2", "X-C": "3", "X-D": "4"}, want: http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithHeaderLimits(tt.maxBytes, tt.maxCount)
+			go serveTunnelStreams(registerTestTunnel(t, s, "app"), okResponse)
+
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			req.Host = "app.localhost"
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			rejected := uint64(0)
+			if tt.want == http.StatusRequestHeaderFieldsTooLarge {
+				rejected = 1
+			}
+			if got := s.metrics.headersRejected.Value(); got != rejected {
+				t.Errorf("rejected = %d, want %d", got, rejected)
+			}
+		})
+	}
+}
+
+func TestHeaderLimitsKeepAlive(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithHeaderLimits(0, 3)
+	go serveKeepAlive(registerTestTunnel(t, s, "app"))
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	first := "GET / HTTP/1.1\r\nHost: app.localhost\r\n\r\n"
+	second := "GET / HTTP/1.1\r\nHost: app.localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n"
+	if keepAliveForwards(t, ts.Listener.Addr().String(), first, second) {
+		t.Error("second request on the kept-alive connection skipped the header limits")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTunnelHistory is how many events are kept per subdomain.
+	defaultTunnelHistory = 50
+
+	// maxHistorySubdomains bounds how many subdomains have a history, since
+	// random subdomains and rejected registrations would otherwise grow it
+	// forever. The subdomain with the oldest latest event is forgotten first.
+	maxHistorySubdomains = 10000
+)
+
+// Tunnel history event types.
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventTakenOver    = "taken_over"
+	eventHandedOver   = "handed_over"
+	eventCanaryJoined = "canary_joined"
+	eventCanaryLeft   = "canary_left"
+	eventHoneytoken   = "honeytoken"
+	eventRejected     = "rejected"
+	eventBlocked      = "blocked"
+	eventUnblocked    = "unblocked"
+)
+
+// tunnelEvent is one entry in a subdomain's connection history.
+type tunnelEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	TokenID    string    `json:"token_id,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// tunnelHistory keeps the most recent connection events of each subdomain.
+type tunnelHistory struct {
+	size int
+
+	mu     sync.Mutex
+	events map[string][]tunnelEvent // subdomain -> events, oldest first
+}
+
+// newTunnelHistory keeps up to size events per subdomain; 0 disables it.
+func newTunnelHistory(size int) *tunnelHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &tunnelHistory{size: size, events: make(map[string][]tunnelEvent)}
+}
+
+// WithTunnelHistory keeps the last size connects, disconnects, and errors
+// of each subdomain for the admin API. 0 disables the history.
+func (s *Server) WithTunnelHistory(size int) *Server {
+	s.history = newTunnelHistory(size)
+	return s
+}
+
+// record appends e to subdomain's history, dropping its oldest event if the
+// history is full.
+func (h *tunnelHistory) record(subdomain string, e tunnelEvent) {
+	if h == nil || subdomain == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events, ok := h.events[subdomain]
+	if !ok && len(h.events) >= maxHistorySubdomains {
+		h.evictLocked()
+	}
+	if len(events) >= h.size {
+		events = append(events[:0], events[len(events)-h.size+1:]...)
+	}
+	h.events[subdomain] = append(events, e)
+}
+
+// evictLocked forgets the subdomain whose latest event is oldest.
+// Must be called with h.mu held.
+func (h *tunnelHistory) evictLocked() {
+	var oldest string
+	var oldestAt time.Time
+	for subdomain, events := range h.events {
+		at := events[len(events)-1].Time
+		if oldest == "" || at.Before(oldestAt) {
+			oldest, oldestAt = subdomain, at
+		}
+	}
+	delete(h.events, oldest)
+}
+
+// get returns subdomain's events, newest first.
+func (h *tunnelHistory) get(subdomain string) []tunnelEvent {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := h.events[subdomain]
+	out := make([]tunnelEvent, len(events))
+	for i, e := range events {
+		out[len(events)-1-i] = e
+	}
+	return out
+}
+
+// has reports whether subdomain has any recorded events.
+func (h *tunnelHistory) has(subdomain string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.events[subdomain]) > 0
+}
+
+func (s *Server) handleTunnelEvents(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	s.mu.RLock()
+	allowed := s.canInspect(caller, subdomain)
+	s.mu.RUnlock()
+
+	// Rejected registrations leave a history for subdomains nobody owns, so
+	// only the admin key may see those
+	if !allowed || !s.history.has(subdomain) {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.history.get(subdomain))
+}
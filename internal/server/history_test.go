@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestTunnelHistoryBounded(t *testing.T) {
+	h := newTunnelHistory(3)
+	for i := range 5 {
+		h.record("demo", tunnelEvent{Type: eventConnected, Reason: fmt.Sprint(i)})
+	}
+
+	events := h.get("demo")
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for i, want := range []string{"4", "3", "2"} {
+		if events[i].Reason != want {
+			t.Errorf("events[%d].Reason = %q, want %q (newest first)", i, events[i].Reason, want)
+		}
+	}
+
+	if newTunnelHistory(0) != nil {
+		t.Error("newTunnelHistory(0) should disable the history")
+	}
+}
+
+func TestTunnelHistoryEvictsStalestSubdomain(t *testing.T) {
+	h := newTunnelHistory(1)
+	start := time.Now()
+	for i := range maxHistorySubdomains {
+		h.record(fmt.Sprint("sub", i), tunnelEvent{Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	h.record("sub0", tunnelEvent{Time: start.Add(time.Hour)})
+	h.record("new", tunnelEvent{Time: start.Add(time.Hour)})
+
+	if !h.has("sub0") || !h.has("new") {
+		t.Error("recently active subdomains should be kept")
+	}
+	if h.has("sub1") {
+		t.Error("the subdomain with the oldest latest event should be evicted")
+	}
+}
+
+func TestTunnelEventsAPI(t *testing.T) {
+	s, h := newSharingTestServer(t)
+
+	reply := registerMessage(t, s, &protocol.RegisterMessage{Subdomain: "demo", Token: "owner-key"})
+	if _, ok := reply.(*protocol.RegisteredMessage); !ok {
+		t.Fatalf("reply = %+v, want registered", reply)
+	}
+	reply = registerMessage(t, s, &protocol.RegisterMessage{Subdomain: "demo", Token: "owner-key"})
+	if _, ok := reply.(*protocol.ErrorMessage); !ok {
+		t.Fatalf("reply = %+v, want error", reply)
+	}
+	if rec := adminRequest(t, h, "POST", "/api/tunnels/demo/block", "root-key", `{"reason": "phishing"}`); rec.Code != http.StatusOK {
+		t.Fatalf("block status = %d", rec.Code)
+	}
+	waitFor(t, time.Second, func() bool { return len(s.history.get("demo")) == 4 })
+
+	rec := adminRequest(t, h, "GET", "/api/tunnels/demo/events", "owner-key", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var events []tunnelEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]tunnelEvent)
+	for _, e := range events {
+		types[e.Type] = e
+	}
+	if events[len(events)-1].Type != eventConnected {
+		t.Errorf("oldest event = %q, want connected", events[len(events)-1].Type)
+	}
+	if e := types[eventRejected]; e.Reason != "subdomain is already in use" || e.TokenID != tokenID("owner-key") {
+		t.Errorf("rejected event = %+v", e)
+	}
+	if e := types[eventDisconnected]; e.Reason != "blocked: phishing" {
+		t.Errorf("disconnected event = %+v, want blocked reason", e)
+	}
+	if _, ok := types[eventBlocked]; !ok {
+		t.Errorf("events = %+v, want a blocked event", events)
+	}
+
+	tests := []struct {
+		token string
+		path  string
+		want  int
+	}{
+		{token: "", path: "/api/tunnels/demo/events", want: http.StatusUnauthorized},
+		{token: "other-key", path: "/api/tunnels/demo/events", want: http.StatusNotFound},
+		{token: "root-key", path: "/api/tunnels/demo/events", want: http.StatusOK},
+		{token: "root-key", path: "/api/tunnels/nothing/events", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(t, h, "GET", tt.path, tt.token, ""); rec.Code != tt.want {
+			t.Errorf("GET %s as %q = %d, want %d", tt.path, tt.token, rec.Code, tt.want)
+		}
+	}
+}
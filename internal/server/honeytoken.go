@@ -0,0 +1,176 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+const (
+	// honeytokenAlertInterval is the least time between alerts about the
+	// same visitor of a tunnel, so a scanner sweeping trap paths raises one
+	// alert rather than hundreds.
+	honeytokenAlertInterval = time.Minute
+
+	// maxHoneytokenVisitors bounds the visitors remembered for bans and
+	// alerts. Beyond it, expired entries are forgotten; if none have
+	// expired, new visitors go unremembered until some do.
+	maxHoneytokenVisitors = 100000
+)
+
+// honeytokenPolicy is a tunnel's trap paths.
+type honeytokenPolicy struct {
+	paths []string // cleaned and lower-cased
+	ban   time.Duration
+}
+
+// newHoneytokenPolicy returns the trap paths requested in msg, or nil if
+// there are none. They must have passed Validate.
+func newHoneytokenPolicy(msg *protocol.RegisterMessage) *honeytokenPolicy {
+	if msg.Honeytokens == nil {
+		return nil
+	}
+	p := &honeytokenPolicy{ban: time.Duration(msg.Honeytokens.Ban) * time.Second}
+	for _, trap := range msg.Honeytokens.Paths {
+		p.paths = append(p.paths, strings.ToLower(path.Clean(trap)))
+	}
+	return p
+}
+
+// matches reports whether urlPath is, or is below, one of the trap paths.
+func (p *honeytokenPolicy) matches(urlPath string) bool {
+	urlPath = strings.ToLower(path.Clean("/" + urlPath))
+	for _, trap := range p.paths {
+		if urlPath == trap || strings.HasPrefix(urlPath, trap+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// honeytokenTrips remembers the visitors who touched a tunnel's trap
+// paths: until when each is banned, and when it was last alerted about.
+type honeytokenTrips struct {
+	mu      sync.Mutex
+	banned  map[visitorKey]time.Time
+	alerted map[visitorKey]time.Time
+}
+
+func newHoneytokenTrips() *honeytokenTrips {
+	return &honeytokenTrips{
+		banned:  make(map[visitorKey]time.Time),
+		alerted: make(map[visitorKey]time.Time),
+	}
+}
+
+// isBanned reports whether key is banned at now.
+func (t *honeytokenTrips) isBanned(key visitorKey, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.banned[key]
+	return ok && now.Before(until)
+}
+
+// trip records key touching a trap path at now, banning it for ban, and
+// reports whether to raise an alert about it.
+func (t *honeytokenTrips) trip(key visitorKey, ban time.Duration, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.banned)+len(t.alerted) >= maxHoneytokenVisitors {
+		t.pruneLocked(now)
+	}
+	full := len(t.banned)+len(t.alerted) >= maxHoneytokenVisitors
+	if ban > 0 && !full {
+		t.banned[key] = now.Add(ban)
+	}
+	if last, ok := t.alerted[key]; ok && now.Sub(last) < honeytokenAlertInterval {
+		return false
+	}
+	if !full {
+		t.alerted[key] = now
+	}
+	return true
+}
+
+// pruneLocked forgets expired bans and alerts.
+// Must be called with t.mu held.
+func (t *honeytokenTrips) pruneLocked(now time.Time) {
+	for key, until := range t.banned {
+		if !now.Before(until) {
+			delete(t.banned, key)
+		}
+	}
+	for key, last := range t.alerted {
+		if now.Sub(last) >= honeytokenAlertInterval {
+			delete(t.alerted, key)
+		}
+	}
+}
+
+// checkHoneytokens answers requests for client's trap paths with 404,
+// raising an alert and banning the visitor if the tunnel asks for it, and
+// refuses banned visitors with 403. It returns false for both.
+func (s *Server) checkHoneytokens(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	p := client.honeytokens
+	if p == nil {
+		return true
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	key := visitorKey{subdomain: client.subdomain, ip: ip}
+	now := time.Now()
+	if s.honeytokens.isBanned(key, now) {
+		s.httpError(w, r, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if !p.matches(r.URL.Path) {
+		return true
+	}
+
+	s.metrics.honeytokenHits.Inc()
+	if s.honeytokens.trip(key, p.ban, now) {
+		s.raiseIntrusion(client, r.Method, r.URL.Path, ip)
+	}
+	// Like otun's own errors, so the trap doesn't stand out
+	s.httpError(w, r, "Not Found", http.StatusNotFound)
+	return false
+}
+
+// raiseIntrusion alerts the tunnel's client, its owner's webhook, the audit
+// log, and the tunnel history that ip requested the trap path.
+func (s *Server) raiseIntrusion(client *tunnelClient, method, trap, ip string) {
+	ban := client.honeytokens.ban
+	slog.Warn("honeytoken touched", "subdomain", client.subdomain, "ip", ip, "method", method, "path", trap, "ban", ban)
+	s.audit("honeytoken touched", "subdomain", client.subdomain, "ip", ip, "method", method, "path", trap, "ban", ban.String())
+	s.history.record(client.subdomain, tunnelEvent{Type: eventHoneytoken, RemoteAddr: ip, Reason: method + " " + trap})
+
+	if client.controlStream != nil {
+		go client.controlStream.SendIntrusion(method, trap, ip, int(ban/time.Second))
+	}
+
+	s.mu.RLock()
+	owner := client.token
+	if o := s.owners[client.subdomain]; o != nil {
+		owner = o.owner
+	}
+	webhook := s.webhooks[owner]
+	s.mu.RUnlock()
+	if webhook != "" {
+		go s.deliverWebhook(webhook, webhookEvent{
+			Event:      "tunnel.honeytoken",
+			Subdomain:  client.subdomain,
+			Reason:     method + " " + trap,
+			RemoteAddr: ip,
+			Time:       time.Now().UTC(),
+			Labels:     client.labels,
+		})
+	}
+}
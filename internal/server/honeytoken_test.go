@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestHoneytokenMatches(t *testing.T) {
+	p := newHoneytokenPolicy(&protocol.RegisterMessage{Honeytokens: &protocol.Honeytokens{Paths: []string{"/wp-login.php", "/.git/"}}})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/wp-login.php", true},
+		{"/WP-Login.PHP", true},
+		{"/blog/../wp-login.php", true},
+		{"/.git/config", true},
+		{"/.git", true},
+		{"/wp-login.php.bak", false},
+		{"/blog/wp-login.php", false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		if got := p.matches(tt.path); got != tt.want {
+			t.Errorf("matches(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHoneytokenTrips(t *testing.T) {
+	trips := newHoneytokenTrips()
+	key := visitorKey{subdomain: "demo", ip: "203.0.113.7"}
+	now := time.Now()
+
+	if !trips.trip(key, time.Hour, now) {
+		t.Error("first trip raised no alert")
+	}
+	if trips.trip(key, time.Hour, now.Add(time.Second)) {
+		t.Error("second trip within the alert interval raised an alert")
+	}
+	if !trips.trip(key, time.Hour, now.Add(honeytokenAlertInterval)) {
+		t.Error("trip after the alert interval raised no alert")
+	}
+	if !trips.isBanned(key, now.Add(30*time.Minute)) {
+		t.Error("visitor not banned after a trip")
+	}
+	if trips.isBanned(key, now.Add(2*time.Hour)) {
+		t.Error("ban outlasted its duration")
+	}
+	if other := (visitorKey{subdomain: "other", ip: key.ip}); trips.isBanned(other, now) {
+		t.Error("ban applied to another tunnel")
+	}
+}
+
+func TestHoneytokenEnforced(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	s.clients["demo"].honeytokens = &honeytokenPolicy{paths: []string{"/wp-login.php"}, ban: time.Hour}
+
+	var lastBody string
+	get := func(path, remoteAddr string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "demo.localhost"
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		lastBody = rec.Body.String()
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		name       string
+		path       string
+		remoteAddr string
+		want       int
+	}{
+		{"before trip", "/", "203.0.113.7:1234", http.StatusOK},
+		{"trap", "/wp-login.php", "203.0.113.7:1234", http.StatusNotFound},
+		{"banned", "/", "203.0.113.7:5678", http.StatusForbidden},
+		{"other visitor", "/", "198.51.100.1:1234", http.StatusOK},
+	} {
+		if got := get(tt.path, tt.remoteAddr); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// The trap answers like otun's other errors
+	get("/wp-login.php", "192.0.2.1:1234")
+	rec := httptest.NewRecorder()
+	s.httpError(rec, httptest.NewRequest("GET", "/wp-login.php", nil), "Not Found", http.StatusNotFound)
+	if lastBody != rec.Body.String() {
+		t.Errorf("trap body = %q, want %q", lastBody, rec.Body.String())
+	}
+}
+
+func TestHoneytokenRegistration(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	reply, _ := registerSession(t, s, &protocol.RegisterMessage{Honeytokens: &protocol.Honeytokens{Paths: []string{"wp-login.php"}}})
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeInvalidHoneytoken {
+		t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeInvalidHoneytoken)
+	}
+
+	registered, _ := mustRegister(t, s, &protocol.RegisterMessage{Honeytokens: &protocol.Honeytokens{Paths: []string{"/.env"}, Ban: 60}})
+	if client := s.lookupClient(registered.Subdomain); client == nil || client.honeytokens == nil || client.honeytokens.ban != time.Minute {
+		t.Error("registered tunnel has no honeytokens")
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// altSvcMaxAge is how long (in seconds) browsers may cache the HTTP/3 advertisement.
+const altSvcMaxAge = 86400
+
+// hopHeaders are connection-specific headers that must not be copied between
+// an HTTP/1.1 upstream response and a downstream HTTP/3 response.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// startHTTP3 starts a QUIC listener on each HTTPS address (UDP) and sets
+// the Alt-Svc value advertised on HTTPS responses, naming the first
+// address's port.
+func (s *Server) startHTTP3(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	_, port, err := net.SplitHostPort(s.httpsAddrs[0])
+	if err != nil {
+		return fmt.Errorf("invalid HTTPS address %s: %w", s.httpsAddrs[0], err)
+	}
+
+	tlsConfig := http3.ConfigureTLSConfig(s.configureTLS(&tls.Config{
+		GetCertificate: getCertificate,
+	}))
+	s.altSvc = fmt.Sprintf(`h3=":%s"; ma=%d`, port, altSvcMaxAge)
+
+	for _, addr := range s.httpsAddrs {
+		h3Server := &http3.Server{
+			Addr:           addr,
+			Handler:        s,
+			TLSConfig:      tlsConfig,
+			MaxHeaderBytes: s.serverMaxHeaderBytes(),
+		}
+		go func() {
+			slog.Info("HTTP/3 server started", "addr", addr)
+			if err := h3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP/3 server error", "addr", addr, "error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// injectConn reads responses from a connection through a goroutine that
+// adds a header to the first final response head.
+type injectConn struct {
+	net.Conn
+	reader *io.PipeReader
+}
+
+// newInjectConn returns conn with line added to the first final response
+// head read from it. The head is rewritten as it streams through, so
+// interim responses reach the visitor while the request body they invite
+// is still being proxied.
+func newInjectConn(conn net.Conn, line string) *injectConn {
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(conn)
+		err := injectResponseHeader(pw, reader, line)
+		if err == nil {
+			_, err = reader.WriteTo(pw)
+		}
+		pw.CloseWithError(err)
+	}()
+	return &injectConn{Conn: conn, reader: pr}
+}
+
+func (c *injectConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Close also stops the goroutine if it is blocked passing data on.
+func (c *injectConn) Close() error {
+	c.reader.Close()
+	return c.Conn.Close()
+}
+
+// injectResponseHeader copies the first final response header block from src to dst,
+// inserting line as an extra header before the terminating blank line.
+// Interim (1xx) responses before it are copied unchanged.
+func injectResponseHeader(dst io.Writer, src *bufio.Reader, line string) error {
+	interim, statusLine := false, true
+	for {
+		l, err := src.ReadString('\n')
+		if err != nil {
+			if l != "" {
+				dst.Write([]byte(l))
+			}
+			return err
+		}
+		if statusLine {
+			var status int
+			fmt.Sscanf(l, "HTTP/1.1 %d", &status)
+			interim, statusLine = isInterim(status), false
+		}
+		if l == "\r\n" || l == "\n" {
+			if interim {
+				if _, err := io.WriteString(dst, l); err != nil {
+					return err
+				}
+				statusLine = true
+				continue
+			}
+			_, err := io.WriteString(dst, line+"\r\n"+l)
+			return err
+		}
+		if _, err := io.WriteString(dst, l); err != nil {
+			return err
+		}
+	}
+}
+
+// proxyRoundTrip forwards a single request over the stream and copies the
+// response back through w. It is used for response writers that can't be
+// hijacked, such as HTTP/3.
+func (s *Server) proxyRoundTrip(w http.ResponseWriter, r *http.Request, stream net.Conn) {
+	// The stream carries exactly one request
+	r.Close = true
+	if err := r.Write(stream); err != nil {
+		slog.Error("failed to write request to tunnel", "error", err)
+		s.httpError(w, r, "Failed to connect to tunnel", http.StatusBadGateway)
+		return
+	}
+
+	br := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(br, r)
+	for err == nil && isInterim(resp.StatusCode) {
+		writeInterim(w, resp)
+		resp, err = http.ReadResponse(br, r)
+	}
+	if errors.Is(err, errRequestTimeout) {
+		s.httpError(w, r, "Tunnel request exceeded the maximum duration", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to read response from tunnel", "error", err)
+		s.httpError(w, r, "Invalid response from tunnel", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Debug("proxy completed", "error", err)
+		return
+	}
+
+	// Trailers are known once the body has been read
+	for k, vv := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vv
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInjectResponseHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "response with body",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			want:     "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nAlt-Svc: h3=\":443\"\r\n\r\n",
+		},
+		{
+			name:     "bare LF line endings",
+			response: "HTTP/1.1 204 No Content\n\n",
+			want:     "HTTP/1.1 204 No Content\nAlt-Svc: h3=\":443\"\r\n\n",
+		},
+		{
+			name:     "after early hints",
+			response: "HTTP/1.1 103 Early Hints\r\nLink: </app.css>; rel=preload\r\n\r\nHTTP/1.1 200 OK\r\n\r\n",
+			want:     "HTTP/1.1 103 Early Hints\r\nLink: </app.css>; rel=preload\r\n\r\nHTTP/1.1 200 OK\r\nAlt-Svc: h3=\":443\"\r\n\r\n",
+		},
+		{
+			name:     "truncated header",
+			response: "HTTP/1.1 200 OK\r\nContent-",
+			want:     "HTTP/1.1 200 OK\r\nContent-",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst strings.Builder
+			src := bufio.NewReader(strings.NewReader(tt.response))
+
+			err := injectResponseHeader(&dst, src, `Alt-Svc: h3=":443"`)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("injectResponseHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if dst.String() != tt.want {
+				t.Errorf("injectResponseHeader() wrote %q, want %q", dst.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPWithoutHijacker(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	session := registerTestTunnel(t, s, "app")
+	go serveTunnelStreams(session, "HTTP/1.1 201 Created\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: keep-alive\r\n"+
+		"Content-Length: 7\r\n"+
+		"\r\n"+
+		"created")
+
+	// httptest.ResponseRecorder doesn't implement http.Hijacker, like HTTP/3
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://app.localhost/items", strings.NewReader("payload"))
+	s.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if string(body) != "created" {
+		t.Errorf("body = %q, want %q", body, "created")
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if c := resp.Header.Get("Connection"); c != "" {
+		t.Errorf("hop-by-hop Connection header forwarded: %q", c)
+	}
+}
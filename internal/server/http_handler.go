@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 )
 
@@ -44,6 +45,19 @@ func parseHTTPHost(conn net.Conn) (host string, newConn net.Conn, err error) {
 	return host, &parsedConn{Conn: conn, reader: combined}, nil
 }
 
+// stripPort returns host without its port, if any, and without the brackets
+// around an IPv6 literal ("[::1]:8080" → "::1").
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// subdomainPattern is a subdomain visitors can reach: one DNS label, in the
+// lowercase browsers send.
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
 // extractSubdomain parses the Host header and extracts the subdomain.
 // Expected formats:
 //   - "abc123.tunnel.example.com" → "abc123"
@@ -51,13 +65,11 @@ func parseHTTPHost(conn net.Conn) (host string, newConn net.Conn, err error) {
 //   - "abc123.localhost" → "abc123"
 //   - "abc123.localhost:8080" → "abc123"
 //   - "localhost:8080" → "" (no subdomain)
+//   - "127.0.0.1:8080", "[::1]:8080" → "" (IP addresses have no subdomain)
 func extractSubdomain(host string) string {
-	// Remove port if present
-	if colonIdx := strings.LastIndex(host, ":"); colonIdx != -1 {
-		// Check it's not IPv6 (which has multiple colons)
-		if strings.Count(host, ":") == 1 {
-			host = host[:colonIdx]
-		}
+	host = stripPort(host)
+	if net.ParseIP(host) != nil {
+		return ""
 	}
 
 	// Split by dots
@@ -182,7 +182,17 @@ func TestExtractSubdomain(t *testing.T) {
 		{
 			name: "IP address with port",
 			host: "127.0.0.1:8080",
-			want: "127",
+			want: "",
+		},
+		{
+			name: "bracketed IPv6 address with port",
+			host: "[::1]:8080",
+			want: "",
+		},
+		{
+			name: "bracketed IPv6 address no port",
+			host: "[2001:db8::1]",
+			want: "",
 		},
 		{
 			name: "empty string",
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// identityTTL is how long a UserJWTHeader token is valid. It is sent with
+// every request, so it only needs to outlive the request.
+const identityTTL = 5 * time.Minute
+
+// identitySigner signs the identities of visitors private tunnels
+// authenticated.
+type identitySigner struct {
+	path string // "" = a new key each start
+	key  ed25519.PrivateKey
+	kid  string
+}
+
+// newIdentitySigner returns a signer with a new key, replaced by the one at
+// path when loaded.
+func newIdentitySigner() *identitySigner {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	return (&identitySigner{}).use(key)
+}
+
+// use makes key the signing key.
+func (id *identitySigner) use(key ed25519.PrivateKey) *identitySigner {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	id.key, id.kid = key, hex.EncodeToString(sum[:8])
+	return id
+}
+
+// WithIdentityKey signs forwarded visitor identities with the Ed25519 key
+// in the PKCS #8 PEM file at path, generating it if it doesn't exist, so
+// local services can keep trusting the same key across restarts. Without
+// it, a new key is generated each start.
+func (s *Server) WithIdentityKey(path string) *Server {
+	s.identity.path = path
+	return s
+}
+
+// load reads the signing key, creating it if needed.
+func (id *identitySigner) load() error {
+	if id.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(id.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return id.save()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read identity key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return fmt.Errorf("identity key %s is not a PEM private key", id.path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid identity key %s: %w", id.path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("identity key %s is not an Ed25519 key", id.path)
+	}
+	id.use(key)
+	return nil
+}
+
+// save writes the generated key to path, readable only by the server.
+func (id *identitySigner) save() error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(id.path), 0o700); err != nil {
+		return fmt.Errorf("failed to save identity key: %w", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(id.path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save identity key: %w", err)
+	}
+	slog.Info("generated identity key", "path", id.path, "kid", id.kid)
+	return nil
+}
+
+// sign returns a JWT asserting that the visitor of audience is user.
+func (id *identitySigner) sign(issuer, audience, user, email string, now time.Time) string {
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": id.kid})
+	claims, _ := json.Marshal(struct {
+		Issuer    string `json:"iss"`
+		Subject   string `json:"sub"`
+		Audience  string `json:"aud"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Email     string `json:"email,omitempty"`
+	}{issuer, user, audience, now.Unix(), now.Add(identityTTL).Unix(), email})
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(id.key, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// serveJWKS answers with the key set that verifies sign's tokens.
+func (id *identitySigner) serveJWKS(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "max-age=300")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(id.key.Public().(ed25519.PublicKey)),
+			"kid": id.kid,
+			"alg": "EdDSA",
+			"use": "sig",
+		}},
+	})
+}
+
+// certIdentity names the visitor a client certificate belongs to: its first
+// email address, or else its common name.
+func certIdentity(cert *x509.Certificate) (user, email string) {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0], cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName, ""
+}
+
+// forwardIdentity tells the local service who the visitor authenticated as,
+// replacing identity headers the visitor sent. cert is the visitor's
+// verified client certificate, or nil if they didn't authenticate as anyone.
+func (s *Server) forwardIdentity(r *http.Request, client *tunnelClient, cert *x509.Certificate) {
+	r.Header.Del(protocol.UserHeader)
+	r.Header.Del(protocol.UserJWTHeader)
+	if cert == nil {
+		return
+	}
+	user, email := certIdentity(cert)
+	if user == "" {
+		return
+	}
+	issuer := "otun"
+	if s.domain != "" {
+		issuer = "https://" + s.domain
+	}
+	r.Header.Set(protocol.UserHeader, user)
+	r.Header.Set(protocol.UserJWTHeader, s.identity.sign(issuer, s.tunnelURL(client.subdomain), user, email, time.Now()))
+	s.metrics.identities.Inc()
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestPrivateTunnelForwardsIdentity(t *testing.T) {
+	caPEM, issue := newTestCA(t)
+	s := New("", "", "", "tunnel.example.com", "", nil)
+	client := &tunnelClient{subdomain: "private", access: newAccessPolicy(&protocol.RegisterMessage{ClientCA: caPEM})}
+
+	r := httptest.NewRequest("GET", "https://private.tunnel.example.com/", nil)
+	r.Header.Set(protocol.UserHeader, "spoofed")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{issue(x509.ExtKeyUsageClientAuth)}}
+	if !s.checkAccess(httptest.NewRecorder(), r, client) {
+		t.Fatal("visitor with a valid certificate was refused")
+	}
+	if got := r.Header.Get(protocol.UserHeader); got != "visitor" {
+		t.Errorf("%s = %q, want the certificate's common name", protocol.UserHeader, got)
+	}
+
+	// The JWT verifies against the key set the tunnel serves
+	rec := httptest.NewRecorder()
+	if s.checkAccess(rec, httptest.NewRequest("GET", "https://private.tunnel.example.com"+protocol.JWKSPath, nil), client) {
+		t.Fatal("JWKS request was forwarded to the local service")
+	}
+	var jwks struct {
+		Keys []struct {
+			X   string `json:"x"`
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("invalid JWKS %q: %v", rec.Body, err)
+	}
+	pub, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+
+	parts := strings.Split(r.Header.Get(protocol.UserJWTHeader), ".")
+	if len(parts) != 3 {
+		t.Fatalf("%s = %q is not a JWT", protocol.UserJWTHeader, r.Header.Get(protocol.UserJWTHeader))
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), signature) {
+		t.Error("JWT signature doesn't verify")
+	}
+	var claims struct {
+		Issuer   string `json:"iss"`
+		Subject  string `json:"sub"`
+		Audience string `json:"aud"`
+		Expires  int64  `json:"exp"`
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "https://tunnel.example.com" || claims.Subject != "visitor" || claims.Audience != s.tunnelURL("private") {
+		t.Errorf("claims = %+v", claims)
+	}
+	if time.Until(time.Unix(claims.Expires, 0)) > identityTTL {
+		t.Errorf("token expires at %v, later than %v from now", time.Unix(claims.Expires, 0), identityTTL)
+	}
+}
+
+func TestSecretAccessForwardsNoIdentity(t *testing.T) {
+	const secret = "0123456789abcdef"
+	s := New("", "", "", "", "", nil)
+	client := &tunnelClient{subdomain: "private", access: newAccessPolicy(&protocol.RegisterMessage{AccessSecret: secret})}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(protocol.AccessHeader, secret)
+	r.Header.Set(protocol.UserHeader, "spoofed")
+	r.Header.Set(protocol.UserJWTHeader, "spoofed")
+	if !s.checkAccess(httptest.NewRecorder(), r, client) {
+		t.Fatal("visitor with the secret was refused")
+	}
+	for _, h := range []string{protocol.UserHeader, protocol.UserJWTHeader} {
+		if got := r.Header.Get(h); got != "" {
+			t.Errorf("%s = %q, want it removed", h, got)
+		}
+	}
+
+	// Public tunnels don't serve a key set
+	r = httptest.NewRequest("GET", protocol.JWKSPath, nil)
+	if !s.checkAccess(httptest.NewRecorder(), r, &tunnelClient{}) {
+		t.Error("public tunnel intercepted a request for the JWKS path")
+	}
+	if got := s.metrics.identities.Value(); got != 0 {
+		t.Errorf("identities forwarded = %d, want 0", got)
+	}
+}
+
+func TestIdentityKeyPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	first := newIdentitySigner()
+	first.path = path
+	if err := first.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+
+	second := newIdentitySigner()
+	second.path = path
+	if err := second.load(); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if second.kid != first.kid || !second.key.Equal(first.key) {
+		t.Error("reloaded identity key differs from the generated one")
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isInterim reports whether status is an informational (1xx) response that
+// precedes the final response, such as 100 Continue or 103 Early Hints.
+// 101 Switching Protocols is final: the connection stops being HTTP.
+func isInterim(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+// expectsContinue reports whether r waits for 100 Continue before sending
+// its body.
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue") && r.ContentLength != 0
+}
+
+// writeRequestHead writes r's request line and headers without its body.
+// It is used for hijacked requests that expect 100 Continue: r.Write would
+// block reading a body the visitor only sends once the local service
+// answers, so the body is left on the connection to be proxied raw.
+func writeRequestHead(w io.Writer, r *http.Request) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.RequestURI, r.Host)
+	r.Header.WriteSubset(bw, map[string]bool{"Host": true, "Content-Length": true, "Transfer-Encoding": true})
+	if len(r.TransferEncoding) > 0 {
+		fmt.Fprintf(bw, "Transfer-Encoding: %s\r\n", strings.Join(r.TransferEncoding, ", "))
+	} else if r.ContentLength > 0 {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", r.ContentLength)
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// writeInterim sends an informational response from the tunnel to w, which
+// must not have had any headers set yet. 100 Continue is dropped: the front
+// server answers the visitor's Expect itself when the body is read.
+func writeInterim(w http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode == http.StatusContinue {
+		return
+	}
+	h := w.Header()
+	for k, vv := range resp.Header {
+		h[k] = vv
+	}
+	w.WriteHeader(resp.StatusCode)
+	// The headers of an interim response don't carry over to the final one
+	clear(h)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusConnSkipsInterimResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     int
+	}{
+		{name: "final only", response: "HTTP/1.1 404 Not Found\r\n\r\n", want: 404},
+		{name: "after 100 continue", response: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\n\r\n", want: 201},
+		{name: "after early hints", response: "HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 200 OK\r\n\r\n", want: 200},
+		{name: "switching protocols is final", response: "HTTP/1.1 101 Switching Protocols\r\n\r\nHTTP/1.1 200 OK", want: 101},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, w := net.Pipe()
+			go func() {
+				// Small writes, as interim and final heads may span reads
+				for _, b := range []byte(tt.response) {
+					w.Write([]byte{b})
+				}
+				w.Close()
+			}()
+			var reported []int
+			c := &statusConn{Conn: upstream, onStatus: func(status int) { reported = append(reported, status) }}
+			io.Copy(io.Discard, c)
+			if c.status != tt.want {
+				t.Errorf("status = %d, want %d", c.status, tt.want)
+			}
+			if len(reported) != 1 || reported[0] != tt.want {
+				t.Errorf("onStatus got %v, want [%d]", reported, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectContinueThroughTunnel(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{name: "kept alive", server: New("", "", "", "", "", nil)},
+		// The response gets Connection: close added to its head
+		{name: "closed after response", server: New("", "", "", "", "", nil).WithHeaderLimits(0, 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testExpectContinue(t, tt.server)
+		})
+	}
+}
+
+func testExpectContinue(t *testing.T, s *Server) {
+	session := registerTestTunnel(t, s, "app")
+	go func() {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		// The local service sees the Expect and answers it before the body
+		br := bufio.NewReader(stream)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Header.Get("Expect") != "100-continue" {
+			return
+		}
+		io.WriteString(stream, "HTTP/1.1 100 Continue\r\n\r\n")
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(stream, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\nConnection: close\r\n\r\n"+string(body))
+	}()
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: app.localhost\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("waiting for 100 Continue: %v", err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("status = %d, want 100", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "data")
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "data" {
+		t.Errorf("got %d %q, want 200 \"data\"", resp.StatusCode, body)
+	}
+}
+
+func TestRoundTripInterimAndTrailers(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	session := registerTestTunnel(t, s, "app")
+	go serveTunnelStreams(session, "HTTP/1.1 103 Early Hints\r\n"+
+		"Link: </app.css>; rel=preload\r\n"+
+		"\r\n"+
+		"HTTP/1.1 200 OK\r\n"+
+		"Content-Type: application/grpc-web\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Trailer: Grpc-Status\r\n"+
+		"\r\n"+
+		"2\r\nok\r\n"+
+		"0\r\nGrpc-Status: 0\r\n\r\n")
+
+	// HTTP/2 connections can't be hijacked, so they take the round-trip path
+	ts := httptest.NewUnstartedServer(s)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			hints = append(hints, header.Get("Link"))
+			return nil
+		},
+	}
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	req, _ := http.NewRequestWithContext(ctx, "POST", ts.URL+"/svc", strings.NewReader("payload"))
+	req.Host = "app.localhost"
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("proto = %s, want HTTP/2", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q, want 200 \"ok\"", resp.StatusCode, body)
+	}
+	if len(hints) != 1 || hints[0] != "</app.css>; rel=preload" {
+		t.Errorf("early hints = %q", hints)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("Grpc-Status trailer = %q, want 0", got)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// introspectRate and introspectBurst limit how often a client key may
+	// introspect itself. The admin key isn't limited.
+	introspectRate  = 1 // per second
+	introspectBurst = 10
+)
+
+// TokenIDHeader tells the local service which API key the tunnel a request
+// came through was registered with, as the same non-secret ID the admin API
+// uses. The local service can look it up with GET /api/tokens/{token_id}.
+const TokenIDHeader = "X-Otun-Token-Id"
+
+// tokenIntrospection is the admin API representation of an API key.
+type tokenIntrospection struct {
+	TokenID string `json:"token_id"`
+
+	// Tunnels are the online tunnels registered with the key
+	Tunnels []tunnelInfo `json:"tunnels"`
+
+	// Email and SubdomainPrefix are set for keys issued through signup, and
+	// like Owned, the subdomains the key owns, only shown to the admin key
+	Email           string   `json:"email,omitempty"`
+	SubdomainPrefix string   `json:"subdomain_prefix,omitempty"`
+	Owned           []string `json:"owned,omitempty"`
+}
+
+// newIntrospectionLimiter returns the limiter of keys introspecting
+// themselves, which it tracks by token ID.
+func newIntrospectionLimiter() *visitorLimiter {
+	return &visitorLimiter{rate: introspectRate, burst: introspectBurst, visitors: make(map[visitorKey]*visitorState)}
+}
+
+// tagTokenID sets the TokenIDHeader on r, replacing any the visitor sent.
+// Tunnels opened without an API key get none.
+func tagTokenID(r *http.Request, client *tunnelClient) {
+	r.Header.Del(TokenIDHeader)
+	if client.token != "" {
+		r.Header.Set(TokenIDHeader, tokenID(client.token))
+	}
+}
+
+// findTokenLocked returns the API key whose ID is id, if the server knows
+// it from its keys, connected clients, or subdomain owners.
+// Must be called with s.mu held.
+func (s *Server) findTokenLocked(id string) (string, bool) {
+	for token := range s.apiKeys {
+		if tokenID(token) == id {
+			return token, true
+		}
+	}
+	if p := s.policies.load(); p != nil {
+		for token := range p.tokens {
+			if tokenID(token) == id {
+				return token, true
+			}
+		}
+	}
+	for _, clients := range []map[string]*tunnelClient{s.clients, s.canaries} {
+		for _, client := range clients {
+			if client.token != "" && tokenID(client.token) == id {
+				return client.token, true
+			}
+		}
+	}
+	for _, o := range s.owners {
+		if tokenID(o.owner) == id {
+			return o.owner, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) handleIntrospectToken(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	id := r.PathValue("tokenID")
+
+	// Client keys may only introspect themselves, and only so often
+	if !caller.admin {
+		if tokenID(caller.token) != id {
+			writeJSONError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		done, err := s.introspections.acquire("", id, time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusTooManyRequests, "too many introspection requests, try again shortly")
+			return
+		}
+		done()
+	}
+
+	s.mu.RLock()
+	token, found := caller.token, !caller.admin
+	if caller.admin {
+		token, found = s.findTokenLocked(id)
+	}
+	info := tokenIntrospection{TokenID: id, Tunnels: []tunnelInfo{}}
+	if found {
+		for subdomain, client := range s.clients {
+			if client.token == token {
+				info.Tunnels = append(info.Tunnels, s.tunnelInfoLocked(subdomain))
+			}
+		}
+		for subdomain, o := range s.owners {
+			if caller.admin && o.owner == token {
+				info.Owned = append(info.Owned, subdomain)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if caller.admin && s.signup != nil {
+		if issued := s.signup.lookup(token); issued != nil {
+			info.Email = issued.Email
+			info.SubdomainPrefix = issued.Prefix
+		}
+	}
+	sort.Slice(info.Tunnels, func(i, j int) bool { return info.Tunnels[i].Subdomain < info.Tunnels[j].Subdomain })
+	sort.Strings(info.Owned)
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTagTokenID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(TokenIDHeader, "spoofed")
+	tagTokenID(r, &tunnelClient{token: "owner-key"})
+	if got := r.Header.Values(TokenIDHeader); len(got) != 1 || got[0] != tokenID("owner-key") {
+		t.Errorf("%s = %q, want %q", TokenIDHeader, got, tokenID("owner-key"))
+	}
+
+	r.Header.Set(TokenIDHeader, "spoofed")
+	tagTokenID(r, &tunnelClient{anonymous: true})
+	if got := r.Header.Get(TokenIDHeader); got != "" {
+		t.Errorf("%s = %q for an anonymous tunnel, want none", TokenIDHeader, got)
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	s.mu.Lock()
+	s.clients["demo"] = &tunnelClient{subdomain: "demo", token: "owner-key", labels: map[string]string{"team": "payments"}}
+	s.mu.Unlock()
+
+	tests := []struct {
+		name     string
+		token    string
+		id       string
+		wantCode int
+	}{
+		{"admin key", "root-key", tokenID("owner-key"), http.StatusOK},
+		{"own key", "owner-key", tokenID("owner-key"), http.StatusOK},
+		{"another key", "team-key", tokenID("owner-key"), http.StatusNotFound},
+		{"unknown id", "root-key", "000000000000", http.StatusNotFound},
+		{"no key", "", tokenID("owner-key"), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(t, h, "GET", "/api/tokens/"+tt.id, tt.token, "")
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var info tokenIntrospection
+			if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(info.Tunnels) != 1 || info.Tunnels[0].Subdomain != "demo" || info.Tunnels[0].Labels["team"] != "payments" {
+				t.Errorf("tunnels = %+v, want demo labeled team=payments", info.Tunnels)
+			}
+			// Keys introspecting themselves only see their tunnels
+			wantOwned := 1
+			if tt.token != "root-key" {
+				wantOwned = 0
+			}
+			if len(info.Owned) != wantOwned || (wantOwned == 1 && info.Owned[0] != "demo") {
+				t.Errorf("owned = %v, want %d subdomains", info.Owned, wantOwned)
+			}
+		})
+	}
+}
+
+func TestIntrospectTokenRateLimit(t *testing.T) {
+	_, h := newSharingTestServer(t)
+
+	for i := range introspectBurst {
+		if rec := adminRequest(t, h, "GET", "/api/tokens/"+tokenID("owner-key"), "owner-key", ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+	if rec := adminRequest(t, h, "GET", "/api/tokens/"+tokenID("owner-key"), "owner-key", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status past the burst = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec := adminRequest(t, h, "GET", "/api/tokens/"+tokenID("owner-key"), "root-key", ""); rec.Code != http.StatusOK {
+		t.Errorf("admin key status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
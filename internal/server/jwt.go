@@ -0,0 +1,480 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+const (
+	// jwksTimeout bounds each fetch of a tunnel's JWKS.
+	jwksTimeout = 10 * time.Second
+
+	// jwksTTL is how long fetched keys are used before they're fetched
+	// again, to pick up rotations.
+	jwksTTL = time.Hour
+
+	// jwksMinRefresh limits how often a token signed with an unknown key,
+	// or a failing JWKS URL, makes the server fetch the keys again.
+	jwksMinRefresh = time.Minute
+
+	// maxJWKSBytes bounds a fetched key set.
+	maxJWKSBytes = 1 << 20
+
+	// jwtLeeway tolerates clock skew between the server and the issuer.
+	jwtLeeway = time.Minute
+)
+
+var (
+	errNoBearerToken = errors.New("no bearer token")
+	errUnknownKey    = errors.New("token signed with an unknown key")
+)
+
+// jwtPolicy verifies the bearer JWTs of a tunnel's requests.
+type jwtPolicy struct {
+	*protocol.JWTPolicy
+	keys *jwks
+}
+
+// WithJWKSHosts lets tunnels require JWTs signed with keys fetched from
+// these hosts; "*.example.com" allows any subdomain of example.com. Tunnels
+// can't require JWTs without it, since the server fetches the key sets the
+// clients name.
+func (s *Server) WithJWKSHosts(hosts []string) *Server {
+	s.jwksHosts = hosts
+	return s
+}
+
+// checkJWKSURL returns why the server won't fetch a key set from rawURL,
+// if it won't.
+func (s *Server) checkJWKSURL(rawURL string) error {
+	if len(s.jwksHosts) == 0 {
+		return errors.New("JWT validation is disabled on this server")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS URL: %w", err)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range s.jwksHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok && strings.HasSuffix(host, suffix) || host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("this server doesn't fetch JWKS from %s", host)
+}
+
+// newJWKSClient returns the client fetching key sets. It only connects to
+// public addresses, so a key set URL can't reach the server's own network,
+// whatever its host resolves to.
+func newJWKSClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: jwksTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(ip) {
+				return fmt.Errorf("refusing to fetch JWKS from non-public address %s", ip)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: jwksTimeout, Transport: transport}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598).
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublicAddr reports whether ip is routable on the internet.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// newJWTPolicy returns the policy requested in msg, or nil if there is
+// none. The policy must have passed Validate.
+func (s *Server) newJWTPolicy(msg *protocol.RegisterMessage) *jwtPolicy {
+	if msg.JWT == nil {
+		return nil
+	}
+	return &jwtPolicy{JWTPolicy: msg.JWT, keys: &jwks{url: msg.JWT.JWKSURL, client: s.jwksClient}}
+}
+
+// applies reports whether requests for urlPath need a token.
+func (p *jwtPolicy) applies(urlPath string) bool {
+	return underPath(p.Path, urlPath)
+}
+
+// jwtClaims are the registered claims a jwtPolicy checks.
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is an aud claim, which may be a string or a list of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// verify checks token's signature and claims at now.
+func (p *jwtPolicy) verify(ctx context.Context, token string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("malformed token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature: %w", err)
+	}
+	key, err := p.keys.key(ctx, header.Kid, now)
+	if err != nil {
+		return err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("malformed token claims: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if p.Issuer != "" && claims.Issuer != p.Issuer {
+		return fmt.Errorf("token issued by %q", claims.Issuer)
+	}
+	if p.Audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == p.Audience {
+				return nil
+			}
+		}
+		return fmt.Errorf("token not meant for audience %q", p.Audience)
+	}
+	return nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON part of a JWT into v.
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWTSignature checks signature over signed with key for alg. Only
+// asymmetric algorithms are accepted, and key must be of alg's type, so a
+// token can't pick a weaker check than its issuer intended.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	// Algorithms are a family (RS, PS, ES) and hash size, or EdDSA
+	var family string
+	var h crypto.Hash
+	if len(alg) == 5 {
+		family = alg[:2]
+		h = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	}
+	var digest []byte
+	if h != 0 {
+		d := h.New()
+		d.Write(signed)
+		digest = d.Sum(nil)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case h != 0 && family == "RS":
+			return checked(rsa.VerifyPKCS1v15(k, h, digest, signature) == nil)
+		case h != 0 && family == "PS":
+			return checked(rsa.VerifyPSS(k, h, digest, signature, nil) == nil)
+		}
+	case *ecdsa.PublicKey:
+		curve := map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}[alg]
+		if curve == "" || curve != k.Curve.Params().Name {
+			break
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return checked(false)
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		return checked(ecdsa.Verify(k, digest, r, s))
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			return checked(ed25519.Verify(k, signed, signature))
+		}
+	}
+	return fmt.Errorf("unsupported token algorithm %q for its key", alg)
+}
+
+// checked turns a signature check's result into an error.
+func checked(ok bool) error {
+	if !ok {
+		return errors.New("invalid token signature")
+	}
+	return nil
+}
+
+// jwks caches the keys of a JSON Web Key Set.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey // kid -> key; "" for keys without one
+	fetched  time.Time                   // last fetch attempt
+	err      error                       // of the last fetch attempt
+	fetching chan struct{}               // closed when the fetch in flight ends (nil = none)
+}
+
+// key returns the key with kid, fetching the set if it's stale or doesn't
+// have it. A token without a kid may use the set's only key. The set is
+// fetched without holding j.mu, so requests with known keys don't wait for
+// a slow JWKS endpoint; only those needing the new set do.
+func (j *jwks) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	known := j.has(kid)
+	sinceFetch := now.Sub(j.fetched)
+	stale := j.fetched.IsZero() || sinceFetch > jwksTTL || (!known && sinceFetch >= jwksMinRefresh)
+	switch {
+	case stale && j.fetching == nil:
+		j.fetched = now
+		done := make(chan struct{})
+		j.fetching = done
+		j.mu.Unlock()
+
+		// Not cut short by the visitor who happened to trigger it, as
+		// other requests wait for it too
+		keys, err := fetchJWKS(context.WithoutCancel(ctx), j.client, j.url)
+		if err != nil {
+			slog.Warn("failed to fetch JWKS", "url", j.url, "error", err)
+		}
+
+		j.mu.Lock()
+		j.err = err
+		if err == nil {
+			j.keys = keys
+		}
+		j.fetching = nil
+		close(done)
+	case j.fetching != nil && !known:
+		// Another request is fetching the set this one needs
+		wait := j.fetching
+		j.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		j.mu.Lock()
+	}
+	defer j.mu.Unlock()
+
+	if j.keys == nil && j.err != nil {
+		return nil, j.err
+	}
+
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	return nil, errUnknownKey
+}
+
+// has reports whether the cached set holds the key with kid. Must be
+// called with j.mu held.
+func (j *jwks) has(kid string) bool {
+	_, ok := j.keys[kid]
+	return ok || (kid == "" && len(j.keys) == 1)
+}
+
+// jsonWebKey is a key of a JSON Web Key Set, as RFC 7517 and RFC 8037
+// define it.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches the signing keys of the key set at url. Keys of types
+// the server can't verify with are skipped.
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys (RSA, EC, or Ed25519)")
+	}
+	return keys, nil
+}
+
+// publicKey decodes k.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// bearerToken returns the token in r's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// checkJWT answers 401 and reports false if client requires a JWT and r
+// doesn't carry a valid one.
+func (s *Server) checkJWT(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	p := client.jwt
+	if p == nil || !p.applies(r.URL.Path) {
+		return true
+	}
+	token, ok := bearerToken(r)
+	err := errNoBearerToken
+	if ok {
+		err = p.verify(r.Context(), token, time.Now())
+	}
+	if err == nil {
+		return true
+	}
+
+	s.metrics.jwtRejected.Inc()
+	slog.Debug("request without a valid JWT refused", "subdomain", client.subdomain, "remote_addr", r.RemoteAddr, "error", err)
+	challenge := `Bearer realm="otun"`
+	if ok {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	s.httpError(w, r, "A valid bearer token is required", http.StatusUnauthorized)
+	return false
+}
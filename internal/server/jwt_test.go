@@ -0,0 +1,332 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// jwtTestKeys are an issuer's signing keys, served as a JWKS.
+type jwtTestKeys struct {
+	ed  ed25519.PrivateKey
+	ec  *ecdsa.PrivateKey
+	rsa *rsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtTestKeys{ed: ed, ec: ec, rsa: rsaKey}
+}
+
+func (k *jwtTestKeys) jwks() []byte {
+	b64 := base64.RawURLEncoding.EncodeToString
+	data, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": b64(k.ed.Public().(ed25519.PublicKey))},
+		{"kty": "EC", "crv": "P-256", "kid": "ec", "x": b64(k.ec.X.FillBytes(make([]byte, 32))), "y": b64(k.ec.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(k.rsa.N.Bytes()), "e": "AQAB"},
+	}})
+	return data
+}
+
+// sign returns a JWT with claims, signed with the key named kid using alg.
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch kid {
+	case "ed":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	case "ec":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "rsa":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newJWTTestServer returns a server whose JWT policies fetch keys' JWKS
+// from a test issuer, and the number of fetches made.
+func newJWTTestServer(t *testing.T, keys *jwtTestKeys) (*Server, string, *atomic.Int32) {
+	t.Helper()
+	var fetches atomic.Int32
+	issuer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(keys.jwks())
+	}))
+	t.Cleanup(issuer.Close)
+
+	s := New("", "", "", "", "", nil)
+	s.jwksClient = issuer.Client()
+	return s, issuer.URL + "/jwks.json", &fetches
+}
+
+func TestJWTPolicyVerify(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	s, jwksURL, fetches := newJWTTestServer(t, keys)
+	p := s.newJWTPolicy(&protocol.RegisterMessage{JWT: &protocol.JWTPolicy{
+		JWKSURL:  jwksURL,
+		Issuer:   "https://id.example.com",
+		Audience: "partner-api",
+	}})
+
+	now := time.Now()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://id.example.com", "aud": "partner-api", "sub": "acme", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "EdDSA", token: keys.sign(t, "EdDSA", "ed", claims(nil))},
+		{name: "ES256", token: keys.sign(t, "ES256", "ec", claims(nil))},
+		{name: "RS256", token: keys.sign(t, "RS256", "rsa", claims(nil))},
+		{name: "audience list", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"aud": []string{"other", "partner-api"}}))},
+		{name: "expired within leeway", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"exp": now.Add(-jwtLeeway / 2).Unix()}))},
+		{name: "expired", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})), wantErr: true},
+		{name: "no expiry", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"exp": nil})), wantErr: true},
+		{name: "not yet valid", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})), wantErr: true},
+		{name: "other issuer", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"iss": "https://evil.example.com"})), wantErr: true},
+		{name: "other audience", token: keys.sign(t, "EdDSA", "ed", claims(map[string]any{"aud": "internal"})), wantErr: true},
+		{name: "algorithm of another key type", token: keys.sign(t, "ES256", "rsa", claims(nil)), wantErr: true},
+		{name: "alg none", token: keys.sign(t, "none", "ed", claims(nil)), wantErr: true},
+		{name: "encryption key", token: keys.sign(t, "RS256", "enc", claims(nil)), wantErr: true},
+		{name: "unknown key", token: keys.sign(t, "EdDSA", "gone", claims(nil)), wantErr: true},
+		{name: "tampered", token: keys.sign(t, "EdDSA", "ed", claims(nil)) + "AA", wantErr: true},
+		{name: "not a JWT", token: "opaque-token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.verify(t.Context(), tt.token, now); (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Unknown keys refetch the set, but at most once per jwksMinRefresh
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", got)
+	}
+	p.verify(t.Context(), keys.sign(t, "EdDSA", "gone", claims(nil)), now.Add(jwksMinRefresh))
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times after jwksMinRefresh, want 2", got)
+	}
+}
+
+func TestCheckJWT(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	s, jwksURL, _ := newJWTTestServer(t, keys)
+	client := &tunnelClient{subdomain: "partner", jwt: s.newJWTPolicy(&protocol.RegisterMessage{JWT: &protocol.JWTPolicy{JWKSURL: jwksURL, Path: "/api"}})}
+	valid := keys.sign(t, "EdDSA", "ed", map[string]any{"exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		wantOK        bool
+		wantChallenge string
+	}{
+		{name: "valid token", path: "/api/orders", authorization: "Bearer " + valid, wantOK: true},
+		{name: "lowercase scheme", path: "/api", authorization: "bearer " + valid, wantOK: true},
+		{name: "outside the path", path: "/health", wantOK: true},
+		{name: "double slash", path: "//api/orders", wantChallenge: `Bearer realm="otun"`},
+		{name: "dot segments", path: "/x/../api/orders", wantChallenge: `Bearer realm="otun"`},
+		{name: "no token", path: "/api/orders", wantChallenge: `Bearer realm="otun"`},
+		{name: "basic auth", path: "/api/orders", authorization: "Basic dXNlcjpwYXNz", wantChallenge: `Bearer realm="otun"`},
+		{name: "invalid token", path: "/api/orders", authorization: "Bearer " + valid + "x", wantChallenge: `Bearer realm="otun", error="invalid_token"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			if ok := s.checkJWT(rec, r, client); ok != tt.wantOK {
+				t.Fatalf("checkJWT() = %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantOK {
+				return
+			}
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantChallenge)
+			}
+		})
+	}
+	if got := s.metrics.jwtRejected.Value(); got != 5 {
+		t.Errorf("rejected = %d, want 5", got)
+	}
+}
+
+func TestJWTRegistration(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	trusting, jwksURL, _ := newJWTTestServer(t, keys)
+	issuer := trusting.jwksClient // trusts the test issuer's certificate
+
+	tests := []struct {
+		name    string
+		hosts   []string
+		client  *http.Client // nil = the server's own
+		want    string       // error code, or "" if registered
+		wantMsg string
+	}{
+		{name: "no allowed hosts", want: protocol.ErrCodeInvalidJWTPolicy},
+		{name: "other host", hosts: []string{"id.example.com"}, client: issuer, want: protocol.ErrCodeInvalidJWTPolicy},
+		{name: "allowed host", hosts: []string{"127.0.0.1"}, client: issuer},
+		{name: "private address", hosts: []string{"127.0.0.1"}, want: protocol.ErrCodeInvalidJWTPolicy, wantMsg: "non-public"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithJWKSHosts(tt.hosts)
+			if tt.client != nil {
+				s.jwksClient = tt.client
+			}
+			reply, _ := registerSession(t, s, &protocol.RegisterMessage{JWT: &protocol.JWTPolicy{JWKSURL: jwksURL}})
+			if tt.want == "" {
+				if _, ok := reply.(*protocol.RegisteredMessage); !ok {
+					t.Fatalf("reply = %+v, want registered", reply)
+				}
+				return
+			}
+			if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != tt.want || !strings.Contains(m.Message, tt.wantMsg) {
+				t.Fatalf("reply = %+v, want error %s", reply, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckJWKSURL(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithJWKSHosts([]string{"id.example.com", "*.auth.example.org"})
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://id.example.com/jwks.json"},
+		{url: "https://ID.example.com:8443/jwks.json"},
+		{url: "https://tenant.auth.example.org/jwks.json"},
+		{url: "https://auth.example.org/jwks.json", wantErr: true},
+		{url: "https://evil-id.example.com/jwks.json", wantErr: true},
+		{url: "https://169.254.169.254/latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := s.checkJWKSURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("checkJWKSURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+	if err := New("", "", "", "", "", nil).checkJWKSURL("https://id.example.com/jwks.json"); err == nil {
+		t.Error("checkJWKSURL() without allowed hosts succeeded")
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"192.168.0.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+	}
+	for addr, want := range tests {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestJWKSFetchDoesNotBlock(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	release := make(chan struct{})
+	refetching := make(chan struct{}, 1)
+	var fetches atomic.Int32
+	issuer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			refetching <- struct{}{}
+			<-release
+		}
+		w.Write(keys.jwks())
+	}))
+	defer issuer.Close()
+	defer close(release)
+
+	j := &jwks{url: issuer.URL, client: issuer.Client()}
+	now := time.Now()
+	if _, err := j.key(t.Context(), "ed", now); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale set is refetched by one request, stuck on the endpoint...
+	later := now.Add(jwksTTL + time.Second)
+	go j.key(t.Context(), "ed", later)
+	<-refetching
+
+	// ...while the others use the keys they have
+	done := make(chan error, 1)
+	go func() {
+		_, err := j.key(t.Context(), "ec", later)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("key() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("key() waited for the refetch of a key it has")
+	}
+}
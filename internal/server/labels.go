@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bc183/otun/internal/metrics"
+)
+
+// labelFilter matches tunnels carrying key, with value if hasValue.
+type labelFilter struct {
+	key, value string
+	hasValue   bool
+}
+
+// labelFilters match tunnels satisfying all of them.
+type labelFilters []labelFilter
+
+// parseLabelFilters parses ?label= query values: "key=value" requires the
+// label to have that value, a bare "key" only that it is set.
+func parseLabelFilters(values []string) (labelFilters, error) {
+	filters := make(labelFilters, 0, len(values))
+	for _, v := range values {
+		key, value, hasValue := strings.Cut(v, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid label filter %q: expected key or key=value", v)
+		}
+		filters = append(filters, labelFilter{key: key, value: value, hasValue: hasValue})
+	}
+	return filters, nil
+}
+
+// match reports whether labels satisfy every filter.
+func (f labelFilters) match(labels map[string]string) bool {
+	for _, filter := range f {
+		value, ok := labels[filter.key]
+		if !ok || (filter.hasValue && value != filter.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupByLabel groups tunnels by their value of the label key; tunnels
+// without it are grouped under "".
+func groupByLabel(tunnels []tunnelInfo, key string) map[string][]tunnelInfo {
+	groups := make(map[string][]tunnelInfo)
+	for _, t := range tunnels {
+		groups[t.Labels[key]] = append(groups[t.Labels[key]], t)
+	}
+	return groups
+}
+
+// tunnelInfoSamples returns a series per connected HTTP tunnel, labeled
+// with its subdomain and its client's labels (prefixed with "label_"), so
+// other metrics can be joined with them and grouped by team or
+// environment.
+func (s *Server) tunnelInfoSamples() []metrics.Sample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	samples := make([]metrics.Sample, 0, len(s.clients))
+	for subdomain, client := range s.clients {
+		labels := map[string]string{"subdomain": subdomain}
+		for k, v := range client.labels {
+			labels["label_"+k] = v
+		}
+		samples = append(samples, metrics.Sample{Labels: labels, Value: 1})
+	}
+	return samples
+}
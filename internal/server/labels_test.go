@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// registerMessage sends msg to s as a new client and returns the reply.
+func registerMessage(t *testing.T, s *Server, msg *protocol.RegisterMessage) any {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+	if err := cs.SendRegisterMessage(msg); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	reply, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return reply
+}
+
+func TestRegistrationLabels(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+
+	reply := registerMessage(t, s, &protocol.RegisterMessage{Subdomain: "pay", Labels: map[string]string{"team": "payments"}})
+	if _, ok := reply.(*protocol.RegisteredMessage); !ok {
+		t.Fatalf("reply = %+v, want registered", reply)
+	}
+	if got := s.lookupClient("pay").labels["team"]; got != "payments" {
+		t.Errorf("team label = %q, want payments", got)
+	}
+
+	reply = registerMessage(t, s, &protocol.RegisterMessage{Subdomain: "bad", Labels: map[string]string{"Team Name": "x"}})
+	if e, ok := reply.(*protocol.ErrorMessage); !ok || e.Code != protocol.ErrCodeInvalidLabels {
+		t.Errorf("reply = %+v, want invalid_labels error", reply)
+	}
+}
+
+func TestListTunnelsByLabel(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	for sub, labels := range map[string]map[string]string{
+		"pay-staging": {"team": "payments", "env": "staging"},
+		"pay-prod":    {"team": "payments", "env": "prod"},
+		"search":      {"team": "search"},
+		"bare":        nil,
+	} {
+		registerTestTunnel(t, s, sub)
+		s.lookupClient(sub).labels = labels
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "", want: "bare demo pay-prod pay-staging search"},
+		{query: "?label=team=payments", want: "pay-prod pay-staging"},
+		{query: "?label=team=payments&label=env=prod", want: "pay-prod"},
+		{query: "?label=env", want: "pay-prod pay-staging"},
+		{query: "?label=team=billing", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := adminRequest(t, h, "GET", "/api/tunnels"+tt.query, "root-key", "")
+			var tunnels []tunnelInfo
+			json.NewDecoder(rec.Body).Decode(&tunnels)
+			var got []string
+			for _, info := range tunnels {
+				got = append(got, info.Subdomain)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("tunnels = %v, want %s", got, tt.want)
+			}
+		})
+	}
+
+	rec := adminRequest(t, h, "GET", "/api/tunnels?group_by=team", "root-key", "")
+	var groups map[string][]tunnelInfo
+	if err := json.NewDecoder(rec.Body).Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups["payments"]) != 2 || len(groups["search"]) != 1 || len(groups[""]) != 2 {
+		t.Errorf("groups = %v", groups)
+	}
+}
+
+func TestTunnelInfoMetric(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	registerTestTunnel(t, s, "pay")
+	s.lookupClient("pay").labels = map[string]string{"team": "payments"}
+
+	var sb strings.Builder
+	s.metrics.registry.WriteTo(&sb)
+	if want := `otun_tunnel_info{label_team="payments",subdomain="pay"} 1`; !strings.Contains(sb.String(), want) {
+		t.Errorf("metrics missing %s:\n%s", want, sb.String())
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// sessionRetryAfter is how long clients turned away at the session limit are
+// told to wait before reconnecting.
+const sessionRetryAfter = 30 * time.Second
+
+var (
+	// errTooManyConnections is returned when the server is already proxying
+	// its maximum number of public connections.
+	errTooManyConnections = errors.New("too many public connections")
+
+	// errTooManyStreams is returned when a tunnel already carries its
+	// maximum number of concurrent streams.
+	errTooManyStreams = errors.New("too many streams for tunnel")
+)
+
+// connLimiter counts concurrent users of a resource against a cap.
+type connLimiter struct {
+	active atomic.Int64
+}
+
+// acquire takes a slot, reporting false if max slots are already taken.
+// A max of zero or less means no limit.
+func (l *connLimiter) acquire(max int) bool {
+	n := l.active.Add(1)
+	if max > 0 && n > int64(max) {
+		l.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release returns a slot taken by acquire.
+func (l *connLimiter) release() {
+	l.active.Add(-1)
+}
+
+// count returns the number of slots currently taken.
+func (l *connLimiter) count() int64 {
+	return l.active.Load()
+}
+
+// WithConnectionLimits caps the number of public connections proxied at once,
+// concurrent streams per tunnel, and tunnel client sessions. Requests over a
+// cap get a 503 and new sessions are turned away, so the server sheds load
+// instead of running out of file descriptors. Zero means no limit.
+func (s *Server) WithConnectionLimits(maxConnections, maxStreamsPerTunnel, maxSessions int) *Server {
+	s.maxConnections = maxConnections
+	s.maxStreamsPerTunnel = maxStreamsPerTunnel
+	s.maxSessions = maxSessions
+	return s
+}
+
+// acquireConn reserves a public connection slot and a stream slot on client.
+// Each successful call must be paired with releaseConn.
+func (s *Server) acquireConn(client *tunnelClient) error {
+	if !s.publicConns.acquire(s.maxConnections) {
+		s.metrics.connectionsRejected.Inc()
+		return errTooManyConnections
+	}
+	if !client.streams.acquire(s.streamLimit(client)) {
+		s.publicConns.release()
+		s.metrics.streamsRejected.Inc()
+		s.warnStreams(client, true)
+		return errTooManyStreams
+	}
+	s.warnStreams(client, false)
+	return nil
+}
+
+// releaseConn frees the slots reserved by acquireConn.
+func (s *Server) releaseConn(client *tunnelClient) {
+	client.streams.release()
+	s.publicConns.release()
+}
+
+// checkFDBudget warns if the configured caps allow more connections than
+// the process may open descriptors for, as the caps would then never kick in
+// before Accept starts failing with EMFILE.
+func (s *Server) checkFDBudget() {
+	limit := fdLimit()
+	if limit < 0 || s.maxConnections <= 0 || s.maxSessions <= 0 {
+		return
+	}
+	// Each proxied connection holds a public socket; each session holds a
+	// control connection. Leave headroom for listeners, certs, and logs.
+	const headroom = 64
+	if need := float64(s.maxConnections + s.maxSessions + headroom); need > limit {
+		slog.Warn("connection limits exceed the file descriptor limit; raise it with ulimit -n",
+			"max_connections", s.maxConnections, "max_sessions", s.maxSessions, "fd_limit", limit)
+	}
+}
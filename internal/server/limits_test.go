@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestConnLimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		want int // successful acquires out of 5
+	}{
+		{name: "unlimited", max: 0, want: 5},
+		{name: "limited", max: 3, want: 3},
+		{name: "one", max: 1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l connLimiter
+			got := 0
+			for i := 0; i < 5; i++ {
+				if l.acquire(tt.max) {
+					got++
+				}
+			}
+			if got != tt.want {
+				t.Errorf("acquired %d slots, want %d", got, tt.want)
+			}
+			if l.count() != int64(tt.want) {
+				t.Errorf("count = %d, want %d", l.count(), tt.want)
+			}
+			l.release()
+			if tt.max > 0 && !l.acquire(tt.max) {
+				t.Error("acquire failed after release")
+			}
+		})
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxConns   int
+		maxStreams int
+		metric     string
+	}{
+		{name: "public connections", maxConns: 1, metric: "otun_public_connections_rejected_total 1\n"},
+		{name: "streams per tunnel", maxStreams: 1, metric: "otun_tunnel_streams_rejected_total 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithConnectionLimits(tt.maxConns, tt.maxStreams, 0)
+			go serveSlowTunnel(registerTestTunnel(t, s, "app"), "", 300*time.Millisecond, okResponse)
+
+			// Hold the only slot with a slow request
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.localhost/", nil))
+			}()
+			waitFor(t, time.Second, func() bool { return s.publicConns.count() == 1 })
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.localhost/", nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503", rec.Code)
+			}
+			if rec.Header().Get("Retry-After") == "" {
+				t.Error("missing Retry-After header")
+			}
+
+			var out strings.Builder
+			s.Metrics().WriteTo(&out)
+			if !strings.Contains(out.String(), tt.metric) {
+				t.Errorf("rejection not counted:\n%s", out.String())
+			}
+
+			// Slots are released once requests finish
+			<-done
+			if n := s.publicConns.count(); n != 0 {
+				t.Errorf("%d connections still counted", n)
+			}
+			if n := s.lookupClient("app").streams.count(); n != 0 {
+				t.Errorf("%d streams still counted", n)
+			}
+		})
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	port := freePort(t)
+	s := New("", "", "", "", "", nil).
+		WithTCPPorts(PortRange{port, port}, nil).
+		WithConnectionLimits(0, 0, 1)
+
+	msg, first := registerTCP(t, s, "", 0)
+	if _, ok := msg.(*protocol.RegisteredMessage); !ok {
+		t.Fatalf("got %T, want RegisteredMessage", msg)
+	}
+
+	msg, _ = registerTCP(t, s, "", 0)
+	errMsg, ok := msg.(*protocol.ErrorMessage)
+	if !ok || errMsg.Code != protocol.ErrCodeServerFull {
+		t.Fatalf("got %+v, want %s error", msg, protocol.ErrCodeServerFull)
+	}
+
+	// The slot frees up when the first session ends
+	first.Close()
+	waitFor(t, 2*time.Second, func() bool { return s.sessions.count() == 0 })
+}
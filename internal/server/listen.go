@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// listenNetwork returns the network to listen on addr with. An IP literal
+// binds only its own family, so "0.0.0.0:443" takes IPv4 alone and
+// "[::]:443" IPv6 alone; an empty host or a hostname listens on both.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// listenTCP listens on addr, honoring the address family of an IP literal.
+func listenTCP(addr string) (net.Listener, error) {
+	return net.Listen(listenNetwork(addr), addr)
+}
+
+// splitAddrs splits a comma-separated list of listen addresses.
+func splitAddrs(list string) []string {
+	addrs := strings.Split(list, ",")
+	for i, addr := range addrs {
+		addrs[i] = strings.TrimSpace(addr)
+	}
+	return addrs
+}
+
+// listenAll listens on every address in addrs. If one fails, the listeners
+// already opened are closed.
+func listenAll(addrs []string, port string) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := listenTCP(addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s port %s: %w", port, addr, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// serveAll runs serve on every listener until one of them stops, then
+// closes srv, and with it the other listeners, and returns why it stopped.
+func serveAll(srv *http.Server, lns []net.Listener, serve func(net.Listener) error) error {
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func() { errc <- serve(ln) }()
+	}
+	err := <-errc
+	srv.Close()
+	return err
+}
+
+// controlListener is one control port listener. The accept loop re-creates
+// it if it keeps failing.
+type controlListener struct {
+	addr string
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+// get returns the current listener.
+func (c *controlListener) get() net.Listener {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ln
+}
+
+// set replaces the current listener.
+func (c *controlListener) set(ln net.Listener) {
+	c.mu.Lock()
+	c.ln = ln
+	c.mu.Unlock()
+}
+
+// close closes the current listener.
+func (c *controlListener) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ln != nil {
+		c.ln.Close()
+	}
+}
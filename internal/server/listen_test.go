@@ -0,0 +1,107 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: ":443", want: "tcp"},
+		{addr: "tunnel.example.com:443", want: "tcp"},
+		{addr: "0.0.0.0:443", want: "tcp4"},
+		{addr: "10.0.0.5:443", want: "tcp4"},
+		{addr: "[::]:443", want: "tcp6"},
+		{addr: "[2001:db8::1]:443", want: "tcp6"},
+		{addr: "bogus", want: "tcp"},
+	}
+	for _, tt := range tests {
+		if got := listenNetwork(tt.addr); got != tt.want {
+			t.Errorf("listenNetwork(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListenTCPIPv6(t *testing.T) {
+	ln, err := listenTCP("[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	defer ln.Close()
+	if ip := ln.Addr().(*net.TCPAddr).IP; ip.To4() != nil || !ip.IsLoopback() {
+		t.Errorf("listening on %v, want the IPv6 loopback", ip)
+	}
+}
+
+func TestTunnelURLWithIPv6Addresses(t *testing.T) {
+	s := New("", "", "[::1]:8080", "", "", nil)
+	if got, want := s.tunnelURL("demo"), "http://demo.localhost:8080"; got != want {
+		t.Errorf("tunnelURL() = %q, want %q", got, want)
+	}
+
+	s = New("", "", "", "", "", nil)
+	if got, want := s.tcpTunnelURL(20000), "tcp://localhost:20000"; got != want {
+		t.Errorf("tcpTunnelURL() = %q, want %q", got, want)
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	got := splitAddrs("10.0.0.5:443, [2001:db8::1]:443")
+	if len(got) != 2 || got[0] != "10.0.0.5:443" || got[1] != "[2001:db8::1]:443" {
+		t.Errorf("splitAddrs() = %q", got)
+	}
+	if got := splitAddrs(":443"); len(got) != 1 || got[0] != ":443" {
+		t.Errorf("splitAddrs(single) = %q", got)
+	}
+}
+
+func TestListenAllClosesOnFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	_, err = listenAll([]string{"127.0.0.1:0", taken.Addr().String()}, "HTTP")
+	if err == nil || !strings.Contains(err.Error(), "HTTP port "+taken.Addr().String()) {
+		t.Fatalf("listenAll() error = %v, want one naming the busy address", err)
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	lns, err := listenAll([]string{"127.0.0.1:0", "127.0.0.1:0"}, "HTTP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	done := make(chan error, 1)
+	go func() { done <- serveAll(srv, lns, srv.Serve) }()
+
+	for _, ln := range lns {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("GET %s: %v", ln.Addr(), err)
+		}
+		resp.Body.Close()
+	}
+
+	// Losing one listener stops them all
+	lns[0].Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("serveAll did not return after a listener failed")
+	}
+	if _, err := net.Dial("tcp", lns[1].Addr().String()); err == nil {
+		t.Error("second listener still accepting after serveAll returned")
+	}
+}
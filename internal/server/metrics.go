@@ -0,0 +1,173 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/bc183/otun/internal/metrics"
+)
+
+// serverMetrics holds the metrics exported by the server.
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	acceptErrors      *metrics.Counter
+	acceptFDExhausted *metrics.Counter
+	listenerRecreated *metrics.Counter
+
+	requestsQueued *metrics.Counter
+	queueTimeouts  *metrics.Counter
+	queueDepth     *metrics.Gauge
+
+	requestTimeouts   *metrics.Counter
+	slowRequests      *metrics.Counter
+	responsesTooLarge *metrics.Counter
+	headersRejected   *metrics.Counter
+	privateDenied     *metrics.Counter
+	identities        *metrics.Counter
+	geoDenied         *metrics.Counter
+	signatureFailures *metrics.Counter
+	jwtRejected       *metrics.Counter
+	webhookReplays    *metrics.Counter
+
+	connectionsRejected *metrics.Counter
+	streamsRejected     *metrics.Counter
+	sessionsRejected    *metrics.Counter
+	visitorsThrottled   *metrics.Counter
+	visitorsTarpitted   *metrics.Counter
+
+	challengesServed *metrics.Counter
+	challengesPassed *metrics.Counter
+	challengesFailed *metrics.Counter
+
+	honeytokenHits *metrics.Counter
+
+	registrationsRejected *metrics.Counter
+	invalidMessages       *metrics.Counter
+	handshakeTimeouts     *metrics.Counter
+	anonymousTunnels      *metrics.Counter
+	anonymousExpired      *metrics.Counter
+	bannersInjected       *metrics.Counter
+	limitWarnings         *metrics.Counter
+
+	scannedRequests *metrics.Counter
+	scanBlocked     *metrics.Counter
+	scanErrors      *metrics.Counter
+
+	ocspFetches     *metrics.Counter
+	ocspFetchErrors *metrics.Counter
+
+	edgeCacheNotModified *metrics.Counter
+	edgeCacheMisses      *metrics.Counter
+	edgeCacheStores      *metrics.Counter
+
+	tlsHandshakes        *metrics.Counter
+	tlsResumedHandshakes *metrics.Counter
+	ticketKeyRotations   *metrics.Counter
+
+	speedTests     *metrics.Counter
+	speedTestBytes *metrics.Counter
+
+	relays *metrics.Counter
+
+	tlsPassthroughConns *metrics.Counter
+	tlsUnknownHosts     *metrics.Counter
+
+	streamsOrphaned *metrics.Counter
+	streamsExpired  *metrics.Counter
+
+	chaosStreamsDropped       *metrics.Counter
+	chaosRegistrationsDelayed *metrics.Counter
+	chaosSessionsKilled       *metrics.Counter
+}
+
+// newServerMetrics creates and registers the server metrics.
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:          r,
+		acceptErrors:      r.NewCounter("otun_control_accept_errors_total", "Errors returned by the control listener's Accept."),
+		acceptFDExhausted: r.NewCounter("otun_control_accept_fd_exhausted_total", "Accept errors caused by file descriptor exhaustion (EMFILE/ENFILE)."),
+		listenerRecreated: r.NewCounter("otun_control_listener_recreated_total", "Times the control listener was re-created after failing."),
+
+		requestsQueued: r.NewCounter("otun_reconnect_queued_requests_total", "Requests held while waiting for a tunnel to reconnect."),
+		queueTimeouts:  r.NewCounter("otun_reconnect_queue_timeouts_total", "Queued requests whose tunnel did not reconnect in time."),
+		queueDepth:     r.NewGauge("otun_reconnect_queue_depth", "Requests currently waiting for a tunnel to reconnect."),
+
+		requestTimeouts:   r.NewCounter("otun_request_duration_exceeded_total", "Proxied requests cut off at the maximum request duration."),
+		slowRequests:      r.NewCounter("otun_slow_requests_total", "Proxied requests logged for taking longer than the slow request threshold."),
+		responsesTooLarge: r.NewCounter("otun_response_size_exceeded_total", "Responses rejected or cut off at the tunnel's size limit."),
+		privateDenied:     r.NewCounter("otun_private_tunnel_denied_total", "Requests refused by a private tunnel for lacking its secret or a valid client certificate."),
+		identities:        r.NewCounter("otun_identities_forwarded_total", "Requests forwarded with the identity of the visitor a private tunnel authenticated by client certificate."),
+		geoDenied:         r.NewCounter("otun_geo_denied_total", "Requests refused by a tunnel's geo policy for the country or network of the visitor."),
+		signatureFailures: r.NewCounter("otun_webhook_signature_failures_total", "Requests refused for a missing or invalid webhook signature."),
+		jwtRejected:       r.NewCounter("otun_jwt_rejected_total", "Requests refused with 401 for lacking a valid bearer JWT a tunnel requires."),
+		webhookReplays:    r.NewCounter("otun_webhook_replays_total", "Webhook deliveries detected as replays of a recent delivery ID."),
+		headersRejected:   r.NewCounter("otun_request_headers_rejected_total", "Requests refused with 431 for exceeding the header size or count limit."),
+
+		connectionsRejected: r.NewCounter("otun_public_connections_rejected_total", "Public connections turned away at the connection limit."),
+		streamsRejected:     r.NewCounter("otun_tunnel_streams_rejected_total", "Public connections turned away at a tunnel's stream limit."),
+		sessionsRejected:    r.NewCounter("otun_sessions_rejected_total", "Tunnel client sessions turned away at the session limit."),
+		visitorsThrottled:   r.NewCounter("otun_visitor_throttled_total", "Requests refused with 429 for exceeding a per-visitor rate or concurrency limit."),
+		visitorsTarpitted:   r.NewCounter("otun_visitor_tarpitted_total", "Throttled requests held for the tarpit delay before being refused."),
+
+		challengesServed: r.NewCounter("otun_challenges_served_total", "Requests answered with a tunnel's interstitial challenge instead of being forwarded."),
+		challengesPassed: r.NewCounter("otun_challenges_passed_total", "Interstitial challenges visitors passed."),
+		challengesFailed: r.NewCounter("otun_challenges_failed_total", "Answers to interstitial challenges that were wrong or expired."),
+
+		honeytokenHits: r.NewCounter("otun_honeytoken_hits_total", "Requests for a tunnel's honeytoken paths, answered with 404 instead of being forwarded."),
+
+		registrationsRejected: r.NewCounter("otun_registrations_rejected_total", "Tunnel client connections turned away because the registration queue was full."),
+		invalidMessages:       r.NewCounter("otun_control_invalid_messages_total", "Control messages refused as malformed, over the protocol limits, or with unknown fields."),
+		handshakeTimeouts:     r.NewCounter("otun_registration_handshake_timeouts_total", "Tunnel client connections closed for not completing a registration step within the handshake timeout."),
+		anonymousTunnels:      r.NewCounter("otun_anonymous_tunnels_total", "Tunnels registered without an API key under the anonymous tier."),
+		anonymousExpired:      r.NewCounter("otun_anonymous_tunnels_expired_total", "Anonymous tunnels closed for reaching the anonymous tier's lifetime."),
+		bannersInjected:       r.NewCounter("otun_html_banners_injected_total", "HTML banners added to anonymous tunnels' pages."),
+		limitWarnings:         r.NewCounter("otun_limit_warnings_total", "Warnings sent to tunnel clients nearing or reaching one of their limits."),
+
+		scannedRequests: r.NewCounter("otun_scanned_requests_total", "Request bodies passed through the content scanner."),
+		scanBlocked:     r.NewCounter("otun_scan_blocked_total", "Requests refused because the content scanner rejected their body."),
+		scanErrors:      r.NewCounter("otun_scan_errors_total", "Requests refused because the content scanner failed."),
+
+		ocspFetches:     r.NewCounter("otun_ocsp_fetches_total", "Requests made to OCSP responders for staples."),
+		ocspFetchErrors: r.NewCounter("otun_ocsp_fetch_errors_total", "OCSP staple requests that failed or returned a non-good status."),
+
+		edgeCacheNotModified: r.NewCounter("otun_edge_cache_not_modified_total", "Conditional requests answered with 304 from the edge cache without using the tunnel."),
+		edgeCacheMisses:      r.NewCounter("otun_edge_cache_misses_total", "Conditional requests forwarded through the tunnel because the edge cache couldn't answer them."),
+		edgeCacheStores:      r.NewCounter("otun_edge_cache_stores_total", "Response validators stored in the edge cache."),
+
+		tlsHandshakes:        r.NewCounter("otun_tls_handshakes_total", "Completed TLS handshakes on the public listeners."),
+		tlsResumedHandshakes: r.NewCounter("otun_tls_resumed_handshakes_total", "TLS handshakes that resumed an earlier session instead of a full handshake."),
+		ticketKeyRotations:   r.NewCounter("otun_tls_ticket_key_rotations_total", "Times the session ticket encryption key changed."),
+
+		speedTests:     r.NewCounter("otun_speedtests_total", "Speed test sessions accepted from clients."),
+		speedTestBytes: r.NewCounter("otun_speedtest_bytes_total", "Bytes sent and received in speed tests."),
+
+		relays: r.NewCounter("otun_relays_total", "Chained client connections relayed to another otun server."),
+
+		tlsPassthroughConns: r.NewCounter("otun_tls_passthrough_connections_total", "TLS connections routed by SNI to a passthrough tunnel without being decrypted."),
+		tlsUnknownHosts:     r.NewCounter("otun_tls_unknown_host_handshakes_total", "TLS handshakes failed because no tunnel serves the requested server name."),
+
+		streamsOrphaned: r.NewCounter("otun_stream_watchdog_orphans_total", "Tunnel streams the watchdog closed because they were left open after their session ended."),
+		streamsExpired:  r.NewCounter("otun_stream_watchdog_expired_total", "Tunnel streams the watchdog closed for exceeding the maximum stream age."),
+
+		chaosStreamsDropped:       r.NewCounter("otun_chaos_streams_dropped_total", "Tunnel streams reset by chaos testing."),
+		chaosRegistrationsDelayed: r.NewCounter("otun_chaos_registrations_delayed_total", "Tunnel registrations held back by chaos testing."),
+		chaosSessionsKilled:       r.NewCounter("otun_chaos_sessions_killed_total", "Tunnel client sessions killed by chaos testing."),
+	}
+	r.NewGaugeFunc("otun_process_open_fds", "Number of open file descriptors.", openFDs)
+	r.NewGaugeFunc("otun_process_max_fds", "Soft limit on open file descriptors.", fdLimit)
+	r.NewGaugeFunc("otun_process_goroutines", "Number of goroutines.", numGoroutines)
+	return m
+}
+
+// serveMetrics serves the metrics endpoint on addr.
+func (s *Server) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry.Handler())
+
+	slog.Info("metrics listener started", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics server error", "error", err)
+	}
+}
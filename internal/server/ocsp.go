@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRefreshInterval is how often staples are checked for refresh.
+	ocspRefreshInterval = time.Minute
+
+	// ocspRetryInterval spaces out fetches for a certificate after a failure.
+	ocspRetryInterval = 5 * time.Minute
+
+	// ocspIdleTimeout drops staples for certificates no longer being served,
+	// e.g. after renewal.
+	ocspIdleTimeout = 24 * time.Hour
+
+	// ocspTimeout bounds each request to an OCSP responder.
+	ocspTimeout = 15 * time.Second
+)
+
+// staple is a cached OCSP response for one certificate.
+type staple struct {
+	leaf, issuer *x509.Certificate
+	der          []byte
+	thisUpdate   time.Time
+	nextUpdate   time.Time
+	lastAttempt  time.Time
+	lastUsed     time.Time
+	fetching     bool
+}
+
+// valid reports whether the staple may be served at now.
+func (st *staple) valid(now time.Time) bool {
+	return st.der != nil && now.Before(st.nextUpdate)
+}
+
+// due reports whether the staple should be refreshed: it is missing or past
+// the midpoint of its validity, and no fetch failed recently.
+func (st *staple) due(now time.Time) bool {
+	if st.fetching || now.Sub(st.lastAttempt) < ocspRetryInterval {
+		return false
+	}
+	if st.der == nil {
+		return true
+	}
+	return now.After(st.thisUpdate.Add(st.nextUpdate.Sub(st.thisUpdate) / 2))
+}
+
+// ocspStapler attaches OCSP staples to the certificates returned by a
+// GetCertificate function. Handshakes never wait on a responder: a missing
+// staple is fetched in the background and served from then on.
+type ocspStapler struct {
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	client         *http.Client
+	metrics        *serverMetrics
+
+	mu      sync.Mutex
+	staples map[[32]byte]*staple // leaf certificate hash -> staple
+}
+
+// WithOCSPStapling enables OCSP stapling for certificates that name an
+// OCSP responder.
+func (s *Server) WithOCSPStapling(enabled bool) *Server {
+	s.stapler = nil
+	if enabled {
+		s.stapler = newOCSPStapler(s.metrics)
+	}
+	return s
+}
+
+// newOCSPStapler creates a stapler; getCertificate must be set before use.
+func newOCSPStapler(m *serverMetrics) *ocspStapler {
+	return &ocspStapler{
+		client:  &http.Client{Timeout: ocspTimeout},
+		metrics: m,
+		staples: make(map[[32]byte]*staple),
+	}
+}
+
+// GetCertificate returns the certificate for hello with its staple attached,
+// if one is cached.
+func (o *ocspStapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := o.getCertificate(hello)
+	if err != nil || cert == nil || len(cert.Certificate) < 2 {
+		return cert, err
+	}
+
+	key := sha256.Sum256(cert.Certificate[0])
+	now := time.Now()
+
+	o.mu.Lock()
+	st := o.staples[key]
+	if st == nil {
+		st = o.newStaple(cert)
+		o.staples[key] = st
+	}
+	st.lastUsed = now
+	fetch := st.leaf != nil && st.due(now)
+	if fetch {
+		st.fetching = true
+	}
+	var der []byte
+	if st.valid(now) {
+		der = st.der
+	}
+	o.mu.Unlock()
+
+	if fetch {
+		go o.fetch(st)
+	}
+	if der == nil || bytes.Equal(cert.OCSPStaple, der) {
+		return cert, nil
+	}
+	// The certificate may be shared with other callers, so staple a copy
+	stapled := *cert
+	stapled.OCSPStaple = der
+	return &stapled, nil
+}
+
+// newStaple creates the cache entry for cert. Certificates without an OCSP
+// responder get an entry with no leaf, so they are only parsed once.
+func (o *ocspStapler) newStaple(cert *tls.Certificate) *staple {
+	st := &staple{}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return st
+		}
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil || len(leaf.OCSPServer) == 0 {
+		return st
+	}
+	st.leaf, st.issuer = leaf, issuer
+	return st
+}
+
+// fetch requests a fresh OCSP response for st.
+func (o *ocspStapler) fetch(st *staple) {
+	resp, der, err := o.request(st.leaf, st.issuer)
+	o.metrics.ocspFetches.Inc()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	st.fetching = false
+	st.lastAttempt = time.Now()
+	if err != nil {
+		o.metrics.ocspFetchErrors.Inc()
+		slog.Warn("failed to fetch OCSP staple", "subject", st.leaf.Subject.CommonName, "responder", st.leaf.OCSPServer[0], "error", err)
+		return
+	}
+	st.der = der
+	st.thisUpdate = resp.ThisUpdate
+	st.nextUpdate = resp.NextUpdate
+	if st.nextUpdate.IsZero() {
+		// Responders may omit NextUpdate; don't serve a staple for too long
+		st.nextUpdate = resp.ThisUpdate.Add(ocspIdleTimeout)
+	}
+	slog.Debug("OCSP staple updated", "subject", st.leaf.Subject.CommonName, "next_update", st.nextUpdate)
+}
+
+// request asks leaf's OCSP responder for its status. Only good responses
+// are returned: stapling a revoked status would just fail handshakes sooner.
+func (o *ocspStapler) request(leaf, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpResp, err := o.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder returned %s", httpResp.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("certificate status is %s", ocspStatus(resp.Status))
+	}
+	return resp, der, nil
+}
+
+// ocspStatus names an OCSP certificate status.
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// refresh keeps staples fresh and drops unused ones until done is closed.
+func (o *ocspStapler) refresh(done <-chan struct{}) {
+	ticker := time.NewTicker(ocspRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var due []*staple
+		o.mu.Lock()
+		for key, st := range o.staples {
+			if now.Sub(st.lastUsed) > ocspIdleTimeout {
+				delete(o.staples, key)
+				continue
+			}
+			if st.leaf != nil && st.due(now) {
+				st.fetching = true
+				due = append(due, st)
+			}
+		}
+		o.mu.Unlock()
+
+		for _, st := range due {
+			o.fetch(st)
+		}
+	}
+}
+
+// oldestStapleAge returns the age in seconds of the oldest staple being
+// served, measured from its thisUpdate time.
+func (o *ocspStapler) oldestStapleAge() float64 {
+	if o == nil {
+		return 0
+	}
+	now := time.Now()
+	var oldest time.Duration
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, st := range o.staples {
+		if st.der != nil {
+			oldest = max(oldest, now.Sub(st.thisUpdate))
+		}
+	}
+	return oldest.Seconds()
+}
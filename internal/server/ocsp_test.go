@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newOCSPTestCert creates a CA, a responder answering with status for every
+// request, and a leaf certificate naming that responder.
+func newOCSPTestCert(t *testing.T, status int) *tls.Certificate {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	t.Cleanup(responder.Close)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "*.tunnel.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: crypto.Signer(key)}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	cert := newOCSPTestCert(t, ocsp.Good)
+	o := newOCSPStapler(newServerMetrics())
+	o.getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+
+	// The first handshake doesn't wait for the responder
+	got, err := o.GetCertificate(nil)
+	if err != nil || got.OCSPStaple != nil {
+		t.Fatalf("first GetCertificate() = staple %v, err %v; want no staple", got.OCSPStaple != nil, err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		got, _ = o.GetCertificate(nil)
+		return got.OCSPStaple != nil
+	})
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	issuer, _ := x509.ParseCertificate(cert.Certificate[1])
+	resp, err := ocsp.ParseResponseForCert(got.OCSPStaple, leaf, issuer)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Errorf("stapled response = %v, %v; want good", resp, err)
+	}
+	if cert.OCSPStaple != nil {
+		t.Error("shared certificate was modified")
+	}
+	if age := o.oldestStapleAge(); age < 60 || age > 120 {
+		t.Errorf("oldestStapleAge() = %v, want about 60", age)
+	}
+	if o.metrics.ocspFetches.Value() != 1 {
+		t.Errorf("fetches = %v, want 1", o.metrics.ocspFetches.Value())
+	}
+}
+
+func TestOCSPStaplingRevoked(t *testing.T) {
+	cert := newOCSPTestCert(t, ocsp.Revoked)
+	o := newOCSPStapler(newServerMetrics())
+	o.getCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+
+	o.GetCertificate(nil)
+	waitFor(t, 2*time.Second, func() bool { return o.metrics.ocspFetchErrors.Value() == 1 })
+	if got, _ := o.GetCertificate(nil); got.OCSPStaple != nil {
+		t.Error("revoked status was stapled")
+	}
+}
+
+func TestStapleDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		st   staple
+		want bool
+	}{
+		{name: "never fetched", st: staple{}, want: true},
+		{name: "recent failure", st: staple{lastAttempt: now.Add(-time.Minute)}, want: false},
+		{name: "fetch in progress", st: staple{fetching: true}, want: false},
+		{name: "fresh", st: staple{der: []byte{1}, thisUpdate: now.Add(-time.Hour), nextUpdate: now.Add(3 * time.Hour)}, want: false},
+		{name: "past midpoint", st: staple{der: []byte{1}, thisUpdate: now.Add(-3 * time.Hour), nextUpdate: now.Add(time.Hour)}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.st.due(now); got != tt.want {
+				t.Errorf("due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
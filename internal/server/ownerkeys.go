@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// ownerKeys binds subdomains to the public key that first claimed them, so
+// a long-lived name can't be taken by whoever connects first after its
+// owner disconnects, even with a valid API key. Unlike other ownership
+// state, bindings are kept in a file and survive restarts.
+type ownerKeys struct {
+	path string // "" = kept in memory only
+
+	mu   sync.Mutex
+	keys map[string]ed25519.PublicKey // subdomain -> key
+}
+
+func newOwnerKeys() *ownerKeys {
+	return &ownerKeys{keys: make(map[string]ed25519.PublicKey)}
+}
+
+// WithOwnerKeyStore keeps the subdomains bound to owner keys in the file at
+// path, so they stay bound across restarts. Without it, bindings last until
+// the server restarts.
+func (s *Server) WithOwnerKeyStore(path string) *Server {
+	s.ownerKeys.path = path
+	return s
+}
+
+// load reads bindings from the store, if it exists.
+func (k *ownerKeys) load() error {
+	if k.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read owner key store: %w", err)
+	}
+	var stored map[string]string
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("invalid owner key store %s: %w", k.path, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for subdomain, encoded := range stored {
+		key, err := protocol.ParseOwnerKey(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid owner key store %s: %s: %w", k.path, subdomain, err)
+		}
+		k.keys[subdomain] = key
+	}
+	return nil
+}
+
+// saveLocked writes the bindings to the store, replacing it atomically.
+// Must be called with k.mu held.
+func (k *ownerKeys) saveLocked() error {
+	if k.path == "" {
+		return nil
+	}
+	stored := make(map[string]string, len(k.keys))
+	for subdomain, key := range k.keys {
+		stored[subdomain] = protocol.EncodeOwnerKey(key)
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".owner-keys-*")
+	if err != nil {
+		return fmt.Errorf("failed to write owner key store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write owner key store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write owner key store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), k.path); err != nil {
+		return fmt.Errorf("failed to write owner key store: %w", err)
+	}
+	return nil
+}
+
+// get returns the key subdomain is bound to, or nil.
+func (k *ownerKeys) get(subdomain string) ed25519.PublicKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys[subdomain]
+}
+
+// bind binds subdomain to key unless it is bound to another key, and
+// reports whether it is now bound to key.
+func (k *ownerKeys) bind(subdomain string, key ed25519.PublicKey) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if bound := k.keys[subdomain]; bound != nil {
+		return bound.Equal(key)
+	}
+	k.keys[subdomain] = key
+	if err := k.saveLocked(); err != nil {
+		slog.Error("failed to save owner key binding", "subdomain", subdomain, "error", err)
+	}
+	return true
+}
+
+// unbind releases subdomain, reporting whether it was bound.
+func (k *ownerKeys) unbind(subdomain string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys[subdomain] == nil {
+		return false, nil
+	}
+	delete(k.keys, subdomain)
+	return true, k.saveLocked()
+}
+
+// proveOwnership makes a client registering subdomain prove it holds the
+// private half of ownerKey, if it sent one or the subdomain is bound to
+// one. It returns the proven key (nil if none is involved), or the error
+// code and message to reject the registration with; an empty code means
+// the control stream failed.
+func (s *Server) proveOwnership(cs *protocol.ControlStream, subdomain, ownerKey string) (ed25519.PublicKey, string, error) {
+	bound := s.ownerKeys.get(subdomain)
+	if bound == nil && ownerKey == "" {
+		return nil, "", nil
+	}
+	if ownerKey == "" {
+		return nil, protocol.ErrCodeOwnerKeyMismatch, fmt.Errorf("subdomain '%s' is bound to an owner key; register with that key", subdomain)
+	}
+	key, err := protocol.ParseOwnerKey(ownerKey)
+	if err != nil {
+		return nil, protocol.ErrCodeInvalidOwnerKey, err
+	}
+	if bound != nil && !bound.Equal(key) {
+		return nil, protocol.ErrCodeOwnerKeyMismatch, fmt.Errorf("subdomain '%s' is bound to a different owner key", subdomain)
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	if err := cs.SendChallenge(subdomain, nonce); err != nil {
+		return nil, "", err
+	}
+	stopDeadline := s.handshakeDeadline(cs, "ownership proof", "subdomain", subdomain)
+	msg, err := cs.ReadMessage()
+	stopDeadline()
+	if err != nil {
+		return nil, "", err
+	}
+	reply, ok := msg.(*protocol.ChallengeReplyMessage)
+	if !ok || !protocol.VerifyOwnership(key, subdomain, nonce, reply.Signature) {
+		return nil, protocol.ErrCodeOwnerKeyMismatch, fmt.Errorf("proof of ownership of subdomain '%s' failed", subdomain)
+	}
+	return key, "", nil
+}
+
+func (s *Server) handleDeleteOwnerKey(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok || !caller.admin {
+		writeJSONError(w, http.StatusUnauthorized, "admin key required")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	found, err := s.ownerKeys.unbind(subdomain)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "subdomain is not bound to an owner key")
+		return
+	}
+	if err != nil {
+		slog.Error("failed to save owner key binding", "subdomain", subdomain, "error", err)
+	}
+
+	slog.Info("owner key unbound", "subdomain", subdomain)
+	s.audit("owner key unbound", "subdomain", subdomain, "by", caller.id())
+	w.WriteHeader(http.StatusNoContent)
+}
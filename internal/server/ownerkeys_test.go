@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// registerWithKey registers subdomain with s as a new client presenting
+// key's public half, answering the server's challenge by signing with sign
+// (nil = with key). It returns the final reply.
+func registerWithKey(t *testing.T, s *Server, subdomain string, key, sign ed25519.PrivateKey) any {
+	t.Helper()
+	if sign == nil {
+		sign = key
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+
+	msg := &protocol.RegisterMessage{Subdomain: subdomain}
+	if key != nil {
+		msg.OwnerKey = protocol.EncodeOwnerKey(key.Public().(ed25519.PublicKey))
+	}
+	if err := cs.SendRegisterMessage(msg); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	reply, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if challenge, ok := reply.(*protocol.ChallengeMessage); ok {
+		if challenge.Subdomain != subdomain {
+			t.Errorf("challenge subdomain = %q, want %q", challenge.Subdomain, subdomain)
+		}
+		if err := cs.SendChallengeReply(protocol.SignOwnership(sign, challenge.Subdomain, challenge.Nonce)); err != nil {
+			t.Fatalf("failed to answer challenge: %v", err)
+		}
+		if reply, err = cs.ReadMessage(); err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+	}
+	session.Close()
+	return reply
+}
+
+func TestOwnerKeyBinding(t *testing.T) {
+	_, owner, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		name     string
+		key      ed25519.PrivateKey
+		sign     ed25519.PrivateKey
+		wantCode string // "" = registered
+	}{
+		{name: "owner", key: owner},
+		{name: "no key", wantCode: protocol.ErrCodeOwnerKeyMismatch},
+		{name: "other key", key: other, wantCode: protocol.ErrCodeOwnerKeyMismatch},
+		{name: "owner's key without its private half", key: owner, sign: other, wantCode: protocol.ErrCodeOwnerKeyMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "owner-keys.json")
+			s := New("", "", "", "", "", nil).WithOwnerKeyStore(path)
+			if _, ok := registerWithKey(t, s, "demo", owner, nil).(*protocol.RegisteredMessage); !ok {
+				t.Fatal("first claim with a key was refused")
+			}
+			waitFor(t, time.Second, func() bool { return s.lookupClient("demo") == nil })
+
+			// The binding outlives the server
+			s = New("", "", "", "", "", nil).WithOwnerKeyStore(path)
+			if err := s.ownerKeys.load(); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := registerWithKey(t, s, "demo", tt.key, tt.sign)
+			code := ""
+			if m, ok := reply.(*protocol.ErrorMessage); ok {
+				code = m.Code
+			} else if _, ok := reply.(*protocol.RegisteredMessage); !ok {
+				t.Fatalf("reply = %T, want registered or error", reply)
+			}
+			if code != tt.wantCode {
+				t.Errorf("reply = %+v, want code %q", reply, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestOwnerKeyUnbind(t *testing.T) {
+	s, h := newSharingTestServer(t)
+	_, owner, _ := ed25519.GenerateKey(nil)
+	s.ownerKeys.bind("demo", owner.Public().(ed25519.PublicKey))
+
+	if rec := adminRequest(t, h, "DELETE", "/api/tunnels/demo/owner-key", "owner-key", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("client key status = %d, want 401", rec.Code)
+	}
+	if rec := adminRequest(t, h, "DELETE", "/api/tunnels/demo/owner-key", "root-key", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", rec.Code)
+	}
+	if s.ownerKeys.get("demo") != nil {
+		t.Error("subdomain still bound")
+	}
+	if rec := adminRequest(t, h, "DELETE", "/api/tunnels/demo/owner-key", "root-key", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second unbind status = %d, want 404", rec.Code)
+	}
+}
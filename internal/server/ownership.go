@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Rights a tunnel owner can grant to other tokens.
+const (
+	// RightInspect allows viewing the tunnel through the admin API.
+	RightInspect = "inspect"
+
+	// RightPublish allows registering the subdomain (co-publishing).
+	RightPublish = "publish"
+)
+
+// ownership records which token owns a subdomain and what it has shared.
+// Ownership is established by the first registration and, like all server
+// state, lasts until the server restarts.
+type ownership struct {
+	owner  string              // token that first registered the subdomain
+	grants map[string][]string // token -> rights
+}
+
+// tokenID returns a short, non-reversible identifier for a token, safe to
+// show in logs and API responses.
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// validRights reports whether every right in rights is known.
+func validRights(rights []string) bool {
+	for _, r := range rights {
+		if r != RightInspect && r != RightPublish {
+			return false
+		}
+	}
+	return len(rights) > 0
+}
+
+// hasRight reports whether token may exercise right on subdomain.
+// Owners hold every right. Must be called with s.mu held.
+func (s *Server) hasRight(subdomain, token, right string) bool {
+	o := s.owners[subdomain]
+	if o == nil {
+		return false
+	}
+	if o.owner == token {
+		return true
+	}
+	return slices.Contains(o.grants[token], right)
+}
+
+// claimSubdomain checks that token may publish subdomain and records it as
+// the owner if the subdomain is unclaimed. Ownership is only tracked when
+// authentication is enabled, since all clients are anonymous otherwise.
+// Tokens issued through signup may only publish subdomains under their prefix.
+// Must be called with s.mu held.
+func (s *Server) claimSubdomain(subdomain, token string) error {
+	if !s.authRequired() {
+		return nil
+	}
+	if prefix := s.subdomainPrefix(token); !strings.HasPrefix(subdomain, prefix) {
+		return fmt.Errorf("this token may only publish subdomains starting with '%s'", prefix)
+	}
+
+	o := s.owners[subdomain]
+	// A reservation in the policy directory decides the owner, whoever
+	// claimed the subdomain first
+	if owner, reserved := s.policies.load().subdomainOwner(subdomain); reserved && (o == nil || o.owner != owner) {
+		o = &ownership{owner: owner, grants: make(map[string][]string)}
+		s.owners[subdomain] = o
+	}
+	if o == nil {
+		s.owners[subdomain] = &ownership{
+			owner:  token,
+			grants: make(map[string][]string),
+		}
+		return nil
+	}
+
+	if o.owner != token && !slices.Contains(o.grants[token], RightPublish) {
+		return fmt.Errorf("subdomain '%s' is reserved by another token", subdomain)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"github.com/bc183/otun/internal/metrics"
+)
+
+// payloadSizeBuckets span 256B to 1GB, by powers of four.
+var payloadSizeBuckets = metrics.ExponentialBuckets(256, 4, 12)
+
+// payloadSizes are the size distributions of the requests and responses
+// proxied through one HTTP tunnel, for capacity planning and spotting
+// sudden large uploads.
+type payloadSizes struct {
+	requests  *metrics.Histogram
+	responses *metrics.Histogram
+}
+
+func newPayloadSizes() *payloadSizes {
+	return &payloadSizes{
+		requests:  metrics.NewHistogram(payloadSizeBuckets),
+		responses: metrics.NewHistogram(payloadSizeBuckets),
+	}
+}
+
+// observe records the bytes written to and read from a tunnel stream for
+// one request. A nil *payloadSizes records nothing.
+func (p *payloadSizes) observe(traffic *countingConn) {
+	if p == nil {
+		return
+	}
+	p.requests.Observe(float64(traffic.written.Load()))
+	p.responses.Observe(float64(traffic.read.Load()))
+}
+
+// registerPayloadSizeMetrics exports the payload size histograms of every
+// connected HTTP tunnel, labeled by subdomain.
+func (s *Server) registerPayloadSizeMetrics() {
+	r := s.metrics.registry
+	r.NewHistogramVecFunc("otun_request_size_bytes", "Size of requests sent through each HTTP tunnel, headers included.", s.payloadSizeSamples(func(p *payloadSizes) *metrics.Histogram {
+		return p.requests
+	}))
+	r.NewHistogramVecFunc("otun_response_size_bytes", "Size of responses received through each HTTP tunnel, headers included.", s.payloadSizeSamples(func(p *payloadSizes) *metrics.Histogram {
+		return p.responses
+	}))
+}
+
+// payloadSizeSamples returns a sample function reporting one of the payload
+// size histograms of every connected HTTP tunnel. Canary deployments are
+// labeled canary="true".
+func (s *Server) payloadSizeSamples(histogram func(*payloadSizes) *metrics.Histogram) func() []metrics.HistogramSample {
+	return func() []metrics.HistogramSample {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		samples := make([]metrics.HistogramSample, 0, len(s.clients)+len(s.canaries))
+		for subdomain, client := range s.clients {
+			if client.sizes != nil {
+				samples = append(samples, metrics.HistogramSample{Labels: map[string]string{"subdomain": subdomain}, Histogram: histogram(client.sizes)})
+			}
+		}
+		for subdomain, client := range s.canaries {
+			if client.sizes != nil {
+				samples = append(samples, metrics.HistogramSample{Labels: map[string]string{"subdomain": subdomain, "canary": "true"}, Histogram: histogram(client.sizes)})
+			}
+		}
+		return samples
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPayloadSizeMetrics(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+	s.clients["demo"].sizes = newPayloadSizes()
+
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("x", 2000)))
+	req.Host = "demo.localhost"
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	var sb strings.Builder
+	s.metrics.registry.WriteTo(&sb)
+	for _, want := range []string{
+		`otun_request_size_bytes_bucket{le="1024",subdomain="demo"} 0`,
+		`otun_request_size_bytes_bucket{le="4096",subdomain="demo"} 1`,
+		`otun_request_size_bytes_count{subdomain="demo"} 1`,
+		`otun_response_size_bytes_bucket{le="256",subdomain="demo"} 1`,
+		`otun_response_size_bytes_count{subdomain="demo"} 1`,
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("metrics missing %s:\n%s", want, sb.String())
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bc183/otun/internal/metrics"
+	"github.com/bc183/otun/internal/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+// policyReloadInterval is how often the policy directory is checked for
+// changes.
+const policyReloadInterval = 10 * time.Second
+
+// policyFile is one YAML file of a policy directory. Every section is
+// optional; a directory's files are merged.
+type policyFile struct {
+	// Tokens are API keys accepted on top of -api-keys
+	Tokens []string `yaml:"tokens"`
+
+	// Reservations give subdomains and TCP ports to a single API key
+	Reservations []reservation `yaml:"reservations"`
+
+	// Tunnels hold per-tunnel policies, Groups policies shared by sets of
+	// tunnels (see Group)
+	Tunnels []tunnelPolicy `yaml:"tunnels"`
+	Groups  []Group        `yaml:"groups"`
+}
+
+// reservation gives a subdomain or a TCP port to a single API key.
+type reservation struct {
+	Subdomain string `yaml:"subdomain"`
+	Port      int    `yaml:"port"`
+	Token     string `yaml:"token"`
+}
+
+// tunnelPolicy is the policy of the tunnel on Subdomain. It is held as a
+// group of that one subdomain, named after it.
+type tunnelPolicy struct {
+	Subdomain string `yaml:"subdomain"`
+	Group     `yaml:",inline"`
+}
+
+// policy is the merged content of a policy directory.
+type policy struct {
+	tokens     map[string]bool
+	subdomains map[string]string // subdomain -> token
+	ports      map[int]string    // port -> token
+
+	// groups holds the tunnel policies, then the groups, so a tunnel's own
+	// policy takes precedence over its groups'
+	groups []*Group
+}
+
+// policyDir serves the policy in a directory of YAML files, reloading it
+// when the files change.
+type policyDir struct {
+	dir string
+
+	current atomic.Pointer[policy]
+
+	mu            sync.Mutex
+	digest        [sha256.Size]byte
+	lastReloadErr error
+
+	reloads      *metrics.Counter
+	reloadErrors *metrics.Counter
+}
+
+// WithPolicyDir loads API keys, reservations and tunnel policies from the
+// *.yaml and *.yml files in dir, so they can be kept in git and deployed
+// by a pipeline rather than set through the admin API. The directory is
+// watched: changes apply to registrations from then on, and a file that
+// doesn't parse keeps the previous policy in force. Clients must present
+// an API key once a policy directory is set.
+func (s *Server) WithPolicyDir(dir string) *Server {
+	s.policies = &policyDir{
+		dir:          dir,
+		reloads:      s.metrics.registry.NewCounter("otun_policy_reloads_total", "Changes to the policy directory applied."),
+		reloadErrors: s.metrics.registry.NewCounter("otun_policy_reload_errors_total", "Reloads of the policy directory that failed, keeping the previous policy, e.g. because a file was invalid."),
+	}
+	return s
+}
+
+// load returns the policy in force, or nil if there is no policy
+// directory.
+func (d *policyDir) load() *policy {
+	if d == nil {
+		return nil
+	}
+	return d.current.Load()
+}
+
+// reload reads the policy files, reporting whether they changed. A failed
+// reload keeps the previous policy.
+func (d *policyDir) reload() (bool, error) {
+	files, digest, err := readPolicyDir(d.dir)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	unchanged := digest == d.digest && d.current.Load() != nil
+	d.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	p, err := parsePolicy(files)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	d.current.Store(p)
+	d.digest = digest
+	d.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the policy every policyReloadInterval until done is closed.
+func (d *policyDir) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(policyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		d.check()
+	}
+}
+
+// check reloads the policy, counting and logging the outcome. Every failed
+// reload is counted, but the same error is only logged once.
+func (d *policyDir) check() {
+	changed, err := d.reload()
+	d.mu.Lock()
+	repeated := err != nil && d.lastReloadErr != nil && err.Error() == d.lastReloadErr.Error()
+	d.lastReloadErr = err
+	d.mu.Unlock()
+
+	if err != nil {
+		d.reloadErrors.Inc()
+	}
+	switch {
+	case err != nil && !repeated:
+		slog.Warn("failed to reload policy, keeping the current one", "dir", d.dir, "error", err)
+	case changed:
+		d.reloads.Inc()
+		d.logLoaded("policy reloaded")
+	}
+}
+
+// logLoaded logs what the policy in force holds.
+func (d *policyDir) logLoaded(msg string) {
+	p := d.load()
+	slog.Info(msg, "dir", d.dir, "tokens", len(p.tokens), "reservations", len(p.subdomains)+len(p.ports), "policies", len(p.groups))
+}
+
+// readPolicyDir returns the contents of dir's policy files by name, along
+// with a digest of them. Hidden files are skipped, as are the
+// subdirectories Kubernetes keeps a mounted ConfigMap's versions in.
+func readPolicyDir(dir string) (map[string][]byte, [sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, digest, fmt.Errorf("failed to read policy directory: %w", err)
+	}
+	files := make(map[string][]byte)
+	h := sha256.New()
+	for _, entry := range entries { // sorted by name
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, ".") || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue // e.g. a dangling symlink mid-update
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to read policy file: %w", err)
+		}
+		files[path] = data
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(data))
+		h.Write(data)
+	}
+	h.Sum(digest[:0])
+	return files, digest, nil
+}
+
+// parsePolicy parses and merges policy files, given by path.
+func parsePolicy(files map[string][]byte) (*policy, error) {
+	p := &policy{
+		tokens:     make(map[string]bool),
+		subdomains: make(map[string]string),
+		ports:      make(map[int]string),
+	}
+	var tunnels, groups []*Group
+	defined := make(map[string]string) // tunnel policy or group name -> file
+	define := func(g *Group, path string) error {
+		if other, dup := defined[g.Name]; dup {
+			return fmt.Errorf("%q is defined twice (also in %s)", g.Name, other)
+		}
+		defined[g.Name] = path
+		return nil
+	}
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		file, err := parsePolicyFile(path, files[path])
+		if err == nil {
+			err = p.merge(file)
+		}
+		for i := 0; err == nil && i < len(file.Tunnels); i++ {
+			var g *Group
+			if g, err = file.Tunnels[i].group(); err == nil {
+				err = define(g, path)
+				tunnels = append(tunnels, g)
+			}
+		}
+		for i := 0; err == nil && i < len(file.Groups); i++ {
+			g := &file.Groups[i]
+			if err = g.validate(); err != nil {
+				err = fmt.Errorf("group %d: %w", i+1, err)
+			} else {
+				err = define(g, path)
+			}
+			groups = append(groups, g)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+		}
+	}
+	p.groups = slices.Concat(tunnels, groups)
+	return p, nil
+}
+
+// parsePolicyFile parses one policy file, which may be encrypted with sops
+// and reference secrets like the client config file.
+func parsePolicyFile(path string, data []byte) (*policyFile, error) {
+	if secrets.IsSOPS(data) {
+		var err error
+		if data, err = secrets.DecryptSOPS(path); err != nil {
+			return nil, err
+		}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := secrets.ExpandNode(&doc); err != nil {
+		return nil, err
+	}
+	var file policyFile
+	if doc.Kind == 0 {
+		return &file, nil // empty
+	}
+	// Decode through YAML again to reject unknown fields
+	expanded, err := yaml.Marshal(&doc)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(expanded))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// merge adds file's tokens and reservations to p.
+func (p *policy) merge(file *policyFile) error {
+	for _, token := range file.Tokens {
+		if token == "" {
+			return errors.New("empty token")
+		}
+		p.tokens[token] = true
+	}
+	for _, r := range file.Reservations {
+		if r.Token == "" {
+			return errors.New("reservation without a token")
+		}
+		switch {
+		case r.Subdomain != "" && r.Port != 0:
+			return fmt.Errorf("reservation of %q and port %d: reserve one per entry", r.Subdomain, r.Port)
+		case r.Subdomain != "":
+			if !subdomainPattern.MatchString(r.Subdomain) {
+				return fmt.Errorf("invalid reserved subdomain %q", r.Subdomain)
+			}
+			if owner, dup := p.subdomains[r.Subdomain]; dup && owner != r.Token {
+				return fmt.Errorf("subdomain %q reserved twice", r.Subdomain)
+			}
+			p.subdomains[r.Subdomain] = r.Token
+		case r.Port > 0 && r.Port <= 65535:
+			if owner, dup := p.ports[r.Port]; dup && owner != r.Token {
+				return fmt.Errorf("port %d reserved twice", r.Port)
+			}
+			p.ports[r.Port] = r.Token
+		default:
+			return errors.New("reservation without a subdomain or a valid port")
+		}
+	}
+	return nil
+}
+
+// group returns t as a group of its one subdomain.
+func (t *tunnelPolicy) group() (*Group, error) {
+	if !subdomainPattern.MatchString(t.Subdomain) {
+		return nil, fmt.Errorf("invalid tunnel subdomain %q", t.Subdomain)
+	}
+	g := t.Group
+	if g.Name != "" || len(g.Tokens) > 0 || len(g.Subdomains) > 0 {
+		return nil, fmt.Errorf("tunnel %q: set subdomain only, not name, tokens or subdomains", t.Subdomain)
+	}
+	g.Name = t.Subdomain
+	g.Subdomains = []string{t.Subdomain}
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// hasToken reports whether p accepts token. A nil p accepts none.
+func (p *policy) hasToken(token string) bool {
+	return p != nil && p.tokens[token]
+}
+
+// subdomainOwner returns the token subdomain is reserved for, if any.
+func (p *policy) subdomainOwner(subdomain string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	token, ok := p.subdomains[subdomain]
+	return token, ok
+}
+
+// reservedPorts returns p's TCP port reservations. A nil p has none.
+func (p *policy) reservedPorts() map[int]string {
+	if p == nil {
+		return nil
+	}
+	return p.ports
+}
+
+// portOwner returns the token a TCP port is reserved for, if any: by
+// -reserved-ports, or else by the policy directory.
+func (s *Server) portOwner(port int) (string, bool) {
+	if token, ok := s.reservedPorts[port]; ok {
+		return token, true
+	}
+	token, ok := s.policies.load().reservedPorts()[port]
+	return token, ok
+}
+
+// portsReservedFor returns the TCP ports reserved for token.
+func (s *Server) portsReservedFor(token string) []int {
+	var ports []int
+	for port, owner := range s.reservedPorts {
+		if owner == token {
+			ports = append(ports, port)
+		}
+	}
+	for port, owner := range s.policies.load().reservedPorts() {
+		if _, static := s.reservedPorts[port]; !static && owner == token {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestParsePolicy(t *testing.T) {
+	t.Setenv("OTUN_TEST_POLICY_KEY", "key-env")
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			files: map[string]string{
+				"tokens.yaml": "tokens: [key-a, '${env:OTUN_TEST_POLICY_KEY}']\n",
+				"acme.yml": `reservations:
+  - subdomain: acme
+    token: key-a
+  - port: 30500
+    token: key-a
+tunnels:
+  - subdomain: acme
+    max_streams: 5
+groups:
+  - name: partners
+    tokens: [key-a]
+    require_access: true
+`,
+			},
+		},
+		{name: "empty", files: map[string]string{"empty.yaml": ""}},
+		{name: "unknown field", files: map[string]string{"a.yaml": "token: [a]\n"}, wantErr: "token"},
+		{name: "missing secret", files: map[string]string{"a.yaml": "tokens: ['${env:OTUN_TEST_POLICY_UNSET}']\n"}, wantErr: "OTUN_TEST_POLICY_UNSET"},
+		{name: "reservation without token", files: map[string]string{"a.yaml": "reservations:\n  - subdomain: acme\n"}, wantErr: "without a token"},
+		{name: "reservation of both", files: map[string]string{"a.yaml": "reservations:\n  - subdomain: acme\n    port: 30500\n    token: a\n"}, wantErr: "one per entry"},
+		{name: "uppercase subdomain", files: map[string]string{"a.yaml": "reservations:\n  - subdomain: Acme\n    token: a\n"}, wantErr: "invalid reserved subdomain"},
+		{name: "underscore subdomain", files: map[string]string{"a.yaml": "reservations:\n  - subdomain: acme_eu\n    token: a\n"}, wantErr: "invalid reserved subdomain"},
+		{name: "trailing hyphen", files: map[string]string{"a.yaml": "reservations:\n  - subdomain: acme-\n    token: a\n"}, wantErr: "invalid reserved subdomain"},
+		{name: "dotted subdomain", files: map[string]string{"a.yaml": "tunnels:\n  - subdomain: eu.acme\n"}, wantErr: "invalid tunnel subdomain"},
+		{name: "invalid port", files: map[string]string{"a.yaml": "reservations:\n  - port: 70000\n    token: a\n"}, wantErr: "valid port"},
+		{
+			name: "reserved twice",
+			files: map[string]string{
+				"a.yaml": "reservations:\n  - subdomain: acme\n    token: a\n",
+				"b.yaml": "reservations:\n  - subdomain: acme\n    token: b\n",
+			},
+			wantErr: "reserved twice",
+		},
+		{name: "tunnel with tokens", files: map[string]string{"a.yaml": "tunnels:\n  - subdomain: acme\n    tokens: [a]\n"}, wantErr: "subdomain only"},
+		{name: "invalid tunnel", files: map[string]string{"a.yaml": "tunnels:\n  - subdomain: acme\n    bandwidth: fast\n"}, wantErr: "invalid bandwidth"},
+		{
+			name: "defined twice",
+			files: map[string]string{
+				"a.yaml": "tunnels:\n  - subdomain: acme\n",
+				"b.yaml": "groups:\n  - name: acme\n    tokens: [a]\n",
+			},
+			wantErr: "defined twice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make(map[string][]byte, len(tt.files))
+			for name, content := range tt.files {
+				files[name] = []byte(content)
+			}
+			p, err := parsePolicy(files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePolicy() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePolicy() error = %v", err)
+			}
+			if tt.name != "valid" {
+				return
+			}
+			if !p.hasToken("key-a") || !p.hasToken("key-env") || p.hasToken("key-b") {
+				t.Errorf("tokens = %v", p.tokens)
+			}
+			if owner, _ := p.subdomainOwner("acme"); owner != "key-a" || p.ports[30500] != "key-a" {
+				t.Errorf("reservations = %v, %v", p.subdomains, p.ports)
+			}
+			// The tunnel's own policy comes before its groups
+			if len(p.groups) != 2 || p.groups[0].Name != "acme" || p.groups[1].Name != "partners" {
+				t.Errorf("groups = %v", p.groups)
+			}
+		})
+	}
+}
+
+// writePolicy writes a policy file to dir.
+func writePolicy(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicyDirReload(t *testing.T) {
+	dir := t.TempDir()
+	writePolicy(t, dir, "tokens.yaml", "tokens: [key-a]\n")
+	writePolicy(t, dir, ".hidden.yaml", "not: [valid\n")
+	writePolicy(t, dir, "README.md", "# Policy\n")
+	s := New("", "", "", "", "", nil).WithPolicyDir(dir)
+
+	if changed, err := s.policies.reload(); err != nil || !changed {
+		t.Fatalf("first reload() = %v, %v; want true, nil", changed, err)
+	}
+	if changed, err := s.policies.reload(); err != nil || changed {
+		t.Fatalf("unchanged reload() = %v, %v; want false, nil", changed, err)
+	}
+
+	// Keys are picked up as they are added
+	writePolicy(t, dir, "tokens.yaml", "tokens: [key-a, key-b]\n")
+	if changed, err := s.policies.reload(); err != nil || !changed {
+		t.Fatalf("reload() after a change = %v, %v; want true, nil", changed, err)
+	}
+	if !s.validateToken("key-b") {
+		t.Error("key-b refused after it was added")
+	}
+
+	// A broken file keeps the policy in force
+	writePolicy(t, dir, "tokens.yaml", "tokens: [key-a\n")
+	if _, err := s.policies.reload(); err == nil {
+		t.Fatal("reload() of an invalid file succeeded")
+	}
+	if !s.validateToken("key-b") {
+		t.Error("policy dropped by a failed reload")
+	}
+
+	// Every check of a broken directory counts as a failure
+	before := s.policies.reloadErrors.Value()
+	s.policies.check()
+	s.policies.check()
+	if got := s.policies.reloadErrors.Value() - before; got != 2 {
+		t.Errorf("reload errors counted = %d, want 2", got)
+	}
+
+	// As is removing a key
+	writePolicy(t, dir, "tokens.yaml", "tokens: [key-a]\n")
+	if _, err := s.policies.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s.validateToken("key-b") {
+		t.Error("key-b accepted after it was removed")
+	}
+}
+
+func TestPolicyDirRegistration(t *testing.T) {
+	dir := t.TempDir()
+	writePolicy(t, dir, "acme.yaml", `tokens: [key-acme]
+reservations:
+  - subdomain: acme
+    token: key-acme
+  - port: 30500
+    token: key-acme
+`)
+	writePolicy(t, dir, "staff.yaml", "tokens: [key-staff]\n")
+	s := New("", "", "", "", "", nil).WithPolicyDir(dir)
+	if _, err := s.policies.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode string
+	}{
+		{name: "listed key", token: "key-staff"},
+		{name: "unknown key", token: "key-other", wantCode: protocol.ErrCodeUnauthorized},
+		{name: "no key", wantCode: protocol.ErrCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client.New("server:4443", "localhost:1").
+				WithServerDialer(pipeDialer{s}).
+				WithToken(tt.token)
+			_, err := c.Probe(context.Background())
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("Probe() error = %v", err)
+				}
+				return
+			}
+			if e := client.AsError(err); e == nil || e.Code != tt.wantCode {
+				t.Fatalf("Probe() error = %v, want code %s", err, tt.wantCode)
+			}
+		})
+	}
+
+	if owner, _ := s.portOwner(30500); owner != "key-acme" || !s.tcpEnabled() {
+		t.Errorf("port 30500 reserved for %q, TCP enabled = %v", tokenID(owner), s.tcpEnabled())
+	}
+	if ports := s.portsReservedFor("key-acme"); len(ports) != 1 || ports[0] != 30500 {
+		t.Errorf("portsReservedFor() = %v, want [30500]", ports)
+	}
+
+	// The reservation wins over whoever claimed the subdomain first
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.owners["acme"] = &ownership{owner: "key-staff", grants: make(map[string][]string)}
+	if err := s.claimSubdomain("acme", "key-staff"); err == nil {
+		t.Error("key-staff may publish a subdomain reserved for key-acme")
+	}
+	if err := s.claimSubdomain("acme", "key-acme"); err != nil {
+		t.Errorf("claimSubdomain() for the reserved key error = %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errQueueFull is returned when too many requests are already waiting for
+// tunnels to reconnect.
+var errQueueFull = errors.New("reconnect queue full")
+
+// waitList holds the requests waiting for a subdomain to reconnect.
+type waitList struct {
+	ready   chan struct{} // closed on re-registration
+	waiting int
+}
+
+// markDisconnected records that subdomain's client went away, so requests
+// arriving during the reconnect grace period can wait for it.
+// Must be called with s.mu held.
+func (s *Server) markDisconnected(subdomain string) {
+	if s.reconnectGrace <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for sub, at := range s.disconnectedAt {
+		if now.Sub(at) > s.reconnectGrace {
+			delete(s.disconnectedAt, sub)
+		}
+	}
+	s.disconnectedAt[subdomain] = now
+}
+
+// notifyRegistered wakes requests waiting for subdomain to reconnect.
+// Must be called with s.mu held.
+func (s *Server) notifyRegistered(subdomain string) {
+	delete(s.disconnectedAt, subdomain)
+	if w, ok := s.waiters[subdomain]; ok {
+		close(w.ready)
+		delete(s.waiters, subdomain)
+	}
+}
+
+// waitForClient holds a request for a recently disconnected subdomain until
+// its client re-registers, the grace period ends, or ctx is cancelled.
+// Returns nil if the subdomain isn't reconnecting or didn't come back in time.
+func (s *Server) waitForClient(ctx context.Context, subdomain string) (*tunnelClient, error) {
+	s.mu.Lock()
+	if client := s.clients[subdomain]; client != nil {
+		s.mu.Unlock()
+		return client, nil
+	}
+	at, ok := s.disconnectedAt[subdomain]
+	remaining := s.reconnectGrace - time.Since(at)
+	if !ok || remaining <= 0 {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	if s.queued >= s.maxQueued {
+		s.mu.Unlock()
+		return nil, errQueueFull
+	}
+	w, ok := s.waiters[subdomain]
+	if !ok {
+		w = &waitList{ready: make(chan struct{})}
+		s.waiters[subdomain] = w
+	}
+	w.waiting++
+	s.queued++
+	s.metrics.requestsQueued.Inc()
+	s.metrics.queueDepth.Inc()
+	s.mu.Unlock()
+
+	// The last request to give up on a client that never came back
+	// forgets the subdomain's waiters
+	defer func() {
+		s.mu.Lock()
+		s.queued--
+		w.waiting--
+		if w.waiting == 0 && s.waiters[subdomain] == w {
+			delete(s.waiters, subdomain)
+		}
+		s.mu.Unlock()
+		s.metrics.queueDepth.Dec()
+	}()
+
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return s.lookupClient(subdomain), nil
+	case <-timer.C:
+		s.metrics.queueTimeouts.Inc()
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const okResponse = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+func TestReconnectQueue(t *testing.T) {
+	tests := []struct {
+		name        string
+		grace       time.Duration
+		maxQueued   int
+		disconnect  bool          // whether the tunnel was online before
+		reconnectIn time.Duration // 0 = never reconnects
+		wantStatus  int
+	}{
+		{
+			name:        "request waits for reconnect",
+			grace:       2 * time.Second,
+			maxQueued:   10,
+			disconnect:  true,
+			reconnectIn: 50 * time.Millisecond,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:       "grace period expires",
+			grace:      50 * time.Millisecond,
+			maxQueued:  10,
+			disconnect: true,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "queue full",
+			grace:      2 * time.Second,
+			maxQueued:  0,
+			disconnect: true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "unknown tunnel fails immediately",
+			grace:      2 * time.Second,
+			maxQueued:  10,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "queueing disabled",
+			maxQueued:  10,
+			disconnect: true,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithReconnectQueue(tt.grace, tt.maxQueued)
+
+			if tt.disconnect {
+				registerTestTunnel(t, s, "app")
+				unregisterTestTunnel(s, "app")
+			}
+			if tt.reconnectIn > 0 {
+				time.AfterFunc(tt.reconnectIn, func() {
+					go serveTunnelStreams(registerTestTunnel(t, s, "app"), okResponse)
+				})
+			}
+
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.localhost/", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				body, _ := io.ReadAll(rec.Body)
+				if string(body) != "ok" {
+					t.Errorf("body = %q, want %q", body, "ok")
+				}
+			}
+			if elapsed := time.Since(start); tt.grace == 0 && elapsed > 100*time.Millisecond {
+				t.Errorf("request waited %v with queueing disabled", elapsed)
+			}
+			if depth := s.metrics.queueDepth.Value(); depth != 0 {
+				t.Errorf("queue depth = %d after request, want 0", depth)
+			}
+			s.mu.Lock()
+			waiting := len(s.waiters)
+			s.mu.Unlock()
+			if waiting != 0 {
+				t.Errorf("%d subdomains still have waiters after the request", waiting)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// WithStripResponseHeaders sets response headers removed from every
+// tunnel's responses, in addition to those each client asks for. A trailing
+// "*" matches a prefix, e.g. "X-Debug-*".
+func (s *Server) WithStripResponseHeaders(rules []string) *Server {
+	s.stripHeaders = rules
+	return s
+}
+
+// tunnelStripHeaders returns the response header rules for a tunnel
+// registering with requested rules.
+func (s *Server) tunnelStripHeaders(requested []string) []string {
+	if len(requested) == 0 {
+		return s.stripHeaders
+	}
+	return append(append([]string(nil), s.stripHeaders...), requested...)
+}
+
+// headerMatches reports whether header name matches any of rules, ignoring
+// case.
+func headerMatches(rules []string, name string) bool {
+	for _, rule := range rules {
+		if prefix, ok := strings.CutSuffix(rule, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripHeaderLines returns a response head without the header lines
+// matching rules. head ends with its blank line; obsolete line folding is
+// not supported, as net/http rejects it anyway.
+func stripHeaderLines(head []byte, rules []string) []byte {
+	statusEnd := bytes.Index(head, []byte("\r\n"))
+	if statusEnd < 0 {
+		return head
+	}
+	out := make([]byte, 0, len(head))
+	out = append(out, head[:statusEnd+2]...)
+	for rest := head[statusEnd+2:]; len(rest) > 0; {
+		end := bytes.Index(rest, []byte("\r\n"))
+		if end < 0 {
+			out = append(out, rest...)
+			break
+		}
+		line := rest[:end+2]
+		rest = rest[end+2:]
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok && headerMatches(rules, string(name)) {
+			continue
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+// filterResponses wraps upstream to enforce client's response size limit
+// and strip its response headers, or returns it as is if it has neither.
+func (s *Server) filterResponses(upstream net.Conn, client *tunnelClient, method string) net.Conn {
+	if client.maxResponseBytes <= 0 && len(client.stripHeaders) == 0 {
+		return upstream
+	}
+	c := s.warnLargeResponses(s.limitResponseSize(upstream, client.maxResponseBytes, client.subdomain, method), client)
+	c.stripHeaders = client.stripHeaders
+	return c
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestStripHeaderLines(t *testing.T) {
+	rules := []string{"Server", "x-powered-by", "X-Debug-*"}
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{
+			name: "strips matching headers",
+			head: "HTTP/1.1 200 OK\r\nServer: nginx\r\nContent-Length: 2\r\nX-Powered-By: Express\r\nX-Debug-Trace: abc\r\n\r\n",
+			want: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n",
+		},
+		{
+			name: "keeps other headers",
+			head: "HTTP/1.1 204 No Content\r\nX-Debugger: on\r\nServer-Timing: db;dur=5\r\n\r\n",
+			want: "HTTP/1.1 204 No Content\r\nX-Debugger: on\r\nServer-Timing: db;dur=5\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(stripHeaderLines([]byte(tt.head), rules)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterResponsesStripsEveryResponse(t *testing.T) {
+	tests := []struct {
+		name  string
+		first string // the first response; a second with a Content-Length follows
+	}{
+		{name: "content length", first: "HTTP/1.1 200 OK\r\nServer: a\r\nContent-Length: 2\r\n\r\nok"},
+		{name: "chunked", first: "HTTP/1.1 200 OK\r\nServer: a\r\nTransfer-Encoding: chunked\r\n\r\n1\r\no\r\n1;ext=1\r\nk\r\n0\r\nX-Trailer: t\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithStripResponseHeaders([]string{"Server"})
+			client := &tunnelClient{subdomain: "app", stripHeaders: s.tunnelStripHeaders([]string{"X-Powered-By"})}
+
+			serverSide, tunnelSide := net.Pipe()
+			defer serverSide.Close()
+			go func() {
+				io.WriteString(tunnelSide, tt.first+"HTTP/1.1 200 OK\r\nX-Powered-By: PHP/5.1\r\nContent-Length: 2\r\n\r\nok")
+				tunnelSide.Close()
+			}()
+
+			br := bufio.NewReader(s.filterResponses(serverSide, client, http.MethodGet))
+			for i := 0; i < 2; i++ {
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("response %d: %v", i, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != "ok" {
+					t.Errorf("response %d body = %q", i, body)
+				}
+				if resp.Header.Get("Server") != "" || resp.Header.Get("X-Powered-By") != "" {
+					t.Errorf("response %d headers not stripped: %v", i, resp.Header)
+				}
+			}
+		})
+	}
+}
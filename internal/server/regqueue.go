@@ -0,0 +1,204 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// registrationRetryAfter is how long clients turned away by a full
+// registration queue are told to wait before reconnecting.
+const registrationRetryAfter = 5 * time.Second
+
+// regQueue holds tunnel client connections waiting for a registration
+// worker. Connections are queued per source IP and served round-robin, so a
+// single host reconnecting many clients can't starve everyone else.
+type regQueue struct {
+	mu       sync.Mutex
+	bySource map[string][]net.Conn
+	sources  []string // sources with queued connections, in service order
+	size     int
+	max      int
+
+	// ready holds a token while connections are queued
+	ready chan struct{}
+}
+
+// newRegQueue creates a queue holding at most max connections.
+func newRegQueue(max int) *regQueue {
+	return &regQueue{
+		bySource: make(map[string][]net.Conn),
+		max:      max,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues conn, reporting false if the queue is full.
+func (q *regQueue) push(conn net.Conn) bool {
+	source := sourceIP(conn.RemoteAddr())
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size >= q.max {
+		return false
+	}
+	if len(q.bySource[source]) == 0 {
+		q.sources = append(q.sources, source)
+	}
+	q.bySource[source] = append(q.bySource[source], conn)
+	q.size++
+	q.signal()
+	return true
+}
+
+// pop removes the next connection in round-robin order, blocking until one
+// is queued or done is closed (in which case it returns nil).
+func (q *regQueue) pop(done <-chan struct{}) net.Conn {
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-q.ready:
+		}
+
+		q.mu.Lock()
+		if q.size == 0 {
+			q.mu.Unlock()
+			continue
+		}
+		source := q.sources[0]
+		conns := q.bySource[source]
+		conn := conns[0]
+		q.sources = q.sources[1:]
+		if len(conns) == 1 {
+			delete(q.bySource, source)
+		} else {
+			// More from this source go to the back of the line
+			q.bySource[source] = conns[1:]
+			q.sources = append(q.sources, source)
+		}
+		q.size--
+		if q.size > 0 {
+			q.signal()
+		}
+		q.mu.Unlock()
+		return conn
+	}
+}
+
+// len returns the number of queued connections.
+func (q *regQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// signal wakes a waiting worker. Must be called with q.mu held.
+func (q *regQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// sourceIP returns the IP part of addr, or its string form if it has none.
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// WithRegistrationQueue limits tunnel client handshakes to workers at a
+// time. Up to queueSize further connections wait their turn, served fairly
+// across source IPs; beyond that clients are told to retry later. A workers
+// value of zero handles every connection immediately.
+func (s *Server) WithRegistrationQueue(workers, queueSize int) *Server {
+	s.registrationWorkers = workers
+	s.regQueue = newRegQueue(queueSize)
+	// Rejections need a handshake of their own, so bound them too
+	s.rejectSlots = make(chan struct{}, max(workers, 1))
+	return s
+}
+
+// startRegistrationWorkers starts the workers that take connections off the
+// registration queue until the server shuts down.
+func (s *Server) startRegistrationWorkers() {
+	for i := 0; i < s.registrationWorkers; i++ {
+		go func() {
+			for {
+				conn := s.regQueue.pop(s.done)
+				if conn == nil {
+					return
+				}
+				s.registerQueued(conn)
+			}
+		}()
+	}
+}
+
+// registerQueued runs the registration handshake for conn, returning once
+// the client is registered (or failed to) while its session carries on in
+// the background.
+func (s *Server) registerQueued(conn net.Conn) {
+	done := make(chan struct{})
+	var once sync.Once
+	registered := func() { once.Do(func() { close(done) }) }
+	go func() {
+		defer registered()
+		s.handleTunnelClient(conn, registered)
+	}()
+	<-done
+}
+
+// enqueueTunnelClient hands conn to the registration workers, or tells the
+// client to back off if the queue is full.
+func (s *Server) enqueueTunnelClient(conn net.Conn) {
+	if s.regQueue.push(conn) {
+		return
+	}
+	s.metrics.registrationsRejected.Inc()
+
+	select {
+	case s.rejectSlots <- struct{}{}:
+		go func() {
+			defer func() { <-s.rejectSlots }()
+			s.rejectTunnelClient(conn, protocol.ErrCodeServerBusy, "server is busy registering other clients", registrationRetryAfter)
+		}()
+	default:
+		// Too busy to even say so; the client will back off on its own
+		conn.Close()
+	}
+}
+
+// rejectTunnelClient opens a session on conn just far enough to tell the
+// client why it was turned away and when to try again.
+func (s *Server) rejectTunnelClient(conn net.Conn, code, message string, retryAfter time.Duration) {
+	stopDeadline := s.handshakeDeadline(conn, "control stream", "remote_addr", conn.RemoteAddr())
+	defer stopDeadline()
+	muxer, conn, err := transport.ReadPreface(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	session, err := muxer.Server(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer session.Close()
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		return
+	}
+	slog.Warn("tunnel client turned away", "remote_addr", conn.RemoteAddr(), "code", code, "retry_after", retryAfter)
+	protocol.NewControlStream(stream).SendRetryAfter(code, message, retryAfter)
+}
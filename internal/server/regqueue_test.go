@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// addrConn is a net.Conn with a fixed remote address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func connFrom(ip string) net.Conn {
+	return &addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestRegQueueFairness(t *testing.T) {
+	q := newRegQueue(10)
+	a1, a2, a3 := connFrom("10.0.0.1"), connFrom("10.0.0.1"), connFrom("10.0.0.1")
+	b1 := connFrom("10.0.0.2")
+	c1 := connFrom("10.0.0.3")
+	for _, c := range []net.Conn{a1, a2, a3, b1, c1} {
+		if !q.push(c) {
+			t.Fatal("push failed")
+		}
+	}
+
+	want := []net.Conn{a1, b1, c1, a2, a3}
+	done := make(chan struct{})
+	for i, w := range want {
+		if got := q.pop(done); got != w {
+			t.Errorf("pop %d = %v, want %v", i, got.RemoteAddr(), w.RemoteAddr())
+		}
+	}
+	if q.len() != 0 {
+		t.Errorf("len = %d after draining", q.len())
+	}
+
+	close(done)
+	if got := q.pop(done); got != nil {
+		t.Errorf("pop after done = %v, want nil", got)
+	}
+}
+
+func TestRegQueueFull(t *testing.T) {
+	q := newRegQueue(2)
+	if !q.push(connFrom("10.0.0.1")) || !q.push(connFrom("10.0.0.2")) {
+		t.Fatal("push failed")
+	}
+	if q.push(connFrom("10.0.0.3")) {
+		t.Error("push succeeded on a full queue")
+	}
+}
+
+func TestRegistrationQueueRejectsWithRetryAfter(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithRegistrationQueue(1, 0)
+
+	serverConn, clientConn := net.Pipe()
+	go s.enqueueTunnelClient(serverConn)
+
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	defer session.Close()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+	cs.SendRegisterMessage(&protocol.RegisterMessage{Subdomain: "app"})
+
+	msg, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	errMsg, ok := msg.(*protocol.ErrorMessage)
+	if !ok {
+		t.Fatalf("got %T, want ErrorMessage", msg)
+	}
+	if errMsg.Code != protocol.ErrCodeServerBusy || errMsg.RetryAfter != 5 {
+		t.Errorf("got code %q retry_after %d, want %q and 5", errMsg.Code, errMsg.RetryAfter, protocol.ErrCodeServerBusy)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/proxy"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// relayDialTimeout bounds connecting to a relay target.
+const relayDialTimeout = 10 * time.Second
+
+// WithRelayTargets lets clients chain through this server to the control
+// ports of the otun servers at targets (host:port), e.g. to enter in one
+// region and leave close to the developer. Empty disables relaying; the
+// list keeps the server from being used as an open proxy.
+func (s *Server) WithRelayTargets(targets []string) *Server {
+	s.relayTargets = targets
+	return s
+}
+
+// relayAllowed reports whether clients may chain through to target.
+func (s *Server) relayAllowed(target string) bool {
+	return slices.ContainsFunc(s.relayTargets, func(t string) bool { return strings.EqualFold(t, target) })
+}
+
+// handleRelay serves a chained client: the first stream it opens is spliced
+// onto a connection to the requested otun server, which the client then
+// speaks to as if it had connected directly. The session ends with that
+// stream.
+func (s *Server) handleRelay(remoteAddr net.Addr, session transport.Session, controlStream *protocol.ControlStream, msg *protocol.RelayMessage, registered func()) {
+	defer session.Close()
+
+	if !s.validateToken(msg.Token) {
+		slog.Warn("invalid API key", "remote_addr", remoteAddr)
+		controlStream.SendErrorCode(protocol.ErrCodeUnauthorized, "invalid or missing API key")
+		return
+	}
+	if !s.relayAllowed(msg.Target) {
+		slog.Warn("relay to disallowed target", "target", msg.Target, "remote_addr", remoteAddr)
+		controlStream.SendErrorCode(protocol.ErrCodeRelayNotAllowed, fmt.Sprintf("relaying to %s is not allowed", msg.Target))
+		return
+	}
+
+	d := net.Dialer{Timeout: relayDialTimeout}
+	conn, err := d.DialContext(s.ctx, "tcp", msg.Target)
+	if err != nil {
+		slog.Warn("failed to connect to relay target", "target", msg.Target, "error", err)
+		controlStream.SendErrorCode(protocol.ErrCodeRelayFailed, fmt.Sprintf("failed to connect to %s", msg.Target))
+		return
+	}
+	defer conn.Close()
+	if err := s.keepAlive.Apply(conn); err != nil {
+		slog.Warn("failed to tune relay connection", "error", err)
+	}
+
+	if err := controlStream.SendRelaying(msg.Target); err != nil {
+		slog.Error("failed to send relaying message", "error", err)
+		return
+	}
+
+	slog.Info("relay started", "target", msg.Target, "remote_addr", remoteAddr, "token_id", tokenID(msg.Token))
+	s.metrics.relays.Inc()
+	registered()
+
+	// Answer heartbeats until the control stream closes
+	go func() {
+		defer session.Close()
+		for {
+			msg, err := controlStream.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*protocol.HeartbeatMessage); ok {
+				if err := controlStream.SendHeartbeatAck(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		slog.Info("relay closed before use", "target", msg.Target, "remote_addr", remoteAddr)
+		return
+	}
+	if err := proxy.BidirectionalContext(s.ctx, stream, conn); err != nil {
+		slog.Debug("relay completed", "target", msg.Target, "error", err)
+	}
+	slog.Info("relay stopped", "target", msg.Target, "remote_addr", remoteAddr)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// serveControl accepts tunnel clients for s on a local port, returning its
+// address.
+func serveControl(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleTunnelClient(conn, func() {})
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRelay(t *testing.T) {
+	// entry -> middle -> exit, the server the client uses
+	exit := New("", "", "", "", "", nil).WithSpeedTest(1 << 20)
+	exitAddr := serveControl(t, exit)
+	middle := New("", "", "", "", "", nil).WithRelayTargets([]string{exitAddr})
+	middleAddr := serveControl(t, middle)
+	entry := New("", "", "", "", "", nil).WithRelayTargets([]string{middleAddr})
+
+	c := client.New(exitAddr, "localhost:1").
+		WithServerDialer(pipeDialer{entry}).
+		WithVia([]string{"entry:4443", middleAddr})
+	result, err := c.SpeedTest(context.Background(), 1<<20)
+	if err != nil {
+		t.Fatalf("SpeedTest() error = %v", err)
+	}
+	if result.DownloadBytes != 1<<20 || result.UploadBytes != 1<<20 {
+		t.Errorf("transferred %d down, %d up; want %d each", result.DownloadBytes, result.UploadBytes, 1<<20)
+	}
+	if got := exit.metrics.speedTestBytes.Value(); got != 2<<20 {
+		t.Errorf("exit server's otun_speedtest_bytes_total = %d, want %d", got, 2<<20)
+	}
+	for name, s := range map[string]*Server{"entry": entry, "middle": middle} {
+		if got := s.metrics.relays.Value(); got != 1 {
+			t.Errorf("%s server's otun_relays_total = %d, want 1", name, got)
+		}
+	}
+}
+
+func TestRelayRefused(t *testing.T) {
+	exitAddr := serveControl(t, New("", "", "", "", "", nil).WithSpeedTest(1<<20))
+
+	// Nothing listens on a port just closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name      string
+		s         *Server
+		token     string
+		target    string
+		wantCode  string
+		permanent bool
+	}{
+		{name: "disabled", s: New("", "", "", "", "", nil), target: exitAddr, wantCode: protocol.ErrCodeRelayNotAllowed, permanent: true},
+		{name: "other target", s: New("", "", "", "", "", nil).WithRelayTargets([]string{"eu.example.com:4443"}), target: exitAddr, wantCode: protocol.ErrCodeRelayNotAllowed, permanent: true},
+		{name: "bad token", s: New("", "", "", "", "", []string{"key"}).WithRelayTargets([]string{exitAddr}), token: "wrong", target: exitAddr, wantCode: protocol.ErrCodeUnauthorized, permanent: true},
+		{name: "target down", s: New("", "", "", "", "", nil).WithRelayTargets([]string{deadAddr}), target: deadAddr, wantCode: protocol.ErrCodeRelayFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client.New(tt.target, "localhost:1").
+				WithServerDialer(pipeDialer{tt.s}).
+				WithVia([]string{"relay:4443"}).
+				WithToken(tt.token).
+				WithReconnect(false)
+			err := c.Run(context.Background())
+			e := client.AsError(err)
+			if e == nil || e.Code != tt.wantCode {
+				t.Fatalf("Run() error = %v, want code %s", err, tt.wantCode)
+			}
+			if e.Retryable == tt.permanent {
+				t.Errorf("Retryable = %v, want %v", e.Retryable, !tt.permanent)
+			}
+			if !strings.Contains(err.Error(), "relay:4443") {
+				t.Errorf("error %q doesn't name the hop", err)
+			}
+			if errors.Is(err, client.ErrPermanentFailure) != tt.permanent {
+				t.Errorf("permanent = %v, want %v", !tt.permanent, tt.permanent)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// maxReplayIDs bounds the delivery IDs remembered across all tunnels; the
+// one that expires first is forgotten once it is reached.
+const maxReplayIDs = 100000
+
+// replayPolicy detects redelivered webhooks for a tunnel.
+type replayPolicy struct {
+	*protocol.ReplayProtection
+	window time.Duration
+}
+
+// newReplayPolicy returns the policy requested in msg, or nil if there is
+// none. The policy must have passed Validate.
+func newReplayPolicy(msg *protocol.RegisterMessage) *replayPolicy {
+	if msg.ReplayProtection == nil {
+		return nil
+	}
+	return &replayPolicy{ReplayProtection: msg.ReplayProtection, window: time.Duration(msg.ReplayProtection.Window) * time.Second}
+}
+
+// replayEntry is a delivery ID that is in flight or was delivered.
+type replayEntry struct {
+	expires   time.Time
+	delivered bool
+}
+
+// replayCache remembers recent delivery IDs. It lives on the server rather
+// than the tunnel so that redeliveries are still caught after the client
+// reconnects, which is when providers retry most.
+type replayCache struct {
+	mu  sync.Mutex
+	ids map[string]replayEntry // subdomain and delivery ID -> entry
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{ids: make(map[string]replayEntry)}
+}
+
+// see reports whether key is already known and if so, whether it was
+// delivered. An unknown key is marked in flight until settled.
+func (c *replayCache) see(key string, window time.Duration, now time.Time) (seen, delivered bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.ids[key]; ok && now.Before(e.expires) {
+		return true, e.delivered
+	}
+	if len(c.ids) >= maxReplayIDs {
+		c.evictLocked(now)
+	}
+	c.ids[key] = replayEntry{expires: now.Add(window)}
+	return false, false
+}
+
+// settle remembers key as delivered for the window, or forgets it if the
+// delivery failed so that the provider's retry goes through.
+func (c *replayCache) settle(key string, delivered bool, window time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if delivered {
+		c.ids[key] = replayEntry{expires: now.Add(window), delivered: true}
+	} else {
+		delete(c.ids, key)
+	}
+}
+
+// evictLocked forgets every expired ID, or if there are none, the one that
+// expires first.
+// Must be called with c.mu held.
+func (c *replayCache) evictLocked(now time.Time) {
+	var first string
+	var firstAt time.Time
+	for key, e := range c.ids {
+		if !now.Before(e.expires) {
+			delete(c.ids, key)
+		} else if first == "" || e.expires.Before(firstAt) {
+			first, firstAt = key, e.expires
+		}
+	}
+	if len(c.ids) >= maxReplayIDs {
+		delete(c.ids, first)
+	}
+}
+
+// checkReplay looks up r's delivery ID if client has replay protection.
+// Replays are dropped or flagged with the ReplayHeader, per the policy. A
+// new delivery is remembered once it gets a 2xx response, which the caller
+// reports through settle (nil if there is nothing to report) as soon as the
+// status is known; only the first call counts. It reports false if the
+// request was answered here.
+func (s *Server) checkReplay(w http.ResponseWriter, r *http.Request, client *tunnelClient) (settle func(status int), ok bool) {
+	p := client.replay
+	if p == nil {
+		return nil, true
+	}
+	// Only the edge may say a request is a replay
+	r.Header.Del(protocol.ReplayHeader)
+	id := r.Header.Get(p.Header)
+	if id == "" {
+		return nil, true
+	}
+
+	key := client.subdomain + "\x00" + id
+	seen, delivered := s.replays.see(key, p.window, time.Now())
+	if !seen {
+		var once sync.Once
+		return func(status int) {
+			once.Do(func() {
+				s.replays.settle(key, status >= 200 && status < 300, p.window, time.Now())
+			})
+		}, true
+	}
+
+	s.metrics.webhookReplays.Inc()
+	slog.Info("webhook replay detected", "subdomain", client.subdomain, "header", p.Header, "id", id, "delivered", delivered)
+	if p.Action == protocol.ReplayFlag {
+		r.Header.Set(protocol.ReplayHeader, "1")
+		return nil, true
+	}
+
+	w.Header().Set(protocol.ReplayHeader, "1")
+	if !delivered {
+		// The first delivery may still fail; have the provider retry later
+		w.Header().Set("Retry-After", "5")
+		s.httpError(w, r, "Delivery already in progress", http.StatusConflict)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Duplicate delivery ignored")
+	return nil, false
+}
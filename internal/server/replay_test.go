@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// serveEchoReplay answers each tunnel request with status, echoing its
+// ReplayHeader in the body.
+func serveEchoReplay(session transport.Session, status *atomic.Int32) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			req, err := http.ReadRequest(bufio.NewReader(stream))
+			if err != nil {
+				return
+			}
+			flag := req.Header.Get(protocol.ReplayHeader)
+			fmt.Fprintf(stream, "HTTP/1.1 %d Reply\r\nContent-Length: %d\r\n\r\n%s", status.Load(), len(flag), flag)
+		}()
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache()
+	now := time.Now()
+	window := time.Minute
+
+	if seen, _ := c.see("a", window, now); seen {
+		t.Fatal("new ID reported as seen")
+	}
+	if seen, delivered := c.see("a", window, now); !seen || delivered {
+		t.Errorf("in-flight ID: seen = %v, delivered = %v, want true, false", seen, delivered)
+	}
+
+	// A failed delivery is forgotten so the retry goes through
+	c.settle("a", false, window, now)
+	if seen, _ := c.see("a", window, now); seen {
+		t.Error("failed delivery still remembered")
+	}
+
+	c.settle("a", true, window, now)
+	if seen, delivered := c.see("a", window, now.Add(window/2)); !seen || !delivered {
+		t.Errorf("delivered ID: seen = %v, delivered = %v, want true, true", seen, delivered)
+	}
+	if seen, _ := c.see("a", window, now.Add(window)); seen {
+		t.Error("ID remembered past the window")
+	}
+}
+
+func TestCheckReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "drop", action: protocol.ReplayDrop, wantStatus: http.StatusOK, wantBody: "Duplicate delivery ignored\n"},
+		{name: "flag", action: protocol.ReplayFlag, wantStatus: http.StatusOK, wantBody: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil)
+			var status atomic.Int32
+			status.Store(http.StatusOK)
+			go serveEchoReplay(registerTestTunnel(t, s, "hooks"), &status)
+			s.clients["hooks"].replay = newReplayPolicy(&protocol.RegisterMessage{ReplayProtection: &protocol.ReplayProtection{
+				Header: "X-GitHub-Delivery", Window: 60, Action: tt.action,
+			}})
+
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			deliver := func(id, spoof string) (int, string) {
+				t.Helper()
+				req, _ := http.NewRequest("POST", ts.URL+"/webhooks", nil)
+				req.Host = "hooks.localhost"
+				req.Header.Set("X-GitHub-Delivery", id)
+				if spoof != "" {
+					req.Header.Set(protocol.ReplayHeader, spoof)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				return resp.StatusCode, string(body)
+			}
+
+			// A failed first delivery doesn't block the retry
+			status.Store(http.StatusInternalServerError)
+			if got, _ := deliver("d1", ""); got != http.StatusInternalServerError {
+				t.Fatalf("failed delivery status = %d, want 500", got)
+			}
+			status.Store(http.StatusOK)
+			if got, body := deliver("d1", "1"); got != http.StatusOK || body != "" {
+				t.Fatalf("retry = %d %q, want 200 forwarded without the replay flag", got, body)
+			}
+
+			got, body := deliver("d1", "")
+			if got != tt.wantStatus || body != tt.wantBody {
+				t.Errorf("replay = %d %q, want %d %q", got, body, tt.wantStatus, tt.wantBody)
+			}
+			if got, body := deliver("d2", ""); got != http.StatusOK || body != "" {
+				t.Errorf("new delivery = %d %q, want 200 forwarded", got, body)
+			}
+			if got := s.metrics.webhookReplays.Value(); got != 1 {
+				t.Errorf("replays = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bc183/otun/internal/requestdb"
+)
+
+// defaultPersistedRequests is how many persisted requests the admin API
+// returns unless asked for more.
+const defaultPersistedRequests = 100
+
+// WithRequestDB persists the metadata of every request served through a
+// tunnel to db, so it survives restarts. The admin API's requests endpoint
+// reads from db instead of the in-memory capture. The server closes db when
+// it stops.
+func (s *Server) WithRequestDB(db *requestdb.DB) *Server {
+	s.requestDB = db
+	s.metrics.registry.NewCounterFunc("otun_request_db_dropped_total",
+		"Request records dropped because the request database fell behind.",
+		func() float64 { return float64(db.Dropped()) })
+	s.metrics.registry.NewCounterFunc("otun_request_db_failed_total",
+		"Batches of request records that failed to be written to the request database.",
+		func() float64 { return float64(db.Failed()) })
+	return s
+}
+
+// persistRequest queues req for the request database, if enabled.
+func (s *Server) persistRequest(subdomain string, req capturedRequest) {
+	if s.requestDB == nil || subdomain == "" {
+		return
+	}
+	data, _ := json.Marshal(req)
+	s.requestDB.Log(requestdb.Record{
+		Time:       req.Time,
+		Subdomain:  subdomain,
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.Path,
+		Status:     req.Status,
+		Duration:   time.Duration(req.DurationMS) * time.Millisecond,
+		RemoteAddr: req.RemoteAddr,
+		Data:       data,
+	})
+}
+
+// handlePersistedRequests serves a subdomain's requests from the request
+// database, newest first. since (RFC 3339) and limit narrow the result.
+func (s *Server) handlePersistedRequests(w http.ResponseWriter, r *http.Request) {
+	q := requestdb.Query{Subdomain: r.PathValue("subdomain"), Limit: defaultPersistedRequests}
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+		q.Since = since
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		q.Limit = limit
+	}
+
+	records, err := s.requestDB.Recent(r.Context(), q)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	requests := make([]capturedRequest, 0, len(records))
+	for _, rec := range records {
+		var req capturedRequest
+		if json.Unmarshal(rec.Data, &req) != nil {
+			req = capturedRequest{
+				Time:       rec.Time.UTC(),
+				Method:     rec.Method,
+				Host:       rec.Host,
+				Path:       rec.Path,
+				Status:     rec.Status,
+				DurationMS: rec.Duration.Milliseconds(),
+				RemoteAddr: rec.RemoteAddr,
+			}
+		}
+		requests = append(requests, req)
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
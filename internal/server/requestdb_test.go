@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/requestdb"
+)
+
+func openRequestDB(t *testing.T, path string) *requestdb.DB {
+	t.Helper()
+	db, err := requestdb.Open(path, requestdb.Retention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPersistedRequestsAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.db")
+
+	s, _ := newSharingTestServer(t)
+	db := openRequestDB(t, path)
+	s.WithRequestDB(db)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	for _, p := range []string{"/first", "/second"} {
+		req, _ := http.NewRequest("GET", ts.URL+p, nil)
+		req.Host = "demo.localhost"
+		req.Header.Set("User-Agent", "probe/1.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		records, _ := db.Recent(context.Background(), requestdb.Query{Subdomain: "demo"})
+		return len(records) == 2
+	})
+	db.Close()
+
+	// A restarted server serves the requests from the file
+	s, h := newSharingTestServer(t)
+	db = openRequestDB(t, path)
+	defer db.Close()
+	s.WithRequestDB(db)
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCode  int
+		wantPaths []string
+	}{
+		{name: "all", wantCode: http.StatusOK, wantPaths: []string{"/second", "/first"}},
+		{name: "limit", query: "?limit=1", wantCode: http.StatusOK, wantPaths: []string{"/second"}},
+		{name: "future since", query: "?since=2100-01-01T00:00:00Z", wantCode: http.StatusOK, wantPaths: []string{}},
+		{name: "bad limit", query: "?limit=-1", wantCode: http.StatusBadRequest},
+		{name: "bad since", query: "?since=yesterday", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := adminRequest(t, h, "GET", "/api/tunnels/demo/requests"+tt.query, "root-key", "")
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var requests []capturedRequest
+			if err := json.NewDecoder(rec.Body).Decode(&requests); err != nil {
+				t.Fatal(err)
+			}
+			if len(requests) != len(tt.wantPaths) {
+				t.Fatalf("got %d requests, want %d", len(requests), len(tt.wantPaths))
+			}
+			for i, want := range tt.wantPaths {
+				if got := requests[i]; got.Path != want || got.Status != http.StatusOK || got.UserAgent != "probe/1.0" {
+					t.Errorf("requests[%d] = %+v, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
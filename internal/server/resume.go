@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// defaultResumeWindow is how long after a tunnel disconnects its client may
+// resume it, unless changed with WithResumeWindow.
+const defaultResumeWindow = 5 * time.Minute
+
+// resumption is what a resume token restores: the tunnel it was issued for
+// and the health counters of the session that held it.
+type resumption struct {
+	token      string
+	apiToken   string
+	protocol   string
+	subdomain  string // HTTP and TLS tunnels
+	remotePort int    // TCP tunnels
+	health     *sessionHealth
+
+	// disconnectedAt is when the tunnel's session ended (zero while it is
+	// connected)
+	disconnectedAt time.Time
+}
+
+// WithResumeWindow sets how long after a tunnel disconnects its client can
+// resume it with the token from its last registration (0 = never). A
+// resumed registration skips the subdomain ownership lookups, keeps its
+// subdomain, and carries over its session counters, provided the API key
+// it was issued to is still valid.
+func (s *Server) WithResumeWindow(d time.Duration) *Server {
+	s.resumeWindow = d
+	return s
+}
+
+// issueResumption creates client's resume token, replacing any it held,
+// and returns it ("" if resumption is disabled).
+// Must be called with s.mu held.
+func (s *Server) issueResumption(client *tunnelClient, protocolName string) string {
+	s.dropResumption(client)
+	if s.resumeWindow <= 0 {
+		return ""
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	r := &resumption{
+		token:      hex.EncodeToString(b),
+		apiToken:   client.token,
+		protocol:   protocolName,
+		subdomain:  client.subdomain,
+		remotePort: client.remotePort,
+	}
+	if hs := healthOf(client.session); hs != nil {
+		r.health = &hs.health
+	}
+	s.resumptions[r.token] = r
+	client.resumeToken = r.token
+	return r.token
+}
+
+// dropResumption revokes client's resume token.
+// Must be called with s.mu held.
+func (s *Server) dropResumption(client *tunnelClient) {
+	if client.resumeToken != "" {
+		delete(s.resumptions, client.resumeToken)
+		client.resumeToken = ""
+	}
+}
+
+// markResumable starts the resume window of client's token now that its
+// session has ended, and forgets tokens whose window has passed or whose
+// API key has been revoked.
+// Must be called with s.mu held.
+func (s *Server) markResumable(client *tunnelClient) {
+	now := time.Now()
+	for token, r := range s.resumptions {
+		if (!r.disconnectedAt.IsZero() && now.Sub(r.disconnectedAt) > s.resumeWindow) || !s.validateToken(r.apiToken) {
+			delete(s.resumptions, token)
+		}
+	}
+	if r := s.resumptions[client.resumeToken]; r != nil {
+		r.disconnectedAt = now
+		if r.health != nil {
+			r.health = r.health.snapshot() // don't hold on to the session
+		}
+	}
+}
+
+// takeResumption consumes the resume token msg presents, returning what it
+// restores, or nil if it is missing, expired, issued to an API key that has
+// since been revoked, or doesn't match the registration. Each token resumes at most once; the new registration gets
+// a fresh one.
+// Must be called with s.mu held.
+func (s *Server) takeResumption(msg *protocol.RegisterMessage) *resumption {
+	if msg.ResumeToken == "" {
+		return nil
+	}
+	r := s.resumptions[msg.ResumeToken]
+	if r == nil {
+		slog.Debug("unknown resume token", "token_id", tokenID(msg.Token))
+		return nil
+	}
+	delete(s.resumptions, msg.ResumeToken)
+
+	switch {
+	case !r.disconnectedAt.IsZero() && time.Since(r.disconnectedAt) > s.resumeWindow:
+		slog.Debug("expired resume token", "token_id", tokenID(msg.Token))
+		return nil
+	case subtle.ConstantTimeCompare([]byte(r.apiToken), []byte(msg.Token)) != 1,
+		r.protocol != msg.Protocol,
+		msg.Subdomain != "" && msg.Subdomain != r.subdomain,
+		msg.RemotePort != 0 && msg.RemotePort != r.remotePort:
+		slog.Warn("resume token presented for another tunnel", "token_id", tokenID(msg.Token))
+		return nil
+	case !s.validateToken(r.apiToken):
+		slog.Warn("resume token of a revoked API key", "token_id", tokenID(msg.Token))
+		return nil
+	}
+	return r
+}
+
+// heldForResume reports whether subdomain is reserved for its previous
+// client to resume: during the reconnect grace period, queued requests are
+// waiting for that client, so only it, or a client with its (non-empty) API
+// key, may register the subdomain.
+// Must be called with s.mu held.
+func (s *Server) heldForResume(subdomain, apiToken string) bool {
+	at, ok := s.disconnectedAt[subdomain]
+	if !ok || time.Since(at) > s.reconnectGrace {
+		return false
+	}
+	for _, r := range s.resumptions {
+		if r.subdomain == subdomain && !r.disconnectedAt.IsZero() {
+			return r.apiToken == "" || r.apiToken != apiToken
+		}
+	}
+	return false
+}
+
+// resumeSession carries the counters of r's session over to session.
+func resumeSession(session transport.Session, r *resumption) {
+	if hs := healthOf(session); hs != nil && r.health != nil {
+		hs.health.carryOver(r.health)
+	}
+}
+
+// snapshot returns a copy of h's current counters.
+func (h *sessionHealth) snapshot() *sessionHealth {
+	c := &sessionHealth{}
+	c.carryOver(h)
+	return c
+}
+
+// carryOver adds the counters of a resumed session's predecessor.
+func (h *sessionHealth) carryOver(prev *sessionHealth) {
+	h.opened.Add(prev.opened.Load())
+	h.closed.Add(prev.closed.Load())
+	h.stalls.Add(prev.stalls.Load())
+	h.errors.Add(prev.errors.Load())
+	if h.rtt.Load() == 0 {
+		h.rtt.Store(prev.rtt.Load())
+	}
+}
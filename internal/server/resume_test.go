@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// registerSession sends msg to s as a new client and returns the reply and
+// the client's session.
+func registerSession(t *testing.T, s *Server, msg *protocol.RegisterMessage) (any, transport.Session) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+	if err := cs.SendRegisterMessage(msg); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	reply, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return reply, session
+}
+
+// mustRegister registers msg with s and fails the test unless it succeeds.
+func mustRegister(t *testing.T, s *Server, msg *protocol.RegisterMessage) (*protocol.RegisteredMessage, transport.Session) {
+	t.Helper()
+	reply, session := registerSession(t, s, msg)
+	registered, ok := reply.(*protocol.RegisteredMessage)
+	if !ok {
+		t.Fatalf("reply = %+v, want registered", reply)
+	}
+	return registered, session
+}
+
+// disconnect closes session and waits for s to unregister subdomain.
+func disconnect(t *testing.T, s *Server, session transport.Session, subdomain string) {
+	t.Helper()
+	session.Close()
+	waitFor(t, time.Second, func() bool { return s.lookupClient(subdomain) == nil })
+}
+
+func TestResumeRestoresTunnel(t *testing.T) {
+	s := New("", "", "", "", "", []string{"key"})
+
+	first, session := mustRegister(t, s, &protocol.RegisterMessage{Token: "key"})
+	if first.ResumeToken == "" {
+		t.Fatal("no resume token issued")
+	}
+	disconnect(t, s, session, first.Subdomain)
+
+	resumed, _ := mustRegister(t, s, &protocol.RegisterMessage{Token: "key", ResumeToken: first.ResumeToken})
+	if resumed.Subdomain != first.Subdomain {
+		t.Errorf("resumed subdomain = %q, want %q", resumed.Subdomain, first.Subdomain)
+	}
+	if resumed.ResumeToken == "" || resumed.ResumeToken == first.ResumeToken {
+		t.Errorf("resume token = %q, want a fresh one", resumed.ResumeToken)
+	}
+
+	// Both sessions' control streams are counted
+	hs := s.lookupClient(first.Subdomain).session.(*healthSession)
+	if got := hs.health.opened.Load(); got != 2 {
+		t.Errorf("streams opened = %d, want 2 carried over", got)
+	}
+
+	// The token was spent: presenting it again is a plain registration
+	again, _ := mustRegister(t, s, &protocol.RegisterMessage{Token: "key", ResumeToken: first.ResumeToken})
+	if again.Subdomain == first.Subdomain {
+		t.Error("spent resume token restored the subdomain")
+	}
+}
+
+func TestResumeReplacesOwnSession(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+
+	first, _ := mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app"})
+
+	// The old session is still registered, as when the server hasn't
+	// noticed a dropped connection yet
+	resumed, _ := mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", ResumeToken: first.ResumeToken})
+	if resumed.Subdomain != "app" {
+		t.Errorf("resumed subdomain = %q, want app", resumed.Subdomain)
+	}
+
+	// Another client still can't take it over
+	reply, _ := registerSession(t, s, &protocol.RegisterMessage{Subdomain: "app"})
+	if m, ok := reply.(*protocol.ErrorMessage); !ok || m.Code != protocol.ErrCodeSubdomainTaken {
+		t.Errorf("reply = %+v, want %s error", reply, protocol.ErrCodeSubdomainTaken)
+	}
+}
+
+func TestResumeHoldsSubdomainDuringGrace(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		wantOK bool
+	}{
+		{name: "other key", token: "other", wantOK: false},
+		{name: "same key", token: "key", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", []string{"key", "other"}).WithReconnectQueue(time.Minute, 10)
+
+			first, session := mustRegister(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: "key"})
+			disconnect(t, s, session, first.Subdomain)
+
+			reply, _ := registerSession(t, s, &protocol.RegisterMessage{Subdomain: "app", Token: tt.token})
+			_, ok := reply.(*protocol.RegisteredMessage)
+			if ok != tt.wantOK {
+				t.Errorf("reply = %+v, want registered %v", reply, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTakeResumption(t *testing.T) {
+	tests := []struct {
+		name         string
+		disconnected time.Duration // how long ago the tunnel disconnected (0 = connected)
+		msg          protocol.RegisterMessage
+		revoked      bool // the API key was revoked after the token was issued
+		want         bool
+	}{
+		{name: "connected", msg: protocol.RegisterMessage{Token: "key"}, want: true},
+		{name: "within window", disconnected: time.Minute, msg: protocol.RegisterMessage{Token: "key"}, want: true},
+		{name: "expired", disconnected: time.Hour, msg: protocol.RegisterMessage{Token: "key"}},
+		{name: "other API key", msg: protocol.RegisterMessage{Token: "other"}},
+		{name: "other subdomain", msg: protocol.RegisterMessage{Token: "key", Subdomain: "other"}},
+		{name: "other protocol", msg: protocol.RegisterMessage{Token: "key", Protocol: protocol.ProtocolTLS}},
+		{name: "revoked API key", msg: protocol.RegisterMessage{Token: "key"}, revoked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil)
+			client := &tunnelClient{subdomain: "app", token: "key"}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			token := s.issueResumption(client, "")
+			if tt.disconnected > 0 {
+				s.resumptions[token].disconnectedAt = time.Now().Add(-tt.disconnected)
+			}
+			if tt.revoked {
+				s.apiKeys = map[string]struct{}{"other": {}}
+			}
+
+			tt.msg.ResumeToken = token
+			got := s.takeResumption(&tt.msg)
+			if (got != nil) != tt.want {
+				t.Errorf("takeResumption() = %+v, want resumed %v", got, tt.want)
+			}
+			if _, ok := s.resumptions[token]; ok {
+				t.Error("resume token not spent")
+			}
+		})
+	}
+}
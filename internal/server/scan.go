@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/scan"
+)
+
+// scanTimeout bounds how long the content scanner may take per body.
+const scanTimeout = 2 * time.Minute
+
+// WithContentScanner passes request bodies larger than threshold bytes
+// through scanner before they are forwarded, for shared tunnels whose
+// operators must inspect uploads. Bodies are spooled to a temporary file
+// while scanned; ones over maxSize are refused (0 = no limit). If the scanner
+// fails, the request is refused rather than forwarded unscanned.
+func (s *Server) WithContentScanner(scanner scan.Scanner, threshold, maxSize int64) *Server {
+	s.scanner = scanner
+	s.scanThreshold = threshold
+	s.scanMaxBytes = maxSize
+	return s
+}
+
+// scanBody runs r's body through the content scanner if it is over the
+// threshold, replacing r.Body with the spooled copy. It reports false if the
+// request was refused, in which case a response has been written. The
+// returned function removes the spooled copy and must be called once the
+// request has been forwarded.
+func (s *Server) scanBody(w http.ResponseWriter, r *http.Request, subdomain string) (func(), bool) {
+	noop := func() {}
+	if s.scanner == nil || r.Body == nil || r.Body == http.NoBody {
+		return noop, true
+	}
+	if r.ContentLength >= 0 && r.ContentLength <= s.scanThreshold {
+		return noop, true
+	}
+	if s.scanMaxBytes > 0 && r.ContentLength > s.scanMaxBytes {
+		s.refuseTooLarge(w, r, subdomain)
+		return noop, false
+	}
+
+	f, err := os.CreateTemp("", "otun-scan-*")
+	if err != nil {
+		slog.Error("failed to spool request body", "error", err)
+		s.httpError(w, r, "Internal server error", http.StatusInternalServerError)
+		return noop, false
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	var body io.Reader = r.Body
+	if s.scanMaxBytes > 0 {
+		body = io.LimitReader(r.Body, s.scanMaxBytes+1)
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		cleanup()
+		s.httpError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return noop, false
+	}
+	if s.scanMaxBytes > 0 && n > s.scanMaxBytes {
+		cleanup()
+		s.refuseTooLarge(w, r, subdomain)
+		return noop, false
+	}
+
+	// Chunked bodies are only known to be over the threshold once spooled
+	if n > s.scanThreshold {
+		f.Seek(0, io.SeekStart)
+		ctx, cancel := context.WithTimeout(r.Context(), scanTimeout)
+		verdict, err := s.scanner.Scan(ctx, r, f)
+		cancel()
+		s.metrics.scannedRequests.Inc()
+
+		if err != nil {
+			cleanup()
+			s.metrics.scanErrors.Inc()
+			slog.Error("content scan failed", "subdomain", subdomain, "error", err)
+			s.httpError(w, r, "Content scanner unavailable, try again later", http.StatusServiceUnavailable)
+			return noop, false
+		}
+		if !verdict.Clean {
+			cleanup()
+			s.metrics.scanBlocked.Inc()
+			slog.Warn("request blocked by content scanner", "subdomain", subdomain, "path", r.URL.Path, "reason", verdict.Reason)
+			s.audit("request blocked by content scanner",
+				"subdomain", subdomain,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"remote_addr", r.RemoteAddr,
+				"size", n,
+				"reason", verdict.Reason)
+			s.httpError(w, r, "Request blocked by content scanner", http.StatusForbidden)
+			return noop, false
+		}
+	}
+
+	// Forward the spooled copy with a fixed length. The visitor has already
+	// been sent 100 Continue, so the upstream must not send another.
+	f.Seek(0, io.SeekStart)
+	r.Body = io.NopCloser(f)
+	r.ContentLength = n
+	r.TransferEncoding = nil
+	r.Header.Del("Expect")
+	return cleanup, true
+}
+
+// refuseTooLarge answers a request whose body is too large to scan.
+func (s *Server) refuseTooLarge(w http.ResponseWriter, r *http.Request, subdomain string) {
+	slog.Warn("request body too large to scan", "subdomain", subdomain, "limit", s.scanMaxBytes)
+	w.Header().Set("Connection", "close")
+	s.httpError(w, r, "Request body exceeds the scanning limit of "+bytesize.Format(s.scanMaxBytes), http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/scan"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// fakeScanner rejects bodies containing "EVIL" and records what it saw.
+type fakeScanner struct {
+	err     error
+	scanned []string
+}
+
+func (f *fakeScanner) Scan(_ context.Context, _ *http.Request, body io.Reader) (scan.Verdict, error) {
+	if f.err != nil {
+		return scan.Verdict{}, f.err
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return scan.Verdict{}, err
+	}
+	f.scanned = append(f.scanned, string(b))
+	if strings.Contains(string(b), "EVIL") {
+		return scan.Verdict{Reason: "Evil.Test"}, nil
+	}
+	return scan.Verdict{Clean: true}, nil
+}
+
+// echoTunnelStreams answers every stream with the request body it received.
+func echoTunnelStreams(session transport.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			req, err := http.ReadRequest(bufio.NewReader(stream))
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				ContentLength: int64(len(body)),
+				Body:          io.NopCloser(strings.NewReader(string(body))),
+			}
+			resp.Write(stream)
+		}()
+	}
+}
+
+func TestContentScanning(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		chunked     bool
+		scannerErr  error
+		wantStatus  int
+		wantScanned bool
+	}{
+		{name: "small body is not scanned", body: "EVIL", wantStatus: http.StatusOK},
+		{name: "clean body is forwarded", body: "hello world", wantStatus: http.StatusOK, wantScanned: true},
+		{name: "chunked clean body is forwarded", body: "hello world", chunked: true, wantStatus: http.StatusOK, wantScanned: true},
+		{name: "rejected body", body: "some EVIL bytes", wantStatus: http.StatusForbidden, wantScanned: true},
+		{name: "chunked rejected body", body: "some EVIL bytes", chunked: true, wantStatus: http.StatusForbidden, wantScanned: true},
+		{name: "scanner failure refuses request", body: "hello world", scannerErr: errors.New("down"), wantStatus: http.StatusServiceUnavailable},
+		{name: "body over max size", body: strings.Repeat("x", 50), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked body over max size", body: strings.Repeat("x", 50), chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner := &fakeScanner{err: tt.scannerErr}
+			s := New("", "", "", "", "", nil).WithContentScanner(scanner, 5, 20)
+			session := registerTestTunnel(t, s, "app")
+			go echoTunnelStreams(session)
+
+			req := httptest.NewRequest("POST", "http://app.localhost/upload", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != tt.body {
+				t.Errorf("upstream received %q, want %q", rec.Body, tt.body)
+			}
+			if scanned := len(scanner.scanned) > 0; scanned != tt.wantScanned {
+				t.Errorf("scanned = %v, want %v", scanned, tt.wantScanned)
+			}
+		})
+	}
+}
+
+func TestContentScanningKeepAlive(t *testing.T) {
+	scanner := &fakeScanner{}
+	s := New("", "", "", "", "", nil).WithContentScanner(scanner, 5, 20)
+	go serveKeepAlive(registerTestTunnel(t, s, "app"))
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	post := func(body string) string {
+		return fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: app.localhost\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	if keepAliveForwards(t, ts.Listener.Addr().String(), post("hello world"), post("some EVIL bytes")) {
+		t.Error("second request on the kept-alive connection skipped the content scanner")
+	}
+}
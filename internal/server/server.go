@@ -3,51 +3,383 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/bc183/otun/internal/dnsprovider"
+	"github.com/bc183/otun/internal/logsink"
+	"github.com/bc183/otun/internal/metrics"
 	"github.com/bc183/otun/internal/protocol"
 	"github.com/bc183/otun/internal/proxy"
-	"github.com/hashicorp/yamux"
+	"github.com/bc183/otun/internal/requestdb"
+	"github.com/bc183/otun/internal/scan"
+	"github.com/bc183/otun/internal/transport"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
 	// HeartbeatTimeout is how long to wait before considering a client dead.
 	HeartbeatTimeout = 90 * time.Second
+
+	// acceptBackoffMin and acceptBackoffMax bound the delay between failed
+	// Accept calls on the control listener.
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = 1 * time.Second
+
+	// acceptRecreateThreshold is the number of consecutive Accept failures
+	// (other than fd exhaustion) after which the control listener is re-created.
+	acceptRecreateThreshold = 10
 )
 
 // tunnelClient represents a connected tunnel client.
 type tunnelClient struct {
 	subdomain     string
-	session       *yamux.Session
+	token         string
+	remoteAddr    string
+	session       transport.Session
 	controlStream *protocol.ControlStream
-	lastHeartbeat time.Time
+	connectedAt   time.Time
+	lastHeartbeat time.Time // protected by Server.mu
+
+	// maxResponseBytes limits each response body (0 = no limit)
+	maxResponseBytes int64
+
+	// labels were attached by the client at registration
+	labels map[string]string
+
+	// stripHeaders are removed from the tunnel's responses
+	stripHeaders []string
+
+	// access makes the tunnel private (nil = public)
+	access *accessPolicy
+
+	// signature verifies webhook signatures on requests (nil = none)
+	signature *signaturePolicy
+
+	// jwt requires a valid bearer JWT on requests (nil = none)
+	jwt *jwtPolicy
+
+	// replay detects redelivered webhooks (nil = none)
+	replay *replayPolicy
+
+	// ab assigns visitors to A/B buckets (nil = none)
+	ab *abPolicy
+
+	// geo refuses visitors by country or network (nil = none)
+	geo *geoPolicy
+
+	// challenge puts an interstitial in front of the tunnel (nil = none)
+	challenge *challengePolicy
+
+	// honeytokens are trap paths that raise an alert (nil = none)
+	honeytokens *honeytokenPolicy
+
+	// sizes records request and response sizes (nil for tunnels that
+	// don't serve HTTP)
+	sizes *payloadSizes
+
+	// timing is set if the client starts every response with its local
+	// dial time, for the slow request log
+	timing bool
+
+	// anonymous is set if the tunnel was opened without an API key;
+	// bandwidth throttles its streams (nil = no limit)
+	anonymous bool
+	bandwidth *bandwidthLimiter
+
+	// htmlBanner is added to the tunnel's pages (nil = none)
+	htmlBanner []byte
+
+	// passthrough is set for ProtocolTLS tunnels, whose TLS connections
+	// are routed by SNI and handed to the client undecrypted
+	passthrough bool
+
+	// TCP tunnels only: the public port and its listener
+	remotePort  int
+	tcpListener net.Listener
+
+	// streams counts the tunnel's open streams against its limit (see
+	// Server.streamLimit)
+	streams connLimiter
+
+	// warnings is set if the client understands limit warnings; warned
+	// holds when each was last sent
+	warnings bool
+	warnMu   sync.Mutex
+	warned   map[string]time.Time
+
+	// closeReason says why the server closed the session, if it did
+	// (protected by Server.mu)
+	closeReason string
+
+	// resumeToken lets the client resume the tunnel after a reconnect
+	// (protected by Server.mu)
+	resumeToken string
+
+	// handoverToken lets another client take the tunnel over without
+	// dropping requests
+	handoverToken string
+
+	// canary is set for a client serving a share of another client's
+	// subdomain (see Server.canaries)
+	canary bool
+
+	// group holds the tunnel to shared policies (nil = none)
+	group *Group
 }
 
 // Server is the otun tunnel server.
 type Server struct {
-	controlAddr string
-	httpsAddr   string
-	httpAddr    string
+	// Addresses to listen on; each may list several
+	controlAddrs []string
+	httpsAddrs   []string
+	httpAddrs    []string
+
 	domain      string
 	certDir     string
+	metricsAddr string
+	metricsPush *metrics.PushConfig
+	adminAddr   string
+	adminKey    string
+	http3       bool
+
+	// altSvc is the Alt-Svc header value advertised on HTTPS responses
+	// when HTTP/3 is enabled
+	altSvc string
+
+	// controlListeners holds a listener for each control address
+	controlListeners []*controlListener
+
+	// keepAlive tunes dead peer detection on control connections
+	keepAlive transport.KeepAlive
+
+	// done is closed when Run returns
+	done chan struct{}
+
+	// ctx is cancelled when Run returns, aborting connections still being
+	// proxied
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	metrics *serverMetrics
+
+	// watchdog tracks open tunnel streams to clean up leaked ones
+	watchdog *streamWatchdog
+
+	// mu protects the clients, canaries, splits, owners, blocked, and
+	// webhooks maps
+	mu       sync.RWMutex
+	clients  map[string]*tunnelClient // subdomain -> client
+	canaries map[string]*tunnelClient // subdomain -> canary client
+	splits   map[string]int           // subdomain -> percent of requests to its canary
+	owners   map[string]*ownership    // subdomain -> ownership
+	blocked  map[string]*blockInfo    // subdomain -> takedown record
+	webhooks map[string]string        // token -> webhook URL
+
+	// ownerKeys binds subdomains to keys their clients must prove they hold
+	ownerKeys *ownerKeys
+
+	// Requests for recently disconnected tunnels wait up to reconnectGrace
+	// for the client to re-register (protected by mu)
+	reconnectGrace time.Duration
+	maxQueued      int
+	queued         int
+	disconnectedAt map[string]time.Time // subdomain -> disconnect time
+	waiters        map[string]*waitList // subdomain -> requests waiting for it
+
+	// Resume tokens of connected and recently disconnected tunnels
+	// (protected by mu)
+	resumeWindow time.Duration
+	resumptions  map[string]*resumption // resume token -> what it restores
+
+	// maxResponseBytes is the default and ceiling for tunnel response limits
+	maxResponseBytes int64
+
+	// speedTestMaxBytes caps each speed test transfer (0 = speed tests
+	// disabled)
+	speedTestMaxBytes int64
+
+	// relayTargets are the otun servers clients may chain through to
+	// (empty = relaying disabled)
+	relayTargets []string
+
+	// maxRequestDuration caps how long a proxied request may run (0 = no limit)
+	maxRequestDuration time.Duration
+
+	// slowRequestThreshold logs requests that take longer (0 = off)
+	slowRequestThreshold time.Duration
+
+	// rejectUnknownFields refuses control messages with fields the
+	// protocol doesn't define
+	rejectUnknownFields bool
+
+	// handshakeTimeout bounds each step of a client's registration
+	// (0 = no limit)
+	handshakeTimeout time.Duration
+
+	// stripHeaders are removed from every tunnel's responses
+	stripHeaders []string
+
+	// Caps on the header bytes and lines of forwarded requests (0 = no limit)
+	maxHeaderBytes int64
+	maxHeaderCount int
+
+	// controlTLS makes the control listeners serve TLS with the server's
+	// certificates; controlTLSConfig is set up by Run
+	controlTLS       bool
+	controlTLSConfig *tls.Config
+
+	// tlsPassthrough routes HTTPS connections by SNI before the handshake so
+	// ProtocolTLS tunnels can terminate TLS themselves
+	tlsPassthrough bool
+
+	// TCP tunnels: allowed public ports, per-token reservations, and the
+	// active tunnels by port (tcpTunnels is protected by mu)
+	tcpPorts      PortRange
+	reservedPorts map[int]string
+	tcpTunnels    map[int]*tunnelClient
+
+	// Caps on proxied public connections, streams per tunnel, and tunnel
+	// client sessions (0 = no limit)
+	maxConnections      int
+	maxStreamsPerTunnel int
+	maxSessions         int
+
+	// limitWarningPercent is the share of a tunnel's limits at which its
+	// client is warned (0 = never)
+	limitWarningPercent int
+	publicConns         connLimiter
+	sessions            connLimiter
+
+	// visitors throttles each visitor IP per tunnel (nil = disabled)
+	visitors *visitorLimiter
+
+	// introspections throttles keys introspecting themselves
+	introspections *visitorLimiter
+
+	// geoip locates visitors for tunnels' geo policies (nil = geo policies
+	// are refused)
+	geoip geoLocator
+
+	// challengeKey signs challenge nonces and the cookies of visitors who
+	// passed; captchas are the CAPTCHA services configured, by mode
+	challengeKey []byte
+	captchas     map[string]*captchaProvider
 
-	controlListener net.Listener
+	// jwksClient fetches the key sets of tunnels' JWT policies, from
+	// jwksHosts only
+	jwksClient *http.Client
+	jwksHosts  []string
 
-	// mu protects the clients map
-	mu      sync.RWMutex
-	clients map[string]*tunnelClient // subdomain -> client
+	// errorPages renders the errors the server answers browsers with
+	// itself (nil = plain text)
+	errorPages *errorPages
 
-	// apiKeys holds valid API keys (empty = no auth required)
+	// identity signs the identities of visitors private tunnels
+	// authenticated, for their local services
+	identity *identitySigner
+
+	// honeytokens remembers visitors who touched trap paths
+	honeytokens *honeytokenTrips
+
+	// Registration handshakes run on registrationWorkers workers fed by
+	// regQueue (0 workers = a goroutine per connection)
+	registrationWorkers int
+	regQueue            *regQueue
+	rejectSlots         chan struct{}
+
+	// scanner inspects request bodies over scanThreshold bytes before they
+	// are forwarded (nil = disabled); larger than scanMaxBytes are refused
+	scanner       scan.Scanner
+	scanThreshold int64
+	scanMaxBytes  int64
+
+	// Custom domains added through the admin API (domains is protected by
+	// mu); lookupTXT resolves ownership challenges
+	customDomains bool
+	verifyDomains bool
+	dnsProvider   dnsprovider.Provider
+	domains       map[string]*customDomain // domain -> mapping
+	lookupTXT     func(ctx context.Context, name string) ([]string, error)
+
+	// stapler staples OCSP responses to served certificates (nil = disabled)
+	stapler *ocspStapler
+
+	// history records each subdomain's recent connection events (nil =
+	// disabled)
+	history *tunnelHistory
+
+	// stats keeps per-subdomain traffic time series (nil = disabled)
+	stats *tunnelStats
+
+	// requestDB persists request metadata across restarts (nil = disabled)
+	requestDB *requestdb.DB
+
+	// capture keeps recent request metadata per subdomain for operators
+	// (nil = disabled)
+	capture *requestCapture
+
+	// edgeCache answers conditional requests from cached validators (nil =
+	// disabled)
+	edgeCache *edgeCache
+
+	// replays remembers recent webhook delivery IDs for tunnels with
+	// replay protection
+	replays *replayCache
+
+	// tickets manages TLS session ticket keys (nil = crypto/tls defaults)
+	tickets *sessionTickets
+
+	// certs serves a certificate from a directory instead of ACME (nil = ACME)
+	certs *certReloader
+
+	// takeoverPolicy decides whether a registration may evict the current
+	// client of a subdomain
+	takeoverPolicy TakeoverPolicy
+
+	// handoverDrain is how long a client that handed its tunnel over may
+	// finish its in-flight requests
+	handoverDrain time.Duration
+
+	// chaos injects faults for resilience testing (nil = disabled)
+	chaos *chaos
+
+	// shipper ships access and audit logs to external sinks (nil = disabled)
+	shipper *logsink.Shipper
+
+	// groups apply shared policies to sets of tunnels
+	groups []*Group
+
+	// policies holds API keys, reservations and tunnel policies from a
+	// policy directory (nil = none)
+	policies *policyDir
+
+	// apiKeys holds valid API keys (empty = no auth required unless signup
+	// is enabled)
 	apiKeys map[string]struct{}
+
+	// signup issues API keys through the self-service signup API (nil = disabled)
+	signup     *signup
+	signupAddr string
+
+	// anonymous lets clients without an API key open constrained tunnels
+	// (nil = disabled)
+	anonymous *AnonymousTier
+
+	// htmlBanner is injected into anonymous tunnels' pages (nil = none)
+	htmlBanner *template.Template
 }
 
 // New creates a new tunnel server.
@@ -56,39 +388,229 @@ func New(controlAddr, httpsAddr, httpAddr, domain, certDir string, apiKeys []str
 	for _, k := range apiKeys {
 		keys[k] = struct{}{}
 	}
-	return &Server{
-		controlAddr: controlAddr,
-		httpsAddr:   httpsAddr,
-		httpAddr:    httpAddr,
-		domain:      domain,
-		certDir:     certDir,
-		clients:     make(map[string]*tunnelClient),
-		apiKeys:     keys,
+	s := &Server{
+		controlAddrs:   splitAddrs(controlAddr),
+		httpsAddrs:     splitAddrs(httpsAddr),
+		httpAddrs:      splitAddrs(httpAddr),
+		domain:         domain,
+		certDir:        certDir,
+		clients:        make(map[string]*tunnelClient),
+		canaries:       make(map[string]*tunnelClient),
+		splits:         make(map[string]int),
+		owners:         make(map[string]*ownership),
+		blocked:        make(map[string]*blockInfo),
+		webhooks:       make(map[string]string),
+		ownerKeys:      newOwnerKeys(),
+		domains:        make(map[string]*customDomain),
+		lookupTXT:      net.DefaultResolver.LookupTXT,
+		disconnectedAt: make(map[string]time.Time),
+		waiters:        make(map[string]*waitList),
+		resumeWindow:   defaultResumeWindow,
+		resumptions:    make(map[string]*resumption),
+		tcpTunnels:     make(map[int]*tunnelClient),
+		takeoverPolicy: TakeoverNever,
+		handoverDrain:  defaultHandoverDrain,
+		keepAlive:      transport.DefaultKeepAlive(),
+		apiKeys:        keys,
+		done:           make(chan struct{}),
+		history:        newTunnelHistory(defaultTunnelHistory),
+		stats:          newTunnelStats(defaultStatsTunnels),
+		replays:        newReplayCache(),
+		challengeKey:   make([]byte, 32),
+		identity:       newIdentitySigner(),
+		jwksClient:     newJWKSClient(),
+		captchas:       make(map[string]*captchaProvider),
+		honeytokens:    newHoneytokenTrips(),
+		introspections: newIntrospectionLimiter(),
+		metrics:        newServerMetrics(),
 	}
+	rand.Read(s.challengeKey)
+	s.handshakeTimeout = DefaultHandshakeTimeout
+	s.watchdog = newStreamWatchdog(s.metrics)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, addr := range s.controlAddrs {
+		s.controlListeners = append(s.controlListeners, &controlListener{addr: addr})
+	}
+	s.metrics.registry.NewGaugeFunc("otun_public_connections", "Public connections currently being proxied.", func() float64 {
+		return float64(s.publicConns.count())
+	})
+	s.metrics.registry.NewGaugeFunc("otun_registration_queue_depth", "Tunnel client connections waiting for a registration worker.", func() float64 {
+		if s.regQueue == nil {
+			return 0
+		}
+		return float64(s.regQueue.len())
+	})
+	s.metrics.registry.NewGaugeFunc("otun_ocsp_staple_age_seconds", "Age of the oldest OCSP staple being served.", func() float64 {
+		return s.stapler.oldestStapleAge()
+	})
+	s.metrics.registry.NewGaugeVecFunc("otun_tunnel_info", "Connected HTTP tunnels, with their labels as label_<key>.", s.tunnelInfoSamples)
+	s.metrics.registry.NewGaugeFunc("otun_tunnel_sessions", "Tunnel client sessions currently connected.", func() float64 {
+		return float64(s.sessions.count())
+	})
+	s.registerSessionMetrics()
+	s.registerPayloadSizeMetrics()
+	s.metrics.registry.NewGaugeFunc("otun_tunnel_streams", "Tunnel streams currently open.", func() float64 {
+		return float64(s.watchdog.count())
+	})
+	return s
+}
+
+// WithMetricsAddr enables the Prometheus metrics endpoint on addr.
+func (s *Server) WithMetricsAddr(addr string) *Server {
+	s.metricsAddr = addr
+	return s
+}
+
+// WithMetricsPush pushes the server's metrics with cfg, for servers
+// Prometheus can't scrape.
+func (s *Server) WithMetricsPush(cfg metrics.PushConfig) *Server {
+	s.metricsPush = &cfg
+	return s
+}
+
+// WithRejectUnknownFields refuses control messages with fields the
+// protocol doesn't define, on top of the size limits every message is
+// held to. Clients newer than the server may send such fields.
+func (s *Server) WithRejectUnknownFields(reject bool) *Server {
+	s.rejectUnknownFields = reject
+	return s
+}
+
+// WithAdmin enables the admin API on addr. Requests authenticate with a
+// bearer token: adminKey grants full access, while client API keys may
+// manage the tunnels they own.
+func (s *Server) WithAdmin(addr, adminKey string) *Server {
+	s.adminAddr = addr
+	s.adminKey = adminKey
+	return s
+}
+
+// WithReconnectQueue holds requests for a tunnel whose client disconnected
+// less than grace ago, for at most grace, instead of failing them right away.
+// At most maxQueued requests wait at once. A grace of zero disables queueing.
+func (s *Server) WithReconnectQueue(grace time.Duration, maxQueued int) *Server {
+	s.reconnectGrace = grace
+	s.maxQueued = maxQueued
+	return s
+}
+
+// WithTakeoverPolicy sets whether a registration may evict the client
+// currently holding the requested subdomain.
+func (s *Server) WithTakeoverPolicy(p TakeoverPolicy) *Server {
+	s.takeoverPolicy = p
+	return s
+}
+
+// WithHTTP3 enables an HTTP/3 (QUIC) listener on the HTTPS address.
+// It has no effect in HTTP-only mode.
+func (s *Server) WithHTTP3(enabled bool) *Server {
+	s.http3 = enabled
+	return s
+}
+
+// Metrics returns the server's metrics registry.
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics.registry
 }
 
 // validateToken checks if the provided token is valid.
 func (s *Server) validateToken(token string) bool {
-	if len(s.apiKeys) == 0 {
+	if !s.authRequired() {
 		return true // no auth required
 	}
-	_, ok := s.apiKeys[token]
-	return ok
+	if _, ok := s.apiKeys[token]; ok {
+		return true
+	}
+	if s.policies.load().hasToken(token) {
+		return true
+	}
+	return s.signup != nil && s.signup.lookup(token) != nil
 }
 
 // Run starts the server and blocks until an error occurs.
 func (s *Server) Run() error {
-	// Start control listener for tunnel clients
-	var err error
-	s.controlListener, err = net.Listen("tcp", s.controlAddr)
+	// Load the policy directory before accepting clients it has keys for
+	if s.policies != nil {
+		if _, err := s.policies.reload(); err != nil {
+			return err
+		}
+		s.policies.logLoaded("policy loaded")
+		go s.policies.watch(s.done)
+	}
+
+	// Start control listeners for tunnel clients
+	lns, err := listenAll(s.controlAddrs, "control")
 	if err != nil {
-		return fmt.Errorf("failed to listen on control port %s: %w", s.controlAddr, err)
+		return err
+	}
+	for i, ln := range lns {
+		s.controlListeners[i].set(ln)
+		defer s.controlListeners[i].close()
+		slog.Info("control listener started", "addr", ln.Addr())
+	}
+	defer close(s.done) // runs first so the accept loops see shutdown, not a failure
+	defer s.cancel()
+	if s.shipper != nil {
+		defer s.shipper.Close()
+	}
+	if s.requestDB != nil {
+		defer s.requestDB.Close()
+	}
+	s.checkFDBudget()
+	go s.watchdog.run(s.done)
+	if s.chaos != nil {
+		go s.chaos.run(s.done, func() { s.killRandomSession() })
+		slog.Warn("chaos testing enabled; faults can be injected through the admin API")
+	}
+
+	if s.metricsAddr != "" {
+		go s.serveMetrics(s.metricsAddr)
+	}
+	if s.metricsPush != nil {
+		pusher, err := metrics.NewPusher(s.metrics.registry, *s.metricsPush)
+		if err != nil {
+			return err
+		}
+		go pusher.Run(s.ctx)
+		slog.Info("pushing metrics", "format", s.metricsPush.Format, "interval", s.metricsPush.Interval)
+	}
+	if s.adminAddr != "" {
+		go s.serveAdmin(s.adminAddr)
+	}
+	if err := s.ownerKeys.load(); err != nil {
+		return err
+	}
+	if err := s.identity.load(); err != nil {
+		return err
+	}
+	if s.signup != nil {
+		if err := s.signup.load(); err != nil {
+			return err
+		}
+		go s.serveSignup(s.signupAddr)
+	}
+
+	// Certificates are needed for HTTPS, and for the control listener if it
+	// serves TLS, before the first client connects
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	var httpHandler http.Handler
+	if s.domain != "" || s.controlTLS {
+		if getCertificate, httpHandler, err = s.certificateSource(); err != nil {
+			return err
+		}
+	}
+	if s.controlTLS {
+		s.controlTLSConfig = newControlTLSConfig(getCertificate)
+		slog.Info("control listeners serve TLS")
 	}
-	defer s.controlListener.Close()
-	slog.Info("control listener started", "addr", s.controlListener.Addr())
 
 	// Start accepting tunnel clients in a goroutine
-	go s.acceptTunnelClients()
+	if s.registrationWorkers > 0 {
+		s.startRegistrationWorkers()
+	}
+	for _, cl := range s.controlListeners {
+		go s.acceptTunnelClients(cl)
+	}
 
 	// If no domain configured, run HTTP-only mode (for local testing)
 	if s.domain == "" {
@@ -96,75 +618,153 @@ func (s *Server) Run() error {
 	}
 
 	// Run with TLS
-	return s.runWithTLS()
+	return s.runWithTLS(getCertificate, httpHandler)
 }
 
 // runHTTPOnly runs the server without TLS (for local testing).
 func (s *Server) runHTTPOnly() error {
-	slog.Info("running in HTTP-only mode (no TLS)", "addr", s.httpAddr)
-
-	server := &http.Server{
-		Addr:    s.httpAddr,
-		Handler: s,
+	slog.Info("running in HTTP-only mode (no TLS)", "addrs", s.httpAddrs)
+	if s.http3 {
+		slog.Warn("HTTP/3 requires TLS, ignoring in HTTP-only mode")
 	}
 
-	return server.ListenAndServe()
+	lns, err := listenAll(s.httpAddrs, "HTTP")
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s, MaxHeaderBytes: s.serverMaxHeaderBytes()}
+	return serveAll(server, lns, server.Serve)
 }
 
-// runWithTLS runs the server with automatic TLS via Let's Encrypt.
-func (s *Server) runWithTLS() error {
+// certificateSource returns where the server's certificates come from:
+// the certificate directory if one is set, or Let's Encrypt through
+// autocert, along with the handler of the HTTP listener, which answers
+// ACME challenges for the latter.
+func (s *Server) certificateSource() (getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), httpHandler http.Handler, err error) {
+	// A mounted certificate (e.g. from cert-manager) replaces ACME
+	if s.certs != nil {
+		if _, err := s.certs.reload(); err != nil {
+			return nil, nil, err
+		}
+		s.certs.logLoaded("TLS certificate loaded")
+		go s.certs.watch(s.done)
+		return s.certs.GetCertificate, http.HandlerFunc(s.redirectToHTTPS), nil
+	}
+	if s.domain == "" {
+		return nil, nil, errors.New("certificates need a domain or a certificate directory")
+	}
+
 	// Setup autocert manager
 	manager := &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		Cache:      autocert.DirCache(s.certDir),
 		HostPolicy: s.hostPolicy,
 	}
+	return manager.GetCertificate, manager.HTTPHandler(http.HandlerFunc(s.redirectToHTTPS)), nil
+}
+
+// runWithTLS runs the server with TLS, using the certificates getCertificate
+// returns and serving httpHandler on the HTTP listener.
+func (s *Server) runWithTLS(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), httpHandler http.Handler) error {
+	// Refuse probes for hosts without a tunnel before touching certificates
+	getCertificate = s.rejectUnknownHosts(getCertificate)
+
+	if s.stapler != nil {
+		s.stapler.getCertificate = getCertificate
+		go s.stapler.refresh(s.done)
+		getCertificate = s.stapler.GetCertificate
+	}
+
+	if err := s.tickets.start(s.done); err != nil {
+		return err
+	}
 
 	// HTTPS server (HTTP/1.1 only - HTTP/2 doesn't support connection hijacking
 	// which we need for bidirectional proxying and WebSocket support)
 	httpsServer := &http.Server{
-		Addr:    s.httpsAddr,
-		Handler: s,
-		TLSConfig: &tls.Config{
-			GetCertificate: manager.GetCertificate,
+		Handler:        s,
+		MaxHeaderBytes: s.serverMaxHeaderBytes(),
+		TLSConfig: s.configureTLS(&tls.Config{
+			GetCertificate: getCertificate,
 			NextProtos:     []string{"http/1.1"},
-		},
+		}),
 	}
 
 	// HTTP server for ACME challenges and redirect
 	httpServer := &http.Server{
-		Addr:    s.httpAddr,
-		Handler: manager.HTTPHandler(http.HandlerFunc(s.redirectToHTTPS)),
+		Handler: httpHandler,
+	}
+
+	httpLns, err := listenAll(s.httpAddrs, "HTTP")
+	if err != nil {
+		return err
+	}
+	httpsLns, err := listenAll(s.httpsAddrs, "HTTPS")
+	if err != nil {
+		httpServer.Close()
+		for _, ln := range httpLns {
+			ln.Close()
+		}
+		return err
+	}
+	defer httpServer.Close()
+
+	// Start HTTP servers in background
+	for _, ln := range httpLns {
+		go func() {
+			slog.Info("HTTP server started (ACME challenges + redirect)", "addr", ln.Addr())
+			if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP server error", "addr", ln.Addr(), "error", err)
+			}
+		}()
 	}
 
-	// Start HTTP server in background
-	go func() {
-		slog.Info("HTTP server started (ACME challenges + redirect)", "addr", s.httpAddr)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			slog.Error("HTTP server error", "error", err)
+	// Start HTTP/3 server alongside HTTPS
+	if s.http3 {
+		if err := s.startHTTP3(getCertificate); err != nil {
+			return err
 		}
-	}()
+	}
+
+	// Route by SNI first so passthrough tunnels bypass termination
+	if s.passthroughEnabled() {
+		for i, ln := range httpsLns {
+			httpsLns[i] = s.newSNIListener(ln)
+		}
+	}
 
-	// Start HTTPS server
-	slog.Info("HTTPS server started", "addr", s.httpsAddr, "domain", "*."+s.domain)
-	return httpsServer.ListenAndServeTLS("", "")
+	// Start HTTPS servers; if one stops, they all do
+	for _, ln := range httpsLns {
+		slog.Info("HTTPS server started", "addr", ln.Addr(), "domain", "*."+s.domain)
+	}
+	return serveAll(httpsServer, httpsLns, func(ln net.Listener) error {
+		return httpsServer.ServeTLS(ln, "", "")
+	})
 }
 
 // hostPolicy determines which domains we'll accept for TLS certificates.
-// Only issues certs for subdomains that have active tunnels.
+// Only issues certs for subdomains that have active tunnels, and for the
+// domain itself if the control listeners serve TLS.
 func (s *Server) hostPolicy(ctx context.Context, host string) error {
-	subdomain := extractSubdomain(host)
+	if s.controlTLS && strings.EqualFold(host, s.domain) {
+		return nil // the control listener's certificate
+	}
+	subdomain := s.subdomainForHost(host)
 	if subdomain == "" {
 		return fmt.Errorf("invalid host: %s", host)
 	}
 
 	s.mu.RLock()
-	_, exists := s.clients[subdomain]
+	client, exists := s.clients[subdomain]
 	s.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("no tunnel registered for subdomain: %s", subdomain)
 	}
+	if client.passthrough {
+		// The client holds the certificate for a passthrough tunnel
+		return fmt.Errorf("tunnel terminates its own TLS: %s", subdomain)
+	}
 
 	slog.Info("allowing certificate for", "host", host, "subdomain", subdomain)
 	return nil
@@ -179,96 +779,423 @@ func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
 // ServeHTTP implements http.Handler to route incoming HTTP requests to tunnels.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	host := r.Host
-	subdomain := extractSubdomain(host)
+	subdomain := s.subdomainForHost(host)
+	trace := s.newRequestTrace(r)
+
+	var upstreamStatus *statusConn
+	var limiter *durationLimitedConn
+	var traffic *countingConn // set once the request reaches a tunnel
+	if s.recordsEachRequest() {
+		rec := &statusRecorder{ResponseWriter: w}
+		w = rec
+		start := time.Now()
+		defer func() {
+			status := rec.status
+			if upstreamStatus != nil {
+				status = upstreamStatus.status
+			}
+			if limiter != nil && limiter.expiredBeforeResponse() {
+				status = http.StatusGatewayTimeout
+			}
+			if s.shipper != nil {
+				s.logAccess(r, subdomain, status, start)
+			}
+			s.captureRequest(r, subdomain, status, start)
+			if traffic != nil {
+				s.stats.record(subdomain, start, status, traffic.written.Load(), traffic.read.Load())
+			}
+		}()
+	}
 
 	if subdomain == "" {
 		slog.Warn("no subdomain in request", "host", host)
-		http.Error(w, "No subdomain specified", http.StatusBadRequest)
+		s.httpError(w, r, "No subdomain specified", http.StatusBadRequest)
 		return
 	}
 
-	s.mu.RLock()
-	client := s.clients[subdomain]
-	s.mu.RUnlock()
+	if s.isBlocked(subdomain) != nil {
+		serveTakedown(w)
+		return
+	}
+
+	if !s.checkHeaders(w, r, subdomain) {
+		return
+	}
+
+	client := s.lookupClient(subdomain)
+	if client == nil {
+		// Give a reconnecting client a chance to come back
+		var err error
+		client, err = s.waitForClient(r.Context(), subdomain)
+		if errors.Is(err, errQueueFull) {
+			slog.Warn("reconnect queue full", "subdomain", subdomain)
+			s.httpError(w, r, "Tunnel is reconnecting, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	if client == nil {
 		slog.Warn("no tunnel found for subdomain", "subdomain", subdomain, "host", host)
-		http.Error(w, fmt.Sprintf("No tunnel found for subdomain: %s", subdomain), http.StatusNotFound)
+		s.httpError(w, r, fmt.Sprintf("No tunnel found for subdomain: %s", subdomain), http.StatusNotFound)
+		return
+	}
+
+	client = s.splitTraffic(subdomain, client)
+
+	if client.passthrough {
+		// Only reachable without SNI routing, e.g. over HTTP/3
+		s.httpError(w, r, "Tunnel only accepts TLS connections", http.StatusMisdirectedRequest)
+		return
+	}
+
+	if !s.checkHoneytokens(w, r, client) || !s.checkAccess(w, r, client) || !s.checkGeo(w, r, client) {
+		return
+	}
+	doneVisiting, ok := s.checkVisitor(w, r, client)
+	if !ok {
+		return
+	}
+	defer doneVisiting()
+	if !s.checkChallenge(w, r, client) || !s.checkJWT(w, r, client) || !s.checkSignature(w, r, client) {
+		return
+	}
+
+	settle, ok := s.checkReplay(w, r, client)
+	if !ok {
+		return
+	}
+	if settle != nil {
+		rec := &statusRecorder{ResponseWriter: w, onStatus: settle}
+		w = rec
+		defer func() {
+			// Report a failure if the response never got a status
+			status := rec.status
+			if upstreamStatus != nil {
+				status = upstreamStatus.status
+			}
+			settle(status)
+		}()
+	}
+
+	if s.edgeCache.serveNotModified(w, r, client) {
 		return
 	}
 
+	release, ok := s.scanBody(w, r, subdomain)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err := s.acquireConn(client); err != nil {
+		slog.Warn("connection limit reached", "subdomain", subdomain, "error", err)
+		w.Header().Set("Retry-After", "1")
+		s.httpError(w, r, "Server is busy, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.releaseConn(client)
+
+	setCookie := client.ab.apply(r)
+	tagTokenID(r, client)
+
 	// Open a new stream to the tunnel client
 	stream, err := client.session.OpenStream()
 	if err != nil {
 		slog.Error("failed to open stream", "error", err)
-		http.Error(w, "Failed to connect to tunnel", http.StatusBadGateway)
+		s.httpError(w, r, "Failed to connect to tunnel", http.StatusBadGateway)
 		return
 	}
 	defer stream.Close()
+	defer trace.log(s, r, subdomain)
+	traffic = &countingConn{Conn: client.bandwidth.limit(trace.traceStream(stream, client))}
+	if !isUpgrade(r) {
+		defer client.sizes.observe(traffic)
+	}
 
 	slog.Info("routing to tunnel", "subdomain", subdomain, "method", r.Method, "path", r.URL.Path)
 
-	// Hijack the connection to get raw TCP access
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		slog.Error("response writer does not support hijacking")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// Hijack the connection to get raw TCP access. Transports that can't be
+	// hijacked (HTTP/3) get a single request/response round trip instead.
+	limited := s.maxRequestDuration > 0
+	clientConn, buf, err := http.NewResponseController(w).Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		var upstream net.Conn = traffic
+		if limited {
+			limiter = s.limitDuration(traffic, nil, subdomain)
+			defer limiter.stop()
+			upstream = limiter
+		}
+		upstream = s.injectBanner(s.filterResponses(upstream, client, r.Method), client, r.Method)
+		if store := s.edgeCache.observer(r, client); store != nil {
+			upstream = &headConn{Conn: upstream, onHead: store}
+		}
+		if setCookie != "" {
+			w.Header().Add("Set-Cookie", setCookie)
+		}
+		if banner := s.anonymousBanner(client); banner != "" {
+			w.Header().Set(AnonymousHeader, banner)
+		}
+		s.proxyRoundTrip(w, r, upstream)
 		return
 	}
-
-	clientConn, buf, err := hijacker.Hijack()
 	if err != nil {
 		slog.Error("failed to hijack connection", "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		s.httpError(w, r, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
 
-	// Write the original request to the tunnel stream
-	if err := r.Write(stream); err != nil {
+	var upstream net.Conn = traffic
+	if limited {
+		limiter = s.limitDuration(traffic, clientConn, subdomain)
+		defer limiter.stop()
+		upstream = limiter
+	}
+	upstream = s.injectBanner(s.filterResponses(upstream, client, r.Method), client, r.Method)
+
+	// The rest of the connection is proxied raw, so when the tunnel checks
+	// or records each request, close it after this one: the local service
+	// and the visitor are both told to, and requests the visitor pipelined
+	// behind it are dropped rather than slipped past the checks. An upgrade can't
+	// be closed, so the visitor's bytes are held back until the local
+	// service has switched protocols instead.
+	upgrade := isUpgrade(r)
+	closeAfter := (s.checksEachRequest(client) || s.recordsEachRequest()) && !upgrade
+	if closeAfter {
+		r.Close = true
+		r.Header.Set("Connection", "close")
+	}
+	var gate *upgradeConn
+	if upgrade && s.checksEachRequest(client) {
+		gate = newUpgradeConn(upstream)
+		upstream = gate
+	}
+
+	// Write the original request to the tunnel stream. A body sent only
+	// after 100 Continue is left to be proxied raw with the rest of the
+	// connection, so the local service can answer the Expect itself.
+	requestConn := upstream
+	if gate != nil {
+		requestConn = gate.Conn
+	}
+	if expectsContinue(r) {
+		err = writeRequestHead(requestConn, r)
+	} else {
+		err = r.Write(requestConn)
+	}
+	if err != nil {
 		slog.Error("failed to write request to tunnel", "error", err)
 		return
 	}
 
 	// Check if there's buffered data from the hijack
-	if buf.Reader.Buffered() > 0 {
+	if buf.Reader.Buffered() > 0 && (!closeAfter || expectsContinue(r)) {
 		buffered := make([]byte, buf.Reader.Buffered())
 		buf.Read(buffered)
-		stream.Write(buffered)
+		if gate != nil {
+			gate.hold(buffered)
+		} else {
+			upstream.Write(buffered)
+		}
+	}
+
+	if store := s.edgeCache.observer(r, client); store != nil {
+		upstream = &headConn{Conn: upstream, onHead: store}
+	}
+
+	if s.recordsEachRequest() || settle != nil || upgrade {
+		// Settle a delivery as soon as its status is read, so a redelivery
+		// sent the moment the provider sees the response is recognised, and
+		// exempt an upgrade from the limits once it has switched protocols
+		upstreamStatus = &statusConn{Conn: upstream, onStatus: func(status int) {
+			if settle != nil {
+				settle(status)
+			}
+			if gate != nil {
+				gate.decide(status)
+			}
+			if limiter != nil && status == http.StatusSwitchingProtocols {
+				limiter.stop()
+			}
+		}}
+		upstream = upstreamStatus
+	}
+	// Remember a new A/B bucket, and advertise HTTP/3 on the first
+	// response of TLS connections
+	var inject []string
+	if setCookie != "" {
+		inject = append(inject, "Set-Cookie: "+setCookie)
+	}
+	if s.altSvc != "" && r.TLS != nil {
+		inject = append(inject, "Alt-Svc: "+s.altSvc)
+	}
+	if banner := s.anonymousBanner(client); banner != "" {
+		inject = append(inject, AnonymousHeader+": "+banner)
+	}
+	if closeAfter {
+		inject = append(inject, "Connection: close")
+	}
+	if len(inject) > 0 {
+		upstream = newInjectConn(upstream, strings.Join(inject, "\r\n"))
 	}
 
-	// Proxy bidirectionally
-	if err := proxy.Bidirectional(clientConn, stream); err != nil {
+	// Proxy bidirectionally until done, or the visitor's request or the
+	// server is cancelled
+	ctx, cancel := s.proxyContext(r.Context())
+	defer cancel()
+	if err := proxy.BidirectionalContext(ctx, clientConn, upstream); err != nil {
 		slog.Debug("proxy completed", "error", err)
 	} else {
 		slog.Debug("proxy completed", "subdomain", subdomain)
 	}
 }
 
-// acceptTunnelClients accepts tunnel client connections and creates yamux sessions.
-func (s *Server) acceptTunnelClients() {
+// proxyContext returns a context for proxying a connection that is cancelled
+// along with parent or when the server stops running.
+func (s *Server) proxyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := context.AfterFunc(s.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// WithKeepAlive sets the TCP keepalive and user timeout of control
+// connections, so clients that vanish without closing the connection are
+// dropped within seconds instead of at the heartbeat timeout.
+func (s *Server) WithKeepAlive(k transport.KeepAlive) *Server {
+	s.keepAlive = k
+	return s
+}
+
+// acceptTunnelClients accepts tunnel client connections and creates multiplexed sessions.
+// Failed Accept calls are retried with exponential backoff, and the listener is
+// re-created if it keeps failing or is closed while the server is still running.
+func (s *Server) acceptTunnelClients(cl *controlListener) {
+	var delay time.Duration
+	failures := 0
+
 	for {
-		conn, err := s.controlListener.Accept()
+		conn, err := cl.get().Accept()
 		if err != nil {
-			slog.Error("failed to accept tunnel client", "error", err)
+			if s.isDone() {
+				return
+			}
+
+			s.metrics.acceptErrors.Inc()
+			failures++
+
+			fdExhausted := isFDExhausted(err)
+			if fdExhausted {
+				s.metrics.acceptFDExhausted.Inc()
+			}
+
+			if delay == 0 {
+				delay = acceptBackoffMin
+			} else {
+				delay = min(delay*2, acceptBackoffMax)
+			}
+
+			slog.Error("failed to accept tunnel client",
+				"error", err,
+				"consecutive_failures", failures,
+				"retry_in", delay,
+			)
+
+			select {
+			case <-s.done:
+				return
+			case <-time.After(delay):
+			}
+
+			// Re-creating the listener won't help when we're out of descriptors
+			if !fdExhausted && (errors.Is(err, net.ErrClosed) || failures >= acceptRecreateThreshold) {
+				if err := s.recreateControlListener(cl); err != nil {
+					slog.Error("failed to re-create control listener", "error", err)
+				} else {
+					failures = 0
+				}
+			}
 			continue
 		}
 
+		delay = 0
+		failures = 0
+
 		slog.Info("tunnel client connected", "remote_addr", conn.RemoteAddr())
+		if err := s.keepAlive.Apply(conn); err != nil {
+			slog.Warn("failed to tune control connection", "remote_addr", conn.RemoteAddr(), "error", err)
+		}
 
-		go s.handleTunnelClient(conn)
+		if s.controlTLSConfig != nil {
+			// The handshake runs on the first read, within the handshake timeout
+			conn = tls.Server(conn, s.controlTLSConfig)
+		}
+
+		if s.registrationWorkers > 0 {
+			s.enqueueTunnelClient(conn)
+		} else {
+			go s.handleTunnelClient(conn, func() {})
+		}
+	}
+}
+
+// recreateControlListener closes cl's listener and opens a new one.
+func (s *Server) recreateControlListener(cl *controlListener) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.ln != nil {
+		cl.ln.Close()
+	}
+
+	ln, err := listenTCP(cl.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control port %s: %w", cl.addr, err)
+	}
+	cl.ln = ln
+	s.metrics.listenerRecreated.Inc()
+
+	slog.Warn("control listener re-created", "addr", ln.Addr())
+	return nil
+}
+
+// isDone reports whether Run has returned.
+func (s *Server) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
 	}
 }
 
-// handleTunnelClient handles a new tunnel client connection.
-func (s *Server) handleTunnelClient(conn net.Conn) {
-	// Create yamux session (server side)
-	session, err := yamux.Server(conn, nil)
+// isFDExhausted reports whether err was caused by running out of file descriptors.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// handleTunnelClient handles a new tunnel client connection. It calls
+// registered once the handshake is over and the session is being served.
+func (s *Server) handleTunnelClient(conn net.Conn, registered func()) {
+	stopDeadline := s.handshakeDeadline(conn, "registration", "remote_addr", conn.RemoteAddr())
+	defer stopDeadline()
+
+	// Negotiate the muxer and create the session (server side)
+	muxer, conn, err := transport.ReadPreface(conn)
+	if err != nil {
+		slog.Error("failed to negotiate muxer", "remote_addr", conn.RemoteAddr(), "error", err)
+		conn.Close()
+		return
+	}
+	session, err := muxer.Server(conn)
 	if err != nil {
-		slog.Error("failed to create yamux session", "error", err)
+		slog.Error("failed to create session", "muxer", muxer.Name(), "error", err)
 		conn.Close()
 		return
 	}
+	session = newHealthSession(session, s.watchdog, s.chaos)
 
 	// Accept Stream 0 (control stream) from the client
 	stream, err := session.AcceptStream()
@@ -280,10 +1207,29 @@ func (s *Server) handleTunnelClient(conn net.Conn) {
 
 	slog.Info("control stream accepted", "stream_id", stream.StreamID())
 
-	controlStream := protocol.NewControlStream(stream)
+	controlStream := s.newControlStream(stream)
+
+	// Turn the client away if the server already holds its maximum number
+	// of sessions; the slot is held until the session ends
+	if !s.sessions.acquire(s.maxSessions) {
+		s.metrics.sessionsRejected.Inc()
+		slog.Warn("session limit reached", "remote_addr", conn.RemoteAddr(), "max_sessions", s.maxSessions)
+		controlStream.SendRetryAfter(protocol.ErrCodeServerFull, "server is at capacity, try again later", sessionRetryAfter)
+		session.Close()
+		return
+	}
+	defer s.sessions.release()
 
 	// Read register message
 	msg, err := controlStream.ReadMessage()
+	stopDeadline()
+	if errors.Is(err, protocol.ErrInvalidMessage) {
+		s.metrics.invalidMessages.Inc()
+		slog.Warn("invalid register message", "remote_addr", conn.RemoteAddr(), "error", err)
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidMessage, err.Error())
+		session.Close()
+		return
+	}
 	if err != nil {
 		slog.Error("failed to read register message", "error", err)
 		controlStream.SendError("failed to read register message")
@@ -291,87 +1237,488 @@ func (s *Server) handleTunnelClient(conn net.Conn) {
 		return
 	}
 
-	registerMsg, ok := msg.(*protocol.RegisterMessage)
-	if !ok {
+	switch m := msg.(type) {
+	case *protocol.RegisterMessage:
+		if m.TunnelID == "" {
+			s.registerTunnel(conn, session, controlStream, m, registered)
+			return
+		}
+		// The client may register more tunnels over this session, each on
+		// a control stream of its own
+		tunnels := newSessionTunnels(conn, session)
+		if !tunnels.serve(s, stream, controlStream, m, registered) {
+			session.Close()
+			return
+		}
+		s.acceptTunnels(tunnels)
+		return
+	case *protocol.ForwardMessage:
+		s.handleForward(conn.RemoteAddr(), session, controlStream, m, registered)
+		return
+	case *protocol.SpeedTestMessage:
+		s.handleSpeedTest(conn.RemoteAddr(), session, controlStream, m, registered)
+		return
+	case *protocol.RelayMessage:
+		s.handleRelay(conn.RemoteAddr(), session, controlStream, m, registered)
+		return
+	default:
 		slog.Error("expected register message", "got", fmt.Sprintf("%T", msg))
 		controlStream.SendError("expected register message")
 		session.Close()
 		return
 	}
+}
+
+// newControlStream wraps stream as a control stream with the server's
+// message limits.
+func (s *Server) newControlStream(stream transport.Stream) *protocol.ControlStream {
+	limits := protocol.DefaultLimits
+	limits.DisallowUnknownFields = s.rejectUnknownFields
+	return protocol.NewControlStream(stream).WithLimits(limits)
+}
+
+// registerTunnel registers the tunnel msg asks for and serves its control
+// stream until the tunnel ends. It calls registered once the tunnel is
+// registered. session carries the tunnel's streams.
+func (s *Server) registerTunnel(conn net.Conn, session transport.Session, controlStream *protocol.ControlStream, registerMsg *protocol.RegisterMessage, registered func()) {
+	var err error
+	s.chaos.delayRegistration()
+
+	// A valid resume token stands in for the ownership lookups; its API
+	// key is checked again as it is taken
+	s.mu.Lock()
+	resumed := s.takeResumption(registerMsg)
+	s.mu.Unlock()
 
-	// Validate API key if authentication is enabled
-	if !s.validateToken(registerMsg.Token) {
+	// Validate API key if authentication is enabled; clients without one
+	// may fall into the anonymous tier
+	anonymous := resumed == nil && s.isAnonymous(registerMsg)
+	if resumed == nil && !anonymous && !s.validateToken(registerMsg.Token) {
 		slog.Warn("invalid API key", "remote_addr", conn.RemoteAddr())
-		controlStream.SendError("invalid or missing API key")
+		controlStream.SendErrorCode(protocol.ErrCodeUnauthorized, "invalid or missing API key")
+		session.Close()
+		return
+	}
+	if anonymous {
+		if err := checkAnonymous(registerMsg); err != nil {
+			slog.Warn("anonymous registration refused", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeAnonymousRestricted, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if err := protocol.ValidateLabels(registerMsg.Labels); err != nil {
+		slog.Warn("invalid tunnel labels", "remote_addr", conn.RemoteAddr(), "error", err)
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidLabels, err.Error())
+		session.Close()
+		return
+	}
+
+	err = protocol.ValidateAccess(registerMsg)
+	if err == nil && registerMsg.ClientCA != "" && s.domain == "" {
+		err = errors.New("client certificates need a server with TLS")
+	}
+	if err != nil {
+		slog.Warn("invalid private tunnel settings", "remote_addr", conn.RemoteAddr(), "error", err)
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidAccess, err.Error())
+		session.Close()
+		return
+	}
+
+	if sig := registerMsg.WebhookSignature; sig != nil {
+		err := sig.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("webhook signatures only apply to HTTP tunnels")
+		}
+		if err != nil {
+			slog.Warn("invalid webhook signature policy", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidSignature, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if policy := registerMsg.JWT; policy != nil {
+		err := policy.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("JWT validation only applies to HTTP tunnels")
+		}
+		if err == nil {
+			err = s.checkJWKSURL(policy.JWKSURL)
+		}
+		if err == nil {
+			// Fail now, rather than on every request, if the keys can't be read
+			_, err = fetchJWKS(s.ctx, s.jwksClient, policy.JWKSURL)
+		}
+		if err != nil {
+			slog.Warn("invalid JWT policy", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidJWTPolicy, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if replay := registerMsg.ReplayProtection; replay != nil {
+		err := replay.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("replay protection only applies to HTTP tunnels")
+		}
+		if err != nil {
+			slog.Warn("invalid replay protection policy", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidReplay, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if ab := registerMsg.ABTest; ab != nil {
+		err := ab.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("A/B tests only apply to HTTP tunnels")
+		}
+		if err != nil {
+			slog.Warn("invalid A/B test", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidABTest, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if geo := registerMsg.GeoPolicy; geo != nil {
+		err := geo.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("geo policies only apply to HTTP tunnels")
+		}
+		if err == nil && s.geoip == nil {
+			err = errors.New("this server has no GeoIP database to enforce geo policies with")
+		}
+		if err != nil {
+			slog.Warn("invalid geo policy", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidGeoPolicy, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if challenge := registerMsg.Challenge; challenge != nil {
+		err := challenge.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("challenges only apply to HTTP tunnels")
+		}
+		if err == nil && challenge.Mode != "" && challenge.Mode != protocol.ChallengeJS && s.captchas[challenge.Mode] == nil {
+			err = fmt.Errorf("this server has no %s keys configured", challenge.Mode)
+		}
+		if err != nil {
+			slog.Warn("invalid challenge", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidChallenge, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if traps := registerMsg.Honeytokens; traps != nil {
+		err := traps.Validate()
+		if err == nil && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+			err = errors.New("honeytokens only apply to HTTP tunnels")
+		}
+		if err != nil {
+			slog.Warn("invalid honeytokens", "remote_addr", conn.RemoteAddr(), "error", err)
+			controlStream.SendErrorCode(protocol.ErrCodeInvalidHoneytoken, err.Error())
+			session.Close()
+			return
+		}
+	}
+
+	if err := protocol.ValidateStripHeaders(registerMsg.StripHeaders); err != nil {
+		slog.Warn("invalid response header rules", "remote_addr", conn.RemoteAddr(), "error", err)
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidHeaders, err.Error())
+		session.Close()
+		return
+	}
+
+	if registerMsg.OwnerKey != "" && registerMsg.Protocol == protocol.ProtocolTCP {
+		slog.Warn("owner key for a TCP tunnel", "remote_addr", conn.RemoteAddr())
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidOwnerKey, "owner keys only apply to HTTP and TLS tunnels")
+		session.Close()
+		return
+	}
+
+	if registerMsg.Canary && registerMsg.Protocol != "" && registerMsg.Protocol != protocol.ProtocolHTTP {
+		slog.Warn("canary for a non-HTTP tunnel", "remote_addr", conn.RemoteAddr())
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidCanary, "canaries only apply to HTTP tunnels")
+		session.Close()
+		return
+	}
+
+	if registerMsg.Protocol == protocol.ProtocolTCP {
+		s.handleTCPRegister(conn, session, controlStream, registerMsg, resumed, registered)
+		return
+	}
+
+	passthrough := registerMsg.Protocol == protocol.ProtocolTLS
+	if passthrough && !s.passthroughEnabled() {
+		slog.Warn("TLS passthrough tunnel refused", "remote_addr", conn.RemoteAddr(), "token_id", tokenID(registerMsg.Token))
+		controlStream.SendErrorCode(protocol.ErrCodeTLSPassthroughDisabled, "TLS passthrough tunnels are not enabled on this server")
 		session.Close()
 		return
 	}
 
 	// Generate subdomain if not provided
 	subdomain := registerMsg.Subdomain
-	if subdomain == "" {
-		subdomain = generateSubdomain()
+	if resumed != nil {
+		subdomain = resumed.subdomain
+	} else if subdomain == "" && !registerMsg.Canary {
+		subdomain = s.subdomainPrefix(registerMsg.Token) + generateSubdomain()
+	}
+
+	// Canaries share their subdomain's traffic, so are held to its group
+	if err := s.groupFor(registerMsg.Token, subdomain).check(registerMsg); err != nil {
+		slog.Warn("tunnel refused by its group", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token), "error", err)
+		s.rejectRegistration(subdomain, conn, registerMsg.Token, err.Error())
+		controlStream.SendErrorCode(protocol.ErrCodeGroupPolicy, err.Error())
+		session.Close()
+		return
+	}
+
+	if registerMsg.Canary {
+		s.handleCanaryRegister(conn, session, controlStream, registerMsg, registered)
+		return
+	}
+
+	// A subdomain bound to an owner key, or being bound to one, needs proof
+	// the client holds the key; a resumed tunnel proved it when it first
+	// registered
+	var ownerKey ed25519.PublicKey
+	if resumed == nil {
+		var code string
+		ownerKey, code, err = s.proveOwnership(controlStream, subdomain, registerMsg.OwnerKey)
+		if err != nil {
+			if code != "" {
+				slog.Warn("proof of subdomain ownership failed", "subdomain", subdomain, "remote_addr", conn.RemoteAddr(), "error", err)
+				s.rejectRegistration(subdomain, conn, registerMsg.Token, err.Error())
+				controlStream.SendErrorCode(code, err.Error())
+			}
+			session.Close()
+			return
+		}
 	}
 
 	// Check if subdomain is already in use
 	s.mu.Lock()
-	if _, exists := s.clients[subdomain]; exists {
+	if s.blocked[subdomain] != nil {
+		s.mu.Unlock()
+		slog.Warn("registration for blocked subdomain", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token))
+		s.rejectRegistration(subdomain, conn, registerMsg.Token, "subdomain is blocked")
+		controlStream.SendErrorCode(protocol.ErrCodeTunnelBlocked, fmt.Sprintf("subdomain '%s' has been blocked by the server operator", subdomain))
+		session.Close()
+		return
+	}
+	if resumed == nil && s.heldForResume(subdomain, registerMsg.Token) {
+		s.mu.Unlock()
+		slog.Warn("subdomain held for its reconnecting client", "subdomain", subdomain)
+		s.rejectRegistration(subdomain, conn, registerMsg.Token, "subdomain is reconnecting")
+		controlStream.SendErrorCode(protocol.ErrCodeSubdomainTaken, fmt.Sprintf("subdomain '%s' is in use", subdomain))
+		session.Close()
+		return
+	}
+	// A resumed client may replace its own session, which the server may
+	// not have noticed is dead yet
+	existing, exists := s.clients[subdomain]
+	ownSession := exists && resumed != nil && existing.resumeToken == resumed.token
+	handover := exists && canHandOver(existing, registerMsg)
+	if exists && registerMsg.HandoverToken != "" && !handover {
+		s.mu.Unlock()
+		slog.Warn("handover token doesn't match the tunnel's client", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token))
+		s.rejectRegistration(subdomain, conn, registerMsg.Token, "invalid handover token")
+		controlStream.SendErrorCode(protocol.ErrCodeInvalidHandover, fmt.Sprintf("the handover token doesn't belong to the client serving '%s'", subdomain))
+		session.Close()
+		return
+	}
+	if exists && !ownSession && !handover && !s.canTakeOver(existing, registerMsg.Token) {
 		s.mu.Unlock()
 		slog.Warn("subdomain already in use", "subdomain", subdomain)
-		controlStream.SendError(fmt.Sprintf("subdomain '%s' is already in use", subdomain))
+		s.rejectRegistration(subdomain, conn, registerMsg.Token, "subdomain is already in use")
+		controlStream.SendErrorCode(protocol.ErrCodeSubdomainTaken, fmt.Sprintf("subdomain '%s' is already in use", subdomain))
+		session.Close()
+		return
+	}
+
+	// Check the token may publish this subdomain; a resumed tunnel was
+	// checked when it first registered, and an anonymous one's random
+	// subdomain isn't reserved for anyone
+	if resumed == nil && !anonymous {
+		err = s.claimSubdomain(subdomain, registerMsg.Token)
+	}
+	if err == nil && ownerKey != nil && !s.ownerKeys.bind(subdomain, ownerKey) {
+		err = fmt.Errorf("subdomain '%s' is bound to a different owner key", subdomain)
+	}
+	if err != nil {
+		s.mu.Unlock()
+		slog.Warn("subdomain reserved", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token))
+		s.rejectRegistration(subdomain, conn, registerMsg.Token, err.Error())
+		controlStream.SendErrorCode(protocol.ErrCodeSubdomainReserved, err.Error())
 		session.Close()
 		return
 	}
 
 	// Register the client
-	client := &tunnelClient{
-		subdomain:     subdomain,
-		session:       session,
-		controlStream: controlStream,
-		lastHeartbeat: time.Now(),
+	client := s.newTunnelClient(subdomain, conn, session, controlStream, registerMsg)
+	client.passthrough = passthrough
+	if passthrough {
+		client.sizes = nil // its requests never pass through ServeHTTP
+		client.timing = false
+	}
+	if anonymous {
+		client.anonymous = true
+		client.bandwidth = newBandwidthLimiter(s.anonymous.BytesPerSecond)
+		client.htmlBanner = s.renderBanner(client)
 	}
+	s.applyGroup(client)
+	client.handoverToken = newHandoverToken()
 	s.clients[subdomain] = client
+	s.notifyRegistered(subdomain)
+	if exists {
+		existing.closeReason = "taken over by " + client.remoteAddr
+		if handover {
+			existing.closeReason = "handed over to " + client.remoteAddr
+		}
+		s.dropResumption(existing)
+	}
+	// Anonymous tunnels can't be resumed, which would restart their lifetime
+	var resumeToken string
+	if !anonymous {
+		resumeToken = s.issueResumption(client, registerMsg.Protocol)
+	}
 	s.mu.Unlock()
+	if resumed != nil {
+		resumeSession(session, resumed)
+		slog.Info("tunnel resumed", "subdomain", subdomain, "remote_addr", conn.RemoteAddr())
+	}
 
-	slog.Info("tunnel registered", "subdomain", subdomain, "remote_addr", conn.RemoteAddr())
-
-	// Build the URL for the client
-	var url string
-	if s.domain != "" {
-		url = fmt.Sprintf("https://%s.%s", subdomain, s.domain)
-	} else {
-		url = fmt.Sprintf("http://%s.localhost%s", subdomain, s.httpAddr)
+	if handover {
+		slog.Info("tunnel handed over", "subdomain", subdomain,
+			"old_remote_addr", existing.remoteAddr,
+			"new_remote_addr", conn.RemoteAddr(),
+		)
+		s.audit("tunnel handed over", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token),
+			"old_remote_addr", existing.remoteAddr, "new_remote_addr", client.remoteAddr)
+		s.history.record(subdomain, tunnelEvent{Type: eventHandedOver, RemoteAddr: existing.remoteAddr, TokenID: tokenID(existing.token),
+			Reason: "handed over to " + client.remoteAddr})
+		go s.drainHandedOver(existing)
+	} else if exists {
+		slog.Warn("tunnel taken over", "subdomain", subdomain,
+			"old_remote_addr", existing.remoteAddr,
+			"new_remote_addr", conn.RemoteAddr(),
+		)
+		s.audit("tunnel taken over", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token),
+			"old_remote_addr", existing.remoteAddr, "new_remote_addr", client.remoteAddr)
+		s.history.record(subdomain, tunnelEvent{Type: eventTakenOver, RemoteAddr: existing.remoteAddr, TokenID: tokenID(existing.token),
+			Reason: "taken over by " + client.remoteAddr})
+		existing.controlStream.SendError("tunnel taken over by another client")
+		existing.session.Close()
 	}
 
-	if err := controlStream.SendRegistered(url, subdomain); err != nil {
+	slog.Info("tunnel registered", "subdomain", subdomain, "remote_addr", conn.RemoteAddr(), "anonymous", anonymous)
+	s.history.record(subdomain, tunnelEvent{Type: eventConnected, RemoteAddr: client.remoteAddr, TokenID: tokenID(client.token)})
+	s.audit("tunnel registered", "subdomain", subdomain, "token_id", tokenID(registerMsg.Token), "remote_addr", client.remoteAddr)
+
+	registeredMsg := &protocol.RegisteredMessage{
+		URL:           s.tunnelURL(subdomain),
+		Subdomain:     subdomain,
+		ResumeToken:   resumeToken,
+		HandoverToken: client.handoverToken,
+		Timing:        client.timing,
+		TunnelID:      registerMsg.TunnelID,
+	}
+	if anonymous {
+		registeredMsg.Anonymous = s.anonymousLimits()
+	}
+	if err := controlStream.SendRegisteredMessage(registeredMsg); err != nil {
 		slog.Error("failed to send registered message", "error", err)
-		s.removeClient(subdomain)
+		s.removeClient(client, err)
 		session.Close()
 		return
 	}
+	if anonymous {
+		s.metrics.anonymousTunnels.Inc()
+		defer s.expireAfter(client)()
+	}
 
 	// Handle control messages (heartbeats) in this goroutine
+	registered()
 	s.handleControlStream(client)
 }
 
+// newTunnelClient creates the client registering subdomain with msg.
+func (s *Server) newTunnelClient(subdomain string, conn net.Conn, session transport.Session, controlStream *protocol.ControlStream, msg *protocol.RegisterMessage) *tunnelClient {
+	now := time.Now()
+	return &tunnelClient{
+		subdomain:     subdomain,
+		token:         msg.Token,
+		remoteAddr:    conn.RemoteAddr().String(),
+		session:       session,
+		controlStream: controlStream,
+		connectedAt:   now,
+		lastHeartbeat: now,
+
+		maxResponseBytes: s.responseLimit(msg.MaxResponseBytes),
+		labels:           msg.Labels,
+		stripHeaders:     s.tunnelStripHeaders(msg.StripHeaders),
+		access:           newAccessPolicy(msg),
+		signature:        newSignaturePolicy(msg),
+		jwt:              s.newJWTPolicy(msg),
+		replay:           newReplayPolicy(msg),
+		ab:               newABPolicy(msg),
+		geo:              newGeoPolicy(msg),
+		challenge:        newChallengePolicy(msg),
+		honeytokens:      newHoneytokenPolicy(msg),
+		sizes:            newPayloadSizes(),
+		timing:           msg.Timing && s.slowRequestThreshold > 0,
+		warnings:         msg.Warnings,
+	}
+}
+
+// tunnelURL builds the public URL for a subdomain.
+func (s *Server) tunnelURL(subdomain string) string {
+	if s.domain != "" {
+		return fmt.Sprintf("https://%s.%s", subdomain, s.domain)
+	}
+	// The port alone: the HTTP address may bind a specific IP
+	if _, port, err := net.SplitHostPort(s.httpAddrs[0]); err == nil && port != "" {
+		return fmt.Sprintf("http://%s.localhost:%s", subdomain, port)
+	}
+	return fmt.Sprintf("http://%s.localhost", subdomain)
+}
+
 // handleControlStream handles control messages from a client.
 func (s *Server) handleControlStream(client *tunnelClient) {
-	defer s.removeClient(client.subdomain)
+	var cause error
+	defer func() { s.removeClient(client, cause) }()
 	defer client.session.Close()
 
 	for {
 		msg, err := client.controlStream.ReadMessage()
+		if errors.Is(err, protocol.ErrInvalidMessage) {
+			s.metrics.invalidMessages.Inc()
+			slog.Warn("invalid control message", "subdomain", client.subdomain, "error", err)
+			client.controlStream.SendErrorCode(protocol.ErrCodeInvalidMessage, err.Error())
+		}
 		if err != nil {
 			slog.Info("control stream closed", "subdomain", client.subdomain, "error", err)
+			cause = err
 			return
 		}
 
 		switch msg.(type) {
 		case *protocol.HeartbeatMessage:
+			s.mu.Lock()
 			client.lastHeartbeat = time.Now()
+			s.mu.Unlock()
 			slog.Debug("heartbeat received", "subdomain", client.subdomain)
 			if err := client.controlStream.SendHeartbeatAck(); err != nil {
 				slog.Error("failed to send heartbeat ack", "error", err)
+				cause = err
 				return
 			}
 		default:
@@ -380,12 +1727,36 @@ func (s *Server) handleControlStream(client *tunnelClient) {
 	}
 }
 
-// removeClient removes a client from the registry.
-func (s *Server) removeClient(subdomain string) {
+// removeClient removes a client from the registry, unless it has already
+// been replaced by a newer client for the same subdomain. cause is the
+// error that ended the session, if any.
+func (s *Server) removeClient(client *tunnelClient, cause error) {
+	if client.canary {
+		s.removeCanary(client, cause)
+		return
+	}
 	s.mu.Lock()
-	delete(s.clients, subdomain)
+	if s.clients[client.subdomain] != client {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.clients, client.subdomain)
+	s.markDisconnected(client.subdomain)
+	s.markResumable(client)
+	reason := client.closeReason
 	s.mu.Unlock()
-	slog.Info("tunnel unregistered", "subdomain", subdomain)
+	if reason == "" && cause != nil {
+		reason = cause.Error()
+	}
+	slog.Info("tunnel unregistered", "subdomain", client.subdomain)
+	s.history.record(client.subdomain, tunnelEvent{Type: eventDisconnected, RemoteAddr: client.remoteAddr, TokenID: tokenID(client.token),
+		Reason: reason})
+	s.audit("tunnel unregistered", "subdomain", client.subdomain, "remote_addr", client.remoteAddr)
+}
+
+// rejectRegistration records a refused registration in subdomain's history.
+func (s *Server) rejectRegistration(subdomain string, conn net.Conn, token, reason string) {
+	s.history.record(subdomain, tunnelEvent{Type: eventRejected, RemoteAddr: conn.RemoteAddr().String(), TokenID: tokenID(token), Reason: reason})
 }
 
 // generateSubdomain generates a random 8-character alphanumeric subdomain.
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// scriptedListener returns a fixed sequence of errors from Accept before
+// handing out connections sent on conns.
+type scriptedListener struct {
+	mu     sync.Mutex
+	errs   []error
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newScriptedListener(errs ...error) *scriptedListener {
+	return &scriptedListener{
+		errs:   errs,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *scriptedListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestAcceptBacksOffOnFDExhaustion(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	ln := newScriptedListener(emfile, emfile, emfile)
+
+	s := New("127.0.0.1:0", "", "", "", "", nil)
+	s.controlListeners[0].set(ln)
+	defer ln.Close()
+
+	start := time.Now()
+	go s.acceptTunnelClients(s.controlListeners[0])
+
+	// A connection after the failures proves the loop recovered
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	select {
+	case ln.conns <- serverSide:
+	case <-time.After(2 * time.Second):
+		t.Fatal("accept loop did not recover after fd exhaustion")
+	}
+	close(s.done)
+
+	// Backoff is 5ms + 10ms + 20ms before the fourth Accept call
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("accept loop retried too quickly: %v", elapsed)
+	}
+	if got := s.metrics.acceptErrors.Value(); got != 3 {
+		t.Errorf("accept errors = %d, want 3", got)
+	}
+	if got := s.metrics.acceptFDExhausted.Value(); got != 3 {
+		t.Errorf("fd exhausted errors = %d, want 3", got)
+	}
+	if got := s.metrics.listenerRecreated.Value(); got != 0 {
+		t.Errorf("listener re-created %d times, want 0 for fd exhaustion", got)
+	}
+}
+
+func TestAcceptRecreatesClosedListener(t *testing.T) {
+	ln := newScriptedListener(net.ErrClosed)
+
+	s := New("127.0.0.1:0", "", "", "", "", nil)
+	s.controlListeners[0].set(ln)
+	defer s.controlListeners[0].close()
+
+	go s.acceptTunnelClients(s.controlListeners[0])
+	defer close(s.done)
+
+	waitFor(t, 2*time.Second, func() bool {
+		return s.metrics.listenerRecreated.Value() == 1
+	})
+
+	if _, ok := s.controlListeners[0].get().(*net.TCPListener); !ok {
+		t.Fatalf("expected re-created TCP listener, got %T", s.controlListeners[0].get())
+	}
+
+	// The re-created listener should accept connections
+	conn, err := net.Dial("tcp", s.controlListeners[0].get().Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial re-created listener: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServerStopAbortsProxiedConnections(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	session := registerTestTunnel(t, s, "stuck")
+
+	// The local service reads the request and never answers
+	go func() {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		http.ReadRequest(bufio.NewReader(stream))
+		io.Copy(io.Discard, stream)
+	}()
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.Host = "stuck.localhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	s.cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("request succeeded, want the connection dropped")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("proxied connection still open after the server stopped")
+	}
+}
+
+// registerTestTunnel registers a tunnel for subdomain backed by an in-memory
+// session and returns the client side of the session.
+func registerTestTunnel(t *testing.T, s *Server, subdomain string) transport.Session {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := transport.Default().Server(serverConn)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	clientSession, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+
+	s.mu.Lock()
+	s.clients[subdomain] = &tunnelClient{
+		subdomain:     subdomain,
+		session:       serverSession,
+		lastHeartbeat: time.Now(),
+	}
+	s.notifyRegistered(subdomain)
+	s.mu.Unlock()
+
+	return clientSession
+}
+
+// unregisterTestTunnel removes the tunnel registered for subdomain.
+func unregisterTestTunnel(s *Server, subdomain string) {
+	if client := s.lookupClient(subdomain); client != nil {
+		s.removeClient(client, nil)
+	}
+}
+
+// serveTunnelStreams answers every stream on session with the given raw HTTP response.
+func serveTunnelStreams(session transport.Session, response string) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			if _, err := http.ReadRequest(bufio.NewReader(stream)); err != nil {
+				return
+			}
+			io.WriteString(stream, response)
+		}()
+	}
+}
+
+func TestInvalidControlMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject bool
+		msg    string
+		want   string // reply type or error code
+	}{
+		{"valid", true, `{"type":"register"}`, protocol.TypeRegistered},
+		{"unknown field allowed", false, `{"type":"register","future":true}`, protocol.TypeRegistered},
+		{"unknown field rejected", true, `{"type":"register","future":true}`, protocol.ErrCodeInvalidMessage},
+		{"oversized field", false, `{"type":"register","subdomain":"` + strings.Repeat("a", 5000) + `"}`, protocol.ErrCodeInvalidMessage},
+		{"malformed", false, `{"type":"register",}`, protocol.ErrCodeInvalidMessage},
+	}
+	for _, tt := range tests {
+		s := New("", "", "", "", "", nil).WithRejectUnknownFields(tt.reject)
+		serverConn, clientConn := net.Pipe()
+		go s.handleTunnelClient(serverConn, func() {})
+		session, err := transport.Default().Client(clientConn)
+		if err != nil {
+			t.Fatalf("failed to create client session: %v", err)
+		}
+		stream, err := session.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open control stream: %v", err)
+		}
+		io.WriteString(stream, tt.msg+"\n")
+
+		reply, err := protocol.NewControlStream(stream).ReadMessage()
+		got := fmt.Sprintf("%v", err)
+		switch m := reply.(type) {
+		case *protocol.RegisteredMessage:
+			got = m.Type
+		case *protocol.ErrorMessage:
+			got = m.Code
+		}
+		if got != tt.want {
+			t.Errorf("%s: reply = %s, want %s", tt.name, got, tt.want)
+		}
+		session.Close()
+	}
+}
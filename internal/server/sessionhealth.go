@@ -0,0 +1,202 @@
+package server
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bc183/otun/internal/metrics"
+	"github.com/bc183/otun/internal/transport"
+)
+
+const (
+	// sessionPingInterval is how often each tunnel session is pinged to
+	// measure its round-trip time.
+	sessionPingInterval = 15 * time.Second
+
+	// writeStallThreshold is how long a write to a tunnel stream may block
+	// before it counts as stalled, i.e. held up waiting for the client to
+	// open its receive window or for the connection to drain.
+	writeStallThreshold = 100 * time.Millisecond
+)
+
+// sessionHealth accumulates transport-level statistics for one session.
+type sessionHealth struct {
+	opened atomic.Uint64
+	closed atomic.Uint64
+	stalls atomic.Uint64
+	errors atomic.Uint64
+	rtt    atomic.Int64 // nanoseconds, 0 until the first ping returns
+}
+
+// healthSession wraps a tunnel session to track its health. Streams it
+// opens or accepts are wrapped to count closes and stalled writes, and the
+// session is pinged in the background while it is open.
+type healthSession struct {
+	transport.Session
+	health   sessionHealth
+	watchdog *streamWatchdog // nil = streams not tracked
+	chaos    *chaos          // nil = no streams dropped
+
+	// streams counts the session's open streams; unlike health, it isn't
+	// carried over to a resumed session
+	streams atomic.Int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newHealthSession wraps session, registering its streams with watchdog and
+// dropping those chaos picks, and starts pinging it if the muxer supports
+// pings.
+func newHealthSession(session transport.Session, watchdog *streamWatchdog, chaos *chaos) *healthSession {
+	hs := &healthSession{Session: session, watchdog: watchdog, chaos: chaos, done: make(chan struct{})}
+	if pinger, ok := session.(transport.Pinger); ok {
+		go hs.pingLoop(pinger)
+	}
+	return hs
+}
+
+func (hs *healthSession) OpenStream() (transport.Stream, error) {
+	stream, err := hs.Session.OpenStream()
+	if err != nil {
+		hs.health.errors.Add(1)
+		return nil, err
+	}
+	if hs.chaos.dropStream() {
+		// Open it first so the client sees the stream reset
+		stream.Close()
+		hs.health.errors.Add(1)
+		return nil, errChaosDrop
+	}
+	return hs.track(stream), nil
+}
+
+func (hs *healthSession) AcceptStream() (transport.Stream, error) {
+	stream, err := hs.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return hs.track(stream), nil
+}
+
+func (hs *healthSession) Close() error {
+	hs.closeOnce.Do(func() { close(hs.done) })
+	return hs.Session.Close()
+}
+
+// track counts stream as opened and wraps it to report back.
+func (hs *healthSession) track(stream transport.Stream) transport.Stream {
+	hs.health.opened.Add(1)
+	hs.streams.Add(1)
+	tracked := &healthStream{Stream: stream, session: hs}
+	if hs.watchdog != nil {
+		hs.watchdog.add(tracked)
+	}
+	return tracked
+}
+
+// openStreams returns the number of the session's streams, the control
+// stream included, that are open.
+func (hs *healthSession) openStreams() int64 {
+	return hs.streams.Load()
+}
+
+// pingLoop measures the session's round-trip time until it is closed.
+func (hs *healthSession) pingLoop(pinger transport.Pinger) {
+	ticker := time.NewTicker(sessionPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-hs.done:
+			return
+		}
+		if hs.IsClosed() {
+			return
+		}
+		hs.ping(pinger)
+	}
+}
+
+// ping records the session's round-trip time, or a failure.
+func (hs *healthSession) ping(pinger transport.Pinger) {
+	rtt, err := pinger.Ping()
+	if err != nil {
+		hs.health.errors.Add(1)
+		slog.Debug("session ping failed", "error", err)
+		return
+	}
+	hs.health.rtt.Store(int64(rtt))
+}
+
+// healthStream counts its close and any write that stalls.
+type healthStream struct {
+	transport.Stream
+	session   *healthSession
+	closeOnce sync.Once
+}
+
+func (s *healthStream) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := s.Stream.Write(b)
+	if time.Since(start) > writeStallThreshold {
+		s.session.health.stalls.Add(1)
+	}
+	return n, err
+}
+
+func (s *healthStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.session.health.closed.Add(1)
+		s.session.streams.Add(-1)
+		if s.session.watchdog != nil {
+			s.session.watchdog.remove(s)
+		}
+	})
+	return s.Stream.Close()
+}
+
+// registerSessionMetrics exports each connected tunnel's session health,
+// labeled by subdomain (HTTP tunnels) or port (TCP tunnels).
+func (s *Server) registerSessionMetrics() {
+	r := s.metrics.registry
+	r.NewCounterVecFunc("otun_session_streams_opened_total", "Streams opened on each tunnel session.", s.sessionSamples(func(h *sessionHealth) float64 {
+		return float64(h.opened.Load())
+	}))
+	r.NewCounterVecFunc("otun_session_streams_closed_total", "Streams closed on each tunnel session.", s.sessionSamples(func(h *sessionHealth) float64 {
+		return float64(h.closed.Load())
+	}))
+	r.NewCounterVecFunc("otun_session_write_stalls_total", "Writes to a tunnel session's streams that blocked over 100ms on flow control or a full connection.", s.sessionSamples(func(h *sessionHealth) float64 {
+		return float64(h.stalls.Load())
+	}))
+	r.NewCounterVecFunc("otun_session_errors_total", "Failed stream opens and pings on each tunnel session.", s.sessionSamples(func(h *sessionHealth) float64 {
+		return float64(h.errors.Load())
+	}))
+	r.NewGaugeVecFunc("otun_session_rtt_seconds", "Round-trip time of each tunnel session's last ping.", s.sessionSamples(func(h *sessionHealth) float64 {
+		return time.Duration(h.rtt.Load()).Seconds()
+	}))
+}
+
+// sessionSamples returns a sample function reporting value for the session
+// of every connected tunnel.
+func (s *Server) sessionSamples(value func(*sessionHealth) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		samples := make([]metrics.Sample, 0, len(s.clients)+len(s.tcpTunnels))
+		for subdomain, client := range s.clients {
+			if hs := healthOf(client.session); hs != nil {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"subdomain": subdomain}, Value: value(&hs.health)})
+			}
+		}
+		for port, client := range s.tcpTunnels {
+			if hs := healthOf(client.session); hs != nil {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"port": strconv.Itoa(port)}, Value: value(&hs.health)})
+			}
+		}
+		return samples
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/transport"
+)
+
+// registerHealthTunnel registers a tunnel whose server session tracks its
+// health, returning both sides.
+func registerHealthTunnel(t *testing.T, s *Server, subdomain string) (*healthSession, transport.Session) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	serverSession, err := transport.Default().Server(serverConn)
+	if err != nil {
+		t.Fatalf("failed to create server session: %v", err)
+	}
+	clientSession, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	hs := newHealthSession(serverSession, s.watchdog, s.chaos)
+	t.Cleanup(func() {
+		clientSession.Close()
+		hs.Close()
+	})
+
+	s.mu.Lock()
+	s.clients[subdomain] = &tunnelClient{subdomain: subdomain, session: hs, lastHeartbeat: time.Now()}
+	s.mu.Unlock()
+	return hs, clientSession
+}
+
+func scrape(t *testing.T, s *Server) string {
+	t.Helper()
+	var sb strings.Builder
+	if _, err := s.metrics.registry.WriteTo(&sb); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	return sb.String()
+}
+
+func TestSessionHealthMetrics(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	hs, clientSession := registerHealthTunnel(t, s, "demo")
+
+	go func() {
+		for {
+			stream, err := clientSession.AcceptStream()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, stream)
+		}
+	}()
+
+	for range 2 {
+		stream, err := hs.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream() error = %v", err)
+		}
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		stream.Close()
+		stream.Close() // counted once
+	}
+	hs.ping(hs.Session.(transport.Pinger))
+
+	out := scrape(t, s)
+	for _, want := range []string{
+		`otun_session_streams_opened_total{subdomain="demo"} 2`,
+		`otun_session_streams_closed_total{subdomain="demo"} 2`,
+		`otun_session_write_stalls_total{subdomain="demo"} 0`,
+		`otun_session_errors_total{subdomain="demo"} 0`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if hs.health.rtt.Load() <= 0 {
+		t.Error("ping did not record a round-trip time")
+	}
+}
+
+func TestSessionHealthWriteStall(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	hs, clientSession := registerHealthTunnel(t, s, "demo")
+
+	// The client holds off reading, so a write larger than the stream's
+	// receive window blocks until it starts
+	go func() {
+		stream, err := clientSession.AcceptStream()
+		if err != nil {
+			return
+		}
+		time.Sleep(2 * writeStallThreshold)
+		io.Copy(io.Discard, stream)
+	}()
+
+	stream, err := hs.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream() error = %v", err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := hs.health.stalls.Load(); got != 1 {
+		t.Errorf("stalls = %d, want 1", got)
+	}
+}
+
+func TestSessionHealthOpenError(t *testing.T) {
+	s := New("", "", "", "", "", nil)
+	hs, _ := registerHealthTunnel(t, s, "demo")
+	hs.Close()
+
+	if _, err := hs.OpenStream(); err == nil {
+		t.Fatal("OpenStream() on a closed session succeeded")
+	}
+	if !strings.Contains(scrape(t, s), `otun_session_errors_total{subdomain="demo"} 1`+"\n") {
+		t.Error("failed open not counted as an error")
+	}
+}
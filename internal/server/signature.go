@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// maxSignedBodyBytes bounds the request bodies buffered to verify a webhook
+// signature. Webhook deliveries are far smaller.
+const maxSignedBodyBytes = 10 << 20
+
+// signaturePolicy verifies the webhook signatures of a tunnel's requests.
+type signaturePolicy struct {
+	*protocol.WebhookSignature
+	hash func() hash.Hash
+}
+
+// newSignaturePolicy returns the policy requested in msg, or nil if there is
+// none. The policy must have passed Validate.
+func newSignaturePolicy(msg *protocol.RegisterMessage) *signaturePolicy {
+	if msg.WebhookSignature == nil {
+		return nil
+	}
+	h, _ := protocol.SignatureHash(msg.WebhookSignature.Algorithm)
+	return &signaturePolicy{WebhookSignature: msg.WebhookSignature, hash: h}
+}
+
+// applies reports whether requests for urlPath must be signed.
+func (p *signaturePolicy) applies(urlPath string) bool {
+	return underPath(p.Path, urlPath)
+}
+
+// underPath reports whether urlPath is prefix or below it; an empty prefix
+// covers every path. urlPath is cleaned first, so "//x" and "/a/../x" can't
+// slip past a policy on "/x".
+func underPath(prefix, urlPath string) bool {
+	if prefix == "" {
+		return true
+	}
+	prefix = path.Clean("/" + prefix)
+	urlPath = path.Clean("/" + urlPath)
+	return urlPath == prefix || strings.HasPrefix(urlPath, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// valid reports whether header is a signature of body.
+func (p *signaturePolicy) valid(header string, body []byte) bool {
+	encoded, ok := strings.CutPrefix(header, p.Prefix)
+	if !ok {
+		return false
+	}
+	var sig []byte
+	var err error
+	if p.Encoding == protocol.SignatureBase64 {
+		sig, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		sig, err = hex.DecodeString(encoded)
+	}
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(p.hash, []byte(p.Secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// checkSignature verifies r's webhook signature if client requires one,
+// replacing r.Body with the buffered copy. It reports false if the request
+// was refused, in which case a response has been written.
+func (s *Server) checkSignature(w http.ResponseWriter, r *http.Request, client *tunnelClient) bool {
+	p := client.signature
+	if p == nil || !p.applies(r.URL.Path) {
+		return true
+	}
+	if r.ContentLength > maxSignedBodyBytes {
+		s.refuseUnsigned(w, r, client, http.StatusRequestEntityTooLarge, "Request body exceeds the signature verification limit of "+bytesize.Format(maxSignedBodyBytes))
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+	if err != nil {
+		s.httpError(w, r, "Failed to read request body", http.StatusBadRequest)
+		return false
+	}
+	if len(body) > maxSignedBodyBytes {
+		s.refuseUnsigned(w, r, client, http.StatusRequestEntityTooLarge, "Request body exceeds the signature verification limit of "+bytesize.Format(maxSignedBodyBytes))
+		return false
+	}
+	if !p.valid(r.Header.Get(p.Header), body) {
+		s.refuseUnsigned(w, r, client, http.StatusUnauthorized, "Invalid webhook signature")
+		return false
+	}
+
+	// Forward the buffered copy with a fixed length. The visitor has
+	// already been sent 100 Continue, so the upstream must not send another.
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Expect")
+	return true
+}
+
+// refuseUnsigned answers a request that failed signature verification.
+func (s *Server) refuseUnsigned(w http.ResponseWriter, r *http.Request, client *tunnelClient, status int, message string) {
+	s.metrics.signatureFailures.Inc()
+	slog.Warn("webhook signature rejected", "subdomain", client.subdomain, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "status", status)
+	if status == http.StatusRequestEntityTooLarge {
+		w.Header().Set("Connection", "close")
+	}
+	s.httpError(w, r, message, status)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func sign(secret, body string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+func TestSignaturePolicyValid(t *testing.T) {
+	const body = `{"action":"opened"}`
+	sig := sign("s3cret", body)
+	tests := []struct {
+		name     string
+		prefix   string
+		encoding string
+		header   string
+		want     bool
+	}{
+		{name: "hex with prefix", prefix: "sha256=", header: "sha256=" + hex.EncodeToString(sig), want: true},
+		{name: "base64", encoding: protocol.SignatureBase64, header: base64.StdEncoding.EncodeToString(sig), want: true},
+		{name: "missing prefix", prefix: "sha256=", header: hex.EncodeToString(sig)},
+		{name: "wrong signature", header: hex.EncodeToString(sign("other", body))},
+		{name: "not hex", header: "zz"},
+		{name: "empty", header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSignaturePolicy(&protocol.RegisterMessage{WebhookSignature: &protocol.WebhookSignature{
+				Header: "X-Signature", Algorithm: "sha256", Secret: "s3cret", Prefix: tt.prefix, Encoding: tt.encoding,
+			}})
+			if got := p.valid(tt.header, []byte(body)); got != tt.want {
+				t.Errorf("valid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	const body = `{"id":1}`
+	s := New("", "", "", "", "", nil)
+	go serveTunnelStreams(registerTestTunnel(t, s, "hooks"), okResponse)
+	s.clients["hooks"].signature = newSignaturePolicy(&protocol.RegisterMessage{WebhookSignature: &protocol.WebhookSignature{
+		Header: "X-Hub-Signature-256", Algorithm: "sha256", Secret: "s3cret", Prefix: "sha256=", Path: "/webhooks",
+	}})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		signature string
+		want      int
+	}{
+		{name: "signed", path: "/webhooks/github", signature: "sha256=" + hex.EncodeToString(sign("s3cret", body)), want: http.StatusOK},
+		{name: "forged", path: "/webhooks/github", signature: "sha256=" + hex.EncodeToString(sign("guess", body)), want: http.StatusUnauthorized},
+		{name: "unsigned", path: "/webhooks", want: http.StatusUnauthorized},
+		{name: "outside path", path: "/health", want: http.StatusOK},
+		{name: "double slash", path: "//webhooks/github", want: http.StatusUnauthorized},
+		{name: "dot segments", path: "/a/../webhooks/github", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", ts.URL+tt.path, strings.NewReader(body))
+			req.Host = "hooks.localhost"
+			if tt.signature != "" {
+				req.Header.Set("X-Hub-Signature-256", tt.signature)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+	if got := s.metrics.signatureFailures.Value(); got != 4 {
+		t.Errorf("signature failures = %d, want 4", got)
+	}
+}
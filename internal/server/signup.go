@@ -0,0 +1,528 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// signupCodeTTL is how long an emailed verification code is valid.
+	signupCodeTTL = 15 * time.Minute
+
+	// signupResendInterval is the minimum time between codes to one address.
+	signupResendInterval = time.Minute
+
+	// signupMaxAttempts is how many wrong codes an address may try before it
+	// has to request a new one.
+	signupMaxAttempts = 5
+
+	// signupPrefixMaxLen caps the length of a token's subdomain prefix.
+	signupPrefixMaxLen = 20
+)
+
+// SignupConfig configures self-service token signup. Exactly one way of
+// proving who the user is must be set up: an OIDC provider, or SMTP for
+// emailed verification codes.
+type SignupConfig struct {
+	// StorePath is the file issued tokens are kept in across restarts.
+	StorePath string
+
+	// AllowedDomains restricts signups to these email domains (empty = any).
+	AllowedDomains []string
+
+	// OIDCIssuer gates signup on an identity provider: callers present an
+	// access token, and the email from the provider's userinfo endpoint is
+	// used to issue theirs.
+	OIDCIssuer string
+
+	// SMTP server used to email verification codes when OIDCIssuer is empty.
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// issuedToken is a token issued through signup. Only a hash of the token is
+// kept, so a leaked store doesn't leak working keys.
+type issuedToken struct {
+	Hash      string    `json:"hash"`
+	Email     string    `json:"email"`
+	Prefix    string    `json:"prefix"` // subdomains the token may publish start with this
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// pendingSignup is an emailed verification code awaiting confirmation.
+type pendingSignup struct {
+	code     string
+	sentAt   time.Time
+	attempts int
+}
+
+// signup issues and tracks self-service tokens.
+type signup struct {
+	cfg        SignupConfig
+	httpClient *http.Client
+	sendMail   func(to, subject, body string) error
+
+	mu      sync.Mutex
+	tokens  map[string]*issuedToken   // hash -> token
+	pending map[string]*pendingSignup // email -> code
+}
+
+// signupResponse is returned once a token is issued.
+type signupResponse struct {
+	Token           string `json:"token"`
+	Email           string `json:"email"`
+	SubdomainPrefix string `json:"subdomain_prefix"`
+}
+
+// WithSignup serves a self-service signup API on addr that issues API keys
+// scoped to a subdomain prefix derived from the user's email address.
+// Enabling signup turns on authentication even without -api-keys.
+func (s *Server) WithSignup(addr string, cfg SignupConfig) *Server {
+	s.signupAddr = addr
+	s.signup = &signup{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		tokens:     make(map[string]*issuedToken),
+		pending:    make(map[string]*pendingSignup),
+	}
+	s.signup.sendMail = s.signup.sendSMTP
+	s.metrics.registry.NewGaugeFunc("otun_signup_tokens", "Tokens currently issued through signup.", func() float64 {
+		return float64(s.signup.count())
+	})
+	return s
+}
+
+// authRequired reports whether clients must present a valid API key.
+func (s *Server) authRequired() bool {
+	return len(s.apiKeys) > 0 || s.signup != nil || s.policies != nil
+}
+
+// serveSignup serves the signup API on addr.
+func (s *Server) serveSignup(addr string) {
+	slog.Info("signup API started", "addr", addr)
+	if err := http.ListenAndServe(addr, s.signupHandler()); err != nil {
+		slog.Error("signup API error", "error", err)
+	}
+}
+
+// signupHandler returns the signup API handler.
+func (s *Server) signupHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/signup", s.handleSignup)
+	mux.HandleFunc("POST /api/signup/verify", s.handleSignupVerify)
+	return mux
+}
+
+func (s *Server) handleSignup(w http.ResponseWriter, r *http.Request) {
+	su := s.signup
+	if su.cfg.OIDCIssuer != "" {
+		accessToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || accessToken == "" {
+			writeJSONError(w, http.StatusUnauthorized, "sign in with the identity provider and send its access token as a bearer token")
+			return
+		}
+		email, err := su.oidcEmail(r.Context(), accessToken)
+		if err != nil {
+			slog.Warn("signup rejected", "error", err)
+			writeJSONError(w, http.StatusUnauthorized, "identity provider did not accept the access token")
+			return
+		}
+		s.issueSignupToken(w, email)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	email, err := su.checkEmail(req.Email)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	code, err := su.newCode(email)
+	if err != nil {
+		writeJSONError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	body := fmt.Sprintf("Your otun signup code is %s.\n\nIt expires in %d minutes. If you didn't ask for it, ignore this email.\n",
+		code, int(signupCodeTTL/time.Minute))
+	if err := su.sendMail(email, "Your otun signup code", body); err != nil {
+		slog.Error("failed to send signup email", "error", err)
+		su.forgetCode(email)
+		writeJSONError(w, http.StatusBadGateway, "failed to send verification email")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "verification code sent"})
+}
+
+func (s *Server) handleSignupVerify(w http.ResponseWriter, r *http.Request) {
+	if s.signup.cfg.OIDCIssuer != "" {
+		writeJSONError(w, http.StatusNotFound, "signup uses the identity provider; POST /api/signup with its access token")
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	email, err := s.signup.checkEmail(req.Email)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.signup.verifyCode(email, req.Code) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or expired code")
+		return
+	}
+	s.issueSignupToken(w, email)
+}
+
+// issueSignupToken issues a token for email and writes it as the response.
+func (s *Server) issueSignupToken(w http.ResponseWriter, email string) {
+	token, issued, revoked, err := s.signup.issue(email)
+	if err != nil {
+		slog.Error("failed to issue token", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to issue token")
+		return
+	}
+
+	// Subdomains owned by the revoked tokens carry over to the new one
+	if len(revoked) > 0 {
+		s.mu.Lock()
+		for _, o := range s.owners {
+			if slices.Contains(revoked, hashToken(o.owner)) {
+				o.owner = token
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	slog.Info("token issued", "email", email, "token_id", tokenID(token), "prefix", issued.Prefix)
+	s.audit("token issued", "email", email, "token_id", tokenID(token), "prefix", issued.Prefix)
+	writeJSON(w, http.StatusOK, signupResponse{Token: token, Email: email, SubdomainPrefix: issued.Prefix})
+}
+
+// checkEmail normalizes an email address and checks its domain is allowed.
+func (su *signup) checkEmail(address string) (string, error) {
+	addr, err := mail.ParseAddress(address)
+	if err != nil || addr.Name != "" {
+		return "", errors.New("invalid email address")
+	}
+	email := strings.ToLower(addr.Address)
+	_, domain, _ := strings.Cut(email, "@")
+	if len(su.cfg.AllowedDomains) > 0 && !slices.Contains(su.cfg.AllowedDomains, domain) {
+		return "", fmt.Errorf("signups from %s are not allowed", domain)
+	}
+	return email, nil
+}
+
+// newCode creates a verification code for email, unless one was sent too
+// recently.
+func (su *signup) newCode(email string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	if p := su.pending[email]; p != nil && time.Since(p.sentAt) < signupResendInterval {
+		return "", errors.New("a code was sent recently; check your inbox or try again in a minute")
+	}
+	su.pending[email] = &pendingSignup{code: code, sentAt: time.Now()}
+	return code, nil
+}
+
+// forgetCode drops the pending code for email.
+func (su *signup) forgetCode(email string) {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	delete(su.pending, email)
+}
+
+// verifyCode checks code against the one sent to email, consuming it on
+// success or after too many wrong guesses.
+func (su *signup) verifyCode(email, code string) bool {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+
+	p := su.pending[email]
+	if p == nil || time.Since(p.sentAt) > signupCodeTTL {
+		delete(su.pending, email)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(p.code), []byte(code)) != 1 {
+		p.attempts++
+		if p.attempts >= signupMaxAttempts {
+			delete(su.pending, email)
+		}
+		return false
+	}
+	delete(su.pending, email)
+	return true
+}
+
+// oidcEmail returns the verified email of the user an access token belongs
+// to, as reported by the identity provider's userinfo endpoint.
+func (su *signup) oidcEmail(ctx context.Context, accessToken string) (string, error) {
+	var meta struct {
+		UserinfoEndpoint string `json:"userinfo_endpoint"`
+	}
+	metaURL := strings.TrimSuffix(su.cfg.OIDCIssuer, "/") + "/.well-known/openid-configuration"
+	if err := su.getJSON(ctx, metaURL, "", &meta); err != nil {
+		return "", fmt.Errorf("failed to fetch provider metadata: %w", err)
+	}
+	if meta.UserinfoEndpoint == "" {
+		return "", errors.New("identity provider has no userinfo endpoint")
+	}
+
+	var info struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err := su.getJSON(ctx, meta.UserinfoEndpoint, accessToken, &info); err != nil {
+		return "", fmt.Errorf("failed to fetch user info: %w", err)
+	}
+	if info.EmailVerified != nil && !*info.EmailVerified {
+		return "", fmt.Errorf("email %s is not verified", info.Email)
+	}
+	return su.checkEmail(info.Email)
+}
+
+// getJSON fetches url, with a bearer token if given, and decodes the JSON
+// response into v.
+func (su *signup) getJSON(ctx context.Context, url, bearer string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := su.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// sendSMTP emails body to to through the configured SMTP server, upgrading
+// to TLS when the server supports it.
+func (su *signup) sendSMTP(to, subject, body string) error {
+	var auth smtp.Auth
+	if su.cfg.SMTPUsername != "" {
+		host, _, _ := strings.Cut(su.cfg.SMTPAddr, ":")
+		auth = smtp.PlainAuth("", su.cfg.SMTPUsername, su.cfg.SMTPPassword, host)
+	}
+	msg := "From: " + su.cfg.SMTPFrom + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(su.cfg.SMTPAddr, auth, su.cfg.SMTPFrom, []string{to}, []byte(msg))
+}
+
+// issue creates a token for email, revoking any it was issued before and
+// returning their hashes. The email keeps its subdomain prefix across
+// re-issues.
+func (su *signup) issue(email string) (string, *issuedToken, []string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, nil, err
+	}
+	token := "otun_" + base64.RawURLEncoding.EncodeToString(b)
+
+	su.mu.Lock()
+	defer su.mu.Unlock()
+
+	prefix := ""
+	var revoked []*issuedToken
+	taken := make(map[string]bool, len(su.tokens))
+	for hash, t := range su.tokens {
+		if t.Email == email {
+			prefix = t.Prefix
+			revoked = append(revoked, t)
+			delete(su.tokens, hash)
+			continue
+		}
+		taken[t.Prefix] = true
+	}
+	if prefix == "" {
+		prefix = uniquePrefix(email, taken)
+	}
+
+	issued := &issuedToken{
+		Hash:      hashToken(token),
+		Email:     email,
+		Prefix:    prefix,
+		CreatedAt: time.Now().UTC(),
+	}
+	su.tokens[issued.Hash] = issued
+	if err := su.saveLocked(); err != nil {
+		delete(su.tokens, issued.Hash)
+		for _, t := range revoked {
+			su.tokens[t.Hash] = t
+		}
+		return "", nil, nil, err
+	}
+
+	hashes := make([]string, len(revoked))
+	for i, t := range revoked {
+		hashes[i] = t.Hash
+	}
+	return token, issued, hashes, nil
+}
+
+// lookup returns the issued token matching token, or nil.
+func (su *signup) lookup(token string) *issuedToken {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.tokens[hashToken(token)]
+}
+
+// count returns the number of issued tokens.
+func (su *signup) count() int {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return len(su.tokens)
+}
+
+// load reads issued tokens from the store, if it exists.
+func (su *signup) load() error {
+	if su.cfg.StorePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(su.cfg.StorePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read signup store: %w", err)
+	}
+	var tokens []*issuedToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return fmt.Errorf("invalid signup store %s: %w", su.cfg.StorePath, err)
+	}
+
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	for _, t := range tokens {
+		su.tokens[t.Hash] = t
+	}
+	return nil
+}
+
+// saveLocked writes issued tokens to the store, replacing it atomically.
+// Must be called with su.mu held.
+func (su *signup) saveLocked() error {
+	if su.cfg.StorePath == "" {
+		return nil
+	}
+	tokens := make([]*issuedToken, 0, len(su.tokens))
+	for _, t := range su.tokens {
+		tokens = append(tokens, t)
+	}
+	slices.SortFunc(tokens, func(a, b *issuedToken) int { return strings.Compare(a.Email, b.Email) })
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(su.cfg.StorePath), ".signup-*")
+	if err != nil {
+		return fmt.Errorf("failed to write signup store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write signup store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write signup store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), su.cfg.StorePath); err != nil {
+		return fmt.Errorf("failed to write signup store: %w", err)
+	}
+	return nil
+}
+
+// hashToken returns the hex SHA-256 of token, as kept in the store.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// uniquePrefix derives a subdomain prefix such as "alice-" from the local
+// part of email, adding a number if the prefix is already taken.
+func uniquePrefix(email string, taken map[string]bool) string {
+	local, _, _ := strings.Cut(email, "@")
+	var b strings.Builder
+	for _, r := range local {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	base := strings.Trim(b.String(), "-")
+	if len(base) > signupPrefixMaxLen {
+		base = strings.TrimRight(base[:signupPrefixMaxLen], "-")
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	prefix := base + "-"
+	for n := 2; taken[prefix]; n++ {
+		prefix = base + strconv.Itoa(n) + "-"
+	}
+	return prefix
+}
+
+// subdomainPrefix returns the prefix subdomains published with token must
+// start with ("" = any subdomain).
+func (s *Server) subdomainPrefix(token string) string {
+	if s.signup == nil {
+		return ""
+	}
+	if issued := s.signup.lookup(token); issued != nil {
+		return issued.Prefix
+	}
+	return ""
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUniquePrefix(t *testing.T) {
+	tests := []struct {
+		email string
+		taken []string
+		want  string
+	}{
+		{email: "alice@example.com", want: "alice-"},
+		{email: "Bob.Smith+otun@example.com", want: "bob-smith-otun-"},
+		{email: "alice@example.com", taken: []string{"alice-", "alice2-"}, want: "alice3-"},
+		{email: "___@example.com", want: "user-"},
+		{email: "averyveryverylongname.here@example.com", want: "averyveryverylongnam-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			taken := make(map[string]bool)
+			for _, p := range tt.taken {
+				taken[p] = true
+			}
+			if got := uniquePrefix(strings.ToLower(tt.email), taken); got != tt.want {
+				t.Errorf("uniquePrefix(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+// postJSON sends body to path on h and decodes the JSON response into v.
+func postJSON(t *testing.T, h http.Handler, path, bearer, body string, v any) int {
+	t.Helper()
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil {
+		json.Unmarshal(rec.Body.Bytes(), v)
+	}
+	return rec.Code
+}
+
+func TestSignupEmailVerification(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "signup.json")
+	s := New("", "", "", "", "", nil).WithSignup("", SignupConfig{StorePath: store, AllowedDomains: []string{"example.com"}})
+	var sent string
+	s.signup.sendMail = func(to, subject, body string) error {
+		sent = body
+		return nil
+	}
+	h := s.signupHandler()
+
+	if code := postJSON(t, h, "/api/signup", "", `{"email": "eve@evil.test"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("disallowed domain: status %d, want 400", code)
+	}
+	if code := postJSON(t, h, "/api/signup", "", `{"email": "Alice@Example.com"}`, nil); code != http.StatusAccepted {
+		t.Fatalf("signup: status %d, want 202", code)
+	}
+	if code := postJSON(t, h, "/api/signup", "", `{"email": "alice@example.com"}`, nil); code != http.StatusTooManyRequests {
+		t.Errorf("resend: status %d, want 429", code)
+	}
+	code := regexp.MustCompile(`\d{6}`).FindString(sent)
+	if code == "" {
+		t.Fatalf("no code in email: %q", sent)
+	}
+
+	if status := postJSON(t, h, "/api/signup/verify", "", `{"email": "alice@example.com", "code": "000000x"}`, nil); status != http.StatusUnauthorized {
+		t.Errorf("wrong code: status %d, want 401", status)
+	}
+	var resp signupResponse
+	if status := postJSON(t, h, "/api/signup/verify", "", `{"email": "alice@example.com", "code": "`+code+`"}`, &resp); status != http.StatusOK {
+		t.Fatalf("verify: status %d, want 200", status)
+	}
+	if resp.SubdomainPrefix != "alice-" || resp.Token == "" {
+		t.Fatalf("response = %+v", resp)
+	}
+	if status := postJSON(t, h, "/api/signup/verify", "", `{"email": "alice@example.com", "code": "`+code+`"}`, nil); status != http.StatusUnauthorized {
+		t.Errorf("code reused: status %d, want 401", status)
+	}
+
+	// The token works, but only under its prefix
+	if !s.validateToken(resp.Token) || s.validateToken("otun_bogus") {
+		t.Error("validateToken doesn't recognize issued tokens")
+	}
+	s.mu.Lock()
+	errOther := s.claimSubdomain("bob-app", resp.Token)
+	errOwn := s.claimSubdomain("alice-app", resp.Token)
+	s.mu.Unlock()
+	if errOther == nil {
+		t.Error("token claimed a subdomain outside its prefix")
+	}
+	if errOwn != nil {
+		t.Errorf("claim under prefix: %v", errOwn)
+	}
+
+	// Tokens survive a restart
+	restarted := New("", "", "", "", "", nil).WithSignup("", SignupConfig{StorePath: store})
+	if err := restarted.signup.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !restarted.validateToken(resp.Token) {
+		t.Error("issued token not loaded from store")
+	}
+
+	// Signing up again replaces the token and hands over its subdomains
+	s.signup.pending["alice@example.com"] = &pendingSignup{code: "123456", sentAt: time.Now()}
+	var again signupResponse
+	postJSON(t, h, "/api/signup/verify", "", `{"email": "alice@example.com", "code": "123456"}`, &again)
+	if again.Token == "" || again.Token == resp.Token || again.SubdomainPrefix != "alice-" {
+		t.Fatalf("re-signup response = %+v", again)
+	}
+	if s.validateToken(resp.Token) {
+		t.Error("old token still valid after re-signup")
+	}
+	s.mu.RLock()
+	owner := s.owners["alice-app"].owner
+	s.mu.RUnlock()
+	if owner != again.Token {
+		t.Error("subdomain ownership not transferred to the new token")
+	}
+}
+
+func TestSignupOIDC(t *testing.T) {
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"userinfo_endpoint": provider.URL + "/userinfo"})
+		case "/userinfo":
+			switch r.Header.Get("Authorization") {
+			case "Bearer good":
+				json.NewEncoder(w).Encode(map[string]any{"email": "carol@corp.example", "email_verified": true})
+			case "Bearer unverified":
+				json.NewEncoder(w).Encode(map[string]any{"email": "carol@corp.example", "email_verified": false})
+			default:
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			}
+		}
+	}))
+	defer provider.Close()
+
+	s := New("", "", "", "", "", nil).WithSignup("", SignupConfig{OIDCIssuer: provider.URL, AllowedDomains: []string{"corp.example"}})
+	h := s.signupHandler()
+
+	tests := []struct {
+		name   string
+		bearer string
+		want   int
+	}{
+		{name: "no token", want: http.StatusUnauthorized},
+		{name: "rejected token", bearer: "bad", want: http.StatusUnauthorized},
+		{name: "unverified email", bearer: "unverified", want: http.StatusUnauthorized},
+		{name: "valid token", bearer: "good", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp signupResponse
+			if status := postJSON(t, h, "/api/signup", tt.bearer, "", &resp); status != tt.want {
+				t.Fatalf("status = %d, want %d", status, tt.want)
+			}
+			if tt.want == http.StatusOK && (resp.Email != "carol@corp.example" || !s.validateToken(resp.Token)) {
+				t.Errorf("response = %+v", resp)
+			}
+		})
+	}
+}
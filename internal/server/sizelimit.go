@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/metrics"
+)
+
+// errResponseTooLarge is returned by reads from a tunnel stream once a
+// response body exceeds the tunnel's size limit.
+var errResponseTooLarge = errors.New("response exceeds size limit")
+
+// maxResponseHeaderBytes bounds how much of a response head is buffered to
+// find its framing. Larger heads are passed through with the body counted
+// from the end of the buffer.
+const maxResponseHeaderBytes = 64 << 10
+
+// tooLargeResponse is substituted for responses whose Content-Length
+// exceeds the limit.
+func tooLargeResponse(limit int64) []byte {
+	body := fmt.Sprintf("Response exceeds the tunnel's size limit of %s\n", bytesize.Format(limit))
+	return []byte(fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body))
+}
+
+// WithMaxResponseSize sets the default per-response body limit for tunnels,
+// which clients may lower but not raise. Zero means no limit.
+func (s *Server) WithMaxResponseSize(n int64) *Server {
+	s.maxResponseBytes = n
+	return s
+}
+
+// responseLimit returns the effective limit for a tunnel requesting
+// requested bytes (0 = no preference).
+func (s *Server) responseLimit(requested int64) int64 {
+	if requested > 0 && (s.maxResponseBytes == 0 || requested < s.maxResponseBytes) {
+		return requested
+	}
+	return s.maxResponseBytes
+}
+
+// Framing states of a sizeLimitedConn.
+const (
+	framingHead        = iota // buffering a response head
+	framingBody               // body with a known length
+	framingChunkSize          // reading a chunk size line
+	framingChunkData          // reading chunk data
+	framingChunkEnd           // reading the CRLF after chunk data
+	framingTrailer            // reading trailer lines
+	framingUntilClose         // body delimited by connection close, or framing we can't follow
+	framingPassthrough        // protocol switched, no longer HTTP
+)
+
+// sizeLimitedConn enforces a per-response body size limit on the response
+// side of a tunnel stream, and strips configured headers from each response
+// head. It follows HTTP/1.1 framing, Content-Length and chunked bodies, to
+// reset the count and find the next head between keep-alive responses;
+// close-delimited bodies count until the stream ends.
+//
+// Responses announcing a Content-Length over the limit are replaced by a
+// 502 if nothing has been sent yet; otherwise the body is cut off after
+// exactly limit bytes.
+type sizeLimitedConn struct {
+	net.Conn
+	limit     int64
+	subdomain string
+	method    string // method of the first request, for HEAD responses
+	exceeds   *metrics.Counter
+
+	state     int
+	head      []byte
+	line      []byte // partial chunk size or trailer line
+	remaining int64  // body bytes left in framingBody, chunk bytes in framingChunkData
+	counted   int64  // body bytes so far of a chunked or close-delimited body
+	responses int    // responses seen
+	started   bool   // whether any byte has been passed on
+
+	pending  []byte
+	readBuf  []byte
+	err      error
+	rejected bool // a 502 was substituted
+
+	// near is called once per response whose body reaches warnAt bytes
+	// (0 = never)
+	warnAt int64
+	near   func(size int64)
+	warned bool
+
+	// stripHeaders are removed from every response head
+	stripHeaders []string
+}
+
+// limitResponseSize starts enforcing a body size limit on responses read
+// from stream (0 = no limit).
+func (s *Server) limitResponseSize(stream net.Conn, limit int64, subdomain, method string) *sizeLimitedConn {
+	return &sizeLimitedConn{
+		Conn:      stream,
+		limit:     limit,
+		subdomain: subdomain,
+		method:    method,
+		exceeds:   s.metrics.responsesTooLarge,
+		readBuf:   make([]byte, 32<<10),
+	}
+}
+
+func (c *sizeLimitedConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		n, err := c.Conn.Read(c.readBuf)
+		c.process(c.readBuf[:n])
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	c.started = true
+	return n, nil
+}
+
+// process runs data through the framing state machine, queueing what may
+// be passed on.
+func (c *sizeLimitedConn) process(data []byte) {
+	for len(data) > 0 && c.err == nil {
+		switch c.state {
+		case framingHead:
+			data = c.processHead(data)
+		case framingBody:
+			n := int64(len(data))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.pending = append(c.pending, data[:n]...)
+			data = data[n:]
+			if c.remaining -= n; c.remaining == 0 {
+				c.state = framingHead
+			}
+		case framingChunkSize:
+			line, rest, ok := c.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+			c.pending = append(c.pending, line...)
+			size, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(string(line), ";", 2)[0]), 16, 64)
+			if err != nil || size < 0 {
+				// Not chunking we understand; count the rest
+				c.state = framingUntilClose
+				continue
+			}
+			c.remaining = size
+			c.state = framingChunkData
+			if size == 0 {
+				c.state = framingTrailer
+			}
+		case framingChunkData:
+			n := min(int64(len(data)), c.remaining)
+			if c.limit > 0 && c.counted+n > c.limit {
+				c.pending = append(c.pending, data[:c.limit-c.counted]...)
+				c.exceeded()
+				return
+			}
+			c.counted += n
+			c.pending = append(c.pending, data[:n]...)
+			data = data[n:]
+			c.checkSize(c.counted)
+			if c.remaining -= n; c.remaining == 0 {
+				c.state = framingChunkEnd
+			}
+		case framingChunkEnd:
+			line, rest, ok := c.readLine(data)
+			data = rest
+			if ok {
+				c.pending = append(c.pending, line...)
+				c.state = framingChunkSize
+			}
+		case framingTrailer:
+			line, rest, ok := c.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+			c.pending = append(c.pending, line...)
+			if string(line) == "\r\n" {
+				c.state = framingHead
+			}
+		case framingUntilClose:
+			allowed := c.limit - c.counted
+			if c.limit > 0 && int64(len(data)) > allowed {
+				c.pending = append(c.pending, data[:allowed]...)
+				c.exceeded()
+				return
+			}
+			c.counted += int64(len(data))
+			c.pending = append(c.pending, data...)
+			data = nil
+			c.checkSize(c.counted)
+		case framingPassthrough:
+			c.pending = append(c.pending, data...)
+			data = nil
+		}
+	}
+}
+
+// readLine buffers data up to and including a line feed. It returns the
+// line once complete, and the unconsumed data.
+func (c *sizeLimitedConn) readLine(data []byte) (line, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		c.line = append(c.line, data...)
+		if len(c.line) > maxResponseHeaderBytes {
+			// Not framing we can follow; count everything from here
+			c.counted += int64(len(c.line))
+			c.pending = append(c.pending, c.line...)
+			c.line = nil
+			c.state = framingUntilClose
+		}
+		return nil, nil, false
+	}
+	line = append(c.line, data[:i+1]...)
+	c.line = nil
+	return line, data[i+1:], true
+}
+
+// processHead buffers a response head and decides how its body is framed.
+// It returns the unconsumed data.
+func (c *sizeLimitedConn) processHead(data []byte) []byte {
+	start := len(c.head)
+	c.head = append(c.head, data...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(c.head) > maxResponseHeaderBytes {
+			// Not a head we can parse; count everything from here
+			c.pending = append(c.pending, c.head...)
+			c.head = nil
+			c.state = framingUntilClose
+		}
+		return nil
+	}
+	end += 4
+	head := c.head[:end]
+	rest := data[end-start:]
+	c.head = nil
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		c.pending = append(c.pending, head...)
+		c.state = framingUntilClose
+		return rest
+	}
+	c.responses++
+	c.warned = false
+
+	switch {
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		c.state = framingPassthrough
+	case resp.StatusCode < 200:
+		c.state = framingHead
+	case resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(c.responses == 1 && c.method == http.MethodHead):
+		c.state = framingHead
+	case c.limit > 0 && resp.ContentLength > c.limit:
+		if !c.started && len(c.pending) == 0 {
+			c.pending = tooLargeResponse(c.limit)
+			c.rejected = true
+		}
+		c.exceeded()
+		return nil
+	case resp.ContentLength >= 0:
+		c.checkSize(resp.ContentLength)
+		c.remaining = resp.ContentLength
+		c.state = framingBody
+		if c.remaining == 0 {
+			c.state = framingHead
+		}
+	case len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked":
+		c.counted = 0
+		c.state = framingChunkSize
+	default:
+		c.counted = 0
+		c.state = framingUntilClose
+	}
+	if len(c.stripHeaders) > 0 {
+		head = stripHeaderLines(head, c.stripHeaders)
+	}
+	c.pending = append(c.pending, head...)
+	return rest
+}
+
+// checkSize reports a response body of size if it's large enough to warn
+// about.
+func (c *sizeLimitedConn) checkSize(size int64) {
+	if c.warnAt > 0 && !c.warned && size >= c.warnAt {
+		c.warned = true
+		c.near(size)
+	}
+}
+
+// exceeded ends the stream after the limit is reached.
+func (c *sizeLimitedConn) exceeded() {
+	c.exceeds.Inc()
+	slog.Warn("response size limit exceeded", "subdomain", c.subdomain, "limit", c.limit, "rejected", c.rejected)
+	c.err = errResponseTooLarge
+	// Stop the tunnel client from sending the rest
+	c.Conn.Close()
+}
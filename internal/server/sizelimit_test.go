@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chunkedConn serves data in small reads, like a network stream.
+type chunkedConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *chunkedConn) Read(b []byte) (int, error) {
+	if len(b) > 7 {
+		b = b[:7]
+	}
+	return c.r.Read(b)
+}
+
+func (c *chunkedConn) Close() error { return nil }
+
+func TestSizeLimitedConn(t *testing.T) {
+	const limit = 10
+	tests := []struct {
+		name     string
+		method   string
+		upstream string
+		want     string // expected output; "" means the 502 substitute
+		wantErr  bool
+	}{
+		{
+			name:     "under limit",
+			upstream: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			want:     "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+		},
+		{
+			name:     "content length over limit",
+			upstream: "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world",
+			wantErr:  true,
+		},
+		{
+			name:     "keep-alive responses reset the count",
+			upstream: "HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n12345678HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n12345678",
+			want:     "HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n12345678HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n12345678",
+		},
+		{
+			name:     "second response over limit is cut off",
+			upstream: "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\naHTTP/1.1 200 OK\r\nContent-Length: 50\r\n\r\n",
+			want:     "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\na",
+			wantErr:  true,
+		},
+		{
+			name:     "chunked keep-alive responses reset the count",
+			upstream: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n12345678",
+			want:     "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n0\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\n12345678",
+		},
+		{
+			name:     "chunked body cut at exactly the limit",
+			upstream: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n8\r\nabcdefgh\r\n0\r\n\r\n",
+			want:     "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n8\r\nab",
+			wantErr:  true,
+		},
+		{
+			name:     "close-delimited body cut at exactly the limit",
+			upstream: "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n0123456789abcdef",
+			want:     "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n0123456789",
+			wantErr:  true,
+		},
+		{
+			name:     "HEAD response announces large body",
+			method:   http.MethodHead,
+			upstream: "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n",
+			want:     "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n",
+		},
+		{
+			name:     "upgraded connection is not limited",
+			upstream: "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n" + strings.Repeat("x", 100),
+			want:     "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n" + strings.Repeat("x", 100),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil)
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			conn := s.limitResponseSize(&chunkedConn{r: bytes.NewReader([]byte(tt.upstream))}, limit, "app", method)
+
+			got, err := io.ReadAll(conn)
+			if tt.wantErr != errors.Is(err, errResponseTooLarge) {
+				t.Errorf("err = %v, want errResponseTooLarge: %v", err, tt.wantErr)
+			}
+			want := tt.want
+			if want == "" {
+				want = string(tooLargeResponse(limit))
+			}
+			if string(got) != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestResponseLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    int64
+		requested int64
+		want      int64
+	}{
+		{name: "no limits", want: 0},
+		{name: "server default", server: 100, want: 100},
+		{name: "client lowers", server: 100, requested: 10, want: 10},
+		{name: "client cannot raise", server: 100, requested: 1000, want: 100},
+		{name: "client only", requested: 10, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithMaxResponseSize(tt.server)
+			if got := s.responseLimit(tt.requested); got != tt.want {
+				t.Errorf("responseLimit(%d) = %d, want %d", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRejectsLargeResponse(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithMaxResponseSize(1)
+	go serveTunnelStreams(registerTestTunnel(t, s, "app"), okResponse)
+	s.clients["app"].maxResponseBytes = s.responseLimit(0)
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Host = "app.localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "size limit of 1 B") {
+		t.Errorf("body = %q", body)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// WithSlowRequestLog logs every proxied request that takes longer than
+// threshold, with a breakdown of where the time went: reaching the tunnel,
+// the client dialing its local service, waiting for the first response
+// byte, and receiving the rest. WebSockets are exempt. Zero disables it.
+func (s *Server) WithSlowRequestLog(threshold time.Duration) *Server {
+	s.slowRequestThreshold = threshold
+	return s
+}
+
+// requestTrace times the phases of one proxied request. A nil
+// *requestTrace times nothing.
+type requestTrace struct {
+	start        time.Time // edge accept
+	streamOpened time.Time
+
+	// Set from the goroutine reading the response
+	dial      atomic.Int64 // nanoseconds, as reported by the client (-1 = unknown)
+	firstByte atomic.Int64 // unix nanoseconds
+	lastByte  atomic.Int64 // unix nanoseconds
+}
+
+// newRequestTrace starts timing a request if the slow request log is on.
+func (s *Server) newRequestTrace(r *http.Request) *requestTrace {
+	if s.slowRequestThreshold <= 0 || isUpgrade(r) {
+		return nil
+	}
+	t := &requestTrace{start: time.Now()}
+	t.dial.Store(-1)
+	return t
+}
+
+// traceStream notes that the tunnel stream was opened and returns it wrapped
+// to time the response and read the client's timing line.
+func (t *requestTrace) traceStream(stream net.Conn, client *tunnelClient) net.Conn {
+	if t == nil {
+		return stripTiming(stream, client)
+	}
+	t.streamOpened = time.Now()
+	return &timingConn{Conn: stream, pending: client.timing, trace: t}
+}
+
+// log logs the request if it took longer than threshold.
+func (t *requestTrace) log(s *Server, r *http.Request, subdomain string) {
+	if t == nil || t.streamOpened.IsZero() {
+		return
+	}
+	total := time.Since(t.start)
+	if total < s.slowRequestThreshold {
+		return
+	}
+	s.metrics.slowRequests.Inc()
+
+	attrs := []any{"subdomain", subdomain, "method", r.Method, "path", r.URL.Path, "duration", total,
+		"stream_open", t.streamOpened.Sub(t.start)}
+	dial := time.Duration(t.dial.Load())
+	if dial >= 0 {
+		attrs = append(attrs, "local_dial", dial)
+	} else {
+		dial = 0
+	}
+	if first := t.firstByte.Load(); first != 0 {
+		firstByte, lastByte := time.Unix(0, first), time.Unix(0, t.lastByte.Load())
+		attrs = append(attrs, "first_byte", firstByte.Sub(t.streamOpened)-dial, "last_byte", lastByte.Sub(firstByte))
+	} else {
+		attrs = append(attrs, "first_byte", "none")
+	}
+	slog.Warn("slow request", attrs...)
+}
+
+// timingConn reads the timing line a client sends ahead of its response,
+// and times the response for trace (if non-nil).
+type timingConn struct {
+	net.Conn
+	pending bool // the timing line is still to be read
+	trace   *requestTrace
+}
+
+// stripTiming returns stream wrapped to discard the timing line of clients
+// that send one, for callers that don't trace the request.
+func stripTiming(stream net.Conn, client *tunnelClient) net.Conn {
+	if !client.timing {
+		return stream
+	}
+	return &timingConn{Conn: stream, pending: true}
+}
+
+func (c *timingConn) Read(b []byte) (int, error) {
+	if c.pending {
+		c.pending = false
+		dial, err := protocol.ReadStreamTiming(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.trace != nil {
+			c.trace.dial.Store(int64(dial))
+		}
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.trace != nil {
+		now := time.Now().UnixNano()
+		c.trace.firstByte.CompareAndSwap(0, now)
+		c.trace.lastByte.Store(now)
+	}
+	return n, err
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestSlowRequestTimingNegotiated(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		threshold time.Duration
+		offered   bool
+		want      bool
+	}{
+		{"log on, client offers", time.Second, true, true},
+		{"log on, old client", time.Second, false, false},
+		{"log off", 0, true, false},
+	} {
+		s := New("", "", "", "", "", nil).WithSlowRequestLog(tt.threshold)
+		registered, _ := mustRegister(t, s, &protocol.RegisterMessage{Timing: tt.offered})
+		if registered.Timing != tt.want {
+			t.Errorf("%s: registered timing = %v, want %v", tt.name, registered.Timing, tt.want)
+		}
+	}
+}
+
+func TestSlowRequestLog(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithSlowRequestLog(time.Nanosecond)
+	registered, session := mustRegister(t, s, &protocol.RegisterMessage{Timing: true})
+	go serveTunnelStreams(session, string(protocol.AppendStreamTiming(nil, time.Millisecond))+okResponse)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = registered.Subdomain + ".localhost"
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Errorf("response = %d %q, want 200 \"ok\" without the timing line", rec.Code, rec.Body.String())
+	}
+	if got := s.metrics.slowRequests.Value(); got != 1 {
+		t.Errorf("slow requests = %d, want 1", got)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bc183/otun/internal/proxy"
+)
+
+// clientHelloTimeout bounds how long a new HTTPS connection may take to send
+// its ClientHello before it is dropped.
+const clientHelloTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake once the ClientHello has been parsed.
+var errHelloRead = errors.New("client hello read")
+
+// WithTLSPassthrough lets clients register ProtocolTLS tunnels. HTTPS
+// connections are then routed by SNI before the handshake: those for a
+// passthrough tunnel are handed to the client undecrypted, the rest are
+// terminated here as usual. Requires a domain.
+func (s *Server) WithTLSPassthrough(enabled bool) *Server {
+	s.tlsPassthrough = enabled
+	return s
+}
+
+// passthroughEnabled reports whether ProtocolTLS tunnels may be registered.
+func (s *Server) passthroughEnabled() bool {
+	return s.tlsPassthrough && s.domain != ""
+}
+
+// readOnlyConn feeds a handshake from r and discards anything it writes.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// peekServerName reads the ClientHello from conn and returns the server
+// name it asks for ("" if none) and a connection that replays the bytes read.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	replay := &parsedConn{Conn: conn, reader: io.MultiReader(&buf, conn)}
+	if !errors.Is(err, errHelloRead) {
+		return "", replay, err
+	}
+	return serverName, replay, nil
+}
+
+// sniListener wraps an HTTPS listener and routes each connection by SNI.
+// Connections for passthrough tunnels are proxied straight to the tunnel;
+// Accept returns the rest, with their ClientHello replayed, for the HTTPS
+// server to terminate.
+type sniListener struct {
+	net.Listener
+	s *Server
+
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// newSNIListener starts routing connections accepted on ln.
+func (s *Server) newSNIListener(ln net.Listener) *sniListener {
+	l := &sniListener{
+		Listener: ln,
+		s:        s,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !l.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+// deliver hands r to Accept, reporting false if the listener was closed.
+func (l *sniListener) deliver(r acceptResult) bool {
+	select {
+	case l.accepted <- r:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// route reads conn's ClientHello and either proxies it to a passthrough
+// tunnel or hands it to Accept.
+func (l *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, replay, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		// Not TLS, or too slow; let the HTTPS server fail the handshake
+		slog.Debug("failed to read client hello", "remote_addr", conn.RemoteAddr(), "error", err)
+	}
+
+	if serverName != "" {
+		if client := l.s.lookupClient(l.s.subdomainForHost(serverName)); client != nil && client.passthrough {
+			l.s.servePassthrough(replay, client)
+			return
+		}
+	}
+
+	if !l.deliver(acceptResult{conn: replay}) {
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// servePassthrough proxies a TLS connection, ClientHello included, to the
+// tunnel client, which terminates TLS itself.
+func (s *Server) servePassthrough(conn net.Conn, client *tunnelClient) {
+	defer conn.Close()
+	if s.isBlocked(client.subdomain) != nil {
+		return
+	}
+	if err := s.acquireConn(client); err != nil {
+		slog.Warn("connection limit reached", "subdomain", client.subdomain, "error", err)
+		return
+	}
+	defer s.releaseConn(client)
+
+	stream, err := client.session.OpenStream()
+	if err != nil {
+		slog.Error("failed to open stream", "subdomain", client.subdomain, "error", err)
+		return
+	}
+	s.metrics.tlsPassthroughConns.Inc()
+	if err := proxy.BidirectionalContext(s.ctx, conn, stream); err != nil {
+		slog.Debug("proxy completed", "subdomain", client.subdomain, "error", err)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// startHandshake dials addr and starts a TLS handshake for serverName in the
+// background; the handshake itself is expected to fail.
+func startHandshake(t *testing.T, addr, serverName string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go tls.Client(conn, &tls.Config{ServerName: serverName}).Handshake()
+}
+
+// readRecordType reads the first byte of a TLS stream.
+func readRecordType(t *testing.T, r io.Reader) byte {
+	t.Helper()
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return b[0]
+}
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+	}{
+		{name: "with SNI", serverName: "demo.example.com"},
+		{name: "without SNI", serverName: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			go tls.Client(clientConn, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}).Handshake()
+
+			got, replay, err := peekServerName(serverConn)
+			if err != nil {
+				t.Fatalf("peekServerName: %v", err)
+			}
+			if got != tt.serverName {
+				t.Errorf("server name = %q, want %q", got, tt.serverName)
+			}
+
+			// The replayed connection still starts with the ClientHello
+			if typ := readRecordType(t, replay); typ != 0x16 {
+				t.Errorf("first byte = %#x, want handshake record", typ)
+			}
+		})
+	}
+}
+
+func TestSNIListenerRouting(t *testing.T) {
+	s := New("", "", "", "example.com", "", nil).WithTLSPassthrough(true)
+	session := registerTestTunnel(t, s, "pass")
+	s.lookupClient("pass").passthrough = true
+	registerTestTunnel(t, s, "plain")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	sni := s.newSNIListener(ln)
+	defer sni.Close()
+
+	// A passthrough tunnel gets the raw TLS stream
+	startHandshake(t, ln.Addr().String(), "pass.example.com")
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatalf("failed to accept stream: %v", err)
+	}
+	defer stream.Close()
+	if typ := readRecordType(t, stream); typ != 0x16 {
+		t.Errorf("tunnel stream starts with %#x, want handshake record", typ)
+	}
+	if got := s.metrics.tlsPassthroughConns.Value(); got != 1 {
+		t.Errorf("passthrough connections = %d, want 1", got)
+	}
+
+	// Anything else is accepted for the HTTPS server to terminate
+	startHandshake(t, ln.Addr().String(), "plain.example.com")
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := sni.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if typ := readRecordType(t, conn); typ != 0x16 {
+			t.Errorf("accepted connection starts with %#x, want handshake record", typ)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection for a terminated tunnel was not accepted")
+	}
+}
+
+func TestTLSPassthroughRegistration(t *testing.T) {
+	tests := []struct {
+		name     string
+		domain   string
+		enabled  bool
+		wantCode string
+	}{
+		{name: "enabled", domain: "example.com", enabled: true},
+		{name: "disabled", domain: "example.com", wantCode: protocol.ErrCodeTLSPassthroughDisabled},
+		{name: "no domain", enabled: true, wantCode: protocol.ErrCodeTLSPassthroughDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", tt.domain, "", nil).WithTLSPassthrough(tt.enabled)
+
+			reply := registerMessage(t, s, &protocol.RegisterMessage{Subdomain: "pass", Protocol: protocol.ProtocolTLS})
+			if tt.wantCode != "" {
+				if e, ok := reply.(*protocol.ErrorMessage); !ok || e.Code != tt.wantCode {
+					t.Errorf("reply = %+v, want %s error", reply, tt.wantCode)
+				}
+				return
+			}
+			if _, ok := reply.(*protocol.RegisteredMessage); !ok {
+				t.Fatalf("reply = %+v, want registered", reply)
+			}
+			if !s.lookupClient("pass").passthrough {
+				t.Error("tunnel not registered for passthrough")
+			}
+			if err := s.hostPolicy(t.Context(), "pass.example.com"); err == nil {
+				t.Error("hostPolicy allowed a certificate for a passthrough tunnel")
+			}
+		})
+	}
+}
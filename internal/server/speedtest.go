@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// speedTestTimeout bounds how long a speed test session may last.
+const speedTestTimeout = 2 * time.Minute
+
+// zeros is the payload sent to speed test clients.
+var zeros = make([]byte, 32<<10)
+
+// WithSpeedTest lets clients measure throughput to the server with transfers
+// of up to maxBytes each (0 = speed tests disabled).
+func (s *Server) WithSpeedTest(maxBytes int64) *Server {
+	s.speedTestMaxBytes = maxBytes
+	return s
+}
+
+// handleSpeedTest serves an otun speedtest client: heartbeats on the control
+// stream measure the round trip, and each stream the client opens uploads or
+// downloads a number of bytes. Nothing reaches a tunnel.
+func (s *Server) handleSpeedTest(remoteAddr net.Addr, session transport.Session, controlStream *protocol.ControlStream, msg *protocol.SpeedTestMessage, registered func()) {
+	defer session.Close()
+
+	if !s.validateToken(msg.Token) {
+		slog.Warn("invalid API key", "remote_addr", remoteAddr)
+		controlStream.SendErrorCode(protocol.ErrCodeUnauthorized, "invalid or missing API key")
+		return
+	}
+	if s.speedTestMaxBytes <= 0 {
+		controlStream.SendError("speed tests are disabled on this server")
+		return
+	}
+	if err := controlStream.SendSpeedTestReady(s.speedTestMaxBytes); err != nil {
+		slog.Error("failed to send speedtest ready message", "error", err)
+		return
+	}
+
+	slog.Info("speed test started", "remote_addr", remoteAddr, "token_id", tokenID(msg.Token))
+	s.metrics.speedTests.Inc()
+	registered()
+
+	timer := time.AfterFunc(speedTestTimeout, func() { session.Close() })
+	defer timer.Stop()
+
+	// Answer heartbeats until the control stream closes
+	go func() {
+		defer session.Close()
+		for {
+			msg, err := controlStream.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, ok := msg.(*protocol.HeartbeatMessage); ok {
+				if err := controlStream.SendHeartbeatAck(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			slog.Info("speed test finished", "remote_addr", remoteAddr)
+			return
+		}
+		go s.speedTestStream(stream)
+	}
+}
+
+// speedTestStream serves one speed test transfer.
+func (s *Server) speedTestStream(stream transport.Stream) {
+	defer stream.Close()
+
+	direction, n, err := protocol.ReadSpeedTestHeader(stream)
+	if err != nil {
+		slog.Debug("invalid speed test stream", "error", err)
+		return
+	}
+	n = min(n, s.speedTestMaxBytes)
+
+	switch direction {
+	case protocol.SpeedTestDownload:
+		for sent := int64(0); sent < n; {
+			m, err := stream.Write(zeros[:min(int64(len(zeros)), n-sent)])
+			sent += int64(m)
+			s.metrics.speedTestBytes.Add(uint64(m))
+			if err != nil {
+				return
+			}
+		}
+	case protocol.SpeedTestUpload:
+		received, err := io.Copy(io.Discard, io.LimitReader(stream, n))
+		s.metrics.speedTestBytes.Add(uint64(received))
+		if err != nil {
+			return
+		}
+		var ack [8]byte
+		binary.BigEndian.PutUint64(ack[:], uint64(received))
+		stream.Write(ack[:])
+	}
+}
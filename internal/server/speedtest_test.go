@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bc183/otun/internal/client"
+)
+
+// pipeDialer connects clients straight to a server's tunnel handler.
+type pipeDialer struct {
+	s *Server
+}
+
+func (d pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	go d.s.handleTunnelClient(serverConn, func() {})
+	return clientConn, nil
+}
+
+func TestSpeedTest(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithSpeedTest(1 << 20)
+
+	c := client.New("server:4443", "localhost:1").WithServerDialer(pipeDialer{s})
+	result, err := c.SpeedTest(context.Background(), 4<<20)
+	if err != nil {
+		t.Fatalf("SpeedTest() error = %v", err)
+	}
+
+	// The server caps transfers at its maximum
+	if result.DownloadBytes != 1<<20 || result.UploadBytes != 1<<20 {
+		t.Errorf("transferred %d down, %d up; want %d each", result.DownloadBytes, result.UploadBytes, 1<<20)
+	}
+	if result.RTT <= 0 || result.MinRTT > result.RTT {
+		t.Errorf("RTT = %v, MinRTT = %v", result.RTT, result.MinRTT)
+	}
+	if result.DownloadRate() <= 0 || result.UploadRate() <= 0 {
+		t.Errorf("rates = %v down, %v up", result.DownloadRate(), result.UploadRate())
+	}
+	if got := s.metrics.speedTestBytes.Value(); got != 2<<20 {
+		t.Errorf("otun_speedtest_bytes_total = %d, want %d", got, 2<<20)
+	}
+}
+
+func TestSpeedTestRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		s     *Server
+		token string
+		want  string
+	}{
+		{name: "disabled", s: New("", "", "", "", "", nil), want: "disabled"},
+		{name: "bad token", s: New("", "", "", "", "", []string{"key"}).WithSpeedTest(1 << 20), token: "wrong", want: "API key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client.New("server:4443", "localhost:1").WithServerDialer(pipeDialer{tt.s}).WithToken(tt.token)
+			_, err := c.SpeedTest(context.Background(), 1<<10)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("SpeedTest() error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import "fmt"
+
+// TakeoverPolicy controls whether a registration may evict the client that
+// currently holds the requested subdomain, e.g. a crashed client whose
+// session hasn't timed out yet.
+type TakeoverPolicy string
+
+const (
+	// TakeoverNever rejects registrations for subdomains in use.
+	TakeoverNever TakeoverPolicy = "never"
+
+	// TakeoverSameToken lets a client evict a session registered with the
+	// same (non-empty) API key.
+	TakeoverSameToken TakeoverPolicy = "same-token"
+
+	// TakeoverAlways lets any client evict the current session. Only
+	// suitable for single-user servers.
+	TakeoverAlways TakeoverPolicy = "always"
+)
+
+// ParseTakeoverPolicy parses a takeover policy name.
+func ParseTakeoverPolicy(s string) (TakeoverPolicy, error) {
+	switch p := TakeoverPolicy(s); p {
+	case TakeoverNever, TakeoverSameToken, TakeoverAlways:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid takeover policy %q (want never, same-token, or always)", s)
+	}
+}
+
+// canTakeOver reports whether a registration with token may evict existing.
+func (s *Server) canTakeOver(existing *tunnelClient, token string) bool {
+	switch s.takeoverPolicy {
+	case TakeoverAlways:
+		return true
+	case TakeoverSameToken:
+		return token != "" && existing.token == token
+	default:
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import "testing"
+
+func TestParseTakeoverPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    TakeoverPolicy
+		wantErr bool
+	}{
+		{"never", TakeoverNever, false},
+		{"same-token", TakeoverSameToken, false},
+		{"always", TakeoverAlways, false},
+		{"", "", true},
+		{"sometimes", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseTakeoverPolicy(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTakeoverPolicy(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTakeoverPolicy(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanTakeOver(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        TakeoverPolicy
+		existingToken string
+		token         string
+		want          bool
+	}{
+		{"never with same token", TakeoverNever, "key", "key", false},
+		{"same-token with same token", TakeoverSameToken, "key", "key", true},
+		{"same-token with other token", TakeoverSameToken, "key", "other", false},
+		{"same-token without auth", TakeoverSameToken, "", "", false},
+		{"always with other token", TakeoverAlways, "key", "other", true},
+		{"always without auth", TakeoverAlways, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithTakeoverPolicy(tt.policy)
+			existing := &tunnelClient{subdomain: "app", token: tt.existingToken}
+
+			if got := s.canTakeOver(existing, tt.token); got != tt.want {
+				t.Errorf("canTakeOver() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/proxy"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Min, Max int
+}
+
+// ParsePortRange parses "20000-20100" or a single port "20000".
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	max, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// contains reports whether port is in the range.
+func (r PortRange) contains(port int) bool {
+	return r.Min > 0 && port >= r.Min && port <= r.Max
+}
+
+// ParseReservedPorts parses "token=port,token=port" into a port -> token map.
+func ParseReservedPorts(s string) (map[int]string, error) {
+	reserved := make(map[int]string)
+	if s == "" {
+		return reserved, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		token, portStr, found := strings.Cut(entry, "=")
+		port, err := strconv.Atoi(portStr)
+		if !found || token == "" || err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid reserved port %q (want token=port)", entry)
+		}
+		if _, dup := reserved[port]; dup {
+			return nil, fmt.Errorf("port %d reserved twice", port)
+		}
+		reserved[port] = token
+	}
+	return reserved, nil
+}
+
+// WithTCPPorts enables TCP tunnels. Clients get a port from ports unless
+// they request one; reserved maps ports (inside or outside the range) to
+// the only token allowed to use them.
+func (s *Server) WithTCPPorts(ports PortRange, reserved map[int]string) *Server {
+	s.tcpPorts = ports
+	s.reservedPorts = reserved
+	return s
+}
+
+// portError is a TCP port allocation failure with a protocol error code.
+type portError struct {
+	code string
+	msg  string
+}
+
+func (e *portError) Error() string {
+	return e.msg
+}
+
+// tcpEnabled reports whether TCP tunnels may be registered.
+func (s *Server) tcpEnabled() bool {
+	return s.tcpPorts.Min > 0 || len(s.reservedPorts) > 0 || len(s.policies.load().reservedPorts()) > 0
+}
+
+// allocateTCPPort opens the public listener for a TCP tunnel. It returns the
+// client evicted from the port, if the takeover policy allowed one or it is
+// the session being resumed.
+// Must be called with s.mu held.
+func (s *Server) allocateTCPPort(requested int, token string, resumed *resumption) (net.Listener, *tunnelClient, error) {
+	if !s.tcpEnabled() {
+		return nil, nil, &portError{protocol.ErrCodeTCPDisabled, "TCP tunnels are not enabled on this server"}
+	}
+
+	if requested > 0 {
+		owner, reserved := s.portOwner(requested)
+		if reserved && owner != token {
+			return nil, nil, &portError{protocol.ErrCodePortReserved, fmt.Sprintf("port %d is reserved by another token", requested)}
+		}
+		if !reserved && !s.tcpPorts.contains(requested) {
+			return nil, nil, &portError{protocol.ErrCodePortNotAllowed,
+				fmt.Sprintf("port %d is outside the allowed range %d-%d", requested, s.tcpPorts.Min, s.tcpPorts.Max)}
+		}
+
+		existing := s.tcpTunnels[requested]
+		if existing != nil {
+			ownSession := resumed != nil && existing.resumeToken == resumed.token
+			if !ownSession && !s.canTakeOver(existing, token) {
+				return nil, nil, &portError{protocol.ErrCodePortInUse, fmt.Sprintf("port %d is already in use", requested)}
+			}
+			// Free the port for the new client
+			existing.tcpListener.Close()
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(requested)))
+		if err != nil {
+			return nil, nil, &portError{protocol.ErrCodePortInUse, fmt.Sprintf("port %d is not available", requested)}
+		}
+		return ln, existing, nil
+	}
+
+	// Prefer the token's own reserved ports, then any free port in the range
+	candidates := s.portsReservedFor(token)
+	if n := s.tcpPorts.Max - s.tcpPorts.Min + 1; s.tcpPorts.Min > 0 {
+		offset := rand.IntN(n)
+		for i := 0; i < n; i++ {
+			candidates = append(candidates, s.tcpPorts.Min+(offset+i)%n)
+		}
+	}
+	for _, port := range candidates {
+		if owner, reserved := s.portOwner(port); reserved && owner != token {
+			continue
+		}
+		if s.tcpTunnels[port] != nil {
+			continue
+		}
+		if ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port))); err == nil {
+			return ln, nil, nil
+		}
+	}
+	return nil, nil, &portError{protocol.ErrCodePortInUse, "no free TCP ports available"}
+}
+
+// handleTCPRegister registers a TCP tunnel, resuming the one resumed
+// restores if it is set, and serves it until the client disconnects.
+func (s *Server) handleTCPRegister(conn net.Conn, session transport.Session, controlStream *protocol.ControlStream, msg *protocol.RegisterMessage, resumed *resumption, registered func()) {
+	if err := s.groupFor(msg.Token, "").check(msg); err != nil {
+		slog.Warn("TCP tunnel refused by its group", "token_id", tokenID(msg.Token), "error", err)
+		controlStream.SendErrorCode(protocol.ErrCodeGroupPolicy, err.Error())
+		session.Close()
+		return
+	}
+
+	requested := msg.RemotePort
+	if resumed != nil {
+		requested = resumed.remotePort
+	}
+	s.mu.Lock()
+	ln, existing, err := s.allocateTCPPort(requested, msg.Token, resumed)
+	if err != nil {
+		s.mu.Unlock()
+		var pe *portError
+		errors.As(err, &pe)
+		slog.Warn("TCP port unavailable", "requested_port", requested, "code", pe.code, "token_id", tokenID(msg.Token))
+		controlStream.SendErrorCode(pe.code, pe.msg)
+		session.Close()
+		return
+	}
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	now := time.Now()
+	client := &tunnelClient{
+		token:         msg.Token,
+		remoteAddr:    conn.RemoteAddr().String(),
+		session:       session,
+		controlStream: controlStream,
+		connectedAt:   now,
+		lastHeartbeat: now,
+		remotePort:    port,
+		tcpListener:   ln,
+		labels:        msg.Labels,
+	}
+	s.applyGroup(client)
+	s.tcpTunnels[port] = client
+	if existing != nil {
+		s.dropResumption(existing)
+	}
+	resumeToken := s.issueResumption(client, msg.Protocol)
+	s.mu.Unlock()
+	if resumed != nil {
+		resumeSession(session, resumed)
+	}
+
+	if existing != nil {
+		slog.Warn("TCP tunnel taken over", "port", port,
+			"old_remote_addr", existing.remoteAddr,
+			"new_remote_addr", client.remoteAddr,
+		)
+		existing.controlStream.SendError("tunnel taken over by another client")
+		existing.session.Close()
+	}
+
+	slog.Info("TCP tunnel registered", "port", port, "remote_addr", client.remoteAddr)
+	s.audit("TCP tunnel registered", "port", port, "token_id", tokenID(msg.Token), "remote_addr", client.remoteAddr)
+
+	defer s.removeTCPTunnel(client)
+	if err := controlStream.SendRegisteredMessage(&protocol.RegisteredMessage{
+		URL:         s.tcpTunnelURL(port),
+		RemotePort:  port,
+		ResumeToken: resumeToken,
+		TunnelID:    msg.TunnelID,
+	}); err != nil {
+		slog.Error("failed to send registered message", "error", err)
+		session.Close()
+		return
+	}
+
+	go s.serveTCPTunnel(client)
+	registered()
+	s.handleControlStream(client)
+}
+
+// tcpTunnelURL builds the public address of a TCP tunnel.
+func (s *Server) tcpTunnelURL(port int) string {
+	host := s.domain
+	if host == "" {
+		host = "localhost"
+	}
+	return "tcp://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// serveTCPTunnel proxies public connections to the tunnel until its listener
+// is closed.
+func (s *Server) serveTCPTunnel(client *tunnelClient) {
+	for {
+		conn, err := client.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.acquireConn(client); err != nil {
+				slog.Warn("connection limit reached", "port", client.remotePort, "error", err)
+				return
+			}
+			defer s.releaseConn(client)
+			stream, err := client.session.OpenStream()
+			if err != nil {
+				slog.Error("failed to open stream", "port", client.remotePort, "error", err)
+				return
+			}
+			if err := proxy.BidirectionalContext(s.ctx, conn, client.bandwidth.limit(stream)); err != nil {
+				slog.Debug("proxy completed", "port", client.remotePort, "error", err)
+			}
+		}()
+	}
+}
+
+// removeTCPTunnel closes a TCP tunnel's listener and forgets it, unless it
+// has already been replaced.
+func (s *Server) removeTCPTunnel(client *tunnelClient) {
+	client.tcpListener.Close()
+	s.mu.Lock()
+	if s.tcpTunnels[client.remotePort] != client {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.tcpTunnels, client.remotePort)
+	s.markResumable(client)
+	s.mu.Unlock()
+	slog.Info("TCP tunnel unregistered", "port", client.remotePort)
+	s.audit("TCP tunnel unregistered", "port", client.remotePort, "remote_addr", client.remoteAddr)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortRange
+		wantErr bool
+	}{
+		{in: "20000-20100", want: PortRange{20000, 20100}},
+		{in: "20000", want: PortRange{20000, 20000}},
+		{in: "20100-20000", wantErr: true},
+		{in: "0-10", wantErr: true},
+		{in: "1-70000", wantErr: true},
+		{in: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePortRange(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePortRange(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePortRange(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseReservedPorts(t *testing.T) {
+	got, err := ParseReservedPorts("key1=20001,key2=22")
+	if err != nil {
+		t.Fatalf("ParseReservedPorts: %v", err)
+	}
+	if got[20001] != "key1" || got[22] != "key2" || len(got) != 2 {
+		t.Errorf("got %v", got)
+	}
+
+	for _, bad := range []string{"key1", "key1=abc", "=20001", "a=1,b=1"} {
+		if _, err := ParseReservedPorts(bad); err == nil {
+			t.Errorf("ParseReservedPorts(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+// freePort returns a port that was free a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// registerTCP performs a TCP tunnel registration against s and returns the
+// server's reply and the client's session.
+func registerTCP(t *testing.T, s *Server, token string, port int) (any, transport.Session) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	go s.handleTunnelClient(serverConn, func() {})
+
+	session, err := transport.Default().Client(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client session: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("failed to open control stream: %v", err)
+	}
+	cs := protocol.NewControlStream(stream)
+	if err := cs.SendRegisterMessage(&protocol.RegisterMessage{Token: token, Protocol: protocol.ProtocolTCP, RemotePort: port}); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	msg, err := cs.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	return msg, session
+}
+
+func TestTCPPortErrors(t *testing.T) {
+	inRange := freePort(t)
+	reserved := freePort(t)
+
+	tests := []struct {
+		name     string
+		disabled bool
+		token    string
+		port     int
+		wantCode string
+	}{
+		{name: "TCP disabled", disabled: true, wantCode: protocol.ErrCodeTCPDisabled},
+		{name: "outside range", port: 1, wantCode: protocol.ErrCodePortNotAllowed},
+		{name: "reserved by another token", token: "key2", port: reserved, wantCode: protocol.ErrCodePortReserved},
+		{name: "in use", token: "key2", port: inRange, wantCode: protocol.ErrCodePortInUse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil)
+			if !tt.disabled {
+				s.WithTCPPorts(PortRange{inRange, inRange}, map[int]string{reserved: "key1"})
+				// Occupy the range's only port with another tunnel
+				if msg, _ := registerTCP(t, s, "key1", inRange); msg.(*protocol.RegisteredMessage).RemotePort != inRange {
+					t.Fatalf("setup registration failed: %+v", msg)
+				}
+			}
+
+			msg, _ := registerTCP(t, s, tt.token, tt.port)
+			errMsg, ok := msg.(*protocol.ErrorMessage)
+			if !ok {
+				t.Fatalf("got %T, want ErrorMessage", msg)
+			}
+			if errMsg.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q (%s)", errMsg.Code, tt.wantCode, errMsg.Message)
+			}
+		})
+	}
+}
+
+func TestTCPTunnel(t *testing.T) {
+	port := freePort(t)
+	reserved := freePort(t)
+	s := New("", "", "", "", "", nil).WithTCPPorts(PortRange{port, port}, map[int]string{reserved: "key1"})
+
+	// The token's reserved port is preferred when no port is requested
+	msg, session := registerTCP(t, s, "key1", 0)
+	registered, ok := msg.(*protocol.RegisteredMessage)
+	if !ok {
+		t.Fatalf("got %T, want RegisteredMessage", msg)
+	}
+	if registered.RemotePort != reserved || registered.URL != "tcp://localhost:"+strconv.Itoa(reserved) {
+		t.Fatalf("registered = %+v, want port %d", registered, reserved)
+	}
+
+	// Echo server on the client side of the tunnel
+	go func() {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(reserved)))
+	if err != nil {
+		t.Fatalf("failed to dial public port: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+
+	// Disconnecting frees the port
+	session.Close()
+	waitFor(t, 2*time.Second, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return len(s.tcpTunnels) == 0
+	})
+	if ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(reserved))); err != nil {
+		t.Errorf("port not released: %v", err)
+	} else {
+		ln.Close()
+	}
+}
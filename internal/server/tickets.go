@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ticketKeyRetention is how many session ticket keys are kept when rotating
+// them in-process, so tickets stay resumable for that many rotations. With
+// the default daily rotation this matches crypto/tls's own behavior.
+const ticketKeyRetention = 7
+
+// sessionTickets manages the keys that encrypt TLS session tickets, which
+// let returning visitors resume a session without a full handshake.
+type sessionTickets struct {
+	disabled bool
+	file     string // shared key file (empty = generate keys in-process)
+	rotation time.Duration
+
+	mu            sync.Mutex
+	keys          [][32]byte // keys[0] encrypts new tickets
+	raw           []byte     // contents of file the keys were read from
+	activeSince   time.Time
+	configs       []*tls.Config
+	lastReloadErr error
+	rotations     func()
+}
+
+// WithSessionTickets configures TLS session resumption. With keyFile set,
+// ticket keys are read from it and re-read when it changes, so every server
+// behind a load balancer can resume sessions started on the others; the
+// first key encrypts new tickets and the rest only decrypt. Otherwise a new
+// key is generated every rotation. Disabling turns resumption off.
+func (s *Server) WithSessionTickets(enabled bool, rotation time.Duration, keyFile string) *Server {
+	s.tickets = &sessionTickets{
+		disabled:  !enabled,
+		file:      keyFile,
+		rotation:  rotation,
+		rotations: s.metrics.ticketKeyRotations.Inc,
+	}
+	s.metrics.registry.NewGaugeFunc("otun_tls_ticket_key_age_seconds", "Time since the session ticket key encrypting new tickets became active.", s.tickets.activeKeyAge)
+	return s
+}
+
+// configureTLS applies the session ticket settings to cfg, counts its
+// handshakes, and asks for client certificates where private tunnels accept
+// them.
+func (s *Server) configureTLS(cfg *tls.Config) *tls.Config {
+	s.tickets.configure(cfg)
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		s.metrics.tlsHandshakes.Inc()
+		if cs.DidResume {
+			s.metrics.tlsResumedHandshakes.Inc()
+		}
+		return nil
+	}
+	cfg.GetConfigForClient = s.requestClientCerts(cfg)
+	return cfg
+}
+
+// start loads or generates the first keys and keeps them current until
+// done is closed. It does nothing if tickets are disabled or unmanaged.
+func (t *sessionTickets) start(done <-chan struct{}) error {
+	if t == nil || t.disabled {
+		return nil
+	}
+	interval := t.rotation
+	if t.file != "" {
+		if _, err := t.reload(); err != nil {
+			return err
+		}
+		slog.Info("TLS session ticket keys loaded", "file", t.file)
+		interval = certReloadInterval
+	} else {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+	go t.watch(done, interval)
+	return nil
+}
+
+// configure makes cfg use the managed keys, now and after every rotation.
+func (t *sessionTickets) configure(cfg *tls.Config) {
+	if t == nil {
+		return
+	}
+	if t.disabled {
+		cfg.SessionTicketsDisabled = true
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.configs = append(t.configs, cfg)
+	if len(t.keys) > 0 {
+		cfg.SetSessionTicketKeys(t.keys)
+	}
+}
+
+// watch rotates or reloads the keys every interval until done is closed.
+func (t *sessionTickets) watch(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if t.file == "" {
+			if err := t.rotate(); err != nil {
+				slog.Warn("failed to rotate TLS session ticket key", "error", err)
+			}
+			continue
+		}
+
+		changed, err := t.reload()
+		t.mu.Lock()
+		repeated := err != nil && t.lastReloadErr != nil && err.Error() == t.lastReloadErr.Error()
+		t.lastReloadErr = err
+		t.mu.Unlock()
+
+		switch {
+		case err != nil && !repeated:
+			slog.Warn("failed to reload TLS session ticket keys, keeping the current ones", "file", t.file, "error", err)
+		case changed:
+			slog.Info("TLS session ticket keys reloaded", "file", t.file)
+		}
+	}
+}
+
+// rotate generates a new key for encrypting tickets, keeping the previous
+// ones for decryption.
+func (t *sessionTickets) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("failed to generate session ticket key: %w", err)
+	}
+
+	t.mu.Lock()
+	keys := append([][32]byte{key}, t.keys...)
+	if len(keys) > ticketKeyRetention {
+		keys = keys[:ticketKeyRetention]
+	}
+	t.mu.Unlock()
+	t.install(keys)
+	return nil
+}
+
+// reload reads the key file, reporting whether it changed. A failed reload
+// keeps the current keys.
+func (t *sessionTickets) reload() (bool, error) {
+	data, err := os.ReadFile(t.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to read session ticket keys: %w", err)
+	}
+
+	t.mu.Lock()
+	unchanged := bytes.Equal(data, t.raw)
+	t.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	keys, err := parseTicketKeys(data)
+	if err != nil {
+		return false, fmt.Errorf("invalid session ticket keys in %s: %w", t.file, err)
+	}
+	t.mu.Lock()
+	t.raw = data
+	t.mu.Unlock()
+	t.install(keys)
+	return true, nil
+}
+
+// install makes keys current on every configured tls.Config.
+func (t *sessionTickets) install(keys [][32]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.keys) == 0 || t.keys[0] != keys[0] {
+		t.activeSince = time.Now()
+		if len(t.keys) > 0 {
+			t.rotations()
+		}
+	}
+	t.keys = keys
+	for _, cfg := range t.configs {
+		cfg.SetSessionTicketKeys(keys)
+	}
+}
+
+// activeKeyAge returns the seconds since the current encryption key became
+// active.
+func (t *sessionTickets) activeKeyAge() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.activeSince.IsZero() {
+		return 0
+	}
+	return time.Since(t.activeSince).Seconds()
+}
+
+// parseTicketKeys parses one 32-byte key per line, hex or base64 encoded
+// (e.g. from "openssl rand -hex 32"). Blank lines and lines starting with
+// # are ignored.
+func parseTicketKeys(data []byte) ([][32]byte, error) {
+	var keys [][32]byte
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil {
+			b, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("line %d: want a 32-byte key in hex or base64", i+1)
+		}
+		keys = append(keys, [32]byte(b))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
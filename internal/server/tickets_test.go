@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testTLSConfig returns a config serving a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestCert(t, dir, "app.tunnel.example.com")
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certFileName), filepath.Join(dir, keyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// handshake connects to a server using cfg and reports whether the session
+// was resumed from cache.
+func handshake(t *testing.T, cfg *tls.Config, cache tls.ClientSessionCache) bool {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn := tls.Server(c, cfg)
+		defer conn.Close()
+		if err := conn.Handshake(); err != nil {
+			t.Errorf("server handshake: %v", err)
+			return
+		}
+		// Session tickets follow the handshake in TLS 1.3
+		conn.Write([]byte("x"))
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	client := tls.Client(c, &tls.Config{
+		ServerName:         "app.tunnel.example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: cache,
+	})
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return client.ConnectionState().DidResume
+}
+
+func TestSessionTicketsSharedKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "ticket-keys")
+	os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0o600)
+
+	// Two replicas sharing the key file
+	a := New("", "", "", "", "", nil).WithSessionTickets(true, 0, keyFile)
+	b := New("", "", "", "", "", nil).WithSessionTickets(true, 0, keyFile)
+	done := make(chan struct{})
+	defer close(done)
+	for _, s := range []*Server{a, b} {
+		if err := s.tickets.start(done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfgA := a.configureTLS(testTLSConfig(t))
+	cfgB := b.configureTLS(testTLSConfig(t))
+
+	cache := tls.NewLRUClientSessionCache(1)
+	if handshake(t, cfgA, cache) {
+		t.Fatal("first handshake resumed")
+	}
+	if !handshake(t, cfgB, cache) {
+		t.Error("session from one replica was not resumed on the other")
+	}
+	if a.metrics.tlsHandshakes.Value() != 1 || b.metrics.tlsResumedHandshakes.Value() != 1 {
+		t.Errorf("handshakes = %d, resumed = %d; want 1, 1", a.metrics.tlsHandshakes.Value(), b.metrics.tlsResumedHandshakes.Value())
+	}
+
+	// Replacing the keys invalidates earlier tickets
+	os.WriteFile(keyFile, []byte(strings.Repeat("cd", 32)+"\n"), 0o600)
+	if changed, err := b.tickets.reload(); !changed || err != nil {
+		t.Fatalf("reload() = %v, %v", changed, err)
+	}
+	if handshake(t, cfgB, cache) {
+		t.Error("session resumed with a removed key")
+	}
+	if b.metrics.ticketKeyRotations.Value() != 1 {
+		t.Errorf("rotations = %d, want 1", b.metrics.ticketKeyRotations.Value())
+	}
+}
+
+func TestSessionTicketsRotation(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithSessionTickets(true, 0, "")
+	if err := s.tickets.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := s.configureTLS(testTLSConfig(t))
+
+	cache := tls.NewLRUClientSessionCache(1)
+	handshake(t, cfg, cache)
+
+	// Earlier keys still decrypt until they age out
+	for i := 1; i < ticketKeyRetention; i++ {
+		s.tickets.rotate()
+	}
+	if !handshake(t, cfg, cache) {
+		t.Error("session not resumed after rotation")
+	}
+	cache = tls.NewLRUClientSessionCache(1)
+	handshake(t, cfg, cache)
+	for i := 0; i < ticketKeyRetention; i++ {
+		s.tickets.rotate()
+	}
+	if handshake(t, cfg, cache) {
+		t.Error("session resumed with an expired key")
+	}
+}
+
+func TestSessionTicketsDisabled(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithSessionTickets(false, 0, "")
+	if err := s.tickets.start(nil); err != nil {
+		t.Fatal(err)
+	}
+	cfg := s.configureTLS(testTLSConfig(t))
+
+	cache := tls.NewLRUClientSessionCache(1)
+	handshake(t, cfg, cache)
+	if handshake(t, cfg, cache) {
+		t.Error("session resumed with tickets disabled")
+	}
+}
+
+func TestParseTicketKeys(t *testing.T) {
+	hexKey := strings.Repeat("0f", 32)
+	b64Key := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	tests := []struct {
+		name    string
+		data    string
+		want    int
+		wantErr bool
+	}{
+		{name: "hex", data: hexKey, want: 1},
+		{name: "base64", data: b64Key, want: 1},
+		{name: "several with comments", data: "# current\n" + hexKey + "\n\n" + b64Key + "\n", want: 2},
+		{name: "short key", data: "abcd", wantErr: true},
+		{name: "empty", data: "# nothing\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseTicketKeys([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTicketKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(keys) != tt.want {
+				t.Errorf("got %d keys, want %d", len(keys), tt.want)
+			}
+		})
+	}
+}
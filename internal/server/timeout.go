@@ -0,0 +1,183 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errRequestTimeout is returned by reads from a tunnel stream once the
+// maximum request duration has passed.
+var errRequestTimeout = errors.New("maximum request duration exceeded")
+
+// timeoutResponse is written to hijacked connections that time out before
+// the tunnel sent any response.
+var timeoutResponse = func() string {
+	body := "Tunnel request exceeded the maximum duration\n"
+	return fmt.Sprintf("HTTP/1.1 504 Gateway Timeout\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}()
+
+// States of a durationLimitedConn.
+const (
+	limitAwaitingResponse int32 = iota
+	limitResponding
+	limitExpired
+)
+
+// WithMaxRequestDuration caps the total time a proxied request may take,
+// independent of activity. When the cap is reached the tunnel stream is
+// closed and, if no response has started yet, the visitor gets a 504.
+// Protocol upgrades (WebSockets) are exempt once the local service has
+// switched protocols. Zero means no limit.
+func (s *Server) WithMaxRequestDuration(d time.Duration) *Server {
+	s.maxRequestDuration = d
+	return s
+}
+
+// durationLimitedConn wraps a tunnel stream and cuts it off once the maximum
+// request duration has passed.
+type durationLimitedConn struct {
+	net.Conn
+	state atomic.Int32
+	timer *time.Timer
+
+	// noResponse is set if the limit expired before any response byte
+	noResponse atomic.Bool
+}
+
+// limitDuration starts enforcing s.maxRequestDuration on stream. clientConn,
+// if non-nil, is the hijacked visitor connection: it receives the 504 and is
+// closed on expiry. Callers must call stop when the request completes.
+func (s *Server) limitDuration(stream, clientConn net.Conn, subdomain string) *durationLimitedConn {
+	c := &durationLimitedConn{Conn: stream}
+	c.timer = time.AfterFunc(s.maxRequestDuration, func() {
+		beforeResponse := c.state.CompareAndSwap(limitAwaitingResponse, limitExpired)
+		c.state.Store(limitExpired)
+		c.noResponse.Store(beforeResponse)
+
+		s.metrics.requestTimeouts.Inc()
+		slog.Warn("request exceeded maximum duration", "subdomain", subdomain,
+			"max_duration", s.maxRequestDuration, "response_started", !beforeResponse)
+
+		if clientConn != nil {
+			if beforeResponse {
+				clientConn.Write([]byte(timeoutResponse))
+			}
+			clientConn.Close()
+		}
+		// Unblock any pending reads and writes on the stream
+		stream.SetDeadline(time.Now())
+	})
+	return c
+}
+
+// Read passes data through until the limit expires, after which it returns
+// errRequestTimeout (discarding any late response).
+func (c *durationLimitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.state.CompareAndSwap(limitAwaitingResponse, limitResponding) && c.state.Load() == limitExpired {
+		return 0, errRequestTimeout
+	}
+	if err != nil && c.state.Load() == limitExpired {
+		err = errRequestTimeout
+	}
+	return n, err
+}
+
+// expiredBeforeResponse reports whether the limit expired before a
+// response started, i.e. the visitor got a 504.
+func (c *durationLimitedConn) expiredBeforeResponse() bool {
+	return c.noResponse.Load()
+}
+
+// stop cancels the timer.
+func (c *durationLimitedConn) stop() {
+	c.timer.Stop()
+}
+
+// errNotUpgraded is returned by writes to an upgradeConn whose upgrade the
+// local service refused.
+var errNotUpgraded = errors.New("upgrade refused by the local service")
+
+// upgradeConn holds a visitor's bytes back from a tunnel stream until the
+// local service has answered an upgrade request. Only a 101 Switching
+// Protocols lets them through; after any other response, anything more the
+// visitor sends closes the stream, so claiming an upgrade can't carry
+// further requests past the edge checks.
+type upgradeConn struct {
+	net.Conn
+	once     sync.Once
+	decided  chan struct{}
+	switched bool
+	pending  []byte // sent by the visitor before the answer
+}
+
+func newUpgradeConn(stream net.Conn) *upgradeConn {
+	return &upgradeConn{Conn: stream, decided: make(chan struct{})}
+}
+
+// decide lets the visitor's bytes through if status is 101.
+func (c *upgradeConn) decide(status int) {
+	c.once.Do(func() {
+		c.switched = status == http.StatusSwitchingProtocols
+		if c.switched && len(c.pending) > 0 {
+			c.Conn.Write(c.pending)
+		}
+		c.pending = nil
+		close(c.decided)
+	})
+}
+
+// hold queues bytes the visitor sent before the answer.
+// Must be called before the connection is proxied.
+func (c *upgradeConn) hold(b []byte) {
+	c.pending = append(c.pending, b...)
+}
+
+func (c *upgradeConn) Write(b []byte) (int, error) {
+	<-c.decided
+	if !c.switched {
+		c.Conn.Close()
+		return 0, errNotUpgraded
+	}
+	return c.Conn.Write(b)
+}
+
+// Read refuses the upgrade if the stream ends without an answer.
+func (c *upgradeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.decide(0)
+	}
+	return n, err
+}
+
+func (c *upgradeConn) Close() error {
+	c.decide(0)
+	return c.Conn.Close()
+}
+
+// isUpgrade reports whether r asks to switch protocols (e.g. WebSocket): an
+// HTTP/1.1 request naming a protocol in Upgrade and listing "upgrade" in
+// Connection, as the handshake requires. The visitor controls both, so a
+// request only escapes limits as an upgrade once the local service has
+// answered 101 Switching Protocols.
+func isUpgrade(r *http.Request) bool {
+	if r.ProtoMajor != 1 || r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
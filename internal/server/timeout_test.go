@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/transport"
+)
+
+// serveSlowTunnel answers each stream with head, then after delay with tail.
+func serveSlowTunnel(session transport.Session, head string, delay time.Duration, tail string) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			if _, err := http.ReadRequest(bufio.NewReader(stream)); err != nil {
+				return
+			}
+			io.WriteString(stream, head)
+			time.Sleep(delay)
+			io.WriteString(stream, tail)
+		}()
+	}
+}
+
+func TestMaxRequestDuration(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	tests := []struct {
+		name       string
+		hijack     bool
+		head       string
+		delay      time.Duration
+		tail       string
+		wantStatus int
+		wantErr    bool // the response is cut off mid-body
+	}{
+		{
+			name:       "fast response",
+			hijack:     true,
+			tail:       okResponse,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no response in time",
+			hijack:     true,
+			delay:      time.Second,
+			tail:       okResponse,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "no response in time without hijacking",
+			delay:      time.Second,
+			tail:       okResponse,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "body stalls",
+			hijack:     true,
+			head:       "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nab",
+			delay:      time.Second,
+			tail:       "cd",
+			wantStatus: http.StatusOK,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithMaxRequestDuration(limit)
+			go serveSlowTunnel(registerTestTunnel(t, s, "app"), tt.head, tt.delay, tt.tail)
+
+			start := time.Now()
+			var status int
+			var readErr error
+			if tt.hijack {
+				ts := httptest.NewServer(s)
+				defer ts.Close()
+				req, _ := http.NewRequest("GET", ts.URL, nil)
+				req.Host = "app.localhost"
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				_, readErr = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				status = resp.StatusCode
+			} else {
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, httptest.NewRequest("GET", "http://app.localhost/", nil))
+				status = rec.Code
+			}
+
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if (readErr != nil) != tt.wantErr {
+				t.Errorf("body error = %v, want error: %v", readErr, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("request took %v, want it cut off near %v", elapsed, limit)
+			}
+		})
+	}
+}
+
+func TestMaxRequestDurationUpgrade(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		head     string
+		tail     string
+		wantBody string
+		wantErr  bool
+	}{
+		{
+			name:     "switched protocols",
+			head:     "HTTP/1.1 101 Switching Protocols\r\nUpgrade: x\r\nConnection: Upgrade\r\n\r\n",
+			tail:     "late",
+			wantBody: "late",
+		},
+		{
+			name:    "upgrade refused",
+			head:    "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nab",
+			tail:    "cd",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithMaxRequestDuration(limit)
+			go serveSlowTunnel(registerTestTunnel(t, s, "app"), tt.head, 3*limit, tt.tail)
+
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			req.Host = "app.localhost"
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "x")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("body error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMaxRequestDurationCountsTimeouts(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithMaxRequestDuration(50 * time.Millisecond)
+	go serveSlowTunnel(registerTestTunnel(t, s, "app"), "", time.Second, okResponse)
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.localhost/", nil))
+
+	var out strings.Builder
+	s.Metrics().WriteTo(&out)
+	if !strings.Contains(out.String(), "otun_request_duration_exceeded_total 1\n") {
+		t.Errorf("timeout not counted:\n%s", out.String())
+	}
+}
+
+func TestIsUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		proto   string
+		headers map[string]string
+		want    bool
+	}{
+		{"websocket", "HTTP/1.1", map[string]string{"Upgrade": "websocket", "Connection": "Upgrade"}, true},
+		{"connection token list", "HTTP/1.1", map[string]string{"Upgrade": "websocket", "Connection": "keep-alive, upgrade"}, true},
+		{"plain request", "HTTP/1.1", nil, false},
+		{"upgrade header alone", "HTTP/1.1", map[string]string{"Upgrade": "websocket"}, false},
+		{"connection alone", "HTTP/1.1", map[string]string{"Connection": "upgrade"}, false},
+		{"other connection token", "HTTP/1.1", map[string]string{"Upgrade": "websocket", "Connection": "upgraded"}, false},
+		{"http/2", "HTTP/2.0", map[string]string{"Upgrade": "websocket", "Connection": "Upgrade"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Proto = tt.proto
+			r.ProtoMajor, r.ProtoMinor, _ = http.ParseHTTPVersion(tt.proto)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := isUpgrade(r); got != tt.want {
+				t.Errorf("isUpgrade() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStatsTunnels is how many subdomains keep traffic time series.
+const defaultStatsTunnels = 1000
+
+// statsResolution is one granularity of the traffic time series: points
+// buckets of step each.
+type statsResolution struct {
+	name   string
+	step   time.Duration
+	points int
+}
+
+// statsResolutions cover the last hour by minute, the last day by five
+// minutes, and the last week by hour.
+var statsResolutions = []statsResolution{
+	{name: "1m", step: time.Minute, points: 60},
+	{name: "5m", step: 5 * time.Minute, points: 288},
+	{name: "1h", step: time.Hour, points: 168},
+}
+
+// statsBucket is the traffic of one time step.
+type statsBucket struct {
+	start    int64 // unix seconds; buckets from an earlier lap are stale
+	requests uint64
+	errors   uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// tunnelSeries holds a ring buffer per resolution for one subdomain.
+type tunnelSeries struct {
+	rings   [][]statsBucket // indexed like statsResolutions
+	updated time.Time
+}
+
+// tunnelStats keeps per-subdomain request, error, and bandwidth time series
+// for the admin API, so charts don't need an external time series database.
+type tunnelStats struct {
+	maxTunnels int
+
+	mu     sync.Mutex
+	series map[string]*tunnelSeries // subdomain -> series
+}
+
+// statsPoint is one time step in the admin API.
+type statsPoint struct {
+	Time     time.Time `json:"time"`
+	Requests uint64    `json:"requests"`
+	Errors   uint64    `json:"errors"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+
+	// Per-second averages over the step
+	RequestRate  float64 `json:"request_rate"`
+	ErrorRate    float64 `json:"error_rate"`
+	BytesInRate  float64 `json:"bytes_in_rate"`
+	BytesOutRate float64 `json:"bytes_out_rate"`
+}
+
+// newTunnelStats keeps series for up to maxTunnels subdomains; 0 disables
+// them.
+func newTunnelStats(maxTunnels int) *tunnelStats {
+	if maxTunnels <= 0 {
+		return nil
+	}
+	return &tunnelStats{maxTunnels: maxTunnels, series: make(map[string]*tunnelSeries)}
+}
+
+// WithTunnelStats keeps request, error, and bandwidth time series for up
+// to maxTunnels subdomains, served by the admin API. The subdomain with the
+// least recent traffic is forgotten first. 0 disables the series.
+func (s *Server) WithTunnelStats(maxTunnels int) *Server {
+	s.stats = newTunnelStats(maxTunnels)
+	return s
+}
+
+// record adds one request to subdomain's series at now. Requests answered
+// with a 5xx status count as errors.
+func (t *tunnelStats) record(subdomain string, now time.Time, status int, bytesIn, bytesOut uint64) {
+	if t == nil || subdomain == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	series, ok := t.series[subdomain]
+	if !ok {
+		if len(t.series) >= t.maxTunnels {
+			t.evictLocked()
+		}
+		series = &tunnelSeries{rings: make([][]statsBucket, len(statsResolutions))}
+		for i, res := range statsResolutions {
+			series.rings[i] = make([]statsBucket, res.points)
+		}
+		t.series[subdomain] = series
+	}
+	series.updated = now
+
+	for i, res := range statsResolutions {
+		start := now.Truncate(res.step).Unix()
+		b := &series.rings[i][start/int64(res.step.Seconds())%int64(res.points)]
+		if b.start != start {
+			*b = statsBucket{start: start}
+		}
+		b.requests++
+		if status >= 500 {
+			b.errors++
+		}
+		b.bytesIn += bytesIn
+		b.bytesOut += bytesOut
+	}
+}
+
+// evictLocked forgets the subdomain with the least recent traffic.
+// Must be called with t.mu held.
+func (t *tunnelStats) evictLocked() {
+	var oldest string
+	var oldestAt time.Time
+	for subdomain, series := range t.series {
+		if oldest == "" || series.updated.Before(oldestAt) {
+			oldest, oldestAt = subdomain, series.updated
+		}
+	}
+	delete(t.series, oldest)
+}
+
+// get returns subdomain's series at resolution res up to now, oldest first,
+// with a point for every step, or nil if it has none.
+func (t *tunnelStats) get(subdomain string, res int, now time.Time) []statsPoint {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	series, ok := t.series[subdomain]
+	if !ok {
+		return nil
+	}
+
+	r := statsResolutions[res]
+	step := int64(r.step.Seconds())
+	last := now.Truncate(r.step).Unix()
+	points := make([]statsPoint, 0, r.points)
+	for start := last - step*int64(r.points-1); start <= last; start += step {
+		p := statsPoint{Time: time.Unix(start, 0).UTC()}
+		if b := series.rings[res][start/step%int64(r.points)]; b.start == start {
+			p.Requests, p.Errors, p.BytesIn, p.BytesOut = b.requests, b.errors, b.bytesIn, b.bytesOut
+			p.RequestRate = float64(b.requests) / float64(step)
+			p.ErrorRate = float64(b.errors) / float64(step)
+			p.BytesInRate = float64(b.bytesIn) / float64(step)
+			p.BytesOutRate = float64(b.bytesOut) / float64(step)
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// has reports whether subdomain has a series.
+func (t *tunnelStats) has(subdomain string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.series[subdomain]
+	return ok
+}
+
+// countingConn counts the bytes written to and read from a tunnel stream,
+// i.e. the request and response sides of the traffic.
+type countingConn struct {
+	net.Conn
+	written atomic.Uint64
+	read    atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+func (s *Server) handleTunnelStats(w http.ResponseWriter, r *http.Request) {
+	caller, ok := s.authenticateAdmin(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	if s.stats == nil {
+		writeJSONError(w, http.StatusNotFound, "tunnel stats are not enabled")
+		return
+	}
+	subdomain := r.PathValue("subdomain")
+
+	res := 0
+	if name := r.URL.Query().Get("resolution"); name != "" {
+		res = -1
+		for i, sr := range statsResolutions {
+			if sr.name == name {
+				res = i
+			}
+		}
+		if res < 0 {
+			writeJSONError(w, http.StatusBadRequest, "resolution must be 1m, 5m, or 1h")
+			return
+		}
+	}
+
+	s.mu.RLock()
+	allowed := s.canInspect(caller, subdomain)
+	s.mu.RUnlock()
+
+	if !allowed || !s.stats.has(subdomain) {
+		writeJSONError(w, http.StatusNotFound, "tunnel not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.stats.get(subdomain, res, time.Now()))
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTunnelStatsSeries(t *testing.T) {
+	st := newTunnelStats(10)
+	base := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	st.record("app", base, 200, 100, 1000)
+	st.record("app", base.Add(10*time.Second), 502, 50, 0)
+	st.record("app", base.Add(2*time.Minute), 200, 10, 20)
+
+	points := st.get("app", 0, base.Add(2*time.Minute))
+	if len(points) != 60 {
+		t.Fatalf("got %d points, want 60", len(points))
+	}
+	last := points[len(points)-1]
+	if !last.Time.Equal(base.Add(2*time.Minute)) || last.Requests != 1 {
+		t.Errorf("last point = %+v, want 1 request at %v", last, base.Add(2*time.Minute))
+	}
+	first := points[len(points)-3]
+	want := statsPoint{Time: base, Requests: 2, Errors: 1, BytesIn: 150, BytesOut: 1000,
+		RequestRate: 2.0 / 60, ErrorRate: 1.0 / 60, BytesInRate: 150.0 / 60, BytesOutRate: 1000.0 / 60}
+	if first != want {
+		t.Errorf("point = %+v, want %+v", first, want)
+	}
+	if empty := points[len(points)-2]; empty.Requests != 0 {
+		t.Errorf("idle minute has %d requests", empty.Requests)
+	}
+
+	// An hour later the minute ring has wrapped and the old traffic is gone,
+	// but the coarser resolutions still have it
+	later := base.Add(time.Hour + 2*time.Minute)
+	for _, p := range st.get("app", 0, later) {
+		if p.Requests != 0 {
+			t.Errorf("stale point %+v reported after the ring wrapped", p)
+		}
+	}
+	hourly := st.get("app", 2, later)
+	if got := hourly[len(hourly)-2].Requests; got != 3 {
+		t.Errorf("hourly requests = %d, want 3", got)
+	}
+}
+
+func TestTunnelStatsEvictsQuietestSubdomain(t *testing.T) {
+	st := newTunnelStats(2)
+	now := time.Now()
+	st.record("old", now, 200, 0, 0)
+	st.record("busy", now.Add(time.Second), 200, 0, 0)
+	st.record("new", now.Add(2*time.Second), 200, 0, 0)
+
+	if st.has("old") || !st.has("busy") || !st.has("new") {
+		t.Error("expected the subdomain with the least recent traffic to be evicted")
+	}
+}
+
+func TestTunnelStatsAPI(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithAdmin("", "root")
+	session := registerTestTunnel(t, s, "app")
+	go serveTunnelStreams(session, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello")
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Host = "app.localhost"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	h := s.adminHandler()
+	var points []statsPoint
+	waitFor(t, time.Second, func() bool {
+		rec := adminRequest(t, h, "GET", "/api/tunnels/app/stats?resolution=5m", "root", "")
+		if rec.Code != http.StatusOK {
+			return false
+		}
+		json.Unmarshal(rec.Body.Bytes(), &points)
+		return true
+	})
+	last := points[len(points)-1]
+	if last.Requests != 1 || last.BytesIn == 0 || last.BytesOut == 0 {
+		t.Errorf("last point = %+v, want 1 request with traffic both ways", last)
+	}
+
+	tests := []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/api/tunnels/app/stats?resolution=2m", "root", http.StatusBadRequest},
+		{"/api/tunnels/other/stats", "root", http.StatusNotFound},
+		{"/api/tunnels/app/stats", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(t, h, "GET", tt.path, tt.token, ""); rec.Code != tt.want {
+			t.Errorf("GET %s status = %d, want %d", tt.path, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+	"github.com/bc183/otun/internal/transport"
+)
+
+// errTunnelClosed is returned when opening a stream for a tunnel that ended
+// while its session carries on.
+var errTunnelClosed = errors.New("tunnel closed")
+
+// sessionTunnels tracks the tunnels a client registered over one session
+// with TunnelIDs. The session ends with the last of them.
+type sessionTunnels struct {
+	conn    net.Conn
+	session transport.Session
+
+	mu  sync.Mutex
+	ids map[string]bool // registered or registering
+}
+
+func newSessionTunnels(conn net.Conn, session transport.Session) *sessionTunnels {
+	return &sessionTunnels{conn: conn, session: session, ids: make(map[string]bool)}
+}
+
+// add reserves id for a tunnel, returning the error code and error to
+// refuse it with if it can't be.
+func (st *sessionTunnels) add(id string) (string, error) {
+	if err := protocol.ValidateTunnelID(id); err != nil {
+		return protocol.ErrCodeInvalidTunnelID, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.ids[id] {
+		return protocol.ErrCodeInvalidTunnelID, fmt.Errorf("tunnel ID %q is already in use on this connection", id)
+	}
+	if len(st.ids) >= protocol.MaxTunnelsPerSession {
+		return protocol.ErrCodeTooManyTunnels, fmt.Errorf("at most %d tunnels per connection", protocol.MaxTunnelsPerSession)
+	}
+	st.ids[id] = true
+	return "", nil
+}
+
+// remove releases id, reporting whether it was the last tunnel.
+func (st *sessionTunnels) remove(id string) (last bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.ids, id)
+	return len(st.ids) == 0
+}
+
+// serve registers the tunnel msg asks for in the background, on a view of
+// the session that carries only the tunnel's streams. It reports whether
+// the tunnel was taken on; if not, the client was told why.
+func (st *sessionTunnels) serve(s *Server, control transport.Stream, controlStream *protocol.ControlStream, msg *protocol.RegisterMessage, registered func()) bool {
+	if code, err := st.add(msg.TunnelID); err != nil {
+		slog.Warn("tunnel refused", "tunnel_id", msg.TunnelID, "remote_addr", st.conn.RemoteAddr(), "error", err)
+		controlStream.SendErrorCode(code, err.Error())
+		control.Close()
+		return false
+	}
+	ts := &tunnelSession{Session: st.session, id: msg.TunnelID, control: control}
+	go func() {
+		s.registerTunnel(st.conn, ts, controlStream, msg, registered)
+		if st.remove(msg.TunnelID) {
+			st.session.Close()
+		}
+	}()
+	return true
+}
+
+// acceptTunnels registers the further tunnels the client opens control
+// streams for, until its session closes.
+func (s *Server) acceptTunnels(tunnels *sessionTunnels) {
+	for {
+		stream, err := tunnels.session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			controlStream := s.newControlStream(stream)
+			if s.handshakeTimeout > 0 {
+				stream.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
+			}
+			msg, err := controlStream.ReadMessage()
+			stream.SetReadDeadline(time.Time{})
+			if err != nil {
+				slog.Warn("failed to read register message", "remote_addr", tunnels.conn.RemoteAddr(), "error", err)
+				stream.Close()
+				return
+			}
+			m, ok := msg.(*protocol.RegisterMessage)
+			if !ok {
+				slog.Error("expected register message", "got", fmt.Sprintf("%T", msg))
+				controlStream.SendError("expected register message")
+				stream.Close()
+				return
+			}
+			tunnels.serve(s, stream, controlStream, m, func() {})
+		}()
+	}
+}
+
+// tunnelSession is the view of a session that one of the tunnels
+// registered over it has. Streams opened on it start with the tunnel's ID,
+// so the client can tell them apart, and closing it ends just the tunnel.
+type tunnelSession struct {
+	transport.Session
+	id      string
+	control transport.Stream
+
+	streams atomic.Int64 // open streams of the tunnel
+	closed  atomic.Bool
+}
+
+func (ts *tunnelSession) OpenStream() (transport.Stream, error) {
+	if ts.closed.Load() {
+		return nil, errTunnelClosed
+	}
+	stream, err := ts.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(protocol.AppendStreamTunnel(nil, ts.id)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	ts.streams.Add(1)
+	return &tunnelStream{Stream: stream, session: ts}, nil
+}
+
+// Close ends the tunnel: its control stream is closed and pending reads on
+// it fail, so the tunnel's handler returns. Streams already open carry on.
+func (ts *tunnelSession) Close() error {
+	if ts.closed.Swap(true) {
+		return nil
+	}
+	ts.control.SetReadDeadline(time.Now())
+	return ts.control.Close()
+}
+
+func (ts *tunnelSession) IsClosed() bool {
+	return ts.closed.Load() || ts.Session.IsClosed()
+}
+
+// openStreams returns the number of the tunnel's streams, its control
+// stream included, that are open.
+func (ts *tunnelSession) openStreams() int64 {
+	return ts.streams.Load() + 1
+}
+
+// tunnelStream counts itself out of its tunnel's open streams when closed.
+type tunnelStream struct {
+	transport.Stream
+	session *tunnelSession
+	once    sync.Once
+}
+
+func (s *tunnelStream) Close() error {
+	s.once.Do(func() { s.session.streams.Add(-1) })
+	return s.Stream.Close()
+}
+
+// healthOf returns the session under session that tracks its health, or
+// nil if there is none.
+func healthOf(session transport.Session) *healthSession {
+	if ts, ok := session.(*tunnelSession); ok {
+		session = ts.Session
+	}
+	hs, _ := session.(*healthSession)
+	return hs
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+func TestSessionTunnelsAdd(t *testing.T) {
+	full := newSessionTunnels(nil, nil)
+	for i := range protocol.MaxTunnelsPerSession {
+		if _, err := full.add(strconv.Itoa(i)); err != nil {
+			t.Fatalf("add(%d): %v", i, err)
+		}
+	}
+	inUse := newSessionTunnels(nil, nil)
+	inUse.add("web")
+
+	tests := []struct {
+		name     string
+		tunnels  *sessionTunnels
+		id       string
+		wantCode string
+	}{
+		{"first", newSessionTunnels(nil, nil), "web", ""},
+		{"another", inUse, "api", ""},
+		{"empty", newSessionTunnels(nil, nil), "", protocol.ErrCodeInvalidTunnelID},
+		{"invalid", newSessionTunnels(nil, nil), "a b", protocol.ErrCodeInvalidTunnelID},
+		{"in use", inUse, "web", protocol.ErrCodeInvalidTunnelID},
+		{"too many", full, "one-more", protocol.ErrCodeTooManyTunnels},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := tt.tunnels.add(tt.id)
+			if code != tt.wantCode || (err != nil) != (tt.wantCode != "") {
+				t.Errorf("add(%q) = %q, %v; want code %q", tt.id, code, err, tt.wantCode)
+			}
+		})
+	}
+
+	if last := inUse.remove("web"); last {
+		t.Error("remove(web) reported the last tunnel with api left")
+	}
+	if last := inUse.remove("api"); !last {
+		t.Error("remove(api) didn't report the last tunnel")
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// rejectUnknownHosts wraps getCertificate to fail the handshake for server
+// names no tunnel serves, before any certificate lookup or ACME work. Hosts
+// whose tunnel is reconnecting or has been taken down still get a
+// certificate so visitors see the queued response or the takedown notice.
+func (s *Server) rejectUnknownHosts(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !s.knownHost(hello.ServerName) {
+			s.metrics.tlsUnknownHosts.Inc()
+			slog.Debug("TLS handshake for unknown host", "server_name", hello.ServerName)
+			return nil, fmt.Errorf("no tunnel for host %q", hello.ServerName)
+		}
+		return getCertificate(hello)
+	}
+}
+
+// knownHost reports whether serverName belongs to a registered, reconnecting,
+// or blocked tunnel.
+func (s *Server) knownHost(serverName string) bool {
+	subdomain := s.subdomainForHost(serverName)
+	if subdomain == "" {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.clients[subdomain] != nil || s.blocked[subdomain] != nil {
+		return true
+	}
+	at, ok := s.disconnectedAt[subdomain]
+	return ok && time.Since(at) < s.reconnectGrace
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestRejectUnknownHosts(t *testing.T) {
+	s := New("", "", "", "example.com", "", nil).WithReconnectQueue(time.Minute, 10)
+	registerTestTunnel(t, s, "live")
+	registerTestTunnel(t, s, "back-soon")
+	unregisterTestTunnel(s, "back-soon")
+	s.blocked["gone"] = &blockInfo{}
+
+	cert := &tls.Certificate{}
+	getCertificate := s.rejectUnknownHosts(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	})
+
+	tests := []struct {
+		serverName string
+		want       bool
+	}{
+		{"live.example.com", true},
+		{"back-soon.example.com", true},
+		{"gone.example.com", true},
+		{"missing.example.com", false},
+		{"example.com", false},
+		{"", false},
+	}
+	rejected := uint64(0)
+	for _, tt := range tests {
+		got, err := getCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if tt.want && (err != nil || got != cert) {
+			t.Errorf("%q: got (%v, %v), want certificate", tt.serverName, got, err)
+		}
+		if !tt.want {
+			rejected++
+			if err == nil {
+				t.Errorf("%q: handshake not rejected", tt.serverName)
+			}
+		}
+	}
+	if got := s.metrics.tlsUnknownHosts.Value(); got != rejected {
+		t.Errorf("unknown host handshakes = %d, want %d", got, rejected)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxVisitors bounds the visitor and tunnel pairs tracked at once.
+	// Beyond it, idle visitors are forgotten; if none are idle, new
+	// visitors go untracked until some are.
+	maxVisitors = 100000
+
+	// maxTarpits bounds the throttled requests held at once, so tarpitting
+	// can't itself exhaust the server. Beyond it, throttled requests are
+	// answered at once.
+	maxTarpits = 1000
+)
+
+var (
+	// errVisitorRate is returned when a visitor exceeds its request rate
+	// on a tunnel.
+	errVisitorRate = errors.New("visitor request rate exceeded")
+
+	// errVisitorStreams is returned when a visitor already has its maximum
+	// number of concurrent requests open on a tunnel.
+	errVisitorStreams = errors.New("too many concurrent requests from visitor")
+)
+
+// visitorKey identifies one visitor of one tunnel.
+type visitorKey struct {
+	subdomain string
+	ip        string
+}
+
+// visitorState is a visitor's open requests and rate budget on a tunnel.
+type visitorState struct {
+	active  int
+	tokens  float64
+	updated time.Time
+}
+
+// visitorLimiter throttles each visitor IP per tunnel, so a scraper that
+// discovers a tunnel can't monopolize the local service behind it.
+type visitorLimiter struct {
+	maxStreams int     // concurrent requests per visitor (0 = no limit)
+	rate       float64 // requests per second per visitor (0 = no limit)
+	burst      float64
+	tarpit     time.Duration // how long throttled requests are held
+
+	tarpits connLimiter
+
+	mu       sync.Mutex
+	visitors map[visitorKey]*visitorState
+}
+
+// WithVisitorLimits throttles each visitor IP on each tunnel to maxStreams
+// concurrent requests and rate requests per second, with bursts of up to
+// burst. Throttled requests get a 429, after being held for tarpit to slow
+// scrapers down. Zero means no limit.
+func (s *Server) WithVisitorLimits(maxStreams int, rate float64, burst int, tarpit time.Duration) *Server {
+	s.visitors = nil
+	if maxStreams > 0 || rate > 0 {
+		s.visitors = &visitorLimiter{
+			maxStreams: maxStreams,
+			rate:       rate,
+			burst:      max(float64(burst), 1),
+			tarpit:     tarpit,
+			visitors:   make(map[visitorKey]*visitorState),
+		}
+	}
+	return s
+}
+
+// acquire admits a request from ip to subdomain at now, returning a
+// function to call once it is done, or the limit it exceeds.
+func (l *visitorLimiter) acquire(subdomain, ip string, now time.Time) (func(), error) {
+	key := visitorKey{subdomain: subdomain, ip: ip}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v := l.visitors[key]
+	if v == nil {
+		if len(l.visitors) >= maxVisitors && !l.pruneLocked(now) {
+			return func() {}, nil
+		}
+		v = &visitorState{tokens: l.burst, updated: now}
+		l.visitors[key] = v
+	}
+
+	if l.rate > 0 {
+		v.tokens = min(l.burst, v.tokens+now.Sub(v.updated).Seconds()*l.rate)
+		v.updated = now
+		if v.tokens < 1 {
+			return nil, errVisitorRate
+		}
+	}
+	if l.maxStreams > 0 && v.active >= l.maxStreams {
+		return nil, errVisitorStreams
+	}
+	v.tokens--
+	v.active++
+
+	return func() {
+		l.mu.Lock()
+		v.active--
+		l.mu.Unlock()
+	}, nil
+}
+
+// pruneLocked forgets visitors with no open requests and a full rate
+// budget, reporting whether any were.
+// Must be called with l.mu held.
+func (l *visitorLimiter) pruneLocked(now time.Time) bool {
+	pruned := false
+	for key, v := range l.visitors {
+		if v.active == 0 && (l.rate <= 0 || v.tokens+now.Sub(v.updated).Seconds()*l.rate >= l.burst) {
+			delete(l.visitors, key)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// retryAfter is how long a visitor throttled for its rate should wait.
+func (l *visitorLimiter) retryAfter() time.Duration {
+	if l.rate <= 0 {
+		return time.Second
+	}
+	return max(time.Duration(float64(time.Second)/l.rate), time.Second)
+}
+
+// checkVisitor admits r to client's tunnel under the per-visitor limits.
+// A throttled visitor is held for the tarpit delay, then answered with 429;
+// checkVisitor returns false. Otherwise it returns a function to call once
+// the request is done.
+func (s *Server) checkVisitor(w http.ResponseWriter, r *http.Request, client *tunnelClient) (func(), bool) {
+	if s.visitors == nil {
+		return func() {}, true
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	release, err := s.visitors.acquire(client.subdomain, ip, time.Now())
+	if err == nil {
+		return release, true
+	}
+
+	s.metrics.visitorsThrottled.Inc()
+	slog.Debug("visitor throttled", "subdomain", client.subdomain, "ip", ip, "error", err)
+	if s.visitors.tarpit > 0 && s.visitors.tarpits.acquire(maxTarpits) {
+		s.metrics.visitorsTarpitted.Inc()
+		t := time.NewTimer(s.visitors.tarpit)
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+		}
+		s.visitors.tarpits.release()
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.visitors.retryAfter()/time.Second)))
+	s.httpError(w, r, "Too many requests", http.StatusTooManyRequests)
+	return nil, false
+}
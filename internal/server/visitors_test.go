@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVisitorLimiterRate(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithVisitorLimits(0, 1, 2, 0)
+	l := s.visitors
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		subdomain string
+		ip        string
+		at        time.Duration
+		wantErr   error
+	}{
+		{"first", "app", "192.0.2.1", 0, nil},
+		{"burst", "app", "192.0.2.1", 0, nil},
+		{"over burst", "app", "192.0.2.1", 0, errVisitorRate},
+		{"other visitor", "app", "192.0.2.2", 0, nil},
+		{"other tunnel", "api", "192.0.2.1", 0, nil},
+		{"refilled", "app", "192.0.2.1", time.Second, nil},
+		{"spent again", "app", "192.0.2.1", time.Second, errVisitorRate},
+	}
+	for _, tt := range tests {
+		release, err := l.acquire(tt.subdomain, tt.ip, now.Add(tt.at))
+		if err != tt.wantErr {
+			t.Errorf("%s: acquire() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if release != nil {
+			release()
+		}
+	}
+}
+
+func TestVisitorLimiterStreams(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithVisitorLimits(1, 0, 0, 0)
+	l := s.visitors
+	now := time.Now()
+
+	release, err := l.acquire("app", "192.0.2.1", now)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if _, err := l.acquire("app", "192.0.2.1", now); err != errVisitorStreams {
+		t.Errorf("second acquire() error = %v, want %v", err, errVisitorStreams)
+	}
+	release()
+	if _, err := l.acquire("app", "192.0.2.1", now); err != nil {
+		t.Errorf("acquire() after release error = %v", err)
+	}
+}
+
+func TestCheckVisitorTarpit(t *testing.T) {
+	const tarpit = 100 * time.Millisecond
+	s := New("", "", "", "", "", nil).WithVisitorLimits(0, 1, 1, tarpit)
+	go serveTunnelStreams(registerTestTunnel(t, s, "demo"), okResponse)
+
+	serve := func() (*httptest.ResponseRecorder, time.Duration) {
+		req := httptest.NewRequest("GET", "http://demo.localhost/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		s.ServeHTTP(rec, req)
+		return rec, time.Since(start)
+	}
+
+	if rec, _ := serve(); rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", rec.Code)
+	}
+	rec, took := serve()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	if took < tarpit {
+		t.Errorf("throttled request answered after %v, want it held for %v", took, tarpit)
+	}
+}
+
+func TestVisitorLimitsKeepAlive(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithVisitorLimits(0, 0.001, 1, 0)
+	go serveKeepAlive(registerTestTunnel(t, s, "app"))
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	get := "GET / HTTP/1.1\r\nHost: app.localhost\r\n\r\n"
+	if keepAliveForwards(t, ts.Listener.Addr().String(), get, get) {
+		t.Error("second request on the kept-alive connection wasn't counted against the rate")
+	}
+}
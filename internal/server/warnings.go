@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bc183/otun/internal/bytesize"
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// limitWarningInterval is the least time between repeated warnings about
+// the same limit to a tunnel client.
+const limitWarningInterval = time.Minute
+
+// WithLimitWarnings warns tunnel clients over the control stream when they
+// reach percent of one of their limits (concurrent streams or response
+// size), so developers hear about it before visitors start getting errors.
+// Zero disables warnings.
+func (s *Server) WithLimitWarnings(percent int) *Server {
+	s.limitWarningPercent = percent
+	return s
+}
+
+// warnThreshold returns the usage of a limit of max at which to warn
+// (0 = never).
+func (s *Server) warnThreshold(max int64) int64 {
+	if s.limitWarningPercent <= 0 || max <= 0 {
+		return 0
+	}
+	return (max*int64(s.limitWarningPercent) + 99) / 100
+}
+
+// warnLimit sends client a warning about limit, at most once per
+// limitWarningInterval. Reaching the limit is warned about separately from
+// nearing it.
+func (s *Server) warnLimit(client *tunnelClient, limit, message string, used, max int64) {
+	if !client.warnings || client.controlStream == nil {
+		return
+	}
+	key := limit
+	if used >= max {
+		key += ":reached"
+	}
+
+	now := time.Now()
+	client.warnMu.Lock()
+	if last, ok := client.warned[key]; ok && now.Sub(last) < limitWarningInterval {
+		client.warnMu.Unlock()
+		return
+	}
+	if client.warned == nil {
+		client.warned = make(map[string]time.Time)
+	}
+	client.warned[key] = now
+	client.warnMu.Unlock()
+
+	s.metrics.limitWarnings.Inc()
+	slog.Info("warning tunnel client about limit", "subdomain", client.subdomain, "limit", limit, "used", used, "max", max)
+
+	// Don't hold up the request if the control stream is backed up
+	go func() {
+		if err := client.controlStream.SendWarning(limit, message, used, max); err != nil {
+			slog.Debug("failed to send limit warning", "subdomain", client.subdomain, "error", err)
+		}
+	}()
+}
+
+// warnStreams warns client if it's using most of its concurrent streams.
+func (s *Server) warnStreams(client *tunnelClient, rejected bool) {
+	max := int64(s.streamLimit(client))
+	threshold := s.warnThreshold(max)
+	if threshold == 0 {
+		return
+	}
+	if rejected {
+		s.warnLimit(client, protocol.LimitStreams,
+			fmt.Sprintf("Concurrent connection limit of %d reached; visitors are getting 503 errors", max), max, max)
+		return
+	}
+	if n := client.streams.count(); n >= threshold {
+		s.warnLimit(client, protocol.LimitStreams,
+			fmt.Sprintf("%d of %d concurrent connections in use; more will get 503 errors", n, max), n, max)
+	}
+}
+
+// warnLargeResponses makes c warn client about responses nearing the
+// tunnel's response size limit.
+func (s *Server) warnLargeResponses(c *sizeLimitedConn, client *tunnelClient) *sizeLimitedConn {
+	c.warnAt = s.warnThreshold(c.limit)
+	c.near = func(size int64) {
+		s.warnLimit(client, protocol.LimitResponseSize,
+			fmt.Sprintf("A %s response is close to the tunnel's %s response size limit", bytesize.Format(size), bytesize.Format(c.limit)), size, c.limit)
+	}
+	return c
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/protocol"
+)
+
+// warnedTestClient returns a client that accepts warnings and a control
+// stream to read them from.
+func warnedTestClient(t *testing.T, s *Server) (*tunnelClient, *protocol.ControlStream) {
+	t.Helper()
+	registerTestTunnel(t, s, "app")
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { serverConn.Close(); clientConn.Close() })
+
+	client := s.lookupClient("app")
+	client.controlStream = protocol.NewControlStream(serverConn)
+	client.warnings = true
+	return client, protocol.NewControlStream(clientConn)
+}
+
+// readWarning reads the next control message, expecting a warning.
+func readWarning(t *testing.T, cs *protocol.ControlStream) *protocol.WarningMessage {
+	t.Helper()
+	msgs := make(chan any, 1)
+	go func() {
+		msg, _ := cs.ReadMessage()
+		msgs <- msg
+	}()
+	select {
+	case msg := <-msgs:
+		w, ok := msg.(*protocol.WarningMessage)
+		if !ok {
+			t.Fatalf("got %T, want a warning", msg)
+		}
+		return w
+	case <-time.After(2 * time.Second):
+		t.Fatal("no warning sent")
+		return nil
+	}
+}
+
+func TestStreamLimitWarnings(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithConnectionLimits(0, 4, 0).WithLimitWarnings(75)
+	client, cs := warnedTestClient(t, s)
+
+	for i := 0; i < 3; i++ {
+		if err := s.acquireConn(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := readWarning(t, cs)
+	if w.Limit != protocol.LimitStreams || w.Used != 3 || w.Max != 4 {
+		t.Errorf("warning = %+v, want 3 of 4 streams", w)
+	}
+
+	// Nearing the limit isn't repeated, but reaching it is
+	s.releaseConn(client)
+	s.acquireConn(client)
+	s.acquireConn(client)
+	w = readWarning(t, cs)
+	if w.Used != 4 {
+		t.Errorf("warning = %+v, want limit reached", w)
+	}
+	if err := s.acquireConn(client); err != errTooManyStreams {
+		t.Fatalf("acquireConn() = %v, want errTooManyStreams", err)
+	}
+	if got := s.metrics.limitWarnings.Value(); got != 2 {
+		t.Errorf("warnings = %d, want 2", got)
+	}
+}
+
+func TestResponseSizeWarning(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithLimitWarnings(80)
+	client, cs := warnedTestClient(t, s)
+
+	upstream := "HTTP/1.1 200 OK\r\nContent-Length: 90\r\n\r\n" + strings.Repeat("x", 90)
+	conn := s.warnLargeResponses(s.limitResponseSize(newMockConn([]byte(upstream)), 100, "app", "GET"), client)
+	if _, err := io.ReadAll(io.LimitReader(conn, int64(len(upstream)))); err != nil {
+		t.Fatal(err)
+	}
+
+	w := readWarning(t, cs)
+	if w.Limit != protocol.LimitResponseSize || w.Used != 90 || w.Max != 100 {
+		t.Errorf("warning = %+v, want a 90 of 100 byte response", w)
+	}
+}
+
+func TestNoWarningsForOldClients(t *testing.T) {
+	s := New("", "", "", "", "", nil).WithConnectionLimits(0, 1, 0).WithLimitWarnings(50)
+	client, _ := warnedTestClient(t, s)
+	client.warnings = false
+
+	s.acquireConn(client)
+	if got := s.metrics.limitWarnings.Value(); got != 0 {
+		t.Errorf("warnings = %d, want 0", got)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// watchdogInterval is how often the stream watchdog looks for leaked and
+// expired streams.
+const watchdogInterval = 30 * time.Second
+
+// streamWatchdog tracks every open tunnel stream so that streams whose
+// proxy goroutines never closed them can't pile up. Streams left open after
+// their session ended are closed as orphans, and streams older than maxAge
+// (if set) are closed to free whatever is still copying on them.
+type streamWatchdog struct {
+	maxAge  time.Duration
+	metrics *serverMetrics
+
+	mu      sync.Mutex
+	streams map[*healthStream]time.Time // stream -> when it was opened
+}
+
+func newStreamWatchdog(metrics *serverMetrics) *streamWatchdog {
+	return &streamWatchdog{
+		metrics: metrics,
+		streams: make(map[*healthStream]time.Time),
+	}
+}
+
+// WithMaxStreamAge closes tunnel streams, WebSockets and TCP connections
+// included, that stay open longer than d (0 = no limit). Streams whose
+// session has ended are closed regardless.
+func (s *Server) WithMaxStreamAge(d time.Duration) *Server {
+	s.watchdog.maxAge = d
+	return s
+}
+
+// add starts tracking stream.
+func (w *streamWatchdog) add(stream *healthStream) {
+	w.mu.Lock()
+	w.streams[stream] = time.Now()
+	w.mu.Unlock()
+}
+
+// remove stops tracking stream.
+func (w *streamWatchdog) remove(stream *healthStream) {
+	w.mu.Lock()
+	delete(w.streams, stream)
+	w.mu.Unlock()
+}
+
+// count returns the number of tracked streams.
+func (w *streamWatchdog) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.streams)
+}
+
+// run sweeps streams every watchdogInterval until done is closed.
+func (w *streamWatchdog) run(done <-chan struct{}) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.sweep(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// sweep closes the streams that are orphaned or older than maxAge at now.
+func (w *streamWatchdog) sweep(now time.Time) {
+	var orphaned, expired []*healthStream
+	w.mu.Lock()
+	for stream, opened := range w.streams {
+		switch {
+		case stream.session.IsClosed():
+			orphaned = append(orphaned, stream)
+		case w.maxAge > 0 && now.Sub(opened) > w.maxAge:
+			expired = append(expired, stream)
+			slog.Warn("closing stream open past the maximum age", "stream_id", stream.StreamID(), "age", now.Sub(opened).Round(time.Second))
+		}
+	}
+	w.mu.Unlock()
+
+	// Closing the stream fails the copies still running on it, ending
+	// their goroutines
+	for _, stream := range orphaned {
+		stream.Close()
+	}
+	for _, stream := range expired {
+		stream.Close()
+	}
+	if len(orphaned) > 0 {
+		slog.Warn("closed streams left open after their session ended", "count", len(orphaned))
+	}
+	w.metrics.streamsOrphaned.Add(uint64(len(orphaned)))
+	w.metrics.streamsExpired.Add(uint64(len(expired)))
+}
+
+// numGoroutines reports the number of goroutines, most of which copy data
+// for tunnel streams on a busy server.
+func numGoroutines() float64 {
+	return float64(runtime.NumGoroutine())
+}
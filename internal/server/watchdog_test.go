@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamWatchdogSweep(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAge      time.Duration
+		elapsed     time.Duration
+		endSession  bool
+		wantClosed  bool
+		wantOrphans uint64
+		wantExpired uint64
+	}{
+		{name: "young stream", maxAge: time.Hour, elapsed: time.Minute},
+		{name: "no max age", elapsed: 48 * time.Hour},
+		{name: "expired", maxAge: time.Hour, elapsed: 2 * time.Hour, wantClosed: true, wantExpired: 1},
+		{name: "orphaned", endSession: true, wantClosed: true, wantOrphans: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", "", "", "", "", nil).WithMaxStreamAge(tt.maxAge)
+			hs, clientSession := registerHealthTunnel(t, s, "demo")
+			go func() {
+				stream, err := clientSession.AcceptStream()
+				if err == nil {
+					io.Copy(io.Discard, stream)
+				}
+			}()
+
+			stream, err := hs.OpenStream()
+			if err != nil {
+				t.Fatalf("OpenStream() error = %v", err)
+			}
+			if got := s.watchdog.count(); got != 1 {
+				t.Fatalf("tracked streams = %d, want 1", got)
+			}
+			if tt.endSession {
+				hs.Session.Close() // as if the session died without the stream being closed
+			}
+
+			s.watchdog.sweep(time.Now().Add(tt.elapsed))
+
+			if closed := s.watchdog.count() == 0; closed != tt.wantClosed {
+				t.Errorf("stream closed = %v, want %v", closed, tt.wantClosed)
+			}
+			if got := s.metrics.streamsOrphaned.Value(); got != tt.wantOrphans {
+				t.Errorf("orphans = %d, want %d", got, tt.wantOrphans)
+			}
+			if got := s.metrics.streamsExpired.Value(); got != tt.wantExpired {
+				t.Errorf("expired = %d, want %d", got, tt.wantExpired)
+			}
+
+			// Closing it normally stops the tracking
+			stream.Close()
+			if got := s.watchdog.count(); got != 0 {
+				t.Errorf("tracked streams after close = %d, want 0", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// keepAliveProbes is how many unanswered keepalive probes mark a control
+// connection dead.
+const keepAliveProbes = 3
+
+// Defaults for control connections: a peer that vanishes behind a NAT or a
+// middlebox that silently drops the connection is noticed in about 20
+// seconds, well before the heartbeat timeout.
+const (
+	DefaultKeepAliveInterval = 5 * time.Second
+	DefaultUserTimeout       = 20 * time.Second
+)
+
+// KeepAlive tunes how quickly a dead control connection is detected by the
+// kernel.
+type KeepAlive struct {
+	// Interval is both the idle time before the first keepalive probe and
+	// the time between probes; the connection is dropped after 3 go
+	// unanswered (0 = keepalive left at the system default)
+	Interval time.Duration
+
+	// UserTimeout is how long sent data may go unacknowledged before the
+	// connection is dropped, i.e. TCP_USER_TIMEOUT (0 = system default;
+	// Linux only)
+	UserTimeout time.Duration
+}
+
+// DefaultKeepAlive returns the default control connection tuning.
+func DefaultKeepAlive() KeepAlive {
+	return KeepAlive{Interval: DefaultKeepAliveInterval, UserTimeout: DefaultUserTimeout}
+}
+
+// Apply sets k on conn. Connections that aren't TCP, such as in-memory
+// pipes or those through a proxy dialer, are left alone.
+func (k KeepAlive) Apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if k.Interval > 0 {
+		err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     k.Interval,
+			Interval: k.Interval,
+			Count:    keepAliveProbes,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set keepalive: %w", err)
+		}
+	}
+	if k.UserTimeout > 0 {
+		if err := setUserTimeout(tc, k.UserTimeout); err != nil {
+			return fmt.Errorf("failed to set TCP user timeout: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is the TCP_USER_TIMEOUT socket option, which syscall
+// doesn't define.
+const tcpUserTimeout = 0x12
+
+// setUserTimeout sets TCP_USER_TIMEOUT on conn.
+func setUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d.Milliseconds()))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveSocketOptions(t *testing.T) {
+	conn := tcpConn(t)
+	k := KeepAlive{Interval: 7 * time.Second, UserTimeout: 12 * time.Second}
+	if err := k.Apply(conn); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() error = %v", err)
+	}
+	var userTimeout, idle, count int
+	raw.Control(func(fd uintptr) {
+		userTimeout, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+		idle, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		count, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+	})
+	if userTimeout != 12000 {
+		t.Errorf("TCP_USER_TIMEOUT = %dms, want 12000ms", userTimeout)
+	}
+	if idle != 7 {
+		t.Errorf("TCP_KEEPIDLE = %ds, want 7s", idle)
+	}
+	if count != keepAliveProbes {
+		t.Errorf("TCP_KEEPCNT = %d, want %d", count, keepAliveProbes)
+	}
+}
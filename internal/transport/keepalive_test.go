@@ -0,0 +1,45 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveApply(t *testing.T) {
+	conn := tcpConn(t)
+	k := KeepAlive{Interval: 7 * time.Second, UserTimeout: 12 * time.Second}
+	if err := k.Apply(conn); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+}
+
+// tcpConn returns the client end of a loopback TCP connection.
+func tcpConn(t *testing.T) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKeepAliveIgnoresNonTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := DefaultKeepAlive().Apply(a); err != nil {
+		t.Errorf("Apply() on a pipe error = %v", err)
+	}
+}
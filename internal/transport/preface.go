@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// prefaceMagic starts the line a client sends to select a non-default muxer:
+//
+//	OTUN/1 <muxer-name>\n
+//
+// Clients using yamux send no preface, which keeps them compatible with
+// servers that predate muxer negotiation. yamux frames always start with
+// protocol version 0, so the server can tell the two apart by the first byte.
+const prefaceMagic = "OTUN/1 "
+
+// maxPrefaceLen bounds the preface line to keep hostile clients from
+// making the server buffer arbitrary amounts of data.
+const maxPrefaceLen = 64
+
+// yamuxVersion is the first byte of every yamux frame.
+const yamuxVersion = 0
+
+// WritePreface writes the muxer selection preface for m. Nothing is written
+// for the default muxer.
+func WritePreface(w io.Writer, m Muxer) error {
+	if m.Name() == YamuxName {
+		return nil
+	}
+	_, err := io.WriteString(w, prefaceMagic+m.Name()+"\n")
+	return err
+}
+
+// ReadPreface reads the muxer selection preface from conn and returns the
+// selected muxer together with a connection that replays any bytes read
+// past the preface.
+func ReadPreface(conn net.Conn) (Muxer, net.Conn, error) {
+	reader := bufio.NewReaderSize(conn, maxPrefaceLen)
+	wrapped := &bufferedConn{Conn: conn, reader: reader}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, wrapped, fmt.Errorf("failed to read preface: %w", err)
+	}
+	if first[0] == yamuxVersion {
+		m, err := Lookup(YamuxName)
+		return m, wrapped, err
+	}
+
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, wrapped, fmt.Errorf("failed to read preface: %w", err)
+	}
+	name, ok := strings.CutPrefix(strings.TrimRight(string(line), "\r\n"), prefaceMagic)
+	if !ok {
+		return nil, wrapped, fmt.Errorf("invalid preface: %q", line)
+	}
+
+	m, err := Lookup(name)
+	return m, wrapped, err
+}
+
+// bufferedConn is a net.Conn whose reads are served from a buffered reader.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
@@ -0,0 +1,100 @@
+// Package transport abstracts the stream multiplexer that carries the control
+// stream and proxied requests over a single client-server connection.
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stream is a single bidirectional stream within a session.
+type Stream interface {
+	net.Conn
+
+	// StreamID returns the multiplexer's identifier for the stream.
+	StreamID() uint32
+}
+
+// Session is a multiplexed connection between a client and the server.
+type Session interface {
+	// OpenStream opens a new stream to the remote side.
+	OpenStream() (Stream, error)
+
+	// AcceptStream blocks until the remote side opens a stream.
+	AcceptStream() (Stream, error)
+
+	// Close closes the session and all of its streams.
+	Close() error
+
+	// IsClosed reports whether the session has been closed.
+	IsClosed() bool
+}
+
+// Pinger is implemented by sessions that can measure the round-trip time
+// to the remote side.
+type Pinger interface {
+	// Ping sends a ping and waits for the reply.
+	Ping() (time.Duration, error)
+}
+
+// Muxer creates sessions over an established connection.
+type Muxer interface {
+	// Name identifies the muxer in the connection preface.
+	Name() string
+
+	// Client creates the client side of a session.
+	Client(conn net.Conn) (Session, error)
+
+	// Server creates the server side of a session.
+	Server(conn net.Conn) (Session, error)
+}
+
+var (
+	muxersMu sync.RWMutex
+	muxers   = map[string]Muxer{}
+)
+
+// Register makes a muxer available for negotiation by name.
+// Registering a name twice replaces the previous muxer.
+func Register(m Muxer) {
+	muxersMu.Lock()
+	defer muxersMu.Unlock()
+	muxers[m.Name()] = m
+}
+
+// Lookup returns the registered muxer with the given name.
+func Lookup(name string) (Muxer, error) {
+	muxersMu.RLock()
+	defer muxersMu.RUnlock()
+	m, ok := muxers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown muxer: %s", name)
+	}
+	return m, nil
+}
+
+// Names returns the names of all registered muxers, sorted.
+func Names() []string {
+	muxersMu.RLock()
+	defer muxersMu.RUnlock()
+	names := make([]string, 0, len(muxers))
+	for name := range muxers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Default returns the default muxer (yamux).
+func Default() Muxer {
+	return defaultMuxer
+}
+
+var defaultMuxer Muxer = &Yamux{}
+
+func init() {
+	Register(defaultMuxer)
+}
@@ -0,0 +1,198 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// renamedMuxer is yamux registered under a different name, standing in for
+// an alternative multiplexer.
+type renamedMuxer struct {
+	Yamux
+	name string
+}
+
+func (m *renamedMuxer) Name() string { return m.name }
+
+// roundTrip negotiates a session over an in-memory pipe using m on the client
+// side and checks that a stream opened by the client reaches the server.
+func roundTrip(t *testing.T, m Muxer) string {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		name    string
+		payload string
+		err     error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		muxer, conn, err := ReadPreface(serverConn)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		session, err := muxer.Server(conn)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer session.Close()
+
+		stream, err := session.AcceptStream()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		payload, err := io.ReadAll(stream)
+		done <- result{name: muxer.Name(), payload: string(payload), err: err}
+	}()
+
+	if err := WritePreface(clientConn, m); err != nil {
+		t.Fatalf("WritePreface() error = %v", err)
+	}
+	session, err := m.Client(clientConn)
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream() error = %v", err)
+	}
+	io.WriteString(stream, "ping")
+	stream.Close()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("server side error = %v", res.err)
+	}
+	if res.payload != "ping" {
+		t.Errorf("server received %q, want %q", res.payload, "ping")
+	}
+	return res.name
+}
+
+func TestDefaultMuxerNeedsNoPreface(t *testing.T) {
+	var sb strings.Builder
+	if err := WritePreface(&sb, Default()); err != nil {
+		t.Fatalf("WritePreface() error = %v", err)
+	}
+	if sb.Len() != 0 {
+		t.Errorf("default muxer wrote preface %q", sb.String())
+	}
+
+	if name := roundTrip(t, Default()); name != YamuxName {
+		t.Errorf("negotiated %q, want %q", name, YamuxName)
+	}
+}
+
+func TestNamedMuxerNegotiation(t *testing.T) {
+	m := &renamedMuxer{name: "yamux-test"}
+	Register(m)
+
+	if name := roundTrip(t, m); name != "yamux-test" {
+		t.Errorf("negotiated %q, want %q", name, "yamux-test")
+	}
+}
+
+func TestReadPrefaceErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unknown muxer", "OTUN/1 carrier-pigeon\n"},
+		{"bad magic", "HELLO yamux\n"},
+		{"missing newline", strings.Repeat("x", maxPrefaceLen+1)},
+		{"empty", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer serverConn.Close()
+
+			go func() {
+				io.WriteString(clientConn, tt.input)
+				clientConn.Close()
+			}()
+
+			if _, _, err := ReadPreface(serverConn); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	names := Names()
+	for _, name := range names {
+		if name == YamuxName {
+			return
+		}
+	}
+	t.Errorf("Names() = %v, missing %q", names, YamuxName)
+}
+
+func TestYamuxStreamCloseWrite(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	m := &Yamux{}
+	done := make(chan error, 1)
+	go func() {
+		session, err := m.Server(serverConn)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer session.Close()
+		stream, err := session.AcceptStream()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer stream.Close()
+		// Reply only once the client is done writing
+		if _, err := io.ReadAll(stream); err != nil {
+			done <- err
+			return
+		}
+		_, err = io.WriteString(stream, "pong")
+		done <- err
+	}()
+
+	session, err := m.Client(clientConn)
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	defer session.Close()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream() error = %v", err)
+	}
+	hc, ok := stream.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("yamux stream doesn't implement CloseWrite")
+	}
+	io.WriteString(stream, "ping")
+	if err := hc.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite() error = %v", err)
+	}
+
+	reply, err := io.ReadAll(stream)
+	if err != nil || string(reply) != "pong" {
+		t.Errorf("read %q, %v after CloseWrite, want %q", reply, err, "pong")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("server side error = %v", err)
+	}
+}
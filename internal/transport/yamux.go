@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// YamuxName is the preface name of the yamux muxer.
+const YamuxName = "yamux"
+
+// Yamux is a Muxer backed by hashicorp/yamux.
+type Yamux struct {
+	// Config is the yamux configuration (nil = yamux defaults)
+	Config *yamux.Config
+}
+
+// Name returns "yamux".
+func (y *Yamux) Name() string {
+	return YamuxName
+}
+
+// Client creates the client side of a yamux session.
+func (y *Yamux) Client(conn net.Conn) (Session, error) {
+	session, err := yamux.Client(conn, y.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	return &yamuxSession{session}, nil
+}
+
+// Server creates the server side of a yamux session.
+func (y *Yamux) Server(conn net.Conn) (Session, error) {
+	session, err := yamux.Server(conn, y.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	return &yamuxSession{session}, nil
+}
+
+// yamuxSession adapts *yamux.Session to Session.
+type yamuxSession struct {
+	*yamux.Session
+}
+
+func (s *yamuxSession) OpenStream() (Stream, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{stream}, nil
+}
+
+func (s *yamuxSession) AcceptStream() (Stream, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{stream}, nil
+}
+
+// yamuxStream adapts *yamux.Stream to Stream.
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+// CloseWrite sends FIN while leaving the stream readable, which is what
+// yamux's Close does, so proxies can half-close streams like TCP
+// connections.
+func (s yamuxStream) CloseWrite() error {
+	return s.Stream.Close()
+}
@@ -2,20 +2,24 @@ package test
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/protocol"
 	"github.com/bc183/otun/internal/server"
 )
 
@@ -68,6 +72,16 @@ func waitForPort(addr string, timeout time.Duration) error {
 	return fmt.Errorf("timeout waiting for %s", addr)
 }
 
+// waitForTunnel waits for a client to finish registering its tunnel.
+func waitForTunnel(t *testing.T, cli *client.Client, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-cli.Ready():
+	case <-time.After(timeout):
+		t.Fatalf("tunnel not registered within %v", timeout)
+	}
+}
+
 // makeRequest makes an HTTP request with the specified Host header.
 // We disable keep-alive to ensure each request gets a fresh TCP connection,
 // which matches real-world behavior where different hostnames (subdomains)
@@ -127,8 +141,7 @@ func TestTunnelIntegration(t *testing.T) {
 		}
 	}()
 
-	// Give client time to connect and register
-	time.Sleep(500 * time.Millisecond)
+	waitForTunnel(t, cli, 2*time.Second)
 	t.Log("Tunnel client started")
 
 	t.Run("basic GET request", func(t *testing.T) {
@@ -321,8 +334,8 @@ func TestMultiClientRouting(t *testing.T) {
 		}
 	}()
 
-	// Give clients time to connect and register
-	time.Sleep(500 * time.Millisecond)
+	waitForTunnel(t, clientA, 2*time.Second)
+	waitForTunnel(t, clientB, 2*time.Second)
 	t.Log("Tunnel clients started")
 
 	t.Run("route to client A", func(t *testing.T) {
@@ -463,7 +476,7 @@ func TestClientGracefulShutdown(t *testing.T) {
 	}()
 
 	// Wait for client to connect
-	time.Sleep(500 * time.Millisecond)
+	waitForTunnel(t, cli, 2*time.Second)
 
 	// Verify tunnel works
 	resp, err := makeRequest("GET", "http://"+publicAddr+"/", hostHeader, nil)
@@ -539,7 +552,7 @@ func TestClientReconnection(t *testing.T) {
 	}
 
 	// Wait for client to eventually connect
-	time.Sleep(1 * time.Second)
+	waitForTunnel(t, cli, 3*time.Second)
 
 	// Verify tunnel works after client reconnected to newly started server
 	resp, err := makeRequest("GET", "http://"+publicAddr+"/", hostHeader, nil)
@@ -708,7 +721,7 @@ func TestAuthenticationSuccess(t *testing.T) {
 	}()
 
 	// Wait for client to connect
-	time.Sleep(500 * time.Millisecond)
+	waitForTunnel(t, cli, 2*time.Second)
 
 	// Verify tunnel works
 	resp, err := makeRequest("GET", "http://"+publicAddr+"/", hostHeader, nil)
@@ -813,7 +826,7 @@ func TestAuthenticationWithMultipleKeys(t *testing.T) {
 			}()
 
 			// Wait for connection
-			time.Sleep(300 * time.Millisecond)
+			waitForTunnel(t, cli, 2*time.Second)
 
 			// Verify tunnel works
 			resp, err := makeRequest("GET", "http://"+publicAddr+"/identity", hostHeader, nil)
@@ -973,3 +986,211 @@ subdomain: wrongsubdomain
 		t.Errorf("unexpected response: %s", body)
 	}
 }
+
+func TestForwardMode(t *testing.T) {
+	localAddr := "127.0.0.1:26000"
+	controlAddr := "127.0.0.1:26443"
+	publicAddr := "127.0.0.1:26080"
+	forwardAddr := "127.0.0.1:26001"
+	subdomain := "fwdtarget"
+
+	// Start local HTTP server behind the target tunnel
+	localServer := startLocalServer(t, localAddr, "forward-target")
+	defer localServer.Close()
+
+	if err := waitForPort(localAddr, 2*time.Second); err != nil {
+		t.Fatalf("local server not ready: %v", err)
+	}
+
+	// Start tunnel server with auth
+	srv := server.New(controlAddr, "", publicAddr, "", "", []string{"fwd-key"})
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+
+	if err := waitForPort(controlAddr, 2*time.Second); err != nil {
+		t.Fatalf("tunnel server not ready: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Target tunnel
+	target := client.New(controlAddr, localAddr).WithSubdomain(subdomain).WithToken("fwd-key")
+	go target.Run(ctx)
+	waitForTunnel(t, target, 2*time.Second)
+
+	t.Run("forward to unknown tunnel fails", func(t *testing.T) {
+		fwd := client.New(controlAddr, forwardAddr).WithToken("fwd-key")
+		err := fwd.Forward(ctx, "missing")
+		if err == nil || !strings.Contains(err.Error(), "no tunnel found") {
+			t.Errorf("expected 'no tunnel found' error, got: %v", err)
+		}
+	})
+
+	t.Run("forward without valid token fails", func(t *testing.T) {
+		fwd := client.New(controlAddr, forwardAddr).WithToken("wrong-key")
+		err := fwd.Forward(ctx, subdomain)
+		if err == nil || !strings.Contains(err.Error(), "invalid or missing API key") {
+			t.Errorf("expected auth error, got: %v", err)
+		}
+	})
+
+	t.Run("forwarded requests reach the target service", func(t *testing.T) {
+		fwdCtx, fwdCancel := context.WithCancel(ctx)
+		fwd := client.New(controlAddr, forwardAddr).WithToken("fwd-key")
+		fwdDone := make(chan error, 1)
+		go func() {
+			fwdDone <- fwd.Forward(fwdCtx, subdomain)
+		}()
+
+		if err := waitForPort(forwardAddr, 2*time.Second); err != nil {
+			t.Fatalf("forward listener not ready: %v", err)
+		}
+
+		resp, err := makeRequest("GET", "http://"+forwardAddr+"/identity", forwardAddr, nil)
+		if err != nil {
+			t.Fatalf("request through forward failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "forward-target" {
+			t.Errorf("expected 'forward-target', got %q", body)
+		}
+
+		fwdCancel()
+		select {
+		case err := <-fwdDone:
+			if err != client.ErrShutdown {
+				t.Errorf("expected ErrShutdown, got: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("forward did not shut down within timeout")
+		}
+	})
+}
+
+func TestTakeoverSameToken(t *testing.T) {
+	localAddrOld := "127.0.0.1:27000"
+	localAddrNew := "127.0.0.1:27001"
+	controlAddr := "127.0.0.1:27443"
+	publicAddr := "127.0.0.1:27080"
+	subdomain := "takeover"
+	hostHeader := subdomain + ".tunnel.localhost:27080"
+
+	oldServer := startLocalServer(t, localAddrOld, "old-client")
+	defer oldServer.Close()
+	newServer := startLocalServer(t, localAddrNew, "new-client")
+	defer newServer.Close()
+
+	srv := server.New(controlAddr, "", publicAddr, "", "", []string{"key-a", "key-b"}).
+		WithTakeoverPolicy(server.TakeoverSameToken)
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+
+	if err := waitForPort(controlAddr, 2*time.Second); err != nil {
+		t.Fatalf("tunnel server not ready: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stale client holds the subdomain
+	oldClient := client.New(controlAddr, localAddrOld).WithSubdomain(subdomain).WithToken("key-a")
+	oldDone := make(chan error, 1)
+	go func() {
+		oldDone <- oldClient.RunWithReconnect(ctx)
+	}()
+	waitForTunnel(t, oldClient, 2*time.Second)
+
+	// A different token can't take over
+	intruder := client.New(controlAddr, localAddrNew).WithSubdomain(subdomain).WithToken("key-b")
+	if err := intruder.Run(ctx); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("expected 'already in use' for different token, got: %v", err)
+	}
+
+	// The same token evicts the stale session
+	newClient := client.New(controlAddr, localAddrNew).WithSubdomain(subdomain).WithToken("key-a")
+	go newClient.Run(ctx)
+	waitForTunnel(t, newClient, 2*time.Second)
+
+	// The evicted client stops instead of fighting for the subdomain
+	select {
+	case err := <-oldDone:
+		if !errors.Is(err, client.ErrPermanentFailure) {
+			t.Errorf("expected ErrPermanentFailure for evicted client, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("evicted client did not stop")
+	}
+
+	resp, err := makeRequest("GET", "http://"+publicAddr+"/identity", hostHeader, nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "new-client" {
+		t.Errorf("expected request routed to new client, got %q", body)
+	}
+}
+
+func TestOwnerKeyIntegration(t *testing.T) {
+	localAddr := "127.0.0.1:28000"
+	controlAddr := "127.0.0.1:28443"
+	publicAddr := "127.0.0.1:28080"
+	subdomain := "owned"
+
+	localServer := startLocalServer(t, localAddr, "owner")
+	defer localServer.Close()
+
+	srv := server.New(controlAddr, "", publicAddr, "", "", nil).
+		WithOwnerKeyStore(filepath.Join(t.TempDir(), "owner-keys.json"))
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+
+	if err := waitForPort(controlAddr, 2*time.Second); err != nil {
+		t.Fatalf("tunnel server not ready: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, ownerKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	// The first claim binds the subdomain to the owner's key
+	owner := client.New(controlAddr, localAddr).WithSubdomain(subdomain).WithOwnerKey(ownerKey).WithReconnect(false)
+	ownerCtx, stopOwner := context.WithCancel(ctx)
+	ownerDone := make(chan error, 1)
+	go func() { ownerDone <- owner.Run(ownerCtx) }()
+	waitForTunnel(t, owner, 2*time.Second)
+	stopOwner()
+	owner.Close()
+	<-ownerDone
+
+	// Once the owner is gone, neither a keyless client nor another key can
+	// take the subdomain
+	for name, c := range map[string]*client.Client{
+		"no key":    client.New(controlAddr, localAddr).WithSubdomain(subdomain),
+		"other key": client.New(controlAddr, localAddr).WithSubdomain(subdomain).WithOwnerKey(otherKey),
+	} {
+		err := c.Run(ctx)
+		if e := client.AsError(err); e == nil || e.Code != protocol.ErrCodeOwnerKeyMismatch {
+			t.Errorf("%s: expected %s, got: %v", name, protocol.ErrCodeOwnerKeyMismatch, err)
+		}
+	}
+
+	// The owner's key gets it back
+	returning := client.New(controlAddr, localAddr).WithSubdomain(subdomain).WithOwnerKey(ownerKey)
+	go returning.Run(ctx)
+	waitForTunnel(t, returning, 2*time.Second)
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/server"
+)
+
+func TestTunnelsOverOneConnection(t *testing.T) {
+	webAddr := "127.0.0.1:30000"
+	apiAddr := "127.0.0.1:30001"
+	controlAddr := "127.0.0.1:30443"
+	publicAddr := "127.0.0.1:30080"
+
+	web := startLocalServer(t, webAddr, "web")
+	defer web.Close()
+	api := startLocalServer(t, apiAddr, "api")
+	defer api.Close()
+
+	srv := server.New(controlAddr, "", publicAddr, "", "", nil)
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	if err := waitForPort(controlAddr, 2*time.Second); err != nil {
+		t.Fatalf("tunnel server not ready: %v", err)
+	}
+
+	apiTunnel := client.New(controlAddr, apiAddr).WithSubdomain("api")
+	cli := client.New(controlAddr, webAddr).
+		WithSubdomain("web").
+		WithTunnel(apiTunnel)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- cli.Run(ctx) }()
+	waitForTunnel(t, cli, 5*time.Second)
+	waitForTunnel(t, apiTunnel, 5*time.Second)
+
+	if st := apiTunnel.Status(); st.State != client.StateConnected || st.Subdomain != "api" {
+		t.Errorf("second tunnel's status = %+v", st)
+	}
+
+	get := func(host string) (int, string) {
+		t.Helper()
+		resp, err := makeRequest("GET", "http://"+publicAddr+"/identity", host+".tunnel.localhost:30080", nil)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", host, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// Each subdomain reaches its own local service, repeatedly, so streams
+	// of both tunnels interleave on the connection
+	for range 3 {
+		for _, name := range []string{"web", "api"} {
+			if status, body := get(name); status != http.StatusOK || body != name {
+				t.Fatalf("GET %s = %d %q, want 200 %q", name, status, body, name)
+			}
+		}
+	}
+
+	// Both tunnels end with the connection
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't stop")
+	}
+	if st := apiTunnel.Status(); st.State != client.StateStopped {
+		t.Errorf("second tunnel's state after stop = %v", st.State)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status, _ := get("api")
+		if status == http.StatusNotFound || status == http.StatusBadGateway {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET api after stop = %d", status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,220 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bc183/otun/internal/client"
+	"github.com/bc183/otun/internal/server"
+)
+
+// WebSocket opcodes used by the tests (RFC 6455, section 5.2).
+const (
+	wsText   = 0x1
+	wsBinary = 0x2
+	wsClose  = 0x8
+)
+
+// wsAccept returns the Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWSFrame writes payload as a single final frame. Clients must mask
+// their frames; servers must not.
+func writeWSFrame(w io.Writer, opcode byte, payload []byte, mask bool) error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if mask {
+		header[1] |= 0x80
+		key := [4]byte{0x12, 0x34, 0x56, 0x78}
+		header = append(header, key[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ key[i%4]
+		}
+		payload = masked
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readWSFrame reads a single unfragmented frame, unmasking its payload.
+func readWSFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("fragmented frames are not supported")
+	}
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var key [4]byte
+	masked := header[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// startWebSocketEcho starts a local service whose /ws endpoint echoes
+// WebSocket messages until the client closes.
+func startWebSocketEcho(t *testing.T, addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+		rw.Flush()
+		for {
+			opcode, payload, err := readWSFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			if err := writeWSFrame(conn, opcode, payload, false); err != nil || opcode == wsClose {
+				return
+			}
+		}
+	})
+
+	srv := &http.Server{Handler: mux}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	go srv.Serve(ln)
+	return srv
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	localAddr := "127.0.0.1:29000"
+	controlAddr := "127.0.0.1:29443"
+	publicAddr := "127.0.0.1:29080"
+	hostHeader := "ws.tunnel.localhost:29080"
+
+	local := startWebSocketEcho(t, localAddr)
+	defer local.Close()
+
+	// Upgraded connections are exempt from the request duration and
+	// response size limits, which this session exceeds
+	srv := server.New(controlAddr, "", publicAddr, "", "", nil).
+		WithMaxRequestDuration(300 * time.Millisecond).
+		WithMaxResponseSize(1024)
+	go func() {
+		if err := srv.Run(); err != nil {
+			t.Logf("server error: %v", err)
+		}
+	}()
+	if err := waitForPort(controlAddr, 2*time.Second); err != nil {
+		t.Fatalf("tunnel server not ready: %v", err)
+	}
+
+	// Deny paths peek at each request before it is proxied
+	cli := client.New(controlAddr, localAddr).
+		WithSubdomain("ws").
+		WithDenyPaths(client.DefaultDenyPaths)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cli.Run(ctx)
+	waitForTunnel(t, cli, 5*time.Second)
+
+	conn, err := net.Dial("tcp", publicAddr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", hostHeader, key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" { // RFC 6455, section 1.3
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	echo := func(opcode byte, payload []byte) {
+		t.Helper()
+		if err := writeWSFrame(conn, opcode, payload, true); err != nil {
+			t.Fatalf("failed to send frame: %v", err)
+		}
+		gotOp, got, err := readWSFrame(br)
+		if err != nil {
+			t.Fatalf("failed to read echo: %v", err)
+		}
+		if gotOp != opcode || !bytes.Equal(got, payload) {
+			t.Fatalf("echo = opcode %d, %d bytes; want opcode %d, %d bytes", gotOp, len(got), opcode, len(payload))
+		}
+	}
+
+	echo(wsText, []byte("hello"))
+	echo(wsBinary, bytes.Repeat([]byte{0xAB}, 64*1024))
+	time.Sleep(500 * time.Millisecond) // past the maximum request duration
+	echo(wsText, []byte("still here"))
+	echo(wsClose, []byte{0x03, 0xE8}) // 1000, normal closure
+
+	// The tunnel closes the connection once the local service has
+	if rest, err := io.ReadAll(br); err != nil || len(rest) != 0 {
+		t.Errorf("after close: read %d bytes, %v; want EOF", len(rest), err)
+	}
+}